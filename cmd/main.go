@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net/http"
@@ -11,15 +13,28 @@ import (
 
 	"github.com/harshavmb/nannyapi/docs"
 	"github.com/harshavmb/nannyapi/internal/agent"
+	"github.com/harshavmb/nannyapi/internal/alert"
 	"github.com/harshavmb/nannyapi/internal/auth"
+	"github.com/harshavmb/nannyapi/internal/campaign"
+	"github.com/harshavmb/nannyapi/internal/connection"
+	"github.com/harshavmb/nannyapi/internal/decommission"
 	"github.com/harshavmb/nannyapi/internal/diagnostic"
+	"github.com/harshavmb/nannyapi/internal/job"
+	"github.com/harshavmb/nannyapi/internal/merge"
+	"github.com/harshavmb/nannyapi/internal/metrics"
+	"github.com/harshavmb/nannyapi/internal/notification"
+	"github.com/harshavmb/nannyapi/internal/org"
+	"github.com/harshavmb/nannyapi/internal/pki"
 	"github.com/harshavmb/nannyapi/internal/server"
 	"github.com/harshavmb/nannyapi/internal/token"
 	"github.com/harshavmb/nannyapi/internal/user"
 	"github.com/harshavmb/nannyapi/pkg/database"
 )
 
-const defaultPort = "8080"
+const (
+	defaultPort         = "8080"
+	digestCheckInterval = 15 * time.Minute
+)
 
 //	@contact.name	API Support
 //	@contact.url	https://nannyai.dev/support
@@ -44,11 +59,24 @@ func main() {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
 
-	// Check if NANNY_ENCRYPTION_KEY is present in env vars
-	if os.Getenv("NANNY_ENCRYPTION_KEY") == "" {
-		log.Fatalf("NANNY_ENCRYPTION_KEY not set")
+	// Secrets stored in the database are encrypted with data keys wrapped by the master keys of the key source
+	keySource, err := token.KeySourceFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid encryption key configuration: %v", err)
 	}
-	nannyEncryptionKey := os.Getenv("NANNY_ENCRYPTION_KEY")
+	if len(os.Args) > 1 && os.Args[1] == "rotate-encryption-key" {
+		kms, ok := keySource.(*token.LocalKMS)
+		if !ok {
+			log.Fatalf("Only the %s key source rotates its keys, add a new key to the others instead", token.KeySourceLocalKMS)
+		}
+		keyID, err := kms.Rotate()
+		if err != nil {
+			log.Fatalf("Failed to rotate encryption key: %v", err)
+		}
+		fmt.Printf("New master key %s is active, secrets are re-encrypted in the background\n", keyID)
+		return
+	}
+	envelope := token.NewEnvelope(keySource)
 
 	// Check if JWT_SECRET is present in env vars
 	if os.Getenv("JWT_SECRET") == "" {
@@ -73,13 +101,196 @@ func main() {
 	agentInfoRepo := agent.NewAgentInfoRepository(mongoDB)
 	tokenRepo := token.NewTokenRepository(mongoDB)
 	refreshTokenRepo := token.NewRefreshTokenRepository(mongoDB)
+	signingKeyRepo := token.NewSigningKeyRepository(mongoDB)
 	diagnosticRepo := diagnostic.NewDiagnosticRepository(mongoDB)
+	preferencesRepo := notification.NewPreferencesRepository(mongoDB)
+	metricsRepo := metrics.NewMetricsRepository(mongoDB)
+	changePolicyRepo := agent.NewChangePolicyRepository(mongoDB)
+	alertRepo := alert.NewAlertRepository(mongoDB)
+	alertRuleRepo := alert.NewRuleRepository(mongoDB)
+	alertBaselineRepo := alert.NewBaselineRepository(mongoDB)
+	groupRepo := agent.NewGroupRepository(mongoDB)
+	campaignRepo := campaign.NewCampaignRepository(mongoDB)
+	jobRepo := job.NewJobRepository(mongoDB)
+	enrollmentRepo := agent.NewEnrollmentRepository(mongoDB)
+	certificateRepo := pki.NewCertificateRepository(mongoDB)
+	orgRepo := org.NewOrgRepository(mongoDB)
 
 	userService := user.NewUserService(userRepo)
+	orgService := org.NewOrgService(orgRepo, userService)
 	tokenService := token.NewTokenService(tokenRepo)
+	rotationConfig, err := token.RotationConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid token rotation configuration: %v", err)
+	}
+	tokenService.SetRotationConfig(rotationConfig)
 	refreshTokenService := token.NewRefreshTokenService(refreshTokenRepo)
+
+	// Access and refresh tokens are signed by a keyring shared by all instances. Tokens signed with
+	// JWT_SECRET before the keyring existed stay valid until they expire, for at most a week.
+	keyringConfig, err := token.KeyringConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid JWT signing configuration: %v", err)
+	}
+	keys := token.NewKeyring(signingKeyRepo, keyringConfig, envelope, jwtSecret)
+	if err := keys.Load(context.Background()); err != nil {
+		log.Fatalf("Failed to load JWT signing keys: %v", err)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "rotate-signing-key" {
+		key, err := keys.Rotate(context.Background())
+		if err != nil {
+			log.Fatalf("Failed to rotate JWT signing key: %v", err)
+		}
+		fmt.Printf("New %s signing key %s is active\n", key.Algorithm, key.ID)
+		return
+	}
+	keys.StartRefresher(context.Background())
+
+	// Move secrets encrypted under previous master keys, or before envelope encryption, to the active key
+	reencryptionConfig, err := token.ReencryptionConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid re-encryption configuration: %v", err)
+	}
+	reencryptor := token.NewReencryptor(envelope, reencryptionConfig,
+		tokenRepo.EncryptedField(),
+		refreshTokenRepo.EncryptedField(),
+		signingKeyRepo.EncryptedField(),
+		enrollmentRepo.EncryptedField(),
+		certificateRepo.EncryptedField(),
+	)
+	if len(os.Args) > 1 && os.Args[1] == "reencrypt-secrets" {
+		moved, err := reencryptor.Run(context.Background())
+		if err != nil {
+			log.Fatalf("Failed to re-encrypt secrets: %v", err)
+		}
+		fmt.Printf("Re-encrypted %d secrets with master key %s\n", moved, envelope.ActiveKeyID())
+		return
+	}
+	reencryptor.Start(context.Background())
+
+	// Agents, tokens and sessions belong to organisations. Every user gets a personal organisation with the
+	// ID of the user, which owns what the user created before organisations were added.
+	migrated, err := orgService.MigratePersonalOrganisations(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to migrate users to personal organisations: %v", err)
+	}
+	if migrated > 0 {
+		log.Printf("Created %d personal organisations", migrated)
+	}
+
 	agentService := agent.NewAgentInfoService(agentInfoRepo)
+	groupService := agent.NewGroupService(groupRepo)
+	// Nonces of signed agent requests are recorded in the database, so a request cannot be replayed on
+	// another instance
+	requestNonces := database.NewNonceRepository(mongoDB, "request_nonces")
+	if err := requestNonces.EnsureIndexes(context.Background()); err != nil {
+		log.Fatalf("Failed to prepare request nonces: %v", err)
+	}
+	enrollmentService := agent.NewEnrollmentService(enrollmentRepo, agentService, envelope, requestNonces)
+
+	// Internal CA issuing client certificates to agents that enroll with a CSR
+	certificateConfig, err := pki.ConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid agent certificate configuration: %v", err)
+	}
+	authority, err := pki.LoadAuthority(context.Background(), certificateRepo, envelope)
+	if err != nil {
+		log.Fatalf("Failed to load agent certificate authority: %v", err)
+	}
+	certificateService := pki.NewCertificateService(certificateRepo, authority, agentService, certificateConfig)
+	enrollmentService.SetCertificateIssuer(certificateService)
+
+	// Agents may sign requests with their credential instead of sending it
+	signatureSkew, err := agent.SignatureSkewFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid request signing configuration: %v", err)
+	}
+	enrollmentService.SetSignatureSkew(signatureSkew)
+
+	// Track agent liveness from heartbeats
+	agentStatusConfig, err := agent.StatusConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid agent status configuration: %v", err)
+	}
+	agentService.StartStatusMonitor(context.Background(), agentStatusConfig)
+
+	// Keep the metric history of agents in a time-series collection
+	metricsRetention, err := metrics.RetentionFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid metrics configuration: %v", err)
+	}
+	if err := metricsRepo.EnsureCollection(context.Background(), metricsRetention); err != nil {
+		log.Fatalf("Failed to set up metrics collection: %v", err)
+	}
+	metricsService := metrics.NewMetricsService(metricsRepo)
+	agentService.OnMetricsReported(metricsService.RecordSample)
+
 	diagnosticService := diagnostic.NewDiagnosticService(os.Getenv("DEEPSEEK_API_KEY"), diagnosticRepo, agentService)
+	diagnosticService.SetTrendProvider(metricsService)
+	changePolicyService := agent.NewChangePolicyService(changePolicyRepo)
+	changePolicyService.SetGroupResolver(groupService.GroupsFor)
+	diagnosticService.SetChangePolicy(changePolicyService)
+
+	// Queue work for agents, including the commands of sessions started by alerts and campaigns
+	jobConfig, err := job.ConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid job configuration: %v", err)
+	}
+	jobService := job.NewJobService(jobRepo, diagnosticService, agentService, jobConfig)
+
+	// Push jobs to agents connected over WebSocket
+	connectionConfig, err := connection.ConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid agent connection configuration: %v", err)
+	}
+	connections := connection.NewHub(jobService, agentService, connectionConfig)
+
+	// Evaluate every metrics report against the anomaly rules
+	alertConfig, err := alert.ConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid alert configuration: %v", err)
+	}
+	alertService := alert.NewAlertService(alertRepo, alertRuleRepo, alertBaselineRepo, alertConfig)
+	alertService.SetSessionStarter(jobService)
+	alertService.SetGroupResolver(groupService.GroupsFor)
+	agentService.OnMetricsReported(alertService.Evaluate)
+
+	// Run fleet-wide diagnostic campaigns
+	campaignConfig, err := campaign.ConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid campaign configuration: %v", err)
+	}
+	campaignService := campaign.NewCampaignService(campaignRepo, jobService, agentService, groupService, campaignConfig)
+	campaignService.StartScheduler(context.Background())
+
+	// Retire agents, archiving or deleting their data
+	decommissionConfig, err := decommission.ConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid decommission configuration: %v", err)
+	}
+	decommissionService := decommission.NewDecommissionService(agentService, enrollmentService, certificateService, tokenService, jobService, diagnosticService, metricsService, decommissionConfig)
+	decommissionService.StartPurger(context.Background())
+	mergeService := merge.NewMergeService(agentService, enrollmentService, certificateService, jobService, diagnosticService, metricsService, alertService)
+
+	// Email notifications are only sent when SMTP_HOST is set
+	smtpConfig, err := notification.SMTPConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid SMTP configuration: %v", err)
+	}
+	var notifier notification.Notifier
+	if smtpConfig != nil {
+		notifier = notification.NewSMTPNotifier(*smtpConfig)
+	}
+	notificationService := notification.NewNotificationService(preferencesRepo, notifier, userService, agentService, diagnosticService)
+	notificationService.SetGroupResolver(groupService.GroupsFor)
+	notificationService.SetOrgResolver(orgService)
+	diagnosticService.SetNotifier(notificationService)
+	notificationService.StartDigestScheduler(context.Background(), digestCheckInterval)
+	// Owners of rotated tokens are told before the previous secret stops working
+	if notifier != nil {
+		tokenService.SetGraceNotifier(notificationService.NotifyTokenGraceEnding)
+	}
+	tokenService.StartGraceNotifier(context.Background())
 
 	// Initialize GitHub OAuth
 	githubClientID := os.Getenv("GH_CLIENT_ID")
@@ -89,25 +300,51 @@ func main() {
 	if githubRedirectURL == "" {
 		githubRedirectURL = fmt.Sprintf("http://localhost:%s/github/callback", port)
 	}
-	githubAuth := auth.NewGitHubAuth(githubClientID, githubClientSecret, githubRedirectURL, userService, refreshTokenService, nannyEncryptionKey, jwtSecret, frontendHost)
+	// Completed logins are recorded in the database, so a callback cannot be replayed on another instance
+	loginNonces := database.NewNonceRepository(mongoDB, "login_nonces")
+	if err := loginNonces.EnsureIndexes(context.Background()); err != nil {
+		log.Fatalf("Failed to prepare login nonces: %v", err)
+	}
+	githubAuth := auth.NewGitHubAuth(githubClientID, githubClientSecret, githubRedirectURL, userService, refreshTokenService, envelope, jwtSecret, keys, frontendHost, loginNonces)
+
+	// OpenID Connect providers, e.g. company SSO, alongside GitHub
+	oidcProviders, err := auth.ProvidersFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid OIDC configuration: %v", err)
+	}
+	oidcAuth := auth.NewOIDCAuth(oidcProviders, userService, refreshTokenService, envelope, jwtSecret, keys, frontendHost, loginNonces)
 
 	// Create server with AI, database client
 	srv := server.NewServer(
 		githubAuth,
+		oidcAuth,
 		userService,
 		agentService,
 		tokenService,
 		refreshTokenService,
 		diagnosticService,
-		jwtSecret,
-		nannyEncryptionKey,
+		notificationService,
+		metricsService,
+		changePolicyService,
+		alertService,
+		groupService,
+		campaignService,
+		jobService,
+		connections,
+		enrollmentService,
+		certificateService,
+		decommissionService,
+		mergeService,
+		orgService,
+		keys,
+		envelope,
 	)
 
 	// Add CORS middleware handler.
 	c := cors.New(cors.Options{
 		AllowedOrigins:   []string{"http://localhost:8081", "https://nannyai.dev", "https://test.nannyai.dev"},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Access-Control-Allow-Origin", "Content-Type", "Authorization"},
+		AllowedHeaders:   []string{"Access-Control-Allow-Origin", "Content-Type", "Authorization", server.OrgHeader},
 		AllowCredentials: true,
 	})
 	handler := c.Handler(srv)
@@ -124,6 +361,25 @@ func main() {
 		ReadHeaderTimeout: 3 * time.Second,
 	}
 
+	// Serve TLS when a server certificate is configured, verifying agent client certificates against the internal CA
+	tlsCertFile := os.Getenv("TLS_CERT_PATH")
+	tlsKeyFile := os.Getenv("TLS_KEY_PATH")
+	if tlsCertFile != "" || tlsKeyFile != "" {
+		if tlsCertFile == "" || tlsKeyFile == "" {
+			log.Fatalf("TLS_CERT_PATH and TLS_KEY_PATH must be set together")
+		}
+		httpServer.TLSConfig = &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			ClientAuth: tls.VerifyClientCertIfGiven,
+			ClientCAs:  authority.CertPool(),
+		}
+		log.Printf("Starting TLS server on port %s...", port)
+		if err := httpServer.ListenAndServeTLS(tlsCertFile, tlsKeyFile); err != nil {
+			log.Fatalf("Failed to start server: %v", err)
+		}
+		return
+	}
+
 	log.Printf("Starting server on port %s...", port)
 	if err := httpServer.ListenAndServe(); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
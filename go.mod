@@ -6,6 +6,7 @@ toolchain go1.24.2
 
 require (
 	github.com/golang-jwt/jwt v3.2.2+incompatible
+	github.com/gorilla/websocket v1.5.3
 	github.com/sashabaranov/go-openai v1.38.1
 	github.com/stretchr/testify v1.10.0
 	github.com/swaggo/swag v1.16.4
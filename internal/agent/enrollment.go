@@ -0,0 +1,355 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+
+	"github.com/harshavmb/nannyapi/internal/token"
+)
+
+const (
+	// CredentialPrefix starts every agent credential, so the API can tell them apart from user keys.
+	CredentialPrefix      = "nagent_"
+	enrollmentTokenPrefix = "nenroll_"
+	secretLength          = 40
+	defaultEnrollmentTTL  = time.Hour
+	maxEnrollmentTTL      = 24 * time.Hour
+	// credentialUseInterval throttles how often the last use of a credential is recorded.
+	credentialUseInterval = time.Minute
+)
+
+// EnrollmentToken lets one new agent register itself for the user who created the token. It can be used
+// once, before it expires.
+type EnrollmentToken struct {
+	ID          bson.ObjectID     `json:"id" bson:"_id,omitempty"`
+	UserID      string            `json:"user_id" bson:"user_id"`   // Owning organisation, which is the user ID for personal organisations
+	Token       string            `json:"token,omitempty" bson:"-"` // Only returned when the token is created
+	HashedToken string            `json:"-" bson:"hashed_token"`
+	Labels      map[string]string `json:"labels,omitempty" bson:"labels,omitempty"`     // Applied to the agent that enrolls
+	AgentID     string            `json:"agent_id,omitempty" bson:"agent_id,omitempty"` // Agent that used the token
+	ExpiresAt   time.Time         `json:"expires_at" bson:"expires_at"`
+	UsedAt      *time.Time        `json:"used_at,omitempty" bson:"used_at,omitempty"`
+	CreatedAt   time.Time         `json:"created_at" bson:"created_at"`
+}
+
+// CreateEnrollmentTokenRequest creates an enrollment token.
+type CreateEnrollmentTokenRequest struct {
+	TTL    string            `json:"ttl,omitempty"` // How long the token can be used, e.g. 15m (default 1h, at most 24h)
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// EnrollRequest is sent by an agent to trade an enrollment token for its own credential, or for a client
+// certificate when it sends a CSR. An agent that enrolls again passes its ID in the agent info.
+type EnrollRequest struct {
+	EnrollmentToken string    `json:"enrollment_token"`
+	Agent           AgentInfo `json:"agent"`
+	CSR             string    `json:"csr,omitempty"` // PEM certificate signing request
+}
+
+// EnrollResponse holds the identity of an enrolled agent. The credential is only returned once.
+type EnrollResponse struct {
+	AgentID      string             `json:"agent_id"`
+	Credential   string             `json:"credential,omitempty"`
+	CredentialID string             `json:"credential_id,omitempty"` // Key ID of requests signed with the credential
+	Certificate  *IssuedCertificate `json:"certificate,omitempty"`
+}
+
+// IssuedCertificate is a client certificate issued to an agent.
+type IssuedCertificate struct {
+	ID            string    `json:"id"`
+	Certificate   string    `json:"certificate"`    // PEM encoded
+	CACertificate string    `json:"ca_certificate"` // PEM encoded certificate of the issuing CA
+	NotAfter      time.Time `json:"not_after"`
+	RenewAfter    time.Time `json:"renew_after"` // When the agent should rotate the certificate
+}
+
+// CertificateIssuer issues client certificates to agents that enroll with a CSR.
+type CertificateIssuer interface {
+	CheckCSR(csrPEM string) error
+	IssueCertificate(ctx context.Context, csrPEM, agentID, userID string) (*IssuedCertificate, error)
+}
+
+// Credential authenticates a single agent, on the agent endpoints only.
+type Credential struct {
+	ID                  bson.ObjectID `json:"id" bson:"_id,omitempty"`
+	AgentID             string        `json:"agent_id" bson:"agent_id"`
+	UserID              string        `json:"user_id" bson:"user_id"` // Owning organisation, which is the user ID for personal organisations
+	HashedCredential    string        `json:"-" bson:"hashed_credential"`
+	EncryptedCredential string        `json:"-" bson:"encrypted_credential,omitempty"` // Lets the server check requests signed with the credential
+	Hint                string        `json:"hint" bson:"hint"`                        // Last characters of the credential, to tell credentials apart
+	CreatedAt           time.Time     `json:"created_at" bson:"created_at"`
+	LastUsedAt          *time.Time    `json:"last_used_at,omitempty" bson:"last_used_at,omitempty"`
+	RevokedAt           *time.Time    `json:"revoked_at,omitempty" bson:"revoked_at,omitempty"`
+}
+
+// IsCredential reports whether an API key is an agent credential rather than a user key.
+func IsCredential(key string) bool {
+	return strings.HasPrefix(key, CredentialPrefix)
+}
+
+// newSecret returns a random secret with the prefix.
+func newSecret(prefix string) (string, error) {
+	random := token.GenerateRandomString(secretLength)
+	if random == "" {
+		return "", fmt.Errorf("failed to generate secret")
+	}
+	return prefix + random, nil
+}
+
+// enrollmentTTL returns how long a requested enrollment token stays valid.
+func enrollmentTTL(req *CreateEnrollmentTokenRequest) (time.Duration, error) {
+	if req.TTL == "" {
+		return defaultEnrollmentTTL, nil
+	}
+	ttl, err := time.ParseDuration(req.TTL)
+	if err != nil || ttl < time.Minute || ttl > maxEnrollmentTTL {
+		return 0, fmt.Errorf("invalid enrollment token: ttl %q must be a duration between 1m and %s", req.TTL, maxEnrollmentTTL)
+	}
+	return ttl, nil
+}
+
+// EnrollmentService enrolls agents and manages their credentials.
+type EnrollmentService struct {
+	repository    *EnrollmentRepository
+	agentService  *AgentInfoService
+	certificates  CertificateIssuer
+	envelope      *token.Envelope
+	signatureSkew time.Duration
+	nonces        NonceStore
+}
+
+func NewEnrollmentService(repository *EnrollmentRepository, agentService *AgentInfoService, envelope *token.Envelope, nonces NonceStore) *EnrollmentService {
+	return &EnrollmentService{
+		repository:    repository,
+		agentService:  agentService,
+		envelope:      envelope,
+		signatureSkew: defaultSignatureSkew,
+		nonces:        nonces,
+	}
+}
+
+// SetCertificateIssuer enables enrollment with a certificate signing request.
+func (s *EnrollmentService) SetCertificateIssuer(certificates CertificateIssuer) {
+	s.certificates = certificates
+}
+
+// CreateEnrollmentToken creates an enrollment token for the user. The returned token holds the secret,
+// which is not stored and cannot be retrieved again.
+func (s *EnrollmentService) CreateEnrollmentToken(ctx context.Context, userID string, req *CreateEnrollmentTokenRequest) (*EnrollmentToken, error) {
+	ttl, err := enrollmentTTL(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := ValidateLabels(req.Labels); err != nil {
+		return nil, err
+	}
+
+	secret, err := newSecret(enrollmentTokenPrefix)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	enrollment := &EnrollmentToken{
+		UserID:      userID,
+		HashedToken: token.HashToken(secret),
+		Labels:      req.Labels,
+		ExpiresAt:   now.Add(ttl),
+		CreatedAt:   now,
+	}
+	if err := s.repository.InsertEnrollmentToken(ctx, enrollment); err != nil {
+		return nil, err
+	}
+	enrollment.Token = secret
+	log.Printf("Enrollment token %s created by user %s", enrollment.ID.Hex(), userID)
+	return enrollment, nil
+}
+
+// ListEnrollmentTokens returns the enrollment tokens of the user, newest first.
+func (s *EnrollmentService) ListEnrollmentTokens(ctx context.Context, userID string) ([]*EnrollmentToken, error) {
+	return s.repository.ListEnrollmentTokens(ctx, userID)
+}
+
+// DeleteEnrollmentToken deletes an enrollment token of the user, so it can no longer be used.
+func (s *EnrollmentService) DeleteEnrollmentToken(ctx context.Context, id bson.ObjectID, userID string) error {
+	enrollment, err := s.repository.GetEnrollmentToken(ctx, id)
+	if err != nil {
+		return err
+	}
+	if enrollment == nil {
+		return fmt.Errorf("enrollment token not found")
+	}
+	if enrollment.UserID != userID {
+		return fmt.Errorf("enrollment token does not belong to user")
+	}
+	return s.repository.DeleteEnrollmentToken(ctx, id)
+}
+
+// Enroll uses up an enrollment token to register the agent for the token's user and issues the agent
+// its own credential, or a client certificate when the request holds a CSR.
+func (s *EnrollmentService) Enroll(ctx context.Context, req *EnrollRequest) (*EnrollResponse, error) {
+	if req.EnrollmentToken == "" {
+		return nil, fmt.Errorf("invalid enrollment token")
+	}
+	info := req.Agent
+	info.MachineID = NormalizeMachineID(info.MachineID)
+	if err := ValidateMachineID(info.MachineID); err != nil {
+		return nil, err
+	}
+
+	if req.CSR != "" {
+		if s.certificates == nil {
+			return nil, fmt.Errorf("invalid enrollment: certificate enrollment is not enabled")
+		}
+		if err := s.certificates.CheckCSR(req.CSR); err != nil {
+			return nil, err
+		}
+	}
+
+	// Check the agent before using up the token, so a bad request can be retried with the same token
+	var existing *AgentInfo
+	if !info.ID.IsZero() {
+		var err error
+		existing, err = s.agentService.GetAgentInfoByID(ctx, info.ID)
+		if err != nil {
+			return nil, err
+		}
+		if existing == nil {
+			return nil, fmt.Errorf("agent not found")
+		}
+	}
+
+	enrollment, err := s.repository.UseEnrollmentToken(ctx, token.HashToken(req.EnrollmentToken), time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if enrollment == nil {
+		return nil, fmt.Errorf("invalid enrollment token")
+	}
+	if existing != nil && existing.UserID != enrollment.UserID {
+		return nil, fmt.Errorf("agent does not belong to user")
+	}
+
+	info.UserID = enrollment.UserID
+	info.Labels = enrollment.Labels
+	result, err := s.agentService.SaveAgentInfo(ctx, info)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save agent info: %v", err)
+	}
+	agentID := result.InsertedID.(bson.ObjectID)
+	if err := s.repository.SetEnrollmentAgent(ctx, enrollment.ID, agentID.Hex()); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Agent %s enrolled with enrollment token %s", agentID.Hex(), enrollment.ID.Hex())
+	if req.CSR != "" {
+		certificate, err := s.certificates.IssueCertificate(ctx, req.CSR, agentID.Hex(), enrollment.UserID)
+		if err != nil {
+			return nil, err
+		}
+		return &EnrollResponse{AgentID: agentID.Hex(), Certificate: certificate}, nil
+	}
+
+	credential, secret, err := s.issueCredential(ctx, agentID.Hex(), enrollment.UserID)
+	if err != nil {
+		return nil, err
+	}
+	return &EnrollResponse{AgentID: agentID.Hex(), Credential: secret, CredentialID: credential.ID.Hex()}, nil
+}
+
+// issueCredential creates a credential for the agent and returns it with its secret.
+func (s *EnrollmentService) issueCredential(ctx context.Context, agentID, userID string) (*Credential, string, error) {
+	secret, err := newSecret(CredentialPrefix)
+	if err != nil {
+		return nil, "", err
+	}
+	// The ID is part of the additional data of the encrypted secret
+	id := bson.NewObjectID()
+	encrypted, err := s.envelope.Encrypt(secret, credentialAAD(id))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to encrypt credential: %v", err)
+	}
+	credential := &Credential{
+		ID:                  id,
+		AgentID:             agentID,
+		UserID:              userID,
+		HashedCredential:    token.HashToken(secret),
+		EncryptedCredential: encrypted,
+		Hint:                secret[len(secret)-4:],
+		CreatedAt:           time.Now(),
+	}
+	if err := s.repository.InsertCredential(ctx, credential); err != nil {
+		return nil, "", err
+	}
+	return credential, secret, nil
+}
+
+// Authenticate returns the credential matching the secret, unless it was revoked.
+func (s *EnrollmentService) Authenticate(ctx context.Context, secret string) (*Credential, error) {
+	credential, err := s.repository.GetCredentialByHash(ctx, token.HashToken(secret))
+	if err != nil {
+		return nil, err
+	}
+	if credential == nil || credential.RevokedAt != nil {
+		return nil, fmt.Errorf("invalid agent credential")
+	}
+	if err := s.repository.TouchCredential(ctx, credential.ID, time.Now(), credentialUseInterval); err != nil {
+		log.Printf("Failed to record use of credential %s: %v", credential.ID.Hex(), err)
+	}
+	return credential, nil
+}
+
+// ListCredentials returns the credentials of an agent of the user, including revoked ones.
+func (s *EnrollmentService) ListCredentials(ctx context.Context, agentID bson.ObjectID, userID string) ([]*Credential, error) {
+	agentInfo, err := s.agentService.GetAgentInfoByID(ctx, agentID)
+	if err != nil {
+		return nil, err
+	}
+	if agentInfo == nil {
+		return nil, fmt.Errorf("agent not found")
+	}
+	if agentInfo.UserID != userID {
+		return nil, fmt.Errorf("agent does not belong to user")
+	}
+	return s.repository.ListCredentials(ctx, agentID.Hex())
+}
+
+// RevokeCredential revokes a credential of the user. The other credentials of the agent keep working.
+func (s *EnrollmentService) RevokeCredential(ctx context.Context, id bson.ObjectID, userID string) (*Credential, error) {
+	credential, err := s.repository.GetCredential(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if credential == nil {
+		return nil, fmt.Errorf("credential not found")
+	}
+	if credential.UserID != userID {
+		return nil, fmt.Errorf("credential does not belong to user")
+	}
+	if credential.RevokedAt != nil {
+		return nil, fmt.Errorf("invalid credential transition: credential is already revoked")
+	}
+
+	now := time.Now()
+	if err := s.repository.RevokeCredential(ctx, id, now); err != nil {
+		return nil, err
+	}
+	credential.RevokedAt = &now
+	log.Printf("Credential %s of agent %s revoked by user %s", id.Hex(), credential.AgentID, userID)
+	return credential, nil
+}
+
+// RevokeAgentCredentials revokes every credential of an agent and returns how many were revoked.
+func (s *EnrollmentService) RevokeAgentCredentials(ctx context.Context, agentID string) (int64, error) {
+	return s.repository.RevokeAgentCredentials(ctx, agentID, time.Now())
+}
+
+// ReassignAgentCredentials moves the credentials of an agent to another agent of the same user and returns
+// how many were moved. Requests with them act as the other agent from then on.
+func (s *EnrollmentService) ReassignAgentCredentials(ctx context.Context, fromAgentID, toAgentID string) (int64, error) {
+	return s.repository.ReassignAgentCredentials(ctx, fromAgentID, toAgentID)
+}
@@ -0,0 +1,40 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnrollmentTTL(t *testing.T) {
+	ttl, err := enrollmentTTL(&CreateEnrollmentTokenRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, defaultEnrollmentTTL, ttl)
+
+	ttl, err = enrollmentTTL(&CreateEnrollmentTokenRequest{TTL: "15m"})
+	assert.NoError(t, err)
+	assert.Equal(t, 15*time.Minute, ttl)
+
+	for _, value := range []string{"30s", "25h", "soon"} {
+		_, err := enrollmentTTL(&CreateEnrollmentTokenRequest{TTL: value})
+		assert.ErrorContains(t, err, "invalid enrollment token", value)
+	}
+}
+
+func TestNewSecret(t *testing.T) {
+	credential, err := newSecret(CredentialPrefix)
+	assert.NoError(t, err)
+	assert.Len(t, credential, len(CredentialPrefix)+secretLength)
+	assert.True(t, IsCredential(credential))
+
+	enrollment, err := newSecret(enrollmentTokenPrefix)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(enrollment, enrollmentTokenPrefix))
+	assert.False(t, IsCredential(enrollment))
+
+	other, err := newSecret(CredentialPrefix)
+	assert.NoError(t, err)
+	assert.NotEqual(t, credential, other)
+}
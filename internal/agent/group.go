@@ -0,0 +1,159 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// Group names are used as keys of change policies, so they are limited to a safe character set.
+var groupNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{0,62}$`)
+
+// Group is a named set of agents defined by a label selector. Membership is evaluated against
+// the current labels of an agent, so agents join and leave groups as their labels change.
+type Group struct {
+	ID          bson.ObjectID `json:"id" bson:"_id,omitempty"`
+	UserID      string        `json:"user_id" bson:"user_id"` // Owning organisation, which is the user ID for personal organisations
+	Name        string        `json:"name" bson:"name"`
+	Description string        `json:"description,omitempty" bson:"description,omitempty"`
+	Selector    string        `json:"selector" bson:"selector"` // Label selector, e.g. env=prod,role=db
+	CreatedAt   time.Time     `json:"created_at" bson:"created_at"`
+	UpdatedAt   time.Time     `json:"updated_at" bson:"updated_at"`
+}
+
+// ValidateGroupName checks that a group name can be referenced by policies, alert rules and notifications.
+func ValidateGroupName(name string) error {
+	if !groupNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid group: name %q must be 1 to 63 letters, digits, '_' or '-' and start with a letter or digit", name)
+	}
+	return nil
+}
+
+// Validate checks the name and selector of the group.
+func (g *Group) Validate() error {
+	if err := ValidateGroupName(g.Name); err != nil {
+		return err
+	}
+	selector, err := ParseSelector(g.Selector)
+	if err != nil {
+		return fmt.Errorf("invalid group: %v", err)
+	}
+	if len(selector) == 0 {
+		return fmt.Errorf("invalid group: selector is required")
+	}
+	return nil
+}
+
+// GroupService manages the agent groups of users.
+type GroupService struct {
+	repository *GroupRepository
+}
+
+func NewGroupService(repository *GroupRepository) *GroupService {
+	return &GroupService{
+		repository: repository,
+	}
+}
+
+// CreateGroup validates and stores a new group. Group names are unique per user.
+func (s *GroupService) CreateGroup(ctx context.Context, group *Group) error {
+	if err := group.Validate(); err != nil {
+		return err
+	}
+	existing, err := s.repository.GetGroupByName(ctx, group.UserID, group.Name)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return fmt.Errorf("group %q already exists", group.Name)
+	}
+	return s.repository.InsertGroup(ctx, group)
+}
+
+// GetGroup returns a group owned by the user.
+func (s *GroupService) GetGroup(ctx context.Context, id bson.ObjectID, userID string) (*Group, error) {
+	group, err := s.repository.GetGroup(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if group == nil {
+		return nil, fmt.Errorf("group not found")
+	}
+	if group.UserID != userID {
+		return nil, fmt.Errorf("group does not belong to user")
+	}
+	return group, nil
+}
+
+// GetGroupByName returns the group of the user with the given name.
+func (s *GroupService) GetGroupByName(ctx context.Context, userID, name string) (*Group, error) {
+	group, err := s.repository.GetGroupByName(ctx, userID, name)
+	if err != nil {
+		return nil, err
+	}
+	if group == nil {
+		return nil, fmt.Errorf("group not found")
+	}
+	return group, nil
+}
+
+// ListGroups returns the groups of a user ordered by name.
+func (s *GroupService) ListGroups(ctx context.Context, userID string) ([]*Group, error) {
+	return s.repository.ListGroups(ctx, userID)
+}
+
+// UpdateGroup validates and replaces a group of the user. Renaming a group does not update the
+// policies, alert rules and notification settings that refer to the old name.
+func (s *GroupService) UpdateGroup(ctx context.Context, group *Group) error {
+	if _, err := s.GetGroup(ctx, group.ID, group.UserID); err != nil {
+		return err
+	}
+	if err := group.Validate(); err != nil {
+		return err
+	}
+	existing, err := s.repository.GetGroupByName(ctx, group.UserID, group.Name)
+	if err != nil {
+		return err
+	}
+	if existing != nil && existing.ID != group.ID {
+		return fmt.Errorf("group %q already exists", group.Name)
+	}
+	return s.repository.UpdateGroup(ctx, group)
+}
+
+// DeleteGroup deletes a group of the user.
+func (s *GroupService) DeleteGroup(ctx context.Context, id bson.ObjectID, userID string) error {
+	if _, err := s.GetGroup(ctx, id, userID); err != nil {
+		return err
+	}
+	return s.repository.DeleteGroup(ctx, id, userID)
+}
+
+// GroupsFor returns the names of the groups of the agent's owner whose selector matches the agent.
+// It satisfies GroupResolver.
+func (s *GroupService) GroupsFor(ctx context.Context, info *AgentInfo) ([]string, error) {
+	groups, err := s.repository.ListGroups(ctx, info.UserID)
+	if err != nil {
+		return nil, err
+	}
+	return matchingGroups(groups, info.Labels), nil
+}
+
+// matchingGroups returns the names of the groups whose selector matches the labels.
+// Groups with a selector that no longer parses match nothing.
+func matchingGroups(groups []*Group, labels map[string]string) []string {
+	var names []string
+	for _, group := range groups {
+		selector, err := ParseSelector(group.Selector)
+		if err != nil || len(selector) == 0 {
+			continue
+		}
+		if selector.Matches(labels) {
+			names = append(names, group.Name)
+		}
+	}
+	return names
+}
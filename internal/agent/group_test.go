@@ -0,0 +1,44 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGroupValidate(t *testing.T) {
+	valid := Group{Name: "prod-databases", Selector: "env=prod,role=db"}
+	assert.NoError(t, valid.Validate())
+
+	testCases := []struct {
+		name   string
+		modify func(g *Group)
+	}{
+		{"MissingName", func(g *Group) { g.Name = "" }},
+		{"DottedName", func(g *Group) { g.Name = "prod.db" }},
+		{"MissingSelector", func(g *Group) { g.Selector = "" }},
+		{"InvalidSelector", func(g *Group) { g.Selector = "env in prod" }},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			group := valid
+			tc.modify(&group)
+			err := group.Validate()
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), "invalid group")
+		})
+	}
+}
+
+func TestMatchingGroups(t *testing.T) {
+	groups := []*Group{
+		{Name: "databases", Selector: "role=db"},
+		{Name: "production", Selector: "env=prod"},
+		{Name: "staging", Selector: "env=staging"},
+		{Name: "broken", Selector: "env in prod"},
+	}
+
+	assert.Equal(t, []string{"databases", "production"}, matchingGroups(groups, map[string]string{"env": "prod", "role": "db"}))
+	assert.Empty(t, matchingGroups(groups, nil))
+}
@@ -0,0 +1,33 @@
+package agent
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// maxMachineIDLength fits the hex SHA-512 of a hardware fingerprint.
+const maxMachineIDLength = 128
+
+var machineIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9:._-]*$`)
+
+// NormalizeMachineID returns the machine ID in the form it is stored and matched in: trimmed and lower
+// case, since /etc/machine-id and fingerprint hashes are hex.
+func NormalizeMachineID(machineID string) string {
+	return strings.ToLower(strings.TrimSpace(machineID))
+}
+
+// ValidateMachineID checks a normalized machine ID. An empty ID is valid: agents that do not send one are
+// only matched by their agent ID.
+func ValidateMachineID(machineID string) error {
+	if machineID == "" {
+		return nil
+	}
+	if len(machineID) < 8 || len(machineID) > maxMachineIDLength {
+		return fmt.Errorf("invalid machine_id: must be between 8 and %d characters", maxMachineIDLength)
+	}
+	if !machineIDPattern.MatchString(machineID) {
+		return fmt.Errorf("invalid machine_id: only letters, digits, '.', '_', ':' and '-' are allowed")
+	}
+	return nil
+}
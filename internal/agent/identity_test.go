@@ -0,0 +1,19 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateMachineID(t *testing.T) {
+	assert.Equal(t, "4c4c4544004e3010", NormalizeMachineID("  4C4C4544004E3010\n"))
+
+	for _, machineID := range []string{"", "b08dfa6083e7567a1921a715000001fb", "sha256:9f86d081884c7d65"} {
+		assert.NoError(t, ValidateMachineID(machineID), machineID)
+	}
+	for _, machineID := range []string{"short", strings.Repeat("a", 129), "host name 1", "-leading-dash", "$where:1"} {
+		assert.Error(t, ValidateMachineID(machineID), machineID)
+	}
+}
@@ -0,0 +1,227 @@
+package agent
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// Label limits. Keys are used as document field names, so dots and dollar signs are not allowed.
+const (
+	maxLabels         = 64
+	maxLabelKeyLength = 63
+	maxLabelValueLen  = 63
+)
+
+var (
+	labelKeyPattern   = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9_/-]*[A-Za-z0-9])?$`)
+	labelValuePattern = regexp.MustCompile(`^([A-Za-z0-9]([A-Za-z0-9_.-]*[A-Za-z0-9])?)?$`)
+)
+
+// Selector operators.
+const (
+	SelectorEquals       = "="
+	SelectorNotEquals    = "!="
+	SelectorIn           = "in"
+	SelectorNotIn        = "notin"
+	SelectorExists       = "exists"
+	SelectorDoesNotExist = "!"
+)
+
+// Requirement is a single condition of a label selector.
+type Requirement struct {
+	Key      string
+	Operator string
+	Values   []string
+}
+
+// Selector matches agents by their labels. All requirements must hold; an empty selector matches every agent.
+type Selector []Requirement
+
+// ValidateLabels checks the keys and values of agent labels.
+func ValidateLabels(labels map[string]string) error {
+	if len(labels) > maxLabels {
+		return fmt.Errorf("invalid label: at most %d labels are allowed", maxLabels)
+	}
+	for key, value := range labels {
+		if err := validateLabelKey(key); err != nil {
+			return err
+		}
+		if err := validateLabelValue(value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateLabelKey(key string) error {
+	if len(key) > maxLabelKeyLength || !labelKeyPattern.MatchString(key) {
+		return fmt.Errorf("invalid label: key %q must be at most %d letters, digits, '_', '-' or '/' and start and end with a letter or digit", key, maxLabelKeyLength)
+	}
+	return nil
+}
+
+func validateLabelValue(value string) error {
+	if len(value) > maxLabelValueLen || !labelValuePattern.MatchString(value) {
+		return fmt.Errorf("invalid label: value %q must be at most %d letters, digits, '_', '-' or '.' and start and end with a letter or digit", value, maxLabelValueLen)
+	}
+	return nil
+}
+
+// ParseSelector parses a comma separated label selector. Supported requirements are
+// key=value, key==value, key!=value, key in (a,b), key notin (a,b), key and !key.
+func ParseSelector(s string) (Selector, error) {
+	var selector Selector
+	for _, part := range splitSelector(s) {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		requirement, err := parseRequirement(part)
+		if err != nil {
+			return nil, err
+		}
+		selector = append(selector, requirement)
+	}
+	return selector, nil
+}
+
+// splitSelector splits a selector on the commas that are not inside a value set.
+func splitSelector(s string) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func parseRequirement(part string) (Requirement, error) {
+	if key, ok := strings.CutPrefix(part, "!"); ok {
+		key = strings.TrimSpace(key)
+		if err := validateLabelKey(key); err != nil {
+			return Requirement{}, fmt.Errorf("invalid selector: %v", err)
+		}
+		return Requirement{Key: key, Operator: SelectorDoesNotExist}, nil
+	}
+
+	for _, op := range []string{"!=", "==", "="} {
+		key, value, ok := strings.Cut(part, op)
+		if !ok {
+			continue
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if err := validateLabelKey(key); err != nil {
+			return Requirement{}, fmt.Errorf("invalid selector: %v", err)
+		}
+		if err := validateLabelValue(value); err != nil {
+			return Requirement{}, fmt.Errorf("invalid selector: %v", err)
+		}
+		operator := SelectorEquals
+		if op == "!=" {
+			operator = SelectorNotEquals
+		}
+		return Requirement{Key: key, Operator: operator, Values: []string{value}}, nil
+	}
+
+	if fields := strings.Fields(part); len(fields) >= 2 && (fields[1] == SelectorIn || fields[1] == SelectorNotIn) {
+		key := fields[0]
+		set := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(part[len(key):]), fields[1]))
+		if err := validateLabelKey(key); err != nil {
+			return Requirement{}, fmt.Errorf("invalid selector: %v", err)
+		}
+		if !strings.HasPrefix(set, "(") || !strings.HasSuffix(set, ")") {
+			return Requirement{}, fmt.Errorf("invalid selector: values of %q must be enclosed in parentheses", key)
+		}
+		var values []string
+		for _, value := range strings.Split(set[1:len(set)-1], ",") {
+			value = strings.TrimSpace(value)
+			if err := validateLabelValue(value); err != nil {
+				return Requirement{}, fmt.Errorf("invalid selector: %v", err)
+			}
+			values = append(values, value)
+		}
+		return Requirement{Key: key, Operator: fields[1], Values: values}, nil
+	}
+
+	if err := validateLabelKey(part); err != nil {
+		return Requirement{}, fmt.Errorf("invalid selector: %v", err)
+	}
+	return Requirement{Key: part, Operator: SelectorExists}, nil
+}
+
+// Matches reports whether the labels satisfy every requirement of the selector.
+func (s Selector) Matches(labels map[string]string) bool {
+	for _, r := range s {
+		value, ok := labels[r.Key]
+		switch r.Operator {
+		case SelectorEquals, SelectorIn:
+			if !ok || !slices.Contains(r.Values, value) {
+				return false
+			}
+		case SelectorNotEquals, SelectorNotIn:
+			if ok && slices.Contains(r.Values, value) {
+				return false
+			}
+		case SelectorExists:
+			if !ok {
+				return false
+			}
+		case SelectorDoesNotExist:
+			if ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Filter translates the selector into query conditions on the labels of agent documents.
+func (s Selector) Filter() []bson.M {
+	filters := make([]bson.M, 0, len(s))
+	for _, r := range s {
+		field := "labels." + r.Key
+		switch r.Operator {
+		case SelectorEquals, SelectorIn:
+			filters = append(filters, bson.M{field: bson.M{"$in": r.Values}})
+		case SelectorNotEquals, SelectorNotIn:
+			filters = append(filters, bson.M{field: bson.M{"$nin": r.Values}})
+		case SelectorExists:
+			filters = append(filters, bson.M{field: bson.M{"$exists": true}})
+		case SelectorDoesNotExist:
+			filters = append(filters, bson.M{field: bson.M{"$exists": false}})
+		}
+	}
+	return filters
+}
+
+// String formats the selector in the syntax accepted by ParseSelector.
+func (s Selector) String() string {
+	parts := make([]string, 0, len(s))
+	for _, r := range s {
+		switch r.Operator {
+		case SelectorEquals, SelectorNotEquals:
+			parts = append(parts, r.Key+r.Operator+r.Values[0])
+		case SelectorIn, SelectorNotIn:
+			parts = append(parts, r.Key+" "+r.Operator+" ("+strings.Join(r.Values, ",")+")")
+		case SelectorExists:
+			parts = append(parts, r.Key)
+		case SelectorDoesNotExist:
+			parts = append(parts, "!"+r.Key)
+		}
+	}
+	return strings.Join(parts, ",")
+}
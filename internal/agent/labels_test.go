@@ -0,0 +1,98 @@
+package agent
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestValidateLabels(t *testing.T) {
+	assert.NoError(t, ValidateLabels(nil))
+	assert.NoError(t, ValidateLabels(map[string]string{"env": "prod", "team/owner": "sre", "version": "1.2.3", "empty": ""}))
+
+	testCases := []struct {
+		name   string
+		labels map[string]string
+	}{
+		{"DottedKey", map[string]string{"app.name": "api"}},
+		{"DollarKey", map[string]string{"$env": "prod"}},
+		{"EmptyKey", map[string]string{"": "prod"}},
+		{"LongKey", map[string]string{strings.Repeat("k", 64): "prod"}},
+		{"SpaceInValue", map[string]string{"env": "prod eu"}},
+		{"LongValue", map[string]string{"env": strings.Repeat("v", 64)}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidateLabels(tc.labels)
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), "invalid label")
+		})
+	}
+}
+
+func TestParseSelector(t *testing.T) {
+	selector, err := ParseSelector("env=prod, role==db,tier!=web,region in (eu-west, us-east),zone notin (a),gpu,!canary")
+	assert.NoError(t, err)
+	assert.Equal(t, Selector{
+		{Key: "env", Operator: SelectorEquals, Values: []string{"prod"}},
+		{Key: "role", Operator: SelectorEquals, Values: []string{"db"}},
+		{Key: "tier", Operator: SelectorNotEquals, Values: []string{"web"}},
+		{Key: "region", Operator: SelectorIn, Values: []string{"eu-west", "us-east"}},
+		{Key: "zone", Operator: SelectorNotIn, Values: []string{"a"}},
+		{Key: "gpu", Operator: SelectorExists},
+		{Key: "canary", Operator: SelectorDoesNotExist},
+	}, selector)
+	assert.Equal(t, "env=prod,role=db,tier!=web,region in (eu-west,us-east),zone notin (a),gpu,!canary", selector.String())
+
+	empty, err := ParseSelector("")
+	assert.NoError(t, err)
+	assert.Empty(t, empty)
+
+	for _, invalid := range []string{"app.name=api", "env=prod eu", "region in eu", "!", "=prod"} {
+		_, err := ParseSelector(invalid)
+		assert.Error(t, err, invalid)
+		assert.Contains(t, err.Error(), "invalid selector", invalid)
+	}
+}
+
+func TestSelectorMatches(t *testing.T) {
+	labels := map[string]string{"env": "prod", "role": "db", "region": "eu-west"}
+
+	testCases := []struct {
+		selector string
+		expected bool
+	}{
+		{"", true},
+		{"env=prod", true},
+		{"env=prod,role=db", true},
+		{"env=prod,role=web", false},
+		{"env!=staging", true},
+		{"tier!=web", true},
+		{"region in (eu-west,us-east)", true},
+		{"region notin (eu-west)", false},
+		{"role", true},
+		{"gpu", false},
+		{"!gpu", true},
+		{"!env", false},
+	}
+
+	for _, tc := range testCases {
+		selector, err := ParseSelector(tc.selector)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expected, selector.Matches(labels), tc.selector)
+	}
+}
+
+func TestSelectorFilter(t *testing.T) {
+	selector, err := ParseSelector("env=prod,tier!=web,gpu,!canary")
+	assert.NoError(t, err)
+	assert.Equal(t, []bson.M{
+		{"labels.env": bson.M{"$in": []string{"prod"}}},
+		{"labels.tier": bson.M{"$nin": []string{"web"}}},
+		{"labels.gpu": bson.M{"$exists": true}},
+		{"labels.canary": bson.M{"$exists": false}},
+	}, selector.Filter())
+}
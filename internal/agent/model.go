@@ -7,25 +7,134 @@ import (
 )
 
 // SystemMetrics represents the current system metrics.
+// Fields after FSUsage are optional so that older agents which do not report them keep working.
 type SystemMetrics struct {
-	CPUInfo     []string          `json:"cpu_info" bson:"cpu_info"`         // CPU information from /proc/cpuinfo
-	CPUUsage    float64           `json:"cpu_usage" bson:"cpu_usage"`       // Current CPU usage percentage
-	MemoryTotal int64             `json:"memory_total" bson:"memory_total"` // Total memory in bytes
-	MemoryUsed  int64             `json:"memory_used" bson:"memory_used"`   // Used memory in bytes
-	MemoryFree  int64             `json:"memory_free" bson:"memory_free"`   // Free memory in bytes
-	DiskUsage   map[string]int64  `json:"disk_usage" bson:"disk_usage"`     // Disk usage per mount point in bytes
-	FSUsage     map[string]string `json:"fs_usage" bson:"fs_usage"`         // Filesystem usage percentages
+	CPUInfo             []string                    `json:"cpu_info" bson:"cpu_info"`                                               // CPU information from /proc/cpuinfo
+	CPUUsage            float64                     `json:"cpu_usage" bson:"cpu_usage"`                                             // Current CPU usage percentage
+	MemoryTotal         int64                       `json:"memory_total" bson:"memory_total"`                                       // Total memory in bytes
+	MemoryUsed          int64                       `json:"memory_used" bson:"memory_used"`                                         // Used memory in bytes
+	MemoryFree          int64                       `json:"memory_free" bson:"memory_free"`                                         // Free memory in bytes
+	DiskUsage           map[string]int64            `json:"disk_usage" bson:"disk_usage"`                                           // Disk usage per mount point in bytes
+	FSUsage             map[string]string           `json:"fs_usage" bson:"fs_usage"`                                               // Filesystem usage percentages
+	LoadAverage         *LoadAverage                `json:"load_average,omitempty" bson:"load_average,omitempty"`                   // Load averages from /proc/loadavg
+	SwapTotal           int64                       `json:"swap_total,omitempty" bson:"swap_total,omitempty"`                       // Total swap in bytes
+	SwapUsed            int64                       `json:"swap_used,omitempty" bson:"swap_used,omitempty"`                         // Used swap in bytes
+	InodeUsage          map[string]InodeUsage       `json:"inode_usage,omitempty" bson:"inode_usage,omitempty"`                     // Inode usage per mount point
+	Network             map[string]NetworkInterface `json:"network,omitempty" bson:"network,omitempty"`                             // Throughput and errors per network interface
+	OpenFileDescriptors int64                       `json:"open_file_descriptors,omitempty" bson:"open_file_descriptors,omitempty"` // Allocated file handles from /proc/sys/fs/file-nr
+	MaxFileDescriptors  int64                       `json:"max_file_descriptors,omitempty" bson:"max_file_descriptors,omitempty"`   // System wide file handle limit
+	ProcessCount        int64                       `json:"process_count,omitempty" bson:"process_count,omitempty"`                 // Number of processes
+	ThreadCount         int64                       `json:"thread_count,omitempty" bson:"thread_count,omitempty"`                   // Number of threads across all processes
+	TCPStates           map[string]int64            `json:"tcp_states,omitempty" bson:"tcp_states,omitempty"`                       // TCP connection count per state, e.g. ESTABLISHED
+	Pressure            *PressureStall              `json:"pressure,omitempty" bson:"pressure,omitempty"`                           // Pressure stall information from /proc/pressure
+	UptimeSeconds       int64                       `json:"uptime_seconds,omitempty" bson:"uptime_seconds,omitempty"`               // System uptime from /proc/uptime
 }
 
+// LoadAverage represents the 1, 5 and 15 minute system load averages.
+type LoadAverage struct {
+	Load1  float64 `json:"load1" bson:"load1"`
+	Load5  float64 `json:"load5" bson:"load5"`
+	Load15 float64 `json:"load15" bson:"load15"`
+}
+
+// InodeUsage represents the inode usage of a filesystem.
+type InodeUsage struct {
+	Total int64 `json:"total" bson:"total"`
+	Used  int64 `json:"used" bson:"used"`
+	Free  int64 `json:"free" bson:"free"`
+}
+
+// NetworkInterface represents the throughput and error counters of a network interface.
+type NetworkInterface struct {
+	RxBytesPerSec float64 `json:"rx_bytes_per_sec" bson:"rx_bytes_per_sec"`
+	TxBytesPerSec float64 `json:"tx_bytes_per_sec" bson:"tx_bytes_per_sec"`
+	RxErrors      int64   `json:"rx_errors" bson:"rx_errors"`   // Receive errors since boot
+	TxErrors      int64   `json:"tx_errors" bson:"tx_errors"`   // Transmit errors since boot
+	RxDropped     int64   `json:"rx_dropped" bson:"rx_dropped"` // Dropped inbound packets since boot
+	TxDropped     int64   `json:"tx_dropped" bson:"tx_dropped"` // Dropped outbound packets since boot
+}
+
+// PressureStall represents the pressure stall information of the CPU, memory and IO resources.
+type PressureStall struct {
+	CPU    *PressureStats `json:"cpu,omitempty" bson:"cpu,omitempty"`
+	Memory *PressureStats `json:"memory,omitempty" bson:"memory,omitempty"`
+	IO     *PressureStats `json:"io,omitempty" bson:"io,omitempty"`
+}
+
+// PressureStats holds the percentage of time tasks were stalled on a resource.
+// Some is the share of time at least one task was stalled, Full the share of time all tasks were.
+type PressureStats struct {
+	SomeAvg10  float64 `json:"some_avg10" bson:"some_avg10"`
+	SomeAvg60  float64 `json:"some_avg60" bson:"some_avg60"`
+	SomeAvg300 float64 `json:"some_avg300" bson:"some_avg300"`
+	FullAvg10  float64 `json:"full_avg10" bson:"full_avg10"`
+	FullAvg60  float64 `json:"full_avg60" bson:"full_avg60"`
+	FullAvg300 float64 `json:"full_avg300" bson:"full_avg300"`
+}
+
+// TCPStateNames lists the connection states accepted in SystemMetrics.TCPStates.
+var TCPStateNames = []string{
+	"ESTABLISHED", "SYN_SENT", "SYN_RECV", "FIN_WAIT1", "FIN_WAIT2", "TIME_WAIT",
+	"CLOSE", "CLOSE_WAIT", "LAST_ACK", "LISTEN", "CLOSING",
+}
+
+// Agent liveness states derived from heartbeats.
+const (
+	StatusOnline  = "online"
+	StatusStale   = "stale"
+	StatusOffline = "offline"
+	// StatusDecommissioned is final: the agent is archived and no longer reports.
+	StatusDecommissioned = "decommissioned"
+)
+
 // AgentInfo represents the information ingested by the agent.
 type AgentInfo struct {
-	ID            bson.ObjectID `json:"id" bson:"_id,omitempty"`
-	UserID        string        `json:"user_id" bson:"user_id"`
-	Hostname      string        `json:"hostname" bson:"hostname"`
-	IPAddress     string        `json:"ip_address" bson:"ip_address"`
-	KernelVersion string        `json:"kernel_version" bson:"kernel_version"`
-	OsVersion     string        `json:"os_version" bson:"os_version"`
-	SystemMetrics SystemMetrics `json:"system_metrics" bson:"system_metrics"`
-	CreatedAt     time.Time     `json:"created_at" bson:"created_at"`
-	UpdatedAt     time.Time     `json:"updated_at" bson:"updated_at"`
+	ID               bson.ObjectID     `json:"id" bson:"_id,omitempty"`
+	UserID           string            `json:"user_id" bson:"user_id"` // Owning organisation, which is the user ID for personal organisations
+	Hostname         string            `json:"hostname" bson:"hostname"`
+	MachineID        string            `json:"machine_id,omitempty" bson:"machine_id,omitempty"` // Stable machine identity, e.g. /etc/machine-id or a hardware fingerprint hash
+	IPAddress        string            `json:"ip_address" bson:"ip_address"`
+	KernelVersion    string            `json:"kernel_version" bson:"kernel_version"`
+	OsVersion        string            `json:"os_version" bson:"os_version"`
+	SystemMetrics    SystemMetrics     `json:"system_metrics" bson:"system_metrics"`
+	Labels           map[string]string `json:"labels,omitempty" bson:"labels,omitempty"`                 // Key/value labels used by selectors and groups
+	Status           string            `json:"status,omitempty" bson:"status,omitempty"`                 // online, stale, offline or decommissioned
+	LastSeen         time.Time         `json:"last_seen,omitempty" bson:"last_seen,omitempty"`           // Time of the last heartbeat or agent-info post
+	AgentVersion     string            `json:"agent_version,omitempty" bson:"agent_version,omitempty"`   // Version reported by the agent
+	UptimeSeconds    int64             `json:"uptime_seconds,omitempty" bson:"uptime_seconds,omitempty"` // Agent process uptime at the last heartbeat
+	Connected        bool              `json:"connected" bson:"-"`                                       // Whether the agent holds a WebSocket connection to this API instance
+	Credentials      []*Credential     `json:"credentials,omitempty" bson:"-"`                           // Credentials the agent authenticates with
+	DecommissionedAt *time.Time        `json:"decommissioned_at,omitempty" bson:"decommissioned_at,omitempty"`
+	ArchivedUntil    *time.Time        `json:"archived_until,omitempty" bson:"archived_until,omitempty"` // When the archived agent and its data are deleted
+	CreatedAt        time.Time         `json:"created_at" bson:"created_at"`
+	UpdatedAt        time.Time         `json:"updated_at" bson:"updated_at"`
+}
+
+// AgentQuery filters the agents of a user. Empty fields match every agent.
+type AgentQuery struct {
+	Statuses []string // Liveness states
+	Selector Selector // Label selector
+	OS       string   // Case-insensitive substring of the OS version
+}
+
+// LabelsRequest replaces the labels of an agent.
+type LabelsRequest struct {
+	Labels map[string]string `json:"labels"`
+}
+
+// Heartbeat represents the lightweight liveness report sent by an agent.
+type Heartbeat struct {
+	AgentVersion  string `json:"agent_version"`
+	UptimeSeconds int64  `json:"uptime_seconds"`
+}
+
+// StatusEvent describes an agent moving from one liveness state to another.
+type StatusEvent struct {
+	AgentID  string    `json:"agent_id"`
+	UserID   string    `json:"user_id"` // Owning organisation, which is the user ID for personal organisations
+	Hostname string    `json:"hostname"`
+	From     string    `json:"from"`
+	To       string    `json:"to"`
+	LastSeen time.Time `json:"last_seen"`
+	At       time.Time `json:"at"`
 }
@@ -0,0 +1,156 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+const (
+	defaultStaleAfter    = 2 * time.Minute
+	defaultOfflineAfter  = 10 * time.Minute
+	defaultCheckInterval = 30 * time.Second
+)
+
+// StatusListener is called whenever an agent changes liveness state.
+type StatusListener func(event StatusEvent)
+
+// StatusConfig holds the timeouts used to derive agent liveness from heartbeats.
+type StatusConfig struct {
+	StaleAfter    time.Duration // Time without heartbeat after which an agent is stale
+	OfflineAfter  time.Duration // Time without heartbeat after which an agent is offline
+	CheckInterval time.Duration // How often the monitor re-evaluates agents
+}
+
+// DefaultStatusConfig returns the default liveness timeouts.
+func DefaultStatusConfig() StatusConfig {
+	return StatusConfig{
+		StaleAfter:    defaultStaleAfter,
+		OfflineAfter:  defaultOfflineAfter,
+		CheckInterval: defaultCheckInterval,
+	}
+}
+
+// StatusConfigFromEnv reads AGENT_STALE_TIMEOUT, AGENT_OFFLINE_TIMEOUT and AGENT_STATUS_CHECK_INTERVAL,
+// falling back to the defaults for any variable that is not set.
+func StatusConfigFromEnv() (StatusConfig, error) {
+	config := DefaultStatusConfig()
+
+	for _, v := range []struct {
+		name   string
+		target *time.Duration
+	}{
+		{"AGENT_STALE_TIMEOUT", &config.StaleAfter},
+		{"AGENT_OFFLINE_TIMEOUT", &config.OfflineAfter},
+		{"AGENT_STATUS_CHECK_INTERVAL", &config.CheckInterval},
+	} {
+		value := os.Getenv(v.name)
+		if value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return config, fmt.Errorf("invalid %s %q", v.name, value)
+		}
+		*v.target = d
+	}
+
+	if config.OfflineAfter <= config.StaleAfter {
+		return config, fmt.Errorf("AGENT_OFFLINE_TIMEOUT (%s) must be greater than AGENT_STALE_TIMEOUT (%s)", config.OfflineAfter, config.StaleAfter)
+	}
+	return config, nil
+}
+
+// ComputeStatus derives the liveness state of an agent from the time it was last seen.
+func ComputeStatus(lastSeen, now time.Time, config StatusConfig) string {
+	since := now.Sub(lastSeen)
+	switch {
+	case since >= config.OfflineAfter:
+		return StatusOffline
+	case since >= config.StaleAfter:
+		return StatusStale
+	default:
+		return StatusOnline
+	}
+}
+
+// OnStatusChange registers a listener for agent status changes.
+func (s *AgentInfoService) OnStatusChange(listener StatusListener) {
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+	s.listeners = append(s.listeners, listener)
+}
+
+func (s *AgentInfoService) emitStatusChange(agentInfo *AgentInfo, to string, lastSeen time.Time) {
+	event := StatusEvent{
+		AgentID:  agentInfo.ID.Hex(),
+		UserID:   agentInfo.UserID,
+		Hostname: agentInfo.Hostname,
+		From:     agentInfo.Status,
+		To:       to,
+		LastSeen: lastSeen,
+		At:       time.Now(),
+	}
+	log.Printf("Agent status changed - Agent: %s, Host: %s, From: %q, To: %s", event.AgentID, event.Hostname, event.From, event.To)
+
+	s.listenersMu.RLock()
+	listeners := append([]StatusListener(nil), s.listeners...)
+	s.listenersMu.RUnlock()
+
+	for _, listener := range listeners {
+		listener(event)
+	}
+}
+
+// CheckAgentStatuses moves agents that stopped sending heartbeats to stale or offline.
+func (s *AgentInfoService) CheckAgentStatuses(ctx context.Context, now time.Time, config StatusConfig) error {
+	agents, err := s.repository.GetAgentsToMonitor(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, agentInfo := range agents {
+		status := ComputeStatus(agentInfo.LastSeen, now, config)
+		if status == agentInfo.Status {
+			continue
+		}
+
+		changed, err := s.repository.UpdateStatus(ctx, agentInfo.ID, status, agentInfo.LastSeen)
+		if err != nil {
+			log.Printf("Failed to update status of agent %s: %v", agentInfo.ID.Hex(), err)
+			continue
+		}
+		// A heartbeat raced with us and the agent is online again
+		if !changed {
+			continue
+		}
+		// Agents without a status already counted as offline
+		if agentInfo.Status == "" && status == StatusOffline {
+			continue
+		}
+		s.emitStatusChange(agentInfo, status, agentInfo.LastSeen)
+	}
+	return nil
+}
+
+// StartStatusMonitor periodically re-evaluates agent liveness until the context is cancelled.
+func (s *AgentInfoService) StartStatusMonitor(ctx context.Context, config StatusConfig) {
+	log.Printf("Starting agent status monitor - Stale after: %s, Offline after: %s", config.StaleAfter, config.OfflineAfter)
+
+	go func() {
+		ticker := time.NewTicker(config.CheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				if err := s.CheckAgentStatuses(ctx, now, config); err != nil {
+					log.Printf("Failed to check agent statuses: %v", err)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,93 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestComputeStatus(t *testing.T) {
+	config := DefaultStatusConfig()
+	now := time.Now()
+
+	testCases := []struct {
+		name     string
+		lastSeen time.Time
+		expected string
+	}{
+		{"JustSeen", now, StatusOnline},
+		{"BeforeStaleTimeout", now.Add(-config.StaleAfter + time.Second), StatusOnline},
+		{"AtStaleTimeout", now.Add(-config.StaleAfter), StatusStale},
+		{"BeforeOfflineTimeout", now.Add(-config.OfflineAfter + time.Second), StatusStale},
+		{"AtOfflineTimeout", now.Add(-config.OfflineAfter), StatusOffline},
+		{"NeverSeen", time.Time{}, StatusOffline},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, ComputeStatus(tc.lastSeen, now, config))
+		})
+	}
+}
+
+func TestStatusConfigFromEnv(t *testing.T) {
+	t.Run("Defaults", func(t *testing.T) {
+		t.Setenv("AGENT_STALE_TIMEOUT", "")
+		t.Setenv("AGENT_OFFLINE_TIMEOUT", "")
+		t.Setenv("AGENT_STATUS_CHECK_INTERVAL", "")
+		config, err := StatusConfigFromEnv()
+		assert.NoError(t, err)
+		assert.Equal(t, DefaultStatusConfig(), config)
+	})
+
+	t.Run("Overrides", func(t *testing.T) {
+		t.Setenv("AGENT_STALE_TIMEOUT", "45s")
+		t.Setenv("AGENT_OFFLINE_TIMEOUT", "5m")
+		t.Setenv("AGENT_STATUS_CHECK_INTERVAL", "10s")
+		config, err := StatusConfigFromEnv()
+		assert.NoError(t, err)
+		assert.Equal(t, 45*time.Second, config.StaleAfter)
+		assert.Equal(t, 5*time.Minute, config.OfflineAfter)
+		assert.Equal(t, 10*time.Second, config.CheckInterval)
+	})
+
+	t.Run("InvalidDuration", func(t *testing.T) {
+		t.Setenv("AGENT_STALE_TIMEOUT", "two minutes")
+		_, err := StatusConfigFromEnv()
+		assert.Error(t, err)
+	})
+
+	t.Run("OfflineNotAfterStale", func(t *testing.T) {
+		t.Setenv("AGENT_STALE_TIMEOUT", "10m")
+		t.Setenv("AGENT_OFFLINE_TIMEOUT", "5m")
+		_, err := StatusConfigFromEnv()
+		assert.Error(t, err)
+	})
+}
+
+func TestOnStatusChange(t *testing.T) {
+	service := NewAgentInfoService(nil)
+
+	var events []StatusEvent
+	service.OnStatusChange(func(event StatusEvent) {
+		events = append(events, event)
+	})
+
+	agentInfo := &AgentInfo{
+		ID:       bson.NewObjectID(),
+		UserID:   "123456",
+		Hostname: "test-host",
+		Status:   StatusStale,
+	}
+	lastSeen := time.Now().Add(-5 * time.Minute)
+	service.emitStatusChange(agentInfo, StatusOffline, lastSeen)
+
+	assert.Len(t, events, 1)
+	assert.Equal(t, agentInfo.ID.Hex(), events[0].AgentID)
+	assert.Equal(t, "test-host", events[0].Hostname)
+	assert.Equal(t, StatusStale, events[0].From)
+	assert.Equal(t, StatusOffline, events[0].To)
+	assert.Equal(t, lastSeen, events[0].LastSeen)
+}
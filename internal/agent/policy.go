@@ -0,0 +1,435 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// Metric families compared by the change-detection policy. Families with one value per mount point,
+// interface, connection state or resource are keyed, the others are scalar.
+const (
+	MetricCPUUsage             = "cpu_usage"                // percentage points
+	MetricMemoryUsedPercent    = "memory_used_percent"      // percentage points
+	MetricDiskUsage            = "disk_usage"               // bytes, per mount point
+	MetricFSUsage              = "fs_usage"                 // percentage points, per mount point
+	MetricLoad1                = "load1"                    // 1 minute load average
+	MetricLoad5                = "load5"                    // 5 minute load average
+	MetricLoad15               = "load15"                   // 15 minute load average
+	MetricSwapUsedPercent      = "swap_used_percent"        // percentage points
+	MetricInodeUsedPercent     = "inode_used_percent"       // percentage points, per mount point
+	MetricNetworkRxBytesPerSec = "network_rx_bytes_per_sec" // per interface
+	MetricNetworkTxBytesPerSec = "network_tx_bytes_per_sec" // per interface
+	MetricNetworkErrors        = "network_errors"           // receive and transmit errors, per interface
+	MetricNetworkDropped       = "network_dropped"          // receive and transmit drops, per interface
+	MetricOpenFileDescriptors  = "open_file_descriptors"
+	MetricProcessCount         = "process_count"
+	MetricThreadCount          = "thread_count"
+	MetricTCPConnections       = "tcp_connections"     // per connection state
+	MetricPressureSomeAvg10    = "pressure_some_avg10" // percentage points, per resource
+	MetricPressureFullAvg10    = "pressure_full_avg10" // percentage points, per resource
+	MetricUptimeSeconds        = "uptime_seconds"
+)
+
+// MetricFamilies lists the metric families in the order they are reported in a diff.
+var MetricFamilies = []string{
+	MetricCPUUsage, MetricMemoryUsedPercent, MetricDiskUsage, MetricFSUsage,
+	MetricLoad1, MetricLoad5, MetricLoad15, MetricSwapUsedPercent, MetricInodeUsedPercent,
+	MetricNetworkRxBytesPerSec, MetricNetworkTxBytesPerSec, MetricNetworkErrors, MetricNetworkDropped,
+	MetricOpenFileDescriptors, MetricProcessCount, MetricThreadCount, MetricTCPConnections,
+	MetricPressureSomeAvg10, MetricPressureFullAvg10, MetricUptimeSeconds,
+}
+
+// Directions of a metric change.
+const (
+	DirectionUp          = "up"
+	DirectionDown        = "down"
+	DirectionAppeared    = "appeared"
+	DirectionDisappeared = "disappeared"
+)
+
+// Threshold decides when the change of a metric is significant. A change is significant when it exceeds
+// every threshold that is set. Relative is a percentage of the previous value.
+type Threshold struct {
+	Absolute  *float64 `json:"absolute,omitempty" bson:"absolute,omitempty"`
+	Relative  *float64 `json:"relative,omitempty" bson:"relative,omitempty"`
+	Direction string   `json:"direction,omitempty" bson:"direction,omitempty"` // up, down or empty for both
+	Disabled  bool     `json:"disabled,omitempty" bson:"disabled,omitempty"`   // Ignore the metric entirely
+}
+
+// Thresholds maps metric families to their thresholds. Families without a threshold are not compared.
+type Thresholds map[string]Threshold
+
+// ChangePolicy holds the change-detection thresholds of a user. Group thresholds override the global
+// ones and agent thresholds override both, one metric family at a time.
+type ChangePolicy struct {
+	ID        bson.ObjectID         `json:"id" bson:"_id,omitempty"`
+	UserID    string                `json:"user_id" bson:"user_id"` // Owning organisation, which is the user ID for personal organisations
+	Global    Thresholds            `json:"global,omitempty" bson:"global,omitempty"`
+	Groups    map[string]Thresholds `json:"groups,omitempty" bson:"groups,omitempty"` // Keyed by group name
+	Agents    map[string]Thresholds `json:"agents,omitempty" bson:"agents,omitempty"` // Keyed by agent ID
+	UpdatedAt time.Time             `json:"updated_at" bson:"updated_at"`
+}
+
+// MetricChange describes a single metric that moved significantly between two snapshots.
+type MetricChange struct {
+	Metric    string  `json:"metric" bson:"metric"`
+	Key       string  `json:"key,omitempty" bson:"key,omitempty"` // Mount point, interface, connection state or resource
+	Old       float64 `json:"old" bson:"old"`
+	New       float64 `json:"new" bson:"new"`
+	Delta     float64 `json:"delta" bson:"delta"`
+	Direction string  `json:"direction" bson:"direction"`
+}
+
+// MetricsDiff lists the significant changes between two snapshots of system metrics.
+type MetricsDiff struct {
+	Changes []MetricChange `json:"changes" bson:"changes"`
+}
+
+// GroupResolver returns the names of the groups an agent belongs to.
+type GroupResolver func(ctx context.Context, info *AgentInfo) ([]string, error)
+
+func limit(v float64) *float64 { return &v }
+
+// DefaultThresholds returns the built-in thresholds used when a user has not configured any.
+func DefaultThresholds() Thresholds {
+	return Thresholds{
+		MetricCPUUsage:             {Absolute: limit(5)},
+		MetricMemoryUsedPercent:    {Absolute: limit(10)},
+		MetricDiskUsage:            {Relative: limit(10)},
+		MetricFSUsage:              {Absolute: limit(5)},
+		MetricLoad1:                {Absolute: limit(1), Relative: limit(25)},
+		MetricSwapUsedPercent:      {Absolute: limit(10)},
+		MetricInodeUsedPercent:     {Absolute: limit(10)},
+		MetricNetworkRxBytesPerSec: {Relative: limit(50)},
+		MetricNetworkTxBytesPerSec: {Relative: limit(50)},
+		MetricNetworkErrors:        {Absolute: limit(0), Direction: DirectionUp},
+		MetricNetworkDropped:       {Absolute: limit(0), Direction: DirectionUp},
+		MetricOpenFileDescriptors:  {Relative: limit(10)},
+		MetricProcessCount:         {Relative: limit(10)},
+		MetricThreadCount:          {Relative: limit(10)},
+		MetricTCPConnections:       {Absolute: limit(10), Relative: limit(20)},
+		MetricPressureSomeAvg10:    {Absolute: limit(10)},
+		// A lower uptime means the system rebooted
+		MetricUptimeSeconds: {Absolute: limit(0), Direction: DirectionDown},
+	}
+}
+
+// Validate checks that every threshold targets a known metric family and is well formed.
+func (t Thresholds) Validate() error {
+	for metric, threshold := range t {
+		if !slices.Contains(MetricFamilies, metric) {
+			return fmt.Errorf("invalid threshold: unknown metric %q", metric)
+		}
+		if threshold.Absolute != nil && *threshold.Absolute < 0 {
+			return fmt.Errorf("invalid threshold: absolute threshold of %s must not be negative", metric)
+		}
+		if threshold.Relative != nil && *threshold.Relative < 0 {
+			return fmt.Errorf("invalid threshold: relative threshold of %s must not be negative", metric)
+		}
+		if threshold.Direction != "" && threshold.Direction != DirectionUp && threshold.Direction != DirectionDown {
+			return fmt.Errorf("invalid threshold: direction of %s must be up or down", metric)
+		}
+		if !threshold.Disabled && threshold.Absolute == nil && threshold.Relative == nil {
+			return fmt.Errorf("invalid threshold: %s needs an absolute or relative threshold", metric)
+		}
+	}
+	return nil
+}
+
+// Validate checks the global, group and agent thresholds of the policy.
+func (p *ChangePolicy) Validate() error {
+	if err := p.Global.Validate(); err != nil {
+		return err
+	}
+	for group, thresholds := range p.Groups {
+		if err := ValidateGroupName(group); err != nil {
+			return fmt.Errorf("invalid threshold: %v", err)
+		}
+		if err := thresholds.Validate(); err != nil {
+			return err
+		}
+	}
+	for agentID, thresholds := range p.Agents {
+		if _, err := bson.ObjectIDFromHex(agentID); err != nil {
+			return fmt.Errorf("invalid threshold: %q is not a valid agent ID", agentID)
+		}
+		if err := thresholds.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Resolve returns the effective thresholds for an agent: the defaults, overridden by the global
+// thresholds, then by the thresholds of each group in name order, then by the agent thresholds.
+func (p *ChangePolicy) Resolve(agentID string, groups []string) Thresholds {
+	resolved := DefaultThresholds()
+	if p == nil {
+		return resolved
+	}
+
+	overlay := func(thresholds Thresholds) {
+		for metric, threshold := range thresholds {
+			resolved[metric] = threshold
+		}
+	}
+
+	overlay(p.Global)
+	sorted := slices.Clone(groups)
+	sort.Strings(sorted)
+	for _, group := range sorted {
+		overlay(p.Groups[group])
+	}
+	overlay(p.Agents[agentID])
+
+	return resolved
+}
+
+// exceeds reports whether a change from old to new is significant under the threshold.
+func (t Threshold) exceeds(old, new float64) bool {
+	delta := new - old
+	if delta == 0 {
+		return false
+	}
+	if t.Direction == DirectionUp && delta < 0 || t.Direction == DirectionDown && delta > 0 {
+		return false
+	}
+	if t.Absolute != nil && math.Abs(delta) <= *t.Absolute {
+		return false
+	}
+	// Any change from zero is an infinite relative change
+	if t.Relative != nil && old != 0 && math.Abs(delta)/math.Abs(old)*100 <= *t.Relative {
+		return false
+	}
+	return true
+}
+
+// FlattenMetrics returns the values of every reported metric family keyed by family and key.
+// Optional metrics an agent did not report are left out, so they are never compared.
+func FlattenMetrics(m SystemMetrics) map[string]map[string]float64 {
+	values := map[string]map[string]float64{}
+	set := func(metric, key string, v float64) {
+		if values[metric] == nil {
+			values[metric] = map[string]float64{}
+		}
+		values[metric][key] = v
+	}
+
+	set(MetricCPUUsage, "", m.CPUUsage)
+	if m.MemoryTotal > 0 {
+		set(MetricMemoryUsedPercent, "", float64(m.MemoryUsed)/float64(m.MemoryTotal)*100)
+	}
+	for mountPoint, usage := range m.DiskUsage {
+		set(MetricDiskUsage, mountPoint, float64(usage))
+	}
+	for mountPoint, usage := range m.FSUsage {
+		if pct, err := parsePercent(usage); err == nil {
+			set(MetricFSUsage, mountPoint, pct)
+		}
+	}
+	if m.LoadAverage != nil {
+		set(MetricLoad1, "", m.LoadAverage.Load1)
+		set(MetricLoad5, "", m.LoadAverage.Load5)
+		set(MetricLoad15, "", m.LoadAverage.Load15)
+	}
+	if m.SwapTotal > 0 {
+		set(MetricSwapUsedPercent, "", float64(m.SwapUsed)/float64(m.SwapTotal)*100)
+	}
+	for mountPoint, inodes := range m.InodeUsage {
+		if inodes.Total > 0 {
+			set(MetricInodeUsedPercent, mountPoint, float64(inodes.Used)/float64(inodes.Total)*100)
+		}
+	}
+	for name, iface := range m.Network {
+		set(MetricNetworkRxBytesPerSec, name, iface.RxBytesPerSec)
+		set(MetricNetworkTxBytesPerSec, name, iface.TxBytesPerSec)
+		set(MetricNetworkErrors, name, float64(iface.RxErrors+iface.TxErrors))
+		set(MetricNetworkDropped, name, float64(iface.RxDropped+iface.TxDropped))
+	}
+	if m.OpenFileDescriptors > 0 {
+		set(MetricOpenFileDescriptors, "", float64(m.OpenFileDescriptors))
+	}
+	if m.ProcessCount > 0 {
+		set(MetricProcessCount, "", float64(m.ProcessCount))
+	}
+	if m.ThreadCount > 0 {
+		set(MetricThreadCount, "", float64(m.ThreadCount))
+	}
+	if len(m.TCPStates) > 0 {
+		// States without connections are reported as zero rather than missing
+		for _, state := range TCPStateNames {
+			set(MetricTCPConnections, state, float64(m.TCPStates[state]))
+		}
+	}
+	if m.Pressure != nil {
+		resources := map[string]*PressureStats{"cpu": m.Pressure.CPU, "memory": m.Pressure.Memory, "io": m.Pressure.IO}
+		for resource, stats := range resources {
+			if stats != nil {
+				set(MetricPressureSomeAvg10, resource, stats.SomeAvg10)
+				set(MetricPressureFullAvg10, resource, stats.FullAvg10)
+			}
+		}
+	}
+	if m.UptimeSeconds > 0 {
+		set(MetricUptimeSeconds, "", float64(m.UptimeSeconds))
+	}
+
+	return values
+}
+
+// parsePercent parses filesystem usage values such as "45%".
+func parsePercent(value string) (float64, error) {
+	return strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(value), "%"), 64)
+}
+
+// DiffSystemMetrics compares two snapshots and returns the changes that exceed the thresholds.
+// A metric family is only compared when both snapshots report it.
+func DiffSystemMetrics(old, new SystemMetrics, thresholds Thresholds) *MetricsDiff {
+	oldValues := FlattenMetrics(old)
+	newValues := FlattenMetrics(new)
+
+	diff := &MetricsDiff{}
+	for _, metric := range MetricFamilies {
+		threshold, ok := thresholds[metric]
+		if !ok || threshold.Disabled {
+			continue
+		}
+		oldKeys, newKeys := oldValues[metric], newValues[metric]
+		if len(oldKeys) == 0 || len(newKeys) == 0 {
+			continue
+		}
+
+		for _, key := range sortedMetricKeys(newKeys) {
+			newValue := newKeys[key]
+			oldValue, exists := oldKeys[key]
+			if !exists {
+				diff.Changes = append(diff.Changes, MetricChange{Metric: metric, Key: key, New: newValue, Delta: newValue, Direction: DirectionAppeared})
+				continue
+			}
+			if !threshold.exceeds(oldValue, newValue) {
+				continue
+			}
+			direction := DirectionUp
+			if newValue < oldValue {
+				direction = DirectionDown
+			}
+			diff.Changes = append(diff.Changes, MetricChange{Metric: metric, Key: key, Old: oldValue, New: newValue, Delta: newValue - oldValue, Direction: direction})
+		}
+		for _, key := range sortedMetricKeys(oldKeys) {
+			if _, exists := newKeys[key]; !exists {
+				oldValue := oldKeys[key]
+				diff.Changes = append(diff.Changes, MetricChange{Metric: metric, Key: key, Old: oldValue, Delta: -oldValue, Direction: DirectionDisappeared})
+			}
+		}
+	}
+	return diff
+}
+
+func sortedMetricKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Changed reports whether any metric changed significantly.
+func (d *MetricsDiff) Changed() bool {
+	return d != nil && len(d.Changes) > 0
+}
+
+// String summarises the changes, e.g. "cpu_usage up 12.0 (40.0 -> 52.0); disk_usage[/data] appeared".
+func (d *MetricsDiff) String() string {
+	if !d.Changed() {
+		return ""
+	}
+	parts := make([]string, 0, len(d.Changes))
+	for _, change := range d.Changes {
+		name := change.Metric
+		if change.Key != "" {
+			name = fmt.Sprintf("%s[%s]", change.Metric, change.Key)
+		}
+		switch change.Direction {
+		case DirectionAppeared, DirectionDisappeared:
+			parts = append(parts, fmt.Sprintf("%s %s", name, change.Direction))
+		default:
+			parts = append(parts, fmt.Sprintf("%s %s %.1f (%.1f -> %.1f)", name, change.Direction, math.Abs(change.Delta), change.Old, change.New))
+		}
+	}
+	return strings.Join(parts, "; ")
+}
+
+// ChangePolicyService manages the change-detection policies of users.
+type ChangePolicyService struct {
+	repository *ChangePolicyRepository
+	groups     GroupResolver
+}
+
+func NewChangePolicyService(repository *ChangePolicyRepository) *ChangePolicyService {
+	return &ChangePolicyService{
+		repository: repository,
+	}
+}
+
+// SetGroupResolver registers how the groups of an agent are looked up for group thresholds.
+func (s *ChangePolicyService) SetGroupResolver(groups GroupResolver) {
+	s.groups = groups
+}
+
+// GetPolicy returns the policy of a user, or an empty policy when none has been saved.
+func (s *ChangePolicyService) GetPolicy(ctx context.Context, userID string) (*ChangePolicy, error) {
+	policy, err := s.repository.GetPolicy(ctx, userID)
+	if err == mongo.ErrNoDocuments {
+		return &ChangePolicy{UserID: userID}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// UpdatePolicy validates and saves the policy of a user.
+func (s *ChangePolicyService) UpdatePolicy(ctx context.Context, policy *ChangePolicy) error {
+	if policy.UserID == "" {
+		return fmt.Errorf("user ID is required")
+	}
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+	return s.repository.UpsertPolicy(ctx, policy)
+}
+
+// ResolveThresholds returns the effective thresholds for an agent under its owner's policy.
+func (s *ChangePolicyService) ResolveThresholds(ctx context.Context, info *AgentInfo) (Thresholds, error) {
+	policy, err := s.GetPolicy(ctx, info.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []string
+	if s.groups != nil {
+		if groups, err = s.groups(ctx, info); err != nil {
+			return nil, fmt.Errorf("failed to resolve agent groups: %v", err)
+		}
+	}
+	return policy.Resolve(info.ID.Hex(), groups), nil
+}
+
+// Diff compares two snapshots of an agent using the thresholds that apply to it.
+func (s *ChangePolicyService) Diff(ctx context.Context, info *AgentInfo, old, new SystemMetrics) (*MetricsDiff, error) {
+	thresholds, err := s.ResolveThresholds(ctx, info)
+	if err != nil {
+		return nil, err
+	}
+	return DiffSystemMetrics(old, new, thresholds), nil
+}
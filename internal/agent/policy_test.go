@@ -0,0 +1,152 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestThresholdExceeds(t *testing.T) {
+	testCases := []struct {
+		name      string
+		threshold Threshold
+		old, new  float64
+		expected  bool
+	}{
+		{"AbsoluteBelow", Threshold{Absolute: limit(5)}, 40, 44, false},
+		{"AbsoluteAbove", Threshold{Absolute: limit(5)}, 40, 46, true},
+		{"AbsoluteDown", Threshold{Absolute: limit(5)}, 40, 30, true},
+		{"RelativeBelow", Threshold{Relative: limit(10)}, 100, 109, false},
+		{"RelativeAbove", Threshold{Relative: limit(10)}, 100, 111, true},
+		{"RelativeFromZero", Threshold{Relative: limit(10)}, 0, 1, true},
+		{"BothRequireAbsolute", Threshold{Absolute: limit(10), Relative: limit(20)}, 10, 18, false},
+		{"BothRequireRelative", Threshold{Absolute: limit(10), Relative: limit(20)}, 100, 115, false},
+		{"BothExceeded", Threshold{Absolute: limit(10), Relative: limit(20)}, 100, 125, true},
+		{"DirectionUpIgnoresDown", Threshold{Absolute: limit(0), Direction: DirectionUp}, 5, 2, false},
+		{"DirectionDownIgnoresUp", Threshold{Absolute: limit(0), Direction: DirectionDown}, 5, 9, false},
+		{"NoChange", Threshold{Absolute: limit(0)}, 5, 5, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, tc.threshold.exceeds(tc.old, tc.new))
+		})
+	}
+}
+
+func TestDiffSystemMetrics(t *testing.T) {
+	old := extendedMetrics()
+	old.FSUsage = map[string]string{"/": "40%"}
+
+	t.Run("StructuredChanges", func(t *testing.T) {
+		updated := extendedMetrics()
+		updated.CPUUsage = 60
+		updated.FSUsage = map[string]string{"/": "52%"}
+		updated.DiskUsage = map[string]int64{"/": 1024, "/data": 2048}
+
+		diff := DiffSystemMetrics(old, updated, DefaultThresholds())
+
+		assert.Equal(t, []MetricChange{
+			{Metric: MetricCPUUsage, Old: 45.5, New: 60, Delta: 14.5, Direction: DirectionUp},
+			{Metric: MetricDiskUsage, Key: "/data", New: 2048, Delta: 2048, Direction: DirectionAppeared},
+			{Metric: MetricFSUsage, Key: "/", Old: 40, New: 52, Delta: 12, Direction: DirectionUp},
+		}, diff.Changes)
+		assert.Equal(t, "cpu_usage up 14.5 (45.5 -> 60.0); disk_usage[/data] appeared; fs_usage[/] up 12.0 (40.0 -> 52.0)", diff.String())
+	})
+
+	t.Run("Disappeared", func(t *testing.T) {
+		updated := extendedMetrics()
+		updated.Network = map[string]NetworkInterface{"eth1": {RxBytesPerSec: 10}}
+
+		diff := DiffSystemMetrics(old, updated, Thresholds{MetricNetworkRxBytesPerSec: {Relative: limit(50)}})
+
+		assert.Equal(t, []MetricChange{
+			{Metric: MetricNetworkRxBytesPerSec, Key: "eth1", New: 10, Delta: 10, Direction: DirectionAppeared},
+			{Metric: MetricNetworkRxBytesPerSec, Key: "eth0", Old: 1024, Delta: -1024, Direction: DirectionDisappeared},
+		}, diff.Changes)
+	})
+
+	t.Run("DisabledMetric", func(t *testing.T) {
+		updated := extendedMetrics()
+		updated.CPUUsage = 90
+
+		thresholds := DefaultThresholds()
+		thresholds[MetricCPUUsage] = Threshold{Disabled: true}
+		assert.False(t, DiffSystemMetrics(old, updated, thresholds).Changed())
+	})
+
+	t.Run("NoChanges", func(t *testing.T) {
+		diff := DiffSystemMetrics(old, old, DefaultThresholds())
+		assert.False(t, diff.Changed())
+		assert.Empty(t, diff.String())
+	})
+}
+
+func TestChangePolicyResolve(t *testing.T) {
+	agentID := bson.NewObjectID().Hex()
+	policy := &ChangePolicy{
+		Global: Thresholds{
+			MetricCPUUsage: {Absolute: limit(20)},
+			MetricFSUsage:  {Absolute: limit(2)},
+		},
+		Groups: map[string]Thresholds{
+			"db":  {MetricCPUUsage: {Absolute: limit(15)}},
+			"web": {MetricCPUUsage: {Absolute: limit(30)}, MetricLoad1: {Disabled: true}},
+		},
+		Agents: map[string]Thresholds{
+			agentID: {MetricCPUUsage: {Absolute: limit(1)}},
+		},
+	}
+
+	t.Run("NilPolicyUsesDefaults", func(t *testing.T) {
+		var empty *ChangePolicy
+		assert.Equal(t, DefaultThresholds(), empty.Resolve(agentID, nil))
+	})
+
+	t.Run("Global", func(t *testing.T) {
+		thresholds := policy.Resolve("other", nil)
+		assert.Equal(t, 20.0, *thresholds[MetricCPUUsage].Absolute)
+		assert.Equal(t, 2.0, *thresholds[MetricFSUsage].Absolute)
+		// Metrics not in the policy keep their defaults
+		assert.Equal(t, DefaultThresholds()[MetricDiskUsage], thresholds[MetricDiskUsage])
+	})
+
+	t.Run("GroupsInNameOrder", func(t *testing.T) {
+		thresholds := policy.Resolve("other", []string{"web", "db"})
+		assert.Equal(t, 30.0, *thresholds[MetricCPUUsage].Absolute)
+		assert.True(t, thresholds[MetricLoad1].Disabled)
+	})
+
+	t.Run("AgentOverridesGroups", func(t *testing.T) {
+		thresholds := policy.Resolve(agentID, []string{"db"})
+		assert.Equal(t, 1.0, *thresholds[MetricCPUUsage].Absolute)
+		assert.Equal(t, 2.0, *thresholds[MetricFSUsage].Absolute)
+	})
+}
+
+func TestChangePolicyValidate(t *testing.T) {
+	assert.NoError(t, (&ChangePolicy{Global: DefaultThresholds()}).Validate())
+
+	testCases := []struct {
+		name   string
+		policy ChangePolicy
+	}{
+		{"UnknownMetric", ChangePolicy{Global: Thresholds{"cpu": {Absolute: limit(5)}}}},
+		{"NegativeAbsolute", ChangePolicy{Global: Thresholds{MetricCPUUsage: {Absolute: limit(-1)}}}},
+		{"NegativeRelative", ChangePolicy{Global: Thresholds{MetricCPUUsage: {Relative: limit(-1)}}}},
+		{"InvalidDirection", ChangePolicy{Global: Thresholds{MetricCPUUsage: {Absolute: limit(5), Direction: "sideways"}}}},
+		{"NoThreshold", ChangePolicy{Global: Thresholds{MetricCPUUsage: {}}}},
+		{"EmptyGroupName", ChangePolicy{Groups: map[string]Thresholds{"": {}}}},
+		{"InvalidGroupThreshold", ChangePolicy{Groups: map[string]Thresholds{"db": {"cpu": {Absolute: limit(5)}}}}},
+		{"InvalidAgentID", ChangePolicy{Agents: map[string]Thresholds{"not-an-id": {}}}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.policy.Validate()
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), "invalid threshold")
+		})
+	}
+}
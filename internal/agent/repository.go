@@ -3,10 +3,15 @@ package agent
 import (
 	"context"
 	"fmt"
+	"regexp"
+	"slices"
 	"time"
 
 	"go.mongodb.org/mongo-driver/v2/bson"
 	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+
+	"github.com/harshavmb/nannyapi/internal/token"
 )
 
 type AgentInfoRepository struct {
@@ -24,9 +29,24 @@ func (r *AgentInfoRepository) InsertAgentInfo(ctx context.Context, agentInfo *Ag
 	return r.collection.InsertOne(ctx, agentInfo)
 }
 
+// UpdateAgentInfo stores what the agent reports about its host. The owner, labels and lifecycle fields of the
+// agent are left alone.
 func (r *AgentInfoRepository) UpdateAgentInfo(ctx context.Context, info *AgentInfo) error {
 	filter := bson.M{"_id": info.ID}
-	update := bson.M{"$set": info}
+	set := bson.M{
+		"hostname":       info.Hostname,
+		"ip_address":     info.IPAddress,
+		"kernel_version": info.KernelVersion,
+		"os_version":     info.OsVersion,
+		"system_metrics": info.SystemMetrics,
+		"status":         info.Status,
+		"last_seen":      info.LastSeen,
+		"updated_at":     info.UpdatedAt,
+	}
+	if info.MachineID != "" {
+		set["machine_id"] = info.MachineID
+	}
+	update := bson.M{"$set": set}
 
 	result, err := r.collection.UpdateOne(ctx, filter, update)
 	if err != nil {
@@ -55,7 +75,159 @@ func (r *AgentInfoRepository) GetAgentInfoByID(ctx context.Context, id bson.Obje
 }
 
 func (r *AgentInfoRepository) GetAgents(ctx context.Context, userID string) ([]*AgentInfo, error) {
+	return r.findAgents(ctx, bson.M{"user_id": userID})
+}
+
+// GetAgentsByStatus retrieves the agents of a user in any of the given liveness states.
+func (r *AgentInfoRepository) GetAgentsByStatus(ctx context.Context, userID string, statuses []string) ([]*AgentInfo, error) {
+	return r.findAgents(ctx, bson.M{"user_id": userID, "status": statusFilter(statuses)})
+}
+
+// statusFilter matches agents in any of the liveness states. Agents saved before statuses were tracked
+// have none and count as offline.
+func statusFilter(statuses []string) bson.M {
+	values := make([]interface{}, 0, len(statuses)+1)
+	for _, status := range statuses {
+		values = append(values, status)
+	}
+	if slices.Contains(statuses, StatusOffline) {
+		values = append(values, nil)
+	}
+	return bson.M{"$in": values}
+}
+
+// FindAgents retrieves the agents of a user matching the query.
+func (r *AgentInfoRepository) FindAgents(ctx context.Context, userID string, query AgentQuery) ([]*AgentInfo, error) {
 	filter := bson.M{"user_id": userID}
+	if len(query.Statuses) > 0 {
+		filter["status"] = statusFilter(query.Statuses)
+	}
+	if query.OS != "" {
+		filter["os_version"] = bson.M{"$regex": regexp.QuoteMeta(query.OS), "$options": "i"}
+	}
+	if conditions := query.Selector.Filter(); len(conditions) > 0 {
+		filter["$and"] = conditions
+	}
+	return r.findAgents(ctx, filter)
+}
+
+// SetLabels replaces the labels of an agent.
+func (r *AgentInfoRepository) SetLabels(ctx context.Context, id bson.ObjectID, labels map[string]string) error {
+	update := bson.M{"$set": bson.M{"labels": labels}}
+	if len(labels) == 0 {
+		update = bson.M{"$unset": bson.M{"labels": ""}}
+	}
+	result, err := r.collection.UpdateByID(ctx, id, update)
+	if err != nil {
+		return fmt.Errorf("failed to update agent labels: %v", err)
+	}
+	if result.MatchedCount == 0 {
+		return fmt.Errorf("agent not found")
+	}
+	return nil
+}
+
+// GetAgentsToMonitor retrieves all agents that are not yet offline and have reported at least once, and the
+// agents saved before statuses were tracked, which have no status yet.
+func (r *AgentInfoRepository) GetAgentsToMonitor(ctx context.Context) ([]*AgentInfo, error) {
+	filter := bson.M{"$or": []bson.M{
+		{"status": bson.M{"$in": []string{StatusOnline, StatusStale}}, "last_seen": bson.M{"$exists": true}},
+		{"status": bson.M{"$exists": false}},
+	}}
+	return r.findAgents(ctx, filter)
+}
+
+// RecordHeartbeat marks the agent as online and returns the agent as it was before the heartbeat.
+func (r *AgentInfoRepository) RecordHeartbeat(ctx context.Context, id bson.ObjectID, heartbeat Heartbeat, seenAt time.Time) (*AgentInfo, error) {
+	filter := bson.M{"_id": id}
+	update := bson.M{"$set": bson.M{
+		"status":         StatusOnline,
+		"last_seen":      seenAt,
+		"agent_version":  heartbeat.AgentVersion,
+		"uptime_seconds": heartbeat.UptimeSeconds,
+	}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.Before)
+
+	var previous AgentInfo
+	err := r.collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&previous)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, mongo.ErrNoDocuments
+		}
+		return nil, fmt.Errorf("failed to record heartbeat: %v", err)
+	}
+	return &previous, nil
+}
+
+// UpdateStatus changes the liveness state of an agent unless a newer heartbeat arrived since lastSeen, or
+// the agent was decommissioned. It reports whether the status was changed.
+func (r *AgentInfoRepository) UpdateStatus(ctx context.Context, id bson.ObjectID, status string, lastSeen time.Time) (bool, error) {
+	filter := bson.M{"_id": id, "last_seen": lastSeen, "status": bson.M{"$ne": StatusDecommissioned}}
+	if lastSeen.IsZero() {
+		filter["last_seen"] = bson.M{"$exists": false}
+	}
+	update := bson.M{"$set": bson.M{"status": status}}
+	result, err := r.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, fmt.Errorf("failed to update agent status: %v", err)
+	}
+	return result.ModifiedCount > 0, nil
+}
+
+// GetAgentByMachineID retrieves the agent of a user with the machine ID, or nil if there is none.
+// Decommissioned agents are not matched, so a machine that is set up again gets a new agent.
+func (r *AgentInfoRepository) GetAgentByMachineID(ctx context.Context, userID, machineID string) (*AgentInfo, error) {
+	filter := bson.M{"user_id": userID, "machine_id": machineID, "status": bson.M{"$ne": StatusDecommissioned}}
+	// Prefer the oldest record if duplicates were created before the agent reported its machine ID
+	opts := options.FindOne().SetSort(bson.M{"created_at": 1})
+
+	var agentInfo AgentInfo
+	err := r.collection.FindOne(ctx, filter, opts).Decode(&agentInfo)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to retrieve agent: %v", err)
+	}
+	return &agentInfo, nil
+}
+
+// SetMachineID records the machine identity of an agent.
+func (r *AgentInfoRepository) SetMachineID(ctx context.Context, id bson.ObjectID, machineID string) error {
+	if _, err := r.collection.UpdateByID(ctx, id, bson.M{"$set": bson.M{"machine_id": machineID}}); err != nil {
+		return fmt.Errorf("failed to update agent machine ID: %v", err)
+	}
+	return nil
+}
+
+// Decommission marks an agent as decommissioned. It reports false when the agent was already decommissioned.
+func (r *AgentInfoRepository) Decommission(ctx context.Context, id bson.ObjectID, decommissionedAt time.Time, archivedUntil *time.Time) (bool, error) {
+	filter := bson.M{"_id": id, "status": bson.M{"$ne": StatusDecommissioned}}
+	set := bson.M{"status": StatusDecommissioned, "decommissioned_at": decommissionedAt}
+	if archivedUntil != nil {
+		set["archived_until"] = *archivedUntil
+	}
+	result, err := r.collection.UpdateOne(ctx, filter, bson.M{"$set": set})
+	if err != nil {
+		return false, fmt.Errorf("failed to decommission agent: %v", err)
+	}
+	return result.ModifiedCount > 0, nil
+}
+
+// DeleteAgentInfo deletes an agent.
+func (r *AgentInfoRepository) DeleteAgentInfo(ctx context.Context, id bson.ObjectID) error {
+	if _, err := r.collection.DeleteOne(ctx, bson.M{"_id": id}); err != nil {
+		return fmt.Errorf("failed to delete agent: %v", err)
+	}
+	return nil
+}
+
+// GetExpiredArchives retrieves the decommissioned agents whose archive period ended.
+func (r *AgentInfoRepository) GetExpiredArchives(ctx context.Context, now time.Time) ([]*AgentInfo, error) {
+	return r.findAgents(ctx, bson.M{"status": StatusDecommissioned, "archived_until": bson.M{"$lte": now}})
+}
+
+func (r *AgentInfoRepository) findAgents(ctx context.Context, filter bson.M) ([]*AgentInfo, error) {
 	var agents []*AgentInfo
 	cursor, err := r.collection.Find(ctx, filter)
 	if err != nil {
@@ -79,3 +251,320 @@ func (r *AgentInfoRepository) GetAgents(ctx context.Context, userID string) ([]*
 	}
 	return agents, nil
 }
+
+type ChangePolicyRepository struct {
+	collection *mongo.Collection
+}
+
+func NewChangePolicyRepository(db *mongo.Database) *ChangePolicyRepository {
+	return &ChangePolicyRepository{
+		collection: db.Collection("change_policies"),
+	}
+}
+
+func (r *ChangePolicyRepository) GetPolicy(ctx context.Context, userID string) (*ChangePolicy, error) {
+	var policy ChangePolicy
+	err := r.collection.FindOne(ctx, bson.M{"user_id": userID}).Decode(&policy)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, mongo.ErrNoDocuments
+		}
+		return nil, fmt.Errorf("failed to retrieve change policy: %v", err)
+	}
+	return &policy, nil
+}
+
+func (r *ChangePolicyRepository) UpsertPolicy(ctx context.Context, policy *ChangePolicy) error {
+	policy.UpdatedAt = time.Now()
+
+	filter := bson.M{"user_id": policy.UserID}
+	update := bson.M{"$set": bson.M{
+		"user_id":    policy.UserID,
+		"global":     policy.Global,
+		"groups":     policy.Groups,
+		"agents":     policy.Agents,
+		"updated_at": policy.UpdatedAt,
+	}}
+	opts := options.UpdateOne().SetUpsert(true)
+	if _, err := r.collection.UpdateOne(ctx, filter, update, opts); err != nil {
+		return fmt.Errorf("failed to save change policy: %v", err)
+	}
+	return nil
+}
+
+type GroupRepository struct {
+	collection *mongo.Collection
+}
+
+func NewGroupRepository(db *mongo.Database) *GroupRepository {
+	return &GroupRepository{
+		collection: db.Collection("agent_groups"),
+	}
+}
+
+func (r *GroupRepository) InsertGroup(ctx context.Context, group *Group) error {
+	group.CreatedAt = time.Now()
+	group.UpdatedAt = group.CreatedAt
+	result, err := r.collection.InsertOne(ctx, group)
+	if err != nil {
+		return fmt.Errorf("failed to insert group: %v", err)
+	}
+	group.ID = result.InsertedID.(bson.ObjectID)
+	return nil
+}
+
+// GetGroup returns the group with the ID, or nil if there is none.
+func (r *GroupRepository) GetGroup(ctx context.Context, id bson.ObjectID) (*Group, error) {
+	return r.findGroup(ctx, bson.M{"_id": id})
+}
+
+// GetGroupByName returns the group of a user with the name, or nil if there is none.
+func (r *GroupRepository) GetGroupByName(ctx context.Context, userID, name string) (*Group, error) {
+	return r.findGroup(ctx, bson.M{"user_id": userID, "name": name})
+}
+
+func (r *GroupRepository) findGroup(ctx context.Context, filter bson.M) (*Group, error) {
+	var group Group
+	err := r.collection.FindOne(ctx, filter).Decode(&group)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to retrieve group: %v", err)
+	}
+	return &group, nil
+}
+
+// ListGroups returns the groups of a user ordered by name.
+func (r *GroupRepository) ListGroups(ctx context.Context, userID string) ([]*Group, error) {
+	opts := options.Find().SetSort(bson.M{"name": 1})
+	cursor, err := r.collection.Find(ctx, bson.M{"user_id": userID}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list groups: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	var groups []*Group
+	if err := cursor.All(ctx, &groups); err != nil {
+		return nil, fmt.Errorf("failed to decode groups: %v", err)
+	}
+	return groups, nil
+}
+
+func (r *GroupRepository) UpdateGroup(ctx context.Context, group *Group) error {
+	group.UpdatedAt = time.Now()
+	update := bson.M{"$set": bson.M{
+		"name":        group.Name,
+		"description": group.Description,
+		"selector":    group.Selector,
+		"updated_at":  group.UpdatedAt,
+	}}
+	result, err := r.collection.UpdateOne(ctx, bson.M{"_id": group.ID, "user_id": group.UserID}, update)
+	if err != nil {
+		return fmt.Errorf("failed to update group: %v", err)
+	}
+	if result.MatchedCount == 0 {
+		return fmt.Errorf("group not found")
+	}
+	return nil
+}
+
+func (r *GroupRepository) DeleteGroup(ctx context.Context, id bson.ObjectID, userID string) error {
+	result, err := r.collection.DeleteOne(ctx, bson.M{"_id": id, "user_id": userID})
+	if err != nil {
+		return fmt.Errorf("failed to delete group: %v", err)
+	}
+	if result.DeletedCount == 0 {
+		return fmt.Errorf("group not found")
+	}
+	return nil
+}
+
+type EnrollmentRepository struct {
+	tokens      *mongo.Collection
+	credentials *mongo.Collection
+}
+
+// credentialsCollection holds agent credentials. Its name is part of the additional data of their secrets.
+const credentialsCollection = "agent_credentials"
+
+func NewEnrollmentRepository(db *mongo.Database) *EnrollmentRepository {
+	return &EnrollmentRepository{
+		tokens:      db.Collection("enrollment_tokens"),
+		credentials: db.Collection(credentialsCollection),
+	}
+}
+
+// credentialAAD returns the additional data the secret of the credential with the ID is encrypted with.
+func credentialAAD(id bson.ObjectID) []byte {
+	return token.AAD(credentialsCollection, "encrypted_credential", id.Hex())
+}
+
+// EncryptedField returns the field holding agent credentials, encrypted with the envelope.
+func (r *EnrollmentRepository) EncryptedField() token.EncryptedField {
+	return token.EncryptedField{Collection: r.credentials, Field: "encrypted_credential"}
+}
+
+func (r *EnrollmentRepository) InsertEnrollmentToken(ctx context.Context, enrollment *EnrollmentToken) error {
+	result, err := r.tokens.InsertOne(ctx, enrollment)
+	if err != nil {
+		return fmt.Errorf("failed to insert enrollment token: %v", err)
+	}
+	enrollment.ID = result.InsertedID.(bson.ObjectID)
+	return nil
+}
+
+// GetEnrollmentToken returns the enrollment token with the ID, or nil if there is none.
+func (r *EnrollmentRepository) GetEnrollmentToken(ctx context.Context, id bson.ObjectID) (*EnrollmentToken, error) {
+	var enrollment EnrollmentToken
+	err := r.tokens.FindOne(ctx, bson.M{"_id": id}).Decode(&enrollment)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to retrieve enrollment token: %v", err)
+	}
+	return &enrollment, nil
+}
+
+// ListEnrollmentTokens returns the enrollment tokens of a user, newest first.
+func (r *EnrollmentRepository) ListEnrollmentTokens(ctx context.Context, userID string) ([]*EnrollmentToken, error) {
+	opts := options.Find().SetSort(bson.M{"created_at": -1})
+	cursor, err := r.tokens.Find(ctx, bson.M{"user_id": userID}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list enrollment tokens: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	var enrollments []*EnrollmentToken
+	if err := cursor.All(ctx, &enrollments); err != nil {
+		return nil, fmt.Errorf("failed to decode enrollment tokens: %v", err)
+	}
+	return enrollments, nil
+}
+
+func (r *EnrollmentRepository) DeleteEnrollmentToken(ctx context.Context, id bson.ObjectID) error {
+	if _, err := r.tokens.DeleteOne(ctx, bson.M{"_id": id}); err != nil {
+		return fmt.Errorf("failed to delete enrollment token: %v", err)
+	}
+	return nil
+}
+
+// UseEnrollmentToken marks the unused, unexpired enrollment token with the hash as used and returns it.
+// It returns nil when there is no such token, so a token can only be used once.
+func (r *EnrollmentRepository) UseEnrollmentToken(ctx context.Context, hashedToken string, now time.Time) (*EnrollmentToken, error) {
+	filter := bson.M{
+		"hashed_token": hashedToken,
+		"used_at":      bson.M{"$exists": false},
+		"expires_at":   bson.M{"$gt": now},
+	}
+	update := bson.M{"$set": bson.M{"used_at": now}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var enrollment EnrollmentToken
+	err := r.tokens.FindOneAndUpdate(ctx, filter, update, opts).Decode(&enrollment)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to use enrollment token: %v", err)
+	}
+	return &enrollment, nil
+}
+
+// SetEnrollmentAgent records the agent that used an enrollment token.
+func (r *EnrollmentRepository) SetEnrollmentAgent(ctx context.Context, id bson.ObjectID, agentID string) error {
+	if _, err := r.tokens.UpdateByID(ctx, id, bson.M{"$set": bson.M{"agent_id": agentID}}); err != nil {
+		return fmt.Errorf("failed to update enrollment token: %v", err)
+	}
+	return nil
+}
+
+func (r *EnrollmentRepository) InsertCredential(ctx context.Context, credential *Credential) error {
+	result, err := r.credentials.InsertOne(ctx, credential)
+	if err != nil {
+		return fmt.Errorf("failed to insert credential: %v", err)
+	}
+	credential.ID = result.InsertedID.(bson.ObjectID)
+	return nil
+}
+
+// GetCredential returns the credential with the ID, or nil if there is none.
+func (r *EnrollmentRepository) GetCredential(ctx context.Context, id bson.ObjectID) (*Credential, error) {
+	return r.findCredential(ctx, bson.M{"_id": id})
+}
+
+// GetCredentialByHash returns the credential with the hash, or nil if there is none.
+func (r *EnrollmentRepository) GetCredentialByHash(ctx context.Context, hashedCredential string) (*Credential, error) {
+	return r.findCredential(ctx, bson.M{"hashed_credential": hashedCredential})
+}
+
+func (r *EnrollmentRepository) findCredential(ctx context.Context, filter bson.M) (*Credential, error) {
+	var credential Credential
+	err := r.credentials.FindOne(ctx, filter).Decode(&credential)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to retrieve credential: %v", err)
+	}
+	return &credential, nil
+}
+
+// ListCredentials returns the credentials of an agent, oldest first.
+func (r *EnrollmentRepository) ListCredentials(ctx context.Context, agentID string) ([]*Credential, error) {
+	opts := options.Find().SetSort(bson.M{"created_at": 1})
+	cursor, err := r.credentials.Find(ctx, bson.M{"agent_id": agentID}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list credentials: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	var credentials []*Credential
+	if err := cursor.All(ctx, &credentials); err != nil {
+		return nil, fmt.Errorf("failed to decode credentials: %v", err)
+	}
+	return credentials, nil
+}
+
+func (r *EnrollmentRepository) RevokeCredential(ctx context.Context, id bson.ObjectID, revokedAt time.Time) error {
+	if _, err := r.credentials.UpdateByID(ctx, id, bson.M{"$set": bson.M{"revoked_at": revokedAt}}); err != nil {
+		return fmt.Errorf("failed to revoke credential: %v", err)
+	}
+	return nil
+}
+
+// RevokeAgentCredentials revokes the credentials of an agent that are not revoked yet and returns how many
+// were revoked.
+func (r *EnrollmentRepository) RevokeAgentCredentials(ctx context.Context, agentID string, revokedAt time.Time) (int64, error) {
+	filter := bson.M{"agent_id": agentID, "revoked_at": bson.M{"$exists": false}}
+	result, err := r.credentials.UpdateMany(ctx, filter, bson.M{"$set": bson.M{"revoked_at": revokedAt}})
+	if err != nil {
+		return 0, fmt.Errorf("failed to revoke agent credentials: %v", err)
+	}
+	return result.ModifiedCount, nil
+}
+
+// ReassignAgentCredentials moves the credentials of an agent to another agent and returns how many were moved.
+func (r *EnrollmentRepository) ReassignAgentCredentials(ctx context.Context, fromAgentID, toAgentID string) (int64, error) {
+	result, err := r.credentials.UpdateMany(ctx, bson.M{"agent_id": fromAgentID}, bson.M{"$set": bson.M{"agent_id": toAgentID}})
+	if err != nil {
+		return 0, fmt.Errorf("failed to reassign agent credentials: %v", err)
+	}
+	return result.ModifiedCount, nil
+}
+
+// TouchCredential records the use of a credential, unless a use was recorded within the interval.
+func (r *EnrollmentRepository) TouchCredential(ctx context.Context, id bson.ObjectID, now time.Time, interval time.Duration) error {
+	filter := bson.M{
+		"_id": id,
+		"$or": bson.A{
+			bson.M{"last_used_at": bson.M{"$exists": false}},
+			bson.M{"last_used_at": bson.M{"$lt": now.Add(-interval)}},
+		},
+	}
+	if _, err := r.credentials.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"last_used_at": now}}); err != nil {
+		return fmt.Errorf("failed to update credential: %v", err)
+	}
+	return nil
+}
@@ -3,7 +3,9 @@ package agent
 import (
 	"context"
 	"os"
+	"slices"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"go.mongodb.org/mongo-driver/v2/bson"
@@ -103,6 +105,7 @@ func TestAgentInfoRepository(t *testing.T) {
 		agentInfo.ID = result.InsertedID.(bson.ObjectID)
 		agentInfo.SystemMetrics.CPUUsage = 75.0
 		agentInfo.SystemMetrics.MemoryUsed = 12 * 1024 * 1024 * 1024 // 12GB
+		agentInfo.UserID = "654321"                                  // Not reported by agents, so left alone
 
 		err = repo.UpdateAgentInfo(context.Background(), agentInfo)
 		assert.NoError(t, err)
@@ -112,6 +115,7 @@ func TestAgentInfoRepository(t *testing.T) {
 		assert.NoError(t, err)
 		assert.Equal(t, 75.0, updatedAgentInfo.SystemMetrics.CPUUsage)
 		assert.Equal(t, int64(12*1024*1024*1024), updatedAgentInfo.SystemMetrics.MemoryUsed)
+		assert.Equal(t, "123456", updatedAgentInfo.UserID)
 	})
 
 	t.Run("GetAgentInfoByID", func(t *testing.T) {
@@ -196,3 +200,79 @@ func TestGetAgents(t *testing.T) {
 		assert.Empty(t, result)
 	})
 }
+
+func TestAgentHeartbeat(t *testing.T) {
+	client, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	repo := NewAgentInfoRepository(client.Database(testDBName))
+
+	t.Run("RecordHeartbeat", func(t *testing.T) {
+		agentInfo := &AgentInfo{
+			UserID:        "123456",
+			Hostname:      "heartbeat-host",
+			IPAddress:     "192.168.1.4",
+			KernelVersion: "5.10.0",
+			OsVersion:     "Ubuntu 24.04",
+			Status:        StatusOffline,
+		}
+		result, err := repo.InsertAgentInfo(context.Background(), agentInfo)
+		assert.NoError(t, err)
+		agentID := result.InsertedID.(bson.ObjectID)
+
+		seenAt := time.Now()
+		previous, err := repo.RecordHeartbeat(context.Background(), agentID, Heartbeat{AgentVersion: "1.2.0", UptimeSeconds: 3600}, seenAt)
+		assert.NoError(t, err)
+		assert.Equal(t, StatusOffline, previous.Status)
+
+		updated, err := repo.GetAgentInfoByID(context.Background(), agentID)
+		assert.NoError(t, err)
+		assert.Equal(t, StatusOnline, updated.Status)
+		assert.Equal(t, "1.2.0", updated.AgentVersion)
+		assert.Equal(t, int64(3600), updated.UptimeSeconds)
+		assert.WithinDuration(t, seenAt, updated.LastSeen, time.Millisecond)
+
+		// Status updates are skipped once a newer heartbeat has arrived
+		changed, err := repo.UpdateStatus(context.Background(), agentID, StatusStale, seenAt.Add(-time.Minute))
+		assert.NoError(t, err)
+		assert.False(t, changed)
+
+		changed, err = repo.UpdateStatus(context.Background(), agentID, StatusStale, updated.LastSeen)
+		assert.NoError(t, err)
+		assert.True(t, changed)
+
+		stale, err := repo.GetAgentsByStatus(context.Background(), "123456", []string{StatusStale})
+		assert.NoError(t, err)
+		assert.Len(t, stale, 1)
+	})
+
+	t.Run("AgentWithoutStatus", func(t *testing.T) {
+		// Agents saved before statuses were tracked have no status or last_seen
+		result, err := repo.collection.InsertOne(context.Background(), bson.M{"user_id": "legacy-user", "hostname": "legacy-host"})
+		assert.NoError(t, err)
+		agentID := result.InsertedID.(bson.ObjectID)
+
+		offline, err := repo.FindAgents(context.Background(), "legacy-user", AgentQuery{Statuses: []string{StatusOffline}})
+		assert.NoError(t, err)
+		assert.Len(t, offline, 1)
+		online, err := repo.GetAgentsByStatus(context.Background(), "legacy-user", []string{StatusOnline})
+		assert.NoError(t, err)
+		assert.Empty(t, online)
+
+		monitored, err := repo.GetAgentsToMonitor(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, slices.ContainsFunc(monitored, func(a *AgentInfo) bool { return a.ID == agentID }))
+
+		changed, err := repo.UpdateStatus(context.Background(), agentID, StatusOffline, time.Time{})
+		assert.NoError(t, err)
+		assert.True(t, changed)
+		updated, err := repo.GetAgentInfoByID(context.Background(), agentID)
+		assert.NoError(t, err)
+		assert.Equal(t, StatusOffline, updated.Status)
+	})
+
+	t.Run("HeartbeatUnknownAgent", func(t *testing.T) {
+		_, err := repo.RecordHeartbeat(context.Background(), bson.NewObjectID(), Heartbeat{}, time.Now())
+		assert.Equal(t, mongo.ErrNoDocuments, err)
+	})
+}
@@ -3,6 +3,8 @@ package agent
 import (
 	"context"
 	"fmt"
+	"log"
+	"sync"
 	"time"
 
 	"go.mongodb.org/mongo-driver/v2/bson"
@@ -11,16 +13,26 @@ import (
 
 type AgentInfoService struct {
 	repository *AgentInfoRepository
+
+	listenersMu      sync.RWMutex
+	listeners        []StatusListener
+	metricsListeners []MetricsListener
 }
 
+// MetricsListener is called with every metrics report saved for an agent.
+type MetricsListener func(ctx context.Context, info *AgentInfo) error
+
 func NewAgentInfoService(repository *AgentInfoRepository) *AgentInfoService {
 	return &AgentInfoService{
 		repository: repository,
 	}
 }
 
-// SaveAgentInfo saves or updates agent information.
+// SaveAgentInfo saves or updates agent information. Agents posted without an ID are matched to an
+// existing agent of the user by their machine ID, so an agent that lost its ID does not create a duplicate.
 func (s *AgentInfoService) SaveAgentInfo(ctx context.Context, info AgentInfo) (*mongo.InsertOneResult, error) {
+	info.MachineID = NormalizeMachineID(info.MachineID)
+
 	// Check if agent exists
 	var existingAgent *AgentInfo
 	if !info.ID.IsZero() {
@@ -29,23 +41,81 @@ func (s *AgentInfoService) SaveAgentInfo(ctx context.Context, info AgentInfo) (*
 		if err != nil && err != mongo.ErrNoDocuments {
 			return nil, fmt.Errorf("failed to check existing agent: %v", err)
 		}
+	} else if info.MachineID != "" {
+		var err error
+		existingAgent, err = s.repository.GetAgentByMachineID(ctx, info.UserID, info.MachineID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check existing agent: %v", err)
+		}
+		if existingAgent != nil {
+			log.Printf("Agent %s matched by machine ID %s", existingAgent.ID.Hex(), info.MachineID)
+			info.ID = existingAgent.ID
+		}
+	}
+
+	if existingAgent != nil && existingAgent.UserID != info.UserID {
+		return nil, fmt.Errorf("agent does not belong to user")
+	}
+	if existingAgent != nil && existingAgent.Status == StatusDecommissioned {
+		return nil, fmt.Errorf("agent is decommissioned")
 	}
 
 	info.UpdatedAt = time.Now()
+
+	// Posting agent info is as good a sign of life as a heartbeat
+	info.LastSeen = info.UpdatedAt
+	info.Status = StatusOnline
+
 	if existingAgent == nil {
 		info.CreatedAt = info.UpdatedAt
-		return s.repository.InsertAgentInfo(ctx, &info)
+		result, err := s.repository.InsertAgentInfo(ctx, &info)
+		if err != nil {
+			return nil, err
+		}
+		info.ID = result.InsertedID.(bson.ObjectID)
+		s.emitMetricsReported(ctx, &info)
+		return result, nil
 	}
 
+	// Labels of registered agents are managed through SetLabels, not by the agent's reports
+	info.Labels = existingAgent.Labels
+	info.CreatedAt = existingAgent.CreatedAt
+
 	// Update existing agent
 	err := s.repository.UpdateAgentInfo(ctx, &info)
 	if err != nil {
 		return nil, err
 	}
 
+	if existingAgent.Status != StatusOnline {
+		s.emitStatusChange(existingAgent, StatusOnline, info.LastSeen)
+	}
+	s.emitMetricsReported(ctx, &info)
+
 	return &mongo.InsertOneResult{InsertedID: info.ID}, nil
 }
 
+// OnMetricsReported registers a listener for incoming metrics reports.
+func (s *AgentInfoService) OnMetricsReported(listener MetricsListener) {
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+	s.metricsListeners = append(s.metricsListeners, listener)
+}
+
+// emitMetricsReported hands the saved report to every listener. Failures are only logged
+// so they never fail the agent's post.
+func (s *AgentInfoService) emitMetricsReported(ctx context.Context, info *AgentInfo) {
+	s.listenersMu.RLock()
+	listeners := append([]MetricsListener(nil), s.metricsListeners...)
+	s.listenersMu.RUnlock()
+
+	for _, listener := range listeners {
+		if err := listener(ctx, info); err != nil {
+			log.Printf("Failed to process metrics report of agent %s: %v", info.ID.Hex(), err)
+		}
+	}
+}
+
 // GetAgentInfoByID retrieves agent information by ID.
 func (s *AgentInfoService) GetAgentInfoByID(ctx context.Context, id bson.ObjectID) (*AgentInfo, error) {
 	return s.repository.GetAgentInfoByID(ctx, id)
@@ -63,46 +133,124 @@ func (s *AgentInfoService) GetAgents(ctx context.Context, userID string) ([]*Age
 	return agents, nil
 }
 
-// HasSystemMetricsChanged checks if there are significant changes in system metrics.
-func (s *AgentInfoService) HasSystemMetricsChanged(old, new SystemMetrics) bool {
-	// CPU usage change threshold (5%)
-	if abs(new.CPUUsage-old.CPUUsage) > 5.0 {
-		return true
-	}
-
-	// Memory change threshold (10%)
-	memoryThreshold := float64(old.MemoryTotal) * 0.10
-	if abs(float64(new.MemoryUsed-old.MemoryUsed)) > memoryThreshold {
-		return true
-	}
-
-	// Check disk usage changes (10% threshold)
-	for mountPoint, newUsage := range new.DiskUsage {
-		if oldUsage, exists := old.DiskUsage[mountPoint]; exists {
-			threshold := float64(oldUsage) * 0.10
-			if abs(float64(newUsage-oldUsage)) > threshold {
-				return true
-			}
-		} else {
-			// New mount point appeared
-			return true
+// GetAgentsByStatus retrieves the agents of a user in any of the given liveness states.
+func (s *AgentInfoService) GetAgentsByStatus(ctx context.Context, userID string, statuses []string) ([]*AgentInfo, error) {
+	for _, status := range statuses {
+		if status != StatusOnline && status != StatusStale && status != StatusOffline && status != StatusDecommissioned {
+			return nil, fmt.Errorf("invalid agent status %q", status)
 		}
 	}
 
-	// Check if any mount points disappeared
-	for mountPoint := range old.DiskUsage {
-		if _, exists := new.DiskUsage[mountPoint]; !exists {
-			return true
+	agents, err := s.repository.GetAgentsByStatus(ctx, userID, statuses)
+	if err != nil {
+		return nil, err
+	}
+	if agents == nil {
+		return []*AgentInfo{}, nil
+	}
+	return agents, nil
+}
+
+// FindAgents retrieves the agents of a user matching the query.
+func (s *AgentInfoService) FindAgents(ctx context.Context, userID string, query AgentQuery) ([]*AgentInfo, error) {
+	for _, status := range query.Statuses {
+		if status != StatusOnline && status != StatusStale && status != StatusOffline && status != StatusDecommissioned {
+			return nil, fmt.Errorf("invalid agent status %q", status)
 		}
 	}
 
-	return false
+	agents, err := s.repository.FindAgents(ctx, userID, query)
+	if err != nil {
+		return nil, err
+	}
+	if agents == nil {
+		return []*AgentInfo{}, nil
+	}
+	return agents, nil
+}
+
+// SetLabels validates and replaces the labels of an agent owned by the user.
+func (s *AgentInfoService) SetLabels(ctx context.Context, id bson.ObjectID, userID string, labels map[string]string) (*AgentInfo, error) {
+	if err := ValidateLabels(labels); err != nil {
+		return nil, err
+	}
+
+	agentInfo, err := s.repository.GetAgentInfoByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if agentInfo == nil {
+		return nil, fmt.Errorf("agent not found")
+	}
+	if agentInfo.UserID != userID {
+		return nil, fmt.Errorf("agent does not belong to user")
+	}
+
+	if err := s.repository.SetLabels(ctx, id, labels); err != nil {
+		return nil, err
+	}
+	agentInfo.Labels = labels
+	return agentInfo, nil
 }
 
-// Helper function for absolute value of float64.
-func abs(x float64) float64 {
-	if x < 0 {
-		return -x
+// RecordHeartbeat records a heartbeat for an agent owned by the user and marks it online.
+func (s *AgentInfoService) RecordHeartbeat(ctx context.Context, id bson.ObjectID, userID string, heartbeat Heartbeat) (*AgentInfo, error) {
+	agentInfo, err := s.repository.GetAgentInfoByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if agentInfo == nil {
+		return nil, fmt.Errorf("agent not found")
 	}
-	return x
+	if agentInfo.UserID != userID {
+		return nil, fmt.Errorf("agent does not belong to user")
+	}
+	if agentInfo.Status == StatusDecommissioned {
+		return nil, fmt.Errorf("agent is decommissioned")
+	}
+
+	seenAt := time.Now()
+	previous, err := s.repository.RecordHeartbeat(ctx, id, heartbeat, seenAt)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, fmt.Errorf("agent not found")
+		}
+		return nil, err
+	}
+
+	if previous.Status != StatusOnline {
+		s.emitStatusChange(previous, StatusOnline, seenAt)
+	}
+
+	previous.Status = StatusOnline
+	previous.LastSeen = seenAt
+	previous.AgentVersion = heartbeat.AgentVersion
+	previous.UptimeSeconds = heartbeat.UptimeSeconds
+	return previous, nil
+}
+
+// SetMachineID records the machine identity of an agent.
+func (s *AgentInfoService) SetMachineID(ctx context.Context, id bson.ObjectID, machineID string) error {
+	return s.repository.SetMachineID(ctx, id, machineID)
+}
+
+// Decommission marks an agent as decommissioned, archived until archivedUntil when set. It reports false
+// when the agent was already decommissioned.
+func (s *AgentInfoService) Decommission(ctx context.Context, id bson.ObjectID, decommissionedAt time.Time, archivedUntil *time.Time) (bool, error) {
+	return s.repository.Decommission(ctx, id, decommissionedAt, archivedUntil)
+}
+
+// DeleteAgentInfo deletes an agent.
+func (s *AgentInfoService) DeleteAgentInfo(ctx context.Context, id bson.ObjectID) error {
+	return s.repository.DeleteAgentInfo(ctx, id)
+}
+
+// GetExpiredArchives retrieves the decommissioned agents whose archive period ended.
+func (s *AgentInfoService) GetExpiredArchives(ctx context.Context, now time.Time) ([]*AgentInfo, error) {
+	return s.repository.GetExpiredArchives(ctx, now)
+}
+
+// HasSystemMetricsChanged checks if there are significant changes in system metrics under the default thresholds.
+func (s *AgentInfoService) HasSystemMetricsChanged(old, new SystemMetrics) bool {
+	return DiffSystemMetrics(old, new, DefaultThresholds()).Changed()
 }
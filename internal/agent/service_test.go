@@ -0,0 +1,66 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHasSystemMetricsChanged(t *testing.T) {
+	service := NewAgentInfoService(nil)
+
+	t.Run("Unchanged", func(t *testing.T) {
+		assert.False(t, service.HasSystemMetricsChanged(extendedMetrics(), extendedMetrics()))
+	})
+
+	t.Run("LegacyAgent", func(t *testing.T) {
+		// Optional metrics missing on either side are not considered a change
+		legacy := extendedMetrics()
+		legacy.LoadAverage = nil
+		legacy.SwapTotal, legacy.SwapUsed = 0, 0
+		legacy.InodeUsage = nil
+		legacy.Network = nil
+		legacy.OpenFileDescriptors, legacy.MaxFileDescriptors = 0, 0
+		legacy.ProcessCount, legacy.ThreadCount = 0, 0
+		legacy.TCPStates = nil
+		legacy.Pressure = nil
+		legacy.UptimeSeconds = 0
+
+		assert.False(t, service.HasSystemMetricsChanged(legacy, extendedMetrics()))
+		assert.False(t, service.HasSystemMetricsChanged(extendedMetrics(), legacy))
+	})
+
+	testCases := []struct {
+		name     string
+		modify   func(m *SystemMetrics)
+		expected bool
+	}{
+		{"CPUUsage", func(m *SystemMetrics) { m.CPUUsage += 10 }, true},
+		{"SmallLoadChange", func(m *SystemMetrics) { m.LoadAverage = &LoadAverage{Load1: 2.0} }, false},
+		{"LoadSpike", func(m *SystemMetrics) { m.LoadAverage = &LoadAverage{Load1: 4.0} }, true},
+		{"SwapGrowth", func(m *SystemMetrics) { m.SwapUsed += 400 }, true},
+		{"InodeGrowth", func(m *SystemMetrics) { m.InodeUsage["/"] = InodeUsage{Total: 1000, Used: 550, Free: 450} }, true},
+		{"NewInodeMount", func(m *SystemMetrics) { m.InodeUsage["/data"] = InodeUsage{Total: 100} }, true},
+		{"NetworkErrors", func(m *SystemMetrics) {
+			m.Network["eth0"] = NetworkInterface{RxBytesPerSec: 1024, TxBytesPerSec: 512, RxErrors: 3}
+		}, true},
+		{"NetworkThroughput", func(m *SystemMetrics) {
+			m.Network["eth0"] = NetworkInterface{RxBytesPerSec: 4096, TxBytesPerSec: 512}
+		}, true},
+		{"FileDescriptorGrowth", func(m *SystemMetrics) { m.OpenFileDescriptors = 2000 }, true},
+		{"ProcessGrowth", func(m *SystemMetrics) { m.ProcessCount = 200; m.ThreadCount = 600 }, true},
+		{"FewTCPConnections", func(m *SystemMetrics) { m.TCPStates["TIME_WAIT"] = 20 }, false},
+		{"TCPConnectionSurge", func(m *SystemMetrics) { m.TCPStates["CLOSE_WAIT"] = 50 }, true},
+		{"PressureSpike", func(m *SystemMetrics) { m.Pressure = &PressureStall{CPU: &PressureStats{SomeAvg10: 30}} }, true},
+		{"Reboot", func(m *SystemMetrics) { m.UptimeSeconds = 60 }, true},
+		{"UptimeIncrease", func(m *SystemMetrics) { m.UptimeSeconds += 60 }, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			updated := extendedMetrics()
+			tc.modify(&updated)
+			assert.Equal(t, tc.expected, service.HasSystemMetricsChanged(extendedMetrics(), updated))
+		})
+	}
+}
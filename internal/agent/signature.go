@@ -0,0 +1,145 @@
+package agent
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// Headers of a request signed with an agent credential. The credential itself is never sent.
+const (
+	SignatureKeyIDHeader     = "X-NANNYAPI-Key-ID" // ID of the credential that signed the request
+	SignatureTimestampHeader = "X-NANNYAPI-Timestamp"
+	SignatureNonceHeader     = "X-NANNYAPI-Nonce"
+	SignatureHeader          = "X-NANNYAPI-Signature"
+)
+
+const (
+	defaultSignatureSkew = 5 * time.Minute
+	maxSignatureSkew     = time.Hour
+	minNonceLength       = 16
+	maxNonceLength       = 128
+)
+
+// SignatureSkewFromEnv reads AGENT_SIGNATURE_SKEW, how far the timestamp of a signed request may be from
+// the server clock.
+func SignatureSkewFromEnv() (time.Duration, error) {
+	value := os.Getenv("AGENT_SIGNATURE_SKEW")
+	if value == "" {
+		return defaultSignatureSkew, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < time.Second || d > maxSignatureSkew {
+		return 0, fmt.Errorf("invalid AGENT_SIGNATURE_SKEW %q, must be a duration between 1s and %s", value, maxSignatureSkew)
+	}
+	return d, nil
+}
+
+// SignedRequest holds what the signature of a request covers, along with the signature headers.
+type SignedRequest struct {
+	KeyID     string
+	Timestamp string // Unix time in seconds
+	Nonce     string // Random value, used once per credential
+	Signature string // Hex encoded HMAC-SHA256 of StringToSign, keyed with the credential
+	Method    string
+	Path      string // Path and query, as sent by the agent
+	Body      []byte
+}
+
+// StringToSign returns the string agents sign: the method, path, timestamp, nonce and hex encoded SHA-256
+// of the body, one per line.
+func StringToSign(method, path, timestamp, nonce string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	return strings.Join([]string{strings.ToUpper(method), path, timestamp, nonce, hex.EncodeToString(bodyHash[:])}, "\n")
+}
+
+// Sign returns the signature of the request with the credential.
+func Sign(credential string, req *SignedRequest) string {
+	mac := hmac.New(sha256.New, []byte(credential))
+	mac.Write([]byte(StringToSign(req.Method, req.Path, req.Timestamp, req.Nonce, req.Body)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// NonceStore records the nonces of signed requests. It is shared by every API instance, so a signed request
+// cannot be replayed against another one.
+type NonceStore interface {
+	UseNonce(ctx context.Context, nonce string, expiresAt time.Time) (bool, error)
+}
+
+// checkTimestamp parses the timestamp of a signed request and checks it is within the skew of now.
+func checkTimestamp(timestamp string, now time.Time, skew time.Duration) (time.Time, error) {
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid request signature: malformed timestamp")
+	}
+	signedAt := time.Unix(seconds, 0)
+	if signedAt.Before(now.Add(-skew)) || signedAt.After(now.Add(skew)) {
+		return time.Time{}, fmt.Errorf("invalid request signature: timestamp is outside the allowed skew of %s", skew)
+	}
+	return signedAt, nil
+}
+
+// SetSignatureSkew sets how far the timestamp of a signed request may be from the server clock.
+func (s *EnrollmentService) SetSignatureSkew(skew time.Duration) {
+	s.signatureSkew = skew
+}
+
+// VerifySignature returns the credential that signed the request. It rejects bad signatures, timestamps
+// outside the allowed skew and nonces that were already used with the credential.
+func (s *EnrollmentService) VerifySignature(ctx context.Context, req *SignedRequest) (*Credential, error) {
+	now := time.Now()
+	if req.KeyID == "" || req.Timestamp == "" || req.Signature == "" {
+		return nil, fmt.Errorf("invalid request signature: %s, %s and %s headers are required", SignatureKeyIDHeader, SignatureTimestampHeader, SignatureHeader)
+	}
+	if len(req.Nonce) < minNonceLength || len(req.Nonce) > maxNonceLength {
+		return nil, fmt.Errorf("invalid request signature: nonce must be between %d and %d characters", minNonceLength, maxNonceLength)
+	}
+	signedAt, err := checkTimestamp(req.Timestamp, now, s.signatureSkew)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := bson.ObjectIDFromHex(req.KeyID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid agent credential")
+	}
+	credential, err := s.repository.GetCredential(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	// Credentials issued before request signing was added have no stored secret to check against
+	if credential == nil || credential.RevokedAt != nil || credential.EncryptedCredential == "" {
+		return nil, fmt.Errorf("invalid agent credential")
+	}
+	secret, err := s.envelope.Decrypt(credential.EncryptedCredential, credentialAAD(credential.ID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt credential: %v", err)
+	}
+	if !hmac.Equal([]byte(Sign(secret, req)), []byte(strings.ToLower(req.Signature))) {
+		return nil, fmt.Errorf("invalid request signature")
+	}
+
+	// Only record nonces of valid signatures, so unauthenticated requests cannot fill the store. A nonce is
+	// kept until the timestamp of its request falls out of the allowed skew, at most twice the skew.
+	unused, err := s.nonces.UseNonce(ctx, "signature:"+req.KeyID+":"+req.Nonce, signedAt.Add(s.signatureSkew))
+	if err != nil {
+		return nil, fmt.Errorf("failed to check request nonce: %v", err)
+	}
+	if !unused {
+		return nil, fmt.Errorf("invalid request signature: nonce was already used")
+	}
+
+	if err := s.repository.TouchCredential(ctx, credential.ID, now, credentialUseInterval); err != nil {
+		log.Printf("Failed to record use of credential %s: %v", credential.ID.Hex(), err)
+	}
+	return credential, nil
+}
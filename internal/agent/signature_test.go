@@ -0,0 +1,74 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignatureSkewFromEnv(t *testing.T) {
+	t.Setenv("AGENT_SIGNATURE_SKEW", "")
+	skew, err := SignatureSkewFromEnv()
+	assert.NoError(t, err)
+	assert.Equal(t, defaultSignatureSkew, skew)
+
+	t.Setenv("AGENT_SIGNATURE_SKEW", "30s")
+	skew, err = SignatureSkewFromEnv()
+	assert.NoError(t, err)
+	assert.Equal(t, 30*time.Second, skew)
+
+	for _, value := range []string{"soon", "100ms", "2h"} {
+		t.Setenv("AGENT_SIGNATURE_SKEW", value)
+		_, err = SignatureSkewFromEnv()
+		assert.Error(t, err, value)
+	}
+}
+
+func TestSign(t *testing.T) {
+	req := &SignedRequest{
+		Timestamp: "1700000000",
+		Nonce:     "0123456789abcdef",
+		Method:    "post",
+		Path:      "/api/agent-info/abc/heartbeat?full=1",
+		Body:      []byte(`{"uptime":1}`),
+	}
+	bodyHash := sha256.Sum256(req.Body)
+	assert.Equal(t, "POST\n/api/agent-info/abc/heartbeat?full=1\n1700000000\n0123456789abcdef\n"+hex.EncodeToString(bodyHash[:]),
+		StringToSign(req.Method, req.Path, req.Timestamp, req.Nonce, req.Body))
+
+	signature := Sign("nagent_secret", req)
+	assert.Len(t, signature, 64)
+	assert.Equal(t, signature, Sign("nagent_secret", req))
+	assert.NotEqual(t, signature, Sign("nagent_other", req))
+
+	// Every part of the request is covered by the signature
+	for _, change := range []func(r *SignedRequest){
+		func(r *SignedRequest) { r.Method = "GET" },
+		func(r *SignedRequest) { r.Path = "/api/agent-info/abc/heartbeat" },
+		func(r *SignedRequest) { r.Timestamp = "1700000001" },
+		func(r *SignedRequest) { r.Nonce = "fedcba9876543210" },
+		func(r *SignedRequest) { r.Body = []byte(`{"uptime":2}`) },
+	} {
+		changed := *req
+		change(&changed)
+		assert.NotEqual(t, signature, Sign("nagent_secret", &changed))
+	}
+}
+
+func TestCheckTimestamp(t *testing.T) {
+	now := time.Now()
+	signedAt, err := checkTimestamp(strconv.FormatInt(now.Add(-time.Minute).Unix(), 10), now, 5*time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, now.Add(-time.Minute).Unix(), signedAt.Unix())
+
+	_, err = checkTimestamp(strconv.FormatInt(now.Add(-10*time.Minute).Unix(), 10), now, 5*time.Minute)
+	assert.ErrorContains(t, err, "outside the allowed skew")
+	_, err = checkTimestamp(strconv.FormatInt(now.Add(10*time.Minute).Unix(), 10), now, 5*time.Minute)
+	assert.ErrorContains(t, err, "outside the allowed skew")
+	_, err = checkTimestamp("yesterday", now, 5*time.Minute)
+	assert.ErrorContains(t, err, "malformed timestamp")
+}
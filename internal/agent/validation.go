@@ -0,0 +1,101 @@
+package agent
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Validate checks that the reported system metrics are consistent.
+// Optional fields that an agent did not report are not validated.
+func (m *SystemMetrics) Validate() error {
+	if m.CPUUsage < 0 || m.CPUUsage > 100 {
+		return fmt.Errorf("invalid system metrics: cpu_usage must be between 0 and 100")
+	}
+	if m.MemoryTotal < 0 || m.MemoryUsed < 0 || m.MemoryFree < 0 {
+		return fmt.Errorf("invalid system metrics: memory values must not be negative")
+	}
+	if m.MemoryTotal > 0 && m.MemoryUsed > m.MemoryTotal {
+		return fmt.Errorf("invalid system metrics: memory_used exceeds memory_total")
+	}
+	for mountPoint, usage := range m.DiskUsage {
+		if usage < 0 {
+			return fmt.Errorf("invalid system metrics: disk_usage of %s must not be negative", mountPoint)
+		}
+	}
+
+	if m.LoadAverage != nil {
+		if m.LoadAverage.Load1 < 0 || m.LoadAverage.Load5 < 0 || m.LoadAverage.Load15 < 0 {
+			return fmt.Errorf("invalid system metrics: load_average must not be negative")
+		}
+	}
+
+	if m.SwapTotal < 0 || m.SwapUsed < 0 {
+		return fmt.Errorf("invalid system metrics: swap values must not be negative")
+	}
+	if m.SwapUsed > m.SwapTotal {
+		return fmt.Errorf("invalid system metrics: swap_used exceeds swap_total")
+	}
+
+	for mountPoint, inodes := range m.InodeUsage {
+		if inodes.Total < 0 || inodes.Used < 0 || inodes.Free < 0 {
+			return fmt.Errorf("invalid system metrics: inode_usage of %s must not be negative", mountPoint)
+		}
+		if inodes.Used > inodes.Total {
+			return fmt.Errorf("invalid system metrics: inode_usage of %s uses more inodes than available", mountPoint)
+		}
+	}
+
+	for name, iface := range m.Network {
+		if iface.RxBytesPerSec < 0 || iface.TxBytesPerSec < 0 ||
+			iface.RxErrors < 0 || iface.TxErrors < 0 || iface.RxDropped < 0 || iface.TxDropped < 0 {
+			return fmt.Errorf("invalid system metrics: network counters of %s must not be negative", name)
+		}
+	}
+
+	if m.OpenFileDescriptors < 0 || m.MaxFileDescriptors < 0 {
+		return fmt.Errorf("invalid system metrics: file descriptor counts must not be negative")
+	}
+	if m.MaxFileDescriptors > 0 && m.OpenFileDescriptors > m.MaxFileDescriptors {
+		return fmt.Errorf("invalid system metrics: open_file_descriptors exceeds max_file_descriptors")
+	}
+
+	if m.ProcessCount < 0 || m.ThreadCount < 0 {
+		return fmt.Errorf("invalid system metrics: process and thread counts must not be negative")
+	}
+	if m.ThreadCount > 0 && m.ThreadCount < m.ProcessCount {
+		return fmt.Errorf("invalid system metrics: thread_count is lower than process_count")
+	}
+
+	for state, count := range m.TCPStates {
+		if !slices.Contains(TCPStateNames, state) {
+			return fmt.Errorf("invalid system metrics: unknown tcp state %q", state)
+		}
+		if count < 0 {
+			return fmt.Errorf("invalid system metrics: tcp_states count of %s must not be negative", state)
+		}
+	}
+
+	if m.Pressure != nil {
+		resources := map[string]*PressureStats{"cpu": m.Pressure.CPU, "memory": m.Pressure.Memory, "io": m.Pressure.IO}
+		for resource, stats := range resources {
+			if stats != nil && !stats.valid() {
+				return fmt.Errorf("invalid system metrics: %s pressure must be between 0 and 100", resource)
+			}
+		}
+	}
+
+	if m.UptimeSeconds < 0 {
+		return fmt.Errorf("invalid system metrics: uptime_seconds must not be negative")
+	}
+
+	return nil
+}
+
+func (p *PressureStats) valid() bool {
+	for _, v := range []float64{p.SomeAvg10, p.SomeAvg60, p.SomeAvg300, p.FullAvg10, p.FullAvg60, p.FullAvg300} {
+		if v < 0 || v > 100 {
+			return false
+		}
+	}
+	return true
+}
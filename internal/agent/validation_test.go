@@ -0,0 +1,78 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func extendedMetrics() SystemMetrics {
+	return SystemMetrics{
+		CPUUsage:            45.5,
+		MemoryTotal:         8192,
+		MemoryUsed:          4096,
+		MemoryFree:          4096,
+		DiskUsage:           map[string]int64{"/": 1024},
+		LoadAverage:         &LoadAverage{Load1: 1.5, Load5: 1.2, Load15: 0.9},
+		SwapTotal:           2048,
+		SwapUsed:            512,
+		InodeUsage:          map[string]InodeUsage{"/": {Total: 1000, Used: 400, Free: 600}},
+		Network:             map[string]NetworkInterface{"eth0": {RxBytesPerSec: 1024, TxBytesPerSec: 512}},
+		OpenFileDescriptors: 1200,
+		MaxFileDescriptors:  65536,
+		ProcessCount:        150,
+		ThreadCount:         600,
+		TCPStates:           map[string]int64{"ESTABLISHED": 40, "TIME_WAIT": 12},
+		Pressure:            &PressureStall{CPU: &PressureStats{SomeAvg10: 2.5}},
+		UptimeSeconds:       86400,
+	}
+}
+
+func TestSystemMetricsValidate(t *testing.T) {
+	t.Run("LegacyMetrics", func(t *testing.T) {
+		metrics := SystemMetrics{
+			CPUInfo:     []string{"Intel i7"},
+			CPUUsage:    45.5,
+			MemoryTotal: 8192,
+			MemoryUsed:  4096,
+			MemoryFree:  4096,
+			DiskUsage:   map[string]int64{"/": 1024},
+			FSUsage:     map[string]string{"/": "45%"},
+		}
+		assert.NoError(t, metrics.Validate())
+	})
+
+	t.Run("ExtendedMetrics", func(t *testing.T) {
+		metrics := extendedMetrics()
+		assert.NoError(t, metrics.Validate())
+	})
+
+	testCases := []struct {
+		name   string
+		modify func(m *SystemMetrics)
+	}{
+		{"CPUUsageAbove100", func(m *SystemMetrics) { m.CPUUsage = 150 }},
+		{"MemoryUsedAboveTotal", func(m *SystemMetrics) { m.MemoryUsed = m.MemoryTotal + 1 }},
+		{"NegativeDiskUsage", func(m *SystemMetrics) { m.DiskUsage["/"] = -1 }},
+		{"NegativeLoad", func(m *SystemMetrics) { m.LoadAverage.Load5 = -0.1 }},
+		{"SwapUsedAboveTotal", func(m *SystemMetrics) { m.SwapUsed = m.SwapTotal + 1 }},
+		{"InodesUsedAboveTotal", func(m *SystemMetrics) { m.InodeUsage["/"] = InodeUsage{Total: 10, Used: 11} }},
+		{"NegativeNetworkCounter", func(m *SystemMetrics) { m.Network["eth0"] = NetworkInterface{RxErrors: -1} }},
+		{"OpenAboveMaxFileDescriptors", func(m *SystemMetrics) { m.OpenFileDescriptors = m.MaxFileDescriptors + 1 }},
+		{"FewerThreadsThanProcesses", func(m *SystemMetrics) { m.ThreadCount = m.ProcessCount - 1 }},
+		{"UnknownTCPState", func(m *SystemMetrics) { m.TCPStates["HALF_OPEN"] = 1 }},
+		{"NegativeTCPCount", func(m *SystemMetrics) { m.TCPStates["ESTABLISHED"] = -1 }},
+		{"PressureAbove100", func(m *SystemMetrics) { m.Pressure.IO = &PressureStats{FullAvg60: 101} }},
+		{"NegativeUptime", func(m *SystemMetrics) { m.UptimeSeconds = -1 }},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics := extendedMetrics()
+			tc.modify(&metrics)
+			err := metrics.Validate()
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), "invalid system metrics")
+		})
+	}
+}
@@ -0,0 +1,329 @@
+package alert
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+
+	"github.com/harshavmb/nannyapi/internal/agent"
+)
+
+// DefaultRules returns the built-in anomaly rules evaluated for every agent.
+func DefaultRules() []Rule {
+	return []Rule{
+		{Name: "high_cpu", Description: "CPU usage is very high", Metric: agent.MetricCPUUsage, Kind: KindThreshold, Operator: OperatorAbove, Value: 90, Severity: SeverityHigh, AutoDiagnose: true},
+		{Name: "high_memory", Description: "Memory usage is very high", Metric: agent.MetricMemoryUsedPercent, Kind: KindThreshold, Operator: OperatorAbove, Value: 90, Severity: SeverityHigh, AutoDiagnose: true},
+		{Name: "filesystem_full", Description: "Filesystem is almost full", Metric: agent.MetricFSUsage, Kind: KindThreshold, Operator: OperatorAbove, Value: 90, Severity: SeverityHigh, AutoDiagnose: true},
+		{Name: "inode_exhaustion", Description: "Filesystem is running out of inodes", Metric: agent.MetricInodeUsedPercent, Kind: KindThreshold, Operator: OperatorAbove, Value: 90, Severity: SeverityHigh, AutoDiagnose: true},
+		{Name: "memory_pressure", Description: "Tasks are stalled waiting for memory", Metric: agent.MetricPressureSomeAvg10, Key: "memory", Kind: KindThreshold, Operator: OperatorAbove, Value: 20, Severity: SeverityMedium},
+		{Name: "swap_growth", Description: "Swap usage is growing fast", Metric: agent.MetricSwapUsedPercent, Kind: KindRateOfChange, Operator: OperatorAbove, Value: 5, Severity: SeverityMedium},
+		{Name: "network_errors", Description: "Network interface is reporting errors", Metric: agent.MetricNetworkErrors, Kind: KindRateOfChange, Operator: OperatorAbove, Value: 10, Severity: SeverityMedium},
+		{Name: "cpu_anomaly", Description: "CPU usage deviates from the usual baseline", Metric: agent.MetricCPUUsage, Kind: KindZScore, Operator: OperatorAbove, Value: 3, MinSamples: 30, Severity: SeverityLow},
+		{Name: "load_anomaly", Description: "Load average deviates from the usual baseline", Metric: agent.MetricLoad1, Kind: KindZScore, Operator: OperatorAbove, Value: 3, MinSamples: 30, Severity: SeverityLow},
+	}
+}
+
+// Validate checks that the rule targets a known metric with a supported detector.
+func (r *Rule) Validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("invalid rule: name is required")
+	}
+	if !slices.Contains(agent.MetricFamilies, r.Metric) {
+		return fmt.Errorf("invalid rule: unknown metric %q", r.Metric)
+	}
+	if r.Kind != KindThreshold && r.Kind != KindRateOfChange && r.Kind != KindZScore {
+		return fmt.Errorf("invalid rule: kind must be threshold, rate_of_change or zscore")
+	}
+	if r.Operator != OperatorAbove && r.Operator != OperatorBelow {
+		return fmt.Errorf("invalid rule: operator must be > or <")
+	}
+	if r.Severity != SeverityHigh && r.Severity != SeverityMedium && r.Severity != SeverityLow {
+		return fmt.Errorf("invalid rule: severity must be high, medium or low")
+	}
+	if r.MinSamples < 0 {
+		return fmt.Errorf("invalid rule: min_samples must not be negative")
+	}
+	if r.ForSeconds < 0 {
+		return fmt.Errorf("invalid rule: for_seconds must not be negative")
+	}
+	for _, agentID := range r.AgentIDs {
+		if _, err := bson.ObjectIDFromHex(agentID); err != nil {
+			return fmt.Errorf("invalid rule: %q is not a valid agent ID", agentID)
+		}
+	}
+	for _, group := range r.Groups {
+		if err := agent.ValidateGroupName(group); err != nil {
+			return fmt.Errorf("invalid rule: %v", err)
+		}
+	}
+	return nil
+}
+
+// ref identifies the rule in alert fingerprints: the ID of user-defined rules, the name of built-in ones.
+func (r *Rule) ref() string {
+	if r.ID.IsZero() {
+		return r.Name
+	}
+	return r.ID.Hex()
+}
+
+// targetsGroups reports whether the rule is limited to agent groups.
+func (r *Rule) targetsGroups() bool {
+	return len(r.Groups) > 0
+}
+
+// appliesTo reports whether the rule is evaluated for the agent, given the groups it belongs to.
+// A rule limited to agents and groups applies to the agents listed and the members of the groups.
+func (r *Rule) appliesTo(agentID string, groups []string) bool {
+	if r.Disabled {
+		return false
+	}
+	if len(r.AgentIDs) == 0 && len(r.Groups) == 0 {
+		return true
+	}
+	if slices.Contains(r.AgentIDs, agentID) {
+		return true
+	}
+	return slices.ContainsFunc(r.Groups, func(group string) bool {
+		return slices.Contains(groups, group)
+	})
+}
+
+func (r *Rule) matches(observed float64) bool {
+	if r.Operator == OperatorBelow {
+		return observed < r.Value
+	}
+	return observed > r.Value
+}
+
+// baseline keeps the last values of a series in a ring buffer.
+type baseline struct {
+	values []float64
+	next   int
+	size   int
+}
+
+func newBaseline(size int) *baseline {
+	return &baseline{values: make([]float64, 0, size), size: size}
+}
+
+func (b *baseline) add(v float64) {
+	if len(b.values) < b.size {
+		b.values = append(b.values, v)
+		return
+	}
+	b.values[b.next] = v
+	b.next = (b.next + 1) % b.size
+}
+
+// stats returns the mean and standard deviation of the buffered values.
+func (b *baseline) stats() (mean, stddev float64) {
+	if len(b.values) == 0 {
+		return 0, 0
+	}
+	for _, v := range b.values {
+		mean += v
+	}
+	mean /= float64(len(b.values))
+	for _, v := range b.values {
+		stddev += (v - mean) * (v - mean)
+	}
+	return mean, math.Sqrt(stddev / float64(len(b.values)))
+}
+
+// ordered returns the buffered values, oldest first.
+func (b *baseline) ordered() []float64 {
+	if len(b.values) < b.size {
+		return slices.Clone(b.values)
+	}
+	return append(slices.Clone(b.values[b.next:]), b.values[:b.next]...)
+}
+
+// agentState holds the previous report and rolling baselines of one agent.
+type agentState struct {
+	reportedAt time.Time
+	previous   map[string]map[string]float64
+	baselines  map[string]*baseline // Keyed by metric and key
+}
+
+// Detector evaluates rules against metric reports. Detect keeps baselines in memory; callers that
+// share them between API instances evaluate each report against the stored baseline of the agent
+// and store the updated one.
+type Detector struct {
+	mu           sync.Mutex
+	baselineSize int
+	agents       map[string]*agentState
+}
+
+func NewDetector(baselineSize int) *Detector {
+	return &Detector{
+		baselineSize: baselineSize,
+		agents:       map[string]*agentState{},
+	}
+}
+
+// Detect returns the findings of the rules for a report and then folds the report into the agent's baselines.
+func (d *Detector) Detect(agentID string, metrics agent.SystemMetrics, reportedAt time.Time, rules []Rule) []Finding {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	state, ok := d.agents[agentID]
+	if !ok {
+		state = &agentState{baselines: map[string]*baseline{}}
+		d.agents[agentID] = state
+	}
+	return d.detect(state, metrics, reportedAt, rules)
+}
+
+// Evaluate runs the rules on a report against a stored baseline and returns the findings with the updated
+// baseline. The state of the agent is not kept, so callers that store baselines do not hold every agent in
+// memory, and concurrent reports of one agent do not share state.
+func (d *Detector) Evaluate(stored *Baseline, metrics agent.SystemMetrics, reportedAt time.Time, rules []Rule) ([]Finding, *Baseline) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	state := d.restore(stored)
+	findings := d.detect(state, metrics, reportedAt, rules)
+	return findings, snapshot(stored.AgentID, state)
+}
+
+// detect evaluates the rules on a report and folds the report into the state.
+func (d *Detector) detect(state *agentState, metrics agent.SystemMetrics, reportedAt time.Time, rules []Rule) []Finding {
+	values := agent.FlattenMetrics(metrics)
+
+	var findings []Finding
+	for _, rule := range rules {
+		keys := values[rule.Metric]
+		for _, key := range sortedKeys(keys) {
+			if rule.Key != "" && rule.Key != key {
+				continue
+			}
+			value := keys[key]
+			observed, ok := d.observe(state, rule, key, value, reportedAt)
+			if ok && rule.matches(observed) {
+				findings = append(findings, Finding{Rule: rule, Key: key, Value: value, Observed: observed})
+			}
+		}
+	}
+
+	for metric, keys := range values {
+		for key, value := range keys {
+			seriesKey := metric + "|" + key
+			b, ok := state.baselines[seriesKey]
+			if !ok {
+				b = newBaseline(d.baselineSize)
+				state.baselines[seriesKey] = b
+			}
+			b.add(value)
+		}
+	}
+	state.previous = values
+	state.reportedAt = reportedAt
+
+	return findings
+}
+
+// Restore replaces the state of an agent with a stored baseline.
+func (d *Detector) Restore(stored *Baseline) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.agents[stored.AgentID] = d.restore(stored)
+}
+
+// restore builds the state of an agent from a stored baseline.
+func (d *Detector) restore(stored *Baseline) *agentState {
+	state := &agentState{
+		reportedAt: stored.ReportedAt,
+		previous:   map[string]map[string]float64{},
+		baselines:  map[string]*baseline{},
+	}
+	for _, series := range stored.Series {
+		b := newBaseline(d.baselineSize)
+		// Keep the newest values when the baseline size shrank
+		for _, v := range series.Values[max(len(series.Values)-d.baselineSize, 0):] {
+			b.add(v)
+		}
+		state.baselines[series.Metric+"|"+series.Key] = b
+
+		if series.Previous && len(series.Values) > 0 {
+			if state.previous[series.Metric] == nil {
+				state.previous[series.Metric] = map[string]float64{}
+			}
+			state.previous[series.Metric][series.Key] = series.Values[len(series.Values)-1]
+		}
+	}
+	return state
+}
+
+// Snapshot returns the state of an agent for storage, or nil if the detector has not seen it.
+func (d *Detector) Snapshot(agentID string) *Baseline {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	state, ok := d.agents[agentID]
+	if !ok {
+		return nil
+	}
+	return snapshot(agentID, state)
+}
+
+// snapshot returns the state of an agent for storage.
+func snapshot(agentID string, state *agentState) *Baseline {
+	snapshot := &Baseline{AgentID: agentID, ReportedAt: state.reportedAt}
+	for _, seriesKey := range sortedKeys(state.baselines) {
+		metric, key, _ := strings.Cut(seriesKey, "|")
+		_, previous := state.previous[metric][key]
+		snapshot.Series = append(snapshot.Series, SeriesBaseline{
+			Metric:   metric,
+			Key:      key,
+			Values:   state.baselines[seriesKey].ordered(),
+			Previous: previous,
+		})
+	}
+	return snapshot
+}
+
+// observe computes the detector output of a rule for one series. It reports false when there is
+// not enough history yet.
+func (d *Detector) observe(state *agentState, rule Rule, key string, value float64, reportedAt time.Time) (float64, bool) {
+	switch rule.Kind {
+	case KindThreshold:
+		return value, true
+
+	case KindRateOfChange:
+		previous, ok := state.previous[rule.Metric][key]
+		minutes := reportedAt.Sub(state.reportedAt).Minutes()
+		if !ok || minutes <= 0 {
+			return 0, false
+		}
+		return (value - previous) / minutes, true
+
+	case KindZScore:
+		b, ok := state.baselines[rule.Metric+"|"+key]
+		if !ok || len(b.values) < max(rule.MinSamples, 2) {
+			return 0, false
+		}
+		mean, stddev := b.stats()
+		if stddev == 0 {
+			return 0, false
+		}
+		return (value - mean) / stddev, true
+	}
+	return 0, false
+}
+
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
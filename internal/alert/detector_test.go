@@ -0,0 +1,220 @@
+package alert
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/v2/bson"
+
+	"github.com/harshavmb/nannyapi/internal/agent"
+)
+
+func TestDetectThreshold(t *testing.T) {
+	detector := NewDetector(10)
+	rules := []Rule{
+		{Name: "filesystem_full", Metric: agent.MetricFSUsage, Kind: KindThreshold, Operator: OperatorAbove, Value: 90, Severity: SeverityHigh},
+		{Name: "idle", Metric: agent.MetricCPUUsage, Kind: KindThreshold, Operator: OperatorBelow, Value: 1, Severity: SeverityLow},
+	}
+	metrics := agent.SystemMetrics{
+		CPUUsage: 0.5,
+		FSUsage:  map[string]string{"/": "95%", "/data": "40%"},
+	}
+
+	findings := detector.Detect("agent", metrics, time.Now(), rules)
+
+	assert.Len(t, findings, 2)
+	assert.Equal(t, "filesystem_full", findings[0].Rule.Name)
+	assert.Equal(t, "/", findings[0].Key)
+	assert.Equal(t, 95.0, findings[0].Observed)
+	assert.Equal(t, "idle", findings[1].Rule.Name)
+}
+
+func TestDetectRuleKey(t *testing.T) {
+	detector := NewDetector(10)
+	rules := []Rule{
+		{Name: "data_full", Metric: agent.MetricFSUsage, Key: "/data", Kind: KindThreshold, Operator: OperatorAbove, Value: 90, Severity: SeverityHigh},
+	}
+	metrics := agent.SystemMetrics{FSUsage: map[string]string{"/": "95%", "/data": "40%"}}
+
+	assert.Empty(t, detector.Detect("agent", metrics, time.Now(), rules))
+}
+
+func TestDetectRateOfChange(t *testing.T) {
+	detector := NewDetector(10)
+	rules := []Rule{
+		{Name: "swap_growth", Metric: agent.MetricSwapUsedPercent, Kind: KindRateOfChange, Operator: OperatorAbove, Value: 5, Severity: SeverityMedium},
+	}
+	start := time.Now()
+	report := func(used int64, at time.Time) []Finding {
+		return detector.Detect("agent", agent.SystemMetrics{SwapTotal: 100, SwapUsed: used}, at, rules)
+	}
+
+	// The first report has no previous value to compare with
+	assert.Empty(t, report(10, start))
+	// 10 points over two minutes is 5 per minute, which does not exceed the rule
+	assert.Empty(t, report(20, start.Add(2*time.Minute)))
+
+	findings := report(40, start.Add(4*time.Minute))
+	assert.Len(t, findings, 1)
+	assert.Equal(t, 10.0, findings[0].Observed)
+	assert.Equal(t, 40.0, findings[0].Value)
+}
+
+func TestDetectZScore(t *testing.T) {
+	detector := NewDetector(20)
+	rules := []Rule{
+		{Name: "cpu_anomaly", Metric: agent.MetricCPUUsage, Kind: KindZScore, Operator: OperatorAbove, Value: 3, MinSamples: 10, Severity: SeverityLow},
+	}
+	start := time.Now()
+
+	// Build a baseline alternating between 20% and 30%: mean 25, standard deviation 5
+	for i := 0; i < 10; i++ {
+		cpu := 20.0
+		if i%2 == 1 {
+			cpu = 30.0
+		}
+		findings := detector.Detect("agent", agent.SystemMetrics{CPUUsage: cpu}, start.Add(time.Duration(i)*time.Minute), rules)
+		assert.Empty(t, findings)
+	}
+
+	// 35% is only two standard deviations above the baseline
+	assert.Empty(t, detector.Detect("agent", agent.SystemMetrics{CPUUsage: 35}, start.Add(10*time.Minute), rules))
+
+	findings := detector.Detect("agent", agent.SystemMetrics{CPUUsage: 90}, start.Add(11*time.Minute), rules)
+	assert.Len(t, findings, 1)
+	assert.Greater(t, findings[0].Observed, 3.0)
+}
+
+func TestDetectZScoreNeedsBaseline(t *testing.T) {
+	detector := NewDetector(20)
+	rules := []Rule{
+		{Name: "cpu_anomaly", Metric: agent.MetricCPUUsage, Kind: KindZScore, Operator: OperatorAbove, Value: 3, MinSamples: 30, Severity: SeverityLow},
+	}
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		detector.Detect("agent", agent.SystemMetrics{CPUUsage: float64(20 + i)}, start.Add(time.Duration(i)*time.Minute), rules)
+	}
+
+	assert.Empty(t, detector.Detect("agent", agent.SystemMetrics{CPUUsage: 99}, start.Add(10*time.Minute), rules))
+}
+
+func TestBaselineRingBuffer(t *testing.T) {
+	b := newBaseline(3)
+	for _, v := range []float64{100, 1, 2, 3} {
+		b.add(v)
+	}
+
+	mean, _ := b.stats()
+	assert.Len(t, b.values, 3)
+	assert.Equal(t, 2.0, mean)
+}
+
+func TestRuleValidate(t *testing.T) {
+	for _, rule := range DefaultRules() {
+		assert.NoError(t, rule.Validate(), rule.Name)
+	}
+
+	valid := Rule{Name: "rule", Metric: agent.MetricCPUUsage, Kind: KindThreshold, Operator: OperatorAbove, Value: 90, Severity: SeverityHigh}
+	testCases := []struct {
+		name   string
+		modify func(r *Rule)
+	}{
+		{"MissingName", func(r *Rule) { r.Name = "" }},
+		{"UnknownMetric", func(r *Rule) { r.Metric = "cpu" }},
+		{"UnknownKind", func(r *Rule) { r.Kind = "forecast" }},
+		{"UnknownOperator", func(r *Rule) { r.Operator = ">=" }},
+		{"UnknownSeverity", func(r *Rule) { r.Severity = "critical" }},
+		{"NegativeMinSamples", func(r *Rule) { r.MinSamples = -1 }},
+		{"NegativeForSeconds", func(r *Rule) { r.ForSeconds = -1 }},
+		{"InvalidAgentID", func(r *Rule) { r.AgentIDs = []string{"agent-1"} }},
+		{"InvalidGroup", func(r *Rule) { r.Groups = []string{"prod.db"} }},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rule := valid
+			tc.modify(&rule)
+			err := rule.Validate()
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), "invalid rule")
+		})
+	}
+}
+
+func TestRuleAppliesTo(t *testing.T) {
+	agentID := bson.NewObjectID().Hex()
+	rule := Rule{Name: "rule"}
+	assert.True(t, rule.appliesTo(agentID, nil))
+	assert.Equal(t, "rule", rule.ref())
+
+	rule.ID = bson.NewObjectID()
+	rule.AgentIDs = []string{bson.NewObjectID().Hex()}
+	assert.False(t, rule.appliesTo(agentID, nil))
+	assert.Equal(t, rule.ID.Hex(), rule.ref())
+
+	rule.Groups = []string{"databases"}
+	assert.False(t, rule.appliesTo(agentID, []string{"web"}))
+	assert.True(t, rule.appliesTo(agentID, []string{"web", "databases"}))
+
+	rule.AgentIDs = append(rule.AgentIDs, agentID)
+	assert.True(t, rule.appliesTo(agentID, nil))
+
+	rule.Disabled = true
+	assert.False(t, rule.appliesTo(agentID, []string{"databases"}))
+}
+
+func TestDetectorSnapshotRestore(t *testing.T) {
+	rules := []Rule{
+		{Name: "swap_growth", Metric: agent.MetricSwapUsedPercent, Kind: KindRateOfChange, Operator: OperatorAbove, Value: 5, Severity: SeverityMedium},
+		{Name: "cpu_anomaly", Metric: agent.MetricCPUUsage, Kind: KindZScore, Operator: OperatorAbove, Value: 3, MinSamples: 10, Severity: SeverityLow},
+	}
+	start := time.Now()
+
+	// Build the baseline on one detector, as one API instance would
+	first := NewDetector(5)
+	for i := 0; i < 12; i++ {
+		cpu := 20.0
+		if i%2 == 1 {
+			cpu = 30.0
+		}
+		first.Detect("agent", agent.SystemMetrics{CPUUsage: cpu, SwapTotal: 100, SwapUsed: 10}, start.Add(time.Duration(i)*time.Minute), rules)
+	}
+	snapshot := first.Snapshot("agent")
+	assert.Nil(t, first.Snapshot("other-agent"))
+	assert.Equal(t, start.Add(11*time.Minute), snapshot.ReportedAt)
+	assert.Equal(t, []SeriesBaseline{
+		{Metric: agent.MetricCPUUsage, Values: []float64{30, 20, 30, 20, 30}, Previous: true},
+		{Metric: agent.MetricSwapUsedPercent, Values: []float64{10, 10, 10, 10, 10}, Previous: true},
+	}, snapshot.Series)
+
+	// Another detector continues from the stored baseline
+	second := NewDetector(20)
+	second.Restore(snapshot)
+	assert.Equal(t, snapshot, second.Snapshot("agent"))
+	findings := second.Detect("agent", agent.SystemMetrics{CPUUsage: 25, SwapTotal: 100, SwapUsed: 30}, start.Add(12*time.Minute), rules)
+	assert.Len(t, findings, 1)
+	assert.Equal(t, "swap_growth", findings[0].Rule.Name)
+	assert.Equal(t, 20.0, findings[0].Observed)
+}
+
+func TestDetectorEvaluate(t *testing.T) {
+	rules := []Rule{
+		{Name: "swap_growth", Metric: agent.MetricSwapUsedPercent, Kind: KindRateOfChange, Operator: OperatorAbove, Value: 5, Severity: SeverityMedium},
+	}
+	start := time.Now()
+	d := NewDetector(5)
+
+	findings, updated := d.Evaluate(&Baseline{AgentID: "agent"}, agent.SystemMetrics{SwapTotal: 100, SwapUsed: 10}, start, rules)
+	assert.Empty(t, findings)
+	assert.Equal(t, start, updated.ReportedAt)
+
+	// The state of the agent is only in the returned baseline
+	assert.Nil(t, d.Snapshot("agent"))
+
+	findings, updated = d.Evaluate(updated, agent.SystemMetrics{SwapTotal: 100, SwapUsed: 30}, start.Add(time.Minute), rules)
+	assert.Len(t, findings, 1)
+	assert.Equal(t, 20.0, findings[0].Observed)
+	assert.Contains(t, updated.Series, SeriesBaseline{Metric: agent.MetricSwapUsedPercent, Values: []float64{10, 30}, Previous: true})
+	assert.Nil(t, d.Snapshot("agent"))
+}
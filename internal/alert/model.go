@@ -0,0 +1,134 @@
+package alert
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// Detector kinds supported by alert rules.
+const (
+	KindThreshold    = "threshold"      // The metric value itself
+	KindRateOfChange = "rate_of_change" // Change of the metric per minute since the previous report
+	KindZScore       = "zscore"         // Deviation from the agent's own rolling baseline in standard deviations
+)
+
+// Comparison operators of alert rules.
+const (
+	OperatorAbove = ">"
+	OperatorBelow = "<"
+)
+
+// Alert severities.
+const (
+	SeverityHigh   = "high"
+	SeverityMedium = "medium"
+	SeverityLow    = "low"
+)
+
+// Alert states. Rules with a duration start pending and fire once the condition has held for that long.
+const (
+	StatusPending      = "pending"
+	StatusFiring       = "firing"
+	StatusAcknowledged = "acknowledged"
+	StatusResolved     = "resolved"
+)
+
+// ActiveStatuses are the states of alerts whose condition has not been resolved.
+var ActiveStatuses = []string{StatusPending, StatusFiring, StatusAcknowledged}
+
+// SystemActor records transitions made by the alert engine rather than a user.
+const SystemActor = "system"
+
+// Rule describes a condition on an agent metric that raises an alert. Built-in rules have no ID,
+// user-defined rules are stored per user.
+type Rule struct {
+	ID           bson.ObjectID `json:"id,omitempty" bson:"_id,omitempty"`
+	UserID       string        `json:"user_id,omitempty" bson:"user_id,omitempty"` // Owning organisation, which is the user ID for personal organisations
+	Name         string        `json:"name" bson:"name"`
+	Description  string        `json:"description,omitempty" bson:"description,omitempty"`
+	Metric       string        `json:"metric" bson:"metric"`                               // Metric family, e.g. cpu_usage or fs_usage
+	Key          string        `json:"key,omitempty" bson:"key,omitempty"`                 // Mount point, interface, state or resource, empty matches all
+	Kind         string        `json:"kind" bson:"kind"`                                   // threshold, rate_of_change or zscore
+	Operator     string        `json:"operator" bson:"operator"`                           // > or <
+	Value        float64       `json:"value" bson:"value"`                                 // Threshold the detector output is compared with
+	MinSamples   int           `json:"min_samples,omitempty" bson:"min_samples,omitempty"` // Baseline size required before a zscore rule fires
+	Severity     string        `json:"severity" bson:"severity"`
+	AutoDiagnose bool          `json:"auto_diagnose" bson:"auto_diagnose"`                 // Start a diagnostic session when the rule fires
+	ForSeconds   int64         `json:"for_seconds,omitempty" bson:"for_seconds,omitempty"` // How long the condition must hold before the alert fires
+	AgentIDs     []string      `json:"agent_ids,omitempty" bson:"agent_ids,omitempty"`     // Agents the rule applies to
+	Groups       []string      `json:"groups,omitempty" bson:"groups,omitempty"`           // Agent groups the rule applies to, all agents when both are empty
+	Disabled     bool          `json:"disabled,omitempty" bson:"disabled,omitempty"`
+	CreatedAt    time.Time     `json:"created_at,omitempty" bson:"created_at,omitempty"`
+	UpdatedAt    time.Time     `json:"updated_at,omitempty" bson:"updated_at,omitempty"`
+}
+
+// Transition records an alert moving from one state to another.
+type Transition struct {
+	From string    `json:"from,omitempty" bson:"from,omitempty"`
+	To   string    `json:"to" bson:"to"`
+	At   time.Time `json:"at" bson:"at"`
+	By   string    `json:"by" bson:"by"` // User ID, or system for transitions made by the engine
+	Note string    `json:"note,omitempty" bson:"note,omitempty"`
+}
+
+// Finding is a rule matching an incoming metrics report.
+type Finding struct {
+	Rule     Rule
+	Key      string
+	Value    float64 // Metric value in the report
+	Observed float64 // Detector output compared against the rule, e.g. the rate or z-score
+}
+
+// Alert records a rule matching for an agent. Repeated findings for the same agent, rule and key
+// update the active alert instead of creating a new one.
+type Alert struct {
+	ID            bson.ObjectID `json:"id" bson:"_id,omitempty"`
+	UserID        string        `json:"user_id" bson:"user_id"` // Owning organisation, which is the user ID for personal organisations
+	AgentID       string        `json:"agent_id" bson:"agent_id"`
+	Hostname      string        `json:"hostname" bson:"hostname"`
+	Fingerprint   string        `json:"fingerprint" bson:"fingerprint"`
+	RuleID        string        `json:"rule_id,omitempty" bson:"rule_id,omitempty"` // Empty for built-in rules
+	RuleName      string        `json:"rule_name" bson:"rule_name"`
+	Metric        string        `json:"metric" bson:"metric"`
+	Key           string        `json:"key,omitempty" bson:"key,omitempty"`
+	Kind          string        `json:"kind" bson:"kind"`
+	Severity      string        `json:"severity" bson:"severity"`
+	Message       string        `json:"message" bson:"message"`
+	Value         float64       `json:"value" bson:"value"`
+	Observed      float64       `json:"observed" bson:"observed"`
+	Threshold     float64       `json:"threshold" bson:"threshold"`
+	Status        string        `json:"status" bson:"status"`
+	Count         int           `json:"count" bson:"count"`                                         // Number of reports the rule matched while firing
+	SessionIDs    []string      `json:"session_ids,omitempty" bson:"session_ids,omitempty"`         // Diagnostic sessions started from the alert
+	AutoSessionAt *time.Time    `json:"auto_session_at,omitempty" bson:"auto_session_at,omitempty"` // When an automatic session was claimed for the alert
+	StartedAt     time.Time     `json:"started_at" bson:"started_at"`                               // First report matching the rule
+	FiredAt       *time.Time    `json:"fired_at,omitempty" bson:"fired_at,omitempty"`
+	LastSeenAt    time.Time     `json:"last_seen_at" bson:"last_seen_at"`
+	AckedAt       *time.Time    `json:"acknowledged_at,omitempty" bson:"acknowledged_at,omitempty"`
+	AckedBy       string        `json:"acknowledged_by,omitempty" bson:"acknowledged_by,omitempty"`
+	ResolvedAt    *time.Time    `json:"resolved_at,omitempty" bson:"resolved_at,omitempty"`
+	History       []Transition  `json:"history" bson:"history"`
+}
+
+// SeriesBaseline holds the recent values of one metric series of an agent, oldest first.
+type SeriesBaseline struct {
+	Metric   string    `bson:"metric"`
+	Key      string    `bson:"key"`
+	Values   []float64 `bson:"values"`
+	Previous bool      `bson:"previous"` // Whether the last value came from the previous report
+}
+
+// Baseline is the detector state of an agent. It is stored after every report so that each API
+// instance evaluates the next report against the same history, also after a restart.
+type Baseline struct {
+	AgentID    string           `bson:"_id"`
+	ReportedAt time.Time        `bson:"reported_at"` // Time of the previous report
+	Series     []SeriesBaseline `bson:"series"`
+	Version    int64            `bson:"version"` // Incremented on every save, 0 for baselines saved before versions were added
+}
+
+// TransitionRequest carries an optional note when a user acknowledges or resolves an alert.
+type TransitionRequest struct {
+	Note string `json:"note"`
+}
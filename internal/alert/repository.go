@@ -0,0 +1,284 @@
+package alert
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+type AlertRepository struct {
+	collection *mongo.Collection
+}
+
+func NewAlertRepository(db *mongo.Database) *AlertRepository {
+	return &AlertRepository{
+		collection: db.Collection("alerts"),
+	}
+}
+
+func (r *AlertRepository) InsertAlert(ctx context.Context, alert *Alert) error {
+	result, err := r.collection.InsertOne(ctx, alert)
+	if err != nil {
+		return fmt.Errorf("failed to insert alert: %v", err)
+	}
+	alert.ID = result.InsertedID.(bson.ObjectID)
+	return nil
+}
+
+// GetAlert returns the alert with the ID, or nil if there is none.
+func (r *AlertRepository) GetAlert(ctx context.Context, id bson.ObjectID) (*Alert, error) {
+	var alert Alert
+	err := r.collection.FindOne(ctx, bson.M{"_id": id}).Decode(&alert)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to retrieve alert: %v", err)
+	}
+	return &alert, nil
+}
+
+// ListActiveAlerts returns the pending, firing and acknowledged alerts of an agent.
+func (r *AlertRepository) ListActiveAlerts(ctx context.Context, agentID string) ([]*Alert, error) {
+	return r.findAlerts(ctx, bson.M{"agent_id": agentID, "status": bson.M{"$in": ActiveStatuses}})
+}
+
+// ListAlerts returns the alerts of a user, newest first, optionally filtered by status.
+func (r *AlertRepository) ListAlerts(ctx context.Context, userID, status string) ([]*Alert, error) {
+	filter := bson.M{"user_id": userID}
+	if status != "" {
+		filter["status"] = status
+	}
+	return r.findAlerts(ctx, filter)
+}
+
+func (r *AlertRepository) findAlerts(ctx context.Context, filter bson.M) ([]*Alert, error) {
+	opts := options.Find().SetSort(bson.M{"started_at": -1})
+	cursor, err := r.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list alerts: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	var alerts []*Alert
+	if err := cursor.All(ctx, &alerts); err != nil {
+		return nil, fmt.Errorf("failed to decode alerts: %v", err)
+	}
+	return alerts, nil
+}
+
+// TouchAlert records another matching report for an active alert.
+func (r *AlertRepository) TouchAlert(ctx context.Context, id bson.ObjectID, value, observed float64, seenAt time.Time) error {
+	update := bson.M{
+		"$set": bson.M{"value": value, "observed": observed, "last_seen_at": seenAt},
+		"$inc": bson.M{"count": 1},
+	}
+	if _, err := r.collection.UpdateByID(ctx, id, update); err != nil {
+		return fmt.Errorf("failed to update alert: %v", err)
+	}
+	return nil
+}
+
+// TransitionAlert moves an alert to a new state if it is still in the state the transition starts from.
+// It reports false when the alert was not in that state.
+func (r *AlertRepository) TransitionAlert(ctx context.Context, id bson.ObjectID, transition Transition) (bool, error) {
+	set := bson.M{"status": transition.To}
+	switch transition.To {
+	case StatusFiring:
+		set["fired_at"] = transition.At
+	case StatusAcknowledged:
+		set["acknowledged_at"] = transition.At
+		set["acknowledged_by"] = transition.By
+	case StatusResolved:
+		set["resolved_at"] = transition.At
+	}
+
+	filter := bson.M{"_id": id, "status": transition.From}
+	update := bson.M{"$set": set, "$push": bson.M{"history": transition}}
+	result, err := r.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, fmt.Errorf("failed to update alert status: %v", err)
+	}
+	return result.ModifiedCount > 0, nil
+}
+
+// AddSession links a diagnostic session to an alert.
+func (r *AlertRepository) AddSession(ctx context.Context, id bson.ObjectID, sessionID string) error {
+	if _, err := r.collection.UpdateByID(ctx, id, bson.M{"$addToSet": bson.M{"session_ids": sessionID}}); err != nil {
+		return fmt.Errorf("failed to link session to alert: %v", err)
+	}
+	return nil
+}
+
+// ClaimAutoSession records that an automatic diagnostic session starts for the alert. It reports false when
+// the alert already has one or another alert of the agent claimed one within the cooldown, so only one API
+// instance starts a session for an alert.
+func (r *AlertRepository) ClaimAutoSession(ctx context.Context, alert *Alert, cooldown time.Duration, now time.Time) (bool, error) {
+	recent, err := r.collection.CountDocuments(ctx, bson.M{"agent_id": alert.AgentID, "auto_session_at": bson.M{"$gt": now.Add(-cooldown)}})
+	if err != nil {
+		return false, fmt.Errorf("failed to check automatic sessions: %v", err)
+	}
+	if recent > 0 {
+		return false, nil
+	}
+
+	filter := bson.M{"_id": alert.ID, "auto_session_at": bson.M{"$exists": false}}
+	result, err := r.collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"auto_session_at": now}})
+	if err != nil {
+		return false, fmt.Errorf("failed to claim automatic session: %v", err)
+	}
+	if result.ModifiedCount == 0 {
+		return false, nil
+	}
+	alert.AutoSessionAt = &now
+	return true, nil
+}
+
+// ReassignAgentAlerts moves the alerts of an agent to another agent and returns how many were moved.
+func (r *AlertRepository) ReassignAgentAlerts(ctx context.Context, fromAgentID, toAgentID string) (int64, error) {
+	result, err := r.collection.UpdateMany(ctx, bson.M{"agent_id": fromAgentID}, bson.M{"$set": bson.M{"agent_id": toAgentID}})
+	if err != nil {
+		return 0, fmt.Errorf("failed to reassign agent alerts: %v", err)
+	}
+	return result.ModifiedCount, nil
+}
+
+type RuleRepository struct {
+	collection *mongo.Collection
+}
+
+func NewRuleRepository(db *mongo.Database) *RuleRepository {
+	return &RuleRepository{
+		collection: db.Collection("alert_rules"),
+	}
+}
+
+func (r *RuleRepository) InsertRule(ctx context.Context, rule *Rule) error {
+	rule.CreatedAt = time.Now()
+	rule.UpdatedAt = rule.CreatedAt
+	result, err := r.collection.InsertOne(ctx, rule)
+	if err != nil {
+		return fmt.Errorf("failed to insert alert rule: %v", err)
+	}
+	rule.ID = result.InsertedID.(bson.ObjectID)
+	return nil
+}
+
+// GetRule returns the rule with the ID, or nil if there is none.
+func (r *RuleRepository) GetRule(ctx context.Context, id bson.ObjectID) (*Rule, error) {
+	var rule Rule
+	err := r.collection.FindOne(ctx, bson.M{"_id": id}).Decode(&rule)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to retrieve alert rule: %v", err)
+	}
+	return &rule, nil
+}
+
+// ListRules returns the rules of a user ordered by name.
+func (r *RuleRepository) ListRules(ctx context.Context, userID string) ([]*Rule, error) {
+	opts := options.Find().SetSort(bson.M{"name": 1})
+	cursor, err := r.collection.Find(ctx, bson.M{"user_id": userID}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list alert rules: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	var rules []*Rule
+	if err := cursor.All(ctx, &rules); err != nil {
+		return nil, fmt.Errorf("failed to decode alert rules: %v", err)
+	}
+	return rules, nil
+}
+
+// UpdateRule replaces the definition of a rule, keeping its owner and creation time.
+func (r *RuleRepository) UpdateRule(ctx context.Context, rule *Rule) error {
+	rule.UpdatedAt = time.Now()
+	update := bson.M{"$set": bson.M{
+		"name":          rule.Name,
+		"description":   rule.Description,
+		"metric":        rule.Metric,
+		"key":           rule.Key,
+		"kind":          rule.Kind,
+		"operator":      rule.Operator,
+		"value":         rule.Value,
+		"min_samples":   rule.MinSamples,
+		"severity":      rule.Severity,
+		"auto_diagnose": rule.AutoDiagnose,
+		"for_seconds":   rule.ForSeconds,
+		"agent_ids":     rule.AgentIDs,
+		"groups":        rule.Groups,
+		"disabled":      rule.Disabled,
+		"updated_at":    rule.UpdatedAt,
+	}}
+	result, err := r.collection.UpdateOne(ctx, bson.M{"_id": rule.ID, "user_id": rule.UserID}, update)
+	if err != nil {
+		return fmt.Errorf("failed to update alert rule: %v", err)
+	}
+	if result.MatchedCount == 0 {
+		return fmt.Errorf("alert rule not found")
+	}
+	return nil
+}
+
+func (r *RuleRepository) DeleteRule(ctx context.Context, id bson.ObjectID, userID string) error {
+	result, err := r.collection.DeleteOne(ctx, bson.M{"_id": id, "user_id": userID})
+	if err != nil {
+		return fmt.Errorf("failed to delete alert rule: %v", err)
+	}
+	if result.DeletedCount == 0 {
+		return fmt.Errorf("alert rule not found")
+	}
+	return nil
+}
+
+type BaselineRepository struct {
+	collection *mongo.Collection
+}
+
+func NewBaselineRepository(db *mongo.Database) *BaselineRepository {
+	return &BaselineRepository{
+		collection: db.Collection("alert_baselines"),
+	}
+}
+
+// GetBaseline returns the detector state of an agent, or nil if none was stored yet.
+func (r *BaselineRepository) GetBaseline(ctx context.Context, agentID string) (*Baseline, error) {
+	var baseline Baseline
+	err := r.collection.FindOne(ctx, bson.M{"_id": agentID}).Decode(&baseline)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to retrieve alert baseline: %v", err)
+	}
+	return &baseline, nil
+}
+
+// SaveBaseline stores the detector state of an agent unless another report updated it since it was read
+// at baseline.Version, and increments the version. It reports false when the baseline changed in the
+// meantime.
+func (r *BaselineRepository) SaveBaseline(ctx context.Context, baseline *Baseline) (bool, error) {
+	filter := bson.M{"_id": baseline.AgentID, "version": baseline.Version}
+	if baseline.Version == 0 {
+		filter["version"] = bson.M{"$in": bson.A{0, nil}}
+	}
+	saved := *baseline
+	saved.Version++
+	// A baseline stored since it was read does not match, so the upsert fails on its ID
+	opts := options.Replace().SetUpsert(true)
+	if _, err := r.collection.ReplaceOne(ctx, filter, saved, opts); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to save alert baseline: %v", err)
+	}
+	baseline.Version = saved.Version
+	return true, nil
+}
@@ -0,0 +1,496 @@
+package alert
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+
+	"github.com/harshavmb/nannyapi/internal/agent"
+	"github.com/harshavmb/nannyapi/internal/diagnostic"
+)
+
+const (
+	defaultSessionCooldown = 30 * time.Minute
+	defaultBaselineSamples = 60
+	sessionStartTimeout    = 2 * time.Minute
+)
+
+// Config holds the settings of the anomaly engine.
+type Config struct {
+	AutoDiagnose    bool          // Start diagnostic sessions for rules that ask for it
+	SessionCooldown time.Duration // Minimum time between automatic sessions on the same agent
+	BaselineSamples int           // Number of reports kept per series for zscore rules
+}
+
+// DefaultConfig returns the default engine settings. Automatic sessions are off by default.
+func DefaultConfig() Config {
+	return Config{
+		SessionCooldown: defaultSessionCooldown,
+		BaselineSamples: defaultBaselineSamples,
+	}
+}
+
+// ConfigFromEnv reads ALERT_AUTO_DIAGNOSE, ALERT_SESSION_COOLDOWN and ALERT_BASELINE_SAMPLES,
+// falling back to the defaults for any variable that is not set.
+func ConfigFromEnv() (Config, error) {
+	config := DefaultConfig()
+
+	if value := os.Getenv("ALERT_AUTO_DIAGNOSE"); value != "" {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return config, fmt.Errorf("invalid ALERT_AUTO_DIAGNOSE %q", value)
+		}
+		config.AutoDiagnose = enabled
+	}
+	if value := os.Getenv("ALERT_SESSION_COOLDOWN"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return config, fmt.Errorf("invalid ALERT_SESSION_COOLDOWN %q", value)
+		}
+		config.SessionCooldown = d
+	}
+	if value := os.Getenv("ALERT_BASELINE_SAMPLES"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 2 {
+			return config, fmt.Errorf("invalid ALERT_BASELINE_SAMPLES %q, must be at least 2", value)
+		}
+		config.BaselineSamples = n
+	}
+	return config, nil
+}
+
+// SessionStarter starts diagnostic sessions for alerts.
+type SessionStarter interface {
+	StartDiagnosticSession(ctx context.Context, agentID string, userID string, issue string) (*diagnostic.DiagnosticSession, error)
+}
+
+// AlertService evaluates agent metrics against alert rules and manages the resulting alerts.
+type AlertService struct {
+	repository         *AlertRepository
+	ruleRepository     *RuleRepository
+	baselineRepository *BaselineRepository
+	detector           *Detector
+	config             Config
+	sessions           SessionStarter
+	groups             agent.GroupResolver
+}
+
+func NewAlertService(repository *AlertRepository, ruleRepository *RuleRepository, baselineRepository *BaselineRepository, config Config) *AlertService {
+	return &AlertService{
+		repository:         repository,
+		ruleRepository:     ruleRepository,
+		baselineRepository: baselineRepository,
+		detector:           NewDetector(config.BaselineSamples),
+		config:             config,
+	}
+}
+
+// SetSessionStarter registers the service used to start automatic diagnostic sessions.
+func (s *AlertService) SetSessionStarter(sessions SessionStarter) {
+	s.sessions = sessions
+}
+
+// SetGroupResolver registers how the groups of an agent are looked up for rules limited to groups.
+func (s *AlertService) SetGroupResolver(groups agent.GroupResolver) {
+	s.groups = groups
+}
+
+// rulesFor returns the built-in rules and the enabled rules of the agent's owner that apply to it.
+func (s *AlertService) rulesFor(ctx context.Context, info *agent.AgentInfo) ([]Rule, error) {
+	rules := DefaultRules()
+	userRules, err := s.ruleRepository.ListRules(ctx, info.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Groups are only looked up when a rule needs them
+	var groups []string
+	if s.groups != nil && slices.ContainsFunc(userRules, (*Rule).targetsGroups) {
+		if groups, err = s.groups(ctx, info); err != nil {
+			return nil, fmt.Errorf("failed to resolve agent groups: %v", err)
+		}
+	}
+
+	for _, rule := range userRules {
+		if rule.appliesTo(info.ID.Hex(), groups) {
+			rules = append(rules, *rule)
+		}
+	}
+	return rules, nil
+}
+
+// Evaluate checks a metrics report against the rules of the agent. New findings raise alerts,
+// repeated findings update the active alert and alerts whose condition cleared are resolved.
+func (s *AlertService) Evaluate(ctx context.Context, info *agent.AgentInfo) error {
+	reportedAt := info.UpdatedAt
+	if reportedAt.IsZero() {
+		reportedAt = time.Now()
+	}
+	agentID := info.ID.Hex()
+
+	rules, err := s.rulesFor(ctx, info)
+	if err != nil {
+		return fmt.Errorf("failed to load alert rules: %v", err)
+	}
+	findings, err := s.detect(ctx, agentID, info.SystemMetrics, reportedAt, rules)
+	if err != nil {
+		return err
+	}
+
+	activeAlerts, err := s.repository.ListActiveAlerts(ctx, agentID)
+	if err != nil {
+		return err
+	}
+	byFingerprint := make(map[string]*Alert, len(activeAlerts))
+	for _, alert := range activeAlerts {
+		byFingerprint[alert.Fingerprint] = alert
+	}
+
+	matched := map[string]bool{}
+	for _, finding := range findings {
+		fingerprint := Fingerprint(agentID, finding.Rule.ref(), finding.Key)
+		matched[fingerprint] = true
+
+		alert, ok := byFingerprint[fingerprint]
+		startedFiring := false
+		if !ok {
+			alert = newAlert(info, finding, fingerprint, reportedAt)
+			if err := s.repository.InsertAlert(ctx, alert); err != nil {
+				return err
+			}
+			log.Printf("Alert %s - Agent: %s, Rule: %s, Message: %s", alert.Status, agentID, alert.RuleName, alert.Message)
+			startedFiring = alert.Status == StatusFiring
+		} else if err := s.repository.TouchAlert(ctx, alert.ID, finding.Value, finding.Observed, reportedAt); err != nil {
+			return err
+		}
+
+		// Pending alerts fire once the condition has held for the duration of the rule
+		if alert.Status == StatusPending && reportedAt.Sub(alert.StartedAt) >= time.Duration(finding.Rule.ForSeconds)*time.Second {
+			if startedFiring, err = s.transition(ctx, alert, StatusFiring, SystemActor, "", reportedAt); err != nil {
+				return err
+			}
+			if startedFiring {
+				log.Printf("Alert firing - Agent: %s, Rule: %s, Message: %s", agentID, alert.RuleName, alert.Message)
+			}
+		}
+
+		// Sessions start only when an alert starts firing, not on every matching report
+		if startedFiring {
+			if err := s.maybeDiagnose(ctx, alert, finding.Rule, reportedAt); err != nil {
+				return err
+			}
+		}
+	}
+
+	for fingerprint, alert := range byFingerprint {
+		if matched[fingerprint] {
+			continue
+		}
+		if _, err := s.transition(ctx, alert, StatusResolved, SystemActor, "condition cleared", reportedAt); err != nil {
+			return err
+		}
+		log.Printf("Alert resolved - Agent: %s, Rule: %s", agentID, alert.RuleName)
+	}
+	return nil
+}
+
+// baselineRetries is how often a report is evaluated again when the baseline of its agent was updated by a
+// concurrent report.
+const baselineRetries = 3
+
+// detect runs the detector on a report against the stored baseline of the agent and stores the updated baseline,
+// so reports evaluated by another API instance or before a restart count towards it. A report that raced
+// with another one of the agent is evaluated again against the baseline that includes the other one.
+func (s *AlertService) detect(ctx context.Context, agentID string, metrics agent.SystemMetrics, reportedAt time.Time, rules []Rule) ([]Finding, error) {
+	if s.baselineRepository == nil {
+		return s.detector.Detect(agentID, metrics, reportedAt, rules), nil
+	}
+
+	for attempt := 0; attempt < baselineRetries; attempt++ {
+		stored, err := s.baselineRepository.GetBaseline(ctx, agentID)
+		if err != nil {
+			return nil, err
+		}
+		if stored == nil {
+			stored = &Baseline{AgentID: agentID}
+		}
+		findings, updated := s.detector.Evaluate(stored, metrics, reportedAt, rules)
+		updated.Version = stored.Version
+		saved, err := s.baselineRepository.SaveBaseline(ctx, updated)
+		if err != nil {
+			return nil, err
+		}
+		if saved {
+			return findings, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to save alert baseline of agent %s: updated concurrently %d times", agentID, baselineRetries)
+}
+
+// transition moves an alert to a new state and records it in the alert history.
+// It reports false when the alert changed state concurrently.
+func (s *AlertService) transition(ctx context.Context, alert *Alert, to, by, note string, at time.Time) (bool, error) {
+	transition := Transition{From: alert.Status, To: to, At: at, By: by, Note: note}
+	ok, err := s.repository.TransitionAlert(ctx, alert.ID, transition)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	alert.Status = to
+	alert.History = append(alert.History, transition)
+	switch to {
+	case StatusFiring:
+		alert.FiredAt = &at
+	case StatusAcknowledged:
+		alert.AckedAt = &at
+		alert.AckedBy = by
+	case StatusResolved:
+		alert.ResolvedAt = &at
+	}
+	return true, nil
+}
+
+// maybeDiagnose starts an automatic diagnostic session for a firing alert when the rule asks for one
+// and the agent is not in its session cooldown. The session is claimed on the alert first, so only
+// one API instance starts it.
+func (s *AlertService) maybeDiagnose(ctx context.Context, alert *Alert, rule Rule, now time.Time) error {
+	if !rule.AutoDiagnose || !s.config.AutoDiagnose || s.sessions == nil {
+		return nil
+	}
+	claimed, err := s.repository.ClaimAutoSession(ctx, alert, s.config.SessionCooldown, now)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		log.Printf("Skipping automatic diagnosis during cooldown - Alert: %s, Agent: %s", alert.ID.Hex(), alert.AgentID)
+		return nil
+	}
+	go s.startSession(alert)
+	return nil
+}
+
+// ReassignAgentAlerts moves every alert of an agent to another agent and returns how many were moved.
+// Their fingerprints still name the old agent, so moved active alerts resolve on the next report.
+func (s *AlertService) ReassignAgentAlerts(ctx context.Context, fromAgentID, toAgentID string) (int64, error) {
+	return s.repository.ReassignAgentAlerts(ctx, fromAgentID, toAgentID)
+}
+
+// ListAlerts returns the alerts of a user, optionally filtered by status.
+func (s *AlertService) ListAlerts(ctx context.Context, userID, status string) ([]*Alert, error) {
+	if status != "" && status != StatusResolved && !slices.Contains(ActiveStatuses, status) {
+		return nil, fmt.Errorf("invalid alert status %q", status)
+	}
+	return s.repository.ListAlerts(ctx, userID, status)
+}
+
+// GetAlert returns an alert of the user.
+func (s *AlertService) GetAlert(ctx context.Context, id bson.ObjectID, userID string) (*Alert, error) {
+	alert, err := s.repository.GetAlert(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if alert == nil {
+		return nil, fmt.Errorf("alert not found")
+	}
+	if alert.UserID != userID {
+		return nil, fmt.Errorf("alert does not belong to user")
+	}
+	return alert, nil
+}
+
+// AcknowledgeAlert marks a firing alert as being handled by the user.
+func (s *AlertService) AcknowledgeAlert(ctx context.Context, id bson.ObjectID, userID, note string) (*Alert, error) {
+	alert, err := s.GetAlert(ctx, id, userID)
+	if err != nil {
+		return nil, err
+	}
+	if alert.Status != StatusFiring {
+		return nil, fmt.Errorf("invalid alert transition: cannot acknowledge a %s alert", alert.Status)
+	}
+	return s.userTransition(ctx, alert, StatusAcknowledged, userID, note)
+}
+
+// ResolveAlert closes an active alert. If its condition still holds, the next report raises a new alert.
+func (s *AlertService) ResolveAlert(ctx context.Context, id bson.ObjectID, userID, note string) (*Alert, error) {
+	alert, err := s.GetAlert(ctx, id, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(ActiveStatuses, alert.Status) {
+		return nil, fmt.Errorf("invalid alert transition: cannot resolve a %s alert", alert.Status)
+	}
+	return s.userTransition(ctx, alert, StatusResolved, userID, note)
+}
+
+func (s *AlertService) userTransition(ctx context.Context, alert *Alert, to, userID, note string) (*Alert, error) {
+	from := alert.Status
+	ok, err := s.transition(ctx, alert, to, userID, note, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("invalid alert transition: alert is no longer %s", from)
+	}
+	return alert, nil
+}
+
+// DiagnoseAlert starts a diagnostic session for an alert on behalf of the user and links it to the alert.
+func (s *AlertService) DiagnoseAlert(ctx context.Context, id bson.ObjectID, userID string) (*diagnostic.DiagnosticSession, error) {
+	alert, err := s.GetAlert(ctx, id, userID)
+	if err != nil {
+		return nil, err
+	}
+	if s.sessions == nil {
+		return nil, fmt.Errorf("diagnostic sessions are not available")
+	}
+
+	session, err := s.sessions.StartDiagnosticSession(ctx, alert.AgentID, userID, IssueDescription(alert))
+	if err != nil {
+		return nil, err
+	}
+	if err := s.repository.AddSession(ctx, alert.ID, session.ID.Hex()); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// CreateRule validates and stores a rule for the user.
+func (s *AlertService) CreateRule(ctx context.Context, rule *Rule) error {
+	if err := rule.Validate(); err != nil {
+		return err
+	}
+	rule.ID = bson.ObjectID{}
+	return s.ruleRepository.InsertRule(ctx, rule)
+}
+
+// GetRule returns a rule of the user.
+func (s *AlertService) GetRule(ctx context.Context, id bson.ObjectID, userID string) (*Rule, error) {
+	rule, err := s.ruleRepository.GetRule(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if rule == nil {
+		return nil, fmt.Errorf("alert rule not found")
+	}
+	if rule.UserID != userID {
+		return nil, fmt.Errorf("alert rule does not belong to user")
+	}
+	return rule, nil
+}
+
+// ListRules returns the rules of the user.
+func (s *AlertService) ListRules(ctx context.Context, userID string) ([]*Rule, error) {
+	return s.ruleRepository.ListRules(ctx, userID)
+}
+
+// UpdateRule validates and replaces a rule of the user. Active alerts of the rule are re-evaluated
+// against the new definition on the next report.
+func (s *AlertService) UpdateRule(ctx context.Context, rule *Rule) error {
+	existing, err := s.GetRule(ctx, rule.ID, rule.UserID)
+	if err != nil {
+		return err
+	}
+	if err := rule.Validate(); err != nil {
+		return err
+	}
+	rule.CreatedAt = existing.CreatedAt
+	return s.ruleRepository.UpdateRule(ctx, rule)
+}
+
+// DeleteRule deletes a rule of the user. Its active alerts resolve on the next report of each agent.
+func (s *AlertService) DeleteRule(ctx context.Context, id bson.ObjectID, userID string) error {
+	if _, err := s.GetRule(ctx, id, userID); err != nil {
+		return err
+	}
+	return s.ruleRepository.DeleteRule(ctx, id, userID)
+}
+
+// startSession starts a diagnostic session for an alert and links it to the alert.
+func (s *AlertService) startSession(alert *Alert) {
+	ctx, cancel := context.WithTimeout(context.Background(), sessionStartTimeout)
+	defer cancel()
+
+	session, err := s.sessions.StartDiagnosticSession(ctx, alert.AgentID, alert.UserID, IssueDescription(alert))
+	if err != nil {
+		log.Printf("Error starting diagnostic session for alert - Alert: %s, Error: %v", alert.ID.Hex(), err)
+		return
+	}
+	if err := s.repository.AddSession(ctx, alert.ID, session.ID.Hex()); err != nil {
+		log.Printf("Error linking diagnostic session to alert - Alert: %s, Session: %s, Error: %v", alert.ID.Hex(), session.ID.Hex(), err)
+		return
+	}
+	log.Printf("Started diagnostic session for alert - Alert: %s, Session: %s", alert.ID.Hex(), session.ID.Hex())
+}
+
+// Fingerprint identifies the alerts of one rule on one series of an agent.
+func Fingerprint(agentID, ruleName, key string) string {
+	return agentID + "/" + ruleName + "/" + key
+}
+
+// newAlert creates the alert for a finding. Rules with a duration start pending, the others fire immediately.
+func newAlert(info *agent.AgentInfo, finding Finding, fingerprint string, startedAt time.Time) *Alert {
+	alert := &Alert{
+		UserID:      info.UserID,
+		AgentID:     info.ID.Hex(),
+		Hostname:    info.Hostname,
+		Fingerprint: fingerprint,
+		RuleName:    finding.Rule.Name,
+		Metric:      finding.Rule.Metric,
+		Key:         finding.Key,
+		Kind:        finding.Rule.Kind,
+		Severity:    finding.Rule.Severity,
+		Message:     describeFinding(finding),
+		Value:       finding.Value,
+		Observed:    finding.Observed,
+		Threshold:   finding.Rule.Value,
+		Status:      StatusPending,
+		Count:       1,
+		StartedAt:   startedAt,
+		LastSeenAt:  startedAt,
+	}
+	if !finding.Rule.ID.IsZero() {
+		alert.RuleID = finding.Rule.ID.Hex()
+	}
+	if finding.Rule.ForSeconds == 0 {
+		alert.Status = StatusFiring
+		alert.FiredAt = &startedAt
+	}
+	alert.History = []Transition{{To: alert.Status, At: startedAt, By: SystemActor}}
+	return alert
+}
+
+// describeFinding explains why a rule fired, e.g. "CPU usage is very high: cpu_usage is 95.0 (> 90.0)".
+func describeFinding(finding Finding) string {
+	rule := finding.Rule
+	series := rule.Metric
+	if finding.Key != "" {
+		series = fmt.Sprintf("%s[%s]", rule.Metric, finding.Key)
+	}
+
+	var detail string
+	switch rule.Kind {
+	case KindRateOfChange:
+		detail = fmt.Sprintf("%s is changing by %.1f per minute (%s %.1f)", series, finding.Observed, rule.Operator, rule.Value)
+	case KindZScore:
+		detail = fmt.Sprintf("%s is %.1f, %.1f standard deviations from its baseline (%s %.1f)", series, finding.Value, finding.Observed, rule.Operator, rule.Value)
+	default:
+		detail = fmt.Sprintf("%s is %.1f (%s %.1f)", series, finding.Value, rule.Operator, rule.Value)
+	}
+
+	if rule.Description == "" {
+		return detail
+	}
+	return rule.Description + ": " + detail
+}
+
+// IssueDescription generates the issue of a diagnostic session started for an alert.
+func IssueDescription(alert *Alert) string {
+	return fmt.Sprintf("Automatic %s severity alert on %s: %s. Find the root cause of this anomaly.",
+		alert.Severity, alert.Hostname, alert.Message)
+}
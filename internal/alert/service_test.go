@@ -0,0 +1,108 @@
+package alert
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/v2/bson"
+
+	"github.com/harshavmb/nannyapi/internal/agent"
+)
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Run("Defaults", func(t *testing.T) {
+		t.Setenv("ALERT_AUTO_DIAGNOSE", "")
+		t.Setenv("ALERT_SESSION_COOLDOWN", "")
+		t.Setenv("ALERT_BASELINE_SAMPLES", "")
+		config, err := ConfigFromEnv()
+		assert.NoError(t, err)
+		assert.Equal(t, DefaultConfig(), config)
+		assert.False(t, config.AutoDiagnose)
+	})
+
+	t.Run("Overrides", func(t *testing.T) {
+		t.Setenv("ALERT_AUTO_DIAGNOSE", "true")
+		t.Setenv("ALERT_SESSION_COOLDOWN", "1h")
+		t.Setenv("ALERT_BASELINE_SAMPLES", "120")
+		config, err := ConfigFromEnv()
+		assert.NoError(t, err)
+		assert.True(t, config.AutoDiagnose)
+		assert.Equal(t, time.Hour, config.SessionCooldown)
+		assert.Equal(t, 120, config.BaselineSamples)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		for name, value := range map[string]string{
+			"ALERT_AUTO_DIAGNOSE":    "sometimes",
+			"ALERT_SESSION_COOLDOWN": "soon",
+			"ALERT_BASELINE_SAMPLES": "1",
+		} {
+			t.Run(name, func(t *testing.T) {
+				t.Setenv(name, value)
+				_, err := ConfigFromEnv()
+				assert.Error(t, err)
+			})
+		}
+	})
+}
+
+func TestDescribeFinding(t *testing.T) {
+	testCases := []struct {
+		name     string
+		finding  Finding
+		expected string
+	}{
+		{
+			"Threshold",
+			Finding{Rule: Rule{Description: "Filesystem is almost full", Metric: agent.MetricFSUsage, Kind: KindThreshold, Operator: OperatorAbove, Value: 90}, Key: "/", Value: 95, Observed: 95},
+			"Filesystem is almost full: fs_usage[/] is 95.0 (> 90.0)",
+		},
+		{
+			"RateOfChange",
+			Finding{Rule: Rule{Metric: agent.MetricSwapUsedPercent, Kind: KindRateOfChange, Operator: OperatorAbove, Value: 5}, Value: 40, Observed: 10},
+			"swap_used_percent is changing by 10.0 per minute (> 5.0)",
+		},
+		{
+			"ZScore",
+			Finding{Rule: Rule{Metric: agent.MetricCPUUsage, Kind: KindZScore, Operator: OperatorAbove, Value: 3}, Value: 90, Observed: 13},
+			"cpu_usage is 90.0, 13.0 standard deviations from its baseline (> 3.0)",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, describeFinding(tc.finding))
+		})
+	}
+}
+
+func TestIssueDescription(t *testing.T) {
+	alert := &Alert{Hostname: "db-1", Severity: SeverityHigh, Message: "Memory usage is very high: memory_used_percent is 95.0 (> 90.0)"}
+
+	issue := IssueDescription(alert)
+	assert.Contains(t, issue, "high severity alert on db-1")
+	assert.Contains(t, issue, "memory_used_percent is 95.0")
+}
+
+func TestNewAlert(t *testing.T) {
+	info := &agent.AgentInfo{ID: bson.NewObjectID(), UserID: "user-1", Hostname: "web-1"}
+	startedAt := time.Now()
+
+	rule := Rule{Name: "high_cpu", Metric: agent.MetricCPUUsage, Kind: KindThreshold, Operator: OperatorAbove, Value: 90, Severity: SeverityHigh}
+	firing := newAlert(info, Finding{Rule: rule, Value: 95, Observed: 95}, "fp", startedAt)
+	assert.Equal(t, StatusFiring, firing.Status)
+	assert.Equal(t, &startedAt, firing.FiredAt)
+	assert.Empty(t, firing.RuleID)
+	assert.Equal(t, []Transition{{To: StatusFiring, At: startedAt, By: SystemActor}}, firing.History)
+
+	rule.ID = bson.NewObjectID()
+	rule.ForSeconds = 600
+	pending := newAlert(info, Finding{Rule: rule, Value: 95, Observed: 95}, "fp", startedAt)
+	assert.Equal(t, StatusPending, pending.Status)
+	assert.Nil(t, pending.FiredAt)
+	assert.Equal(t, rule.ID.Hex(), pending.RuleID)
+	assert.Equal(t, info.ID.Hex(), pending.AgentID)
+	assert.Equal(t, "user-1", pending.UserID)
+	assert.Len(t, pending.History, 1)
+}
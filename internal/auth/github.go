@@ -7,7 +7,6 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"math/big"
 	"net/http"
 	"reflect"
 	"strings"
@@ -20,36 +19,26 @@ import (
 	"github.com/harshavmb/nannyapi/internal/user"
 )
 
+// githubProvider names GitHub in login states.
+const githubProvider = "github"
+
 type GitHubAuth struct {
 	oauthConf           *oauth2.Config
 	randSrc             io.Reader
 	userService         *user.UserService
 	refreshTokenService *token.RefreshTokenService
-	nannyEncryptionKey  string
-	jwtSecret           string
+	envelope            *token.Envelope
+	jwtSecret           string // Signs the state cookie
+	keys                *token.Keyring
 	frontEndHost        string
-}
-
-func (g *GitHubAuth) generateStateString() (string, error) {
-	const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-	b := make([]byte, 16)
-
-	for i := range b {
-		randomIndex, err := rand.Int(rand.Reader, big.NewInt(int64(len(letters))))
-		if err != nil {
-			return "", err
-		}
-		b[i] = letters[randomIndex.Int64()]
-	}
-
-	return string(b), nil
+	nonces              NonceStore
 }
 
 // creating a new OAuth App at https://github.com/settings/applications/new
 // The "Authorization callback URL" you set there must match the redirect URL
 // you use in your code.  For local testing, something like
 // "http://localhost:8080/github/callback" is typical.
-func NewGitHubAuth(clientID, clientSecret, redirectURL string, userService *user.UserService, refreshTokenService *token.RefreshTokenService, nannyEncryptionKey, jwtSecret, frontEndHost string) *GitHubAuth {
+func NewGitHubAuth(clientID, clientSecret, redirectURL string, userService *user.UserService, refreshTokenService *token.RefreshTokenService, envelope *token.Envelope, jwtSecret string, keys *token.Keyring, frontEndHost string, nonces NonceStore) *GitHubAuth {
 	return &GitHubAuth{
 		oauthConf: &oauth2.Config{
 			ClientID:     clientID,
@@ -61,48 +50,54 @@ func NewGitHubAuth(clientID, clientSecret, redirectURL string, userService *user
 		randSrc:             rand.Reader,
 		userService:         userService,
 		refreshTokenService: refreshTokenService,
-		nannyEncryptionKey:  nannyEncryptionKey,
+		envelope:            envelope,
 		jwtSecret:           jwtSecret,
+		keys:                keys,
 		frontEndHost:        frontEndHost,
+		nonces:              nonces,
 	}
 }
 
 func (g *GitHubAuth) HandleGitHubLogin() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		state, err := g.generateStateString()
+		login, err := newLoginState(githubProvider, time.Now())
 		if err != nil {
 			http.Error(w, "Failed to generate state", http.StatusInternalServerError)
 			return
 		}
+		setStateCookie(w, r, login, g.jwtSecret)
 
-		// set secure flag to true if the request is coming from https
-		secure := r.TLS != nil
-
-		http.SetCookie(w, &http.Cookie{
-			Name:     "oauthstate",
-			Value:    state,
-			Expires:  time.Now().Add(1 * time.Hour),
-			HttpOnly: true,
-			Path:     "/", // Ensure the cookie is sent with the callback request
-			Secure:   secure,
-			SameSite: http.SameSiteLaxMode,
-		})
-		url := g.oauthConf.AuthCodeURL(state, oauth2.AccessTypeOffline)
+		// GitHub ignores nonces, the one in the state only protects the callback against replays
+		url := g.oauthConf.AuthCodeURL(login.State, oauth2.AccessTypeOffline, oauth2.S256ChallengeOption(login.Verifier))
 		http.Redirect(w, r, url, http.StatusSeeOther)
 	}
 }
 
 func (g *GitHubAuth) HandleGitHubCallback() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		_, err := r.Cookie("oauthstate")
+		login, err := checkCallback(w, r, githubProvider, g.jwtSecret, g.nonces)
 		if err != nil {
-			log.Printf("State cookie not found: %v", err)
-			http.Error(w, "State cookie not found", http.StatusBadRequest)
+			log.Printf("OAuth state validation failed: %v", err)
+			if strings.Contains(err.Error(), "failed to") {
+				http.Error(w, "Failed to check OAuth state", http.StatusInternalServerError)
+				return
+			}
+			if strings.Contains(err.Error(), "state cookie not found") {
+				http.Error(w, "State cookie not found", http.StatusBadRequest)
+				return
+			}
+			http.Error(w, "Invalid OAuth state", http.StatusBadRequest)
+			return
+		}
+
+		if oauthErr := r.FormValue("error"); oauthErr != "" {
+			log.Printf("GitHub authorization failed: %s", oauthErr)
+			http.Error(w, "GitHub authorization failed: "+oauthErr, http.StatusBadRequest)
 			return
 		}
 
 		code := r.FormValue("code")
-		token, err := g.oauthConf.Exchange(context.Background(), code)
+		token, err := g.oauthConf.Exchange(r.Context(), code, oauth2.VerifierOption(login.Verifier))
 		if err != nil {
 			http.Error(w, "Failed to exchange token: "+err.Error(), http.StatusInternalServerError)
 			return
@@ -137,30 +132,6 @@ func (g *GitHubAuth) HandleGitHubProfile() http.HandlerFunc {
 			return
 		}
 
-		// Check for the presence of the refresh_token cookie
-		refreshTokenCookie, err := r.Cookie("refresh_token")
-		if err == nil {
-			// Validate the existing refresh token
-			_, err := token.ValidateJWTToken(refreshTokenCookie.Value, g.jwtSecret)
-			if err == nil {
-				// Reuse the existing refresh token if valid
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(http.StatusOK)
-				// Return tokens and user info
-				refreshTokenResponse := map[string]interface{}{
-					"refresh_token": refreshTokenCookie.Value,
-				}
-				if err := json.NewEncoder(w).Encode(refreshTokenResponse); err != nil {
-					log.Printf("Failed to encode refresh token response: %v", err)
-					http.Error(w, "Failed to encode response", http.StatusInternalServerError)
-					return
-				}
-				return // we don't execute further to avoid more DB calls
-			} else {
-				log.Printf("Existing refresh token is invalid: %v", err)
-			}
-		}
-
 		client := g.oauthConf.Client(context.Background(), &oauth2.Token{AccessToken: tokenCookie.Value})
 		resp, err := client.Get("https://api.github.com/user")
 		if err != nil {
@@ -232,38 +203,25 @@ func (g *GitHubAuth) HandleGitHubProfile() http.HandlerFunc {
 		// Save user information to the database
 		if err := g.userService.SaveUser(r.Context(), userInfo); err != nil {
 			http.Error(w, "Failed to save user info: "+err.Error(), http.StatusInternalServerError)
+			return
 		}
 
 		// Fetch the userID
 		userByEmail, err := g.userService.GetUserByEmail(context.Background(), user.Email)
 		if err != nil {
 			http.Error(w, "Failed to fetch user info by email: "+err.Error(), http.StatusInternalServerError)
-		}
-		userID := userByEmail.ID.Hex()
-
-		// Generate Acccess and Refresh Tokens
-		refreshToken, err := token.GenerateJWT(userID, 7*24*time.Hour, "refresh", g.jwtSecret)
-		if err != nil {
-			http.Error(w, "Failed to generate refresh token: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
+		userID := userByEmail.ID.Hex()
 
-		ipAddress := strings.Split(r.RemoteAddr, ":")
-
-		// Save the new refresh token in database
-		refreshTokenData := &token.RefreshToken{
-			Token:     refreshToken,
-			UserID:    userID,
-			UserAgent: r.UserAgent(),
-			IPAddress: ipAddress[0],
-		}
-		_, err = g.refreshTokenService.CreateRefreshToken(context.Background(), *refreshTokenData, g.nannyEncryptionKey)
+		// Every profile request starts a new session and revokes the one in the refresh_token cookie
+		refreshToken, err := startSession(w, r, g.refreshTokenService, g.keys, g.envelope, userID)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, "Failed to create refresh token: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		accessToken, err := token.GenerateJWT(userID, 15*time.Minute, "access", g.jwtSecret)
+		accessToken, err := g.keys.GenerateJWT(userID, token.AccessTokenLifetime, "access")
 		if err != nil {
 			http.Error(w, "Failed to generate access token: "+err.Error(), http.StatusInternalServerError)
 			return
@@ -276,20 +234,6 @@ func (g *GitHubAuth) HandleGitHubProfile() http.HandlerFunc {
 			"refresh_token": refreshToken,
 		}
 
-		// set secure flag to true if the request is coming from https
-		secure := r.TLS != nil
-
-		// Store the refresh_token in a http-only cookie
-		http.SetCookie(w, &http.Cookie{
-			Name:     "refresh_token",
-			Value:    refreshToken,
-			Expires:  time.Now().Add(7 * 24 * time.Hour),
-			HttpOnly: true,
-			Path:     "/",
-			Secure:   secure,
-			SameSite: http.SameSiteLaxMode,
-		})
-
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 		if err := json.NewEncoder(w).Encode(response); err != nil {
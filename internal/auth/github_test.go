@@ -2,31 +2,22 @@ package auth
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/stretchr/testify/assert"
 	"golang.org/x/oauth2"
 	githubOAuth2 "golang.org/x/oauth2/github"
 )
 
-// MockOAuth2Config is a mock implementation of oauth2.Config.
-type MockOAuth2Config struct {
-	oauth2.Config
-	ExchangeFunc func(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error)
-}
-
-// Override the Exchange method for mocking.
-func (m *MockOAuth2Config) Exchange(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
-	if m.ExchangeFunc != nil {
-		return m.ExchangeFunc(ctx, code, opts...)
-	}
-	return nil, fmt.Errorf("mock Exchange not implemented")
-}
-
 // Helper function to check if a string contains a substring.
 func contains(str, substr string) bool {
 	return len(str) >= len(substr) && str[:len(substr)] == substr
@@ -84,76 +75,190 @@ func TestHandleGitHubLogin(t *testing.T) {
 	}
 }
 
-// TO-DO to be added later (no iead how to do that)
-// Test for HandleGitHubCallback
-// func TestHandleGitHubCallback(t *testing.T) {
-// 	// Mock the OAuth2 Config
-// 	mockConfig := &MockOAuth2Config{
-// 		Config: oauth2.Config{
-// 			ClientID:     os.Getenv("GH_CLIENT_ID"),
-// 			ClientSecret: os.Getenv("GH_CLIENT_SECRET"),
-// 			RedirectURL:  "http://localhost:8080/github/callback",
-// 			Scopes:       []string{"user:email"},
-// 			Endpoint:     githubOAuth2.Endpoint,
-// 		},
-// 		ExchangeFunc: func(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
-// 			if code != "mock-code" {
-// 				return nil, fmt.Errorf("invalid code")
-// 			}
-// 			return &oauth2.Token{
-// 				AccessToken: "mock-access-token",
-// 				Expiry:      time.Now().Add(1 * time.Hour),
-// 			}, nil
-// 		},
-// 	}
-
-// 	// Initialize GitHubAuth with the mock config
-// 	githubAuth := &GitHubAuth{
-// 		oauthConf: &mockConfig.Config, // Correctly assign the mock config
-// 	}
-
-// 	githubAuth.oauthConf = &mockConfig.Config // Correctly assign the mock config
-
-// 	// Create a test HTTP request with a valid state and code
-// 	req := httptest.NewRequest(http.MethodGet, "/github/callback?code=mock-code", nil)
-// 	req.AddCookie(&http.Cookie{
-// 		Name:     "oauthstate",
-// 		Value:    "mock-state",
-// 		Expires:  time.Now().Add(1 * time.Hour),
-// 		HttpOnly: true,
-// 	})
-
-// 	// Create a response recorder
-// 	rec := httptest.NewRecorder()
-
-// 	// Call the handler
-// 	handler := githubAuth.HandleGitHubCallback()
-// 	handler.ServeHTTP(rec, req)
-
-// 	// Assert the response status code
-// 	if rec.Code != http.StatusSeeOther {
-// 		t.Errorf("Expected status %d, got %d", http.StatusSeeOther, rec.Code)
-// 	}
-
-// 	// Assert the `Authorization` cookie is set
-// 	cookies := rec.Result().Cookies()
-// 	found := false
-// 	for _, cookie := range cookies {
-// 		if cookie.Name == "Authorization" {
-// 			found = true
-// 			if cookie.Expires.Before(time.Now()) {
-// 				t.Errorf("Authorization cookie has expired")
-// 			}
-// 			break
-// 		}
-// 	}
-// 	if !found {
-// 		t.Errorf("Authorization cookie not set")
-// 	}
-
-// 	// Assert the redirect URL
-// 	location := rec.Header().Get("Location")
-// 	if location != "/github/profile" {
-// 		t.Errorf("Expected redirect to /github/profile, got %s", location)
-// 	}
-// }
+// fakeGitHub is a local OAuth server that only accepts codes exchanged with the verifier of the
+// challenge they were issued for.
+type fakeGitHub struct {
+	server     *httptest.Server
+	challenges map[string]string // PKCE challenge of each issued code
+}
+
+func newFakeGitHub(t *testing.T) *fakeGitHub {
+	fake := &fakeGitHub{challenges: map[string]string{}}
+	fake.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/login/oauth/access_token" {
+			http.NotFound(w, r)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		challenge, ok := fake.challenges[r.PostForm.Get("code")]
+		verifierHash := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(verifierHash[:]) != challenge {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"invalid_grant"}`)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"access_token":"gho_test","token_type":"bearer"}`)
+	}))
+	t.Cleanup(fake.server.Close)
+	return fake
+}
+
+func newTestGitHubAuth(fake *fakeGitHub) *GitHubAuth {
+	g := NewGitHubAuth("client-id", "client-secret", "http://localhost:8080/github/callback", nil, nil, nil, "test-jwt-secret", newTestKeyring(), "http://localhost:8081", newMemoryNonces())
+	g.oauthConf.Endpoint = oauth2.Endpoint{
+		AuthURL:   fake.server.URL + "/login/oauth/authorize",
+		TokenURL:  fake.server.URL + "/login/oauth/access_token",
+		AuthStyle: oauth2.AuthStyleInParams,
+	}
+	return g
+}
+
+// startLogin runs the login handler and returns the state cookie and the authorization URL.
+func startLogin(t *testing.T, g *GitHubAuth) (*http.Cookie, *url.URL) {
+	rec := httptest.NewRecorder()
+	g.HandleGitHubLogin().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/github/login", nil))
+	assert.Equal(t, http.StatusSeeOther, rec.Code)
+
+	var stateCookie *http.Cookie
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == stateCookieName {
+			stateCookie = cookie
+		}
+	}
+	assert.NotNil(t, stateCookie)
+	location, err := url.Parse(rec.Header().Get("Location"))
+	assert.NoError(t, err)
+	return stateCookie, location
+}
+
+func callback(g *GitHubAuth, query string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/github/callback?"+query, nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	g.HandleGitHubCallback().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestHandleGitHubCallback(t *testing.T) {
+	fake := newFakeGitHub(t)
+	g := newTestGitHubAuth(fake)
+
+	t.Run("ValidLogin", func(t *testing.T) {
+		cookie, location := startLogin(t, g)
+		query := location.Query()
+		assert.Equal(t, "S256", query.Get("code_challenge_method"))
+		assert.Empty(t, query.Get("nonce"))
+		fake.challenges["code-valid"] = query.Get("code_challenge")
+
+		rec := callback(g, "code=code-valid&state="+query.Get("state"), cookie)
+		assert.Equal(t, http.StatusSeeOther, rec.Code)
+		assert.Equal(t, "http://localhost:8081/dashboard", rec.Header().Get("Location"))
+		var accessToken string
+		for _, c := range rec.Result().Cookies() {
+			if c.Name == "GH_Authorization" {
+				accessToken = c.Value
+			}
+		}
+		assert.Equal(t, "gho_test", accessToken)
+
+		// Replaying the callback is rejected even though the state is still within its lifetime
+		rec = callback(g, "code=code-valid&state="+query.Get("state"), cookie)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("StateMismatch", func(t *testing.T) {
+		cookie, location := startLogin(t, g)
+		fake.challenges["code-mismatch"] = location.Query().Get("code_challenge")
+
+		rec := callback(g, "code=code-mismatch&state=attacker-state", cookie)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("MissingCookie", func(t *testing.T) {
+		_, location := startLogin(t, g)
+		rec := callback(g, "code=code-valid&state="+location.Query().Get("state"), nil)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("TamperedCookie", func(t *testing.T) {
+		_, location := startLogin(t, g)
+		state := location.Query().Get("state")
+		forged := &loginState{Provider: githubProvider, State: state, Nonce: "forged-nonce", Verifier: oauth2.GenerateVerifier(), ExpiresAt: time.Now().Add(time.Minute)}
+		cookie := &http.Cookie{Name: stateCookieName, Value: signState(forged, "another-secret")}
+
+		rec := callback(g, "code=code-valid&state="+state, cookie)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("ExpiredState", func(t *testing.T) {
+		expired := &loginState{Provider: githubProvider, State: "expired-state", Nonce: "expired-nonce", Verifier: oauth2.GenerateVerifier(), ExpiresAt: time.Now().Add(-time.Minute)}
+		cookie := &http.Cookie{Name: stateCookieName, Value: signState(expired, "test-jwt-secret")}
+
+		rec := callback(g, "code=code-valid&state=expired-state", cookie)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("WrongVerifier", func(t *testing.T) {
+		cookie, location := startLogin(t, g)
+		// The code was issued for another login, so the verifier in this login's state does not match
+		fake.challenges["code-stolen"] = oauth2.S256ChallengeFromVerifier(oauth2.GenerateVerifier())
+
+		rec := callback(g, "code=code-stolen&state="+location.Query().Get("state"), cookie)
+		assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	})
+
+	t.Run("AuthorizationDenied", func(t *testing.T) {
+		cookie, location := startLogin(t, g)
+		rec := callback(g, "error=access_denied&state="+location.Query().Get("state"), cookie)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+}
+
+func TestParseState(t *testing.T) {
+	now := time.Now()
+	login := &loginState{Provider: "google", State: "state", Nonce: "nonce", Verifier: "verifier", ExpiresAt: now.Add(time.Minute).Truncate(time.Second)}
+
+	parsed, err := parseState(signState(login, "key"), "key", now)
+	assert.NoError(t, err)
+	assert.Equal(t, login.Provider, parsed.Provider)
+	assert.Equal(t, login.State, parsed.State)
+	assert.Equal(t, login.Nonce, parsed.Nonce)
+	assert.Equal(t, login.Verifier, parsed.Verifier)
+	assert.True(t, login.ExpiresAt.Equal(parsed.ExpiresAt))
+
+	_, err = parseState(signState(login, "key"), "other-key", now)
+	assert.ErrorContains(t, err, "bad signature")
+
+	_, err = parseState(signState(login, "key"), "key", now.Add(time.Hour))
+	assert.ErrorContains(t, err, "login expired")
+
+	_, err = parseState("not-a-state", "key", now)
+	assert.Error(t, err)
+}
+
+// memoryNonces is a NonceStore for tests.
+type memoryNonces struct {
+	mu   sync.Mutex
+	used map[string]bool
+}
+
+func newMemoryNonces() *memoryNonces {
+	return &memoryNonces{used: map[string]bool{}}
+}
+
+func (m *memoryNonces) UseNonce(ctx context.Context, nonce string, expiresAt time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.used[nonce] {
+		return false, nil
+	}
+	m.used[nonce] = true
+	return true, nil
+}
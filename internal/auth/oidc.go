@@ -0,0 +1,416 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"golang.org/x/oauth2"
+
+	"github.com/harshavmb/nannyapi/internal/token"
+	"github.com/harshavmb/nannyapi/internal/user"
+)
+
+// wellKnownIssuers are used for providers configured without OIDC_<NAME>_ISSUER.
+var wellKnownIssuers = map[string]string{
+	"google": "https://accounts.google.com",
+	"gitlab": "https://gitlab.com",
+}
+
+var providerNamePattern = regexp.MustCompile(`^[a-z][a-z0-9-]{0,31}$`)
+
+// idTokenAlgorithms are the ID token signatures accepted from providers.
+var idTokenAlgorithms = []string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}
+
+// ProviderConfig configures an OpenID Connect provider.
+type ProviderConfig struct {
+	Name         string // Used in the login and callback paths, /oidc/{name}/login
+	Issuer       string // Discovery is done at Issuer + /.well-known/openid-configuration
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string // Must point at /oidc/{name}/callback
+	Scopes       []string
+	EmailClaim   string // Claim holding the email of the user, email by default
+	NameClaim    string // name by default
+	AvatarClaim  string // picture by default
+	// TrustEmail links logins by email even when the provider does not mark it verified. Only set it for
+	// providers that own the email domain, such as company SSO.
+	TrustEmail bool
+}
+
+// ProvidersFromEnv reads the providers named in OIDC_PROVIDERS, e.g. google,keycloak. Each provider is
+// configured with OIDC_<NAME>_ISSUER, OIDC_<NAME>_CLIENT_ID, OIDC_<NAME>_CLIENT_SECRET,
+// OIDC_<NAME>_REDIRECT_URL and optionally OIDC_<NAME>_SCOPES, OIDC_<NAME>_EMAIL_CLAIM,
+// OIDC_<NAME>_NAME_CLAIM, OIDC_<NAME>_AVATAR_CLAIM and OIDC_<NAME>_TRUST_EMAIL.
+func ProvidersFromEnv() ([]ProviderConfig, error) {
+	value := os.Getenv("OIDC_PROVIDERS")
+	if value == "" {
+		return nil, nil
+	}
+
+	var configs []ProviderConfig
+	for _, name := range strings.Split(value, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !providerNamePattern.MatchString(name) || name == githubProvider {
+			return nil, fmt.Errorf("invalid OIDC_PROVIDERS %q, names must match %s and not be github", value, providerNamePattern)
+		}
+		if slices.ContainsFunc(configs, func(c ProviderConfig) bool { return c.Name == name }) {
+			return nil, fmt.Errorf("invalid OIDC_PROVIDERS %q, %s is listed twice", value, name)
+		}
+
+		prefix := "OIDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		config := ProviderConfig{
+			Name:         name,
+			Issuer:       strings.TrimSuffix(os.Getenv(prefix+"ISSUER"), "/"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			RedirectURL:  os.Getenv(prefix + "REDIRECT_URL"),
+			Scopes:       []string{"openid", "email", "profile"},
+			EmailClaim:   envOrDefault(prefix+"EMAIL_CLAIM", "email"),
+			NameClaim:    envOrDefault(prefix+"NAME_CLAIM", "name"),
+			AvatarClaim:  envOrDefault(prefix+"AVATAR_CLAIM", "picture"),
+		}
+		if config.Issuer == "" {
+			config.Issuer = wellKnownIssuers[name]
+		}
+		if config.Issuer == "" || config.ClientID == "" || config.RedirectURL == "" {
+			return nil, fmt.Errorf("invalid OIDC provider %s: %sISSUER, %sCLIENT_ID and %sREDIRECT_URL are required", name, prefix, prefix, prefix)
+		}
+		if scopes := os.Getenv(prefix + "SCOPES"); scopes != "" {
+			config.Scopes = strings.FieldsFunc(scopes, func(r rune) bool { return r == ',' || r == ' ' })
+			if !slices.Contains(config.Scopes, "openid") {
+				config.Scopes = append([]string{"openid"}, config.Scopes...)
+			}
+		}
+		if trust := os.Getenv(prefix + "TRUST_EMAIL"); trust != "" {
+			if trust != "true" && trust != "false" {
+				return nil, fmt.Errorf("invalid %sTRUST_EMAIL %q, must be true or false", prefix, trust)
+			}
+			config.TrustEmail = trust == "true"
+		}
+		configs = append(configs, config)
+	}
+	return configs, nil
+}
+
+func envOrDefault(name, defaultValue string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// providerMetadata is the part of the discovery document logins need.
+type providerMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcProvider discovers its endpoints on first use, so an unreachable provider does not stop the server
+// from starting.
+type oidcProvider struct {
+	config ProviderConfig
+	client *http.Client
+
+	mu        sync.Mutex
+	oauthConf *oauth2.Config
+	keys      *keySet
+}
+
+// discover fetches the discovery document of the provider once it succeeds.
+func (p *oidcProvider) discover(ctx context.Context) (*oauth2.Config, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.oauthConf != nil {
+		return p.oauthConf, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.config.Issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch discovery document: %v", err)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch discovery document: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch discovery document: %s", resp.Status)
+	}
+
+	var metadata providerMetadata
+	if err := json.NewDecoder(resp.Body).Decode(&metadata); err != nil {
+		return nil, fmt.Errorf("failed to decode discovery document: %v", err)
+	}
+	// A discovery document for another issuer could hand out keys that are not the provider's
+	if strings.TrimSuffix(metadata.Issuer, "/") != p.config.Issuer {
+		return nil, fmt.Errorf("discovery document is for issuer %q, expected %q", metadata.Issuer, p.config.Issuer)
+	}
+	if metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" || metadata.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery document lacks authorization_endpoint, token_endpoint or jwks_uri")
+	}
+
+	p.keys = newKeySet(metadata.JWKSURI, p.client)
+	p.oauthConf = &oauth2.Config{
+		ClientID:     p.config.ClientID,
+		ClientSecret: p.config.ClientSecret,
+		RedirectURL:  p.config.RedirectURL,
+		Scopes:       p.config.Scopes,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  metadata.AuthorizationEndpoint,
+			TokenURL: metadata.TokenEndpoint,
+		},
+	}
+	return p.oauthConf, nil
+}
+
+// verifyIDToken checks the signature, issuer, audience, lifetime and nonce of an ID token and returns its
+// claims.
+func (p *oidcProvider) verifyIDToken(ctx context.Context, rawIDToken, nonce string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	parser := &jwt.Parser{ValidMethods: idTokenAlgorithms}
+	_, err := parser.ParseWithClaims(rawIDToken, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		key, err := p.keys.key(ctx, kid)
+		if err != nil {
+			return nil, err
+		}
+		switch t.Method.(type) {
+		case *jwt.SigningMethodRSA:
+			if _, ok := key.(*rsa.PublicKey); !ok {
+				return nil, fmt.Errorf("key %q is not an RSA key", kid)
+			}
+		case *jwt.SigningMethodECDSA:
+			if _, ok := key.(*ecdsa.PublicKey); !ok {
+				return nil, fmt.Errorf("key %q is not an EC key", kid)
+			}
+		}
+		return key, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID token: %v", err)
+	}
+
+	now := time.Now().Unix()
+	if !claims.VerifyExpiresAt(now, true) {
+		return nil, fmt.Errorf("invalid ID token: expired or without exp")
+	}
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != p.config.Issuer {
+		return nil, fmt.Errorf("invalid ID token: issuer %q", iss)
+	}
+	if !claims.VerifyAudience(p.config.ClientID, true) {
+		return nil, fmt.Errorf("invalid ID token: not issued for this client")
+	}
+	// Tokens issued to several audiences must name the client they were issued to
+	if audiences, ok := claims["aud"].([]interface{}); ok && len(audiences) > 1 {
+		if azp, _ := claims["azp"].(string); azp != p.config.ClientID {
+			return nil, fmt.Errorf("invalid ID token: authorized party %q", azp)
+		}
+	}
+	if tokenNonce, _ := claims["nonce"].(string); tokenNonce != nonce {
+		return nil, fmt.Errorf("invalid ID token: nonce mismatch")
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, fmt.Errorf("invalid ID token: missing sub")
+	}
+	return claims, nil
+}
+
+// identity maps the claims of an ID token to the identity and profile of the user.
+func (p *oidcProvider) identity(claims jwt.MapClaims) (user.Identity, user.User, error) {
+	sub, _ := claims["sub"].(string)
+	email, _ := claims[p.config.EmailClaim].(string)
+	email = user.NormalizeEmail(email)
+	if email == "" || !strings.Contains(email, "@") {
+		return user.Identity{}, user.User{}, fmt.Errorf("ID token has no email in claim %s", p.config.EmailClaim)
+	}
+
+	verified := p.config.TrustEmail
+	switch v := claims["email_verified"].(type) {
+	case bool:
+		verified = verified || v
+	case string:
+		verified = verified || v == "true"
+	}
+	if !verified {
+		return user.Identity{}, user.User{}, fmt.Errorf("email %s is not verified by %s", email, p.config.Name)
+	}
+
+	name, _ := claims[p.config.NameClaim].(string)
+	avatarURL, _ := claims[p.config.AvatarClaim].(string)
+	identity := user.Identity{Provider: p.config.Name, Subject: sub, Email: email}
+	return identity, user.User{Email: email, Name: name, AvatarURL: avatarURL}, nil
+}
+
+// IdentityLinker finds or creates the user of an OpenID Connect login.
+type IdentityLinker interface {
+	LoginWithIdentity(ctx context.Context, identity user.Identity, profile user.User) (*user.User, error)
+}
+
+// RefreshTokenStore stores the refresh tokens issued at login and revokes the sessions they replace.
+type RefreshTokenStore interface {
+	CreateRefreshToken(ctx context.Context, token token.RefreshToken, envelope *token.Envelope) (*token.RefreshToken, error)
+	RevokeRefreshToken(ctx context.Context, refreshToken, reason string) error
+}
+
+// OIDCAuth logs users in with OpenID Connect providers alongside GitHub.
+type OIDCAuth struct {
+	providers     map[string]*oidcProvider
+	users         IdentityLinker
+	refreshTokens RefreshTokenStore
+	envelope      *token.Envelope
+	jwtSecret     string // Signs the state cookie
+	keys          *token.Keyring
+	frontEndHost  string
+	nonces        NonceStore
+}
+
+// NewOIDCAuth creates the login handlers of the configured providers.
+func NewOIDCAuth(configs []ProviderConfig, users IdentityLinker, refreshTokens RefreshTokenStore, envelope *token.Envelope, jwtSecret string, keys *token.Keyring, frontEndHost string, nonces NonceStore) *OIDCAuth {
+	providers := make(map[string]*oidcProvider, len(configs))
+	for _, config := range configs {
+		providers[config.Name] = &oidcProvider{config: config, client: &http.Client{Timeout: 10 * time.Second}}
+	}
+	return &OIDCAuth{
+		providers:     providers,
+		users:         users,
+		refreshTokens: refreshTokens,
+		envelope:      envelope,
+		jwtSecret:     jwtSecret,
+		keys:          keys,
+		frontEndHost:  frontEndHost,
+		nonces:        nonces,
+	}
+}
+
+// HandleProviders lists the names of the configured providers, for login buttons.
+func (o *OIDCAuth) HandleProviders() http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		names := make([]string, 0, len(o.providers))
+		for name := range o.providers {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string][]string{"providers": names}); err != nil {
+			log.Printf("Failed to encode providers response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// HandleLogin redirects to the provider named in the path, with a state, nonce and PKCE challenge.
+func (o *OIDCAuth) HandleLogin() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		provider, ok := o.providers[r.PathValue("provider")]
+		if !ok {
+			http.Error(w, "Unknown login provider", http.StatusNotFound)
+			return
+		}
+		oauthConf, err := provider.discover(r.Context())
+		if err != nil {
+			log.Printf("OIDC discovery for %s failed: %v", provider.config.Name, err)
+			http.Error(w, "Login provider is unavailable", http.StatusBadGateway)
+			return
+		}
+
+		login, err := newLoginState(provider.config.Name, time.Now())
+		if err != nil {
+			http.Error(w, "Failed to generate state", http.StatusInternalServerError)
+			return
+		}
+		setStateCookie(w, r, login, o.jwtSecret)
+
+		url := oauthConf.AuthCodeURL(login.State, oauth2.S256ChallengeOption(login.Verifier), oauth2.SetAuthURLParam("nonce", login.Nonce))
+		http.Redirect(w, r, url, http.StatusSeeOther)
+	}
+}
+
+// HandleCallback completes a login: it exchanges the code, verifies the ID token, links the user by
+// provider account or verified email and starts a session like the GitHub login.
+func (o *OIDCAuth) HandleCallback() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		provider, ok := o.providers[r.PathValue("provider")]
+		if !ok {
+			http.Error(w, "Unknown login provider", http.StatusNotFound)
+			return
+		}
+
+		login, err := checkCallback(w, r, provider.config.Name, o.jwtSecret, o.nonces)
+		if err != nil {
+			log.Printf("OAuth state validation failed: %v", err)
+			if strings.Contains(err.Error(), "failed to") {
+				http.Error(w, "Failed to check OAuth state", http.StatusInternalServerError)
+				return
+			}
+			http.Error(w, "Invalid OAuth state", http.StatusBadRequest)
+			return
+		}
+		if oauthErr := r.FormValue("error"); oauthErr != "" {
+			log.Printf("%s authorization failed: %s", provider.config.Name, oauthErr)
+			http.Error(w, "Authorization failed: "+oauthErr, http.StatusBadRequest)
+			return
+		}
+
+		oauthConf, err := provider.discover(r.Context())
+		if err != nil {
+			log.Printf("OIDC discovery for %s failed: %v", provider.config.Name, err)
+			http.Error(w, "Login provider is unavailable", http.StatusBadGateway)
+			return
+		}
+		ctx := context.WithValue(r.Context(), oauth2.HTTPClient, provider.client)
+		oauthToken, err := oauthConf.Exchange(ctx, r.FormValue("code"), oauth2.VerifierOption(login.Verifier))
+		if err != nil {
+			log.Printf("Failed to exchange %s code: %v", provider.config.Name, err)
+			http.Error(w, "Failed to exchange token", http.StatusBadGateway)
+			return
+		}
+		rawIDToken, _ := oauthToken.Extra("id_token").(string)
+		if rawIDToken == "" {
+			http.Error(w, "Login provider returned no ID token", http.StatusBadGateway)
+			return
+		}
+
+		claims, err := provider.verifyIDToken(r.Context(), rawIDToken, login.Nonce)
+		if err != nil {
+			log.Printf("%s ID token rejected: %v", provider.config.Name, err)
+			http.Error(w, "Invalid ID token", http.StatusUnauthorized)
+			return
+		}
+		identity, profile, err := provider.identity(claims)
+		if err != nil {
+			log.Printf("%s login rejected: %v", provider.config.Name, err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		u, err := o.users.LoginWithIdentity(r.Context(), identity, profile)
+		if err != nil {
+			log.Printf("Failed to log in %s user %s: %v", provider.config.Name, identity.Subject, err)
+			http.Error(w, "Failed to save user info", http.StatusInternalServerError)
+			return
+		}
+		if _, err := startSession(w, r, o.refreshTokens, o.keys, o.envelope, u.ID.Hex()); err != nil {
+			log.Printf("Failed to start session for user %s: %v", u.ID.Hex(), err)
+			http.Error(w, "Failed to create refresh token", http.StatusInternalServerError)
+			return
+		}
+
+		http.Redirect(w, r, fmt.Sprintf("%s/%s", o.frontEndHost, "dashboard"), http.StatusSeeOther)
+	}
+}
@@ -0,0 +1,368 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/v2/bson"
+
+	"github.com/harshavmb/nannyapi/internal/token"
+	"github.com/harshavmb/nannyapi/internal/user"
+)
+
+// mockIssuer is a local OpenID Connect provider. Codes are registered with the nonce and PKCE challenge
+// of the login they belong to, and exchanged for an ID token built by claims.
+type mockIssuer struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	kid    string
+
+	mu     sync.Mutex
+	codes  map[string]authRequest
+	claims func(issuer, nonce string) jwt.MapClaims
+	signer *rsa.PrivateKey // Signs ID tokens, the published key unless a test swaps it
+}
+
+type authRequest struct {
+	nonce     string
+	challenge string
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	m := &mockIssuer{key: key, kid: "key-1", codes: map[string]authRequest{}, signer: key}
+	m.claims = func(issuer, nonce string) jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss":            issuer,
+			"sub":            "user-123",
+			"aud":            "nanny-client",
+			"exp":            time.Now().Add(time.Hour).Unix(),
+			"iat":            time.Now().Unix(),
+			"nonce":          nonce,
+			"email":          "Jane@Example.com",
+			"email_verified": true,
+			"name":           "Jane Doe",
+			"picture":        "https://example.com/jane.png",
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.server.URL,
+			"authorization_endpoint": m.server.URL + "/authorize",
+			"token_endpoint":         m.server.URL + "/token",
+			"jwks_uri":               m.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": m.kid,
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		req, ok := m.codes[r.FormValue("code")]
+		verifierHash := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(verifierHash[:]) != req.challenge {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"invalid_grant"}`)
+			return
+		}
+		idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, m.claims(m.server.URL, req.nonce))
+		idToken.Header["kid"] = m.kid
+		signed, err := idToken.SignedString(m.signer)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]string{"access_token": "at", "token_type": "Bearer", "id_token": signed})
+	})
+	m.server = httptest.NewServer(mux)
+	t.Cleanup(m.server.Close)
+	return m
+}
+
+type fakeLinker struct {
+	identities []user.Identity
+	profiles   []user.User
+}
+
+func (f *fakeLinker) LoginWithIdentity(_ context.Context, identity user.Identity, profile user.User) (*user.User, error) {
+	f.identities = append(f.identities, identity)
+	f.profiles = append(f.profiles, profile)
+	return &user.User{ID: bson.NewObjectID(), Email: identity.Email}, nil
+}
+
+type fakeRefreshTokens struct {
+	created []token.RefreshToken
+	revoked []string
+}
+
+func (f *fakeRefreshTokens) CreateRefreshToken(_ context.Context, t token.RefreshToken, _ *token.Envelope) (*token.RefreshToken, error) {
+	f.created = append(f.created, t)
+	return &t, nil
+}
+
+func (f *fakeRefreshTokens) RevokeRefreshToken(_ context.Context, refreshToken, reason string) error {
+	f.revoked = append(f.revoked, reason+":"+refreshToken)
+	return nil
+}
+
+// newTestKeyring returns an in-memory keyring with a signing key.
+func newTestKeyring() *token.Keyring {
+	keys := token.NewKeyring(nil, token.DefaultKeyringConfig(), nil, "")
+	if err := keys.Load(context.Background()); err != nil {
+		panic(err)
+	}
+	return keys
+}
+
+func newTestOIDCAuth(issuer *mockIssuer, trustEmail bool) (*OIDCAuth, *fakeLinker, *fakeRefreshTokens) {
+	linker := &fakeLinker{}
+	refreshTokens := &fakeRefreshTokens{}
+	config := ProviderConfig{
+		Name:         "keycloak",
+		Issuer:       issuer.server.URL,
+		ClientID:     "nanny-client",
+		ClientSecret: "secret",
+		RedirectURL:  "http://localhost:8080/oidc/keycloak/callback",
+		Scopes:       []string{"openid", "email", "profile"},
+		EmailClaim:   "email",
+		NameClaim:    "name",
+		AvatarClaim:  "picture",
+		TrustEmail:   trustEmail,
+	}
+	return NewOIDCAuth([]ProviderConfig{config}, linker, refreshTokens, nil, "test-jwt-secret", newTestKeyring(), "http://localhost:8081", newMemoryNonces()), linker, refreshTokens
+}
+
+// oidcLogin runs a login against the mock issuer and returns the response of the callback.
+func oidcLogin(t *testing.T, o *OIDCAuth, issuer *mockIssuer, provider string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /oidc/{provider}/login", o.HandleLogin())
+	mux.HandleFunc("GET /oidc/{provider}/callback", o.HandleCallback())
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/oidc/"+provider+"/login", nil))
+	if rec.Code != http.StatusSeeOther {
+		return rec
+	}
+	location, err := url.Parse(rec.Header().Get("Location"))
+	assert.NoError(t, err)
+	query := location.Query()
+	assert.Equal(t, issuer.server.URL+"/authorize", location.Scheme+"://"+location.Host+location.Path)
+	assert.Equal(t, "S256", query.Get("code_challenge_method"))
+
+	code := "code-" + query.Get("state")
+	issuer.mu.Lock()
+	issuer.codes[code] = authRequest{nonce: query.Get("nonce"), challenge: query.Get("code_challenge")}
+	issuer.mu.Unlock()
+
+	req := httptest.NewRequest(http.MethodGet, "/oidc/"+provider+"/callback?code="+code+"&state="+query.Get("state"), nil)
+	for _, cookie := range append(rec.Result().Cookies(), cookies...) {
+		req.AddCookie(cookie)
+	}
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestOIDCLogin(t *testing.T) {
+	t.Run("ValidLogin", func(t *testing.T) {
+		issuer := newMockIssuer(t)
+		o, linker, refreshTokens := newTestOIDCAuth(issuer, false)
+
+		rec := oidcLogin(t, o, issuer, "keycloak")
+		assert.Equal(t, http.StatusSeeOther, rec.Code)
+		assert.Equal(t, "http://localhost:8081/dashboard", rec.Header().Get("Location"))
+		assert.Equal(t, []user.Identity{{Provider: "keycloak", Subject: "user-123", Email: "jane@example.com"}}, linker.identities)
+		assert.Equal(t, "Jane Doe", linker.profiles[0].Name)
+		assert.Equal(t, "https://example.com/jane.png", linker.profiles[0].AvatarURL)
+		assert.Len(t, refreshTokens.created, 1)
+
+		var refreshCookie string
+		for _, cookie := range rec.Result().Cookies() {
+			if cookie.Name == "refresh_token" {
+				refreshCookie = cookie.Value
+			}
+		}
+		assert.Equal(t, refreshTokens.created[0].Token, refreshCookie)
+	})
+
+	t.Run("ReplacesSession", func(t *testing.T) {
+		issuer := newMockIssuer(t)
+		o, _, refreshTokens := newTestOIDCAuth(issuer, false)
+
+		rec := oidcLogin(t, o, issuer, "keycloak", &http.Cookie{Name: "refresh_token", Value: "old-refresh-token"})
+		assert.Equal(t, http.StatusSeeOther, rec.Code)
+		assert.Equal(t, []string{token.RevokedReplaced + ":old-refresh-token"}, refreshTokens.revoked)
+		assert.Len(t, refreshTokens.created, 1)
+	})
+
+	t.Run("UnknownProvider", func(t *testing.T) {
+		issuer := newMockIssuer(t)
+		o, _, _ := newTestOIDCAuth(issuer, false)
+		assert.Equal(t, http.StatusNotFound, oidcLogin(t, o, issuer, "okta").Code)
+	})
+
+	rejected := []struct {
+		name   string
+		claims func(claims jwt.MapClaims)
+		status int
+	}{
+		{"NonceMismatch", func(c jwt.MapClaims) { c["nonce"] = "replayed" }, http.StatusUnauthorized},
+		{"WrongAudience", func(c jwt.MapClaims) { c["aud"] = "another-client" }, http.StatusUnauthorized},
+		{"WrongAuthorizedParty", func(c jwt.MapClaims) {
+			c["aud"] = []string{"nanny-client", "another-client"}
+			c["azp"] = "another-client"
+		}, http.StatusUnauthorized},
+		{"WrongIssuer", func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" }, http.StatusUnauthorized},
+		{"Expired", func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() }, http.StatusUnauthorized},
+		{"MissingExpiry", func(c jwt.MapClaims) { delete(c, "exp") }, http.StatusUnauthorized},
+		{"UnverifiedEmail", func(c jwt.MapClaims) { c["email_verified"] = false }, http.StatusForbidden},
+		{"MissingEmail", func(c jwt.MapClaims) { delete(c, "email") }, http.StatusForbidden},
+	}
+	for _, tc := range rejected {
+		t.Run(tc.name, func(t *testing.T) {
+			issuer := newMockIssuer(t)
+			claims := issuer.claims
+			issuer.claims = func(iss, nonce string) jwt.MapClaims {
+				c := claims(iss, nonce)
+				tc.claims(c)
+				return c
+			}
+			o, linker, _ := newTestOIDCAuth(issuer, false)
+
+			assert.Equal(t, tc.status, oidcLogin(t, o, issuer, "keycloak").Code)
+			assert.Empty(t, linker.identities)
+		})
+	}
+
+	t.Run("ForgedSignature", func(t *testing.T) {
+		issuer := newMockIssuer(t)
+		forger, err := rsa.GenerateKey(rand.Reader, 2048)
+		assert.NoError(t, err)
+		issuer.signer = forger
+		o, linker, _ := newTestOIDCAuth(issuer, false)
+
+		assert.Equal(t, http.StatusUnauthorized, oidcLogin(t, o, issuer, "keycloak").Code)
+		assert.Empty(t, linker.identities)
+	})
+
+	t.Run("TrustedEmail", func(t *testing.T) {
+		issuer := newMockIssuer(t)
+		claims := issuer.claims
+		issuer.claims = func(iss, nonce string) jwt.MapClaims {
+			c := claims(iss, nonce)
+			delete(c, "email_verified")
+			return c
+		}
+		o, linker, _ := newTestOIDCAuth(issuer, true)
+
+		assert.Equal(t, http.StatusSeeOther, oidcLogin(t, o, issuer, "keycloak").Code)
+		assert.Len(t, linker.identities, 1)
+	})
+
+	t.Run("StateFromAnotherProvider", func(t *testing.T) {
+		issuer := newMockIssuer(t)
+		o, _, _ := newTestOIDCAuth(issuer, false)
+		login := &loginState{Provider: githubProvider, State: "state", Nonce: "nonce", Verifier: "verifier", ExpiresAt: time.Now().Add(time.Minute)}
+
+		req := httptest.NewRequest(http.MethodGet, "/oidc/keycloak/callback?code=code&state=state", nil)
+		req.SetPathValue("provider", "keycloak")
+		req.AddCookie(&http.Cookie{Name: stateCookieName, Value: signState(login, "test-jwt-secret")})
+		rec := httptest.NewRecorder()
+		o.HandleCallback().ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+}
+
+func TestOIDCDiscoveryIssuerMismatch(t *testing.T) {
+	issuer := newMockIssuer(t)
+	o, _, _ := newTestOIDCAuth(issuer, false)
+	o.providers["keycloak"].config.Issuer = issuer.server.URL + "/realms/other"
+
+	assert.Equal(t, http.StatusBadGateway, oidcLogin(t, o, issuer, "keycloak").Code)
+}
+
+func TestProvidersFromEnv(t *testing.T) {
+	t.Run("None", func(t *testing.T) {
+		configs, err := ProvidersFromEnv()
+		assert.NoError(t, err)
+		assert.Empty(t, configs)
+	})
+
+	t.Run("Providers", func(t *testing.T) {
+		t.Setenv("OIDC_PROVIDERS", "google, azure-ad")
+		t.Setenv("OIDC_GOOGLE_CLIENT_ID", "google-client")
+		t.Setenv("OIDC_GOOGLE_REDIRECT_URL", "https://api.example.com/oidc/google/callback")
+		t.Setenv("OIDC_AZURE_AD_ISSUER", "https://login.microsoftonline.com/tenant/v2.0/")
+		t.Setenv("OIDC_AZURE_AD_CLIENT_ID", "azure-client")
+		t.Setenv("OIDC_AZURE_AD_REDIRECT_URL", "https://api.example.com/oidc/azure-ad/callback")
+		t.Setenv("OIDC_AZURE_AD_SCOPES", "email profile")
+		t.Setenv("OIDC_AZURE_AD_EMAIL_CLAIM", "preferred_username")
+		t.Setenv("OIDC_AZURE_AD_TRUST_EMAIL", "true")
+
+		configs, err := ProvidersFromEnv()
+		assert.NoError(t, err)
+		assert.Len(t, configs, 2)
+		assert.Equal(t, "https://accounts.google.com", configs[0].Issuer)
+		assert.Equal(t, "email", configs[0].EmailClaim)
+		assert.False(t, configs[0].TrustEmail)
+		assert.Equal(t, "azure-ad", configs[1].Name)
+		assert.Equal(t, "https://login.microsoftonline.com/tenant/v2.0", configs[1].Issuer)
+		assert.Equal(t, []string{"openid", "email", "profile"}, configs[1].Scopes)
+		assert.Equal(t, "preferred_username", configs[1].EmailClaim)
+		assert.True(t, configs[1].TrustEmail)
+	})
+
+	t.Run("MissingIssuer", func(t *testing.T) {
+		t.Setenv("OIDC_PROVIDERS", "keycloak")
+		t.Setenv("OIDC_KEYCLOAK_CLIENT_ID", "client")
+		t.Setenv("OIDC_KEYCLOAK_REDIRECT_URL", "https://api.example.com/oidc/keycloak/callback")
+		_, err := ProvidersFromEnv()
+		assert.ErrorContains(t, err, "OIDC_KEYCLOAK_ISSUER")
+	})
+
+	t.Run("InvalidName", func(t *testing.T) {
+		t.Setenv("OIDC_PROVIDERS", "github")
+		_, err := ProvidersFromEnv()
+		assert.ErrorContains(t, err, "invalid OIDC_PROVIDERS")
+	})
+}
+
+func TestJSONWebKey(t *testing.T) {
+	weak, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(t, err)
+	k := jsonWebKey{Kty: "RSA", Kid: "weak", N: base64.RawURLEncoding.EncodeToString(weak.N.Bytes()), E: "AQAB"}
+	_, err = k.publicKey()
+	assert.ErrorContains(t, err, "at least 2048 bits")
+
+	_, err = (&jsonWebKey{Kty: "EC", Kid: "off-curve", Crv: "P-256", X: "AQ", Y: "AQ"}).publicKey()
+	assert.ErrorContains(t, err, "not on the curve")
+
+	_, err = (&jsonWebKey{Kty: "oct", Kid: "secret"}).publicKey()
+	assert.ErrorContains(t, err, "unsupported key type")
+}
@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/harshavmb/nannyapi/internal/token"
+)
+
+// startSession issues a refresh token in the cookie /api/refresh-token reads and returns it. GitHub and
+// OpenID Connect logins both start their sessions here. The session of a refresh token already in the
+// cookie is revoked, as the login replaces it.
+func startSession(w http.ResponseWriter, r *http.Request, refreshTokens RefreshTokenStore, keys *token.Keyring, envelope *token.Envelope, userID string) (string, error) {
+	if cookie, err := r.Cookie("refresh_token"); err == nil && cookie.Value != "" {
+		if err := refreshTokens.RevokeRefreshToken(r.Context(), cookie.Value, token.RevokedReplaced); err != nil {
+			return "", err
+		}
+	}
+
+	refreshToken, err := keys.GenerateJWT(userID, token.RefreshTokenLifetime, "refresh")
+	if err != nil {
+		return "", err
+	}
+
+	refreshTokenData := token.RefreshToken{
+		Token:     refreshToken,
+		UserID:    userID,
+		UserAgent: r.UserAgent(),
+		IPAddress: RemoteIP(r),
+	}
+	if _, err := refreshTokens.CreateRefreshToken(r.Context(), refreshTokenData, envelope); err != nil {
+		return "", err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "refresh_token",
+		Value:    refreshToken,
+		Expires:  time.Now().Add(token.RefreshTokenLifetime),
+		HttpOnly: true,
+		Path:     "/",
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return refreshToken, nil
+}
+
+// RemoteIP returns the IP address of the client that sent the request, without the port. IPv6 addresses
+// come without their brackets.
+func RemoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
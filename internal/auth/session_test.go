@@ -0,0 +1,21 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemoteIP(t *testing.T) {
+	for remoteAddr, expected := range map[string]string{
+		"192.0.2.1:1234":        "192.0.2.1",
+		"[2001:db8::1]:1234":    "2001:db8::1",
+		"2001:db8::1":           "2001:db8::1",
+		"unix-socket-peer-name": "unix-socket-peer-name",
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = remoteAddr
+		assert.Equal(t, expected, RemoteIP(r), remoteAddr)
+	}
+}
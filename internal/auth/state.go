@@ -0,0 +1,160 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	// stateCookieName holds the signed state of a login until GitHub redirects back.
+	stateCookieName = "oauthstate"
+	// stateTTL is how long a user has to complete a login.
+	stateTTL = 10 * time.Minute
+)
+
+// NonceStore records the nonces of completed logins. It is shared by every instance, so a callback cannot
+// be replayed against another one.
+type NonceStore interface {
+	UseNonce(ctx context.Context, nonce string, expiresAt time.Time) (bool, error)
+}
+
+// loginState is what the callback of a login is checked against. It is kept in a signed cookie, so
+// logins can start and complete on any instance.
+type loginState struct {
+	Provider  string // github or the name of an OpenID Connect provider
+	State     string // Sent to GitHub and compared with the state it redirects back with
+	Nonce     string // Used once, so a callback cannot be replayed; also sent to OpenID Connect providers
+	Verifier  string // PKCE code verifier, only its S256 challenge is sent to GitHub
+	ExpiresAt time.Time
+}
+
+// signState encodes the state and signs it with the key.
+func signState(s *loginState, key string) string {
+	payload := strings.Join([]string{s.Provider, s.State, s.Nonce, s.Verifier, strconv.FormatInt(s.ExpiresAt.Unix(), 10)}, "|")
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(payload))
+	return encoded + "." + stateSignature(encoded, key)
+}
+
+// parseState checks the signature and expiry of a signed state.
+func parseState(value, key string, now time.Time) (*loginState, error) {
+	encoded, signature, ok := strings.Cut(value, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(stateSignature(encoded, key))) {
+		return nil, fmt.Errorf("invalid OAuth state: bad signature")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OAuth state: malformed payload")
+	}
+	fields := strings.Split(string(payload), "|")
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid OAuth state: malformed payload")
+	}
+	expiresAt, err := strconv.ParseInt(fields[4], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OAuth state: malformed expiry")
+	}
+	s := &loginState{Provider: fields[0], State: fields[1], Nonce: fields[2], Verifier: fields[3], ExpiresAt: time.Unix(expiresAt, 0)}
+	if !now.Before(s.ExpiresAt) {
+		return nil, fmt.Errorf("invalid OAuth state: login expired")
+	}
+	return s, nil
+}
+
+// newLoginState starts a login at the provider.
+func newLoginState(provider string, now time.Time) (*loginState, error) {
+	state, err := randomString()
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := randomString()
+	if err != nil {
+		return nil, err
+	}
+	return &loginState{Provider: provider, State: state, Nonce: nonce, Verifier: oauth2.GenerateVerifier(), ExpiresAt: now.Add(stateTTL)}, nil
+}
+
+// setStateCookie stores the signed state of a login until the provider redirects back.
+func setStateCookie(w http.ResponseWriter, r *http.Request, login *loginState, key string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     stateCookieName,
+		Value:    signState(login, key),
+		Expires:  login.ExpiresAt,
+		HttpOnly: true,
+		Path:     "/", // Ensure the cookie is sent with the callback request
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// checkCallback validates the state of a login callback from the provider and clears the state cookie.
+// Each state can complete a single login.
+func checkCallback(w http.ResponseWriter, r *http.Request, provider, key string, nonces NonceStore) (*loginState, error) {
+	stateCookie, err := r.Cookie(stateCookieName)
+	if err != nil {
+		return nil, fmt.Errorf("state cookie not found")
+	}
+
+	// The state is single use, whatever the outcome of the callback
+	http.SetCookie(w, &http.Cookie{
+		Name:     stateCookieName,
+		Value:    "",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Path:     "/",
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	now := time.Now()
+	login, err := parseState(stateCookie.Value, key, now)
+	if err != nil {
+		return nil, err
+	}
+	if login.Provider != provider {
+		return nil, fmt.Errorf("invalid OAuth state: login was started with %s", login.Provider)
+	}
+	if !hmac.Equal([]byte(r.FormValue("state")), []byte(login.State)) {
+		return nil, fmt.Errorf("invalid OAuth state: state mismatch")
+	}
+	unused, err := nonces.UseNonce(r.Context(), "login:"+login.Nonce, login.ExpiresAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check OAuth state: %v", err)
+	}
+	if !unused {
+		return nil, fmt.Errorf("invalid OAuth state: already used")
+	}
+	return login, nil
+}
+
+// randomString returns 16 random alphanumeric characters.
+func randomString() (string, error) {
+	const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	b := make([]byte, 16)
+
+	for i := range b {
+		randomIndex, err := rand.Int(rand.Reader, big.NewInt(int64(len(letters))))
+		if err != nil {
+			return "", err
+		}
+		b[i] = letters[randomIndex.Int64()]
+	}
+
+	return string(b), nil
+}
+
+func stateSignature(encoded, key string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte("oauthstate\n" + encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,96 @@
+package campaign
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// Campaign states.
+const (
+	StatusRunning   = "running"
+	StatusCompleted = "completed"
+	StatusCancelled = "cancelled"
+)
+
+// Target states. Queued targets wait for a free slot, starting targets were claimed by an API instance that
+// is creating their session, running targets have a diagnostic session in progress.
+const (
+	TargetQueued    = "queued"
+	TargetStarting  = "starting"
+	TargetRunning   = "running"
+	TargetCompleted = "completed"
+	TargetFailed    = "failed"
+	TargetSkipped   = "skipped"   // The session could not be started, e.g. because the agent is offline
+	TargetTimedOut  = "timed_out" // The session did not complete within the target timeout
+)
+
+// Target is one agent of a campaign and its child diagnostic session.
+type Target struct {
+	AgentID    string     `json:"agent_id" bson:"agent_id"`
+	Hostname   string     `json:"hostname" bson:"hostname"`
+	Status     string     `json:"status" bson:"status"`
+	SessionID  string     `json:"session_id,omitempty" bson:"session_id,omitempty"`
+	Error      string     `json:"error,omitempty" bson:"error,omitempty"`
+	StartedAt  *time.Time `json:"started_at,omitempty" bson:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty" bson:"finished_at,omitempty"`
+}
+
+// Progress counts the targets of a campaign by state.
+type Progress struct {
+	Total     int `json:"total" bson:"total"`
+	Queued    int `json:"queued" bson:"queued"`
+	Running   int `json:"running" bson:"running"`
+	Completed int `json:"completed" bson:"completed"`
+	Failed    int `json:"failed" bson:"failed"` // Failed, skipped and timed out targets
+}
+
+// Campaign runs the same diagnosis on many agents, with at most Concurrency sessions in progress at a time.
+type Campaign struct {
+	ID          bson.ObjectID `json:"id" bson:"_id,omitempty"`
+	UserID      string        `json:"user_id" bson:"user_id"` // Owning organisation, which is the user ID for personal organisations
+	Issue       string        `json:"issue" bson:"issue"`
+	Selector    string        `json:"selector,omitempty" bson:"selector,omitempty"` // Label selector the targets were chosen with
+	Group       string        `json:"group,omitempty" bson:"group,omitempty"`       // Agent group the targets were chosen from
+	Concurrency int           `json:"concurrency" bson:"concurrency"`
+	Status      string        `json:"status" bson:"status"`
+	Targets     []Target      `json:"targets" bson:"targets"`
+	Progress    Progress      `json:"progress" bson:"progress"`
+	CreatedAt   time.Time     `json:"created_at" bson:"created_at"`
+	UpdatedAt   time.Time     `json:"updated_at" bson:"updated_at"`
+	CompletedAt *time.Time    `json:"completed_at,omitempty" bson:"completed_at,omitempty"`
+}
+
+// CreateCampaignRequest starts a campaign on the listed agents, the agents matching the selector, or the
+// members of the group. Agents matched more than once are diagnosed once.
+type CreateCampaignRequest struct {
+	Issue       string   `json:"issue"`
+	AgentIDs    []string `json:"agent_ids,omitempty"`
+	Selector    string   `json:"selector,omitempty"`
+	Group       string   `json:"group,omitempty"`
+	Concurrency int      `json:"concurrency,omitempty"` // Defaults to 5
+}
+
+// ClusterMember is an agent whose diagnosis falls into a cluster.
+type ClusterMember struct {
+	AgentID   string `json:"agent_id"`
+	Hostname  string `json:"hostname"`
+	SessionID string `json:"session_id"`
+	Severity  string `json:"severity,omitempty"`
+}
+
+// Cluster groups the agents that share a diagnosis type and root cause.
+type Cluster struct {
+	DiagnosisType string          `json:"diagnosis_type"`
+	RootCause     string          `json:"root_cause"`
+	Agents        []ClusterMember `json:"agents"`
+}
+
+// Comparison groups the latest diagnoses of the targets of a campaign by cause, largest cluster first.
+type Comparison struct {
+	CampaignID  string          `json:"campaign_id"`
+	Status      string          `json:"status"`
+	Progress    Progress        `json:"progress"`
+	Clusters    []Cluster       `json:"clusters"`
+	Undiagnosed []ClusterMember `json:"undiagnosed"` // Targets without a diagnosis yet
+}
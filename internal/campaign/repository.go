@@ -0,0 +1,138 @@
+package campaign
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+type CampaignRepository struct {
+	collection *mongo.Collection
+}
+
+func NewCampaignRepository(db *mongo.Database) *CampaignRepository {
+	return &CampaignRepository{
+		collection: db.Collection("campaigns"),
+	}
+}
+
+func (r *CampaignRepository) InsertCampaign(ctx context.Context, campaign *Campaign) error {
+	result, err := r.collection.InsertOne(ctx, campaign)
+	if err != nil {
+		return fmt.Errorf("failed to insert campaign: %v", err)
+	}
+	campaign.ID = result.InsertedID.(bson.ObjectID)
+	return nil
+}
+
+// GetCampaign returns the campaign with the ID, or nil if there is none.
+func (r *CampaignRepository) GetCampaign(ctx context.Context, id bson.ObjectID) (*Campaign, error) {
+	var campaign Campaign
+	err := r.collection.FindOne(ctx, bson.M{"_id": id}).Decode(&campaign)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to retrieve campaign: %v", err)
+	}
+	return &campaign, nil
+}
+
+// ListCampaigns returns the campaigns of a user, newest first.
+func (r *CampaignRepository) ListCampaigns(ctx context.Context, userID string) ([]*Campaign, error) {
+	return r.findCampaigns(ctx, bson.M{"user_id": userID})
+}
+
+// ListRunningCampaigns returns the campaigns of all users that are still running.
+func (r *CampaignRepository) ListRunningCampaigns(ctx context.Context) ([]*Campaign, error) {
+	return r.findCampaigns(ctx, bson.M{"status": StatusRunning})
+}
+
+func (r *CampaignRepository) findCampaigns(ctx context.Context, filter bson.M) ([]*Campaign, error) {
+	opts := options.Find().SetSort(bson.M{"created_at": -1})
+	cursor, err := r.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list campaigns: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	var campaigns []*Campaign
+	if err := cursor.All(ctx, &campaigns); err != nil {
+		return nil, fmt.Errorf("failed to decode campaigns: %v", err)
+	}
+	return campaigns, nil
+}
+
+// UpdateProgress saves the state and progress of a campaign, unless it was completed or cancelled
+// meanwhile.
+func (r *CampaignRepository) UpdateProgress(ctx context.Context, campaign *Campaign) error {
+	campaign.UpdatedAt = time.Now()
+	filter := bson.M{"_id": campaign.ID, "status": bson.M{"$in": []string{StatusRunning, campaign.Status}}}
+	update := bson.M{"$set": bson.M{
+		"status":       campaign.Status,
+		"progress":     campaign.Progress,
+		"updated_at":   campaign.UpdatedAt,
+		"completed_at": campaign.CompletedAt,
+	}}
+	if _, err := r.collection.UpdateOne(ctx, filter, update); err != nil {
+		return fmt.Errorf("failed to update campaign: %v", err)
+	}
+	return nil
+}
+
+// ClaimTarget moves a queued target of a running campaign to starting, if the campaign has a free slot,
+// and reports whether it did. Only one API instance can claim a target.
+func (r *CampaignRepository) ClaimTarget(ctx context.Context, id bson.ObjectID, index int, now time.Time) (bool, error) {
+	prefix := "targets." + strconv.Itoa(index) + "."
+	busy := bson.M{"$filter": bson.M{
+		"input": "$targets",
+		"cond":  bson.M{"$in": bson.A{"$$this.status", bson.A{TargetStarting, TargetRunning}}},
+	}}
+	filter := bson.M{
+		"_id":             id,
+		"status":          StatusRunning,
+		prefix + "status": TargetQueued,
+		"$expr":           bson.M{"$lt": bson.A{bson.M{"$size": busy}, "$concurrency"}},
+	}
+	update := bson.M{"$set": bson.M{prefix + "status": TargetStarting, prefix + "started_at": now, "updated_at": now}}
+	result, err := r.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, fmt.Errorf("failed to claim campaign target: %v", err)
+	}
+	return result.ModifiedCount > 0, nil
+}
+
+// UpdateTarget replaces a target that is still in the state it was read in, and reports whether it did.
+func (r *CampaignRepository) UpdateTarget(ctx context.Context, id bson.ObjectID, index int, from string, target *Target) (bool, error) {
+	prefix := "targets." + strconv.Itoa(index)
+	filter := bson.M{"_id": id, prefix + ".status": from}
+	update := bson.M{"$set": bson.M{prefix: target, "updated_at": time.Now()}}
+	result, err := r.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, fmt.Errorf("failed to update campaign target: %v", err)
+	}
+	return result.ModifiedCount > 0, nil
+}
+
+// CancelCampaign cancels a running campaign and skips its queued targets, and reports whether it did.
+func (r *CampaignRepository) CancelCampaign(ctx context.Context, id bson.ObjectID, now time.Time) (bool, error) {
+	filter := bson.M{"_id": id, "status": StatusRunning}
+	update := bson.M{"$set": bson.M{
+		"status":              StatusCancelled,
+		"targets.$[t].status": TargetSkipped,
+		"targets.$[t].error":  "campaign cancelled",
+		"updated_at":          now,
+		"completed_at":        now,
+	}}
+	opts := options.UpdateOne().SetArrayFilters([]interface{}{bson.M{"t.status": TargetQueued}})
+	result, err := r.collection.UpdateOne(ctx, filter, update, opts)
+	if err != nil {
+		return false, fmt.Errorf("failed to cancel campaign: %v", err)
+	}
+	return result.ModifiedCount > 0, nil
+}
@@ -0,0 +1,528 @@
+package campaign
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+
+	"github.com/harshavmb/nannyapi/internal/agent"
+	"github.com/harshavmb/nannyapi/internal/diagnostic"
+)
+
+const (
+	defaultConcurrency   = 5
+	maxConcurrency       = 50
+	maxTargets           = 1000
+	defaultTargetTimeout = time.Hour
+	defaultCheckInterval = 30 * time.Second
+	advanceTimeout       = 5 * time.Minute
+)
+
+// Config holds the settings of the campaign runner.
+type Config struct {
+	TargetTimeout time.Duration // How long a child session may stay in progress before its target times out
+	CheckInterval time.Duration // How often running campaigns are advanced
+}
+
+// DefaultConfig returns the default campaign runner settings.
+func DefaultConfig() Config {
+	return Config{
+		TargetTimeout: defaultTargetTimeout,
+		CheckInterval: defaultCheckInterval,
+	}
+}
+
+// ConfigFromEnv reads CAMPAIGN_TARGET_TIMEOUT and CAMPAIGN_CHECK_INTERVAL, falling back to the
+// defaults for any variable that is not set.
+func ConfigFromEnv() (Config, error) {
+	config := DefaultConfig()
+
+	if value := os.Getenv("CAMPAIGN_TARGET_TIMEOUT"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return config, fmt.Errorf("invalid CAMPAIGN_TARGET_TIMEOUT %q", value)
+		}
+		config.TargetTimeout = d
+	}
+	if value := os.Getenv("CAMPAIGN_CHECK_INTERVAL"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < time.Second {
+			return config, fmt.Errorf("invalid CAMPAIGN_CHECK_INTERVAL %q, must be at least 1s", value)
+		}
+		config.CheckInterval = d
+	}
+	return config, nil
+}
+
+// SessionService starts and looks up the child diagnostic sessions of campaigns.
+type SessionService interface {
+	StartDiagnosticSession(ctx context.Context, agentID string, userID string, issue string) (*diagnostic.DiagnosticSession, error)
+	GetDiagnosticSession(ctx context.Context, sessionID string, userID string) (*diagnostic.DiagnosticSession, error)
+}
+
+// CampaignService runs diagnostic campaigns across many agents. Every API instance advances the running
+// campaigns; targets are claimed in the database so each is started once.
+type CampaignService struct {
+	repository   *CampaignRepository
+	sessions     SessionService
+	agentService *agent.AgentInfoService
+	groupService *agent.GroupService
+	config       Config
+
+	// advancing holds the IDs of the campaigns this instance is advancing, so ticks do not pile up
+	advancing sync.Map
+}
+
+func NewCampaignService(repository *CampaignRepository, sessions SessionService, agentService *agent.AgentInfoService, groupService *agent.GroupService, config Config) *CampaignService {
+	return &CampaignService{
+		repository:   repository,
+		sessions:     sessions,
+		agentService: agentService,
+		groupService: groupService,
+		config:       config,
+	}
+}
+
+// CreateCampaign resolves the targets of the request, stores the campaign and starts the first sessions
+// in the background.
+func (s *CampaignService) CreateCampaign(ctx context.Context, userID string, req *CreateCampaignRequest) (*Campaign, error) {
+	if strings.TrimSpace(req.Issue) == "" {
+		return nil, fmt.Errorf("invalid campaign: issue is required")
+	}
+	if len(req.AgentIDs) == 0 && req.Selector == "" && req.Group == "" {
+		return nil, fmt.Errorf("invalid campaign: agent_ids, selector or group is required")
+	}
+	concurrency := req.Concurrency
+	if concurrency == 0 {
+		concurrency = defaultConcurrency
+	}
+	if concurrency < 1 || concurrency > maxConcurrency {
+		return nil, fmt.Errorf("invalid campaign: concurrency must be between 1 and %d", maxConcurrency)
+	}
+
+	agents, err := s.resolveAgents(ctx, userID, req)
+	if err != nil {
+		return nil, err
+	}
+	if len(agents) == 0 {
+		return nil, fmt.Errorf("invalid campaign: no agents match")
+	}
+	if len(agents) > maxTargets {
+		return nil, fmt.Errorf("invalid campaign: %d agents match, at most %d are allowed", len(agents), maxTargets)
+	}
+
+	now := time.Now()
+	campaign := &Campaign{
+		UserID:      userID,
+		Issue:       req.Issue,
+		Selector:    req.Selector,
+		Group:       req.Group,
+		Concurrency: concurrency,
+		Status:      StatusRunning,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	for _, a := range agents {
+		campaign.Targets = append(campaign.Targets, Target{AgentID: a.ID.Hex(), Hostname: a.Hostname, Status: TargetQueued})
+	}
+	campaign.refreshProgress(now)
+
+	if err := s.repository.InsertCampaign(ctx, campaign); err != nil {
+		return nil, err
+	}
+	log.Printf("Campaign created - Campaign: %s, User: %s, Targets: %d", campaign.ID.Hex(), userID, len(campaign.Targets))
+
+	go s.advanceInBackground(campaign.ID)
+	return campaign, nil
+}
+
+// resolveAgents returns the agents of the user listed in the request or matching its selector and group,
+// ordered by hostname.
+func (s *CampaignService) resolveAgents(ctx context.Context, userID string, req *CreateCampaignRequest) ([]*agent.AgentInfo, error) {
+	byID := map[string]*agent.AgentInfo{}
+
+	for _, agentID := range req.AgentIDs {
+		id, err := bson.ObjectIDFromHex(agentID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid campaign: %q is not a valid agent ID", agentID)
+		}
+		agentInfo, err := s.agentService.GetAgentInfoByID(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if agentInfo == nil || agentInfo.UserID != userID {
+			return nil, fmt.Errorf("invalid campaign: agent %s not found", agentID)
+		}
+		byID[agentID] = agentInfo
+	}
+
+	if req.Selector != "" || req.Group != "" {
+		selector, err := agent.ParseSelector(req.Selector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid campaign: %v", err)
+		}
+		if req.Group != "" {
+			group, err := s.groupService.GetGroupByName(ctx, userID, req.Group)
+			if err != nil {
+				if strings.Contains(err.Error(), "group not found") {
+					return nil, fmt.Errorf("invalid campaign: group %q not found", req.Group)
+				}
+				return nil, err
+			}
+			groupSelector, err := agent.ParseSelector(group.Selector)
+			if err != nil {
+				return nil, fmt.Errorf("invalid campaign: %v", err)
+			}
+			selector = append(selector, groupSelector...)
+		}
+
+		matched, err := s.agentService.FindAgents(ctx, userID, agent.AgentQuery{Selector: selector})
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range matched {
+			byID[a.ID.Hex()] = a
+		}
+	}
+
+	agents := make([]*agent.AgentInfo, 0, len(byID))
+	for _, a := range byID {
+		agents = append(agents, a)
+	}
+	slices.SortFunc(agents, func(a, b *agent.AgentInfo) int {
+		return strings.Compare(a.Hostname+a.ID.Hex(), b.Hostname+b.ID.Hex())
+	})
+	return agents, nil
+}
+
+// GetCampaign returns a campaign owned by the user.
+func (s *CampaignService) GetCampaign(ctx context.Context, id bson.ObjectID, userID string) (*Campaign, error) {
+	campaign, err := s.repository.GetCampaign(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if campaign == nil {
+		return nil, fmt.Errorf("campaign not found")
+	}
+	if campaign.UserID != userID {
+		return nil, fmt.Errorf("campaign does not belong to user")
+	}
+	return campaign, nil
+}
+
+// ListCampaigns returns the campaigns of a user, newest first.
+func (s *CampaignService) ListCampaigns(ctx context.Context, userID string) ([]*Campaign, error) {
+	return s.repository.ListCampaigns(ctx, userID)
+}
+
+// CancelCampaign stops a running campaign from starting further sessions. Sessions already in
+// progress are not stopped.
+func (s *CampaignService) CancelCampaign(ctx context.Context, id bson.ObjectID, userID string) (*Campaign, error) {
+	campaign, err := s.GetCampaign(ctx, id, userID)
+	if err != nil {
+		return nil, err
+	}
+	if campaign.Status != StatusRunning {
+		return nil, fmt.Errorf("campaign is already %s", campaign.Status)
+	}
+
+	cancelled, err := s.repository.CancelCampaign(ctx, id, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if campaign, err = s.GetCampaign(ctx, id, userID); err != nil {
+		return nil, err
+	}
+	if !cancelled {
+		return nil, fmt.Errorf("campaign is already %s", campaign.Status)
+	}
+	campaign.refreshProgress(time.Now())
+	if err := s.repository.UpdateProgress(ctx, campaign); err != nil {
+		return nil, err
+	}
+	log.Printf("Campaign cancelled - Campaign: %s, User: %s", id.Hex(), userID)
+	return campaign, nil
+}
+
+// CompareResults groups the latest diagnoses of the targets of a campaign by diagnosis type and root cause.
+func (s *CampaignService) CompareResults(ctx context.Context, id bson.ObjectID, userID string) (*Comparison, error) {
+	campaign, err := s.GetCampaign(ctx, id, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := map[string]*diagnostic.DiagnosticSession{}
+	for _, target := range campaign.Targets {
+		if target.SessionID == "" {
+			continue
+		}
+		session, err := s.sessions.GetDiagnosticSession(ctx, target.SessionID, campaign.UserID)
+		if err != nil {
+			// Deleted sessions leave their target undiagnosed
+			log.Printf("Failed to load session %s of campaign %s: %v", target.SessionID, id.Hex(), err)
+			continue
+		}
+		sessions[target.SessionID] = session
+	}
+
+	comparison := compare(campaign, sessions)
+	return &comparison, nil
+}
+
+// StartScheduler advances the running campaigns every check interval until the context is cancelled.
+func (s *CampaignService) StartScheduler(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(s.config.CheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				campaigns, err := s.repository.ListRunningCampaigns(ctx)
+				if err != nil {
+					log.Printf("Failed to list running campaigns: %v", err)
+					continue
+				}
+				for _, campaign := range campaigns {
+					go s.advanceInBackground(campaign.ID)
+				}
+			}
+		}
+	}()
+}
+
+func (s *CampaignService) advanceInBackground(id bson.ObjectID) {
+	if _, busy := s.advancing.LoadOrStore(id, true); busy {
+		return
+	}
+	defer s.advancing.Delete(id)
+
+	ctx, cancel := context.WithTimeout(context.Background(), advanceTimeout)
+	defer cancel()
+	if err := s.advance(ctx, id); err != nil {
+		log.Printf("Failed to advance campaign %s: %v", id.Hex(), err)
+	}
+}
+
+// advance refreshes the running targets of a campaign from their sessions, starts queued targets
+// while slots are free and completes the campaign once every target has finished. Each target is
+// updated on its own, only if no other instance changed it meanwhile.
+func (s *CampaignService) advance(ctx context.Context, id bson.ObjectID) error {
+	campaign, err := s.repository.GetCampaign(ctx, id)
+	if err != nil {
+		return err
+	}
+	if campaign == nil || campaign.Status != StatusRunning {
+		return nil
+	}
+
+	now := time.Now()
+	for i := range campaign.Targets {
+		target := campaign.Targets[i]
+		switch target.Status {
+		case TargetRunning:
+			session, err := s.sessions.GetDiagnosticSession(ctx, target.SessionID, campaign.UserID)
+			if err != nil && !strings.Contains(err.Error(), "session not found") {
+				log.Printf("Failed to check session %s of campaign %s: %v", target.SessionID, id.Hex(), err)
+				continue
+			}
+			checkTarget(&target, session, now, s.config.TargetTimeout)
+		case TargetStarting:
+			// The instance that claimed the target stopped before it recorded the session
+			if target.StartedAt == nil || now.Sub(*target.StartedAt) <= advanceTimeout {
+				continue
+			}
+			target.Status = TargetSkipped
+			target.Error = "session could not be started"
+			target.FinishedAt = &now
+		}
+		if target.Status != campaign.Targets[i].Status {
+			if _, err := s.repository.UpdateTarget(ctx, id, i, campaign.Targets[i].Status, &target); err != nil {
+				return err
+			}
+			campaign.Targets[i] = target
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, i := range campaign.nextTargets() {
+		claimed, err := s.repository.ClaimTarget(ctx, id, i, now)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, target Target) {
+			defer wg.Done()
+			s.startTarget(ctx, campaign, &target, now)
+			if _, err := s.repository.UpdateTarget(ctx, id, i, TargetStarting, &target); err != nil {
+				log.Printf("Failed to record session %s of campaign %s: %v", target.SessionID, id.Hex(), err)
+			}
+		}(i, campaign.Targets[i])
+	}
+	wg.Wait()
+
+	// Other instances may have changed targets meanwhile
+	if campaign, err = s.repository.GetCampaign(ctx, id); err != nil || campaign == nil || campaign.Status != StatusRunning {
+		return err
+	}
+	campaign.refreshProgress(time.Now())
+	if campaign.Status == StatusCompleted {
+		log.Printf("Campaign completed - Campaign: %s, Completed: %d, Failed: %d", id.Hex(), campaign.Progress.Completed, campaign.Progress.Failed)
+	}
+	return s.repository.UpdateProgress(ctx, campaign)
+}
+
+// startTarget starts the child session of a target. Targets whose session cannot be created are
+// skipped; targets whose session was created but could not be diagnosed fail.
+func (s *CampaignService) startTarget(ctx context.Context, campaign *Campaign, target *Target, now time.Time) {
+	target.StartedAt = &now
+	session, err := s.sessions.StartDiagnosticSession(ctx, target.AgentID, campaign.UserID, campaign.Issue)
+	if session != nil {
+		target.SessionID = session.ID.Hex()
+	}
+	switch {
+	case err != nil && session == nil:
+		target.Status = TargetSkipped
+		target.Error = err.Error()
+		target.FinishedAt = &now
+	case err != nil:
+		target.Status = TargetFailed
+		target.Error = err.Error()
+		target.FinishedAt = &now
+	default:
+		target.Status = TargetRunning
+	}
+}
+
+// checkTarget updates a running target from its session. A nil session means it was deleted.
+func checkTarget(target *Target, session *diagnostic.DiagnosticSession, now time.Time, timeout time.Duration) {
+	switch {
+	case session == nil:
+		target.Status = TargetFailed
+		target.Error = "session was deleted"
+		target.FinishedAt = &now
+	case session.Status == "cancelled":
+		target.Status = TargetFailed
+		target.Error = "session was cancelled"
+		target.FinishedAt = &now
+	case session.Status == "completed":
+		target.Status = TargetCompleted
+		finishedAt := session.UpdatedAt
+		target.FinishedAt = &finishedAt
+	case target.StartedAt != nil && now.Sub(*target.StartedAt) > timeout:
+		target.Status = TargetTimedOut
+		target.Error = fmt.Sprintf("session did not complete within %s", timeout)
+		target.FinishedAt = &now
+	}
+}
+
+// nextTargets returns the indexes of the queued targets that fit into the free slots.
+func (c *Campaign) nextTargets() []int {
+	slots := c.Concurrency
+	for _, target := range c.Targets {
+		if target.Status == TargetRunning || target.Status == TargetStarting {
+			slots--
+		}
+	}
+
+	var next []int
+	for i, target := range c.Targets {
+		if slots <= 0 {
+			break
+		}
+		if target.Status == TargetQueued {
+			next = append(next, i)
+			slots--
+		}
+	}
+	return next
+}
+
+// refreshProgress recounts the targets and completes a running campaign once none are left to run.
+func (c *Campaign) refreshProgress(now time.Time) {
+	progress := Progress{Total: len(c.Targets)}
+	for _, target := range c.Targets {
+		switch target.Status {
+		case TargetQueued:
+			progress.Queued++
+		case TargetRunning, TargetStarting:
+			progress.Running++
+		case TargetCompleted:
+			progress.Completed++
+		default:
+			progress.Failed++
+		}
+	}
+	c.Progress = progress
+
+	if c.Status == StatusRunning && progress.Queued == 0 && progress.Running == 0 {
+		c.Status = StatusCompleted
+		c.CompletedAt = &now
+	}
+}
+
+// compare clusters the targets by the latest diagnosis with a root cause in their session.
+func compare(campaign *Campaign, sessions map[string]*diagnostic.DiagnosticSession) Comparison {
+	comparison := Comparison{
+		CampaignID:  campaign.ID.Hex(),
+		Status:      campaign.Status,
+		Progress:    campaign.Progress,
+		Clusters:    []Cluster{},
+		Undiagnosed: []ClusterMember{},
+	}
+
+	index := map[string]int{}
+	for _, target := range campaign.Targets {
+		member := ClusterMember{AgentID: target.AgentID, Hostname: target.Hostname, SessionID: target.SessionID}
+
+		diagnosis := latestDiagnosis(sessions[target.SessionID])
+		if diagnosis == nil {
+			comparison.Undiagnosed = append(comparison.Undiagnosed, member)
+			continue
+		}
+		member.Severity = diagnosis.Severity
+
+		key := diagnosis.DiagnosisType + "|" + normalizeCause(diagnosis.RootCause)
+		i, ok := index[key]
+		if !ok {
+			i = len(comparison.Clusters)
+			index[key] = i
+			comparison.Clusters = append(comparison.Clusters, Cluster{DiagnosisType: diagnosis.DiagnosisType, RootCause: diagnosis.RootCause})
+		}
+		comparison.Clusters[i].Agents = append(comparison.Clusters[i].Agents, member)
+	}
+
+	slices.SortStableFunc(comparison.Clusters, func(a, b Cluster) int {
+		return len(b.Agents) - len(a.Agents)
+	})
+	return comparison
+}
+
+// latestDiagnosis returns the last response of a session that names a root cause.
+func latestDiagnosis(session *diagnostic.DiagnosticSession) *diagnostic.DiagnosticResponse {
+	if session == nil {
+		return nil
+	}
+	for i := len(session.History) - 1; i >= 0; i-- {
+		if session.History[i].RootCause != "" {
+			return &session.History[i]
+		}
+	}
+	return nil
+}
+
+// normalizeCause lets root causes that differ only in case, spacing or a trailing period match.
+func normalizeCause(cause string) string {
+	return strings.TrimRight(strings.ToLower(strings.Join(strings.Fields(cause), " ")), ".")
+}
@@ -0,0 +1,200 @@
+package campaign
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/v2/bson"
+
+	"github.com/harshavmb/nannyapi/internal/diagnostic"
+)
+
+type fakeSessions struct {
+	sessions map[string]*diagnostic.DiagnosticSession
+	startErr map[string]error
+}
+
+func (f *fakeSessions) StartDiagnosticSession(ctx context.Context, agentID string, userID string, issue string) (*diagnostic.DiagnosticSession, error) {
+	if err, ok := f.startErr[agentID]; ok {
+		return nil, err
+	}
+	session := &diagnostic.DiagnosticSession{ID: bson.NewObjectID(), AgentID: agentID, UserID: userID, InitialIssue: issue, Status: "in_progress"}
+	f.sessions[session.ID.Hex()] = session
+	return session, nil
+}
+
+func (f *fakeSessions) GetDiagnosticSession(ctx context.Context, sessionID string, userID string) (*diagnostic.DiagnosticSession, error) {
+	session, ok := f.sessions[sessionID]
+	if !ok {
+		return nil, fmt.Errorf("session not found")
+	}
+	if session.UserID != userID {
+		return nil, fmt.Errorf("session does not belong to organisation")
+	}
+	return session, nil
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Run("Defaults", func(t *testing.T) {
+		t.Setenv("CAMPAIGN_TARGET_TIMEOUT", "")
+		t.Setenv("CAMPAIGN_CHECK_INTERVAL", "")
+		config, err := ConfigFromEnv()
+		assert.NoError(t, err)
+		assert.Equal(t, DefaultConfig(), config)
+	})
+
+	t.Run("Overrides", func(t *testing.T) {
+		t.Setenv("CAMPAIGN_TARGET_TIMEOUT", "2h")
+		t.Setenv("CAMPAIGN_CHECK_INTERVAL", "10s")
+		config, err := ConfigFromEnv()
+		assert.NoError(t, err)
+		assert.Equal(t, 2*time.Hour, config.TargetTimeout)
+		assert.Equal(t, 10*time.Second, config.CheckInterval)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		for name, value := range map[string]string{
+			"CAMPAIGN_TARGET_TIMEOUT": "0s",
+			"CAMPAIGN_CHECK_INTERVAL": "10ms",
+		} {
+			t.Run(name, func(t *testing.T) {
+				t.Setenv(name, value)
+				_, err := ConfigFromEnv()
+				assert.Error(t, err)
+			})
+		}
+	})
+}
+
+func TestNextTargets(t *testing.T) {
+	campaign := &Campaign{
+		Concurrency: 2,
+		Targets: []Target{
+			{AgentID: "a", Status: TargetCompleted},
+			{AgentID: "b", Status: TargetRunning},
+			{AgentID: "c", Status: TargetQueued},
+			{AgentID: "d", Status: TargetQueued},
+		},
+	}
+	assert.Equal(t, []int{2}, campaign.nextTargets())
+
+	campaign.Targets[1].Status = TargetCompleted
+	assert.Equal(t, []int{2, 3}, campaign.nextTargets())
+
+	// Targets another instance is starting hold a slot
+	campaign.Targets[2].Status = TargetStarting
+	assert.Equal(t, []int{3}, campaign.nextTargets())
+
+	campaign.Concurrency = 0
+	assert.Empty(t, campaign.nextTargets())
+}
+
+func TestRefreshProgress(t *testing.T) {
+	now := time.Now()
+	campaign := &Campaign{
+		Status: StatusRunning,
+		Targets: []Target{
+			{Status: TargetCompleted},
+			{Status: TargetRunning},
+			{Status: TargetSkipped},
+			{Status: TargetTimedOut},
+			{Status: TargetStarting},
+		},
+	}
+
+	campaign.refreshProgress(now)
+	assert.Equal(t, Progress{Total: 5, Running: 2, Completed: 1, Failed: 2}, campaign.Progress)
+	assert.Equal(t, StatusRunning, campaign.Status)
+
+	campaign.Targets[1].Status = TargetCompleted
+	campaign.Targets[4].Status = TargetCompleted
+	campaign.refreshProgress(now)
+	assert.Equal(t, StatusCompleted, campaign.Status)
+	assert.Equal(t, &now, campaign.CompletedAt)
+}
+
+func TestCheckTarget(t *testing.T) {
+	now := time.Now()
+	startedAt := now.Add(-2 * time.Hour)
+
+	running := &Target{Status: TargetRunning, StartedAt: &startedAt}
+	checkTarget(running, &diagnostic.DiagnosticSession{Status: "in_progress"}, now, 3*time.Hour)
+	assert.Equal(t, TargetRunning, running.Status)
+
+	completed := &Target{Status: TargetRunning, StartedAt: &startedAt}
+	checkTarget(completed, &diagnostic.DiagnosticSession{Status: "completed", UpdatedAt: now}, now, time.Hour)
+	assert.Equal(t, TargetCompleted, completed.Status)
+	assert.Equal(t, &now, completed.FinishedAt)
+
+	timedOut := &Target{Status: TargetRunning, StartedAt: &startedAt}
+	checkTarget(timedOut, &diagnostic.DiagnosticSession{Status: "in_progress"}, now, time.Hour)
+	assert.Equal(t, TargetTimedOut, timedOut.Status)
+
+	cancelled := &Target{Status: TargetRunning, StartedAt: &startedAt}
+	checkTarget(cancelled, &diagnostic.DiagnosticSession{Status: "cancelled"}, now, 3*time.Hour)
+	assert.Equal(t, TargetFailed, cancelled.Status)
+	assert.Equal(t, "session was cancelled", cancelled.Error)
+
+	deleted := &Target{Status: TargetRunning, StartedAt: &startedAt}
+	checkTarget(deleted, nil, now, time.Hour)
+	assert.Equal(t, TargetFailed, deleted.Status)
+}
+
+func TestStartTarget(t *testing.T) {
+	sessions := &fakeSessions{
+		sessions: map[string]*diagnostic.DiagnosticSession{},
+		startErr: map[string]error{"offline": fmt.Errorf("agent is offline")},
+	}
+	s := &CampaignService{sessions: sessions}
+	campaign := &Campaign{UserID: "user-1", Issue: "high load", Targets: []Target{{AgentID: "online"}, {AgentID: "offline"}}}
+	now := time.Now()
+
+	s.startTarget(context.Background(), campaign, &campaign.Targets[0], now)
+	assert.Equal(t, TargetRunning, campaign.Targets[0].Status)
+	assert.Contains(t, sessions.sessions, campaign.Targets[0].SessionID)
+	assert.Equal(t, "high load", sessions.sessions[campaign.Targets[0].SessionID].InitialIssue)
+
+	s.startTarget(context.Background(), campaign, &campaign.Targets[1], now)
+	assert.Equal(t, TargetSkipped, campaign.Targets[1].Status)
+	assert.Equal(t, "agent is offline", campaign.Targets[1].Error)
+	assert.Empty(t, campaign.Targets[1].SessionID)
+}
+
+func TestCompare(t *testing.T) {
+	session := func(history ...diagnostic.DiagnosticResponse) *diagnostic.DiagnosticSession {
+		return &diagnostic.DiagnosticSession{ID: bson.NewObjectID(), History: history}
+	}
+	sessions := map[string]*diagnostic.DiagnosticSession{
+		"s1": session(diagnostic.DiagnosticResponse{DiagnosisType: "memory", RootCause: "Memory leak in java process."}),
+		"s2": session(
+			diagnostic.DiagnosticResponse{DiagnosisType: "memory", RootCause: "memory leak in  java process", Severity: "high"},
+			diagnostic.DiagnosticResponse{DiagnosisType: "memory"},
+		),
+		"s3": session(diagnostic.DiagnosticResponse{DiagnosisType: "disk", RootCause: "Log partition is full"}),
+		"s4": session(diagnostic.DiagnosticResponse{DiagnosisType: "memory"}),
+	}
+	campaign := &Campaign{
+		ID: bson.NewObjectID(),
+		Targets: []Target{
+			{AgentID: "a1", Hostname: "db-1", SessionID: "s3"},
+			{AgentID: "a2", Hostname: "web-1", SessionID: "s1"},
+			{AgentID: "a3", Hostname: "web-2", SessionID: "s2"},
+			{AgentID: "a4", Hostname: "web-3", SessionID: "s4"},
+			{AgentID: "a5", Hostname: "web-4"},
+		},
+	}
+
+	comparison := compare(campaign, sessions)
+	assert.Len(t, comparison.Clusters, 2)
+	assert.Equal(t, "memory", comparison.Clusters[0].DiagnosisType)
+	assert.Equal(t, "Memory leak in java process.", comparison.Clusters[0].RootCause)
+	assert.Equal(t, []ClusterMember{
+		{AgentID: "a2", Hostname: "web-1", SessionID: "s1"},
+		{AgentID: "a3", Hostname: "web-2", SessionID: "s2", Severity: "high"},
+	}, comparison.Clusters[0].Agents)
+	assert.Equal(t, "disk", comparison.Clusters[1].DiagnosisType)
+	assert.Len(t, comparison.Undiagnosed, 2)
+}
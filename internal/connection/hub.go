@@ -0,0 +1,436 @@
+package connection
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/v2/bson"
+
+	"github.com/harshavmb/nannyapi/internal/agent"
+	"github.com/harshavmb/nannyapi/internal/job"
+)
+
+const (
+	defaultPingInterval = 30 * time.Second
+	// writeWait bounds how long a single frame may take to write.
+	writeWait = 10 * time.Second
+	// maxMessageSize caps the size of a frame sent by an agent.
+	maxMessageSize = 1 << 20
+	// sendBuffer is the number of messages queued for a connection before Send fails.
+	sendBuffer = 64
+)
+
+// Config holds the settings of agent connections.
+type Config struct {
+	PingInterval time.Duration // How often connections are pinged; connections silent for twice as long are dropped
+}
+
+// DefaultConfig returns the default connection settings.
+func DefaultConfig() Config {
+	return Config{PingInterval: defaultPingInterval}
+}
+
+// ConfigFromEnv reads AGENT_WS_PING_INTERVAL, falling back to the default when it is not set.
+func ConfigFromEnv() (Config, error) {
+	config := DefaultConfig()
+
+	if value := os.Getenv("AGENT_WS_PING_INTERVAL"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < time.Second {
+			return config, fmt.Errorf("invalid AGENT_WS_PING_INTERVAL %q, must be at least 1s", value)
+		}
+		config.PingInterval = d
+	}
+	return config, nil
+}
+
+// conn is an open agent connection. Messages pushed to send are written by the write loop of the connection.
+type conn struct {
+	info      Info
+	send      chan Message
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newConn(info Info) *conn {
+	return &conn{info: info, send: make(chan Message, sendBuffer), done: make(chan struct{})}
+}
+
+// close asks the connection to shut down. It is safe to call more than once.
+func (c *conn) close() {
+	c.closeOnce.Do(func() { close(c.done) })
+}
+
+// push queues a message without blocking.
+func (c *conn) push(msg Message) error {
+	select {
+	case <-c.done:
+		return fmt.Errorf("agent is not connected")
+	default:
+	}
+	select {
+	case c.send <- msg:
+		return nil
+	case <-c.done:
+		return fmt.Errorf("agent is not connected")
+	default:
+		return fmt.Errorf("send buffer of agent is full")
+	}
+}
+
+// reportedHeartbeat is the agent version and uptime an agent last reported over its connection.
+type reportedHeartbeat struct {
+	heartbeat agent.Heartbeat
+	at        time.Time
+}
+
+// current returns the heartbeat to record at now, with the uptime advanced by the time since it was reported.
+func (r reportedHeartbeat) current(now time.Time) agent.Heartbeat {
+	heartbeat := r.heartbeat
+	if heartbeat.UptimeSeconds > 0 {
+		heartbeat.UptimeSeconds += int64(now.Sub(r.at) / time.Second)
+	}
+	return heartbeat
+}
+
+// Hub keeps the WebSocket connections agents hold to this API instance. It pushes queued jobs and settings
+// to them and records the output and results they send back.
+type Hub struct {
+	jobService   *job.JobService
+	agentService *agent.AgentInfoService
+	config       Config
+	upgrader     websocket.Upgrader
+
+	mu    sync.RWMutex
+	conns map[string]*conn
+}
+
+func NewHub(jobService *job.JobService, agentService *agent.AgentInfoService, config Config) *Hub {
+	return &Hub{
+		jobService:   jobService,
+		agentService: agentService,
+		config:       config,
+		conns:        map[string]*conn{},
+	}
+}
+
+// register adds a connection, closing the previous connection of the same agent.
+func (h *Hub) register(c *conn) {
+	h.mu.Lock()
+	previous := h.conns[c.info.AgentID]
+	h.conns[c.info.AgentID] = c
+	h.mu.Unlock()
+
+	if previous != nil {
+		previous.close()
+	}
+}
+
+// unregister removes a connection, unless a newer connection of the agent already replaced it.
+func (h *Hub) unregister(c *conn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.conns[c.info.AgentID] == c {
+		delete(h.conns, c.info.AgentID)
+	}
+}
+
+// touch records a pong on a connection.
+func (h *Hub) touch(c *conn, at time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c.info.LastPongAt = at
+}
+
+// IsConnected reports whether the agent holds a connection to this API instance.
+func (h *Hub) IsConnected(agentID string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	_, ok := h.conns[agentID]
+	return ok
+}
+
+// Connections returns the open connections of the agents of a user, oldest first.
+func (h *Hub) Connections(userID string) []Info {
+	h.mu.RLock()
+	infos := []Info{}
+	for _, c := range h.conns {
+		if c.info.UserID == userID {
+			infos = append(infos, c.info)
+		}
+	}
+	h.mu.RUnlock()
+
+	slices.SortFunc(infos, func(a, b Info) int {
+		return a.ConnectedAt.Compare(b.ConnectedAt)
+	})
+	return infos
+}
+
+// Send queues a message for a connected agent.
+func (h *Hub) Send(agentID string, msg Message) error {
+	h.mu.RLock()
+	c, ok := h.conns[agentID]
+	h.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("agent is not connected")
+	}
+	return c.push(msg)
+}
+
+// Disconnect closes the connection of an agent, if it has one.
+func (h *Hub) Disconnect(agentID string) {
+	h.mu.RLock()
+	c, ok := h.conns[agentID]
+	h.mu.RUnlock()
+	if ok {
+		c.close()
+	}
+}
+
+// agentConfig returns the settings pushed to agents when they connect.
+func (h *Hub) agentConfig() *AgentConfig {
+	return &AgentConfig{
+		PingIntervalSeconds: int64(h.config.PingInterval / time.Second),
+		JobLeaseSeconds:     int64(h.jobService.Lease() / time.Second),
+	}
+}
+
+// Serve upgrades the request to a WebSocket connection of the agent and runs it until it closes.
+// A new connection of the same agent replaces the current one.
+func (h *Hub) Serve(w http.ResponseWriter, r *http.Request, agentInfo *agent.AgentInfo) {
+	ws, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade already replied with an error
+		log.Printf("Failed to upgrade connection of agent %s: %v", agentInfo.ID.Hex(), err)
+		return
+	}
+
+	now := time.Now()
+	c := newConn(Info{
+		AgentID:     agentInfo.ID.Hex(),
+		UserID:      agentInfo.UserID,
+		Hostname:    agentInfo.Hostname,
+		RemoteAddr:  r.RemoteAddr,
+		ConnectedAt: now,
+		LastPongAt:  now,
+	})
+	h.register(c)
+	log.Printf("Agent connected - Agent: %s, Remote: %s", c.info.AgentID, c.info.RemoteAddr)
+
+	// The request context ends with the handler, so the connection gets its own
+	ctx, cancel := context.WithCancel(context.Background())
+	go h.writeLoop(ws, c)
+	err = h.readLoop(ctx, ws, c, agentInfo)
+	cancel()
+	c.close()
+	h.unregister(c)
+
+	if err != nil && !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+		log.Printf("Agent connection closed - Agent: %s, Error: %v", c.info.AgentID, err)
+		return
+	}
+	log.Printf("Agent disconnected - Agent: %s", c.info.AgentID)
+}
+
+// writeLoop writes the queued messages and pings of a connection until it closes.
+func (h *Hub) writeLoop(ws *websocket.Conn, c *conn) {
+	ticker := time.NewTicker(h.config.PingInterval)
+	defer func() {
+		ticker.Stop()
+		// Closing the socket also ends the read loop
+		ws.Close()
+	}()
+
+	for {
+		select {
+		case msg := <-c.send:
+			if err := ws.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
+				c.close()
+				return
+			}
+			if err := ws.WriteJSON(msg); err != nil {
+				c.close()
+				return
+			}
+		case <-ticker.C:
+			if err := ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				c.close()
+				return
+			}
+		case <-c.done:
+			// Flush what is still queued, such as the error that closed the connection
+			for len(c.send) > 0 {
+				if err := ws.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
+					return
+				}
+				if err := ws.WriteJSON(<-c.send); err != nil {
+					return
+				}
+			}
+			closing := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+			_ = ws.WriteControl(websocket.CloseMessage, closing, time.Now().Add(writeWait))
+			return
+		}
+	}
+}
+
+// readLoop runs the agent side of a connection. The first message must be a hello, after which jobs are
+// pushed to the agent and its messages are processed until the connection closes.
+func (h *Hub) readLoop(ctx context.Context, ws *websocket.Conn, c *conn, agentInfo *agent.AgentInfo) error {
+	pongWait := 2 * h.config.PingInterval
+	ws.SetReadLimit(maxMessageSize)
+	if err := ws.SetReadDeadline(time.Now().Add(pongWait)); err != nil {
+		return err
+	}
+
+	var hello Message
+	if err := ws.ReadJSON(&hello); err != nil {
+		return err
+	}
+	if hello.Type != TypeHello {
+		_ = c.push(Message{Type: TypeError, Error: "first message must be a hello"})
+		return fmt.Errorf("first message was %q, not a hello", hello.Type)
+	}
+
+	reported := reportedHeartbeat{at: time.Now()}
+	if hello.Heartbeat != nil {
+		reported.heartbeat = *hello.Heartbeat
+	}
+	h.recordHeartbeat(ctx, c, reported)
+
+	// Jobs the agent lost track of while it was disconnected are delivered again
+	if err := h.jobService.Resume(ctx, agentInfo.ID, agentInfo.UserID, hello.JobIDs); err != nil {
+		_ = c.push(Message{Type: TypeError, Error: err.Error()})
+		return fmt.Errorf("failed to resume jobs: %v", err)
+	}
+	if err := c.push(Message{Type: TypeConfig, Config: h.agentConfig()}); err != nil {
+		return err
+	}
+	go h.deliver(ctx, c, agentInfo.ID, agentInfo.UserID)
+
+	ws.SetPongHandler(func(string) error {
+		now := time.Now()
+		h.touch(c, now)
+		h.recordHeartbeat(ctx, c, reported)
+		return ws.SetReadDeadline(now.Add(pongWait))
+	})
+
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if err := ws.SetReadDeadline(time.Now().Add(pongWait)); err != nil {
+			return err
+		}
+
+		var msg Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			_ = c.push(Message{Type: TypeError, Error: "invalid message: " + err.Error()})
+			continue
+		}
+		if msg.Type == TypeHeartbeat {
+			if msg.Heartbeat != nil {
+				reported = reportedHeartbeat{heartbeat: *msg.Heartbeat, at: time.Now()}
+			}
+			h.recordHeartbeat(ctx, c, reported)
+			continue
+		}
+		if reply := h.handle(ctx, c, msg); reply != nil {
+			if err := c.push(*reply); err != nil {
+				log.Printf("Failed to reply to agent %s: %v", c.info.AgentID, err)
+			}
+		}
+	}
+}
+
+// handle processes a message of an agent and returns the reply, if any.
+func (h *Hub) handle(ctx context.Context, c *conn, msg Message) *Message {
+	switch msg.Type {
+	case TypeOutput, TypeResult:
+	default:
+		return &Message{Type: TypeError, Error: fmt.Sprintf("unknown message type %q", msg.Type)}
+	}
+
+	jobID, err := bson.ObjectIDFromHex(msg.JobID)
+	if err != nil {
+		return &Message{Type: TypeError, JobID: msg.JobID, Error: "invalid job ID format"}
+	}
+
+	if msg.Type == TypeOutput {
+		if err := h.jobService.AppendOutput(ctx, jobID, c.info.AgentID, msg.Output); err != nil {
+			return &Message{Type: TypeError, JobID: msg.JobID, Error: err.Error()}
+		}
+		return nil
+	}
+
+	if msg.Result == nil {
+		return &Message{Type: TypeError, JobID: msg.JobID, Error: "result is required"}
+	}
+	existing, err := h.jobService.GetJob(ctx, jobID, c.info.UserID)
+	if err != nil {
+		return &Message{Type: TypeError, JobID: msg.JobID, Error: err.Error()}
+	}
+	if existing.AgentID != c.info.AgentID {
+		return &Message{Type: TypeError, JobID: msg.JobID, Error: "job does not belong to agent"}
+	}
+	completed, err := h.jobService.CompleteJob(ctx, jobID, c.info.UserID, msg.Result)
+	if err != nil {
+		if completed == nil {
+			return &Message{Type: TypeError, JobID: msg.JobID, Error: err.Error()}
+		}
+		// The result was recorded, only processing it failed
+		log.Printf("Failed to process result of job %s: %v", msg.JobID, err)
+	}
+	return &Message{Type: TypeAck, JobID: msg.JobID}
+}
+
+// deliver pushes the jobs of an agent to its connection as they are queued.
+func (h *Hub) deliver(ctx context.Context, c *conn, agentID bson.ObjectID, userID string) {
+	for ctx.Err() == nil {
+		jobs, err := h.jobService.Poll(ctx, agentID, userID, h.config.PingInterval)
+		if err != nil {
+			if strings.Contains(err.Error(), "agent not found") || strings.Contains(err.Error(), "does not belong to user") {
+				_ = c.push(Message{Type: TypeError, Error: err.Error()})
+				c.close()
+				return
+			}
+			log.Printf("Failed to poll jobs of agent %s: %v", c.info.AgentID, err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(h.config.PingInterval):
+			}
+			continue
+		}
+
+		for _, j := range jobs {
+			select {
+			case c.send <- Message{Type: TypeJob, JobID: j.ID.Hex(), Job: j}:
+			case <-c.done:
+				// Undelivered jobs stay dispatched and are delivered again after a reconnect or their lease
+				return
+			}
+		}
+	}
+}
+
+// recordHeartbeat keeps a connected agent online.
+func (h *Hub) recordHeartbeat(ctx context.Context, c *conn, reported reportedHeartbeat) {
+	agentID, err := bson.ObjectIDFromHex(c.info.AgentID)
+	if err != nil {
+		return
+	}
+	if _, err := h.agentService.RecordHeartbeat(ctx, agentID, c.info.UserID, reported.current(time.Now())); err != nil {
+		log.Printf("Failed to record heartbeat of connected agent %s: %v", c.info.AgentID, err)
+	}
+}
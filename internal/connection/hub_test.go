@@ -0,0 +1,152 @@
+package connection
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/v2/bson"
+
+	"github.com/harshavmb/nannyapi/internal/agent"
+)
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Run("Defaults", func(t *testing.T) {
+		t.Setenv("AGENT_WS_PING_INTERVAL", "")
+		config, err := ConfigFromEnv()
+		assert.NoError(t, err)
+		assert.Equal(t, DefaultConfig(), config)
+	})
+
+	t.Run("Overrides", func(t *testing.T) {
+		t.Setenv("AGENT_WS_PING_INTERVAL", "10s")
+		config, err := ConfigFromEnv()
+		assert.NoError(t, err)
+		assert.Equal(t, 10*time.Second, config.PingInterval)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		t.Setenv("AGENT_WS_PING_INTERVAL", "500ms")
+		_, err := ConfigFromEnv()
+		assert.Error(t, err)
+	})
+}
+
+func TestRegistry(t *testing.T) {
+	h := NewHub(nil, nil, DefaultConfig())
+	now := time.Now()
+
+	first := newConn(Info{AgentID: "a1", UserID: "user-1", ConnectedAt: now})
+	other := newConn(Info{AgentID: "a2", UserID: "user-1", ConnectedAt: now.Add(-time.Minute)})
+	foreign := newConn(Info{AgentID: "a3", UserID: "user-2", ConnectedAt: now})
+	h.register(first)
+	h.register(other)
+	h.register(foreign)
+
+	assert.True(t, h.IsConnected("a1"))
+	assert.False(t, h.IsConnected("a4"))
+	connections := h.Connections("user-1")
+	assert.Len(t, connections, 2)
+	assert.Equal(t, "a2", connections[0].AgentID)
+
+	// A reconnect replaces and closes the previous connection
+	second := newConn(Info{AgentID: "a1", UserID: "user-1", ConnectedAt: now.Add(time.Minute)})
+	h.register(second)
+	assert.True(t, isClosed(first))
+	assert.False(t, isClosed(second))
+
+	// The replaced connection going away leaves the new one registered
+	h.unregister(first)
+	assert.True(t, h.IsConnected("a1"))
+	h.unregister(second)
+	assert.False(t, h.IsConnected("a1"))
+	assert.Len(t, h.Connections("user-1"), 1)
+}
+
+func TestSend(t *testing.T) {
+	h := NewHub(nil, nil, DefaultConfig())
+	assert.EqualError(t, h.Send("a1", Message{Type: TypeConfig}), "agent is not connected")
+
+	c := newConn(Info{AgentID: "a1", UserID: "user-1"})
+	h.register(c)
+	for range sendBuffer {
+		assert.NoError(t, h.Send("a1", Message{Type: TypeConfig}))
+	}
+	assert.EqualError(t, h.Send("a1", Message{Type: TypeConfig}), "send buffer of agent is full")
+
+	c.close()
+	assert.EqualError(t, h.Send("a1", Message{Type: TypeConfig}), "agent is not connected")
+}
+
+func TestReportedHeartbeat(t *testing.T) {
+	reportedAt := time.Now()
+	reported := reportedHeartbeat{heartbeat: agent.Heartbeat{AgentVersion: "1.2.0", UptimeSeconds: 100}, at: reportedAt}
+	assert.Equal(t, agent.Heartbeat{AgentVersion: "1.2.0", UptimeSeconds: 190}, reported.current(reportedAt.Add(90*time.Second)))
+
+	// An unknown uptime stays unknown
+	unknown := reportedHeartbeat{heartbeat: agent.Heartbeat{AgentVersion: "1.2.0"}, at: reportedAt}
+	assert.Equal(t, int64(0), unknown.current(reportedAt.Add(time.Minute)).UptimeSeconds)
+}
+
+func TestHandle(t *testing.T) {
+	h := NewHub(nil, nil, DefaultConfig())
+	c := newConn(Info{AgentID: "a1", UserID: "user-1"})
+
+	tests := []struct {
+		name    string
+		msg     Message
+		wantErr string
+	}{
+		{"UnknownType", Message{Type: "shell"}, `unknown message type "shell"`},
+		{"InvalidJobID", Message{Type: TypeOutput, JobID: "not-an-id"}, "invalid job ID format"},
+		{"MissingResult", Message{Type: TypeResult, JobID: bson.NewObjectID().Hex()}, "result is required"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply := h.handle(context.Background(), c, tt.msg)
+			if !assert.NotNil(t, reply) {
+				return
+			}
+			assert.Equal(t, TypeError, reply.Type)
+			assert.Equal(t, tt.wantErr, reply.Error)
+		})
+	}
+}
+
+func TestServeRequiresHello(t *testing.T) {
+	h := NewHub(nil, nil, DefaultConfig())
+	agentInfo := &agent.AgentInfo{ID: bson.NewObjectID(), UserID: "user-1"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.Serve(w, r, agentInfo)
+	}))
+	defer server.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ws.Close()
+
+	assert.NoError(t, ws.WriteJSON(Message{Type: TypeOutput}))
+	var reply Message
+	assert.NoError(t, ws.ReadJSON(&reply))
+	assert.Equal(t, Message{Type: TypeError, Error: "first message must be a hello"}, reply)
+
+	_, _, err = ws.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseNormalClosure))
+	assert.Eventually(t, func() bool { return !h.IsConnected(agentInfo.ID.Hex()) }, time.Second, 10*time.Millisecond)
+}
+
+func isClosed(c *conn) bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,53 @@
+package connection
+
+import (
+	"time"
+
+	"github.com/harshavmb/nannyapi/internal/agent"
+	"github.com/harshavmb/nannyapi/internal/job"
+)
+
+// Message types sent by agents.
+const (
+	TypeHello     = "hello"     // First message of a connection, lists the jobs the agent is still running
+	TypeHeartbeat = "heartbeat" // Updates the agent version and uptime reported with the ping/pong heartbeats
+	TypeOutput    = "output"    // Output of a running job, streamed as it is produced
+	TypeResult    = "result"    // Result of a finished job
+)
+
+// Message types sent by the server.
+const (
+	TypeConfig = "config" // Settings the agent should apply, sent after the hello and whenever they change
+	TypeJob    = "job"    // A job to run
+	TypeAck    = "ack"    // The result of a job was recorded and the agent can forget about it
+	TypeError  = "error"  // A message of the agent could not be processed
+)
+
+// Message is a JSON frame exchanged over an agent connection. Only the fields relevant to the type are set.
+type Message struct {
+	Type      string           `json:"type"`
+	JobID     string           `json:"job_id,omitempty"`    // output, result, ack and error messages about a job
+	JobIDs    []string         `json:"job_ids,omitempty"`   // hello: jobs the agent is still running
+	Heartbeat *agent.Heartbeat `json:"heartbeat,omitempty"` // hello and heartbeat
+	Output    []string         `json:"output,omitempty"`    // output: new lines of the job
+	Result    *job.Result      `json:"result,omitempty"`    // result
+	Job       *job.Job         `json:"job,omitempty"`       // job
+	Config    *AgentConfig     `json:"config,omitempty"`    // config
+	Error     string           `json:"error,omitempty"`     // error
+}
+
+// AgentConfig holds the settings pushed to connected agents.
+type AgentConfig struct {
+	PingIntervalSeconds int64 `json:"ping_interval_seconds"` // How often the server pings the connection
+	JobLeaseSeconds     int64 `json:"job_lease_seconds"`     // How long the agent has to report a result before a job is delivered again
+}
+
+// Info describes an open agent connection.
+type Info struct {
+	AgentID     string    `json:"agent_id"`
+	UserID      string    `json:"user_id"` // Owning organisation, which is the user ID for personal organisations
+	Hostname    string    `json:"hostname"`
+	RemoteAddr  string    `json:"remote_addr"`
+	ConnectedAt time.Time `json:"connected_at"`
+	LastPongAt  time.Time `json:"last_pong_at"`
+}
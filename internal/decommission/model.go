@@ -0,0 +1,32 @@
+package decommission
+
+import "time"
+
+// Retention modes of a decommissioned agent's data.
+const (
+	ModeArchive = "archive" // Keep the agent, its sessions and metric history until the archive period ends
+	ModeDelete  = "delete"  // Delete the agent, its sessions, jobs and metric history right away
+)
+
+// Request decommissions an agent.
+type Request struct {
+	Mode string `json:"mode,omitempty"` // archive or delete, AGENT_DECOMMISSION_MODE when empty
+}
+
+// Report tells what decommissioning an agent revoked, cancelled and removed.
+type Report struct {
+	AgentID              string     `json:"agent_id"`
+	Hostname             string     `json:"hostname"`
+	Mode                 string     `json:"mode"`
+	DecommissionedAt     time.Time  `json:"decommissioned_at"`
+	ArchivedUntil        *time.Time `json:"archived_until,omitempty"` // When the archived data is deleted
+	CredentialsRevoked   int64      `json:"credentials_revoked"`
+	CertificatesRevoked  int64      `json:"certificates_revoked"`
+	TokensRevoked        int64      `json:"tokens_revoked"` // Auth tokens bound to the agent, which are expired
+	JobsCancelled        int64      `json:"jobs_cancelled"`
+	SessionsCancelled    int64      `json:"sessions_cancelled"`
+	SessionsDeleted      int64      `json:"sessions_deleted"`
+	JobsDeleted          int64      `json:"jobs_deleted"`
+	MetricSamplesDeleted int64      `json:"metric_samples_deleted"`
+	AgentDeleted         bool       `json:"agent_deleted"`
+}
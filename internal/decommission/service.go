@@ -0,0 +1,270 @@
+package decommission
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+
+	"github.com/harshavmb/nannyapi/internal/agent"
+)
+
+const (
+	defaultMode             = ModeArchive
+	defaultArchiveRetention = 90 * 24 * time.Hour
+	defaultPurgeInterval    = time.Hour
+	purgeTimeout            = 5 * time.Minute
+)
+
+// Config holds the retention policy of decommissioned agents.
+type Config struct {
+	Mode             string        // Mode used when a request does not name one
+	ArchiveRetention time.Duration // How long archived agents and their data are kept
+	PurgeInterval    time.Duration // How often expired archives are deleted
+}
+
+// DefaultConfig returns the default retention policy.
+func DefaultConfig() Config {
+	return Config{
+		Mode:             defaultMode,
+		ArchiveRetention: defaultArchiveRetention,
+		PurgeInterval:    defaultPurgeInterval,
+	}
+}
+
+// ConfigFromEnv reads AGENT_DECOMMISSION_MODE, AGENT_ARCHIVE_RETENTION and AGENT_ARCHIVE_PURGE_INTERVAL,
+// falling back to the defaults for any variable that is not set.
+func ConfigFromEnv() (Config, error) {
+	config := DefaultConfig()
+
+	if value := os.Getenv("AGENT_DECOMMISSION_MODE"); value != "" {
+		if value != ModeArchive && value != ModeDelete {
+			return config, fmt.Errorf("invalid AGENT_DECOMMISSION_MODE %q, must be %s or %s", value, ModeArchive, ModeDelete)
+		}
+		config.Mode = value
+	}
+	if value := os.Getenv("AGENT_ARCHIVE_RETENTION"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < time.Hour {
+			return config, fmt.Errorf("invalid AGENT_ARCHIVE_RETENTION %q, must be at least 1h", value)
+		}
+		config.ArchiveRetention = d
+	}
+	if value := os.Getenv("AGENT_ARCHIVE_PURGE_INTERVAL"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < time.Minute {
+			return config, fmt.Errorf("invalid AGENT_ARCHIVE_PURGE_INTERVAL %q, must be at least 1m", value)
+		}
+		config.PurgeInterval = d
+	}
+	return config, nil
+}
+
+// AgentStore looks up, decommissions and deletes agents.
+type AgentStore interface {
+	GetAgentInfoByID(ctx context.Context, id bson.ObjectID) (*agent.AgentInfo, error)
+	Decommission(ctx context.Context, id bson.ObjectID, decommissionedAt time.Time, archivedUntil *time.Time) (bool, error)
+	DeleteAgentInfo(ctx context.Context, id bson.ObjectID) error
+	GetExpiredArchives(ctx context.Context, now time.Time) ([]*agent.AgentInfo, error)
+}
+
+// CredentialRevoker revokes the credentials of an agent.
+type CredentialRevoker interface {
+	RevokeAgentCredentials(ctx context.Context, agentID string) (int64, error)
+}
+
+// CertificateRevoker revokes the client certificates of an agent.
+type CertificateRevoker interface {
+	RevokeAgentCertificates(ctx context.Context, agentID string) (int64, error)
+}
+
+// TokenRevoker revokes the auth tokens bound to an agent.
+type TokenRevoker interface {
+	RevokeAgentTokens(ctx context.Context, agentID string) (int64, error)
+}
+
+// JobStore cancels and deletes the jobs of an agent.
+type JobStore interface {
+	CancelAgentJobs(ctx context.Context, agentID string) (int64, error)
+	DeleteAgentJobs(ctx context.Context, agentID string) (int64, error)
+}
+
+// SessionStore cancels and deletes the diagnostic sessions of an agent.
+type SessionStore interface {
+	CancelAgentSessions(ctx context.Context, agentID string) (int64, error)
+	DeleteAgentSessions(ctx context.Context, agentID string) (int64, error)
+}
+
+// MetricsStore deletes the metric history of an agent.
+type MetricsStore interface {
+	DeleteHistory(ctx context.Context, agentID string) (int64, error)
+}
+
+// DecommissionService retires agents: it cuts off their access, stops their work and archives or deletes
+// their data.
+type DecommissionService struct {
+	agents       AgentStore
+	credentials  CredentialRevoker
+	certificates CertificateRevoker
+	tokens       TokenRevoker
+	jobs         JobStore
+	sessions     SessionStore
+	metrics      MetricsStore
+	config       Config
+}
+
+func NewDecommissionService(agents AgentStore, credentials CredentialRevoker, certificates CertificateRevoker, tokens TokenRevoker, jobs JobStore, sessions SessionStore, metrics MetricsStore, config Config) *DecommissionService {
+	return &DecommissionService{
+		agents:       agents,
+		credentials:  credentials,
+		certificates: certificates,
+		tokens:       tokens,
+		jobs:         jobs,
+		sessions:     sessions,
+		metrics:      metrics,
+		config:       config,
+	}
+}
+
+// Decommission retires an agent of the user. Its credentials, certificates and bound auth tokens are
+// revoked and its unfinished jobs and sessions cancelled. Then the agent is either archived with its data
+// until the archive period ends, or deleted with its data. Archived agents can be decommissioned again
+// with the delete mode to delete them early.
+func (s *DecommissionService) Decommission(ctx context.Context, id bson.ObjectID, userID string, req *Request) (*Report, error) {
+	mode := req.Mode
+	if mode == "" {
+		mode = s.config.Mode
+	}
+	if mode != ModeArchive && mode != ModeDelete {
+		return nil, fmt.Errorf("invalid decommission mode %q, must be %s or %s", mode, ModeArchive, ModeDelete)
+	}
+
+	agentInfo, err := s.agents.GetAgentInfoByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if agentInfo == nil {
+		return nil, fmt.Errorf("agent not found")
+	}
+	if agentInfo.UserID != userID {
+		return nil, fmt.Errorf("agent does not belong to user")
+	}
+
+	report := &Report{AgentID: id.Hex(), Hostname: agentInfo.Hostname, Mode: mode}
+	if agentInfo.Status == agent.StatusDecommissioned {
+		if mode == ModeArchive {
+			return nil, fmt.Errorf("invalid decommission transition: agent is already decommissioned")
+		}
+		if agentInfo.DecommissionedAt != nil {
+			report.DecommissionedAt = *agentInfo.DecommissionedAt
+		}
+	} else {
+		// Mark the agent first, so it can no longer report, get jobs or start sessions
+		report.DecommissionedAt = time.Now()
+		if mode == ModeArchive {
+			archivedUntil := report.DecommissionedAt.Add(s.config.ArchiveRetention)
+			report.ArchivedUntil = &archivedUntil
+		}
+		marked, err := s.agents.Decommission(ctx, id, report.DecommissionedAt, report.ArchivedUntil)
+		if err != nil {
+			return nil, err
+		}
+		if !marked {
+			return nil, fmt.Errorf("invalid decommission transition: agent is already decommissioned")
+		}
+	}
+
+	if err := s.retire(ctx, report); err != nil {
+		return nil, err
+	}
+	if mode == ModeDelete {
+		if err := s.purge(ctx, id, report); err != nil {
+			return nil, err
+		}
+	}
+
+	log.Printf("Agent %s decommissioned by user %s: %+v", id.Hex(), userID, *report)
+	return report, nil
+}
+
+// retire revokes the access of an agent, including the auth tokens bound to it, and cancels its unfinished
+// work.
+func (s *DecommissionService) retire(ctx context.Context, report *Report) error {
+	var err error
+	if report.CredentialsRevoked, err = s.credentials.RevokeAgentCredentials(ctx, report.AgentID); err != nil {
+		return err
+	}
+	if report.CertificatesRevoked, err = s.certificates.RevokeAgentCertificates(ctx, report.AgentID); err != nil {
+		return err
+	}
+	if report.TokensRevoked, err = s.tokens.RevokeAgentTokens(ctx, report.AgentID); err != nil {
+		return err
+	}
+	if report.JobsCancelled, err = s.jobs.CancelAgentJobs(ctx, report.AgentID); err != nil {
+		return err
+	}
+	if report.SessionsCancelled, err = s.sessions.CancelAgentSessions(ctx, report.AgentID); err != nil {
+		return err
+	}
+	return nil
+}
+
+// purge deletes the sessions, jobs and metric history of an agent, then the agent itself. Revoked
+// credentials and certificates are kept, so their use stays traceable.
+func (s *DecommissionService) purge(ctx context.Context, id bson.ObjectID, report *Report) error {
+	var err error
+	if report.SessionsDeleted, err = s.sessions.DeleteAgentSessions(ctx, report.AgentID); err != nil {
+		return err
+	}
+	if report.JobsDeleted, err = s.jobs.DeleteAgentJobs(ctx, report.AgentID); err != nil {
+		return err
+	}
+	if report.MetricSamplesDeleted, err = s.metrics.DeleteHistory(ctx, report.AgentID); err != nil {
+		return err
+	}
+	if err := s.agents.DeleteAgentInfo(ctx, id); err != nil {
+		return err
+	}
+	report.AgentDeleted = true
+	return nil
+}
+
+// PurgeExpiredArchives deletes the archived agents whose archive period ended, with their data.
+func (s *DecommissionService) PurgeExpiredArchives(ctx context.Context, now time.Time) error {
+	agents, err := s.agents.GetExpiredArchives(ctx, now)
+	if err != nil {
+		return err
+	}
+	for _, agentInfo := range agents {
+		report := &Report{AgentID: agentInfo.ID.Hex(), Hostname: agentInfo.Hostname, Mode: ModeDelete}
+		if err := s.purge(ctx, agentInfo.ID, report); err != nil {
+			log.Printf("Failed to purge archived agent %s: %v", agentInfo.ID.Hex(), err)
+			continue
+		}
+		log.Printf("Archived agent %s purged: %+v", agentInfo.ID.Hex(), *report)
+	}
+	return nil
+}
+
+// StartPurger periodically deletes expired archives until the context is cancelled.
+func (s *DecommissionService) StartPurger(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(s.config.PurgeInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				purgeCtx, cancel := context.WithTimeout(ctx, purgeTimeout)
+				if err := s.PurgeExpiredArchives(purgeCtx, now); err != nil {
+					log.Printf("Failed to purge expired archives: %v", err)
+				}
+				cancel()
+			}
+		}
+	}()
+}
@@ -0,0 +1,251 @@
+package decommission
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/v2/bson"
+
+	"github.com/harshavmb/nannyapi/internal/agent"
+)
+
+// fakeStore keeps agents in memory and counts what is attached to each agent.
+type fakeStore struct {
+	agents       map[bson.ObjectID]*agent.AgentInfo
+	credentials  map[string]int64
+	certificates map[string]int64
+	tokens       map[string]int64
+	activeJobs   map[string]int64
+	jobs         map[string]int64
+	running      map[string]int64
+	sessions     map[string]int64
+	samples      map[string]int64
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{
+		agents:       map[bson.ObjectID]*agent.AgentInfo{},
+		credentials:  map[string]int64{},
+		certificates: map[string]int64{},
+		tokens:       map[string]int64{},
+		activeJobs:   map[string]int64{},
+		jobs:         map[string]int64{},
+		running:      map[string]int64{},
+		sessions:     map[string]int64{},
+		samples:      map[string]int64{},
+	}
+}
+
+func (f *fakeStore) add(info *agent.AgentInfo) string {
+	info.ID = bson.NewObjectID()
+	f.agents[info.ID] = info
+	agentID := info.ID.Hex()
+	f.credentials[agentID] = 2
+	f.certificates[agentID] = 1
+	f.tokens[agentID] = 1
+	f.activeJobs[agentID] = 1
+	f.jobs[agentID] = 3
+	f.running[agentID] = 1
+	f.sessions[agentID] = 4
+	f.samples[agentID] = 100
+	return agentID
+}
+
+func take(counts map[string]int64, agentID string) int64 {
+	n := counts[agentID]
+	delete(counts, agentID)
+	return n
+}
+
+func (f *fakeStore) GetAgentInfoByID(ctx context.Context, id bson.ObjectID) (*agent.AgentInfo, error) {
+	return f.agents[id], nil
+}
+
+func (f *fakeStore) Decommission(ctx context.Context, id bson.ObjectID, decommissionedAt time.Time, archivedUntil *time.Time) (bool, error) {
+	info := f.agents[id]
+	if info == nil || info.Status == agent.StatusDecommissioned {
+		return false, nil
+	}
+	info.Status = agent.StatusDecommissioned
+	info.DecommissionedAt = &decommissionedAt
+	info.ArchivedUntil = archivedUntil
+	return true, nil
+}
+
+func (f *fakeStore) DeleteAgentInfo(ctx context.Context, id bson.ObjectID) error {
+	delete(f.agents, id)
+	return nil
+}
+
+func (f *fakeStore) GetExpiredArchives(ctx context.Context, now time.Time) ([]*agent.AgentInfo, error) {
+	var expired []*agent.AgentInfo
+	for _, info := range f.agents {
+		if info.ArchivedUntil != nil && !info.ArchivedUntil.After(now) {
+			expired = append(expired, info)
+		}
+	}
+	return expired, nil
+}
+
+func (f *fakeStore) RevokeAgentCredentials(ctx context.Context, agentID string) (int64, error) {
+	return take(f.credentials, agentID), nil
+}
+
+func (f *fakeStore) RevokeAgentCertificates(ctx context.Context, agentID string) (int64, error) {
+	return take(f.certificates, agentID), nil
+}
+
+func (f *fakeStore) RevokeAgentTokens(ctx context.Context, agentID string) (int64, error) {
+	return take(f.tokens, agentID), nil
+}
+
+func (f *fakeStore) CancelAgentJobs(ctx context.Context, agentID string) (int64, error) {
+	return take(f.activeJobs, agentID), nil
+}
+
+func (f *fakeStore) DeleteAgentJobs(ctx context.Context, agentID string) (int64, error) {
+	return take(f.jobs, agentID), nil
+}
+
+func (f *fakeStore) CancelAgentSessions(ctx context.Context, agentID string) (int64, error) {
+	return take(f.running, agentID), nil
+}
+
+func (f *fakeStore) DeleteAgentSessions(ctx context.Context, agentID string) (int64, error) {
+	return take(f.sessions, agentID), nil
+}
+
+func (f *fakeStore) DeleteHistory(ctx context.Context, agentID string) (int64, error) {
+	return take(f.samples, agentID), nil
+}
+
+func newTestService(store *fakeStore) *DecommissionService {
+	return NewDecommissionService(store, store, store, store, store, store, store, DefaultConfig())
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Run("Defaults", func(t *testing.T) {
+		t.Setenv("AGENT_DECOMMISSION_MODE", "")
+		t.Setenv("AGENT_ARCHIVE_RETENTION", "")
+		t.Setenv("AGENT_ARCHIVE_PURGE_INTERVAL", "")
+		config, err := ConfigFromEnv()
+		assert.NoError(t, err)
+		assert.Equal(t, DefaultConfig(), config)
+	})
+
+	t.Run("Overrides", func(t *testing.T) {
+		t.Setenv("AGENT_DECOMMISSION_MODE", "delete")
+		t.Setenv("AGENT_ARCHIVE_RETENTION", "720h")
+		t.Setenv("AGENT_ARCHIVE_PURGE_INTERVAL", "10m")
+		config, err := ConfigFromEnv()
+		assert.NoError(t, err)
+		assert.Equal(t, Config{Mode: ModeDelete, ArchiveRetention: 720 * time.Hour, PurgeInterval: 10 * time.Minute}, config)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		for name, value := range map[string]string{
+			"AGENT_DECOMMISSION_MODE":      "shred",
+			"AGENT_ARCHIVE_RETENTION":      "30m",
+			"AGENT_ARCHIVE_PURGE_INTERVAL": "10s",
+		} {
+			t.Run(name, func(t *testing.T) {
+				t.Setenv(name, value)
+				_, err := ConfigFromEnv()
+				assert.Error(t, err)
+			})
+		}
+	})
+}
+
+func TestDecommissionArchive(t *testing.T) {
+	store := newFakeStore()
+	agentID := store.add(&agent.AgentInfo{UserID: "user-1", Hostname: "web-1", Status: agent.StatusOnline})
+	id, _ := bson.ObjectIDFromHex(agentID)
+	s := newTestService(store)
+
+	report, err := s.Decommission(context.Background(), id, "user-1", &Request{})
+	assert.NoError(t, err)
+	assert.Equal(t, ModeArchive, report.Mode)
+	assert.Equal(t, "web-1", report.Hostname)
+	assert.Equal(t, int64(2), report.CredentialsRevoked)
+	assert.Equal(t, int64(1), report.CertificatesRevoked)
+	assert.Equal(t, int64(1), report.TokensRevoked)
+	assert.Equal(t, int64(1), report.JobsCancelled)
+	assert.Equal(t, int64(1), report.SessionsCancelled)
+	assert.Zero(t, report.SessionsDeleted)
+	assert.False(t, report.AgentDeleted)
+	if assert.NotNil(t, report.ArchivedUntil) {
+		assert.Equal(t, report.DecommissionedAt.Add(defaultArchiveRetention), *report.ArchivedUntil)
+	}
+
+	// The archive and its data are kept
+	assert.Equal(t, agent.StatusDecommissioned, store.agents[id].Status)
+	assert.Equal(t, int64(4), store.sessions[agentID])
+	assert.Equal(t, int64(100), store.samples[agentID])
+
+	_, err = s.Decommission(context.Background(), id, "user-1", &Request{Mode: ModeArchive})
+	assert.ErrorContains(t, err, "invalid decommission transition")
+
+	// An archive can still be deleted early
+	report, err = s.Decommission(context.Background(), id, "user-1", &Request{Mode: ModeDelete})
+	assert.NoError(t, err)
+	assert.True(t, report.AgentDeleted)
+	assert.Equal(t, int64(4), report.SessionsDeleted)
+	assert.Equal(t, int64(3), report.JobsDeleted)
+	assert.Equal(t, int64(100), report.MetricSamplesDeleted)
+	assert.NotContains(t, store.agents, id)
+}
+
+func TestDecommissionDelete(t *testing.T) {
+	store := newFakeStore()
+	agentID := store.add(&agent.AgentInfo{UserID: "user-1", Status: agent.StatusOffline})
+	id, _ := bson.ObjectIDFromHex(agentID)
+	s := newTestService(store)
+
+	report, err := s.Decommission(context.Background(), id, "user-1", &Request{Mode: ModeDelete})
+	assert.NoError(t, err)
+	assert.Nil(t, report.ArchivedUntil)
+	assert.Equal(t, int64(2), report.CredentialsRevoked)
+	assert.Equal(t, int64(1), report.SessionsCancelled)
+	assert.Equal(t, int64(4), report.SessionsDeleted)
+	assert.Equal(t, int64(3), report.JobsDeleted)
+	assert.Equal(t, int64(100), report.MetricSamplesDeleted)
+	assert.True(t, report.AgentDeleted)
+	assert.Empty(t, store.agents)
+}
+
+func TestDecommissionErrors(t *testing.T) {
+	store := newFakeStore()
+	agentID := store.add(&agent.AgentInfo{UserID: "user-1"})
+	id, _ := bson.ObjectIDFromHex(agentID)
+	s := newTestService(store)
+
+	_, err := s.Decommission(context.Background(), id, "user-1", &Request{Mode: "shred"})
+	assert.ErrorContains(t, err, "invalid decommission mode")
+
+	_, err = s.Decommission(context.Background(), bson.NewObjectID(), "user-1", &Request{})
+	assert.ErrorContains(t, err, "agent not found")
+
+	_, err = s.Decommission(context.Background(), id, "user-2", &Request{})
+	assert.ErrorContains(t, err, "does not belong to user")
+	assert.NotEqual(t, agent.StatusDecommissioned, store.agents[id].Status)
+	assert.Equal(t, int64(2), store.credentials[agentID])
+}
+
+func TestPurgeExpiredArchives(t *testing.T) {
+	store := newFakeStore()
+	now := time.Now()
+	expired, kept := now.Add(-time.Minute), now.Add(time.Hour)
+	expiredID := store.add(&agent.AgentInfo{UserID: "user-1", Status: agent.StatusDecommissioned, ArchivedUntil: &expired})
+	keptID := store.add(&agent.AgentInfo{UserID: "user-1", Status: agent.StatusDecommissioned, ArchivedUntil: &kept})
+	activeID := store.add(&agent.AgentInfo{UserID: "user-1", Status: agent.StatusOnline})
+
+	assert.NoError(t, newTestService(store).PurgeExpiredArchives(context.Background(), now))
+	assert.Len(t, store.agents, 2)
+	assert.NotContains(t, store.sessions, expiredID)
+	assert.NotContains(t, store.samples, expiredID)
+	assert.Contains(t, store.sessions, keptID)
+	assert.Contains(t, store.sessions, activeID)
+}
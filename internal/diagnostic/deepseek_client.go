@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
@@ -163,11 +164,12 @@ func (c *DeepSeekClient) buildUserPrompt(req *DiagnosticRequest) string {
 		}
 
 		return fmt.Sprintf(
-			"Analyze these Linux command results for issue '%s'.\n\nResponse Requirements:\n%s\n\nCommand Results:\n%s\n\n"+
+			"Analyze these Linux command results for issue '%s'.\n\nResponse Requirements:\n%s\n\nCommand Results:\n%s\n\n%s"+
 				"Your response MUST include ALL required terms in the analysis guidance and stay focused on the original issue.",
 			req.Issue,
 			analysisGuidance,
 			strings.Join(req.CommandResults, "\n"),
+			trendSection(req.Trends),
 		)
 	}
 
@@ -191,6 +193,8 @@ func (c *DeepSeekClient) buildUserPrompt(req *DiagnosticRequest) string {
 			usageGiB := float64(usage) / (1024 * 1024 * 1024)
 			systemInfo = append(systemInfo, fmt.Sprintf("Disk (%s): %.2f GiB", mountPoint, usageGiB))
 		}
+
+		systemInfo = append(systemInfo, describeExtendedMetrics(req.SystemMetrics)...)
 	}
 
 	var analysisType string
@@ -208,17 +212,100 @@ func (c *DeepSeekClient) buildUserPrompt(req *DiagnosticRequest) string {
 	}
 
 	return fmt.Sprintf(
-		"Analyze Linux system for issue '%s'.\n\nSystem State:\n%s\n\n"+
+		"Analyze Linux system for issue '%s'.\n\nSystem State:\n%s\n\n%s"+
 			"Analysis Type: %s\n%s\n"+
 			"Suggest diagnostic commands to investigate this issue.\n"+
 			"Your response MUST use the correct diagnosis_type and include ALL required terms.",
 		req.Issue,
 		strings.Join(systemInfo, "\n"),
+		trendSection(req.Trends),
 		analysisType,
 		requiredTerms,
 	)
 }
 
+// describeExtendedMetrics renders the optional system metrics reported by newer agents.
+func describeExtendedMetrics(m *agent.SystemMetrics) []string {
+	const gib = 1024 * 1024 * 1024
+	var lines []string
+
+	if m.LoadAverage != nil {
+		lines = append(lines, fmt.Sprintf("Load Average: %.2f, %.2f, %.2f (1m, 5m, 15m)",
+			m.LoadAverage.Load1, m.LoadAverage.Load5, m.LoadAverage.Load15))
+	}
+	if m.SwapTotal > 0 {
+		lines = append(lines, fmt.Sprintf("Swap: Total: %.2f GiB, Used: %.2f GiB (%.1f%%)",
+			float64(m.SwapTotal)/gib, float64(m.SwapUsed)/gib, float64(m.SwapUsed)/float64(m.SwapTotal)*100))
+	}
+	for _, mountPoint := range sortedKeys(m.InodeUsage) {
+		inodes := m.InodeUsage[mountPoint]
+		if inodes.Total > 0 {
+			lines = append(lines, fmt.Sprintf("Inodes (%s): Used: %d of %d (%.1f%%)",
+				mountPoint, inodes.Used, inodes.Total, float64(inodes.Used)/float64(inodes.Total)*100))
+		}
+	}
+	for _, name := range sortedKeys(m.Network) {
+		iface := m.Network[name]
+		lines = append(lines, fmt.Sprintf("Network (%s): RX: %.1f KiB/s, TX: %.1f KiB/s, Errors: %d rx / %d tx, Dropped: %d rx / %d tx",
+			name, iface.RxBytesPerSec/1024, iface.TxBytesPerSec/1024, iface.RxErrors, iface.TxErrors, iface.RxDropped, iface.TxDropped))
+	}
+	if m.OpenFileDescriptors > 0 {
+		if m.MaxFileDescriptors > 0 {
+			lines = append(lines, fmt.Sprintf("Open File Descriptors: %d of %d", m.OpenFileDescriptors, m.MaxFileDescriptors))
+		} else {
+			lines = append(lines, fmt.Sprintf("Open File Descriptors: %d", m.OpenFileDescriptors))
+		}
+	}
+	if m.ProcessCount > 0 {
+		lines = append(lines, fmt.Sprintf("Processes: %d, Threads: %d", m.ProcessCount, m.ThreadCount))
+	}
+	if len(m.TCPStates) > 0 {
+		var states []string
+		for _, state := range agent.TCPStateNames {
+			if count, ok := m.TCPStates[state]; ok {
+				states = append(states, fmt.Sprintf("%s=%d", state, count))
+			}
+		}
+		lines = append(lines, "TCP Connections: "+strings.Join(states, ", "))
+	}
+	if m.Pressure != nil {
+		resources := []struct {
+			name  string
+			stats *agent.PressureStats
+		}{{"CPU", m.Pressure.CPU}, {"Memory", m.Pressure.Memory}, {"IO", m.Pressure.IO}}
+		for _, resource := range resources {
+			if resource.stats != nil {
+				lines = append(lines, fmt.Sprintf("Pressure (%s): some avg10=%.2f avg60=%.2f avg300=%.2f, full avg10=%.2f avg60=%.2f avg300=%.2f",
+					resource.name, resource.stats.SomeAvg10, resource.stats.SomeAvg60, resource.stats.SomeAvg300,
+					resource.stats.FullAvg10, resource.stats.FullAvg60, resource.stats.FullAvg300))
+			}
+		}
+	}
+	if m.UptimeSeconds > 0 {
+		lines = append(lines, fmt.Sprintf("Uptime: %s", time.Duration(m.UptimeSeconds)*time.Second))
+	}
+
+	return lines
+}
+
+// sortedKeys returns the keys of a map in a stable order for prompt rendering.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// trendSection renders the recent metric history for the prompt, if any.
+func trendSection(trends string) string {
+	if trends == "" {
+		return ""
+	}
+	return "Recent Metric Trends:\n" + trends + "\n\n"
+}
+
 // extractPID extracts process ID from command results.
 func extractPID(results []string) string {
 	for _, line := range results {
@@ -55,6 +55,60 @@ func TestBuildUserPrompt(t *testing.T) {
 	assert.Contains(t, analysisPrompt, "load average: 2.15")
 }
 
+func TestBuildUserPromptExtendedMetrics(t *testing.T) {
+	client := &DeepSeekClient{}
+
+	req := &DiagnosticRequest{
+		Issue: "Server is slow",
+		SystemMetrics: &agent.SystemMetrics{
+			CPUUsage:            35.0,
+			MemoryTotal:         16 * 1024 * 1024 * 1024,
+			MemoryUsed:          8 * 1024 * 1024 * 1024,
+			MemoryFree:          8 * 1024 * 1024 * 1024,
+			LoadAverage:         &agent.LoadAverage{Load1: 7.25, Load5: 5.5, Load15: 3.1},
+			SwapTotal:           4 * 1024 * 1024 * 1024,
+			SwapUsed:            1 * 1024 * 1024 * 1024,
+			InodeUsage:          map[string]agent.InodeUsage{"/var": {Total: 1000, Used: 950, Free: 50}},
+			Network:             map[string]agent.NetworkInterface{"eth0": {RxBytesPerSec: 2048, TxBytesPerSec: 1024, RxDropped: 17}},
+			OpenFileDescriptors: 1200,
+			MaxFileDescriptors:  65536,
+			ProcessCount:        150,
+			ThreadCount:         600,
+			TCPStates:           map[string]int64{"TIME_WAIT": 12, "ESTABLISHED": 40},
+			Pressure:            &agent.PressureStall{IO: &agent.PressureStats{SomeAvg10: 12.5}},
+			UptimeSeconds:       3600,
+		},
+		Trends:    "CPU Usage: 10.0% -> 35.0%",
+		Iteration: 0,
+	}
+
+	prompt := client.buildUserPrompt(req)
+	assert.Contains(t, prompt, "Load Average: 7.25, 5.50, 3.10")
+	assert.Contains(t, prompt, "Swap: Total: 4.00 GiB, Used: 1.00 GiB (25.0%)")
+	assert.Contains(t, prompt, "Inodes (/var): Used: 950 of 1000 (95.0%)")
+	assert.Contains(t, prompt, "Network (eth0): RX: 2.0 KiB/s, TX: 1.0 KiB/s, Errors: 0 rx / 0 tx, Dropped: 17 rx / 0 tx")
+	assert.Contains(t, prompt, "Open File Descriptors: 1200 of 65536")
+	assert.Contains(t, prompt, "Processes: 150, Threads: 600")
+	assert.Contains(t, prompt, "TCP Connections: ESTABLISHED=40, TIME_WAIT=12")
+	assert.Contains(t, prompt, "Pressure (IO): some avg10=12.50")
+	assert.Contains(t, prompt, "Uptime: 1h0m0s")
+	assert.Contains(t, prompt, "Recent Metric Trends:\nCPU Usage: 10.0% -> 35.0%")
+
+	// Older agents only report the basic metrics
+	legacy := &DiagnosticRequest{
+		Issue: "Server is slow",
+		SystemMetrics: &agent.SystemMetrics{
+			CPUUsage:    35.0,
+			MemoryTotal: 16 * 1024 * 1024 * 1024,
+			MemoryUsed:  8 * 1024 * 1024 * 1024,
+		},
+	}
+	legacyPrompt := client.buildUserPrompt(legacy)
+	assert.Contains(t, legacyPrompt, "CPU Usage: 35.0%")
+	assert.NotContains(t, legacyPrompt, "Load Average")
+	assert.NotContains(t, legacyPrompt, "Recent Metric Trends")
+}
+
 func TestNewDeepSeekClient(t *testing.T) {
 	client := NewDeepSeekClient("test-api-key")
 	assert.NotNil(t, client)
@@ -32,12 +32,14 @@ type DiagnosticResponse struct {
 	RootCause      string               `json:"root_cause,omitempty" bson:"root_cause,omitempty"`
 	Severity       string               `json:"severity,omitempty" bson:"severity,omitempty"`
 	Impact         string               `json:"impact,omitempty" bson:"impact,omitempty"`
+	MetricsDiff    *agent.MetricsDiff   `json:"metrics_diff,omitempty" bson:"metrics_diff,omitempty"` // Significant metric changes since the previous iteration
 }
 
 // DiagnosticRequest represents a Linux system diagnostic request.
 type DiagnosticRequest struct {
 	Issue           string               `json:"issue" bson:"issue"`
 	SystemMetrics   *agent.SystemMetrics `json:"system_metrics" bson:"system_metrics"`
+	Trends          string               `json:"trends,omitempty" bson:"trends,omitempty"` // Summary of recent metric history
 	LogFiles        []string             `json:"log_files,omitempty" bson:"log_files,omitempty"`
 	CommandResults  []string             `json:"command_results,omitempty" bson:"command_results,omitempty"`
 	Iteration       int                  `json:"iteration" bson:"iteration"`
@@ -60,7 +62,7 @@ type ContinueDiagnosticRequest struct {
 type DiagnosticSession struct {
 	ID               bson.ObjectID        `json:"id" bson:"_id,omitempty"`
 	AgentID          string               `json:"agent_id" bson:"agent_id"`
-	UserID           string               `json:"user_id" bson:"user_id"`
+	UserID           string               `json:"user_id" bson:"user_id"` // Owning organisation, which is the user ID for personal organisations
 	InitialIssue     string               `json:"initial_issue" bson:"initial_issue"`
 	CurrentIteration int                  `json:"current_iteration" bson:"current_iteration"`
 	MaxIterations    int                  `json:"max_iterations" bson:"max_iterations"`
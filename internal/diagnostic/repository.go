@@ -3,6 +3,7 @@ package diagnostic
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"go.mongodb.org/mongo-driver/v2/bson"
 	"go.mongodb.org/mongo-driver/v2/mongo"
@@ -76,3 +77,33 @@ func (r *DiagnosticRepository) DeleteSession(ctx context.Context, sessionID bson
 	}
 	return nil
 }
+
+// CancelAgentSessions marks the sessions of an agent that are in progress as cancelled and returns how many
+// were cancelled.
+func (r *DiagnosticRepository) CancelAgentSessions(ctx context.Context, agentID string, cancelledAt time.Time) (int64, error) {
+	filter := bson.M{"agent_id": agentID, "status": "in_progress"}
+	update := bson.M{"$set": bson.M{"status": "cancelled", "updated_at": cancelledAt}}
+	result, err := r.collection.UpdateMany(ctx, filter, update)
+	if err != nil {
+		return 0, fmt.Errorf("failed to cancel agent sessions: %v", err)
+	}
+	return result.ModifiedCount, nil
+}
+
+// DeleteAgentSessions deletes the sessions of an agent and returns how many were deleted.
+func (r *DiagnosticRepository) DeleteAgentSessions(ctx context.Context, agentID string) (int64, error) {
+	result, err := r.collection.DeleteMany(ctx, bson.M{"agent_id": agentID})
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete agent sessions: %v", err)
+	}
+	return result.DeletedCount, nil
+}
+
+// ReassignAgentSessions moves the sessions of an agent to another agent and returns how many were moved.
+func (r *DiagnosticRepository) ReassignAgentSessions(ctx context.Context, fromAgentID, toAgentID string) (int64, error) {
+	result, err := r.collection.UpdateMany(ctx, bson.M{"agent_id": fromAgentID}, bson.M{"$set": bson.M{"agent_id": toAgentID}})
+	if err != nil {
+		return 0, fmt.Errorf("failed to reassign agent sessions: %v", err)
+	}
+	return result.ModifiedCount, nil
+}
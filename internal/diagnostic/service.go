@@ -12,11 +12,29 @@ import (
 	"github.com/harshavmb/nannyapi/internal/agent"
 )
 
+const (
+	notifyTimeout = 30 * time.Second
+	trendWindow   = time.Hour
+)
+
+// SessionNotifier is told about diagnostic sessions that have completed.
+type SessionNotifier interface {
+	NotifySessionCompleted(ctx context.Context, session *DiagnosticSession) error
+}
+
+// TrendProvider summarises the recent metric history of an agent.
+type TrendProvider interface {
+	TrendSummary(ctx context.Context, agentID string, window time.Duration) (string, error)
+}
+
 // DiagnosticService manages diagnostic sessions and coordinates with DeepSeek API.
 type DiagnosticService struct {
 	client        *DeepSeekClient
 	repository    *DiagnosticRepository
 	agentService  *agent.AgentInfoService
+	notifier      SessionNotifier
+	trends        TrendProvider
+	policies      *agent.ChangePolicyService
 	maxIterations int
 }
 
@@ -31,6 +49,65 @@ func NewDiagnosticService(apiKey string, repository *DiagnosticRepository, agent
 	}
 }
 
+// SetNotifier registers the notifier called when a session completes.
+func (s *DiagnosticService) SetNotifier(notifier SessionNotifier) {
+	s.notifier = notifier
+}
+
+// SetChangePolicy registers the policy used to detect significant metric changes between iterations.
+// Without it the default thresholds apply.
+func (s *DiagnosticService) SetChangePolicy(policies *agent.ChangePolicyService) {
+	s.policies = policies
+}
+
+// diffSystemMetrics compares the metrics of the last iteration with the current ones.
+func (s *DiagnosticService) diffSystemMetrics(ctx context.Context, agentInfo *agent.AgentInfo, old agent.SystemMetrics) *agent.MetricsDiff {
+	if s.policies != nil {
+		diff, err := s.policies.Diff(ctx, agentInfo, old, agentInfo.SystemMetrics)
+		if err == nil {
+			return diff
+		}
+		log.Printf("Error applying change policy, using default thresholds - Agent: %s, Error: %v", agentInfo.ID.Hex(), err)
+	}
+	return agent.DiffSystemMetrics(old, agentInfo.SystemMetrics, agent.DefaultThresholds())
+}
+
+// SetTrendProvider registers the source of metric trends included in prompts.
+func (s *DiagnosticService) SetTrendProvider(trends TrendProvider) {
+	s.trends = trends
+}
+
+// trendSummary returns the metric trend of the agent over the last hour, or an empty
+// string when no history is available. A failing lookup never blocks a diagnosis.
+func (s *DiagnosticService) trendSummary(ctx context.Context, agentID string) string {
+	if s.trends == nil {
+		return ""
+	}
+	summary, err := s.trends.TrendSummary(ctx, agentID, trendWindow)
+	if err != nil {
+		log.Printf("Error retrieving metric trends - Agent: %s, Error: %v", agentID, err)
+		return ""
+	}
+	return summary
+}
+
+// notifySessionCompleted hands a copy of the session to the notifier in the background,
+// so slow mail delivery never holds up the agent.
+func (s *DiagnosticService) notifySessionCompleted(session *DiagnosticSession) {
+	if s.notifier == nil {
+		return
+	}
+
+	completed := *session
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+		defer cancel()
+		if err := s.notifier.NotifySessionCompleted(ctx, &completed); err != nil {
+			log.Printf("Error notifying session completion - Session: %s, Error: %v", completed.ID.Hex(), err)
+		}
+	}()
+}
+
 // StartDiagnosticSession initiates a new diagnostic session.
 func (s *DiagnosticService) StartDiagnosticSession(ctx context.Context, agentID string, userID string, issue string) (*DiagnosticSession, error) {
 	log.Printf("Starting new diagnostic session - User: %s, Agent: %s, Issue: %s", userID, agentID, issue)
@@ -63,6 +140,16 @@ func (s *DiagnosticService) StartDiagnosticSession(ctx context.Context, agentID
 		return nil, fmt.Errorf("agent does not belong to user")
 	}
 
+	// Refuse to diagnose agents that can't run the suggested commands
+	if agentInfo.Status == agent.StatusDecommissioned {
+		log.Printf("Agent is decommissioned - User: %s, Agent: %s", userID, agentID)
+		return nil, fmt.Errorf("agent is decommissioned")
+	}
+	if agentInfo.Status == agent.StatusOffline {
+		log.Printf("Agent is offline - User: %s, Agent: %s, Last seen: %s", userID, agentID, agentInfo.LastSeen)
+		return nil, fmt.Errorf("agent is offline, last seen at %s", agentInfo.LastSeen.UTC().Format(time.RFC3339))
+	}
+
 	session := &DiagnosticSession{
 		AgentID:          agentID,
 		UserID:           userID,
@@ -89,6 +176,7 @@ func (s *DiagnosticService) StartDiagnosticSession(ctx context.Context, agentID
 	req := &DiagnosticRequest{
 		Issue:         issue,
 		SystemMetrics: &agentInfo.SystemMetrics,
+		Trends:        s.trendSummary(ctx, agentID),
 		Iteration:     0,
 	}
 
@@ -114,8 +202,8 @@ func (s *DiagnosticService) StartDiagnosticSession(ctx context.Context, agentID
 	return session, nil
 }
 
-// ContinueDiagnosticSession continues an existing diagnostic session with new results.
-func (s *DiagnosticService) ContinueDiagnosticSession(ctx context.Context, sessionID string, results []string) (*DiagnosticSession, error) {
+// ContinueDiagnosticSession continues an existing diagnostic session of the organisation with new results.
+func (s *DiagnosticService) ContinueDiagnosticSession(ctx context.Context, sessionID string, userID string, results []string) (*DiagnosticSession, error) {
 	log.Printf("Continuing diagnostic session - Session: %s", sessionID)
 
 	id, err := bson.ObjectIDFromHex(sessionID)
@@ -133,6 +221,14 @@ func (s *DiagnosticService) ContinueDiagnosticSession(ctx context.Context, sessi
 		log.Printf("Error retrieving session - Session: %s, Error: %v", sessionID, err)
 		return nil, fmt.Errorf("failed to retrieve session")
 	}
+	if err := checkSessionOwner(session, userID); err != nil {
+		return nil, err
+	}
+	if session.Status == "cancelled" {
+		log.Printf("Session was cancelled - Session: %s", sessionID)
+		return nil, fmt.Errorf("session was cancelled")
+	}
+	alreadyCompleted := session.Status == "completed"
 
 	// Check if we've already reached the maximum iterations
 	if session.CurrentIteration >= s.maxIterations {
@@ -142,6 +238,9 @@ func (s *DiagnosticService) ContinueDiagnosticSession(ctx context.Context, sessi
 			log.Printf("Error updating completed session - Session: %s, Error: %v", sessionID, err)
 			return session, fmt.Errorf("failed to update completed session: %v", err)
 		}
+		if !alreadyCompleted {
+			s.notifySessionCompleted(session)
+		}
 		return session, nil
 	}
 
@@ -161,6 +260,7 @@ func (s *DiagnosticService) ContinueDiagnosticSession(ctx context.Context, sessi
 	req := &DiagnosticRequest{
 		Issue:          session.InitialIssue,
 		SystemMetrics:  &agentInfo.SystemMetrics,
+		Trends:         s.trendSummary(ctx, session.AgentID),
 		CommandResults: results,
 		Iteration:      session.CurrentIteration + 1,
 	}
@@ -182,14 +282,18 @@ func (s *DiagnosticService) ContinueDiagnosticSession(ctx context.Context, sessi
 			log.Printf("Error updating session after diagnosis error - Session: %s, Error: %v", sessionID, err)
 			return session, fmt.Errorf("failed to update session in database: %v", err)
 		}
+		if session.Status == "completed" {
+			s.notifySessionCompleted(session)
+		}
 		return session, err
 	}
 
 	// Check if system metrics have changed significantly
 	lastMetrics := session.History[len(session.History)-1].SystemSnapshot
-	if s.agentService.HasSystemMetricsChanged(*lastMetrics, agentInfo.SystemMetrics) {
-		log.Printf("Significant system metrics changes detected - Session: %s", sessionID)
-		resp.NextStep += "\n[ALERT] Significant system changes detected since last check."
+	if diff := s.diffSystemMetrics(ctx, agentInfo, *lastMetrics); diff.Changed() {
+		log.Printf("Significant system metrics changes detected - Session: %s, Changes: %s", sessionID, diff)
+		resp.NextStep += "\n[ALERT] Significant system changes detected since last check: " + diff.String()
+		resp.MetricsDiff = diff
 	}
 
 	// Store current system metrics with the diagnostic response
@@ -211,6 +315,9 @@ func (s *DiagnosticService) ContinueDiagnosticSession(ctx context.Context, sessi
 		log.Printf("Error updating session with new diagnosis - Session: %s, Error: %v", sessionID, err)
 		return session, fmt.Errorf("failed to update session in database: %v", err)
 	}
+	if session.Status == "completed" {
+		s.notifySessionCompleted(session)
+	}
 
 	return session, nil
 }
@@ -251,6 +358,25 @@ func (s *DiagnosticService) DeleteSession(ctx context.Context, sessionID string,
 	return nil
 }
 
+// CancelAgentSessions cancels the sessions of an agent that are in progress and returns how many were
+// cancelled.
+func (s *DiagnosticService) CancelAgentSessions(ctx context.Context, agentID string) (int64, error) {
+	log.Printf("Cancelling sessions in progress - Agent: %s", agentID)
+	return s.repository.CancelAgentSessions(ctx, agentID, time.Now())
+}
+
+// DeleteAgentSessions deletes every session of an agent and returns how many were deleted.
+func (s *DiagnosticService) DeleteAgentSessions(ctx context.Context, agentID string) (int64, error) {
+	log.Printf("Deleting sessions - Agent: %s", agentID)
+	return s.repository.DeleteAgentSessions(ctx, agentID)
+}
+
+// ReassignAgentSessions moves every session of an agent to another agent and returns how many were moved.
+func (s *DiagnosticService) ReassignAgentSessions(ctx context.Context, fromAgentID, toAgentID string) (int64, error) {
+	log.Printf("Reassigning sessions - From: %s, To: %s", fromAgentID, toAgentID)
+	return s.repository.ReassignAgentSessions(ctx, fromAgentID, toAgentID)
+}
+
 // ListUserSessions returns all diagnostic sessions for a user.
 func (s *DiagnosticService) ListUserSessions(ctx context.Context, userID string) ([]*DiagnosticSession, error) {
 	log.Printf("Listing sessions for user - User: %s", userID)
@@ -258,8 +384,17 @@ func (s *DiagnosticService) ListUserSessions(ctx context.Context, userID string)
 	return s.repository.ListSessions(ctx, filter)
 }
 
-// GetDiagnosticSession retrieves a diagnostic session by ID.
-func (s *DiagnosticService) GetDiagnosticSession(ctx context.Context, sessionID string) (*DiagnosticSession, error) {
+// checkSessionOwner returns an error unless the session belongs to the organisation.
+func checkSessionOwner(session *DiagnosticSession, userID string) error {
+	if session.UserID != userID {
+		log.Printf("Session belongs to another organisation - Organisation: %s, Session: %s", userID, session.ID.Hex())
+		return fmt.Errorf("session does not belong to organisation")
+	}
+	return nil
+}
+
+// GetDiagnosticSession retrieves a diagnostic session of the organisation by ID.
+func (s *DiagnosticService) GetDiagnosticSession(ctx context.Context, sessionID string, userID string) (*DiagnosticSession, error) {
 	log.Printf("Retrieving diagnostic session - Session: %s", sessionID)
 	id, err := bson.ObjectIDFromHex(sessionID)
 	if err != nil {
@@ -276,12 +411,15 @@ func (s *DiagnosticService) GetDiagnosticSession(ctx context.Context, sessionID
 		log.Printf("Error retrieving session - Session: %s, Error: %v", sessionID, err)
 		return nil, fmt.Errorf("failed to retrieve session %v", err)
 	}
+	if err := checkSessionOwner(session, userID); err != nil {
+		return nil, err
+	}
 	log.Printf("Session retrieved successfully - Session: %s", sessionID)
 	return session, nil
 }
 
-// GetDiagnosticSummary generates a summary of the diagnostic session.
-func (s *DiagnosticService) GetDiagnosticSummary(ctx context.Context, sessionID string) (string, error) {
+// GetDiagnosticSummary generates a summary of a diagnostic session of the organisation.
+func (s *DiagnosticService) GetDiagnosticSummary(ctx context.Context, sessionID string, userID string) (string, error) {
 	log.Printf("Generating diagnostic summary - Session: %s", sessionID)
 	id, err := bson.ObjectIDFromHex(sessionID)
 	if err != nil {
@@ -298,6 +436,9 @@ func (s *DiagnosticService) GetDiagnosticSummary(ctx context.Context, sessionID
 		log.Printf("Error retrieving session for summary - Session: %s, Error: %v", sessionID, err)
 		return "", fmt.Errorf("failed to retrieve session %v", err)
 	}
+	if err := checkSessionOwner(session, userID); err != nil {
+		return "", err
+	}
 
 	summary := fmt.Sprintf("Diagnostic Summary for Issue: %s\n\n", session.InitialIssue)
 	summary += fmt.Sprintf("Session Status: %s\n", session.Status)
@@ -118,7 +118,7 @@ func TestStartDiagnosticSession(t *testing.T) {
 	assert.Greater(t, firstResponse.SystemSnapshot.CPUUsage, float64(0))
 
 	// Verify session was stored in MongoDB
-	storedSession, err := service.GetDiagnosticSession(context.Background(), session.ID.Hex())
+	storedSession, err := service.GetDiagnosticSession(context.Background(), session.ID.Hex(), userID)
 	assert.NoError(t, err)
 	assert.Equal(t, session.ID, storedSession.ID)
 	assert.Equal(t, session.InitialIssue, storedSession.InitialIssue)
@@ -157,7 +157,7 @@ func TestContinueDiagnosticSession(t *testing.T) {
 		"Tasks: 180 total, 2 running, 178 sleeping",
 	}
 
-	continuedSession, err := service.ContinueDiagnosticSession(context.Background(), sessionID.Hex(), results)
+	continuedSession, err := service.ContinueDiagnosticSession(context.Background(), sessionID.Hex(), userID, results)
 	assert.NoError(t, err)
 	assert.NotNil(t, continuedSession)
 	assert.Equal(t, sessionID, continuedSession.ID)
@@ -201,7 +201,7 @@ func TestSessionMaxIterations(t *testing.T) {
 	// Run through all iterations
 	for i := 0; i < 3; i++ {
 		var err error
-		session, err = service.ContinueDiagnosticSession(context.Background(), sessionID.Hex(), results)
+		session, err = service.ContinueDiagnosticSession(context.Background(), sessionID.Hex(), userID, results)
 		if err != nil {
 			t.Fatalf("Failed in iteration %d: %v", i, err)
 		}
@@ -212,7 +212,7 @@ func TestSessionMaxIterations(t *testing.T) {
 	assert.NotEmpty(t, session.History)
 
 	// Verify final state in MongoDB
-	storedSession, err := service.GetDiagnosticSession(context.Background(), sessionID.Hex())
+	storedSession, err := service.GetDiagnosticSession(context.Background(), sessionID.Hex(), userID)
 	assert.NoError(t, err)
 	assert.Equal(t, "completed", storedSession.Status)
 	assert.Equal(t, 3, storedSession.CurrentIteration)
@@ -240,12 +240,20 @@ func TestGetDiagnosticSummary(t *testing.T) {
 	assert.NoError(t, err)
 	session.ID = sessionID
 
-	summary, err := service.GetDiagnosticSummary(context.Background(), sessionID.Hex())
+	summary, err := service.GetDiagnosticSummary(context.Background(), sessionID.Hex(), userID)
 	assert.NoError(t, err)
 	assert.Contains(t, summary, "High CPU usage")
 	assert.Contains(t, summary, "Diagnostic Summary")
 	assert.Contains(t, summary, "cpu")         // diagnosis_type
 	assert.Contains(t, summary, "top -b -n 1") // command
+
+	// Sessions of other organisations are rejected
+	_, err = service.GetDiagnosticSummary(context.Background(), sessionID.Hex(), "wrong_user_123")
+	assert.EqualError(t, err, "session does not belong to organisation")
+	_, err = service.GetDiagnosticSession(context.Background(), sessionID.Hex(), "wrong_user_123")
+	assert.EqualError(t, err, "session does not belong to organisation")
+	_, err = service.ContinueDiagnosticSession(context.Background(), sessionID.Hex(), "wrong_user_123", []string{"ok"})
+	assert.EqualError(t, err, "session does not belong to organisation")
 }
 
 func TestStartDiagnosticSessionWithInvalidAgent(t *testing.T) {
@@ -303,7 +311,7 @@ func TestDeleteSession(t *testing.T) {
 	assert.NoError(t, err)
 
 	// Verify session was deleted
-	_, err = service.GetDiagnosticSession(context.Background(), sessionID.Hex())
+	_, err = service.GetDiagnosticSession(context.Background(), sessionID.Hex(), userID)
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "session not found")
 
@@ -451,7 +459,7 @@ func TestComplexMemoryLeakDiagnosticScenario(t *testing.T) {
 		"app      12345  25.5 75.5 16.2g 14.8g ?        Ssl  Apr05 132:12 /app/myapp",
 	}
 
-	session, err = service.ContinueDiagnosticSession(context.Background(), session.ID.Hex(), results)
+	session, err = service.ContinueDiagnosticSession(context.Background(), session.ID.Hex(), userID, results)
 	assert.NoError(t, err)
 
 	// Core memory diagnostic terms
@@ -484,7 +492,7 @@ func TestComplexDatabaseDiagnosticScenario(t *testing.T) {
 		"postgres  1234   95.5  5.0  5962404 839892 ?   Ssl  Apr05 125:30 /usr/lib/postgresql/14/bin/postgres",
 	}
 
-	session, err = service.ContinueDiagnosticSession(context.Background(), session.ID.Hex(), results)
+	session, err = service.ContinueDiagnosticSession(context.Background(), session.ID.Hex(), userID, results)
 	assert.NoError(t, err)
 
 	// Core database diagnostic terms
@@ -519,7 +527,7 @@ func TestComplexTCPNetworkDiagnosticScenario(t *testing.T) {
 		"ESTAB    0        456        10.0.0.5:8080          10.0.0.101:40001",
 	}
 
-	session, err = service.ContinueDiagnosticSession(context.Background(), session.ID.Hex(), results)
+	session, err = service.ContinueDiagnosticSession(context.Background(), session.ID.Hex(), userID, results)
 	assert.NoError(t, err)
 
 	// Core network diagnostic terms
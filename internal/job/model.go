@@ -0,0 +1,60 @@
+package job
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+
+	"github.com/harshavmb/nannyapi/internal/agent"
+	"github.com/harshavmb/nannyapi/internal/diagnostic"
+)
+
+// Job types agents know how to run.
+const (
+	TypeDiagnostic     = "diagnostic"      // Run the commands and log checks of a diagnostic session iteration
+	TypeLogCheck       = "log_check"       // Grep log files and return the matches
+	TypeMetricsRefresh = "metrics_refresh" // Collect and return fresh system metrics
+)
+
+// Job states. Dispatched jobs that are not completed within the lease are delivered again.
+const (
+	StatusPending    = "pending"
+	StatusDispatched = "dispatched"
+	StatusCompleted  = "completed"
+	StatusFailed     = "failed"
+	StatusCancelled  = "cancelled"
+	StatusExpired    = "expired"
+)
+
+// Job is a unit of work queued for an agent.
+type Job struct {
+	ID           bson.ObjectID                  `json:"id" bson:"_id,omitempty"`
+	UserID       string                         `json:"user_id" bson:"user_id"` // Owning organisation, which is the user ID for personal organisations
+	AgentID      string                         `json:"agent_id" bson:"agent_id"`
+	Type         string                         `json:"type" bson:"type"`
+	Status       string                         `json:"status" bson:"status"`
+	SessionID    string                         `json:"session_id,omitempty" bson:"session_id,omitempty"` // Diagnostic session continued with the result
+	Commands     []diagnostic.DiagnosticCommand `json:"commands,omitempty" bson:"commands,omitempty"`
+	LogChecks    []diagnostic.LogCheck          `json:"log_checks,omitempty" bson:"log_checks,omitempty"`
+	Attempts     int                            `json:"attempts" bson:"attempts"`                 // Number of times the job was dispatched
+	Stream       []string                       `json:"stream,omitempty" bson:"stream,omitempty"` // Latest output streamed by the agent while the job runs
+	Result       *Result                        `json:"result,omitempty" bson:"result,omitempty"`
+	CreatedAt    time.Time                      `json:"created_at" bson:"created_at"`
+	DispatchedAt *time.Time                     `json:"dispatched_at,omitempty" bson:"dispatched_at,omitempty"`
+	CompletedAt  *time.Time                     `json:"completed_at,omitempty" bson:"completed_at,omitempty"`
+	ExpiresAt    time.Time                      `json:"expires_at" bson:"expires_at"` // Jobs not completed by then are never delivered again
+}
+
+// Result is what an agent posts back after running a job.
+type Result struct {
+	Output        []string             `json:"output,omitempty" bson:"output,omitempty"` // Command and log check output, in the order of the job
+	Error         string               `json:"error,omitempty" bson:"error,omitempty"`   // Set when the agent could not run the job
+	SystemMetrics *agent.SystemMetrics `json:"system_metrics,omitempty" bson:"-"`        // Fresh metrics for metrics_refresh jobs, saved on the agent
+}
+
+// CreateJobRequest queues a job for an agent. Diagnostic jobs start a new session for the issue.
+type CreateJobRequest struct {
+	Type      string                `json:"type"`
+	Issue     string                `json:"issue,omitempty"`
+	LogChecks []diagnostic.LogCheck `json:"log_checks,omitempty"`
+}
@@ -0,0 +1,194 @@
+package job
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+type JobRepository struct {
+	collection *mongo.Collection
+}
+
+func NewJobRepository(db *mongo.Database) *JobRepository {
+	return &JobRepository{
+		collection: db.Collection("jobs"),
+	}
+}
+
+func (r *JobRepository) InsertJob(ctx context.Context, job *Job) error {
+	result, err := r.collection.InsertOne(ctx, job)
+	if err != nil {
+		return fmt.Errorf("failed to insert job: %v", err)
+	}
+	job.ID = result.InsertedID.(bson.ObjectID)
+	return nil
+}
+
+// GetJob returns the job with the ID, or nil if there is none.
+func (r *JobRepository) GetJob(ctx context.Context, id bson.ObjectID) (*Job, error) {
+	var job Job
+	err := r.collection.FindOne(ctx, bson.M{"_id": id}).Decode(&job)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to retrieve job: %v", err)
+	}
+	return &job, nil
+}
+
+// ListJobs returns the jobs of a user, newest first, optionally filtered by agent and status.
+func (r *JobRepository) ListJobs(ctx context.Context, userID, agentID, status string) ([]*Job, error) {
+	filter := bson.M{"user_id": userID}
+	if agentID != "" {
+		filter["agent_id"] = agentID
+	}
+	if status != "" {
+		filter["status"] = status
+	}
+
+	opts := options.Find().SetSort(bson.M{"created_at": -1})
+	cursor, err := r.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list jobs: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	var jobs []*Job
+	if err := cursor.All(ctx, &jobs); err != nil {
+		return nil, fmt.Errorf("failed to decode jobs: %v", err)
+	}
+	return jobs, nil
+}
+
+// ClaimJob dispatches the oldest deliverable job of an agent: a pending job, or a dispatched job whose
+// lease ran out. It returns nil when there is none.
+func (r *JobRepository) ClaimJob(ctx context.Context, agentID string, now time.Time, lease time.Duration, maxAttempts int) (*Job, error) {
+	filter := bson.M{
+		"agent_id":   agentID,
+		"expires_at": bson.M{"$gt": now},
+		"attempts":   bson.M{"$lt": maxAttempts},
+		"$or": bson.A{
+			bson.M{"status": StatusPending},
+			bson.M{"status": StatusDispatched, "dispatched_at": bson.M{"$lt": now.Add(-lease)}},
+		},
+	}
+	update := bson.M{
+		"$set": bson.M{"status": StatusDispatched, "dispatched_at": now},
+		"$inc": bson.M{"attempts": 1},
+	}
+	opts := options.FindOneAndUpdate().SetSort(bson.M{"created_at": 1}).SetReturnDocument(options.After)
+
+	var job Job
+	err := r.collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&job)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to claim job: %v", err)
+	}
+	return &job, nil
+}
+
+// FinishJob records the result of a dispatched job. It reports false when the job was not dispatched.
+func (r *JobRepository) FinishJob(ctx context.Context, id bson.ObjectID, status string, result *Result, finishedAt time.Time) (bool, error) {
+	filter := bson.M{"_id": id, "status": StatusDispatched}
+	update := bson.M{"$set": bson.M{"status": status, "result": result, "completed_at": finishedAt}}
+	updated, err := r.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, fmt.Errorf("failed to update job: %v", err)
+	}
+	return updated.ModifiedCount > 0, nil
+}
+
+// CancelJob cancels a job that has not finished yet. It reports false when the job already finished.
+func (r *JobRepository) CancelJob(ctx context.Context, id bson.ObjectID, cancelledAt time.Time) (bool, error) {
+	filter := bson.M{"_id": id, "status": bson.M{"$in": []string{StatusPending, StatusDispatched}}}
+	update := bson.M{"$set": bson.M{"status": StatusCancelled, "completed_at": cancelledAt}}
+	updated, err := r.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, fmt.Errorf("failed to cancel job: %v", err)
+	}
+	return updated.ModifiedCount > 0, nil
+}
+
+// CancelAgentJobs cancels the unfinished jobs of an agent and returns how many were cancelled.
+func (r *JobRepository) CancelAgentJobs(ctx context.Context, agentID string, cancelledAt time.Time) (int64, error) {
+	filter := bson.M{"agent_id": agentID, "status": bson.M{"$in": []string{StatusPending, StatusDispatched}}}
+	update := bson.M{"$set": bson.M{"status": StatusCancelled, "completed_at": cancelledAt}}
+	result, err := r.collection.UpdateMany(ctx, filter, update)
+	if err != nil {
+		return 0, fmt.Errorf("failed to cancel agent jobs: %v", err)
+	}
+	return result.ModifiedCount, nil
+}
+
+// DeleteAgentJobs deletes the jobs of an agent and returns how many were deleted.
+func (r *JobRepository) DeleteAgentJobs(ctx context.Context, agentID string) (int64, error) {
+	result, err := r.collection.DeleteMany(ctx, bson.M{"agent_id": agentID})
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete agent jobs: %v", err)
+	}
+	return result.DeletedCount, nil
+}
+
+// ReassignAgentJobs moves the jobs of an agent to another agent and returns how many were moved.
+func (r *JobRepository) ReassignAgentJobs(ctx context.Context, fromAgentID, toAgentID string) (int64, error) {
+	result, err := r.collection.UpdateMany(ctx, bson.M{"agent_id": fromAgentID}, bson.M{"$set": bson.M{"agent_id": toAgentID}})
+	if err != nil {
+		return 0, fmt.Errorf("failed to reassign agent jobs: %v", err)
+	}
+	return result.ModifiedCount, nil
+}
+
+// RenewLeases restarts the lease of the dispatched jobs of an agent with the given IDs.
+func (r *JobRepository) RenewLeases(ctx context.Context, agentID string, ids []bson.ObjectID, now time.Time) error {
+	filter := bson.M{"agent_id": agentID, "status": StatusDispatched, "_id": bson.M{"$in": ids}}
+	if _, err := r.collection.UpdateMany(ctx, filter, bson.M{"$set": bson.M{"dispatched_at": now}}); err != nil {
+		return fmt.Errorf("failed to renew job leases: %v", err)
+	}
+	return nil
+}
+
+// RequeueJobs makes the dispatched jobs of an agent, other than the ones with the given IDs, pending again.
+func (r *JobRepository) RequeueJobs(ctx context.Context, agentID string, except []bson.ObjectID) error {
+	filter := bson.M{"agent_id": agentID, "status": StatusDispatched, "_id": bson.M{"$nin": except}}
+	update := bson.M{"$set": bson.M{"status": StatusPending}, "$unset": bson.M{"dispatched_at": ""}}
+	if _, err := r.collection.UpdateMany(ctx, filter, update); err != nil {
+		return fmt.Errorf("failed to requeue jobs: %v", err)
+	}
+	return nil
+}
+
+// AppendOutput adds output to the stream of a dispatched job of an agent, keeping the last maxLines lines.
+// It reports false when there is no such job.
+func (r *JobRepository) AppendOutput(ctx context.Context, id bson.ObjectID, agentID string, lines []string, maxLines int) (bool, error) {
+	filter := bson.M{"_id": id, "agent_id": agentID, "status": StatusDispatched}
+	update := bson.M{"$push": bson.M{"stream": bson.M{"$each": lines, "$slice": -maxLines}}}
+	updated, err := r.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, fmt.Errorf("failed to append job output: %v", err)
+	}
+	return updated.MatchedCount > 0, nil
+}
+
+// ExpireJobs marks the unfinished jobs of an agent whose expiry passed, or that ran out of attempts, as expired.
+func (r *JobRepository) ExpireJobs(ctx context.Context, agentID string, now time.Time, lease time.Duration, maxAttempts int) error {
+	filter := bson.M{
+		"agent_id": agentID,
+		"$or": bson.A{
+			bson.M{"status": bson.M{"$in": []string{StatusPending, StatusDispatched}}, "expires_at": bson.M{"$lte": now}},
+			bson.M{"status": StatusDispatched, "attempts": bson.M{"$gte": maxAttempts}, "dispatched_at": bson.M{"$lt": now.Add(-lease)}},
+		},
+	}
+	update := bson.M{"$set": bson.M{"status": StatusExpired, "completed_at": now}}
+	if _, err := r.collection.UpdateMany(ctx, filter, update); err != nil {
+		return fmt.Errorf("failed to expire jobs: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,466 @@
+package job
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+
+	"github.com/harshavmb/nannyapi/internal/agent"
+	"github.com/harshavmb/nannyapi/internal/diagnostic"
+)
+
+const (
+	defaultLease = 5 * time.Minute
+	defaultTTL   = time.Hour
+	maxAttempts  = 3
+	// maxBatch caps the number of jobs handed out by a single poll.
+	maxBatch = 10
+	// recheckInterval bounds how long a poll waits without looking at the queue, so jobs queued by
+	// another API instance are still delivered.
+	recheckInterval = 5 * time.Second
+	// maxStreamLines caps the output kept from what agents stream while a job runs.
+	maxStreamLines = 1000
+)
+
+// Config holds the settings of the job queue.
+type Config struct {
+	Lease time.Duration // How long an agent has to post a result before the job is delivered again
+	TTL   time.Duration // How long a job stays deliverable after it was queued
+}
+
+// DefaultConfig returns the default job queue settings.
+func DefaultConfig() Config {
+	return Config{
+		Lease: defaultLease,
+		TTL:   defaultTTL,
+	}
+}
+
+// ConfigFromEnv reads JOB_LEASE and JOB_TTL, falling back to the defaults for any variable that is not set.
+func ConfigFromEnv() (Config, error) {
+	config := DefaultConfig()
+
+	if value := os.Getenv("JOB_LEASE"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < time.Second {
+			return config, fmt.Errorf("invalid JOB_LEASE %q, must be at least 1s", value)
+		}
+		config.Lease = d
+	}
+	if value := os.Getenv("JOB_TTL"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < time.Minute {
+			return config, fmt.Errorf("invalid JOB_TTL %q, must be at least 1m", value)
+		}
+		config.TTL = d
+	}
+	return config, nil
+}
+
+// waiters wakes up the polls of an agent when a job is queued for it.
+type waiters struct {
+	mu    sync.Mutex
+	chans map[string]chan struct{}
+}
+
+// wait returns a channel that is closed the next time a job is queued for the agent.
+func (w *waiters) wait(agentID string) <-chan struct{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	ch, ok := w.chans[agentID]
+	if !ok {
+		ch = make(chan struct{})
+		w.chans[agentID] = ch
+	}
+	return ch
+}
+
+func (w *waiters) notify(agentID string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if ch, ok := w.chans[agentID]; ok {
+		close(ch)
+		delete(w.chans, agentID)
+	}
+}
+
+// JobService queues work for agents and processes the results they post back.
+type JobService struct {
+	repository        *JobRepository
+	diagnosticService *diagnostic.DiagnosticService
+	agentService      *agent.AgentInfoService
+	config            Config
+	waiters           *waiters
+}
+
+func NewJobService(repository *JobRepository, diagnosticService *diagnostic.DiagnosticService, agentService *agent.AgentInfoService, config Config) *JobService {
+	return &JobService{
+		repository:        repository,
+		diagnosticService: diagnosticService,
+		agentService:      agentService,
+		config:            config,
+		waiters:           &waiters{chans: map[string]chan struct{}{}},
+	}
+}
+
+// Lease returns how long an agent has to post the result of a dispatched job.
+func (s *JobService) Lease() time.Duration {
+	return s.config.Lease
+}
+
+// ownedAgent returns the agent if it belongs to the user.
+func (s *JobService) ownedAgent(ctx context.Context, agentID bson.ObjectID, userID string) (*agent.AgentInfo, error) {
+	agentInfo, err := s.agentService.GetAgentInfoByID(ctx, agentID)
+	if err != nil {
+		return nil, err
+	}
+	if agentInfo == nil {
+		return nil, fmt.Errorf("agent not found")
+	}
+	if agentInfo.UserID != userID {
+		return nil, fmt.Errorf("agent does not belong to user")
+	}
+	if agentInfo.Status == agent.StatusDecommissioned {
+		return nil, fmt.Errorf("agent is decommissioned")
+	}
+	return agentInfo, nil
+}
+
+// CreateJob queues a job for an agent of the user. Diagnostic jobs start a diagnostic session for the
+// issue and queue its first commands.
+func (s *JobService) CreateJob(ctx context.Context, agentID bson.ObjectID, userID string, req *CreateJobRequest) (*Job, error) {
+	if _, err := s.ownedAgent(ctx, agentID, userID); err != nil {
+		return nil, err
+	}
+
+	switch req.Type {
+	case TypeDiagnostic:
+		if req.Issue == "" {
+			return nil, fmt.Errorf("invalid job: issue is required for diagnostic jobs")
+		}
+		session, err := s.diagnosticService.StartDiagnosticSession(ctx, agentID.Hex(), userID, req.Issue)
+		if err != nil {
+			return nil, err
+		}
+		job, err := s.enqueueSession(ctx, session)
+		if err != nil {
+			return nil, err
+		}
+		if job == nil {
+			return nil, fmt.Errorf("diagnosis suggested no commands to run")
+		}
+		return job, nil
+
+	case TypeLogCheck:
+		if len(req.LogChecks) == 0 {
+			return nil, fmt.Errorf("invalid job: log_checks are required for log_check jobs")
+		}
+		for _, check := range req.LogChecks {
+			if check.LogPath == "" {
+				return nil, fmt.Errorf("invalid job: log_path is required")
+			}
+		}
+		job := &Job{UserID: userID, AgentID: agentID.Hex(), Type: TypeLogCheck, LogChecks: req.LogChecks}
+		return job, s.enqueue(ctx, job)
+
+	case TypeMetricsRefresh:
+		job := &Job{UserID: userID, AgentID: agentID.Hex(), Type: TypeMetricsRefresh}
+		return job, s.enqueue(ctx, job)
+	}
+	return nil, fmt.Errorf("invalid job: type must be diagnostic, log_check or metrics_refresh")
+}
+
+// StartDiagnosticSession starts a diagnostic session and queues its first commands for the agent, so
+// sessions started by campaigns and alerts run without the agent having to ask for them.
+func (s *JobService) StartDiagnosticSession(ctx context.Context, agentID string, userID string, issue string) (*diagnostic.DiagnosticSession, error) {
+	session, err := s.diagnosticService.StartDiagnosticSession(ctx, agentID, userID, issue)
+	if err != nil {
+		return session, err
+	}
+	if _, err := s.enqueueSession(ctx, session); err != nil {
+		log.Printf("Failed to queue commands of session %s: %v", session.ID.Hex(), err)
+	}
+	return session, nil
+}
+
+// GetDiagnosticSession retrieves a diagnostic session of the organisation by ID.
+func (s *JobService) GetDiagnosticSession(ctx context.Context, sessionID string, userID string) (*diagnostic.DiagnosticSession, error) {
+	return s.diagnosticService.GetDiagnosticSession(ctx, sessionID, userID)
+}
+
+// enqueueSession queues the commands and log checks of the latest iteration of a session.
+// It returns nil when the iteration has nothing for the agent to run.
+func (s *JobService) enqueueSession(ctx context.Context, session *diagnostic.DiagnosticSession) (*Job, error) {
+	if len(session.History) == 0 {
+		return nil, nil
+	}
+	latest := session.History[len(session.History)-1]
+	if len(latest.Commands) == 0 && len(latest.LogChecks) == 0 {
+		return nil, nil
+	}
+
+	job := &Job{
+		UserID:    session.UserID,
+		AgentID:   session.AgentID,
+		Type:      TypeDiagnostic,
+		SessionID: session.ID.Hex(),
+		Commands:  latest.Commands,
+		LogChecks: latest.LogChecks,
+	}
+	if err := s.enqueue(ctx, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+func (s *JobService) enqueue(ctx context.Context, job *Job) error {
+	job.Status = StatusPending
+	job.CreatedAt = time.Now()
+	job.ExpiresAt = job.CreatedAt.Add(s.config.TTL)
+	if err := s.repository.InsertJob(ctx, job); err != nil {
+		return err
+	}
+	log.Printf("Job queued - Job: %s, Agent: %s, Type: %s", job.ID.Hex(), job.AgentID, job.Type)
+	s.waiters.notify(job.AgentID)
+	return nil
+}
+
+// Poll hands out the deliverable jobs of an agent, waiting up to wait for one to be queued when there
+// are none. It returns an empty list when the wait ends without work.
+func (s *JobService) Poll(ctx context.Context, agentID bson.ObjectID, userID string, wait time.Duration) ([]*Job, error) {
+	if _, err := s.ownedAgent(ctx, agentID, userID); err != nil {
+		return nil, err
+	}
+	id := agentID.Hex()
+	if err := s.repository.ExpireJobs(ctx, id, time.Now(), s.config.Lease, maxAttempts); err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		// Subscribe before looking at the queue so a job queued in between is not missed
+		queued := s.waiters.wait(id)
+
+		jobs, err := s.claim(ctx, id)
+		if err != nil || len(jobs) > 0 {
+			return jobs, err
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return []*Job{}, nil
+		}
+		timer := time.NewTimer(min(remaining, recheckInterval))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return []*Job{}, nil
+		case <-queued:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// claim dispatches up to maxBatch jobs of an agent.
+func (s *JobService) claim(ctx context.Context, agentID string) ([]*Job, error) {
+	var jobs []*Job
+	for len(jobs) < maxBatch {
+		job, err := s.repository.ClaimJob(ctx, agentID, time.Now(), s.config.Lease, maxAttempts)
+		if err != nil {
+			return nil, err
+		}
+		if job == nil {
+			break
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// Resume reconciles the dispatched jobs of an agent that reconnects. Jobs the agent reports it is still
+// running get a fresh lease; the others were lost with the previous connection and are delivered again.
+func (s *JobService) Resume(ctx context.Context, agentID bson.ObjectID, userID string, running []string) error {
+	if _, err := s.ownedAgent(ctx, agentID, userID); err != nil {
+		return err
+	}
+	ids := make([]bson.ObjectID, 0, len(running))
+	for _, hex := range running {
+		id, err := bson.ObjectIDFromHex(hex)
+		if err != nil {
+			return fmt.Errorf("invalid job ID format: %q", hex)
+		}
+		ids = append(ids, id)
+	}
+
+	id := agentID.Hex()
+	if len(ids) > 0 {
+		if err := s.repository.RenewLeases(ctx, id, ids, time.Now()); err != nil {
+			return err
+		}
+	}
+	return s.repository.RequeueJobs(ctx, id, ids)
+}
+
+// AppendOutput records output an agent streams while it runs a dispatched job.
+func (s *JobService) AppendOutput(ctx context.Context, id bson.ObjectID, agentID string, lines []string) error {
+	if len(lines) == 0 {
+		return nil
+	}
+	appended, err := s.repository.AppendOutput(ctx, id, agentID, lines, maxStreamLines)
+	if err != nil {
+		return err
+	}
+	if !appended {
+		return fmt.Errorf("job not found or no longer dispatched")
+	}
+	return nil
+}
+
+// GetJob returns a job of the user.
+func (s *JobService) GetJob(ctx context.Context, id bson.ObjectID, userID string) (*Job, error) {
+	job, err := s.repository.GetJob(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if job == nil {
+		return nil, fmt.Errorf("job not found")
+	}
+	if job.UserID != userID {
+		return nil, fmt.Errorf("job does not belong to user")
+	}
+	return job, nil
+}
+
+// ListJobs returns the jobs of a user, optionally filtered by agent and status.
+func (s *JobService) ListJobs(ctx context.Context, userID, agentID, status string) ([]*Job, error) {
+	if status != "" && !slices.Contains([]string{StatusPending, StatusDispatched, StatusCompleted, StatusFailed, StatusCancelled, StatusExpired}, status) {
+		return nil, fmt.Errorf("invalid job status %q", status)
+	}
+	return s.repository.ListJobs(ctx, userID, agentID, status)
+}
+
+// CancelJob cancels a job of the user that has not finished yet.
+func (s *JobService) CancelJob(ctx context.Context, id bson.ObjectID, userID string) (*Job, error) {
+	job, err := s.GetJob(ctx, id, userID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	cancelled, err := s.repository.CancelJob(ctx, id, now)
+	if err != nil {
+		return nil, err
+	}
+	if !cancelled {
+		return nil, fmt.Errorf("invalid job transition: job is %s", job.Status)
+	}
+	job.Status = StatusCancelled
+	job.CompletedAt = &now
+	return job, nil
+}
+
+// CancelAgentJobs cancels every unfinished job of an agent and returns how many were cancelled.
+func (s *JobService) CancelAgentJobs(ctx context.Context, agentID string) (int64, error) {
+	return s.repository.CancelAgentJobs(ctx, agentID, time.Now())
+}
+
+// DeleteAgentJobs deletes every job of an agent and returns how many were deleted.
+func (s *JobService) DeleteAgentJobs(ctx context.Context, agentID string) (int64, error) {
+	return s.repository.DeleteAgentJobs(ctx, agentID)
+}
+
+// ReassignAgentJobs moves every job of an agent to another agent and returns how many were moved.
+// Unfinished jobs are delivered to the other agent.
+func (s *JobService) ReassignAgentJobs(ctx context.Context, fromAgentID, toAgentID string) (int64, error) {
+	return s.repository.ReassignAgentJobs(ctx, fromAgentID, toAgentID)
+}
+
+// CompleteJob records the result an agent posted for a dispatched job. The output of diagnostic jobs
+// continues their session and queues the next iteration; metrics_refresh results update the agent.
+func (s *JobService) CompleteJob(ctx context.Context, id bson.ObjectID, userID string, result *Result) (*Job, error) {
+	job, err := s.GetJob(ctx, id, userID)
+	if err != nil {
+		return nil, err
+	}
+	if job.Status != StatusDispatched {
+		return nil, fmt.Errorf("invalid job transition: job is %s", job.Status)
+	}
+
+	status := StatusCompleted
+	if result.Error != "" {
+		status = StatusFailed
+	} else if job.Type == TypeMetricsRefresh {
+		if result.SystemMetrics == nil {
+			return nil, fmt.Errorf("invalid job result: system_metrics is required for metrics_refresh jobs")
+		}
+		if err := result.SystemMetrics.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now()
+	finished, err := s.repository.FinishJob(ctx, id, status, result, now)
+	if err != nil {
+		return nil, err
+	}
+	if !finished {
+		return nil, fmt.Errorf("invalid job transition: job is no longer dispatched")
+	}
+	job.Status = status
+	job.Result = result
+	job.CompletedAt = &now
+	log.Printf("Job finished - Job: %s, Agent: %s, Status: %s", id.Hex(), job.AgentID, status)
+
+	if status != StatusCompleted {
+		return job, nil
+	}
+	switch job.Type {
+	case TypeDiagnostic:
+		if err := s.continueSession(ctx, job, result.Output); err != nil {
+			return job, err
+		}
+	case TypeMetricsRefresh:
+		if err := s.refreshMetrics(ctx, job, *result.SystemMetrics); err != nil {
+			return job, err
+		}
+	}
+	return job, nil
+}
+
+// continueSession feeds the output of a diagnostic job into its session and queues the next iteration.
+func (s *JobService) continueSession(ctx context.Context, job *Job, output []string) error {
+	session, err := s.diagnosticService.ContinueDiagnosticSession(ctx, job.SessionID, job.UserID, output)
+	if err != nil {
+		return fmt.Errorf("failed to continue diagnostic session: %v", err)
+	}
+	if session.Status != "in_progress" {
+		return nil
+	}
+	if _, err := s.enqueueSession(ctx, session); err != nil {
+		return fmt.Errorf("failed to queue next iteration: %v", err)
+	}
+	return nil
+}
+
+// refreshMetrics saves the metrics of a metrics_refresh job on the agent, as if the agent had posted them.
+func (s *JobService) refreshMetrics(ctx context.Context, job *Job, metrics agent.SystemMetrics) error {
+	agentID, err := bson.ObjectIDFromHex(job.AgentID)
+	if err != nil {
+		return fmt.Errorf("invalid agent ID format")
+	}
+	agentInfo, err := s.ownedAgent(ctx, agentID, job.UserID)
+	if err != nil {
+		return err
+	}
+	agentInfo.SystemMetrics = metrics
+	if _, err := s.agentService.SaveAgentInfo(ctx, *agentInfo); err != nil {
+		return fmt.Errorf("failed to save refreshed metrics: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package job
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Run("Defaults", func(t *testing.T) {
+		t.Setenv("JOB_LEASE", "")
+		t.Setenv("JOB_TTL", "")
+		config, err := ConfigFromEnv()
+		assert.NoError(t, err)
+		assert.Equal(t, DefaultConfig(), config)
+	})
+
+	t.Run("Overrides", func(t *testing.T) {
+		t.Setenv("JOB_LEASE", "30s")
+		t.Setenv("JOB_TTL", "24h")
+		config, err := ConfigFromEnv()
+		assert.NoError(t, err)
+		assert.Equal(t, 30*time.Second, config.Lease)
+		assert.Equal(t, 24*time.Hour, config.TTL)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		for name, value := range map[string]string{
+			"JOB_LEASE": "500ms",
+			"JOB_TTL":   "later",
+		} {
+			t.Run(name, func(t *testing.T) {
+				t.Setenv(name, value)
+				_, err := ConfigFromEnv()
+				assert.Error(t, err)
+			})
+		}
+	})
+}
+
+func TestWaiters(t *testing.T) {
+	w := &waiters{chans: map[string]chan struct{}{}}
+
+	// Notifying an agent nobody waits for is a no-op
+	w.notify("agent-1")
+
+	first := w.wait("agent-1")
+	assert.Equal(t, first, w.wait("agent-1"))
+	other := w.wait("agent-2")
+
+	w.notify("agent-1")
+	select {
+	case <-first:
+	default:
+		t.Fatal("waiter of agent-1 was not woken up")
+	}
+	select {
+	case <-other:
+		t.Fatal("waiter of agent-2 was woken up")
+	default:
+	}
+
+	// Later waits get a fresh channel
+	assert.NotEqual(t, first, w.wait("agent-1"))
+}
@@ -0,0 +1,18 @@
+package merge
+
+// Request folds duplicate agents into the agent of the endpoint.
+type Request struct {
+	AgentIDs []string `json:"agent_ids"` // Duplicates to merge and delete
+}
+
+// Report tells what merging duplicate agents moved into the remaining agent.
+type Report struct {
+	AgentID             string   `json:"agent_id"`
+	MergedAgentIDs      []string `json:"merged_agent_ids"`
+	SessionsMoved       int64    `json:"sessions_moved"`
+	JobsMoved           int64    `json:"jobs_moved"`
+	MetricSamplesMoved  int64    `json:"metric_samples_moved"`
+	AlertsMoved         int64    `json:"alerts_moved"`
+	CredentialsMoved    int64    `json:"credentials_moved"`
+	CertificatesRevoked int64    `json:"certificates_revoked"` // Certificates name their agent, so they cannot be moved
+}
@@ -0,0 +1,206 @@
+package merge
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+
+	"github.com/harshavmb/nannyapi/internal/agent"
+)
+
+// maxDuplicates limits how many agents one request merges.
+const maxDuplicates = 50
+
+// AgentStore looks up and updates the agents being merged.
+type AgentStore interface {
+	GetAgentInfoByID(ctx context.Context, id bson.ObjectID) (*agent.AgentInfo, error)
+	SetLabels(ctx context.Context, id bson.ObjectID, userID string, labels map[string]string) (*agent.AgentInfo, error)
+	SetMachineID(ctx context.Context, id bson.ObjectID, machineID string) error
+	DeleteAgentInfo(ctx context.Context, id bson.ObjectID) error
+}
+
+// CredentialStore moves the credentials of an agent.
+type CredentialStore interface {
+	ReassignAgentCredentials(ctx context.Context, fromAgentID, toAgentID string) (int64, error)
+}
+
+// CertificateRevoker revokes the client certificates of an agent.
+type CertificateRevoker interface {
+	RevokeAgentCertificates(ctx context.Context, agentID string) (int64, error)
+}
+
+// JobStore moves the jobs of an agent.
+type JobStore interface {
+	ReassignAgentJobs(ctx context.Context, fromAgentID, toAgentID string) (int64, error)
+}
+
+// SessionStore moves the diagnostic sessions of an agent.
+type SessionStore interface {
+	ReassignAgentSessions(ctx context.Context, fromAgentID, toAgentID string) (int64, error)
+}
+
+// MetricsStore moves the metric history of an agent.
+type MetricsStore interface {
+	ReassignHistory(ctx context.Context, fromAgentID, toAgentID string) (int64, error)
+}
+
+// AlertStore moves the alerts of an agent.
+type AlertStore interface {
+	ReassignAgentAlerts(ctx context.Context, fromAgentID, toAgentID string) (int64, error)
+}
+
+// MergeService folds duplicate records of the same machine into one agent.
+type MergeService struct {
+	agents       AgentStore
+	credentials  CredentialStore
+	certificates CertificateRevoker
+	jobs         JobStore
+	sessions     SessionStore
+	metrics      MetricsStore
+	alerts       AlertStore
+}
+
+func NewMergeService(agents AgentStore, credentials CredentialStore, certificates CertificateRevoker, jobs JobStore, sessions SessionStore, metrics MetricsStore, alerts AlertStore) *MergeService {
+	return &MergeService{
+		agents:       agents,
+		credentials:  credentials,
+		certificates: certificates,
+		jobs:         jobs,
+		sessions:     sessions,
+		metrics:      metrics,
+		alerts:       alerts,
+	}
+}
+
+// Merge moves the sessions, jobs, metric history, alerts and credentials of duplicate agents of the user
+// into the target agent and deletes the duplicates. The target keeps its own info; labels and the machine
+// ID it lacks are taken from the duplicates. Certificates of the duplicates are revoked.
+func (s *MergeService) Merge(ctx context.Context, targetID bson.ObjectID, userID string, req *Request) (*Report, error) {
+	if len(req.AgentIDs) == 0 {
+		return nil, fmt.Errorf("invalid merge: agent_ids is required")
+	}
+	if len(req.AgentIDs) > maxDuplicates {
+		return nil, fmt.Errorf("invalid merge: at most %d agents can be merged at once", maxDuplicates)
+	}
+
+	target, err := s.ownedAgent(ctx, targetID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if target.Status == agent.StatusDecommissioned {
+		return nil, fmt.Errorf("invalid merge: agent %s is decommissioned", targetID.Hex())
+	}
+
+	// Check every duplicate before changing anything
+	duplicates := make([]*agent.AgentInfo, 0, len(req.AgentIDs))
+	seen := map[bson.ObjectID]bool{}
+	for _, agentID := range req.AgentIDs {
+		id, err := bson.ObjectIDFromHex(agentID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid merge: agent ID %q is malformed", agentID)
+		}
+		if id == targetID {
+			return nil, fmt.Errorf("invalid merge: agent %s cannot be merged into itself", agentID)
+		}
+		if seen[id] {
+			return nil, fmt.Errorf("invalid merge: agent %s is listed twice", agentID)
+		}
+		seen[id] = true
+		duplicate, err := s.ownedAgent(ctx, id, userID)
+		if err != nil {
+			return nil, err
+		}
+		duplicates = append(duplicates, duplicate)
+	}
+
+	labels, machineID := mergedIdentity(target, duplicates)
+	if !maps.Equal(labels, target.Labels) {
+		if _, err := s.agents.SetLabels(ctx, targetID, userID, labels); err != nil {
+			return nil, err
+		}
+	}
+	if machineID != target.MachineID {
+		if err := s.agents.SetMachineID(ctx, targetID, machineID); err != nil {
+			return nil, err
+		}
+	}
+
+	report := &Report{AgentID: targetID.Hex(), MergedAgentIDs: []string{}}
+	for _, duplicate := range duplicates {
+		if err := s.fold(ctx, duplicate, report); err != nil {
+			return nil, fmt.Errorf("failed to merge agent %s: %v", duplicate.ID.Hex(), err)
+		}
+		report.MergedAgentIDs = append(report.MergedAgentIDs, duplicate.ID.Hex())
+	}
+
+	log.Printf("Agents merged into %s by user %s: %+v", targetID.Hex(), userID, *report)
+	return report, nil
+}
+
+// ownedAgent returns the agent if it belongs to the user.
+func (s *MergeService) ownedAgent(ctx context.Context, id bson.ObjectID, userID string) (*agent.AgentInfo, error) {
+	agentInfo, err := s.agents.GetAgentInfoByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if agentInfo == nil {
+		return nil, fmt.Errorf("agent %s not found", id.Hex())
+	}
+	if agentInfo.UserID != userID {
+		return nil, fmt.Errorf("agent %s does not belong to user", id.Hex())
+	}
+	return agentInfo, nil
+}
+
+// mergedIdentity returns the labels and machine ID of the target after the merge: its own, completed with
+// the ones of the duplicates it lacks, in the order the duplicates were given.
+func mergedIdentity(target *agent.AgentInfo, duplicates []*agent.AgentInfo) (map[string]string, string) {
+	labels := maps.Clone(target.Labels)
+	machineID := target.MachineID
+	for _, duplicate := range duplicates {
+		for key, value := range duplicate.Labels {
+			if _, ok := labels[key]; !ok {
+				if labels == nil {
+					labels = map[string]string{}
+				}
+				labels[key] = value
+			}
+		}
+		if machineID == "" {
+			machineID = duplicate.MachineID
+		}
+	}
+	return labels, machineID
+}
+
+// fold moves everything attached to a duplicate to the target of the report, then deletes the duplicate.
+// Each step is idempotent, so a failed merge can be retried.
+func (s *MergeService) fold(ctx context.Context, duplicate *agent.AgentInfo, report *Report) error {
+	from, to := duplicate.ID.Hex(), report.AgentID
+	for _, step := range []struct {
+		move  func(ctx context.Context, fromAgentID, toAgentID string) (int64, error)
+		count *int64
+	}{
+		{s.sessions.ReassignAgentSessions, &report.SessionsMoved},
+		{s.jobs.ReassignAgentJobs, &report.JobsMoved},
+		{s.metrics.ReassignHistory, &report.MetricSamplesMoved},
+		{s.alerts.ReassignAgentAlerts, &report.AlertsMoved},
+		{s.credentials.ReassignAgentCredentials, &report.CredentialsMoved},
+	} {
+		moved, err := step.move(ctx, from, to)
+		if err != nil {
+			return err
+		}
+		*step.count += moved
+	}
+
+	revoked, err := s.certificates.RevokeAgentCertificates(ctx, from)
+	if err != nil {
+		return err
+	}
+	report.CertificatesRevoked += revoked
+	return s.agents.DeleteAgentInfo(ctx, duplicate.ID)
+}
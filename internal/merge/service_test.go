@@ -0,0 +1,153 @@
+package merge
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/v2/bson"
+
+	"github.com/harshavmb/nannyapi/internal/agent"
+)
+
+// fakeStore keeps agents in memory and the number of records of each kind attached to each agent.
+type fakeStore struct {
+	agents       map[bson.ObjectID]*agent.AgentInfo
+	records      map[string]map[string]int64 // Kind, then agent ID
+	certificates map[string]int64
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{
+		agents:       map[bson.ObjectID]*agent.AgentInfo{},
+		records:      map[string]map[string]int64{"sessions": {}, "jobs": {}, "samples": {}, "alerts": {}, "credentials": {}},
+		certificates: map[string]int64{},
+	}
+}
+
+func (f *fakeStore) add(info *agent.AgentInfo, records int64) bson.ObjectID {
+	info.ID = bson.NewObjectID()
+	f.agents[info.ID] = info
+	for _, counts := range f.records {
+		counts[info.ID.Hex()] = records
+	}
+	f.certificates[info.ID.Hex()] = 1
+	return info.ID
+}
+
+func (f *fakeStore) move(kind, from, to string) (int64, error) {
+	moved := f.records[kind][from]
+	f.records[kind][to] += moved
+	delete(f.records[kind], from)
+	return moved, nil
+}
+
+func (f *fakeStore) GetAgentInfoByID(ctx context.Context, id bson.ObjectID) (*agent.AgentInfo, error) {
+	return f.agents[id], nil
+}
+
+func (f *fakeStore) SetLabels(ctx context.Context, id bson.ObjectID, userID string, labels map[string]string) (*agent.AgentInfo, error) {
+	f.agents[id].Labels = labels
+	return f.agents[id], nil
+}
+
+func (f *fakeStore) SetMachineID(ctx context.Context, id bson.ObjectID, machineID string) error {
+	f.agents[id].MachineID = machineID
+	return nil
+}
+
+func (f *fakeStore) DeleteAgentInfo(ctx context.Context, id bson.ObjectID) error {
+	delete(f.agents, id)
+	return nil
+}
+
+func (f *fakeStore) ReassignAgentCredentials(ctx context.Context, from, to string) (int64, error) {
+	return f.move("credentials", from, to)
+}
+
+func (f *fakeStore) ReassignAgentJobs(ctx context.Context, from, to string) (int64, error) {
+	return f.move("jobs", from, to)
+}
+
+func (f *fakeStore) ReassignAgentSessions(ctx context.Context, from, to string) (int64, error) {
+	return f.move("sessions", from, to)
+}
+
+func (f *fakeStore) ReassignHistory(ctx context.Context, from, to string) (int64, error) {
+	return f.move("samples", from, to)
+}
+
+func (f *fakeStore) ReassignAgentAlerts(ctx context.Context, from, to string) (int64, error) {
+	return f.move("alerts", from, to)
+}
+
+func (f *fakeStore) RevokeAgentCertificates(ctx context.Context, agentID string) (int64, error) {
+	revoked := f.certificates[agentID]
+	delete(f.certificates, agentID)
+	return revoked, nil
+}
+
+func newTestService(store *fakeStore) *MergeService {
+	return NewMergeService(store, store, store, store, store, store, store)
+}
+
+func TestMerge(t *testing.T) {
+	store := newFakeStore()
+	target := store.add(&agent.AgentInfo{UserID: "user-1", Hostname: "web-1", Labels: map[string]string{"env": "prod"}}, 1)
+	first := store.add(&agent.AgentInfo{UserID: "user-1", Hostname: "web-1", MachineID: "b08dfa6083e7567a", Labels: map[string]string{"env": "dev", "role": "web"}}, 2)
+	second := store.add(&agent.AgentInfo{UserID: "user-1", Hostname: "web-1", Status: agent.StatusDecommissioned}, 3)
+
+	report, err := newTestService(store).Merge(context.Background(), target, "user-1", &Request{AgentIDs: []string{first.Hex(), second.Hex()}})
+	assert.NoError(t, err)
+	assert.Equal(t, &Report{
+		AgentID:             target.Hex(),
+		MergedAgentIDs:      []string{first.Hex(), second.Hex()},
+		SessionsMoved:       5,
+		JobsMoved:           5,
+		MetricSamplesMoved:  5,
+		AlertsMoved:         5,
+		CredentialsMoved:    5,
+		CertificatesRevoked: 2,
+	}, report)
+
+	assert.Len(t, store.agents, 1)
+	assert.Equal(t, map[string]string{"env": "prod", "role": "web"}, store.agents[target].Labels)
+	assert.Equal(t, "b08dfa6083e7567a", store.agents[target].MachineID)
+	for kind, counts := range store.records {
+		assert.Equal(t, map[string]int64{target.Hex(): 6}, counts, kind)
+	}
+	assert.Equal(t, map[string]int64{target.Hex(): 1}, store.certificates)
+}
+
+func TestMergeErrors(t *testing.T) {
+	store := newFakeStore()
+	target := store.add(&agent.AgentInfo{UserID: "user-1"}, 1)
+	duplicate := store.add(&agent.AgentInfo{UserID: "user-1"}, 1)
+	other := store.add(&agent.AgentInfo{UserID: "user-2"}, 1)
+	retired := store.add(&agent.AgentInfo{UserID: "user-1", Status: agent.StatusDecommissioned}, 1)
+	s := newTestService(store)
+
+	for name, tc := range map[string]struct {
+		target   bson.ObjectID
+		agentIDs []string
+		err      string
+	}{
+		"NoAgents":             {target, nil, "agent_ids is required"},
+		"MalformedID":          {target, []string{"nope"}, "is malformed"},
+		"Itself":               {target, []string{target.Hex()}, "cannot be merged into itself"},
+		"Twice":                {target, []string{duplicate.Hex(), duplicate.Hex()}, "is listed twice"},
+		"UnknownTarget":        {bson.NewObjectID(), []string{duplicate.Hex()}, "not found"},
+		"UnknownDuplicate":     {target, []string{bson.NewObjectID().Hex()}, "not found"},
+		"OtherUser":            {target, []string{duplicate.Hex(), other.Hex()}, "does not belong to user"},
+		"DecommissionedTarget": {retired, []string{duplicate.Hex()}, "is decommissioned"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := s.Merge(context.Background(), tc.target, "user-1", &Request{AgentIDs: tc.agentIDs})
+			assert.ErrorContains(t, err, tc.err)
+		})
+	}
+
+	// Nothing was changed by the failed merges
+	assert.Len(t, store.agents, 4)
+	assert.Equal(t, int64(1), store.records["sessions"][duplicate.Hex()])
+}
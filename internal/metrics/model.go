@@ -0,0 +1,65 @@
+package metrics
+
+import (
+	"time"
+)
+
+// Aggregations supported when downsampling a series.
+const (
+	AggregationAvg = "avg"
+	AggregationMax = "max"
+)
+
+// SampleMeta identifies the agent a sample belongs to. It is the meta field of the time-series collection.
+type SampleMeta struct {
+	AgentID string `json:"agent_id" bson:"agent_id"`
+	UserID  string `json:"user_id" bson:"user_id"` // Owning organisation, which is the user ID for personal organisations
+}
+
+// Sample is a single metrics report of an agent.
+type Sample struct {
+	Timestamp   time.Time         `json:"timestamp" bson:"timestamp"`
+	Meta        SampleMeta        `json:"meta" bson:"meta"`
+	CPUUsage    float64           `json:"cpu_usage" bson:"cpu_usage"`
+	MemoryTotal int64             `json:"memory_total" bson:"memory_total"`
+	MemoryUsed  int64             `json:"memory_used" bson:"memory_used"`
+	MemoryFree  int64             `json:"memory_free" bson:"memory_free"`
+	DiskUsage   map[string]int64  `json:"disk_usage" bson:"disk_usage"`
+	FSUsage     map[string]string `json:"fs_usage" bson:"fs_usage"`
+}
+
+// Series of the buckets that MongoDB downsamples samples into.
+const (
+	seriesCPU    = "cpu"
+	seriesMemory = "memory"
+	seriesDisk   = "disk"
+	seriesFS     = "fs"
+)
+
+// Bucket holds the average and maximum of one series of an agent over one bucket.
+type Bucket struct {
+	Series string  `bson:"series"`
+	Key    string  `bson:"key"`   // Mount point of disk and filesystem series
+	Index  int64   `bson:"index"` // Number of buckets between the start of the range and this one
+	Avg    float64 `bson:"avg"`
+	Max    float64 `bson:"max"`
+}
+
+// Point is one downsampled value of a series, timestamped with the start of its bucket.
+type Point struct {
+	Time  time.Time `json:"t"`
+	Value float64   `json:"v"`
+}
+
+// Series holds the downsampled metrics of an agent over a time range.
+type Series struct {
+	AgentID        string             `json:"agent_id"`
+	From           time.Time          `json:"from"`
+	To             time.Time          `json:"to"`
+	BucketSeconds  int64              `json:"bucket_seconds"`
+	Aggregation    string             `json:"aggregation"`
+	CPUUsage       []Point            `json:"cpu_usage"`           // CPU usage percentage
+	MemoryUsedPct  []Point            `json:"memory_used_percent"` // Used memory as a percentage of total memory
+	DiskUsage      map[string][]Point `json:"disk_usage"`          // Disk usage per mount point in bytes
+	FSUsagePercent map[string][]Point `json:"fs_usage_percent"`    // Filesystem usage percentage per mount point
+}
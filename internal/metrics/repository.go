@@ -0,0 +1,184 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const metricsCollection = "agent_metrics"
+
+type MetricsRepository struct {
+	db         *mongo.Database
+	collection *mongo.Collection
+}
+
+func NewMetricsRepository(db *mongo.Database) *MetricsRepository {
+	return &MetricsRepository{
+		db:         db,
+		collection: db.Collection(metricsCollection),
+	}
+}
+
+// EnsureCollection creates the time-series collection if needed and applies the retention period.
+func (r *MetricsRepository) EnsureCollection(ctx context.Context, retention time.Duration) error {
+	names, err := r.db.ListCollectionNames(ctx, bson.M{"name": metricsCollection})
+	if err != nil {
+		return fmt.Errorf("failed to list collections: %v", err)
+	}
+
+	expireAfter := int64(retention.Seconds())
+	if len(names) == 0 {
+		tsOpts := options.TimeSeries().
+			SetTimeField("timestamp").
+			SetMetaField("meta").
+			SetGranularity("minutes")
+		opts := options.CreateCollection().
+			SetTimeSeriesOptions(tsOpts).
+			SetExpireAfterSeconds(expireAfter)
+		if err := r.db.CreateCollection(ctx, metricsCollection, opts); err != nil {
+			return fmt.Errorf("failed to create metrics collection: %v", err)
+		}
+		log.Printf("Created time-series collection %s with retention %s", metricsCollection, retention)
+		return nil
+	}
+
+	// Keep the retention in sync with the configuration
+	cmd := bson.D{{Key: "collMod", Value: metricsCollection}, {Key: "expireAfterSeconds", Value: expireAfter}}
+	if err := r.db.RunCommand(ctx, cmd).Err(); err != nil {
+		return fmt.Errorf("failed to update metrics retention: %v", err)
+	}
+	return nil
+}
+
+func (r *MetricsRepository) InsertSample(ctx context.Context, sample *Sample) error {
+	if _, err := r.collection.InsertOne(ctx, sample); err != nil {
+		return fmt.Errorf("failed to insert metrics sample: %v", err)
+	}
+	return nil
+}
+
+// DeleteSamples deletes the samples of an agent and returns how many were deleted.
+func (r *MetricsRepository) DeleteSamples(ctx context.Context, agentID string) (int64, error) {
+	result, err := r.collection.DeleteMany(ctx, bson.M{"meta.agent_id": agentID})
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete metrics samples: %v", err)
+	}
+	return result.DeletedCount, nil
+}
+
+// ReassignSamples moves the samples of an agent to another agent and returns how many were moved. Only
+// the meta field is changed, which time-series collections allow.
+func (r *MetricsRepository) ReassignSamples(ctx context.Context, fromAgentID, toAgentID string) (int64, error) {
+	result, err := r.collection.UpdateMany(ctx, bson.M{"meta.agent_id": fromAgentID}, bson.M{"$set": bson.M{"meta.agent_id": toAgentID}})
+	if err != nil {
+		return 0, fmt.Errorf("failed to reassign metrics samples: %v", err)
+	}
+	return result.ModifiedCount, nil
+}
+
+// AggregateSamples downsamples the samples of an agent in [from, to) into buckets of the given size
+// starting at from, so only the buckets leave the database. Memory is aggregated as a percentage of the
+// total memory and unparsable filesystem usage is skipped. Buckets are ordered by series, key and time,
+// and empty buckets are left out.
+func (r *MetricsRepository) AggregateSamples(ctx context.Context, agentID string, from, to time.Time, bucket time.Duration) ([]Bucket, error) {
+	// Each sample is unwound into one value per series
+	memory := bson.M{"$cond": bson.M{
+		"if": bson.M{"$gt": bson.A{"$memory_total", 0}},
+		"then": bson.A{bson.M{
+			"series": seriesMemory,
+			"key":    "",
+			"value":  bson.M{"$multiply": bson.A{bson.M{"$divide": bson.A{"$memory_used", "$memory_total"}}, 100}},
+		}},
+		"else": bson.A{},
+	}}
+	disk := bson.M{"$map": bson.M{
+		"input": bson.M{"$ifNull": bson.A{bson.M{"$objectToArray": "$disk_usage"}, bson.A{}}},
+		"as":    "usage",
+		"in":    bson.M{"series": seriesDisk, "key": "$$usage.k", "value": bson.M{"$toDouble": "$$usage.v"}},
+	}}
+	// Filesystem usage is stored as text such as "45%", see ParsePercent
+	fs := bson.M{"$map": bson.M{
+		"input": bson.M{"$ifNull": bson.A{bson.M{"$objectToArray": "$fs_usage"}, bson.A{}}},
+		"as":    "usage",
+		"in": bson.M{"series": seriesFS, "key": "$$usage.k", "value": bson.M{"$convert": bson.M{
+			"input":   bson.M{"$rtrim": bson.M{"input": bson.M{"$trim": bson.M{"input": "$$usage.v"}}, "chars": "%"}},
+			"to":      "double",
+			"onError": nil,
+			"onNull":  nil,
+		}}},
+	}}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"meta.agent_id": agentID,
+			"timestamp":     bson.M{"$gte": from, "$lt": to},
+		}}},
+		{{Key: "$project", Value: bson.M{
+			"_id": 0,
+			"index": bson.M{"$toLong": bson.M{"$floor": bson.M{
+				"$divide": bson.A{bson.M{"$subtract": bson.A{"$timestamp", from}}, bucket.Milliseconds()},
+			}}},
+			"values": bson.M{"$concatArrays": bson.A{
+				bson.A{bson.M{"series": seriesCPU, "key": "", "value": "$cpu_usage"}},
+				memory,
+				disk,
+				fs,
+			}},
+		}}},
+		{{Key: "$unwind", Value: "$values"}},
+		{{Key: "$match", Value: bson.M{"values.value": bson.M{"$ne": nil}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id": bson.M{"series": "$values.series", "key": "$values.key", "index": "$index"},
+			"avg": bson.M{"$avg": "$values.value"},
+			"max": bson.M{"$max": "$values.value"},
+		}}},
+		{{Key: "$project", Value: bson.M{
+			"_id":    0,
+			"series": "$_id.series",
+			"key":    "$_id.key",
+			"index":  "$_id.index",
+			"avg":    1,
+			"max":    1,
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "series", Value: 1}, {Key: "key", Value: 1}, {Key: "index", Value: 1}}}},
+	}
+
+	cursor, err := r.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("failed to aggregate metrics samples: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	var buckets []Bucket
+	if err := cursor.All(ctx, &buckets); err != nil {
+		return nil, fmt.Errorf("failed to decode metrics buckets: %v", err)
+	}
+	return buckets, nil
+}
+
+// GetSamples returns the samples of an agent in [from, to) ordered by time.
+func (r *MetricsRepository) GetSamples(ctx context.Context, agentID string, from, to time.Time) ([]Sample, error) {
+	filter := bson.M{
+		"meta.agent_id": agentID,
+		"timestamp":     bson.M{"$gte": from, "$lt": to},
+	}
+	opts := options.Find().SetSort(bson.M{"timestamp": 1})
+
+	cursor, err := r.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query metrics samples: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	var samples []Sample
+	if err := cursor.All(ctx, &samples); err != nil {
+		return nil, fmt.Errorf("failed to decode metrics samples: %v", err)
+	}
+	return samples, nil
+}
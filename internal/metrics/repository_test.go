@@ -0,0 +1,103 @@
+package metrics
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const testDBName = "test_db"
+
+func setupTestDB(t *testing.T) (*mongo.Client, func()) {
+	mongoURI := os.Getenv("MONGODB_URI")
+	clientOptions := options.Client().ApplyURI(mongoURI)
+	client, err := mongo.Connect(clientOptions)
+	if err != nil {
+		t.Fatalf("Failed to connect to MongoDB: %v", err)
+	}
+
+	// Cleanup function to drop the test collection after tests
+	cleanup := func() {
+		err := client.Database(testDBName).Collection(metricsCollection).Drop(context.Background())
+		if err != nil {
+			t.Fatalf("Failed to drop test collection: %v", err)
+		}
+		err = client.Disconnect(context.Background())
+		if err != nil {
+			t.Fatalf("Failed to disconnect from MongoDB: %v", err)
+		}
+	}
+
+	return client, cleanup
+}
+
+func TestGetSeries(t *testing.T) {
+	client, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	repository := NewMetricsRepository(client.Database(testDBName))
+	service := NewMetricsService(repository)
+
+	from := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	for _, sample := range testSamples(from) {
+		sample.Meta = SampleMeta{AgentID: "agent", UserID: "user"}
+		assert.NoError(t, repository.InsertSample(context.Background(), &sample))
+	}
+	// Samples of other agents and outside of the range are left out
+	assert.NoError(t, repository.InsertSample(context.Background(), &Sample{Timestamp: from.Add(time.Minute), Meta: SampleMeta{AgentID: "other-agent"}, CPUUsage: 100}))
+	assert.NoError(t, repository.InsertSample(context.Background(), &Sample{Timestamp: from.Add(-time.Minute), Meta: SampleMeta{AgentID: "agent"}, CPUUsage: 100}))
+
+	to := from.Add(time.Hour)
+
+	t.Run("Average", func(t *testing.T) {
+		series, err := service.GetSeries(context.Background(), "agent", from, to, time.Minute, AggregationAvg)
+		assert.NoError(t, err)
+
+		assert.Equal(t, []Point{
+			{Time: from, Value: 20},
+			{Time: from.Add(2 * time.Minute), Value: 80},
+		}, series.CPUUsage)
+		assert.Equal(t, []Point{
+			{Time: from, Value: 30},
+			{Time: from.Add(2 * time.Minute), Value: 90},
+		}, series.MemoryUsedPct)
+		assert.Equal(t, []Point{
+			{Time: from, Value: 200},
+			{Time: from.Add(2 * time.Minute), Value: 500},
+		}, series.DiskUsage["/"])
+		// Unparsable filesystem usage is skipped
+		assert.Equal(t, []Point{{Time: from, Value: 45}}, series.FSUsagePercent["/"])
+	})
+
+	t.Run("Max", func(t *testing.T) {
+		series, err := service.GetSeries(context.Background(), "agent", from, to, time.Minute, AggregationMax)
+		assert.NoError(t, err)
+
+		assert.Equal(t, []Point{
+			{Time: from, Value: 30},
+			{Time: from.Add(2 * time.Minute), Value: 80},
+		}, series.CPUUsage)
+		assert.Equal(t, []Point{{Time: from, Value: 50}}, series.FSUsagePercent["/"])
+	})
+
+	t.Run("SingleBucket", func(t *testing.T) {
+		series, err := service.GetSeries(context.Background(), "agent", from, to, time.Hour, AggregationAvg)
+		assert.NoError(t, err)
+
+		assert.Len(t, series.CPUUsage, 1)
+		assert.Equal(t, 40.0, series.CPUUsage[0].Value)
+	})
+
+	t.Run("NoSamples", func(t *testing.T) {
+		series, err := service.GetSeries(context.Background(), "unknown-agent", from, to, time.Minute, AggregationAvg)
+		assert.NoError(t, err)
+
+		assert.Empty(t, series.CPUUsage)
+		assert.Empty(t, series.DiskUsage)
+	})
+}
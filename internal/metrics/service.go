@@ -0,0 +1,239 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/harshavmb/nannyapi/internal/agent"
+)
+
+const (
+	defaultRetention = 30 * 24 * time.Hour
+	// maxPoints caps the number of buckets a single query may return.
+	maxPoints = 1440
+)
+
+// MetricsService stores the metric history of agents and serves downsampled series.
+type MetricsService struct {
+	repository *MetricsRepository
+}
+
+// NewMetricsService creates a new metrics service.
+func NewMetricsService(repository *MetricsRepository) *MetricsService {
+	return &MetricsService{
+		repository: repository,
+	}
+}
+
+// RetentionFromEnv reads METRICS_RETENTION, defaulting to 30 days.
+func RetentionFromEnv() (time.Duration, error) {
+	value := os.Getenv("METRICS_RETENTION")
+	if value == "" {
+		return defaultRetention, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < time.Hour {
+		return 0, fmt.Errorf("invalid METRICS_RETENTION %q, must be a duration of at least 1h", value)
+	}
+	return d, nil
+}
+
+// RecordSample appends the current metrics of the agent to its history.
+func (s *MetricsService) RecordSample(ctx context.Context, info *agent.AgentInfo) error {
+	sample := &Sample{
+		Timestamp: info.UpdatedAt,
+		Meta: SampleMeta{
+			AgentID: info.ID.Hex(),
+			UserID:  info.UserID,
+		},
+		CPUUsage:    info.SystemMetrics.CPUUsage,
+		MemoryTotal: info.SystemMetrics.MemoryTotal,
+		MemoryUsed:  info.SystemMetrics.MemoryUsed,
+		MemoryFree:  info.SystemMetrics.MemoryFree,
+		DiskUsage:   info.SystemMetrics.DiskUsage,
+		FSUsage:     info.SystemMetrics.FSUsage,
+	}
+	if sample.Timestamp.IsZero() {
+		sample.Timestamp = time.Now()
+	}
+	return s.repository.InsertSample(ctx, sample)
+}
+
+// DeleteHistory deletes the metric history of an agent and returns how many samples were deleted.
+func (s *MetricsService) DeleteHistory(ctx context.Context, agentID string) (int64, error) {
+	return s.repository.DeleteSamples(ctx, agentID)
+}
+
+// ReassignHistory moves the metric history of an agent to another agent and returns how many samples
+// were moved.
+func (s *MetricsService) ReassignHistory(ctx context.Context, fromAgentID, toAgentID string) (int64, error) {
+	return s.repository.ReassignSamples(ctx, fromAgentID, toAgentID)
+}
+
+// GetSeries returns the metrics of an agent over [from, to) downsampled into buckets by MongoDB.
+func (s *MetricsService) GetSeries(ctx context.Context, agentID string, from, to time.Time, bucket time.Duration, aggregation string) (*Series, error) {
+	if !to.After(from) {
+		return nil, fmt.Errorf("invalid time range: from must be before to")
+	}
+	if bucket < time.Second {
+		return nil, fmt.Errorf("invalid bucket size: must be at least 1s")
+	}
+	if to.Sub(from)/bucket > maxPoints {
+		return nil, fmt.Errorf("invalid bucket size: range would produce more than %d points", maxPoints)
+	}
+	if aggregation != AggregationAvg && aggregation != AggregationMax {
+		return nil, fmt.Errorf("invalid aggregation %q, must be avg or max", aggregation)
+	}
+
+	buckets, err := s.repository.AggregateSamples(ctx, agentID, from, to, bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	series := seriesFromBuckets(buckets, from, bucket, aggregation)
+	series.AgentID = agentID
+	series.To = to
+	return series, nil
+}
+
+// TrendSummary describes how the metrics of an agent moved over the last window, for use in prompts.
+// It returns an empty string when no history is available.
+func (s *MetricsService) TrendSummary(ctx context.Context, agentID string, window time.Duration) (string, error) {
+	to := time.Now()
+	samples, err := s.repository.GetSamples(ctx, agentID, to.Add(-window), to)
+	if err != nil {
+		return "", err
+	}
+	return summarizeTrend(samples, window), nil
+}
+
+// accumulator aggregates a stream of values.
+type accumulator struct {
+	sum   float64
+	max   float64
+	count int
+}
+
+func (a *accumulator) add(v float64) {
+	if a.count == 0 || v > a.max {
+		a.max = v
+	}
+	a.sum += v
+	a.count++
+}
+
+func (a *accumulator) value(aggregation string) float64 {
+	if aggregation == AggregationMax {
+		return a.max
+	}
+	return a.sum / float64(a.count)
+}
+
+// value returns the aggregate of the bucket.
+func (b Bucket) value(aggregation string) float64 {
+	if aggregation == AggregationMax {
+		return b.Max
+	}
+	return b.Avg
+}
+
+// seriesFromBuckets builds the series of buckets starting at from, ordered by time within each series.
+func seriesFromBuckets(buckets []Bucket, from time.Time, bucket time.Duration, aggregation string) *Series {
+	series := &Series{
+		From:           from,
+		BucketSeconds:  int64(bucket.Seconds()),
+		Aggregation:    aggregation,
+		CPUUsage:       []Point{},
+		MemoryUsedPct:  []Point{},
+		DiskUsage:      map[string][]Point{},
+		FSUsagePercent: map[string][]Point{},
+	}
+	for _, b := range buckets {
+		point := Point{Time: from.Add(time.Duration(b.Index) * bucket), Value: b.value(aggregation)}
+		switch b.Series {
+		case seriesCPU:
+			series.CPUUsage = append(series.CPUUsage, point)
+		case seriesMemory:
+			series.MemoryUsedPct = append(series.MemoryUsedPct, point)
+		case seriesDisk:
+			series.DiskUsage[b.Key] = append(series.DiskUsage[b.Key], point)
+		case seriesFS:
+			series.FSUsagePercent[b.Key] = append(series.FSUsagePercent[b.Key], point)
+		}
+	}
+	return series
+}
+
+// ParsePercent parses filesystem usage values such as "45%" or "45.5".
+func ParsePercent(value string) (float64, bool) {
+	v, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(value), "%"), 64)
+	if err != nil {
+		return 0, false
+	}
+	return v, true
+}
+
+// trend tracks the first, last, average and peak of a metric over a window.
+type trend struct {
+	first, last float64
+	acc         accumulator
+}
+
+func (t *trend) add(v float64) {
+	if t.acc.count == 0 {
+		t.first = v
+	}
+	t.last = v
+	t.acc.add(v)
+}
+
+func (t *trend) String() string {
+	return fmt.Sprintf("%.1f%% -> %.1f%% (avg %.1f%%, max %.1f%%)", t.first, t.last, t.acc.value(AggregationAvg), t.acc.max)
+}
+
+func summarizeTrend(samples []Sample, window time.Duration) string {
+	if len(samples) == 0 {
+		return ""
+	}
+
+	var cpu, memory trend
+	fs := map[string]*trend{}
+	for _, sample := range samples {
+		cpu.add(sample.CPUUsage)
+		if sample.MemoryTotal > 0 {
+			memory.add(float64(sample.MemoryUsed) / float64(sample.MemoryTotal) * 100)
+		}
+		for mount, usage := range sample.FSUsage {
+			pct, ok := ParsePercent(usage)
+			if !ok {
+				continue
+			}
+			if fs[mount] == nil {
+				fs[mount] = &trend{}
+			}
+			fs[mount].add(pct)
+		}
+	}
+
+	lines := []string{fmt.Sprintf("Trend over the last %s (%d samples):", window, len(samples))}
+	lines = append(lines, "CPU Usage: "+cpu.String())
+	if memory.acc.count > 0 {
+		lines = append(lines, "Memory Usage: "+memory.String())
+	}
+
+	mounts := make([]string, 0, len(fs))
+	for mount := range fs {
+		mounts = append(mounts, mount)
+	}
+	sort.Strings(mounts)
+	for _, mount := range mounts {
+		lines = append(lines, fmt.Sprintf("Filesystem (%s): %s", mount, fs[mount]))
+	}
+
+	return strings.Join(lines, "\n")
+}
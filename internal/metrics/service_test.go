@@ -0,0 +1,171 @@
+package metrics
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testSamples(from time.Time) []Sample {
+	return []Sample{
+		{
+			Timestamp:   from.Add(10 * time.Second),
+			CPUUsage:    10,
+			MemoryTotal: 1000,
+			MemoryUsed:  200,
+			DiskUsage:   map[string]int64{"/": 100},
+			FSUsage:     map[string]string{"/": "40%"},
+		},
+		{
+			Timestamp:   from.Add(50 * time.Second),
+			CPUUsage:    30,
+			MemoryTotal: 1000,
+			MemoryUsed:  400,
+			DiskUsage:   map[string]int64{"/": 300},
+			FSUsage:     map[string]string{"/": "50%"},
+		},
+		{
+			Timestamp:   from.Add(2*time.Minute + 5*time.Second),
+			CPUUsage:    80,
+			MemoryTotal: 1000,
+			MemoryUsed:  900,
+			DiskUsage:   map[string]int64{"/": 500},
+			FSUsage:     map[string]string{"/": "invalid"},
+		},
+	}
+}
+
+func TestSeriesFromBuckets(t *testing.T) {
+	from := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	buckets := []Bucket{
+		{Series: seriesCPU, Index: 0, Avg: 20, Max: 30},
+		{Series: seriesCPU, Index: 2, Avg: 80, Max: 80},
+		{Series: seriesDisk, Key: "/", Index: 0, Avg: 200, Max: 300},
+		{Series: seriesFS, Key: "/", Index: 0, Avg: 45, Max: 50},
+		{Series: seriesMemory, Index: 0, Avg: 30, Max: 40},
+	}
+
+	t.Run("Average", func(t *testing.T) {
+		series := seriesFromBuckets(buckets, from, time.Minute, AggregationAvg)
+
+		assert.Equal(t, int64(60), series.BucketSeconds)
+		assert.Equal(t, []Point{
+			{Time: from, Value: 20},
+			{Time: from.Add(2 * time.Minute), Value: 80},
+		}, series.CPUUsage)
+		assert.Equal(t, []Point{{Time: from, Value: 30}}, series.MemoryUsedPct)
+		assert.Equal(t, []Point{{Time: from, Value: 200}}, series.DiskUsage["/"])
+		assert.Equal(t, []Point{{Time: from, Value: 45}}, series.FSUsagePercent["/"])
+	})
+
+	t.Run("Max", func(t *testing.T) {
+		series := seriesFromBuckets(buckets, from, time.Minute, AggregationMax)
+
+		assert.Equal(t, []Point{
+			{Time: from, Value: 30},
+			{Time: from.Add(2 * time.Minute), Value: 80},
+		}, series.CPUUsage)
+		assert.Equal(t, []Point{{Time: from, Value: 50}}, series.FSUsagePercent["/"])
+	})
+
+	t.Run("NoBuckets", func(t *testing.T) {
+		series := seriesFromBuckets(nil, from, time.Minute, AggregationAvg)
+
+		assert.NotNil(t, series.CPUUsage)
+		assert.Empty(t, series.CPUUsage)
+		assert.Empty(t, series.DiskUsage)
+	})
+}
+
+func TestParsePercent(t *testing.T) {
+	testCases := []struct {
+		value    string
+		expected float64
+		ok       bool
+	}{
+		{"45%", 45, true},
+		{" 45.5% ", 45.5, true},
+		{"12", 12, true},
+		{"", 0, false},
+		{"full", 0, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.value, func(t *testing.T) {
+			value, ok := ParsePercent(tc.value)
+			assert.Equal(t, tc.ok, ok)
+			assert.Equal(t, tc.expected, value)
+		})
+	}
+}
+
+func TestSummarizeTrend(t *testing.T) {
+	from := time.Now().Add(-time.Hour)
+
+	t.Run("NoSamples", func(t *testing.T) {
+		assert.Empty(t, summarizeTrend(nil, time.Hour))
+	})
+
+	t.Run("WithSamples", func(t *testing.T) {
+		summary := summarizeTrend(testSamples(from), time.Hour)
+
+		lines := strings.Split(summary, "\n")
+		assert.Equal(t, "Trend over the last 1h0m0s (3 samples):", lines[0])
+		assert.Contains(t, summary, "CPU Usage: 10.0% -> 80.0% (avg 40.0%, max 80.0%)")
+		assert.Contains(t, summary, "Memory Usage: 20.0% -> 90.0% (avg 50.0%, max 90.0%)")
+		assert.Contains(t, summary, "Filesystem (/): 40.0% -> 50.0% (avg 45.0%, max 50.0%)")
+	})
+}
+
+func TestGetSeriesValidation(t *testing.T) {
+	// Validation happens before the repository is used
+	service := NewMetricsService(nil)
+	to := time.Now()
+
+	testCases := []struct {
+		name        string
+		from        time.Time
+		bucket      time.Duration
+		aggregation string
+	}{
+		{"FromAfterTo", to.Add(time.Hour), time.Minute, AggregationAvg},
+		{"EmptyRange", to, time.Minute, AggregationAvg},
+		{"ZeroBucket", to.Add(-time.Hour), 0, AggregationAvg},
+		{"SubSecondBucket", to.Add(-time.Second), time.Millisecond, AggregationAvg},
+		{"TooManyPoints", to.Add(-48 * time.Hour), time.Minute, AggregationAvg},
+		{"UnknownAggregation", to.Add(-time.Hour), time.Minute, "sum"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := service.GetSeries(context.Background(), "agent", tc.from, to, tc.bucket, tc.aggregation)
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), "invalid")
+		})
+	}
+}
+
+func TestRetentionFromEnv(t *testing.T) {
+	t.Run("Default", func(t *testing.T) {
+		t.Setenv("METRICS_RETENTION", "")
+		retention, err := RetentionFromEnv()
+		assert.NoError(t, err)
+		assert.Equal(t, defaultRetention, retention)
+	})
+
+	t.Run("Override", func(t *testing.T) {
+		t.Setenv("METRICS_RETENTION", "168h")
+		retention, err := RetentionFromEnv()
+		assert.NoError(t, err)
+		assert.Equal(t, 7*24*time.Hour, retention)
+	})
+
+	t.Run("TooShort", func(t *testing.T) {
+		t.Setenv("METRICS_RETENTION", "30m")
+		_, err := RetentionFromEnv()
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,79 @@
+package notification
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// Preferences holds the email notification settings of a user.
+type Preferences struct {
+	ID               bson.ObjectID `json:"id" bson:"_id,omitempty"`
+	UserID           string        `json:"user_id" bson:"user_id"`
+	Email            string        `json:"email,omitempty" bson:"email,omitempty"` // Overrides the account email when set, must be an email address of the account
+	SessionCompleted bool          `json:"session_completed" bson:"session_completed"`
+	DailyDigest      bool          `json:"daily_digest" bson:"daily_digest"`
+	DigestHour       int           `json:"digest_hour" bson:"digest_hour"`           // Hour of the day (UTC) the digest is sent
+	Groups           []string      `json:"groups,omitempty" bson:"groups,omitempty"` // Only notify about agents in these groups, all agents when empty
+	LastDigestSentAt time.Time     `json:"last_digest_sent_at,omitempty" bson:"last_digest_sent_at,omitempty"`
+	UpdatedAt        time.Time     `json:"updated_at" bson:"updated_at"`
+}
+
+// PreferencesUpdate changes the notification settings of a user. Fields that are left out keep their saved value.
+type PreferencesUpdate struct {
+	Email            *string   `json:"email,omitempty"` // An email address of the user's account, empty to use the account email
+	SessionCompleted *bool     `json:"session_completed,omitempty"`
+	DailyDigest      *bool     `json:"daily_digest,omitempty"`
+	DigestHour       *int      `json:"digest_hour,omitempty"`
+	Groups           *[]string `json:"groups,omitempty"`
+}
+
+// Message represents a plain text email.
+type Message struct {
+	To      []string
+	Subject string
+	Body    string
+}
+
+// SessionReport is the data rendered into a session completion email.
+type SessionReport struct {
+	SessionID     string
+	Hostname      string
+	Issue         string
+	Status        string
+	Iterations    int
+	DiagnosisType string
+	RootCause     string
+	Severity      string
+	Impact        string
+	NextStep      string
+	CompletedAt   time.Time
+}
+
+// DigestFinding is a high severity finding listed in a daily digest.
+type DigestFinding struct {
+	SessionID     string
+	Hostname      string
+	DiagnosisType string
+	RootCause     string
+	Impact        string
+}
+
+// GraceNotice is the data rendered into the email sent before the previous secret of a rotated token
+// stops working.
+type GraceNotice struct {
+	TokenID            string
+	TokenName          string
+	RotatedAt          time.Time
+	GraceEndsAt        time.Time
+	PreviousLastUsedAt *time.Time // Last use of the previous secret, nil when unused since the rotation
+	PreviousLastUsedIP string
+}
+
+// Digest is the data rendered into a daily digest email.
+type Digest struct {
+	Since    time.Time
+	Until    time.Time
+	Sessions []SessionReport
+	Findings []DigestFinding
+}
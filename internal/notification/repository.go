@@ -0,0 +1,78 @@
+package notification
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+type PreferencesRepository struct {
+	collection *mongo.Collection
+}
+
+func NewPreferencesRepository(db *mongo.Database) *PreferencesRepository {
+	return &PreferencesRepository{
+		collection: db.Collection("notification_preferences"),
+	}
+}
+
+func (r *PreferencesRepository) GetPreferences(ctx context.Context, userID string) (*Preferences, error) {
+	filter := bson.M{"user_id": userID}
+	var prefs Preferences
+	err := r.collection.FindOne(ctx, filter).Decode(&prefs)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, mongo.ErrNoDocuments
+		}
+		return nil, fmt.Errorf("failed to retrieve notification preferences: %v", err)
+	}
+	return &prefs, nil
+}
+
+func (r *PreferencesRepository) UpsertPreferences(ctx context.Context, prefs *Preferences) error {
+	prefs.UpdatedAt = time.Now()
+
+	filter := bson.M{"user_id": prefs.UserID}
+	update := bson.M{"$set": bson.M{
+		"user_id":           prefs.UserID,
+		"email":             prefs.Email,
+		"session_completed": prefs.SessionCompleted,
+		"daily_digest":      prefs.DailyDigest,
+		"digest_hour":       prefs.DigestHour,
+		"groups":            prefs.Groups,
+		"updated_at":        prefs.UpdatedAt,
+	}}
+	opts := options.UpdateOne().SetUpsert(true)
+	if _, err := r.collection.UpdateOne(ctx, filter, update, opts); err != nil {
+		return fmt.Errorf("failed to save notification preferences: %v", err)
+	}
+	return nil
+}
+
+// ListDigestSubscribers returns the preferences of all users who opted into the daily digest.
+func (r *PreferencesRepository) ListDigestSubscribers(ctx context.Context) ([]*Preferences, error) {
+	cursor, err := r.collection.Find(ctx, bson.M{"daily_digest": true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list digest subscribers: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	var prefs []*Preferences
+	if err := cursor.All(ctx, &prefs); err != nil {
+		return nil, fmt.Errorf("failed to decode notification preferences: %v", err)
+	}
+	return prefs, nil
+}
+
+func (r *PreferencesRepository) SetLastDigestSentAt(ctx context.Context, userID string, sentAt time.Time) error {
+	filter := bson.M{"user_id": userID}
+	update := bson.M{"$set": bson.M{"last_digest_sent_at": sentAt}}
+	if _, err := r.collection.UpdateOne(ctx, filter, update); err != nil {
+		return fmt.Errorf("failed to update last digest time: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,506 @@
+package notification
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+
+	"github.com/harshavmb/nannyapi/internal/agent"
+	"github.com/harshavmb/nannyapi/internal/diagnostic"
+	"github.com/harshavmb/nannyapi/internal/token"
+	"github.com/harshavmb/nannyapi/internal/user"
+)
+
+const (
+	defaultDigestHour = 8
+	digestPeriod      = 24 * time.Hour
+	// digestMinInterval stops a digest from going out twice when the scheduler ticks more than once in the digest hour.
+	digestMinInterval = 23 * time.Hour
+)
+
+// NotificationService sends session reports and daily digests by email.
+type NotificationService struct {
+	repository        *PreferencesRepository
+	notifier          Notifier
+	userService       *user.UserService
+	agentService      *agent.AgentInfoService
+	diagnosticService *diagnostic.DiagnosticService
+	groups            agent.GroupResolver
+	orgs              OrgResolver
+}
+
+// OrgResolver tells which users belong to the organisation that owns an agent or session, and which
+// organisations a user belongs to.
+type OrgResolver interface {
+	MemberIDs(ctx context.Context, orgID string) ([]string, error)
+	OrgIDs(ctx context.Context, userID string) ([]string, error)
+}
+
+// NewNotificationService creates a new notification service.
+// A nil notifier disables email delivery while preferences can still be managed.
+func NewNotificationService(repository *PreferencesRepository, notifier Notifier, userService *user.UserService, agentService *agent.AgentInfoService, diagnosticService *diagnostic.DiagnosticService) *NotificationService {
+	return &NotificationService{
+		repository:        repository,
+		notifier:          notifier,
+		userService:       userService,
+		agentService:      agentService,
+		diagnosticService: diagnosticService,
+	}
+}
+
+// SetGroupResolver registers how the groups of an agent are looked up for preferences limited to groups.
+func (s *NotificationService) SetGroupResolver(groups agent.GroupResolver) {
+	s.groups = groups
+}
+
+// SetOrgResolver registers how the members of organisations are looked up. Without it, notifications about
+// an organisation go to the user with its ID, which is the owner of a personal organisation.
+func (s *NotificationService) SetOrgResolver(orgs OrgResolver) {
+	s.orgs = orgs
+}
+
+// memberIDs returns the users told about the resources of the organisation.
+func (s *NotificationService) memberIDs(ctx context.Context, orgID string) ([]string, error) {
+	if s.orgs == nil {
+		return []string{orgID}, nil
+	}
+	return s.orgs.MemberIDs(ctx, orgID)
+}
+
+// orgIDs returns the organisations whose resources are in the digest of the user.
+func (s *NotificationService) orgIDs(ctx context.Context, userID string) ([]string, error) {
+	if s.orgs == nil {
+		return []string{userID}, nil
+	}
+	return s.orgs.OrgIDs(ctx, userID)
+}
+
+// DefaultPreferences returns the preferences used for users who never saved any.
+func DefaultPreferences(userID string) *Preferences {
+	return &Preferences{
+		UserID:           userID,
+		SessionCompleted: true,
+		DailyDigest:      false,
+		DigestHour:       defaultDigestHour,
+	}
+}
+
+// GetPreferences retrieves the notification preferences of a user.
+func (s *NotificationService) GetPreferences(ctx context.Context, userID string) (*Preferences, error) {
+	prefs, err := s.repository.GetPreferences(ctx, userID)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return DefaultPreferences(userID), nil
+		}
+		return nil, err
+	}
+	return prefs, nil
+}
+
+// UpdatePreferences applies an update to the notification preferences of a user, validates and saves them.
+func (s *NotificationService) UpdatePreferences(ctx context.Context, userID string, update *PreferencesUpdate) (*Preferences, error) {
+	if userID == "" {
+		return nil, fmt.Errorf("user ID is required")
+	}
+	prefs, err := s.GetPreferences(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if update.Email != nil {
+		prefs.Email = user.NormalizeEmail(*update.Email)
+		if prefs.Email != "" {
+			u, err := s.lookupUser(ctx, userID)
+			if err != nil {
+				return nil, err
+			}
+			if !slices.Contains(accountEmails(u), prefs.Email) {
+				return nil, fmt.Errorf("invalid email: notifications can only be sent to an email address of your account")
+			}
+		}
+	}
+	if update.SessionCompleted != nil {
+		prefs.SessionCompleted = *update.SessionCompleted
+	}
+	if update.DailyDigest != nil {
+		prefs.DailyDigest = *update.DailyDigest
+	}
+	if update.DigestHour != nil {
+		prefs.DigestHour = *update.DigestHour
+	}
+	if update.Groups != nil {
+		prefs.Groups = *update.Groups
+	}
+
+	if prefs.DigestHour < 0 || prefs.DigestHour > 23 {
+		return nil, fmt.Errorf("digest_hour must be between 0 and 23")
+	}
+	for _, group := range prefs.Groups {
+		if err := agent.ValidateGroupName(group); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.repository.UpsertPreferences(ctx, prefs); err != nil {
+		return nil, err
+	}
+	log.Printf("Notification preferences updated for user %s", prefs.UserID)
+	return prefs, nil
+}
+
+// NotifySessionCompleted emails the session report to the members of the organisation owning the session.
+func (s *NotificationService) NotifySessionCompleted(ctx context.Context, session *diagnostic.DiagnosticSession) error {
+	if s.notifier == nil {
+		return nil
+	}
+
+	memberIDs, err := s.memberIDs(ctx, session.UserID)
+	if err != nil {
+		return fmt.Errorf("failed to resolve organisation members: %v", err)
+	}
+	agentInfo := s.agentInfo(ctx, session.AgentID)
+
+	// A member without an email address does not keep the report from the others
+	var firstErr error
+	for _, userID := range memberIDs {
+		if err := s.sendSessionReport(ctx, session, agentInfo, userID); err != nil {
+			log.Printf("Failed to send session report of session %s to user %s: %v", session.ID.Hex(), userID, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// sendSessionReport emails the session report to the user, if the preferences of the user want it.
+func (s *NotificationService) sendSessionReport(ctx context.Context, session *diagnostic.DiagnosticSession, agentInfo *agent.AgentInfo, userID string) error {
+	prefs, err := s.GetPreferences(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if !prefs.SessionCompleted {
+		return nil
+	}
+
+	inScope, err := s.inScope(ctx, prefs, agentInfo)
+	if err != nil {
+		return err
+	}
+	if !inScope {
+		return nil
+	}
+
+	to, err := s.recipient(ctx, prefs)
+	if err != nil {
+		return err
+	}
+
+	hostname := session.AgentID
+	if agentInfo != nil {
+		hostname = agentInfo.Hostname
+	}
+	report := buildSessionReport(session, hostname)
+	msg, err := RenderSessionReport(&report)
+	if err != nil {
+		return err
+	}
+	msg.To = []string{to}
+
+	if err := s.notifier.Send(ctx, msg); err != nil {
+		return fmt.Errorf("failed to send session report: %v", err)
+	}
+	log.Printf("Session report sent - Session: %s, User: %s", session.ID.Hex(), userID)
+	return nil
+}
+
+// NotifyTokenGraceEnding emails the creator of a rotated token that its previous secret stops working soon.
+// It is sent regardless of the session and digest preferences.
+func (s *NotificationService) NotifyTokenGraceEnding(ctx context.Context, t *token.Token) error {
+	if s.notifier == nil || t.GraceEndsAt == nil {
+		return nil
+	}
+
+	prefs, err := s.GetPreferences(ctx, t.Creator())
+	if err != nil {
+		return err
+	}
+	to, err := s.recipient(ctx, prefs)
+	if err != nil {
+		return err
+	}
+
+	notice := GraceNotice{
+		TokenID:            t.ID.Hex(),
+		TokenName:          t.Name,
+		GraceEndsAt:        *t.GraceEndsAt,
+		PreviousLastUsedAt: t.PreviousLastUsedAt,
+		PreviousLastUsedIP: t.PreviousLastUsedIP,
+	}
+	if notice.TokenName == "" {
+		notice.TokenName = notice.TokenID
+	}
+	if t.RotatedAt != nil {
+		notice.RotatedAt = *t.RotatedAt
+	}
+	msg, err := RenderGraceNotice(&notice)
+	if err != nil {
+		return err
+	}
+	msg.To = []string{to}
+
+	if err := s.notifier.Send(ctx, msg); err != nil {
+		return fmt.Errorf("failed to send grace notice: %v", err)
+	}
+	log.Printf("Grace notice sent - Token: %s, User: %s", notice.TokenID, prefs.UserID)
+	return nil
+}
+
+// SendDailyDigests sends the digest to every subscriber whose digest hour is the current hour.
+func (s *NotificationService) SendDailyDigests(ctx context.Context, now time.Time) error {
+	if s.notifier == nil {
+		return nil
+	}
+
+	subscribers, err := s.repository.ListDigestSubscribers(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, prefs := range subscribers {
+		if now.UTC().Hour() != prefs.DigestHour {
+			continue
+		}
+		if !prefs.LastDigestSentAt.IsZero() && now.Sub(prefs.LastDigestSentAt) < digestMinInterval {
+			continue
+		}
+
+		if err := s.sendDigest(ctx, prefs, now); err != nil {
+			log.Printf("Failed to send daily digest to user %s: %v", prefs.UserID, err)
+			continue
+		}
+		if err := s.repository.SetLastDigestSentAt(ctx, prefs.UserID, now); err != nil {
+			log.Printf("Failed to record daily digest for user %s: %v", prefs.UserID, err)
+		}
+	}
+	return nil
+}
+
+// StartDigestScheduler checks for due digests every interval until the context is cancelled.
+func (s *NotificationService) StartDigestScheduler(ctx context.Context, interval time.Duration) {
+	if s.notifier == nil {
+		log.Printf("SMTP is not configured, daily digests are disabled")
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				if err := s.SendDailyDigests(ctx, now); err != nil {
+					log.Printf("Failed to send daily digests: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+func (s *NotificationService) sendDigest(ctx context.Context, prefs *Preferences, now time.Time) error {
+	to, err := s.recipient(ctx, prefs)
+	if err != nil {
+		return err
+	}
+
+	// The digest covers every organisation of the user
+	orgIDs, err := s.orgIDs(ctx, prefs.UserID)
+	if err != nil {
+		return fmt.Errorf("failed to resolve organisations: %v", err)
+	}
+	var sessions []*diagnostic.DiagnosticSession
+	var agents []*agent.AgentInfo
+	for _, orgID := range orgIDs {
+		orgSessions, err := s.diagnosticService.ListUserSessions(ctx, orgID)
+		if err != nil {
+			return err
+		}
+		sessions = append(sessions, orgSessions...)
+
+		orgAgents, err := s.agentService.GetAgents(ctx, orgID)
+		if err != nil {
+			return err
+		}
+		agents = append(agents, orgAgents...)
+	}
+	hostnames := make(map[string]string, len(agents))
+	for _, a := range agents {
+		inScope, err := s.inScope(ctx, prefs, a)
+		if err != nil {
+			return err
+		}
+		if inScope {
+			hostnames[a.ID.Hex()] = a.Hostname
+		}
+	}
+
+	// Sessions of agents outside the preferred groups are left out of the digest
+	if len(prefs.Groups) > 0 {
+		sessions = slices.DeleteFunc(sessions, func(session *diagnostic.DiagnosticSession) bool {
+			_, ok := hostnames[session.AgentID]
+			return !ok
+		})
+	}
+
+	digest := buildDigest(sessions, hostnames, now.Add(-digestPeriod), now)
+	msg, err := RenderDigest(&digest)
+	if err != nil {
+		return err
+	}
+	msg.To = []string{to}
+
+	if err := s.notifier.Send(ctx, msg); err != nil {
+		return fmt.Errorf("failed to send digest: %v", err)
+	}
+	log.Printf("Daily digest sent to user %s with %d sessions", prefs.UserID, len(digest.Sessions))
+	return nil
+}
+
+// recipient returns the address notifications of the user are sent to. An override that is no longer an
+// email address of the account falls back to the account email.
+func (s *NotificationService) recipient(ctx context.Context, prefs *Preferences) (string, error) {
+	u, err := s.lookupUser(ctx, prefs.UserID)
+	if err != nil {
+		return "", err
+	}
+	if prefs.Email != "" && slices.Contains(accountEmails(u), user.NormalizeEmail(prefs.Email)) {
+		return prefs.Email, nil
+	}
+	if u.Email == "" {
+		return "", fmt.Errorf("no email address for user %s", prefs.UserID)
+	}
+	return u.Email, nil
+}
+
+// lookupUser returns the user with the ID.
+func (s *NotificationService) lookupUser(ctx context.Context, userID string) (*user.User, error) {
+	id, err := bson.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid user ID format: %v", err)
+	}
+	u, err := s.userService.GetUserByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if u == nil {
+		return nil, fmt.Errorf("user %s not found", userID)
+	}
+	return u, nil
+}
+
+// accountEmails returns the email addresses of the user's account: the account email and the emails of
+// the linked identities, which their providers verified.
+func accountEmails(u *user.User) []string {
+	var emails []string
+	if u.Email != "" {
+		emails = append(emails, user.NormalizeEmail(u.Email))
+	}
+	for _, identity := range u.Identities {
+		if identity.Email != "" {
+			emails = append(emails, user.NormalizeEmail(identity.Email))
+		}
+	}
+	return emails
+}
+
+// agentInfo looks up the agent of a session, returning nil when it cannot be found.
+func (s *NotificationService) agentInfo(ctx context.Context, agentID string) *agent.AgentInfo {
+	id, err := bson.ObjectIDFromHex(agentID)
+	if err != nil {
+		return nil
+	}
+	agentInfo, err := s.agentService.GetAgentInfoByID(ctx, id)
+	if err != nil {
+		return nil
+	}
+	return agentInfo
+}
+
+// inScope reports whether notifications about the agent are wanted under the preferences.
+// Agents that cannot be found only match preferences without groups.
+func (s *NotificationService) inScope(ctx context.Context, prefs *Preferences, agentInfo *agent.AgentInfo) (bool, error) {
+	if len(prefs.Groups) == 0 {
+		return true, nil
+	}
+	if agentInfo == nil || s.groups == nil {
+		return false, nil
+	}
+	groups, err := s.groups(ctx, agentInfo)
+	if err != nil {
+		return false, fmt.Errorf("failed to resolve agent groups: %v", err)
+	}
+	return slices.ContainsFunc(prefs.Groups, func(group string) bool {
+		return slices.Contains(groups, group)
+	}), nil
+}
+
+// buildSessionReport summarises a session using its latest diagnosis.
+func buildSessionReport(session *diagnostic.DiagnosticSession, hostname string) SessionReport {
+	report := SessionReport{
+		SessionID:   session.ID.Hex(),
+		Hostname:    hostname,
+		Issue:       session.InitialIssue,
+		Status:      session.Status,
+		Iterations:  len(session.History),
+		CompletedAt: session.UpdatedAt,
+	}
+
+	if len(session.History) > 0 {
+		last := session.History[len(session.History)-1]
+		report.DiagnosisType = last.DiagnosisType
+		report.RootCause = last.RootCause
+		report.Severity = last.Severity
+		report.Impact = last.Impact
+		report.NextStep = last.NextStep
+	}
+	return report
+}
+
+// buildDigest collects the sessions updated in [since, until) and their high severity findings.
+func buildDigest(sessions []*diagnostic.DiagnosticSession, hostnames map[string]string, since, until time.Time) Digest {
+	digest := Digest{Since: since, Until: until}
+
+	for _, session := range sessions {
+		if session.UpdatedAt.Before(since) || !session.UpdatedAt.Before(until) {
+			continue
+		}
+
+		hostname := hostnames[session.AgentID]
+		if hostname == "" {
+			hostname = session.AgentID
+		}
+		digest.Sessions = append(digest.Sessions, buildSessionReport(session, hostname))
+
+		for _, resp := range session.History {
+			if !strings.EqualFold(resp.Severity, "high") {
+				continue
+			}
+			digest.Findings = append(digest.Findings, DigestFinding{
+				SessionID:     session.ID.Hex(),
+				Hostname:      hostname,
+				DiagnosisType: resp.DiagnosisType,
+				RootCause:     resp.RootCause,
+				Impact:        resp.Impact,
+			})
+		}
+	}
+	return digest
+}
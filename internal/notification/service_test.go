@@ -0,0 +1,163 @@
+package notification
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/v2/bson"
+
+	"github.com/harshavmb/nannyapi/internal/agent"
+	"github.com/harshavmb/nannyapi/internal/diagnostic"
+	"github.com/harshavmb/nannyapi/internal/user"
+)
+
+func testSession(agentID, issue string, updatedAt time.Time, history ...diagnostic.DiagnosticResponse) *diagnostic.DiagnosticSession {
+	return &diagnostic.DiagnosticSession{
+		ID:           bson.NewObjectID(),
+		AgentID:      agentID,
+		UserID:       "test_user_123",
+		InitialIssue: issue,
+		Status:       "completed",
+		UpdatedAt:    updatedAt,
+		History:      history,
+	}
+}
+
+func TestBuildSessionReport(t *testing.T) {
+	session := testSession("agent1", "High CPU usage", time.Now(),
+		diagnostic.DiagnosticResponse{DiagnosisType: "cpu", Severity: "low"},
+		diagnostic.DiagnosticResponse{DiagnosisType: "thread_deadlock", Severity: "high", RootCause: "lock contention in worker pool", NextStep: "Inspect thread dumps"},
+	)
+
+	report := buildSessionReport(session, "db-01")
+	assert.Equal(t, "db-01", report.Hostname)
+	assert.Equal(t, 2, report.Iterations)
+	assert.Equal(t, "thread_deadlock", report.DiagnosisType)
+	assert.Equal(t, "high", report.Severity)
+	assert.Equal(t, "lock contention in worker pool", report.RootCause)
+
+	msg, err := RenderSessionReport(&report)
+	assert.NoError(t, err)
+	assert.Contains(t, msg.Subject, "db-01")
+	assert.Contains(t, msg.Body, "High CPU usage")
+	assert.Contains(t, msg.Body, "lock contention in worker pool")
+	assert.Contains(t, msg.Body, "Inspect thread dumps")
+	assert.Contains(t, msg.Body, session.ID.Hex())
+}
+
+func TestBuildDigest(t *testing.T) {
+	now := time.Date(2025, 4, 10, 8, 0, 0, 0, time.UTC)
+	since := now.Add(-digestPeriod)
+
+	sessions := []*diagnostic.DiagnosticSession{
+		testSession("agent1", "Disk full", now.Add(-2*time.Hour),
+			diagnostic.DiagnosticResponse{DiagnosisType: "inode_exhaustion", Severity: "high", RootCause: "log rotation disabled"},
+		),
+		testSession("agent2", "Slow queries", now.Add(-3*time.Hour),
+			diagnostic.DiagnosticResponse{DiagnosisType: "database", Severity: "medium"},
+		),
+		testSession("agent1", "Old issue", now.Add(-48*time.Hour),
+			diagnostic.DiagnosticResponse{DiagnosisType: "memory_leak", Severity: "high"},
+		),
+	}
+	hostnames := map[string]string{"agent1": "web-01"}
+
+	digest := buildDigest(sessions, hostnames, since, now)
+	assert.Len(t, digest.Sessions, 2)
+	assert.Len(t, digest.Findings, 1)
+	assert.Equal(t, "web-01", digest.Findings[0].Hostname)
+	assert.Equal(t, "log rotation disabled", digest.Findings[0].RootCause)
+	// Agents without a known hostname fall back to their ID
+	assert.Equal(t, "agent2", digest.Sessions[1].Hostname)
+
+	msg, err := RenderDigest(&digest)
+	assert.NoError(t, err)
+	assert.Contains(t, msg.Subject, "2 sessions")
+	assert.Contains(t, msg.Subject, "1 high severity findings")
+	assert.Contains(t, msg.Body, "log rotation disabled")
+	assert.Contains(t, msg.Body, "Slow queries")
+	assert.NotContains(t, msg.Body, "Old issue")
+}
+
+func TestRenderEmptyDigest(t *testing.T) {
+	now := time.Now()
+	digest := buildDigest(nil, nil, now.Add(-digestPeriod), now)
+
+	msg, err := RenderDigest(&digest)
+	assert.NoError(t, err)
+	assert.Contains(t, msg.Body, "No high severity findings.")
+	assert.Contains(t, msg.Body, "No diagnostic sessions in this period.")
+}
+
+func TestRenderGraceNotice(t *testing.T) {
+	graceEndsAt := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	notice := GraceNotice{TokenID: "abc", TokenName: "ci", RotatedAt: graceEndsAt.Add(-24 * time.Hour), GraceEndsAt: graceEndsAt}
+
+	msg, err := RenderGraceNotice(&notice)
+	assert.NoError(t, err)
+	assert.Contains(t, msg.Subject, "API key ci")
+	assert.Contains(t, msg.Body, "stops working at 2025-03-01 12:00:00 UTC")
+	assert.Contains(t, msg.Body, "has not been used since the rotation")
+
+	lastUsedAt := graceEndsAt.Add(-time.Hour)
+	notice.PreviousLastUsedAt = &lastUsedAt
+	notice.PreviousLastUsedIP = "10.0.0.1"
+	msg, err = RenderGraceNotice(&notice)
+	assert.NoError(t, err)
+	assert.Contains(t, msg.Body, "last used at 2025-03-01 11:00:00 UTC from 10.0.0.1")
+}
+
+func TestDefaultPreferences(t *testing.T) {
+	prefs := DefaultPreferences("test_user_123")
+	assert.Equal(t, "test_user_123", prefs.UserID)
+	assert.True(t, prefs.SessionCompleted)
+	assert.False(t, prefs.DailyDigest)
+	assert.Equal(t, defaultDigestHour, prefs.DigestHour)
+}
+
+func TestAccountEmails(t *testing.T) {
+	u := &user.User{
+		Email: "Owner@Example.com",
+		Identities: []user.Identity{
+			{Provider: "okta", Subject: "123", Email: "owner@corp.example.com"},
+			{Provider: "google", Subject: "456"},
+		},
+	}
+	assert.Equal(t, []string{"owner@example.com", "owner@corp.example.com"}, accountEmails(u))
+	assert.Empty(t, accountEmails(&user.User{}))
+}
+
+func TestInScope(t *testing.T) {
+	s := &NotificationService{}
+	s.SetGroupResolver(func(ctx context.Context, info *agent.AgentInfo) ([]string, error) {
+		if info.Labels["env"] == "prod" {
+			return []string{"production"}, nil
+		}
+		return nil, nil
+	})
+	prod := &agent.AgentInfo{Labels: map[string]string{"env": "prod"}}
+	staging := &agent.AgentInfo{Labels: map[string]string{"env": "staging"}}
+
+	all := DefaultPreferences("test_user_123")
+	for _, info := range []*agent.AgentInfo{prod, staging, nil} {
+		inScope, err := s.inScope(context.Background(), all, info)
+		assert.NoError(t, err)
+		assert.True(t, inScope)
+	}
+
+	production := DefaultPreferences("test_user_123")
+	production.Groups = []string{"production"}
+	inScope, err := s.inScope(context.Background(), production, prod)
+	assert.NoError(t, err)
+	assert.True(t, inScope)
+
+	inScope, err = s.inScope(context.Background(), production, staging)
+	assert.NoError(t, err)
+	assert.False(t, inScope)
+
+	inScope, err = s.inScope(context.Background(), production, nil)
+	assert.NoError(t, err)
+	assert.False(t, inScope)
+}
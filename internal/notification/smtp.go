@@ -0,0 +1,184 @@
+package notification
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	TLSModeNone     = "none"
+	TLSModeStartTLS = "starttls"
+	TLSModeTLS      = "tls"
+
+	defaultSMTPPort = 587
+	dialTimeout     = 10 * time.Second
+)
+
+// Notifier delivers email messages.
+type Notifier interface {
+	Send(ctx context.Context, msg *Message) error
+}
+
+// SMTPConfig holds the settings of the outgoing mail server.
+type SMTPConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+	TLSMode  string // "none", "starttls" or "tls"
+}
+
+// SMTPConfigFromEnv reads the SMTP settings from the environment.
+// It returns nil when SMTP_HOST is not set, which disables email notifications.
+func SMTPConfigFromEnv() (*SMTPConfig, error) {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return nil, nil
+	}
+
+	config := &SMTPConfig{
+		Host:     host,
+		Port:     defaultSMTPPort,
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		From:     os.Getenv("SMTP_FROM"),
+		TLSMode:  strings.ToLower(os.Getenv("SMTP_TLS")),
+	}
+
+	if port := os.Getenv("SMTP_PORT"); port != "" {
+		p, err := strconv.Atoi(port)
+		if err != nil || p <= 0 || p > 65535 {
+			return nil, fmt.Errorf("invalid SMTP_PORT %q", port)
+		}
+		config.Port = p
+	}
+
+	if config.TLSMode == "" {
+		config.TLSMode = TLSModeStartTLS
+	}
+	if config.TLSMode != TLSModeNone && config.TLSMode != TLSModeStartTLS && config.TLSMode != TLSModeTLS {
+		return nil, fmt.Errorf("invalid SMTP_TLS %q, must be one of none, starttls or tls", config.TLSMode)
+	}
+
+	if config.From == "" {
+		return nil, fmt.Errorf("SMTP_FROM must be set when SMTP_HOST is set")
+	}
+
+	return config, nil
+}
+
+// SMTPNotifier sends emails through an SMTP server.
+type SMTPNotifier struct {
+	config    SMTPConfig
+	tlsConfig *tls.Config
+}
+
+// NewSMTPNotifier creates a new SMTP notifier.
+func NewSMTPNotifier(config SMTPConfig) *SMTPNotifier {
+	return &SMTPNotifier{
+		config: config,
+		tlsConfig: &tls.Config{
+			ServerName: config.Host,
+			MinVersion: tls.VersionTLS12,
+		},
+	}
+}
+
+// Send delivers the message to all of its recipients.
+func (n *SMTPNotifier) Send(ctx context.Context, msg *Message) error {
+	if len(msg.To) == 0 {
+		return fmt.Errorf("message has no recipients")
+	}
+
+	addr := net.JoinHostPort(n.config.Host, strconv.Itoa(n.config.Port))
+	dialer := &net.Dialer{Timeout: dialTimeout}
+
+	var conn net.Conn
+	var err error
+	if n.config.TLSMode == TLSModeTLS {
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: n.tlsConfig}
+		conn, err = tlsDialer.DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to connect to SMTP server %s: %v", addr, err)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(conn, n.config.Host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to create SMTP client: %v", err)
+	}
+	defer client.Close()
+
+	if n.config.TLSMode == TLSModeStartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("SMTP server %s does not support STARTTLS", addr)
+		}
+		if err := client.StartTLS(n.tlsConfig); err != nil {
+			return fmt.Errorf("failed to start TLS: %v", err)
+		}
+	}
+
+	if n.config.Username != "" {
+		auth := smtp.PlainAuth("", n.config.Username, n.config.Password, n.config.Host)
+		if err := client.Auth(auth); err != nil {
+			return fmt.Errorf("SMTP authentication failed: %v", err)
+		}
+	}
+
+	if err := client.Mail(n.config.From); err != nil {
+		return fmt.Errorf("failed to set sender: %v", err)
+	}
+	for _, rcpt := range msg.To {
+		if err := client.Rcpt(rcpt); err != nil {
+			return fmt.Errorf("failed to set recipient %s: %v", rcpt, err)
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("failed to start message data: %v", err)
+	}
+	if _, err := w.Write(buildMessage(n.config.From, msg, time.Now())); err != nil {
+		return fmt.Errorf("failed to write message: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to send message: %v", err)
+	}
+
+	return client.Quit()
+}
+
+// buildMessage renders the message headers and body in RFC 5322 format.
+func buildMessage(from string, msg *Message, date time.Time) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("From: " + from + "\r\n")
+	buf.WriteString("To: " + strings.Join(msg.To, ", ") + "\r\n")
+	buf.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", msg.Subject) + "\r\n")
+	buf.WriteString("Date: " + date.Format(time.RFC1123Z) + "\r\n")
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	buf.WriteString("\r\n")
+
+	// SMTP requires CRLF line endings in the message body
+	body := strings.ReplaceAll(msg.Body, "\r\n", "\n")
+	buf.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return buf.Bytes()
+}
@@ -0,0 +1,157 @@
+package notification
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSMTPServer accepts a single SMTP session and records the message data.
+func fakeSMTPServer(t *testing.T) (string, int, <-chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	data := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		write := func(line string) { _, _ = conn.Write([]byte(line + "\r\n")) }
+		write("220 localhost ESMTP")
+
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			cmd := strings.ToUpper(strings.TrimSpace(line))
+			switch {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				write("250 localhost")
+			case strings.HasPrefix(cmd, "MAIL FROM"), strings.HasPrefix(cmd, "RCPT TO"):
+				write("250 OK")
+			case cmd == "DATA":
+				write("354 End data with <CR><LF>.<CR><LF>")
+				var body strings.Builder
+				for {
+					l, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if l == ".\r\n" {
+						break
+					}
+					body.WriteString(l)
+				}
+				data <- body.String()
+				write("250 OK")
+			case cmd == "QUIT":
+				write("221 Bye")
+				return
+			default:
+				write("502 Command not implemented")
+			}
+		}
+	}()
+
+	addr := listener.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port, data
+}
+
+func TestSMTPNotifierSend(t *testing.T) {
+	host, port, data := fakeSMTPServer(t)
+
+	notifier := NewSMTPNotifier(SMTPConfig{
+		Host:    host,
+		Port:    port,
+		From:    "nannyai@example.com",
+		TLSMode: TLSModeNone,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := notifier.Send(ctx, &Message{
+		To:      []string{"user@example.com"},
+		Subject: "Diagnostic session completed",
+		Body:    "Root cause: disk full\nNext step: rotate logs",
+	})
+	assert.NoError(t, err)
+
+	select {
+	case msg := <-data:
+		assert.Contains(t, msg, "From: nannyai@example.com\r\n")
+		assert.Contains(t, msg, "To: user@example.com\r\n")
+		assert.Contains(t, msg, "Subject: Diagnostic session completed\r\n")
+		assert.Contains(t, msg, "Root cause: disk full\r\nNext step: rotate logs")
+	case <-ctx.Done():
+		t.Fatal("Timed out waiting for message")
+	}
+}
+
+func TestSMTPNotifierNoRecipients(t *testing.T) {
+	notifier := NewSMTPNotifier(SMTPConfig{Host: "127.0.0.1", Port: 25, From: "nannyai@example.com"})
+	err := notifier.Send(context.Background(), &Message{Subject: "test"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "no recipients")
+}
+
+func TestSMTPConfigFromEnv(t *testing.T) {
+	t.Run("Disabled", func(t *testing.T) {
+		t.Setenv("SMTP_HOST", "")
+		config, err := SMTPConfigFromEnv()
+		assert.NoError(t, err)
+		assert.Nil(t, config)
+	})
+
+	t.Run("Defaults", func(t *testing.T) {
+		t.Setenv("SMTP_HOST", "smtp.example.com")
+		t.Setenv("SMTP_FROM", "nannyai@example.com")
+		t.Setenv("SMTP_PORT", "")
+		t.Setenv("SMTP_TLS", "")
+		config, err := SMTPConfigFromEnv()
+		assert.NoError(t, err)
+		assert.Equal(t, defaultSMTPPort, config.Port)
+		assert.Equal(t, TLSModeStartTLS, config.TLSMode)
+	})
+
+	t.Run("ImplicitTLS", func(t *testing.T) {
+		t.Setenv("SMTP_HOST", "smtp.example.com")
+		t.Setenv("SMTP_FROM", "nannyai@example.com")
+		t.Setenv("SMTP_PORT", strconv.Itoa(465))
+		t.Setenv("SMTP_TLS", "TLS")
+		config, err := SMTPConfigFromEnv()
+		assert.NoError(t, err)
+		assert.Equal(t, 465, config.Port)
+		assert.Equal(t, TLSModeTLS, config.TLSMode)
+	})
+
+	t.Run("InvalidTLSMode", func(t *testing.T) {
+		t.Setenv("SMTP_HOST", "smtp.example.com")
+		t.Setenv("SMTP_FROM", "nannyai@example.com")
+		t.Setenv("SMTP_TLS", "ssl3")
+		_, err := SMTPConfigFromEnv()
+		assert.Error(t, err)
+	})
+
+	t.Run("MissingFrom", func(t *testing.T) {
+		t.Setenv("SMTP_HOST", "smtp.example.com")
+		t.Setenv("SMTP_FROM", "")
+		t.Setenv("SMTP_TLS", "")
+		_, err := SMTPConfigFromEnv()
+		assert.Error(t, err)
+	})
+}
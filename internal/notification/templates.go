@@ -0,0 +1,113 @@
+package notification
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+)
+
+const sessionReportTemplate = `Your diagnostic session on {{.Hostname}} has completed.
+
+Issue:          {{.Issue}}
+Session ID:     {{.SessionID}}
+Status:         {{.Status}}
+Iterations:     {{.Iterations}}
+Completed at:   {{.CompletedAt.UTC.Format "2006-01-02 15:04:05 MST"}}
+{{if .DiagnosisType}}
+Diagnosis type: {{.DiagnosisType}}{{end}}{{if .Severity}}
+Severity:       {{.Severity}}{{end}}{{if .RootCause}}
+Root cause:     {{.RootCause}}{{end}}{{if .Impact}}
+Impact:         {{.Impact}}{{end}}
+{{if .NextStep}}
+Recommended next step:
+{{.NextStep}}
+{{end}}
+--
+NannyAI
+`
+
+const digestTemplate = `NannyAI daily digest for {{.Since.UTC.Format "2006-01-02 15:04"}} - {{.Until.UTC.Format "2006-01-02 15:04"}} UTC
+
+{{if .Findings}}High severity findings ({{len .Findings}}):
+{{range .Findings}}
+- {{.Hostname}} [{{.DiagnosisType}}] {{.RootCause}}{{if .Impact}}
+  Impact: {{.Impact}}{{end}}
+  Session: {{.SessionID}}
+{{end}}
+{{else}}No high severity findings.
+
+{{end}}Diagnostic sessions ({{len .Sessions}}):
+{{range .Sessions}}
+- {{.Hostname}}: {{.Issue}}
+  Status: {{.Status}}, iterations: {{.Iterations}}{{if .Severity}}, severity: {{.Severity}}{{end}}
+  Session: {{.SessionID}}
+{{else}}
+No diagnostic sessions in this period.
+{{end}}
+--
+NannyAI
+`
+
+const graceNoticeTemplate = `The previous secret of your API key {{.TokenName}} stops working at {{.GraceEndsAt.UTC.Format "2006-01-02 15:04:05 MST"}}.
+
+Token ID:       {{.TokenID}}
+Rotated at:     {{.RotatedAt.UTC.Format "2006-01-02 15:04:05 MST"}}
+{{if .PreviousLastUsedAt}}
+The previous secret was last used at {{.PreviousLastUsedAt.UTC.Format "2006-01-02 15:04:05 MST"}} from {{.PreviousLastUsedIP}}.
+Clients still using it will be rejected once the grace period ends.
+{{else}}
+The previous secret has not been used since the rotation.
+{{end}}
+--
+NannyAI
+`
+
+var (
+	sessionReportTmpl = template.Must(template.New("session_report").Parse(sessionReportTemplate))
+	digestTmpl        = template.Must(template.New("digest").Parse(digestTemplate))
+	graceNoticeTmpl   = template.Must(template.New("grace_notice").Parse(graceNoticeTemplate))
+)
+
+// RenderSessionReport renders the session completion email.
+func RenderSessionReport(report *SessionReport) (*Message, error) {
+	var buf bytes.Buffer
+	if err := sessionReportTmpl.Execute(&buf, report); err != nil {
+		return nil, fmt.Errorf("failed to render session report: %v", err)
+	}
+
+	return &Message{
+		Subject: fmt.Sprintf("[NannyAI] Diagnostic session completed on %s", report.Hostname),
+		Body:    buf.String(),
+	}, nil
+}
+
+// RenderDigest renders the daily digest email.
+func RenderDigest(digest *Digest) (*Message, error) {
+	var buf bytes.Buffer
+	if err := digestTmpl.Execute(&buf, digest); err != nil {
+		return nil, fmt.Errorf("failed to render digest: %v", err)
+	}
+
+	subject := fmt.Sprintf("[NannyAI] Daily digest: %d sessions", len(digest.Sessions))
+	if len(digest.Findings) > 0 {
+		subject += fmt.Sprintf(", %d high severity findings", len(digest.Findings))
+	}
+
+	return &Message{
+		Subject: subject,
+		Body:    buf.String(),
+	}, nil
+}
+
+// RenderGraceNotice renders the email sent before the grace period of a token rotation ends.
+func RenderGraceNotice(notice *GraceNotice) (*Message, error) {
+	var buf bytes.Buffer
+	if err := graceNoticeTmpl.Execute(&buf, notice); err != nil {
+		return nil, fmt.Errorf("failed to render grace notice: %v", err)
+	}
+
+	return &Message{
+		Subject: fmt.Sprintf("[NannyAI] Previous secret of API key %s expires soon", notice.TokenName),
+		Body:    buf.String(),
+	}, nil
+}
@@ -0,0 +1,124 @@
+package org
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// Role is the role of a member in an organisation. Each role holds the permissions of the roles below it.
+type Role string
+
+const (
+	RoleViewer   Role = "viewer"   // Sees the agents, sessions and alerts of the organisation
+	RoleOperator Role = "operator" // Also runs diagnostics, jobs and campaigns and changes agents and alert rules
+	RoleAdmin    Role = "admin"    // Also manages auth tokens, agent enrollment, members and invitations
+	RoleOwner    Role = "owner"    // Also grants and takes away the owner role
+)
+
+// Permission is what an endpoint requires from the role of the caller in the organisation it acts in.
+type Permission string
+
+const (
+	PermissionView    Permission = "view"
+	PermissionOperate Permission = "operate"
+	PermissionAdmin   Permission = "admin"
+	PermissionOwner   Permission = "owner"
+)
+
+// roleRanks orders the roles from the least to the most privileged.
+var roleRanks = map[Role]int{
+	RoleViewer:   1,
+	RoleOperator: 2,
+	RoleAdmin:    3,
+	RoleOwner:    4,
+}
+
+// permissionRoles maps each permission to the least privileged role that has it.
+var permissionRoles = map[Permission]Role{
+	PermissionView:    RoleViewer,
+	PermissionOperate: RoleOperator,
+	PermissionAdmin:   RoleAdmin,
+	PermissionOwner:   RoleOwner,
+}
+
+// Valid reports whether the role is one of the known roles.
+func (r Role) Valid() bool {
+	_, ok := roleRanks[r]
+	return ok
+}
+
+// Can reports whether the role has the permission.
+func (r Role) Can(permission Permission) bool {
+	least, ok := permissionRoles[permission]
+	return ok && r.Valid() && roleRanks[r] >= roleRanks[least]
+}
+
+// AtLeast reports whether the role holds every permission of the other role.
+func (r Role) AtLeast(other Role) bool {
+	return r.Valid() && roleRanks[r] >= roleRanks[other]
+}
+
+// Organisation owns agents, auth tokens, diagnostic sessions and everything derived from them, in the
+// user_id field of those resources. Every user has a personal organisation with the ID of the user, so
+// resources created before organisations were added belong to it.
+type Organisation struct {
+	ID        string    `json:"id" bson:"_id"`
+	Name      string    `json:"name" bson:"name"`
+	Personal  bool      `json:"personal" bson:"personal"` // Personal organisations have their user as the only member
+	CreatedBy string    `json:"created_by" bson:"created_by"`
+	CreatedAt time.Time `json:"created_at" bson:"created_at"`
+}
+
+// Member is a user in an organisation.
+type Member struct {
+	ID        bson.ObjectID `json:"id" bson:"_id,omitempty"`
+	OrgID     string        `json:"org_id" bson:"org_id"`
+	UserID    string        `json:"user_id" bson:"user_id"`
+	Email     string        `json:"email,omitempty" bson:"email,omitempty"`
+	Role      Role          `json:"role" bson:"role"`
+	CreatedAt time.Time     `json:"created_at" bson:"created_at"`
+}
+
+// Membership is an organisation of a user together with the role of the user in it.
+type Membership struct {
+	*Organisation
+	Role Role `json:"role"`
+}
+
+// Invitation lets the user with the email address join an organisation with the role. It can be accepted
+// once, before it expires.
+type Invitation struct {
+	ID          bson.ObjectID `json:"id" bson:"_id,omitempty"`
+	OrgID       string        `json:"org_id" bson:"org_id"`
+	Email       string        `json:"email" bson:"email"`
+	Role        Role          `json:"role" bson:"role"`
+	Token       string        `json:"token,omitempty" bson:"-"` // Only returned when the invitation is created
+	HashedToken string        `json:"-" bson:"hashed_token"`
+	InvitedBy   string        `json:"invited_by" bson:"invited_by"`
+	ExpiresAt   time.Time     `json:"expires_at" bson:"expires_at"`
+	AcceptedAt  *time.Time    `json:"accepted_at,omitempty" bson:"accepted_at,omitempty"`
+	AcceptedBy  string        `json:"accepted_by,omitempty" bson:"accepted_by,omitempty"`
+	CreatedAt   time.Time     `json:"created_at" bson:"created_at"`
+}
+
+// CreateOrganisationRequest creates an organisation.
+type CreateOrganisationRequest struct {
+	Name string `json:"name"`
+}
+
+// InviteRequest invites a user to the organisation.
+type InviteRequest struct {
+	Email string `json:"email"`
+	Role  Role   `json:"role"`
+}
+
+// UpdateMemberRequest changes the role of a member.
+type UpdateMemberRequest struct {
+	Role Role `json:"role"`
+}
+
+// AcceptInvitationRequest accepts an invitation with the token sent to the invited user.
+type AcceptInvitationRequest struct {
+	Token string `json:"token"`
+}
@@ -0,0 +1,244 @@
+package org
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+type OrgRepository struct {
+	organisations *mongo.Collection
+	members       *mongo.Collection
+	invitations   *mongo.Collection
+}
+
+func NewOrgRepository(db *mongo.Database) *OrgRepository {
+	return &OrgRepository{
+		organisations: db.Collection("organisations"),
+		members:       db.Collection("org_members"),
+		invitations:   db.Collection("org_invitations"),
+	}
+}
+
+func (r *OrgRepository) InsertOrganisation(ctx context.Context, organisation *Organisation) error {
+	if _, err := r.organisations.InsertOne(ctx, organisation); err != nil {
+		return fmt.Errorf("failed to insert organisation: %v", err)
+	}
+	return nil
+}
+
+// EnsureOrganisation inserts the organisation unless one with its ID exists, and reports whether it did.
+func (r *OrgRepository) EnsureOrganisation(ctx context.Context, organisation *Organisation) (bool, error) {
+	opts := options.UpdateOne().SetUpsert(true)
+	result, err := r.organisations.UpdateOne(ctx, bson.M{"_id": organisation.ID}, bson.M{"$setOnInsert": organisation}, opts)
+	if err != nil {
+		return false, fmt.Errorf("failed to insert organisation: %v", err)
+	}
+	return result.UpsertedCount > 0, nil
+}
+
+// GetOrganisation returns the organisation with the ID, or nil if there is none.
+func (r *OrgRepository) GetOrganisation(ctx context.Context, id string) (*Organisation, error) {
+	var organisation Organisation
+	err := r.organisations.FindOne(ctx, bson.M{"_id": id}).Decode(&organisation)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to retrieve organisation: %v", err)
+	}
+	return &organisation, nil
+}
+
+// ListOrganisations returns the organisations with the IDs, by name.
+func (r *OrgRepository) ListOrganisations(ctx context.Context, ids []string) ([]*Organisation, error) {
+	opts := options.Find().SetSort(bson.M{"name": 1})
+	cursor, err := r.organisations.Find(ctx, bson.M{"_id": bson.M{"$in": ids}}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list organisations: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	var organisations []*Organisation
+	if err := cursor.All(ctx, &organisations); err != nil {
+		return nil, fmt.Errorf("failed to decode organisations: %v", err)
+	}
+	return organisations, nil
+}
+
+// ListPersonalOrganisationIDs returns the IDs of all personal organisations.
+func (r *OrgRepository) ListPersonalOrganisationIDs(ctx context.Context) (map[string]bool, error) {
+	opts := options.Find().SetProjection(bson.M{"_id": 1})
+	cursor, err := r.organisations.Find(ctx, bson.M{"personal": true}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list personal organisations: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	var organisations []*Organisation
+	if err := cursor.All(ctx, &organisations); err != nil {
+		return nil, fmt.Errorf("failed to decode personal organisations: %v", err)
+	}
+	ids := make(map[string]bool, len(organisations))
+	for _, organisation := range organisations {
+		ids[organisation.ID] = true
+	}
+	return ids, nil
+}
+
+// AddMember adds the user to the organisation, unless the user already is a member, and reports whether it
+// did.
+func (r *OrgRepository) AddMember(ctx context.Context, member *Member) (bool, error) {
+	filter := bson.M{"org_id": member.OrgID, "user_id": member.UserID}
+	update := bson.M{"$setOnInsert": bson.M{
+		"email":      member.Email,
+		"role":       member.Role,
+		"created_at": member.CreatedAt,
+	}}
+	opts := options.UpdateOne().SetUpsert(true)
+	result, err := r.members.UpdateOne(ctx, filter, update, opts)
+	if err != nil {
+		return false, fmt.Errorf("failed to insert member: %v", err)
+	}
+	return result.UpsertedCount > 0, nil
+}
+
+// GetMember returns the membership of the user in the organisation, or nil if there is none.
+func (r *OrgRepository) GetMember(ctx context.Context, orgID, userID string) (*Member, error) {
+	var member Member
+	err := r.members.FindOne(ctx, bson.M{"org_id": orgID, "user_id": userID}).Decode(&member)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to retrieve member: %v", err)
+	}
+	return &member, nil
+}
+
+// ListMembers returns the members of the organisation, oldest first.
+func (r *OrgRepository) ListMembers(ctx context.Context, orgID string) ([]*Member, error) {
+	return r.findMembers(ctx, bson.M{"org_id": orgID})
+}
+
+// ListUserMemberships returns the memberships of the user in every organisation.
+func (r *OrgRepository) ListUserMemberships(ctx context.Context, userID string) ([]*Member, error) {
+	return r.findMembers(ctx, bson.M{"user_id": userID})
+}
+
+func (r *OrgRepository) findMembers(ctx context.Context, filter bson.M) ([]*Member, error) {
+	opts := options.Find().SetSort(bson.M{"created_at": 1})
+	cursor, err := r.members.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list members: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	var members []*Member
+	if err := cursor.All(ctx, &members); err != nil {
+		return nil, fmt.Errorf("failed to decode members: %v", err)
+	}
+	return members, nil
+}
+
+// CountOwners returns how many owners the organisation has.
+func (r *OrgRepository) CountOwners(ctx context.Context, orgID string) (int64, error) {
+	count, err := r.members.CountDocuments(ctx, bson.M{"org_id": orgID, "role": RoleOwner})
+	if err != nil {
+		return 0, fmt.Errorf("failed to count owners: %v", err)
+	}
+	return count, nil
+}
+
+func (r *OrgRepository) UpdateMemberRole(ctx context.Context, orgID, userID string, role Role) error {
+	if _, err := r.members.UpdateOne(ctx, bson.M{"org_id": orgID, "user_id": userID}, bson.M{"$set": bson.M{"role": role}}); err != nil {
+		return fmt.Errorf("failed to update member: %v", err)
+	}
+	return nil
+}
+
+func (r *OrgRepository) DeleteMember(ctx context.Context, orgID, userID string) error {
+	if _, err := r.members.DeleteOne(ctx, bson.M{"org_id": orgID, "user_id": userID}); err != nil {
+		return fmt.Errorf("failed to delete member: %v", err)
+	}
+	return nil
+}
+
+func (r *OrgRepository) InsertInvitation(ctx context.Context, invitation *Invitation) error {
+	result, err := r.invitations.InsertOne(ctx, invitation)
+	if err != nil {
+		return fmt.Errorf("failed to insert invitation: %v", err)
+	}
+	invitation.ID = result.InsertedID.(bson.ObjectID)
+	return nil
+}
+
+// GetInvitation returns the invitation with the ID, or nil if there is none.
+func (r *OrgRepository) GetInvitation(ctx context.Context, id bson.ObjectID) (*Invitation, error) {
+	return r.findInvitation(ctx, bson.M{"_id": id})
+}
+
+// GetInvitationByHashedToken returns the invitation with the token, or nil if there is none.
+func (r *OrgRepository) GetInvitationByHashedToken(ctx context.Context, hashedToken string) (*Invitation, error) {
+	return r.findInvitation(ctx, bson.M{"hashed_token": hashedToken})
+}
+
+func (r *OrgRepository) findInvitation(ctx context.Context, filter bson.M) (*Invitation, error) {
+	var invitation Invitation
+	err := r.invitations.FindOne(ctx, filter).Decode(&invitation)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to retrieve invitation: %v", err)
+	}
+	return &invitation, nil
+}
+
+// ListPendingInvitations returns the invitations of the organisation that can still be accepted, newest first.
+func (r *OrgRepository) ListPendingInvitations(ctx context.Context, orgID string, now time.Time) ([]*Invitation, error) {
+	filter := bson.M{
+		"org_id":      orgID,
+		"accepted_at": bson.M{"$exists": false},
+		"expires_at":  bson.M{"$gt": now},
+	}
+	opts := options.Find().SetSort(bson.M{"created_at": -1})
+	cursor, err := r.invitations.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list invitations: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	var invitations []*Invitation
+	if err := cursor.All(ctx, &invitations); err != nil {
+		return nil, fmt.Errorf("failed to decode invitations: %v", err)
+	}
+	return invitations, nil
+}
+
+// AcceptInvitation marks the invitation as accepted by the user, unless it was accepted or expired
+// meanwhile, and reports whether it did.
+func (r *OrgRepository) AcceptInvitation(ctx context.Context, id bson.ObjectID, userID string, now time.Time) (bool, error) {
+	filter := bson.M{
+		"_id":         id,
+		"accepted_at": bson.M{"$exists": false},
+		"expires_at":  bson.M{"$gt": now},
+	}
+	update := bson.M{"$set": bson.M{"accepted_at": now, "accepted_by": userID}}
+	result, err := r.invitations.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, fmt.Errorf("failed to accept invitation: %v", err)
+	}
+	return result.ModifiedCount > 0, nil
+}
+
+func (r *OrgRepository) DeleteInvitation(ctx context.Context, id bson.ObjectID) error {
+	if _, err := r.invitations.DeleteOne(ctx, bson.M{"_id": id}); err != nil {
+		return fmt.Errorf("failed to delete invitation: %v", err)
+	}
+	return nil
+}
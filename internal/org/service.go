@@ -0,0 +1,442 @@
+package org
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+
+	"github.com/harshavmb/nannyapi/internal/token"
+	"github.com/harshavmb/nannyapi/internal/user"
+)
+
+const (
+	invitationTokenPrefix = "ninvite_"
+	invitationTokenLength = 40
+	invitationTTL         = 7 * 24 * time.Hour
+	maxNameLength         = 100
+)
+
+// OrgService manages organisations, their members and invitations, and tells which role a user has in an
+// organisation.
+type OrgService struct {
+	repository *OrgRepository
+	users      *user.UserService
+}
+
+func NewOrgService(repository *OrgRepository, users *user.UserService) *OrgService {
+	return &OrgService{
+		repository: repository,
+		users:      users,
+	}
+}
+
+// Authorize returns the role of the user in the organisation. Users own their personal organisation, whose
+// ID is their own, so it needs no lookup.
+func (s *OrgService) Authorize(ctx context.Context, orgID, userID string) (Role, error) {
+	if orgID == userID {
+		return RoleOwner, nil
+	}
+	member, err := s.repository.GetMember(ctx, orgID, userID)
+	if err != nil {
+		return "", err
+	}
+	if member == nil {
+		return "", fmt.Errorf("user is not a member of organisation %s", orgID)
+	}
+	return member.Role, nil
+}
+
+// EnsurePersonalOrganisation creates the personal organisation of the user unless it exists.
+func (s *OrgService) EnsurePersonalOrganisation(ctx context.Context, userID string) error {
+	id, err := bson.ObjectIDFromHex(userID)
+	if err != nil {
+		return fmt.Errorf("invalid user ID format: %v", err)
+	}
+	u, err := s.users.GetUserByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	if u == nil {
+		return fmt.Errorf("user not found")
+	}
+	_, err = s.ensurePersonalOrganisation(ctx, u)
+	return err
+}
+
+// ensurePersonalOrganisation creates the personal organisation of the user with the user as its owner,
+// and reports whether it did.
+func (s *OrgService) ensurePersonalOrganisation(ctx context.Context, u *user.User) (bool, error) {
+	now := time.Now()
+	name := u.Name
+	if name == "" {
+		name = u.Email
+	}
+	created, err := s.repository.EnsureOrganisation(ctx, &Organisation{
+		ID:        u.ID.Hex(),
+		Name:      name,
+		Personal:  true,
+		CreatedBy: u.ID.Hex(),
+		CreatedAt: now,
+	})
+	if err != nil {
+		return false, err
+	}
+	if _, err := s.repository.AddMember(ctx, &Member{OrgID: u.ID.Hex(), UserID: u.ID.Hex(), Email: u.Email, Role: RoleOwner, CreatedAt: now}); err != nil {
+		return false, err
+	}
+	return created, nil
+}
+
+// MigratePersonalOrganisations creates the personal organisation of every user that has none yet and
+// returns how many it created. The agents, tokens and sessions of a user already carry the ID of the
+// personal organisation, so they need not be changed.
+func (s *OrgService) MigratePersonalOrganisations(ctx context.Context) (int, error) {
+	existing, err := s.repository.ListPersonalOrganisationIDs(ctx)
+	if err != nil {
+		return 0, err
+	}
+	users, err := s.users.ListUsers(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+	for _, u := range users {
+		if existing[u.ID.Hex()] {
+			continue
+		}
+		created, err := s.ensurePersonalOrganisation(ctx, u)
+		if err != nil {
+			return migrated, fmt.Errorf("failed to create personal organisation of user %s: %v", u.ID.Hex(), err)
+		}
+		if created {
+			migrated++
+		}
+	}
+	return migrated, nil
+}
+
+// CreateOrganisation creates an organisation with the user as its owner.
+func (s *OrgService) CreateOrganisation(ctx context.Context, userID string, req *CreateOrganisationRequest) (*Membership, error) {
+	name := strings.TrimSpace(req.Name)
+	if name == "" || len(name) > maxNameLength {
+		return nil, fmt.Errorf("invalid organisation: name must be between 1 and %d characters", maxNameLength)
+	}
+	email, err := s.email(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	organisation := &Organisation{
+		ID:        bson.NewObjectID().Hex(),
+		Name:      name,
+		CreatedBy: userID,
+		CreatedAt: now,
+	}
+	if err := s.repository.InsertOrganisation(ctx, organisation); err != nil {
+		return nil, err
+	}
+	if _, err := s.repository.AddMember(ctx, &Member{OrgID: organisation.ID, UserID: userID, Email: email, Role: RoleOwner, CreatedAt: now}); err != nil {
+		return nil, err
+	}
+	log.Printf("Organisation %s created by user %s", organisation.ID, userID)
+	return &Membership{Organisation: organisation, Role: RoleOwner}, nil
+}
+
+// ListOrganisations returns the organisations of the user, starting with the personal one.
+func (s *OrgService) ListOrganisations(ctx context.Context, userID string) ([]*Membership, error) {
+	if err := s.EnsurePersonalOrganisation(ctx, userID); err != nil {
+		return nil, err
+	}
+	members, err := s.repository.ListUserMemberships(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	roles := make(map[string]Role, len(members))
+	ids := make([]string, 0, len(members))
+	for _, member := range members {
+		roles[member.OrgID] = member.Role
+		ids = append(ids, member.OrgID)
+	}
+	organisations, err := s.repository.ListOrganisations(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	memberships := make([]*Membership, 0, len(organisations))
+	for _, organisation := range organisations {
+		membership := &Membership{Organisation: organisation, Role: roles[organisation.ID]}
+		if organisation.Personal {
+			memberships = append([]*Membership{membership}, memberships...)
+		} else {
+			memberships = append(memberships, membership)
+		}
+	}
+	return memberships, nil
+}
+
+// GetOrganisation returns an organisation the user is a member of.
+func (s *OrgService) GetOrganisation(ctx context.Context, orgID, userID string) (*Organisation, error) {
+	if orgID == userID {
+		if err := s.EnsurePersonalOrganisation(ctx, userID); err != nil {
+			return nil, err
+		}
+	}
+	organisation, err := s.repository.GetOrganisation(ctx, orgID)
+	if err != nil {
+		return nil, err
+	}
+	if organisation == nil {
+		return nil, fmt.Errorf("organisation not found")
+	}
+	return organisation, nil
+}
+
+// ListMembers returns the members of an organisation the user is a member of.
+func (s *OrgService) ListMembers(ctx context.Context, orgID, userID string) ([]*Member, error) {
+	if orgID == userID {
+		if err := s.EnsurePersonalOrganisation(ctx, userID); err != nil {
+			return nil, err
+		}
+	}
+	return s.repository.ListMembers(ctx, orgID)
+}
+
+// MemberIDs returns the IDs of the users in the organisation. Organisations without member records are
+// the personal organisations of users that have not been migrated, so their only member is the user.
+func (s *OrgService) MemberIDs(ctx context.Context, orgID string) ([]string, error) {
+	members, err := s.repository.ListMembers(ctx, orgID)
+	if err != nil {
+		return nil, err
+	}
+	if len(members) == 0 {
+		return []string{orgID}, nil
+	}
+	ids := make([]string, 0, len(members))
+	for _, member := range members {
+		ids = append(ids, member.UserID)
+	}
+	return ids, nil
+}
+
+// OrgIDs returns the IDs of the organisations the user is a member of, starting with the personal one.
+func (s *OrgService) OrgIDs(ctx context.Context, userID string) ([]string, error) {
+	members, err := s.repository.ListUserMemberships(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{userID}
+	for _, member := range members {
+		if member.OrgID != userID {
+			ids = append(ids, member.OrgID)
+		}
+	}
+	return ids, nil
+}
+
+// UpdateMemberRole changes the role of a member. Only owners may grant or take away the owner role, and
+// the last owner keeps it.
+func (s *OrgService) UpdateMemberRole(ctx context.Context, orgID string, actorRole Role, userID string, role Role) (*Member, error) {
+	if !role.Valid() {
+		return nil, fmt.Errorf("invalid role %q, must be one of owner, admin, operator or viewer", role)
+	}
+	member, err := s.repository.GetMember(ctx, orgID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if member == nil {
+		return nil, fmt.Errorf("member not found")
+	}
+	if member.UserID == orgID {
+		return nil, fmt.Errorf("invalid role change: the owner of a personal organisation cannot be changed")
+	}
+	if member.Role == role {
+		return member, nil
+	}
+	if (role == RoleOwner || member.Role == RoleOwner) && !actorRole.Can(PermissionOwner) {
+		return nil, fmt.Errorf("only owners can grant or take away the owner role")
+	}
+	if member.Role == RoleOwner {
+		if err := s.keepOwner(ctx, orgID); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.repository.UpdateMemberRole(ctx, orgID, userID, role); err != nil {
+		return nil, err
+	}
+	log.Printf("Role of user %s in organisation %s changed from %s to %s", userID, orgID, member.Role, role)
+	member.Role = role
+	return member, nil
+}
+
+// RemoveMember removes a member from the organisation. Only owners may remove owners, and the last owner
+// cannot be removed.
+func (s *OrgService) RemoveMember(ctx context.Context, orgID string, actorRole Role, userID string) error {
+	member, err := s.repository.GetMember(ctx, orgID, userID)
+	if err != nil {
+		return err
+	}
+	if member == nil {
+		return fmt.Errorf("member not found")
+	}
+	if member.UserID == orgID {
+		return fmt.Errorf("invalid removal: the owner of a personal organisation cannot be removed")
+	}
+	if member.Role == RoleOwner {
+		if !actorRole.Can(PermissionOwner) {
+			return fmt.Errorf("only owners can grant or take away the owner role")
+		}
+		if err := s.keepOwner(ctx, orgID); err != nil {
+			return err
+		}
+	}
+
+	if err := s.repository.DeleteMember(ctx, orgID, userID); err != nil {
+		return err
+	}
+	log.Printf("User %s removed from organisation %s", userID, orgID)
+	return nil
+}
+
+// keepOwner returns an error if the organisation has a single owner.
+func (s *OrgService) keepOwner(ctx context.Context, orgID string) error {
+	owners, err := s.repository.CountOwners(ctx, orgID)
+	if err != nil {
+		return err
+	}
+	if owners <= 1 {
+		return fmt.Errorf("invalid change: an organisation must keep at least one owner")
+	}
+	return nil
+}
+
+// Invite invites the user with the email address to the organisation. The returned invitation holds the
+// token to accept it with, which is not stored and cannot be retrieved again.
+func (s *OrgService) Invite(ctx context.Context, orgID, actorID string, actorRole Role, req *InviteRequest) (*Invitation, error) {
+	email := strings.ToLower(strings.TrimSpace(req.Email))
+	if !strings.Contains(email, "@") {
+		return nil, fmt.Errorf("invalid invitation: email address is required")
+	}
+	if !req.Role.Valid() {
+		return nil, fmt.Errorf("invalid invitation: role %q must be one of owner, admin, operator or viewer", req.Role)
+	}
+	if req.Role == RoleOwner && !actorRole.Can(PermissionOwner) {
+		return nil, fmt.Errorf("only owners can grant or take away the owner role")
+	}
+	organisation, err := s.GetOrganisation(ctx, orgID, actorID)
+	if err != nil {
+		return nil, err
+	}
+	if organisation.Personal {
+		return nil, fmt.Errorf("invalid invitation: personal organisations cannot have other members")
+	}
+
+	random := token.GenerateRandomString(invitationTokenLength)
+	if random == "" {
+		return nil, fmt.Errorf("failed to generate invitation token")
+	}
+	secret := invitationTokenPrefix + random
+	now := time.Now()
+	invitation := &Invitation{
+		OrgID:       orgID,
+		Email:       email,
+		Role:        req.Role,
+		HashedToken: token.HashToken(secret),
+		InvitedBy:   actorID,
+		ExpiresAt:   now.Add(invitationTTL),
+		CreatedAt:   now,
+	}
+	if err := s.repository.InsertInvitation(ctx, invitation); err != nil {
+		return nil, err
+	}
+	invitation.Token = secret
+	log.Printf("Invitation %s to organisation %s created by user %s", invitation.ID.Hex(), orgID, actorID)
+	return invitation, nil
+}
+
+// ListInvitations returns the invitations of the organisation that can still be accepted.
+func (s *OrgService) ListInvitations(ctx context.Context, orgID string) ([]*Invitation, error) {
+	return s.repository.ListPendingInvitations(ctx, orgID, time.Now())
+}
+
+// RevokeInvitation deletes an invitation of the organisation, so it can no longer be accepted.
+func (s *OrgService) RevokeInvitation(ctx context.Context, orgID string, id bson.ObjectID) error {
+	invitation, err := s.repository.GetInvitation(ctx, id)
+	if err != nil {
+		return err
+	}
+	if invitation == nil {
+		return fmt.Errorf("invitation not found")
+	}
+	if invitation.OrgID != orgID {
+		return fmt.Errorf("invitation does not belong to organisation")
+	}
+	return s.repository.DeleteInvitation(ctx, id)
+}
+
+// AcceptInvitation adds the user to the organisation of the invitation, if it was sent to the email address
+// of the user. Users that already are members keep their role.
+func (s *OrgService) AcceptInvitation(ctx context.Context, userID, secret string) (*Membership, error) {
+	if !strings.HasPrefix(secret, invitationTokenPrefix) {
+		return nil, fmt.Errorf("invalid invitation token")
+	}
+	invitation, err := s.repository.GetInvitationByHashedToken(ctx, token.HashToken(secret))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	// Used and expired invitations are reported as missing so they tell nothing about the organisation
+	if invitation == nil || invitation.AcceptedAt != nil || !invitation.ExpiresAt.After(now) {
+		return nil, fmt.Errorf("invitation not found")
+	}
+	email, err := s.email(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(email, invitation.Email) {
+		return nil, fmt.Errorf("invitation is for another email address")
+	}
+
+	accepted, err := s.repository.AcceptInvitation(ctx, invitation.ID, userID, now)
+	if err != nil {
+		return nil, err
+	}
+	if !accepted {
+		return nil, fmt.Errorf("invitation not found")
+	}
+	if _, err := s.repository.AddMember(ctx, &Member{OrgID: invitation.OrgID, UserID: userID, Email: email, Role: invitation.Role, CreatedAt: now}); err != nil {
+		return nil, err
+	}
+	member, err := s.repository.GetMember(ctx, invitation.OrgID, userID)
+	if err != nil {
+		return nil, err
+	}
+	organisation, err := s.GetOrganisation(ctx, invitation.OrgID, userID)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("User %s joined organisation %s as %s", userID, invitation.OrgID, member.Role)
+	return &Membership{Organisation: organisation, Role: member.Role}, nil
+}
+
+// email returns the email address of the user.
+func (s *OrgService) email(ctx context.Context, userID string) (string, error) {
+	id, err := bson.ObjectIDFromHex(userID)
+	if err != nil {
+		return "", fmt.Errorf("invalid user ID format: %v", err)
+	}
+	u, err := s.users.GetUserByID(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	if u == nil {
+		return "", fmt.Errorf("user not found")
+	}
+	return u.Email, nil
+}
@@ -0,0 +1,194 @@
+package org
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+
+	"github.com/harshavmb/nannyapi/internal/user"
+)
+
+const testDBName = "test_db"
+
+func setupTestDB(t *testing.T) (*mongo.Client, func()) {
+	mongoURI := os.Getenv("MONGODB_URI")
+	clientOptions := options.Client().ApplyURI(mongoURI)
+	client, err := mongo.Connect(clientOptions)
+	if err != nil {
+		t.Fatalf("Failed to connect to MongoDB: %v", err)
+	}
+
+	// Cleanup function to drop the test collections after tests
+	cleanup := func() {
+		for _, name := range []string{"organisations", "org_members", "org_invitations", "users"} {
+			if err := client.Database(testDBName).Collection(name).Drop(context.Background()); err != nil {
+				t.Fatalf("Failed to drop test collection %s: %v", name, err)
+			}
+		}
+		if err := client.Disconnect(context.Background()); err != nil {
+			t.Fatalf("Failed to disconnect from MongoDB: %v", err)
+		}
+	}
+
+	return client, cleanup
+}
+
+func TestRoleCan(t *testing.T) {
+	assert.True(t, RoleViewer.Can(PermissionView))
+	assert.False(t, RoleViewer.Can(PermissionOperate))
+	assert.True(t, RoleOperator.Can(PermissionOperate))
+	assert.False(t, RoleOperator.Can(PermissionAdmin))
+	assert.True(t, RoleAdmin.Can(PermissionAdmin))
+	assert.False(t, RoleAdmin.Can(PermissionOwner))
+	assert.True(t, RoleOwner.Can(PermissionOwner))
+	assert.True(t, RoleOwner.Can(PermissionView))
+
+	assert.False(t, Role("").Can(PermissionView))
+	assert.False(t, Role("superuser").Can(PermissionView))
+	assert.False(t, RoleOwner.Can(Permission("delete")))
+}
+
+func TestRoleAtLeast(t *testing.T) {
+	assert.True(t, RoleOwner.AtLeast(RoleOwner))
+	assert.True(t, RoleOwner.AtLeast(RoleAdmin))
+	assert.False(t, RoleAdmin.AtLeast(RoleOwner))
+	assert.True(t, RoleAdmin.AtLeast(RoleViewer))
+	assert.False(t, Role("").AtLeast(RoleViewer))
+}
+
+func TestOrgService(t *testing.T) {
+	client, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	db := client.Database(testDBName)
+	userRepo := user.NewUserRepository(db)
+	service := NewOrgService(NewOrgRepository(db), user.NewUserService(userRepo))
+
+	newUser := func(email string) string {
+		u := &user.User{ID: bson.NewObjectID(), Email: email, Name: email}
+		_, err := userRepo.UpsertUser(ctx, u)
+		assert.NoError(t, err)
+		return u.ID.Hex()
+	}
+	owner := newUser("owner@example.com")
+	teammate := newUser("teammate@example.com")
+
+	t.Run("MigratePersonalOrganisations", func(t *testing.T) {
+		migrated, err := service.MigratePersonalOrganisations(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, migrated)
+
+		// Running it again changes nothing
+		migrated, err = service.MigratePersonalOrganisations(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, migrated)
+
+		organisation, err := service.GetOrganisation(ctx, owner, owner)
+		assert.NoError(t, err)
+		assert.True(t, organisation.Personal)
+		role, err := service.Authorize(ctx, owner, owner)
+		assert.NoError(t, err)
+		assert.Equal(t, RoleOwner, role)
+	})
+
+	membership, err := service.CreateOrganisation(ctx, owner, &CreateOrganisationRequest{Name: " Platform "})
+	assert.NoError(t, err)
+	assert.Equal(t, "Platform", membership.Name)
+	orgID := membership.ID
+
+	t.Run("InvalidName", func(t *testing.T) {
+		_, err := service.CreateOrganisation(ctx, owner, &CreateOrganisationRequest{Name: "  "})
+		assert.ErrorContains(t, err, "invalid organisation")
+	})
+
+	t.Run("Invitation", func(t *testing.T) {
+		_, err := service.Authorize(ctx, orgID, teammate)
+		assert.ErrorContains(t, err, "not a member")
+
+		_, err = service.Invite(ctx, owner, owner, RoleOwner, &InviteRequest{Email: "teammate@example.com", Role: RoleViewer})
+		assert.ErrorContains(t, err, "personal organisations cannot have other members")
+		_, err = service.Invite(ctx, orgID, owner, RoleAdmin, &InviteRequest{Email: "teammate@example.com", Role: RoleOwner})
+		assert.EqualError(t, err, "only owners can grant or take away the owner role")
+
+		invitation, err := service.Invite(ctx, orgID, owner, RoleOwner, &InviteRequest{Email: " Teammate@Example.com ", Role: RoleOperator})
+		assert.NoError(t, err)
+		assert.Equal(t, "teammate@example.com", invitation.Email)
+		invitations, err := service.ListInvitations(ctx, orgID)
+		assert.NoError(t, err)
+		assert.Len(t, invitations, 1)
+
+		_, err = service.AcceptInvitation(ctx, owner, invitation.Token)
+		assert.EqualError(t, err, "invitation is for another email address")
+		joined, err := service.AcceptInvitation(ctx, teammate, invitation.Token)
+		assert.NoError(t, err)
+		assert.Equal(t, RoleOperator, joined.Role)
+		_, err = service.AcceptInvitation(ctx, teammate, invitation.Token)
+		assert.EqualError(t, err, "invitation not found")
+
+		role, err := service.Authorize(ctx, orgID, teammate)
+		assert.NoError(t, err)
+		assert.Equal(t, RoleOperator, role)
+		invitations, err = service.ListInvitations(ctx, orgID)
+		assert.NoError(t, err)
+		assert.Empty(t, invitations)
+	})
+
+	t.Run("ExpiredInvitation", func(t *testing.T) {
+		invitation, err := service.Invite(ctx, orgID, owner, RoleOwner, &InviteRequest{Email: "late@example.com", Role: RoleViewer})
+		assert.NoError(t, err)
+		_, err = service.repository.invitations.UpdateByID(ctx, invitation.ID, bson.M{"$set": bson.M{"expires_at": time.Now().Add(-time.Minute)}})
+		assert.NoError(t, err)
+
+		_, err = service.AcceptInvitation(ctx, newUser("late@example.com"), invitation.Token)
+		assert.EqualError(t, err, "invitation not found")
+
+		err = service.RevokeInvitation(ctx, owner, invitation.ID)
+		assert.EqualError(t, err, "invitation does not belong to organisation")
+		assert.NoError(t, service.RevokeInvitation(ctx, orgID, invitation.ID))
+	})
+
+	t.Run("Members", func(t *testing.T) {
+		memberIDs, err := service.MemberIDs(ctx, orgID)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{owner, teammate}, memberIDs)
+		orgIDs, err := service.OrgIDs(ctx, teammate)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{teammate, orgID}, orgIDs)
+
+		memberships, err := service.ListOrganisations(ctx, teammate)
+		assert.NoError(t, err)
+		assert.Len(t, memberships, 2)
+		assert.True(t, memberships[0].Personal)
+	})
+
+	t.Run("Owners", func(t *testing.T) {
+		// The last owner keeps the role
+		_, err := service.UpdateMemberRole(ctx, orgID, RoleOwner, owner, RoleAdmin)
+		assert.ErrorContains(t, err, "must keep at least one owner")
+		assert.ErrorContains(t, service.RemoveMember(ctx, orgID, RoleOwner, owner), "must keep at least one owner")
+
+		_, err = service.UpdateMemberRole(ctx, orgID, RoleAdmin, teammate, RoleOwner)
+		assert.EqualError(t, err, "only owners can grant or take away the owner role")
+		member, err := service.UpdateMemberRole(ctx, orgID, RoleOwner, teammate, RoleOwner)
+		assert.NoError(t, err)
+		assert.Equal(t, RoleOwner, member.Role)
+
+		// With a second owner the first can leave
+		assert.NoError(t, service.RemoveMember(ctx, orgID, RoleOwner, owner))
+		_, err = service.Authorize(ctx, orgID, owner)
+		assert.ErrorContains(t, err, "not a member")
+	})
+
+	t.Run("PersonalOrganisation", func(t *testing.T) {
+		_, err := service.UpdateMemberRole(ctx, owner, RoleOwner, owner, RoleViewer)
+		assert.ErrorContains(t, err, "personal organisation")
+		assert.ErrorContains(t, service.RemoveMember(ctx, owner, RoleOwner, owner), "personal organisation")
+	})
+}
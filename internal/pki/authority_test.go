@@ -0,0 +1,107 @@
+package pki
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newCSR(t *testing.T, commonName string) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: commonName}}, key)
+	if err != nil {
+		t.Fatalf("Failed to create CSR: %v", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}))
+}
+
+func TestParseAuthority(t *testing.T) {
+	authority, err := NewAuthority(time.Now())
+	assert.NoError(t, err)
+	keyPEM, err := authority.keyPEM()
+	assert.NoError(t, err)
+
+	loaded, err := parseAuthority(authority.CertificatePEM(), keyPEM)
+	assert.NoError(t, err)
+	assert.True(t, loaded.cert.Equal(authority.cert))
+	assert.True(t, loaded.cert.IsCA)
+
+	_, err = parseAuthority([]byte("not a certificate"), keyPEM)
+	assert.Error(t, err)
+}
+
+func TestParseCSR(t *testing.T) {
+	_, err := ParseCSR(newCSR(t, "agent"))
+	assert.NoError(t, err)
+
+	_, err = ParseCSR("not a csr")
+	assert.ErrorContains(t, err, "invalid CSR")
+
+	weak, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(t, err)
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, weak)
+	assert.NoError(t, err)
+	_, err = ParseCSR(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})))
+	assert.ErrorContains(t, err, "at least 2048 bits")
+}
+
+func TestSign(t *testing.T) {
+	now := time.Now()
+	authority, err := NewAuthority(now)
+	assert.NoError(t, err)
+
+	// The subject asked for in the CSR is replaced by the agent
+	csr, err := ParseCSR(newCSR(t, "some-other-agent"))
+	assert.NoError(t, err)
+	cert, err := authority.Sign(csr, "agent-1", "user-1", now, time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, "agent-1", cert.Subject.CommonName)
+	assert.Equal(t, []string{"user-1"}, cert.Subject.Organization)
+	assert.Equal(t, "urn:nannyapi:agent:agent-1", cert.URIs[0].String())
+	assert.Equal(t, now.Add(time.Hour).Truncate(time.Second), cert.NotAfter.Local())
+
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots:       authority.CertPool(),
+		KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		CurrentTime: now,
+	})
+	assert.NoError(t, err)
+
+	// Certificates of another authority do not verify
+	other, err := NewAuthority(now)
+	assert.NoError(t, err)
+	_, err = cert.Verify(x509.VerifyOptions{Roots: other.CertPool(), KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, CurrentTime: now})
+	assert.Error(t, err)
+}
+
+func TestRevocationList(t *testing.T) {
+	now := time.Now()
+	authority, err := NewAuthority(now)
+	assert.NoError(t, err)
+	csr, err := ParseCSR(newCSR(t, ""))
+	assert.NoError(t, err)
+	cert, err := authority.Sign(csr, "agent-1", "user-1", now, time.Hour)
+	assert.NoError(t, err)
+
+	revokedAt := now.Truncate(time.Second)
+	der, err := authority.RevocationList([]*Certificate{{SerialNumber: cert.SerialNumber.Text(16), RevokedAt: &revokedAt}}, now, now.Add(crlValidity))
+	assert.NoError(t, err)
+
+	crl, err := x509.ParseRevocationList(der)
+	assert.NoError(t, err)
+	assert.NoError(t, crl.CheckSignatureFrom(authority.cert))
+	if assert.Len(t, crl.RevokedCertificateEntries, 1) {
+		assert.Equal(t, 0, crl.RevokedCertificateEntries[0].SerialNumber.Cmp(cert.SerialNumber))
+	}
+}
@@ -0,0 +1,37 @@
+package pki
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// authorityID is the ID of the single certificate authority document.
+const authorityID = "agent-ca"
+
+// storedAuthority is the certificate authority as it is kept in the database. The private key is
+// encrypted with the envelope of the server.
+type storedAuthority struct {
+	ID           string    `bson:"_id"`
+	Certificate  string    `bson:"certificate"`   // PEM encoded CA certificate
+	EncryptedKey string    `bson:"encrypted_key"` // PEM encoded PKCS #8 private key, encrypted
+	CreatedAt    time.Time `bson:"created_at"`
+}
+
+// Certificate is a client certificate issued to an agent.
+type Certificate struct {
+	ID           bson.ObjectID `json:"id" bson:"_id,omitempty"`
+	SerialNumber string        `json:"serial_number" bson:"serial_number"` // Hex encoded
+	AgentID      string        `json:"agent_id" bson:"agent_id"`           // Also the subject common name
+	UserID       string        `json:"user_id" bson:"user_id"`             // Owning organisation, which is the user ID for personal organisations
+	Fingerprint  string        `json:"fingerprint" bson:"fingerprint"`     // SHA-256 of the DER certificate, hex encoded
+	NotBefore    time.Time     `json:"not_before" bson:"not_before"`
+	NotAfter     time.Time     `json:"not_after" bson:"not_after"`
+	CreatedAt    time.Time     `json:"created_at" bson:"created_at"`
+	RevokedAt    *time.Time    `json:"revoked_at,omitempty" bson:"revoked_at,omitempty"`
+}
+
+// CertificateRequest asks for a certificate for an agent.
+type CertificateRequest struct {
+	CSR string `json:"csr"` // PEM encoded certificate signing request
+}
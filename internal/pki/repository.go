@@ -0,0 +1,135 @@
+package pki
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+
+	"github.com/harshavmb/nannyapi/internal/token"
+)
+
+type CertificateRepository struct {
+	authorities  *mongo.Collection
+	certificates *mongo.Collection
+}
+
+// authoritiesCollection holds the certificate authority. Its name is part of the additional data of the
+// encrypted private key.
+const authoritiesCollection = "certificate_authorities"
+
+// authorityKeyAAD is the additional data the private key of the certificate authority is encrypted with.
+var authorityKeyAAD = token.AAD(authoritiesCollection, "encrypted_key", authorityID)
+
+func NewCertificateRepository(db *mongo.Database) *CertificateRepository {
+	return &CertificateRepository{
+		authorities:  db.Collection(authoritiesCollection),
+		certificates: db.Collection("agent_certificates"),
+	}
+}
+
+// EncryptedField returns the field holding the private key of the authority, encrypted with the envelope.
+func (r *CertificateRepository) EncryptedField() token.EncryptedField {
+	return token.EncryptedField{Collection: r.authorities, Field: "encrypted_key"}
+}
+
+// getAuthority returns the stored certificate authority, or nil if none was created yet.
+func (r *CertificateRepository) getAuthority(ctx context.Context) (*storedAuthority, error) {
+	var stored storedAuthority
+	err := r.authorities.FindOne(ctx, bson.M{"_id": authorityID}).Decode(&stored)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to retrieve certificate authority: %v", err)
+	}
+	return &stored, nil
+}
+
+// insertAuthority stores the certificate authority. It reports false when another instance stored one first.
+func (r *CertificateRepository) insertAuthority(ctx context.Context, stored *storedAuthority) (bool, error) {
+	if _, err := r.authorities.InsertOne(ctx, stored); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to insert certificate authority: %v", err)
+	}
+	return true, nil
+}
+
+func (r *CertificateRepository) InsertCertificate(ctx context.Context, cert *Certificate) error {
+	result, err := r.certificates.InsertOne(ctx, cert)
+	if err != nil {
+		return fmt.Errorf("failed to insert certificate: %v", err)
+	}
+	cert.ID = result.InsertedID.(bson.ObjectID)
+	return nil
+}
+
+// GetCertificate returns the certificate with the ID, or nil if there is none.
+func (r *CertificateRepository) GetCertificate(ctx context.Context, id bson.ObjectID) (*Certificate, error) {
+	return r.findCertificate(ctx, bson.M{"_id": id})
+}
+
+// GetCertificateBySerial returns the certificate with the hex serial number, or nil if there is none.
+func (r *CertificateRepository) GetCertificateBySerial(ctx context.Context, serialNumber string) (*Certificate, error) {
+	return r.findCertificate(ctx, bson.M{"serial_number": serialNumber})
+}
+
+func (r *CertificateRepository) findCertificate(ctx context.Context, filter bson.M) (*Certificate, error) {
+	var cert Certificate
+	err := r.certificates.FindOne(ctx, filter).Decode(&cert)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to retrieve certificate: %v", err)
+	}
+	return &cert, nil
+}
+
+// ListCertificates returns the certificates of an agent, newest first.
+func (r *CertificateRepository) ListCertificates(ctx context.Context, agentID string) ([]*Certificate, error) {
+	return r.listCertificates(ctx, bson.M{"agent_id": agentID})
+}
+
+// ListRevoked returns the revoked certificates that have not expired yet.
+func (r *CertificateRepository) ListRevoked(ctx context.Context, now time.Time) ([]*Certificate, error) {
+	return r.listCertificates(ctx, bson.M{"revoked_at": bson.M{"$exists": true}, "not_after": bson.M{"$gt": now}})
+}
+
+func (r *CertificateRepository) listCertificates(ctx context.Context, filter bson.M) ([]*Certificate, error) {
+	opts := options.Find().SetSort(bson.M{"created_at": -1})
+	cursor, err := r.certificates.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list certificates: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	var certs []*Certificate
+	if err := cursor.All(ctx, &certs); err != nil {
+		return nil, fmt.Errorf("failed to decode certificates: %v", err)
+	}
+	return certs, nil
+}
+
+func (r *CertificateRepository) RevokeCertificate(ctx context.Context, id bson.ObjectID, revokedAt time.Time) error {
+	if _, err := r.certificates.UpdateByID(ctx, id, bson.M{"$set": bson.M{"revoked_at": revokedAt}}); err != nil {
+		return fmt.Errorf("failed to revoke certificate: %v", err)
+	}
+	return nil
+}
+
+// RevokeAgentCertificates revokes the certificates of an agent that are not revoked yet and returns how many
+// were revoked.
+func (r *CertificateRepository) RevokeAgentCertificates(ctx context.Context, agentID string, revokedAt time.Time) (int64, error) {
+	filter := bson.M{"agent_id": agentID, "revoked_at": bson.M{"$exists": false}}
+	result, err := r.certificates.UpdateMany(ctx, filter, bson.M{"$set": bson.M{"revoked_at": revokedAt}})
+	if err != nil {
+		return 0, fmt.Errorf("failed to revoke agent certificates: %v", err)
+	}
+	return result.ModifiedCount, nil
+}
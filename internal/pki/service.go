@@ -0,0 +1,274 @@
+package pki
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+
+	"github.com/harshavmb/nannyapi/internal/agent"
+	"github.com/harshavmb/nannyapi/internal/token"
+)
+
+const (
+	defaultValidity    = 30 * 24 * time.Hour
+	defaultRenewBefore = 7 * 24 * time.Hour
+	// crlValidity is how long a served CRL is valid; clients fetch a new one after that.
+	crlValidity = time.Hour
+)
+
+// Config holds the settings of agent client certificates.
+type Config struct {
+	Validity    time.Duration // How long issued certificates are valid
+	RenewBefore time.Duration // How long before expiry agents are told to rotate their certificate
+}
+
+// DefaultConfig returns the default certificate settings.
+func DefaultConfig() Config {
+	return Config{
+		Validity:    defaultValidity,
+		RenewBefore: defaultRenewBefore,
+	}
+}
+
+// ConfigFromEnv reads AGENT_CERT_VALIDITY and AGENT_CERT_RENEW_BEFORE, falling back to the defaults for
+// any variable that is not set.
+func ConfigFromEnv() (Config, error) {
+	config := DefaultConfig()
+
+	if value := os.Getenv("AGENT_CERT_VALIDITY"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < time.Hour {
+			return config, fmt.Errorf("invalid AGENT_CERT_VALIDITY %q, must be at least 1h", value)
+		}
+		config.Validity = d
+	}
+	if value := os.Getenv("AGENT_CERT_RENEW_BEFORE"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return config, fmt.Errorf("invalid AGENT_CERT_RENEW_BEFORE %q, must be a positive duration", value)
+		}
+		config.RenewBefore = d
+	}
+	if config.RenewBefore >= config.Validity {
+		return config, fmt.Errorf("invalid AGENT_CERT_RENEW_BEFORE %s, must be less than AGENT_CERT_VALIDITY %s", config.RenewBefore, config.Validity)
+	}
+	return config, nil
+}
+
+// LoadAuthority returns the certificate authority stored in the database, creating it on first use.
+// The private key is stored encrypted with the envelope.
+func LoadAuthority(ctx context.Context, repository *CertificateRepository, envelope *token.Envelope) (*Authority, error) {
+	stored, err := repository.getAuthority(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if stored == nil {
+		authority, err := NewAuthority(time.Now())
+		if err != nil {
+			return nil, err
+		}
+		keyPEM, err := authority.keyPEM()
+		if err != nil {
+			return nil, err
+		}
+		encryptedKey, err := envelope.Encrypt(string(keyPEM), authorityKeyAAD)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt CA key: %v", err)
+		}
+		stored = &storedAuthority{
+			ID:           authorityID,
+			Certificate:  string(authority.CertificatePEM()),
+			EncryptedKey: encryptedKey,
+			CreatedAt:    time.Now(),
+		}
+		inserted, err := repository.insertAuthority(ctx, stored)
+		if err != nil {
+			return nil, err
+		}
+		if inserted {
+			log.Printf("Created agent certificate authority")
+			return authority, nil
+		}
+		// Another instance created the authority at the same time, use theirs
+		if stored, err = repository.getAuthority(ctx); err != nil || stored == nil {
+			return nil, fmt.Errorf("failed to load certificate authority: %v", err)
+		}
+	}
+
+	keyPEM, err := envelope.Decrypt(stored.EncryptedKey, authorityKeyAAD)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt CA key: %v", err)
+	}
+	return parseAuthority([]byte(stored.Certificate), []byte(keyPEM))
+}
+
+// fingerprint returns the hex SHA-256 of a DER certificate.
+func fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// CertificateService issues, rotates and revokes agent client certificates and authenticates agents
+// that present them.
+type CertificateService struct {
+	repository   *CertificateRepository
+	authority    *Authority
+	agentService *agent.AgentInfoService
+	config       Config
+}
+
+func NewCertificateService(repository *CertificateRepository, authority *Authority, agentService *agent.AgentInfoService, config Config) *CertificateService {
+	return &CertificateService{
+		repository:   repository,
+		authority:    authority,
+		agentService: agentService,
+		config:       config,
+	}
+}
+
+// Authority returns the certificate authority that issues the agent certificates.
+func (s *CertificateService) Authority() *Authority {
+	return s.authority
+}
+
+// CheckCSR validates a PEM certificate signing request.
+func (s *CertificateService) CheckCSR(csrPEM string) error {
+	_, err := ParseCSR(csrPEM)
+	return err
+}
+
+// IssueCertificate signs the request for the agent and records the certificate.
+func (s *CertificateService) IssueCertificate(ctx context.Context, csrPEM, agentID, userID string) (*agent.IssuedCertificate, error) {
+	csr, err := ParseCSR(csrPEM)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	cert, err := s.authority.Sign(csr, agentID, userID, now, s.config.Validity)
+	if err != nil {
+		return nil, err
+	}
+
+	record := &Certificate{
+		SerialNumber: cert.SerialNumber.Text(16),
+		AgentID:      agentID,
+		UserID:       userID,
+		Fingerprint:  fingerprint(cert.Raw),
+		NotBefore:    cert.NotBefore,
+		NotAfter:     cert.NotAfter,
+		CreatedAt:    now,
+	}
+	if err := s.repository.InsertCertificate(ctx, record); err != nil {
+		return nil, err
+	}
+	log.Printf("Certificate %s issued to agent %s, expires %s", record.SerialNumber, agentID, cert.NotAfter.Format(time.RFC3339))
+
+	return &agent.IssuedCertificate{
+		ID:            record.ID.Hex(),
+		Certificate:   string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})),
+		CACertificate: string(s.authority.CertificatePEM()),
+		NotAfter:      cert.NotAfter,
+		RenewAfter:    cert.NotAfter.Add(-s.config.RenewBefore),
+	}, nil
+}
+
+// ownedAgent checks that the agent belongs to the user.
+func (s *CertificateService) ownedAgent(ctx context.Context, agentID bson.ObjectID, userID string) error {
+	agentInfo, err := s.agentService.GetAgentInfoByID(ctx, agentID)
+	if err != nil {
+		return err
+	}
+	if agentInfo == nil {
+		return fmt.Errorf("agent not found")
+	}
+	if agentInfo.UserID != userID {
+		return fmt.Errorf("agent does not belong to user")
+	}
+	return nil
+}
+
+// RotateCertificate issues a new certificate to an agent of the user. Earlier certificates stay valid
+// until they expire or are revoked, so the agent can switch over without downtime.
+func (s *CertificateService) RotateCertificate(ctx context.Context, agentID bson.ObjectID, userID, csrPEM string) (*agent.IssuedCertificate, error) {
+	if err := s.ownedAgent(ctx, agentID, userID); err != nil {
+		return nil, err
+	}
+	return s.IssueCertificate(ctx, csrPEM, agentID.Hex(), userID)
+}
+
+// ListCertificates returns the certificates of an agent of the user, newest first.
+func (s *CertificateService) ListCertificates(ctx context.Context, agentID bson.ObjectID, userID string) ([]*Certificate, error) {
+	if err := s.ownedAgent(ctx, agentID, userID); err != nil {
+		return nil, err
+	}
+	return s.repository.ListCertificates(ctx, agentID.Hex())
+}
+
+// RevokeCertificate revokes a certificate of the user. It is rejected from then on and listed in the CRL
+// until it expires.
+func (s *CertificateService) RevokeCertificate(ctx context.Context, id bson.ObjectID, userID string) (*Certificate, error) {
+	cert, err := s.repository.GetCertificate(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if cert == nil {
+		return nil, fmt.Errorf("certificate not found")
+	}
+	if cert.UserID != userID {
+		return nil, fmt.Errorf("certificate does not belong to user")
+	}
+	if cert.RevokedAt != nil {
+		return nil, fmt.Errorf("invalid certificate transition: certificate is already revoked")
+	}
+
+	now := time.Now()
+	if err := s.repository.RevokeCertificate(ctx, id, now); err != nil {
+		return nil, err
+	}
+	cert.RevokedAt = &now
+	log.Printf("Certificate %s of agent %s revoked by user %s", cert.SerialNumber, cert.AgentID, userID)
+	return cert, nil
+}
+
+// RevokeAgentCertificates revokes every certificate of an agent and returns how many were revoked. They
+// are listed in the revocation list until they expire.
+func (s *CertificateService) RevokeAgentCertificates(ctx context.Context, agentID string) (int64, error) {
+	return s.repository.RevokeAgentCertificates(ctx, agentID, time.Now())
+}
+
+// Authenticate returns the record of a client certificate the TLS handshake verified against the
+// authority, unless it was revoked.
+func (s *CertificateService) Authenticate(ctx context.Context, leaf *x509.Certificate) (*Certificate, error) {
+	cert, err := s.repository.GetCertificateBySerial(ctx, leaf.SerialNumber.Text(16))
+	if err != nil {
+		return nil, err
+	}
+	if cert == nil || cert.Fingerprint != fingerprint(leaf.Raw) {
+		return nil, fmt.Errorf("unknown certificate")
+	}
+	if cert.RevokedAt != nil {
+		return nil, fmt.Errorf("certificate is revoked")
+	}
+	if cert.AgentID != leaf.Subject.CommonName {
+		return nil, fmt.Errorf("certificate subject does not match agent")
+	}
+	return cert, nil
+}
+
+// RevocationList returns the DER CRL of the revoked certificates that have not expired.
+func (s *CertificateService) RevocationList(ctx context.Context) ([]byte, error) {
+	now := time.Now()
+	revoked, err := s.repository.ListRevoked(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+	return s.authority.RevocationList(revoked, now, now.Add(crlValidity))
+}
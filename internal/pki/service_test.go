@@ -0,0 +1,43 @@
+package pki
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Run("Defaults", func(t *testing.T) {
+		t.Setenv("AGENT_CERT_VALIDITY", "")
+		t.Setenv("AGENT_CERT_RENEW_BEFORE", "")
+		config, err := ConfigFromEnv()
+		assert.NoError(t, err)
+		assert.Equal(t, DefaultConfig(), config)
+	})
+
+	t.Run("Overrides", func(t *testing.T) {
+		t.Setenv("AGENT_CERT_VALIDITY", "48h")
+		t.Setenv("AGENT_CERT_RENEW_BEFORE", "12h")
+		config, err := ConfigFromEnv()
+		assert.NoError(t, err)
+		assert.Equal(t, 48*time.Hour, config.Validity)
+		assert.Equal(t, 12*time.Hour, config.RenewBefore)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		for name, env := range map[string]map[string]string{
+			"ShortValidity":     {"AGENT_CERT_VALIDITY": "30m", "AGENT_CERT_RENEW_BEFORE": ""},
+			"NegativeRenewal":   {"AGENT_CERT_VALIDITY": "", "AGENT_CERT_RENEW_BEFORE": "-1h"},
+			"RenewalPastExpiry": {"AGENT_CERT_VALIDITY": "24h", "AGENT_CERT_RENEW_BEFORE": "24h"},
+		} {
+			t.Run(name, func(t *testing.T) {
+				for key, value := range env {
+					t.Setenv(key, value)
+				}
+				_, err := ConfigFromEnv()
+				assert.Error(t, err)
+			})
+		}
+	})
+}
@@ -1,22 +1,12 @@
 package server
 
 import (
-	"context"
 	"encoding/json"
 	"fmt"
 	"mime"
 	"net/http"
 	"regexp"
 	"strings"
-	"time"
-
-	"github.com/golang-jwt/jwt"
-
-	"github.com/harshavmb/nannyapi/internal/token"
-)
-
-const (
-	Issuer = "https://nannyai.dev"
 )
 
 // parseRequestJSON populates the target with the fields of the JSON-encoded value in the request
@@ -70,64 +60,3 @@ func IsValidEmail(email string) bool {
 
 	return true
 }
-
-func generateRefreshToken(userID, jwtSecret string) (string, error) {
-	expirationTime := time.Now().Add(30 * 24 * time.Hour) // 30 days
-
-	claims := &token.Claims{
-		UserID: userID,
-		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: expirationTime.Unix(),
-			IssuedAt:  time.Now().Unix(),
-			Issuer:    Issuer,
-		},
-	}
-
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(jwtSecret))
-}
-
-func generateAccessToken(userID, jwtSecret string) (string, error) {
-	expirationTime := time.Now().Add(15 * time.Minute) // 15 minutes
-
-	claims := &token.Claims{
-		UserID: userID,
-		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: expirationTime.Unix(),
-			IssuedAt:  time.Now().Unix(),
-			Issuer:    Issuer,
-		},
-	}
-
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(jwtSecret))
-}
-
-func (s *Server) validateRefreshToken(ctx context.Context, tokenString, jwtSecret string) (bool, *token.Claims, error) {
-	hashedToken := token.HashToken(tokenString)
-
-	// Validate the refresh token
-	claims, err := token.ValidateJWTToken(tokenString, jwtSecret)
-	if err != nil {
-		return false, nil, err
-	}
-	// Check if the token exists in the database and is not revoked
-	refreshToken, err := s.refreshTokenservice.GetRefreshTokenByHashedToken(ctx, hashedToken)
-	if err != nil {
-		return false, claims, err
-	}
-	if refreshToken != nil {
-		// Check if the token is revoked
-		if refreshToken.Revoked {
-			return false, claims, fmt.Errorf("refresh token revoked")
-		}
-
-		// Check if the token has expired
-		if time.Now().After(refreshToken.ExpiresAt) {
-			return false, claims, fmt.Errorf("refresh token expired")
-		}
-
-		return true, claims, nil
-	}
-	return false, nil, nil
-}
@@ -1,30 +1,99 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"crypto/x509"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"strings"
+	"time"
 
 	"go.mongodb.org/mongo-driver/v2/mongo"
 
+	"github.com/harshavmb/nannyapi/internal/agent"
+	"github.com/harshavmb/nannyapi/internal/auth"
+	"github.com/harshavmb/nannyapi/internal/org"
 	"github.com/harshavmb/nannyapi/internal/token"
 )
 
 type contextKey string
 
 const (
-	userContextKey contextKey = "userID"
+	userContextKey  contextKey = "userID"
+	agentContextKey contextKey = "agentID"
+	tokenContextKey contextKey = "staticToken"
+	orgContextKey   contextKey = "orgID"
+	roleContextKey  contextKey = "role"
 )
 
+// OrgHeader selects the organisation a request with an access token acts in. Without it requests act in
+// the personal organisation of the user; API keys and agents always act in the organisation they belong to.
+const OrgHeader = "X-NANNYAPI-Org"
+
+// maxSignedBodySize limits the body of signed requests, which is read in full to check its hash.
+const maxSignedBodySize = 10 << 20
+
 // AuthMiddleware authenticates requests using the Authorization header.
 func (s *Server) AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Check for the Authorization header
 		authHeader := r.Header.Get("Authorization")
 		apiKeyHeader := r.Header.Get("X-NANNYAPI-Key")
+
+		// Agents behind TLS-terminating proxies can sign requests with their credential instead of sending it
+		if signature := r.Header.Get(agent.SignatureHeader); signature != "" {
+			if authHeader != "" || apiKeyHeader != "" {
+				http.Error(w, "Signed requests must not carry Authorization/X-NANNYAPI-Key headers", http.StatusUnauthorized)
+				return
+			}
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSignedBodySize))
+			if err != nil {
+				http.Error(w, "Failed to read request body", http.StatusBadRequest)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			credential, err := s.enrollmentService.VerifySignature(r.Context(), &agent.SignedRequest{
+				KeyID:     r.Header.Get(agent.SignatureKeyIDHeader),
+				Timestamp: r.Header.Get(agent.SignatureTimestampHeader),
+				Nonce:     r.Header.Get(agent.SignatureNonceHeader),
+				Signature: signature,
+				Method:    r.Method,
+				Path:      r.URL.RequestURI(),
+				Body:      body,
+			})
+			if err != nil {
+				log.Printf("Request signature validation failed: %v", err)
+				http.Error(w, "Invalid request signature", http.StatusUnauthorized)
+				return
+			}
+			if !checkRequestedOrg(w, r, credential.UserID) {
+				return
+			}
+			ctx := context.WithValue(r.Context(), agentContextKey, credential.AgentID)
+			next.ServeHTTP(w, r.WithContext(withOrg(ctx, credential.UserID, org.RoleOperator)))
+			return
+		}
+
+		// Agents with a client certificate issued by the internal CA need no header
 		if authHeader == "" && apiKeyHeader == "" {
+			if leaf := verifiedClientCertificate(r); leaf != nil {
+				cert, err := s.certificateService.Authenticate(r.Context(), leaf)
+				if err != nil {
+					log.Printf("Client certificate validation failed: %v", err)
+					http.Error(w, "Invalid client certificate passed", http.StatusUnauthorized)
+					return
+				}
+				if !checkRequestedOrg(w, r, cert.UserID) {
+					return
+				}
+				ctx := context.WithValue(r.Context(), agentContextKey, cert.AgentID)
+				next.ServeHTTP(w, r.WithContext(withOrg(ctx, cert.UserID, org.RoleOperator)))
+				return
+			}
 			http.Error(w, "One of Authorization/X-NANNYAPI-Key headers is required", http.StatusUnauthorized)
 			return
 		}
@@ -34,10 +103,20 @@ func (s *Server) AuthMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		var userID string
+		var userID, orgID, agentID string
+		var staticToken *token.Token
 
-		// Extract the key from the header (assuming an API key)
-		if apiKeyHeader != "" {
+		// Agent credentials authenticate a single agent, see agentScope for where they are accepted
+		if agent.IsCredential(apiKeyHeader) {
+			credential, err := s.enrollmentService.Authenticate(r.Context(), apiKeyHeader)
+			if err != nil {
+				log.Printf("Agent credential validation failed: %v", err)
+				http.Error(w, "Invalid agent credential passed", http.StatusUnauthorized)
+				return
+			}
+			orgID = credential.UserID
+			agentID = credential.AgentID
+		} else if apiKeyHeader != "" {
 			// Validate the static token against the database
 			userToken, err := s.validateStaticToken(r.Context(), apiKeyHeader)
 			if err != nil {
@@ -45,7 +124,20 @@ func (s *Server) AuthMiddleware(next http.Handler) http.Handler {
 				http.Error(w, "Invalid API key passed", http.StatusUnauthorized)
 				return
 			}
-			userID = userToken.UserID
+			// Clients still on the previous secret of a rotated token can tell from the response
+			secret := userToken.Secret(token.HashToken(apiKeyHeader))
+			w.Header().Set(token.SecretHeader, secret)
+			if secret == token.SecretPrevious {
+				log.Printf("Auth token %s used with its previous secret from %s, valid until %s", userToken.ID.Hex(), auth.RemoteIP(r), userToken.GraceEndsAt.Format(time.RFC3339))
+			}
+			if err := s.tokenService.TouchToken(r.Context(), userToken.ID, auth.RemoteIP(r), secret == token.SecretPrevious); err != nil {
+				log.Printf("Failed to record use of auth token %s: %v", userToken.ID.Hex(), err)
+			}
+			orgID = userToken.UserID
+			userID = userToken.Creator()
+			// Tokens bound to an agent get the same restrictions as the credential of that agent
+			agentID = userToken.AgentID
+			staticToken = userToken
 		}
 
 		// Check whether valid accessToken is passed
@@ -60,18 +152,49 @@ func (s *Server) AuthMiddleware(next http.Handler) http.Handler {
 			}
 
 			// Validate the accessToken
-			userToken, err := token.ValidateJWTToken(tokenString, s.jwtSecret)
+			userToken, err := s.keys.ValidateJWTToken(tokenString, "access")
 			if err != nil {
 				log.Printf("Invalid access token: %v", err)
 				http.Error(w, "Invalid access token", http.StatusUnauthorized)
 				return
 			}
 			userID = userToken.UserID
+			orgID = r.Header.Get(OrgHeader)
+			if orgID == "" {
+				orgID = userID
+			}
+		} else if !checkRequestedOrg(w, r, orgID) {
+			return
 		}
 
-		if userID != "" {
+		if orgID != "" {
+			// Agents act as operators of their organisation, users and their API keys with the role of the user
+			role := org.RoleOperator
+			if userID != "" {
+				var err error
+				role, err = s.orgService.Authorize(r.Context(), orgID, userID)
+				if err != nil {
+					if strings.Contains(err.Error(), "not a member") {
+						http.Error(w, "User is not a member of the organisation", http.StatusForbidden)
+						return
+					}
+					log.Printf("Failed to authorize user %s in organisation %s: %v", userID, orgID, err)
+					http.Error(w, "Failed to authorize request", http.StatusInternalServerError)
+					return
+				}
+			}
+
 			// Add the user information to the request context
-			ctx := context.WithValue(r.Context(), userContextKey, userID)
+			ctx := withOrg(r.Context(), orgID, role)
+			if userID != "" {
+				ctx = context.WithValue(ctx, userContextKey, userID)
+			}
+			if agentID != "" {
+				ctx = context.WithValue(ctx, agentContextKey, agentID)
+			}
+			if staticToken != nil {
+				ctx = context.WithValue(ctx, tokenContextKey, staticToken)
+			}
 			r = r.WithContext(ctx)
 		}
 
@@ -80,7 +203,33 @@ func (s *Server) AuthMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-// GetUserFromContext retrieves the token information from the request context.
+// verifiedClientCertificate returns the client certificate of the request if the TLS handshake verified it
+// against the internal CA.
+func verifiedClientCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// checkRequestedOrg reports whether the organisation selected with the OrgHeader, if any, is the one the
+// agent or API key belongs to; it writes a 403 otherwise.
+func checkRequestedOrg(w http.ResponseWriter, r *http.Request, orgID string) bool {
+	if requested := r.Header.Get(OrgHeader); requested != "" && requested != orgID {
+		http.Error(w, "Credential is not valid for this organisation", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// withOrg adds the organisation the request acts in and the role of the caller in it to the context.
+func withOrg(ctx context.Context, orgID string, role org.Role) context.Context {
+	ctx = context.WithValue(ctx, orgContextKey, orgID)
+	return context.WithValue(ctx, roleContextKey, role)
+}
+
+// GetUserFromContext returns the ID of the user making the request, or of the user who created the API key
+// it was made with. Requests of agents have none.
 func GetUserFromContext(r *http.Request) (string, bool) {
 	userID, ok := r.Context().Value(userContextKey).(string)
 	if !ok {
@@ -89,6 +238,127 @@ func GetUserFromContext(r *http.Request) (string, bool) {
 	return userID, ok
 }
 
+// GetOrgFromContext returns the ID of the organisation the request acts in. Resources of the organisation
+// carry it in their user_id field.
+func GetOrgFromContext(r *http.Request) (string, bool) {
+	orgID, ok := r.Context().Value(orgContextKey).(string)
+	return orgID, ok
+}
+
+// GetRoleFromContext returns the role of the caller in the organisation the request acts in.
+func GetRoleFromContext(r *http.Request) (org.Role, bool) {
+	role, ok := r.Context().Value(roleContextKey).(org.Role)
+	return role, ok
+}
+
+// GetAgentFromContext returns the agent ID of requests authenticated with an agent credential.
+func GetAgentFromContext(r *http.Request) (string, bool) {
+	agentID, ok := r.Context().Value(agentContextKey).(string)
+	return agentID, ok
+}
+
+// routeScope is the authorisation layer of the API endpoints. It rejects requests to endpoints registered
+// with handleSessionRoute unless they are authenticated with an access token, requests authenticated with an
+// agent credential, unless they go to an endpoint registered with handleAgentRoute, requests authenticated
+// with a static token that lacks the scope of the endpoint, and requests whose caller lacks the permission
+// of the endpoint in the organisation the request acts in.
+func (s *Server) routeScope(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		if pattern == "" {
+			mux.ServeHTTP(w, r)
+			return
+		}
+		_, isAgent := GetAgentFromContext(r)
+		staticToken, isStaticToken := r.Context().Value(tokenContextKey).(*token.Token)
+		if s.sessionRoutes[pattern] && (isAgent || isStaticToken) {
+			http.Error(w, "This endpoint requires a login session", http.StatusForbidden)
+			return
+		}
+		if isAgent && !s.agentRoutes[pattern] {
+			http.Error(w, "Agent credentials are only valid on agent endpoints", http.StatusForbidden)
+			return
+		}
+		if isStaticToken && !s.tokenAllows(staticToken, pattern) {
+			http.Error(w, "API key does not have the scope required by this endpoint", http.StatusForbidden)
+			return
+		}
+		permission, ok := s.routePermissions[pattern]
+		if !ok {
+			log.Printf("Endpoint %s is registered without a permission", pattern)
+			http.Error(w, "Endpoint is not available", http.StatusInternalServerError)
+			return
+		}
+		role, ok := GetRoleFromContext(r)
+		if !ok {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+		if !role.Can(permission) {
+			http.Error(w, fmt.Sprintf("The %s role does not have the %s permission required by this endpoint", role, permission), http.StatusForbidden)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// tokenAllows reports whether the static token may call the endpoint. Scoped tokens may only call endpoints
+// registered with a scope they have; unscoped tokens may call all of them.
+func (s *Server) tokenAllows(staticToken *token.Token, pattern string) bool {
+	if len(staticToken.Scopes) == 0 {
+		return true
+	}
+	scope, ok := s.routeScopes[pattern]
+	if !ok {
+		return false
+	}
+	return scope == "" || staticToken.HasScope(scope)
+}
+
+// checkAgentScope reports whether the request may act on the agent. Requests authenticated with an agent
+// credential may only act on their own agent; it writes a 403 otherwise.
+func checkAgentScope(w http.ResponseWriter, r *http.Request, agentID string) bool {
+	if credentialAgentID, ok := GetAgentFromContext(r); ok && credentialAgentID != agentID {
+		http.Error(w, "Agent credential is not valid for this agent", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// ownAgent wraps a handler of an /api/agent-info/{id} endpoint so agent credentials can only call it for
+// their own agent.
+func ownAgent(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !checkAgentScope(w, r, r.PathValue("id")) {
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// checkSessionScope is checkAgentScope for the agent of a diagnostic session.
+func (s *Server) checkSessionScope(w http.ResponseWriter, r *http.Request, sessionID string) bool {
+	if _, ok := GetAgentFromContext(r); !ok {
+		return true
+	}
+	orgID, _ := GetOrgFromContext(r)
+	session, err := s.diagnosticService.GetDiagnosticSession(r.Context(), sessionID, orgID)
+	if err != nil {
+		if strings.Contains(err.Error(), "session not found") {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return false
+		}
+		if strings.Contains(err.Error(), "does not belong") {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return false
+		}
+		log.Printf("Failed to retrieve session %s: %v", sessionID, err)
+		http.Error(w, "Failed to retrieve session", http.StatusInternalServerError)
+		return false
+	}
+	return checkAgentScope(w, r, session.AgentID)
+}
+
 func (s *Server) validateStaticToken(ctx context.Context, tokenString string) (*token.Token, error) {
 	// Hash the token
 	hashedToken := token.HashToken(tokenString)
@@ -101,6 +371,12 @@ func (s *Server) validateStaticToken(ctx context.Context, tokenString string) (*
 		}
 		return nil, fmt.Errorf("failed to find auth token: %w", err)
 	}
+	if token == nil {
+		return nil, fmt.Errorf("auth token not found")
+	}
+	if token.Expired(time.Now()) {
+		return nil, fmt.Errorf("auth token %s has expired", token.ID.Hex())
+	}
 
 	return token, nil
 }
@@ -1,12 +1,12 @@
 package server
 
 import (
-	"context"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"encoding/json"
 
@@ -16,8 +16,18 @@ import (
 	"go.mongodb.org/mongo-driver/v2/mongo"
 
 	"github.com/harshavmb/nannyapi/internal/agent"
+	"github.com/harshavmb/nannyapi/internal/alert"
 	"github.com/harshavmb/nannyapi/internal/auth"
+	"github.com/harshavmb/nannyapi/internal/campaign"
+	"github.com/harshavmb/nannyapi/internal/connection"
+	"github.com/harshavmb/nannyapi/internal/decommission"
 	"github.com/harshavmb/nannyapi/internal/diagnostic"
+	"github.com/harshavmb/nannyapi/internal/job"
+	"github.com/harshavmb/nannyapi/internal/merge"
+	"github.com/harshavmb/nannyapi/internal/metrics"
+	"github.com/harshavmb/nannyapi/internal/notification"
+	"github.com/harshavmb/nannyapi/internal/org"
+	"github.com/harshavmb/nannyapi/internal/pki"
 	"github.com/harshavmb/nannyapi/internal/token"
 	"github.com/harshavmb/nannyapi/internal/user"
 )
@@ -26,16 +36,34 @@ import (
 type Server struct {
 	mux                 *http.ServeMux
 	githubAuth          *auth.GitHubAuth
+	oidcAuth            *auth.OIDCAuth
 	userService         *user.UserService
 	agentInfoService    *agent.AgentInfoService
 	tokenService        *token.TokenService
 	refreshTokenservice *token.RefreshTokenService
 	diagnosticService   *diagnostic.DiagnosticService
+	notificationService *notification.NotificationService
+	metricsService      *metrics.MetricsService
+	changePolicyService *agent.ChangePolicyService
+	alertService        *alert.AlertService
+	groupService        *agent.GroupService
+	campaignService     *campaign.CampaignService
+	jobService          *job.JobService
+	connections         *connection.Hub
+	enrollmentService   *agent.EnrollmentService
+	certificateService  *pki.CertificateService
+	decommissionService *decommission.DecommissionService
+	mergeService        *merge.MergeService
+	orgService          *org.OrgService
+	agentRoutes         map[string]bool           // Patterns of the endpoints that accept agent credentials
+	sessionRoutes       map[string]bool           // Patterns of the endpoints that only accept access tokens
+	routeScopes         map[string]string         // Scope static tokens need for each endpoint, empty if any token may call it
+	routePermissions    map[string]org.Permission // Permission the caller needs in the organisation for each endpoint
 	nannyAPIPort        string
 	nannySwaggerURL     string
 	gitHubRedirectURL   string
-	jwtSecret           string
-	nannyEncryptionKey  string
+	keys                *token.Keyring
+	envelope            *token.Envelope
 }
 
 // StartDiagnosticRequest represents a request to start a diagnostic session.
@@ -50,7 +78,7 @@ type ContinueDiagnosticRequest struct {
 }
 
 // NewServer creates a new Server instance.
-func NewServer(githubAuth *auth.GitHubAuth, userService *user.UserService, agentInfoService *agent.AgentInfoService, tokenService *token.TokenService, refreshTokenService *token.RefreshTokenService, diagnosticService *diagnostic.DiagnosticService, jwtSecret, nannyEncryptionKey string) *Server {
+func NewServer(githubAuth *auth.GitHubAuth, oidcAuth *auth.OIDCAuth, userService *user.UserService, agentInfoService *agent.AgentInfoService, tokenService *token.TokenService, refreshTokenService *token.RefreshTokenService, diagnosticService *diagnostic.DiagnosticService, notificationService *notification.NotificationService, metricsService *metrics.MetricsService, changePolicyService *agent.ChangePolicyService, alertService *alert.AlertService, groupService *agent.GroupService, campaignService *campaign.CampaignService, jobService *job.JobService, connections *connection.Hub, enrollmentService *agent.EnrollmentService, certificateService *pki.CertificateService, decommissionService *decommission.DecommissionService, mergeService *merge.MergeService, orgService *org.OrgService, keys *token.Keyring, envelope *token.Envelope) *Server {
 	mux := http.NewServeMux()
 
 	// override default nanny API port if NANNY_API_PORT is set
@@ -72,7 +100,7 @@ func NewServer(githubAuth *auth.GitHubAuth, userService *user.UserService, agent
 		gitHubRedirectURL = fmt.Sprintf("http://localhost:%s/github/callback", nannyAPIPort) // Default GitHubCallback URL
 	}
 
-	server := &Server{mux: mux, githubAuth: githubAuth, userService: userService, agentInfoService: agentInfoService, tokenService: tokenService, refreshTokenservice: refreshTokenService, diagnosticService: diagnosticService, nannyAPIPort: nannyAPIPort, nannySwaggerURL: nannySwaggerURL, gitHubRedirectURL: gitHubRedirectURL, jwtSecret: jwtSecret, nannyEncryptionKey: nannyEncryptionKey}
+	server := &Server{mux: mux, githubAuth: githubAuth, oidcAuth: oidcAuth, userService: userService, agentInfoService: agentInfoService, tokenService: tokenService, refreshTokenservice: refreshTokenService, diagnosticService: diagnosticService, notificationService: notificationService, metricsService: metricsService, changePolicyService: changePolicyService, alertService: alertService, groupService: groupService, campaignService: campaignService, jobService: jobService, connections: connections, enrollmentService: enrollmentService, certificateService: certificateService, decommissionService: decommissionService, mergeService: mergeService, orgService: orgService, agentRoutes: map[string]bool{}, sessionRoutes: map[string]bool{}, routeScopes: map[string]string{}, routePermissions: map[string]org.Permission{}, nannyAPIPort: nannyAPIPort, nannySwaggerURL: nannySwaggerURL, gitHubRedirectURL: gitHubRedirectURL, keys: keys, envelope: envelope}
 	server.routes()
 	return server
 }
@@ -88,34 +116,113 @@ func (s *Server) routes() {
 	s.mux.HandleFunc("/github/callback", s.githubAuth.HandleGitHubCallback())
 	s.mux.HandleFunc("/github/profile", s.githubAuth.HandleGitHubProfile())
 
+	// OpenID Connect Auth Endpoints
+	s.mux.HandleFunc("GET /oidc/{provider}/login", s.oidcAuth.HandleLogin())
+	s.mux.HandleFunc("GET /oidc/{provider}/callback", s.oidcAuth.HandleCallback())
+
 	// Token Endpoints
 	s.mux.HandleFunc("POST /api/refresh-token", s.handleRefreshToken())
+	s.mux.HandleFunc("GET /.well-known/jwks.json", s.handleJWKS())
+
+	// Agents authenticate with the enrollment token in the request body
+	s.mux.HandleFunc("POST /api/agents/enroll", s.handleEnrollAgent())
+
+	// Internal CA for agent client certificates
+	s.mux.HandleFunc("GET /api/ca/certificate", s.handleGetCACertificate())
+	s.mux.HandleFunc("GET /api/ca/crl", s.handleGetCRL())
 
 	// API endoints with token authentication
 	apiMux := http.NewServeMux()
-	apiMux.HandleFunc("POST /api/auth-token", s.handleCreateAuthToken())
-	apiMux.HandleFunc("/api/auth-tokens", s.handleGetAuthTokens())
-	apiMux.Handle("/api/user-auth-token", s.handleFetchUserInfoFromToken())
-	apiMux.Handle("GET /api/user/{id}", s.handleFetchUserInfo())
-	apiMux.Handle("DELETE /api/auth-token/{id}", s.handleDeleteAuthToken())
-	apiMux.HandleFunc("POST /api/agent-info", s.handleAgentInfo())
-	apiMux.HandleFunc("GET /api/agent-info/", s.handleGetAgentInfoByID())
-	apiMux.HandleFunc("GET /api/agent-info/{id}", s.handleGetAgentInfoByID())
-	apiMux.HandleFunc("GET /api/agents", s.handleAgentInfos())
+	s.handleScopedRoute(apiMux, "POST /api/auth-token", token.ScopeTokensAdmin, org.PermissionAdmin, s.handleCreateAuthToken())
+	s.handleScopedRoute(apiMux, "/api/auth-tokens", token.ScopeTokensAdmin, org.PermissionAdmin, s.handleGetAuthTokens())
+	s.handleScopedRoute(apiMux, "/api/user-auth-token", "", org.PermissionView, s.handleFetchUserInfoFromToken())
+	s.handleRoute(apiMux, "GET /api/user/{id}", org.PermissionView, s.handleFetchUserInfo())
+	s.handleScopedRoute(apiMux, "DELETE /api/auth-token/{id}", token.ScopeTokensAdmin, org.PermissionAdmin, s.handleDeleteAuthToken())
+	s.handleScopedRoute(apiMux, "POST /api/auth-token/{id}/rotate", token.ScopeTokensAdmin, org.PermissionAdmin, s.handleRotateAuthToken())
+	s.handleAgentRoute(apiMux, "POST /api/agent-info", token.ScopeAgentsWrite, org.PermissionOperate, s.handleAgentInfo())
+	s.handleScopedRoute(apiMux, "GET /api/agent-info/", token.ScopeAgentsWrite, org.PermissionView, s.handleGetAgentInfoByID())
+	s.handleAgentRoute(apiMux, "GET /api/agent-info/{id}", token.ScopeAgentsWrite, org.PermissionView, ownAgent(s.handleGetAgentInfoByID()))
+	s.handleAgentRoute(apiMux, "POST /api/agent-info/{id}/heartbeat", token.ScopeAgentsWrite, org.PermissionOperate, ownAgent(s.handleAgentHeartbeat()))
+	s.handleScopedRoute(apiMux, "GET /api/agent-info/{id}/metrics", token.ScopeAgentsWrite, org.PermissionView, s.handleGetAgentMetrics())
+	s.handleScopedRoute(apiMux, "PUT /api/agent-info/{id}/labels", token.ScopeAgentsWrite, org.PermissionOperate, s.handleSetAgentLabels())
+	s.handleScopedRoute(apiMux, "POST /api/agent-info/{id}/jobs", token.ScopeAgentsWrite, org.PermissionOperate, s.handleCreateJob())
+	s.handleScopedRoute(apiMux, "POST /api/agent-info/{id}/decommission", token.ScopeAgentsWrite, org.PermissionAdmin, s.handleDecommissionAgent())
+	s.handleScopedRoute(apiMux, "POST /api/agent-info/{id}/merge", token.ScopeAgentsWrite, org.PermissionAdmin, s.handleMergeAgents())
+	s.handleAgentRoute(apiMux, "POST /api/agent-info/{id}/jobs/poll", token.ScopeAgentsWrite, org.PermissionOperate, ownAgent(s.handlePollJobs()))
+	s.handleAgentRoute(apiMux, "GET /api/agent-info/{id}/connect", token.ScopeAgentsWrite, org.PermissionOperate, ownAgent(s.handleAgentConnect()))
+	s.handleScopedRoute(apiMux, "GET /api/agent-info/{id}/credentials", token.ScopeAgentsWrite, org.PermissionAdmin, s.handleListAgentCredentials())
+	s.handleScopedRoute(apiMux, "POST /api/agent-credentials/{id}/revoke", token.ScopeAgentsWrite, org.PermissionAdmin, s.handleRevokeAgentCredential())
+	s.handleAgentRoute(apiMux, "POST /api/agent-info/{id}/certificates", token.ScopeAgentsWrite, org.PermissionOperate, ownAgent(s.handleIssueAgentCertificate()))
+	s.handleScopedRoute(apiMux, "GET /api/agent-info/{id}/certificates", token.ScopeAgentsWrite, org.PermissionAdmin, s.handleListAgentCertificates())
+	s.handleScopedRoute(apiMux, "POST /api/agent-certificates/{id}/revoke", token.ScopeAgentsWrite, org.PermissionAdmin, s.handleRevokeAgentCertificate())
+	s.handleScopedRoute(apiMux, "POST /api/enrollment-tokens", token.ScopeAgentsWrite, org.PermissionAdmin, s.handleCreateEnrollmentToken())
+	s.handleScopedRoute(apiMux, "GET /api/enrollment-tokens", token.ScopeAgentsWrite, org.PermissionAdmin, s.handleListEnrollmentTokens())
+	s.handleScopedRoute(apiMux, "DELETE /api/enrollment-tokens/{id}", token.ScopeAgentsWrite, org.PermissionAdmin, s.handleDeleteEnrollmentToken())
+	s.handleScopedRoute(apiMux, "GET /api/agents", token.ScopeAgentsWrite, org.PermissionView, s.handleAgentInfos())
+	s.handleScopedRoute(apiMux, "POST /api/agent-groups", token.ScopeAgentsWrite, org.PermissionOperate, s.handleCreateGroup())
+	s.handleScopedRoute(apiMux, "GET /api/agent-groups", token.ScopeAgentsWrite, org.PermissionView, s.handleListGroups())
+	s.handleScopedRoute(apiMux, "GET /api/agent-groups/{id}", token.ScopeAgentsWrite, org.PermissionView, s.handleGetGroup())
+	s.handleScopedRoute(apiMux, "PUT /api/agent-groups/{id}", token.ScopeAgentsWrite, org.PermissionOperate, s.handleUpdateGroup())
+	s.handleScopedRoute(apiMux, "DELETE /api/agent-groups/{id}", token.ScopeAgentsWrite, org.PermissionOperate, s.handleDeleteGroup())
+	s.handleScopedRoute(apiMux, "GET /api/agent-groups/{id}/agents", token.ScopeAgentsWrite, org.PermissionView, s.handleListGroupAgents())
+	s.handleScopedRoute(apiMux, "POST /api/campaigns", token.ScopeAgentsWrite, org.PermissionOperate, s.handleCreateCampaign())
+	s.handleScopedRoute(apiMux, "GET /api/campaigns", token.ScopeAgentsWrite, org.PermissionView, s.handleListCampaigns())
+	s.handleScopedRoute(apiMux, "GET /api/campaigns/{id}", token.ScopeAgentsWrite, org.PermissionView, s.handleGetCampaign())
+	s.handleScopedRoute(apiMux, "GET /api/campaigns/{id}/comparison", token.ScopeAgentsWrite, org.PermissionView, s.handleCompareCampaign())
+	s.handleScopedRoute(apiMux, "POST /api/campaigns/{id}/cancel", token.ScopeAgentsWrite, org.PermissionOperate, s.handleCancelCampaign())
+	s.handleScopedRoute(apiMux, "GET /api/jobs", token.ScopeAgentsWrite, org.PermissionView, s.handleListJobs())
+	s.handleScopedRoute(apiMux, "GET /api/jobs/{id}", token.ScopeAgentsWrite, org.PermissionView, s.handleGetJob())
+	s.handleAgentRoute(apiMux, "POST /api/jobs/{id}/result", token.ScopeAgentsWrite, org.PermissionOperate, s.handleJobResult())
+	s.handleScopedRoute(apiMux, "POST /api/jobs/{id}/cancel", token.ScopeAgentsWrite, org.PermissionOperate, s.handleCancelJob())
+	s.handleScopedRoute(apiMux, "GET /api/connections", token.ScopeAgentsWrite, org.PermissionView, s.handleListConnections())
 
 	// Diagnostic Endpoints
-	apiMux.HandleFunc("POST /api/diagnostic", s.handleStartDiagnostic())
-	apiMux.HandleFunc("POST /api/diagnostic/{id}/continue", s.handleContinueDiagnostic())
-	apiMux.HandleFunc("GET /api/diagnostic/{id}", s.handleGetDiagnostic())
-	apiMux.HandleFunc("GET /api/diagnostic/{id}/summary", s.handleGetDiagnosticSummary())
-	apiMux.HandleFunc("DELETE /api/diagnostic/{id}", s.handleDeleteDiagnostic())
-	apiMux.HandleFunc("GET /api/diagnostics", s.handleListDiagnostics())
+	s.handleAgentRoute(apiMux, "POST /api/diagnostic", token.ScopeDiagnosticsWrite, org.PermissionOperate, s.handleStartDiagnostic())
+	s.handleAgentRoute(apiMux, "POST /api/diagnostic/{id}/continue", token.ScopeDiagnosticsWrite, org.PermissionOperate, s.handleContinueDiagnostic())
+	s.handleAgentRoute(apiMux, "GET /api/diagnostic/{id}", token.ScopeDiagnosticsRead, org.PermissionView, s.handleGetDiagnostic())
+	s.handleScopedRoute(apiMux, "GET /api/diagnostic/{id}/summary", token.ScopeDiagnosticsRead, org.PermissionView, s.handleGetDiagnosticSummary())
+	s.handleScopedRoute(apiMux, "DELETE /api/diagnostic/{id}", token.ScopeDiagnosticsWrite, org.PermissionOperate, s.handleDeleteDiagnostic())
+	s.handleScopedRoute(apiMux, "GET /api/diagnostics", token.ScopeDiagnosticsRead, org.PermissionView, s.handleListDiagnostics())
+
+	// Notification Endpoints
+	s.handleRoute(apiMux, "GET /api/notification-preferences", org.PermissionView, s.handleGetNotificationPreferences())
+	s.handleRoute(apiMux, "PUT /api/notification-preferences", org.PermissionView, s.handleUpdateNotificationPreferences())
+	s.handleRoute(apiMux, "GET /api/change-policy", org.PermissionView, s.handleGetChangePolicy())
+	s.handleRoute(apiMux, "PUT /api/change-policy", org.PermissionAdmin, s.handleUpdateChangePolicy())
+	s.handleRoute(apiMux, "GET /api/alerts", org.PermissionView, s.handleListAlerts())
+	s.handleRoute(apiMux, "GET /api/alerts/{id}", org.PermissionView, s.handleGetAlert())
+	s.handleRoute(apiMux, "POST /api/alerts/{id}/acknowledge", org.PermissionOperate, s.handleAlertTransition(alert.StatusAcknowledged))
+	s.handleRoute(apiMux, "POST /api/alerts/{id}/resolve", org.PermissionOperate, s.handleAlertTransition(alert.StatusResolved))
+	s.handleRoute(apiMux, "POST /api/alerts/{id}/diagnose", org.PermissionOperate, s.handleDiagnoseAlert())
+	s.handleRoute(apiMux, "POST /api/alert-rules", org.PermissionOperate, s.handleCreateAlertRule())
+	s.handleRoute(apiMux, "GET /api/alert-rules", org.PermissionView, s.handleListAlertRules())
+	s.handleRoute(apiMux, "GET /api/alert-rules/{id}", org.PermissionView, s.handleGetAlertRule())
+	s.handleRoute(apiMux, "PUT /api/alert-rules/{id}", org.PermissionOperate, s.handleUpdateAlertRule())
+	s.handleRoute(apiMux, "DELETE /api/alert-rules/{id}", org.PermissionOperate, s.handleDeleteAlertRule())
+
+	// Session Endpoints
+	s.handleSessionRoute(apiMux, "GET /api/sessions", org.PermissionView, s.handleListSessions())
+	s.handleSessionRoute(apiMux, "DELETE /api/sessions", org.PermissionView, s.handleRevokeOtherSessions())
+	s.handleSessionRoute(apiMux, "DELETE /api/sessions/{id}", org.PermissionView, s.handleRevokeSession())
+
+	// Organisation Endpoints, /api/org acts on the organisation the request acts in
+	s.handleRoute(apiMux, "GET /api/orgs", org.PermissionView, s.handleListOrganisations())
+	s.handleRoute(apiMux, "POST /api/orgs", org.PermissionView, s.handleCreateOrganisation())
+	s.handleRoute(apiMux, "GET /api/org", org.PermissionView, s.handleGetOrganisation())
+	s.handleRoute(apiMux, "GET /api/org/members", org.PermissionView, s.handleListMembers())
+	s.handleRoute(apiMux, "PUT /api/org/members/{user_id}", org.PermissionAdmin, s.handleUpdateMember())
+	s.handleRoute(apiMux, "DELETE /api/org/members/{user_id}", org.PermissionAdmin, s.handleRemoveMember())
+	s.handleRoute(apiMux, "POST /api/org/leave", org.PermissionView, s.handleLeaveOrganisation())
+	s.handleRoute(apiMux, "POST /api/org/invitations", org.PermissionAdmin, s.handleCreateInvitation())
+	s.handleRoute(apiMux, "GET /api/org/invitations", org.PermissionAdmin, s.handleListInvitations())
+	s.handleRoute(apiMux, "DELETE /api/org/invitations/{id}", org.PermissionAdmin, s.handleRevokeInvitation())
+	s.handleRoute(apiMux, "POST /api/invitations/accept", org.PermissionView, s.handleAcceptInvitation())
 
 	// Create a new CORS handler
 	c := cors.New(cors.Options{
 		AllowedOrigins:   []string{"http://localhost:8081", "https://nannyai.dev", "https://nannyui.pages.dev"},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Origin", "Content-Type", "Authorization"},
+		AllowedHeaders:   []string{"Origin", "Content-Type", "Authorization", OrgHeader},
 		AllowCredentials: true,
 	})
 
@@ -131,24 +238,57 @@ func (s *Server) routes() {
 		})
 	}
 
+	// The UI lists the login providers before the user is authenticated
+	s.mux.Handle("GET /oidc/providers", c.Handler(s.oidcAuth.HandleProviders()))
+
+	// Logging out needs the refresh_token cookie only, as the access token may have expired
+	s.mux.Handle("POST /api/logout", c.Handler(s.handleLogout()))
+
 	// Apply the CORS middleware to the main mux
 	s.mux.Handle("/index", corsMiddleware(s.mux))
 
 	// Wrap the API mux with the CORS handler
-	s.mux.Handle("/api/", c.Handler(s.AuthMiddleware(apiMux)))
+	s.mux.Handle("/api/", c.Handler(s.AuthMiddleware(s.routeScope(apiMux))))
+
+}
+
+// handleRoute registers an endpoint that callers with the permission in the organisation of the request
+// may call. It is only open to sessions and unscoped tokens.
+func (s *Server) handleRoute(mux *http.ServeMux, pattern string, permission org.Permission, handler http.HandlerFunc) {
+	s.routePermissions[pattern] = permission
+	mux.HandleFunc(pattern, handler)
+}
+
+// handleScopedRoute registers an endpoint that scoped static tokens with the scope may also call. Endpoints
+// registered with an empty scope are open to every static token.
+func (s *Server) handleScopedRoute(mux *http.ServeMux, pattern, scope string, permission org.Permission, handler http.HandlerFunc) {
+	s.routeScopes[pattern] = scope
+	s.handleRoute(mux, pattern, permission, handler)
+}
+
+// handleSessionRoute registers an endpoint that only users logged in with an access token may call, not
+// API keys or agents.
+func (s *Server) handleSessionRoute(mux *http.ServeMux, pattern string, permission org.Permission, handler http.HandlerFunc) {
+	s.sessionRoutes[pattern] = true
+	s.handleRoute(mux, pattern, permission, handler)
+}
 
+// handleAgentRoute registers an endpoint that agents may also call with their agent credential.
+func (s *Server) handleAgentRoute(mux *http.ServeMux, pattern, scope string, permission org.Permission, handler http.HandlerFunc) {
+	s.agentRoutes[pattern] = true
+	s.handleScopedRoute(mux, pattern, scope, permission, handler)
 }
 
 // HandleRefreshToken handles refresh token requests.
-// @Summary Handle refresh token validation, creation and creation of accessTokens too
-// @Description Handle refresh token validation, creation and creation of accessTokens too
+// @Summary Exchange a refresh token for a new refresh token and an access token
+// @Description Exchange the refresh_token cookie for a new refresh token and an access token. Each refresh token can be exchanged once; presenting it again revokes every token issued from the same login.
 // @Tags refresh-token
 // @Accept json
 // @Produce json
 // @Param refreshToken body string true "Refresh Token"
-// @Success 200 {object} map[string]string "refreshToken and accessToken"
+// @Success 201 {object} map[string]string "refreshToken and accessToken"
 // @Failure 400 {string} string "Invalid request payload"
-// @Failure 401 {string} string "User not authenticated"
+// @Failure 401 {string} string "Refresh token invalid, expired, revoked or reused"
 // @Failure 500 {string} string "Failed to create refresh token"
 // @Router /api/refresh-token [post].
 func (s *Server) handleRefreshToken() http.HandlerFunc {
@@ -159,73 +299,242 @@ func (s *Server) handleRefreshToken() http.HandlerFunc {
 			http.Error(w, "Refresh token is required", http.StatusBadRequest)
 			return
 		}
-		refreshToken := cookie.Value
 
-		// Validate the refresh token
-		var tokenExpired bool
-		_, claims, err := s.validateRefreshToken(context.Background(), refreshToken, s.jwtSecret)
+		refreshToken, stored, err := s.refreshTokenservice.RotateRefreshToken(r.Context(), cookie.Value, s.keys, r.UserAgent(), auth.RemoteIP(r), s.envelope)
 		if err != nil {
-			// check for revoked or expired tokens
-			if err.Error() == "refresh token expired" || err.Error() == "refresh token revoked" {
-				tokenExpired = true
-			} else {
-				http.Error(w, err.Error(), http.StatusUnauthorized)
+			status := refreshTokenErrorStatus(err)
+			if status == http.StatusInternalServerError {
+				log.Printf("Failed to rotate refresh token: %v", err)
+				http.Error(w, "Failed to create refresh token", status)
 				return
 			}
+			setRefreshTokenCookie(w, r, "", -1)
+			http.Error(w, err.Error(), status)
+			return
 		}
 
-		// final refresh token
-		var finalRefreshToken string
+		// Generate the new access token
+		accessToken, err := s.keys.GenerateJWT(stored.UserID, token.AccessTokenLifetime, "access")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 
-		if tokenExpired && claims != nil {
-			// Generate a new refresh token
-			finalRefreshToken, err = generateRefreshToken(claims.UserID, s.jwtSecret)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+		// Prepare response
+		response := map[string]string{
+			"access_token":  accessToken,
+			"refresh_token": refreshToken,
+		}
 
-			ipAddress := strings.Split(r.RemoteAddr, ":")
+		log.Printf("Refresh and access tokens are created for user %s", stored.UserID)
 
-			// Save the new refresh token
-			refreshTokenData := &token.RefreshToken{
-				Token:     finalRefreshToken,
-				UserID:    claims.UserID,
-				UserAgent: r.UserAgent(),
-				IPAddress: ipAddress[0],
-			}
-			_, err = s.refreshTokenservice.CreateRefreshToken(context.Background(), *refreshTokenData, s.nannyEncryptionKey)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+		setRefreshTokenCookie(w, r, refreshToken, int(token.RefreshTokenLifetime.Seconds()))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			log.Printf("Failed to encode refresh token response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// refreshTokenErrorStatus maps refresh token errors to HTTP status codes. Every rejected token is a 401 so
+// clients send the user to log in again.
+func refreshTokenErrorStatus(err error) int {
+	if strings.Contains(err.Error(), "failed to") {
+		return http.StatusInternalServerError
+	}
+	return http.StatusUnauthorized
+}
+
+// setRefreshTokenCookie stores the refresh token in the http-only cookie read by /api/refresh-token. A
+// negative maxAge removes it.
+func setRefreshTokenCookie(w http.ResponseWriter, r *http.Request, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "refresh_token",
+		Value:    value,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Path:     "/",
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// refreshTokenFromCookie returns the refresh token of the browser session, empty for other clients.
+func refreshTokenFromCookie(r *http.Request) string {
+	if cookie, err := r.Cookie("refresh_token"); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// handleListSessions lists the login sessions of the authenticated user
+// @Summary List login sessions
+// @Description List the devices the authenticated user is logged in on, most recently used first. The session of the refresh_token cookie is marked as current.
+// @Tags sessions
+// @Produce json
+// @Success 200 {array} token.Session
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 500 {string} string "Failed to retrieve sessions"
+// @Router /api/sessions [get].
+func (s *Server) handleListSessions() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		userID, _ := GetUserFromContext(r)
+		if userID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		sessions, err := s.refreshTokenservice.ListSessions(r.Context(), userID, refreshTokenFromCookie(r))
+		if err != nil {
+			log.Printf("Failed to list sessions of user %s: %v", userID, err)
+			http.Error(w, "Failed to retrieve sessions", http.StatusInternalServerError)
+			return
+		}
+
+		if err := json.NewEncoder(w).Encode(sessions); err != nil {
+			log.Printf("Failed to encode sessions response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleRevokeSession signs out a login session
+// @Summary Revoke a login session
+// @Description Sign out a session of the authenticated user. Its refresh token stops working at once; access tokens already issued to it expire within 15 minutes.
+// @Tags sessions
+// @Produce json
+// @Param id path string true "Session ID"
+// @Success 200 {object} map[string]string "Session revoked successfully"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 404 {string} string "Session not found"
+// @Failure 500 {string} string "Failed to revoke session"
+// @Router /api/sessions/{id} [delete].
+func (s *Server) handleRevokeSession() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		userID, _ := GetUserFromContext(r)
+		if userID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		if err := s.refreshTokenservice.RevokeSession(r.Context(), userID, r.PathValue("id")); err != nil {
+			if strings.Contains(err.Error(), "not found") {
+				http.Error(w, "Session not found", http.StatusNotFound)
 				return
 			}
+			log.Printf("Failed to revoke session %s of user %s: %v", r.PathValue("id"), userID, err)
+			http.Error(w, "Failed to revoke session", http.StatusInternalServerError)
+			return
 		}
 
-		// just use the same refreshToken
-		if !tokenExpired && claims != nil {
-			finalRefreshToken = refreshToken
+		if err := json.NewEncoder(w).Encode(map[string]string{"message": "Session revoked successfully"}); err != nil {
+			log.Printf("Failed to encode revoke session response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
 		}
+	}
+}
 
-		// Generate the new access token
-		accessToken, err := generateAccessToken(claims.UserID, s.jwtSecret)
+// handleRevokeOtherSessions signs out every other login session
+// @Summary Revoke all other login sessions
+// @Description Sign out every session of the authenticated user except the one of the refresh_token cookie, which is required.
+// @Tags sessions
+// @Produce json
+// @Success 200 {object} map[string]int "Number of revoked sessions"
+// @Failure 400 {string} string "The current session could not be identified"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 500 {string} string "Failed to revoke sessions"
+// @Router /api/sessions [delete].
+func (s *Server) handleRevokeOtherSessions() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		userID, _ := GetUserFromContext(r)
+		if userID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		revoked, err := s.refreshTokenservice.RevokeOtherSessions(r.Context(), userID, refreshTokenFromCookie(r))
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			if strings.Contains(err.Error(), "invalid session") {
+				http.Error(w, "The current session could not be identified, log in again to sign out other sessions", http.StatusBadRequest)
+				return
+			}
+			log.Printf("Failed to revoke sessions of user %s: %v", userID, err)
+			http.Error(w, "Failed to revoke sessions", http.StatusInternalServerError)
 			return
 		}
 
-		// Prepare response
-		response := map[string]string{
-			"access_token":  accessToken,
-			"refresh_token": finalRefreshToken,
+		if err := json.NewEncoder(w).Encode(map[string]int{"revoked": revoked}); err != nil {
+			log.Printf("Failed to encode revoke sessions response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleLogout ends the browser session
+// @Summary Log out
+// @Description Revoke the session of the refresh_token cookie and clear the refresh_token and GH_Authorization cookies. Succeeds without a session, so it can always be called.
+// @Tags sessions
+// @Produce json
+// @Success 200 {object} map[string]string "Logged out successfully"
+// @Failure 500 {string} string "Failed to log out"
+// @Router /api/logout [post].
+func (s *Server) handleLogout() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if refreshToken := refreshTokenFromCookie(r); refreshToken != "" {
+			if err := s.refreshTokenservice.Logout(r.Context(), refreshToken); err != nil {
+				log.Printf("Failed to log out: %v", err)
+				http.Error(w, "Failed to log out", http.StatusInternalServerError)
+				return
+			}
 		}
 
-		log.Printf("Refresh and access tokens are created for user %s", claims.UserID)
+		setRefreshTokenCookie(w, r, "", -1)
+		http.SetCookie(w, &http.Cookie{
+			Name:     "GH_Authorization",
+			Value:    "",
+			MaxAge:   -1,
+			HttpOnly: true,
+			Path:     "/",
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+
+		if err := json.NewEncoder(w).Encode(map[string]string{"message": "Logged out successfully"}); err != nil {
+			log.Printf("Failed to encode logout response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
 
-		// Write response
+// handleJWKS publishes the public keys that verify access and refresh tokens
+// @Summary Get JSON Web Key Set
+// @Description Get the public keys of the JWT signing keyring, including retired keys whose tokens may still be valid. Tokens name their key in the kid header.
+// @Tags tokens
+// @Produce json
+// @Success 200 {object} token.JSONWebKeySet "Signing keys"
+// @Router /.well-known/jwks.json [get].
+func (s *Server) handleJWKS() http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusCreated)
-		if err := json.NewEncoder(w).Encode(response); err != nil {
-			log.Printf("Failed to encode refresh token response: %v", err)
+		// Verifiers refetch the set when they see an unknown kid, so a short cache is enough
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		if err := json.NewEncoder(w).Encode(s.keys.JWKS()); err != nil {
+			log.Printf("Failed to encode JWKS: %v", err)
 			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
 			return
 		}
@@ -355,12 +664,15 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 // handleCreateAuthToken creates auth token (aka API key) for the authenticated user
 // @Summary Creates auth token (aka API key) for the authenticated user
-// @Description Creates auth token (aka API key) for the authenticated user.
+// @Description Creates auth token (aka API key) for the authenticated user with a name, scopes (agents:write, diagnostics:read, diagnostics:write, tokens:admin), an optional expiry and an optional agent binding. Tokens bound to an agent can only call the endpoints of that agent.
 // @Tags auth-token
+// @Accept json
 // @Produce json
-// @Success 201 {object} map[string]string "id of the inserted token"
-// @Failure 400 {string} string "Invalid request payload"
+// @Param request body token.CreateTokenRequest true "Name, scopes, expiry and agent of the token"
+// @Success 201 {object} token.Token
+// @Failure 400 {string} string "Invalid request payload, name, scopes, expiry or agent"
 // @Failure 401 {string} string "User not authenticated"
+// @Failure 403 {string} string "Scopes not held by the API key creating the token"
 // @Failure 500 {string} string "Failed to create API key"
 // @Router /api/auth-token [post].
 func (s *Server) handleCreateAuthToken() http.HandlerFunc {
@@ -368,21 +680,64 @@ func (s *Server) handleCreateAuthToken() http.HandlerFunc {
 		w.Header().Set("Content-Type", "application/json")
 
 		// Check if user info is already in the cookie
-		userID, ok := GetUserFromContext(r)
+		orgID, ok := GetOrgFromContext(r)
 		if !ok {
 			http.Error(w, "User not authenticated", http.StatusUnauthorized)
 			return
 		}
 
+		var req token.CreateTokenRequest
+		if err := parseRequestJSON(r, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := req.Validate(time.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// API keys cannot create tokens with more rights than they have
+		if creator, ok := r.Context().Value(tokenContextKey).(*token.Token); ok {
+			for _, scope := range req.Scopes {
+				if !creator.HasScope(scope) {
+					http.Error(w, fmt.Sprintf("API key does not have the %s scope", scope), http.StatusForbidden)
+					return
+				}
+			}
+		}
+
+		if req.AgentID != "" {
+			agentID, err := bson.ObjectIDFromHex(req.AgentID)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid agent_id %q", req.AgentID), http.StatusBadRequest)
+				return
+			}
+			agentInfo, err := s.agentInfoService.GetAgentInfoByID(r.Context(), agentID)
+			if err != nil {
+				log.Printf("Failed to retrieve agent %s: %v", req.AgentID, err)
+				http.Error(w, "Failed to create API key", http.StatusInternalServerError)
+				return
+			}
+			if agentInfo == nil || agentInfo.UserID != orgID || agentInfo.Status == agent.StatusDecommissioned {
+				http.Error(w, fmt.Sprintf("invalid agent_id %q", req.AgentID), http.StatusBadRequest)
+				return
+			}
+		}
+
 		// set token.Token model
 		var authToken token.Token
 		tokenString := token.GenerateRandomString(33) // 33 characters as it was before
 
-		authToken.UserID = userID
+		authToken.UserID = orgID
+		authToken.CreatedBy, _ = GetUserFromContext(r)
 		authToken.Token = tokenString
+		authToken.Name = req.Name
+		authToken.Scopes = req.Scopes
+		authToken.ExpiresAt = req.ExpiresAt
+		authToken.AgentID = req.AgentID
 
 		// Create API key for the user
-		responseToken, err := s.tokenService.CreateToken(r.Context(), authToken, s.nannyEncryptionKey)
+		responseToken, err := s.tokenService.CreateToken(r.Context(), authToken, s.envelope)
 		if err != nil || responseToken == nil {
 			log.Printf("Failed to create API key: %v", err)
 			http.Error(w, "Failed to create API key", http.StatusInternalServerError)
@@ -390,7 +745,7 @@ func (s *Server) handleCreateAuthToken() http.HandlerFunc {
 		}
 
 		// Decrypt the token before sent to client
-		decryptedToken, err := token.Decrypt(responseToken.Token, s.nannyEncryptionKey)
+		decryptedToken, err := s.envelope.Decrypt(responseToken.Token, token.TokenAAD(responseToken.ID))
 		if err != nil {
 			log.Printf("Failed to decrypt Token: %v", err)
 			http.Error(w, "Failed to create API key", http.StatusInternalServerError)
@@ -409,7 +764,7 @@ func (s *Server) handleCreateAuthToken() http.HandlerFunc {
 
 // handleGetAuthTokens retrieves all auth tokens for the authenticated user
 // @Summary Get all auth tokens
-// @Description Retrieves all auth tokens for the authenticated user
+// @Description Retrieves all auth tokens for the authenticated user with their name, hint, scopes, expiry, agent binding and last use. Secrets are only returned when a token is created or rotated.
 // @Tags auth-tokens
 // @Produce json
 // @Success 200 {array} token.Token "Successfully retrieved auth tokens"
@@ -421,40 +776,27 @@ func (s *Server) handleGetAuthTokens() http.HandlerFunc {
 		w.Header().Set("Content-Type", "application/json")
 
 		// Check if user info is already in the cookie
-		userID, ok := GetUserFromContext(r)
+		orgID, ok := GetOrgFromContext(r)
 		if !ok {
 			http.Error(w, "User not authenticated", http.StatusUnauthorized)
 			return
 		}
 
 		// Retrieve all auth tokens for the user
-		authTokens, err := s.tokenService.GetAllTokens(r.Context(), userID)
+		authTokens, err := s.tokenService.GetAllTokens(r.Context(), orgID)
 		if err != nil {
 			log.Printf("Failed to retrieve auth tokens: %v", err)
 			http.Error(w, "Failed to retrieve auth tokens", http.StatusInternalServerError)
 			return
 		}
 
-		// decrypt all token keys
-		var unencryptedTokens []*token.Token
-		for _, innerToken := range authTokens {
-			// Create a copy of the innerToken
-			newToken := *innerToken
-
-			// Unencrytping the token now
-			newTokenStr, err := token.Decrypt(newToken.Token, s.nannyEncryptionKey)
-			if err != nil {
-				log.Printf("Failed to retrieve auth tokens: %v", err)
-				http.Error(w, "Failed to retrieve auth tokens", http.StatusInternalServerError)
-				return
-			}
-			newToken.Token = newTokenStr
-
-			// Append the modified copy to the new slice
-			unencryptedTokens = append(unencryptedTokens, &newToken)
+		// Secrets are only returned when a token is created or rotated
+		redactedTokens := make([]*token.Token, 0, len(authTokens))
+		for _, authToken := range authTokens {
+			redactedTokens = append(redactedTokens, authToken.Redacted())
 		}
 		w.WriteHeader(http.StatusOK)
-		if err := json.NewEncoder(w).Encode(unencryptedTokens); err != nil {
+		if err := json.NewEncoder(w).Encode(redactedTokens); err != nil {
 			log.Printf("Failed to encode tokens response: %v", err)
 			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
 			return
@@ -470,6 +812,8 @@ func (s *Server) handleGetAuthTokens() http.HandlerFunc {
 // @Produce json
 // @Success 200 {object} map[string]string "Auth token deleted successfully"
 // @Failure 400 {string} string "Invalid token ID format or Token ID is required"
+// @Failure 403 {string} string "Auth token does not belong to user"
+// @Failure 404 {string} string "Auth token not found"
 // @Failure 500 {string} string "Failed to delete auth token"
 // @Router /api/auth-token/{id} [delete].
 func (s *Server) handleDeleteAuthToken() http.HandlerFunc {
@@ -477,8 +821,8 @@ func (s *Server) handleDeleteAuthToken() http.HandlerFunc {
 		w.Header().Set("Content-Type", "application/json")
 
 		// Check if user info is already in the cookie
-		userID, _ := GetUserFromContext(r)
-		if userID == "" {
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
 			http.Error(w, "User not authenticated", http.StatusUnauthorized)
 			return
 		}
@@ -497,14 +841,18 @@ func (s *Server) handleDeleteAuthToken() http.HandlerFunc {
 			return
 		}
 
-		err = s.tokenService.DeleteToken(r.Context(), objID)
+		err = s.tokenService.DeleteToken(r.Context(), objID, orgID)
 		if err != nil {
 			// non-existant token passed
 			if strings.Contains(err.Error(), "invalid token passed") {
 				http.Error(w, "Failed to delete auth token", http.StatusNotFound)
 				return
 			}
-			log.Printf("Failed to delete %s auth token of user %s: %v", tokenID, userID, err)
+			if strings.Contains(err.Error(), "does not belong to user") {
+				http.Error(w, "Auth token does not belong to user", http.StatusForbidden)
+				return
+			}
+			log.Printf("Failed to delete %s auth token of organisation %s: %v", tokenID, orgID, err)
 			http.Error(w, "Failed to delete auth token", http.StatusInternalServerError)
 			return
 		}
@@ -519,6 +867,135 @@ func (s *Server) handleDeleteAuthToken() http.HandlerFunc {
 	}
 }
 
+// tokenErrorStatus maps token rotation errors to HTTP status codes.
+func tokenErrorStatus(err error) int {
+	switch {
+	case strings.Contains(err.Error(), "invalid rotation"):
+		return http.StatusConflict
+	case strings.Contains(err.Error(), "invalid"):
+		return http.StatusBadRequest
+	case strings.Contains(err.Error(), "not found"):
+		return http.StatusNotFound
+	case strings.Contains(err.Error(), "does not belong to user"), strings.Contains(err.Error(), "rights the API key does not have"):
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// outranksCreator reports whether the caller created the auth token or has at least the role of its creator
+// in the organisation. Tokens of former members cannot be used, so any caller may rotate them.
+func (s *Server) outranksCreator(r *http.Request, orgID string, authToken *token.Token) (bool, error) {
+	if userID, _ := GetUserFromContext(r); userID == authToken.Creator() {
+		return true, nil
+	}
+	creatorRole, err := s.orgService.Authorize(r.Context(), orgID, authToken.Creator())
+	if err != nil {
+		if strings.Contains(err.Error(), "not a member") {
+			return true, nil
+		}
+		return false, err
+	}
+	role, _ := GetRoleFromContext(r)
+	return role.AtLeast(creatorRole), nil
+}
+
+// handleRotateAuthToken issues a new secret for an auth token
+// @Summary Rotate an auth token
+// @Description Issue a new secret for the auth token. Members can only rotate the tokens they created or those of members without a higher role, and API keys only tokens without scopes or an agent binding they lack. The previous secret stays valid for the grace period (TOKEN_ROTATION_GRACE by default, 0s revokes it at once), and the owner is emailed before it ends. Responses to requests made with the token carry X-NANNYAPI-Key-Secret: current or previous. The new secret is only returned once.
+// @Tags auth-tokens
+// @Accept json
+// @Produce json
+// @Param id path string true "Token ID"
+// @Param request body token.RotateTokenRequest false "Grace period of the previous secret"
+// @Success 200 {object} token.Token
+// @Failure 400 {string} string "Invalid token ID format or grace period"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 403 {string} string "Auth token does not belong to user, was created by a member with a higher role or has rights the API key does not have"
+// @Failure 404 {string} string "Auth token not found"
+// @Failure 409 {string} string "Auth token expired or rotated concurrently"
+// @Failure 500 {string} string "Failed to rotate auth token"
+// @Router /api/auth-token/{id}/rotate [post].
+func (s *Server) handleRotateAuthToken() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if user is authenticated
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		tokenID, err := bson.ObjectIDFromHex(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid token ID format", http.StatusBadRequest)
+			return
+		}
+
+		// An empty body rotates with the default grace period
+		var req token.RotateTokenRequest
+		if r.ContentLength != 0 {
+			if err := parseRequestJSON(r, &req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		// API keys act with the role of their creator, so members cannot take over the keys of members
+		// with a higher role
+		target, err := s.tokenService.GetToken(r.Context(), tokenID, orgID)
+		if err != nil {
+			status := tokenErrorStatus(err)
+			if status == http.StatusInternalServerError {
+				log.Printf("Failed to rotate auth token %s: %v", tokenID.Hex(), err)
+				http.Error(w, "Failed to rotate auth token", status)
+				return
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		allowed, err := s.outranksCreator(r, orgID, target)
+		if err != nil {
+			log.Printf("Failed to authorize rotation of auth token %s: %v", tokenID.Hex(), err)
+			http.Error(w, "Failed to rotate auth token", http.StatusInternalServerError)
+			return
+		}
+		if !allowed {
+			http.Error(w, "Auth token was created by a member with a higher role", http.StatusForbidden)
+			return
+		}
+
+		caller, _ := r.Context().Value(tokenContextKey).(*token.Token)
+		rotated, err := s.tokenService.RotateToken(r.Context(), tokenID, orgID, caller, &req, s.envelope)
+		if err != nil {
+			status := tokenErrorStatus(err)
+			if status == http.StatusInternalServerError {
+				log.Printf("Failed to rotate auth token %s: %v", tokenID.Hex(), err)
+				http.Error(w, "Failed to rotate auth token", status)
+				return
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		// Decrypt the new secret before it is sent to the client
+		decryptedToken, err := s.envelope.Decrypt(rotated.Token, token.TokenAAD(rotated.ID))
+		if err != nil {
+			log.Printf("Failed to decrypt Token: %v", err)
+			http.Error(w, "Failed to rotate auth token", http.StatusInternalServerError)
+			return
+		}
+		rotated.Token = decryptedToken
+
+		if err := json.NewEncoder(w).Encode(rotated); err != nil {
+			log.Printf("Failed to encode token response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
 // handleAgentInfo handles the ingestion of agent information.
 // @Summary Create agent information
 // @Description Creates or updates agent information with system metrics
@@ -526,8 +1003,9 @@ func (s *Server) handleDeleteAuthToken() http.HandlerFunc {
 // @Accept json
 // @Produce json
 // @Success 201 {object} map[string]string "Successfully created agent info"
-// @Failure 400 {string} string "Invalid request payload or missing required fields"
+// @Failure 400 {string} string "Invalid request payload, missing required fields or invalid system metrics"
 // @Failure 401 {string} string "User not authenticated"
+// @Failure 403 {string} string "Agent does not belong to this organisation"
 // @Failure 500 {string} string "Failed to save agent info"
 // @Router /api/agent-info [post].
 func (s *Server) handleAgentInfo() http.HandlerFunc {
@@ -535,8 +1013,8 @@ func (s *Server) handleAgentInfo() http.HandlerFunc {
 		w.Header().Set("Content-Type", "application/json")
 
 		// Check if user info is already in the cookie
-		userID, _ := GetUserFromContext(r)
-		if userID == "" {
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
 			http.Error(w, "User not authenticated", http.StatusUnauthorized)
 			return
 		}
@@ -552,11 +1030,46 @@ func (s *Server) handleAgentInfo() http.HandlerFunc {
 			http.Error(w, "All fields (hostname, ip_address, kernel_version) are required", http.StatusBadRequest)
 			return
 		}
+		if err := agentInfo.SystemMetrics.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := agent.ValidateLabels(agentInfo.Labels); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		agentInfo.MachineID = agent.NormalizeMachineID(agentInfo.MachineID)
+		if err := agent.ValidateMachineID(agentInfo.MachineID); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
-		agentInfo.UserID = userID
+		agentInfo.UserID = orgID
+
+		// An agent credential can only report on its own agent
+		if credentialAgentID, ok := GetAgentFromContext(r); ok {
+			agentID, err := bson.ObjectIDFromHex(credentialAgentID)
+			if err != nil {
+				http.Error(w, "Invalid agent ID format", http.StatusBadRequest)
+				return
+			}
+			if !agentInfo.ID.IsZero() && agentInfo.ID != agentID {
+				http.Error(w, "Agent credential is not valid for this agent", http.StatusForbidden)
+				return
+			}
+			agentInfo.ID = agentID
+		}
 
 		insertOneResult, err := s.agentInfoService.SaveAgentInfo(r.Context(), agentInfo)
 		if err != nil {
+			if strings.Contains(err.Error(), "does not belong to user") {
+				http.Error(w, "Agent does not belong to this organisation", http.StatusForbidden)
+				return
+			}
+			if strings.Contains(err.Error(), "agent is decommissioned") {
+				http.Error(w, "Agent is decommissioned", http.StatusConflict)
+				return
+			}
 			http.Error(w, "Failed to save agent info", http.StatusInternalServerError)
 			return
 		}
@@ -581,9 +1094,14 @@ func (s *Server) handleAgentInfo() http.HandlerFunc {
 // @Tags agent-info
 // @Accept json
 // @Produce json
+// @Param status query string false "Comma separated liveness states to filter by (online, stale, offline)"
+// @Param selector query string false "Label selector, e.g. env=prod,role=db or tier in (web,api)"
+// @Param group query string false "Name of an agent group"
+// @Param os query string false "Case-insensitive substring of the OS version, e.g. ubuntu"
 // @Success 200 {array} agent.AgentInfo "Successfully retrieved agent info"
-// @Failure 400 {string} string "Invalid request payload"
+// @Failure 400 {string} string "Invalid request payload, status or selector"
 // @Failure 401 {string} string "User not authenticated"
+// @Failure 404 {string} string "Group not found"
 // @Failure 500 {string} string "Failed to retrieve agents info"
 // @Router /api/agents [get].
 func (s *Server) handleAgentInfos() http.HandlerFunc {
@@ -591,22 +1109,64 @@ func (s *Server) handleAgentInfos() http.HandlerFunc {
 		w.Header().Set("Content-Type", "application/json")
 
 		// Check if user info is already in the cookie
-		userID, _ := GetUserFromContext(r)
-		if userID == "" {
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
 			http.Error(w, "User not authenticated", http.StatusUnauthorized)
 			return
 		}
 
-		agents, err := s.agentInfoService.GetAgents(context.Background(), userID)
+		query := r.URL.Query()
+		selector, err := agent.ParseSelector(query.Get("selector"))
 		if err != nil {
-			log.Printf("Failed to retrieve agents info: %v", err)
-			http.Error(w, "Failed to retrieve agents info", http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Agents of a group must match the group's selector as well
+		if name := query.Get("group"); name != "" {
+			group, err := s.groupService.GetGroupByName(r.Context(), orgID, name)
+			if err != nil {
+				if strings.Contains(err.Error(), "group not found") {
+					http.Error(w, err.Error(), http.StatusNotFound)
+					return
+				}
+				log.Printf("Failed to retrieve group: %v", err)
+				http.Error(w, "Failed to retrieve agents info", http.StatusInternalServerError)
+				return
+			}
+			groupSelector, err := agent.ParseSelector(group.Selector)
+			if err != nil {
+				log.Printf("Failed to parse selector of group %s: %v", group.Name, err)
+				http.Error(w, "Failed to retrieve agents info", http.StatusInternalServerError)
+				return
+			}
+			selector = append(selector, groupSelector...)
+		}
+
+		agentQuery := agent.AgentQuery{Selector: selector, OS: query.Get("os")}
+		for _, status := range strings.Split(query.Get("status"), ",") {
+			if status = strings.TrimSpace(status); status != "" {
+				agentQuery.Statuses = append(agentQuery.Statuses, status)
+			}
+		}
+
+		agents, err := s.agentInfoService.FindAgents(r.Context(), orgID, agentQuery)
+		if err != nil && strings.Contains(err.Error(), "invalid agent status") {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to retrieve agents info: %v", err)
+			http.Error(w, "Failed to retrieve agents info", http.StatusInternalServerError)
 			return
 		}
 
 		if agents == nil {
 			agents = []*agent.AgentInfo{}
 		}
+		for _, agentInfo := range agents {
+			agentInfo.Connected = s.connections.IsConnected(agentInfo.ID.Hex())
+		}
 
 		if err := json.NewEncoder(w).Encode(agents); err != nil {
 			log.Printf("Failed to encode agents response: %v", err)
@@ -625,6 +1185,7 @@ func (s *Server) handleAgentInfos() http.HandlerFunc {
 // @Success 200 {object} agent.AgentInfo "Successfully retrieved agent info"
 // @Failure 400 {string} string "Invalid ID format or Agent ID is required"
 // @Failure 401 {string} string "User not authenticated"
+// @Failure 403 {string} string "Agent does not belong to user"
 // @Failure 404 {string} string "Agent info not found"
 // @Failure 500 {string} string "Failed to retrieve agent info"
 // @Router /api/agent-info/{id} [get].
@@ -633,8 +1194,8 @@ func (s *Server) handleGetAgentInfoByID() http.HandlerFunc {
 		w.Header().Set("Content-Type", "application/json")
 
 		// Check if user info is already in the cookie
-		userID, _ := GetUserFromContext(r)
-		if userID == "" {
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
 			http.Error(w, "User not authenticated", http.StatusUnauthorized)
 			return
 		}
@@ -662,6 +1223,21 @@ func (s *Server) handleGetAgentInfoByID() http.HandlerFunc {
 			http.Error(w, "Failed to retrieve agent info", http.StatusInternalServerError)
 			return
 		}
+		if agentInfo == nil {
+			http.Error(w, "Agent info not found", http.StatusNotFound)
+			return
+		}
+		if agentInfo.UserID != orgID {
+			http.Error(w, "Agent does not belong to user", http.StatusForbidden)
+			return
+		}
+		agentInfo.Connected = s.connections.IsConnected(agentInfo.ID.Hex())
+		agentInfo.Credentials, err = s.enrollmentService.ListCredentials(r.Context(), agentInfo.ID, orgID)
+		if err != nil {
+			log.Printf("Failed to retrieve credentials of agent %s: %v", agentInfo.ID.Hex(), err)
+			http.Error(w, "Failed to retrieve agent info", http.StatusInternalServerError)
+			return
+		}
 
 		if err := json.NewEncoder(w).Encode(agentInfo); err != nil {
 			log.Printf("Failed to encode agent info response: %v", err)
@@ -671,6 +1247,170 @@ func (s *Server) handleGetAgentInfoByID() http.HandlerFunc {
 	}
 }
 
+// handleAgentHeartbeat records a heartbeat from an agent
+// @Summary Record agent heartbeat
+// @Description Records the last seen time, agent version and uptime of an agent and marks it online
+// @Tags agent-info
+// @Accept json
+// @Produce json
+// @Param id path string true "Agent ID"
+// @Param request body agent.Heartbeat true "Heartbeat"
+// @Success 200 {object} map[string]string "Agent status and last seen time"
+// @Failure 400 {string} string "Invalid ID format or request payload"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 403 {string} string "Agent does not belong to user"
+// @Failure 404 {string} string "Agent not found"
+// @Failure 500 {string} string "Failed to record heartbeat"
+// @Router /api/agent-info/{id}/heartbeat [post].
+func (s *Server) handleAgentHeartbeat() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if user info is already in the cookie
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		objectID, err := bson.ObjectIDFromHex(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid ID format", http.StatusBadRequest)
+			return
+		}
+
+		// An empty body is a valid heartbeat
+		var heartbeat agent.Heartbeat
+		if r.ContentLength != 0 {
+			if err := parseRequestJSON(r, &heartbeat); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		agentInfo, err := s.agentInfoService.RecordHeartbeat(r.Context(), objectID, orgID, heartbeat)
+		if err != nil {
+			switch {
+			case strings.Contains(err.Error(), "agent not found"):
+				http.Error(w, "Agent not found", http.StatusNotFound)
+			case strings.Contains(err.Error(), "agent does not belong to user"):
+				http.Error(w, "Agent does not belong to user", http.StatusForbidden)
+			case strings.Contains(err.Error(), "agent is decommissioned"):
+				http.Error(w, "Agent is decommissioned", http.StatusConflict)
+			default:
+				log.Printf("Failed to record heartbeat for agent %s: %v", objectID.Hex(), err)
+				http.Error(w, "Failed to record heartbeat", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		response := map[string]string{
+			"id":        agentInfo.ID.Hex(),
+			"status":    agentInfo.Status,
+			"last_seen": agentInfo.LastSeen.UTC().Format(time.RFC3339),
+		}
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			log.Printf("Failed to encode heartbeat response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleGetAgentMetrics retrieves the metric history of an agent
+// @Summary Get agent metrics history
+// @Description Retrieves CPU, memory, disk and filesystem usage of an agent over a time range, downsampled into buckets
+// @Tags agent-info
+// @Produce json
+// @Param id path string true "Agent ID"
+// @Param from query string false "Start of the range in RFC3339, defaults to one hour before to"
+// @Param to query string false "End of the range in RFC3339, defaults to now"
+// @Param bucket query string false "Bucket size as a duration such as 1m or 1h, at least 1s, defaults to 1m"
+// @Param agg query string false "Aggregation per bucket, avg or max, defaults to avg"
+// @Success 200 {object} metrics.Series "Successfully retrieved agent metrics"
+// @Failure 400 {string} string "Invalid ID format or query parameters"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 403 {string} string "Agent does not belong to user"
+// @Failure 404 {string} string "Agent not found"
+// @Failure 500 {string} string "Failed to retrieve agent metrics"
+// @Router /api/agent-info/{id}/metrics [get].
+func (s *Server) handleGetAgentMetrics() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if user info is already in the cookie
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		objectID, err := bson.ObjectIDFromHex(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid ID format", http.StatusBadRequest)
+			return
+		}
+
+		query := r.URL.Query()
+		to := time.Now()
+		if value := query.Get("to"); value != "" {
+			if to, err = time.Parse(time.RFC3339, value); err != nil {
+				http.Error(w, "Invalid to parameter, must be RFC3339", http.StatusBadRequest)
+				return
+			}
+		}
+		from := to.Add(-time.Hour)
+		if value := query.Get("from"); value != "" {
+			if from, err = time.Parse(time.RFC3339, value); err != nil {
+				http.Error(w, "Invalid from parameter, must be RFC3339", http.StatusBadRequest)
+				return
+			}
+		}
+		bucket := time.Minute
+		if value := query.Get("bucket"); value != "" {
+			if bucket, err = time.ParseDuration(value); err != nil {
+				http.Error(w, "Invalid bucket parameter, must be a duration", http.StatusBadRequest)
+				return
+			}
+		}
+		aggregation := query.Get("agg")
+		if aggregation == "" {
+			aggregation = metrics.AggregationAvg
+		}
+
+		agentInfo, err := s.agentInfoService.GetAgentInfoByID(r.Context(), objectID)
+		if err != nil {
+			http.Error(w, "Failed to retrieve agent info", http.StatusInternalServerError)
+			return
+		}
+		if agentInfo == nil {
+			http.Error(w, "Agent not found", http.StatusNotFound)
+			return
+		}
+		if agentInfo.UserID != orgID {
+			http.Error(w, "Agent does not belong to user", http.StatusForbidden)
+			return
+		}
+
+		series, err := s.metricsService.GetSeries(r.Context(), objectID.Hex(), from, to, bucket, aggregation)
+		if err != nil {
+			if strings.Contains(err.Error(), "invalid") {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.Printf("Failed to retrieve metrics for agent %s: %v", objectID.Hex(), err)
+			http.Error(w, "Failed to retrieve agent metrics", http.StatusInternalServerError)
+			return
+		}
+
+		if err := json.NewEncoder(w).Encode(series); err != nil {
+			log.Printf("Failed to encode agent metrics response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
 // handleStartDiagnostic starts a new diagnostic session.
 // @Summary Start diagnostic session
 // @Description Start a new Linux system diagnostic session
@@ -682,6 +1422,7 @@ func (s *Server) handleGetAgentInfoByID() http.HandlerFunc {
 // @Failure 400 {string} string "Invalid request payload or missing required fields"
 // @Failure 401 {string} string "User not authenticated"
 // @Failure 403 {string} string "User not authorized"
+// @Failure 409 {string} string "Agent is offline"
 // @Failure 500 {string} string "Internal server error"
 // @Router /api/diagnostic [post].
 func (s *Server) handleStartDiagnostic() http.HandlerFunc {
@@ -689,8 +1430,8 @@ func (s *Server) handleStartDiagnostic() http.HandlerFunc {
 		w.Header().Set("Content-Type", "application/json")
 
 		// Check if user is authenticated
-		userID, _ := GetUserFromContext(r)
-		if userID == "" {
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
 			w.WriteHeader(http.StatusUnauthorized)
 			encodeErr := json.NewEncoder(w).Encode(map[string]string{"error": "User not authenticated"})
 			if encodeErr != nil {
@@ -721,7 +1462,11 @@ func (s *Server) handleStartDiagnostic() http.HandlerFunc {
 			return
 		}
 
-		session, err := s.diagnosticService.StartDiagnosticSession(r.Context(), req.AgentID, userID, req.Issue)
+		if !checkAgentScope(w, r, req.AgentID) {
+			return
+		}
+
+		session, err := s.diagnosticService.StartDiagnosticSession(r.Context(), req.AgentID, orgID, req.Issue)
 		if err != nil {
 			statusCode := http.StatusInternalServerError
 			switch {
@@ -731,6 +1476,8 @@ func (s *Server) handleStartDiagnostic() http.HandlerFunc {
 				statusCode = http.StatusBadRequest
 			case strings.Contains(err.Error(), "agent does not belong to user"):
 				statusCode = http.StatusForbidden
+			case strings.Contains(err.Error(), "agent is offline"), strings.Contains(err.Error(), "agent is decommissioned"):
+				statusCode = http.StatusConflict
 			}
 			w.WriteHeader(statusCode)
 			encodeErr := json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
@@ -760,6 +1507,8 @@ func (s *Server) handleStartDiagnostic() http.HandlerFunc {
 // @Success 201 {object} diagnostic.DiagnosticSession "When diagnosis is still in progress"
 // @Success 200 {object} diagnostic.DiagnosticSession "When diagnosis is completed"
 // @Failure 400 {string} string "Invalid request"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 403 {string} string "Session does not belong to organisation"
 // @Failure 404 {string} string "Session not found"
 // @Failure 500 {string} string "Internal server error"
 // @Router /api/diagnostic/{id}/continue [post].
@@ -767,6 +1516,13 @@ func (s *Server) handleContinueDiagnostic() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 
+		// Check if user is authenticated
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
 		sessionID := r.PathValue("id")
 		if sessionID == "" {
 			http.Error(w, "Session ID is required", http.StatusBadRequest)
@@ -785,13 +1541,21 @@ func (s *Server) handleContinueDiagnostic() http.HandlerFunc {
 			return
 		}
 
-		session, err := s.diagnosticService.ContinueDiagnosticSession(r.Context(), sessionID, req.DiagnosticOutput)
+		if !s.checkSessionScope(w, r, sessionID) {
+			return
+		}
+
+		session, err := s.diagnosticService.ContinueDiagnosticSession(r.Context(), sessionID, orgID, req.DiagnosticOutput)
 		if err != nil {
 			statusCode := http.StatusInternalServerError
 			if strings.Contains(err.Error(), "invalid session ID format") {
 				statusCode = http.StatusBadRequest
 			} else if strings.Contains(err.Error(), "session not found") {
 				statusCode = http.StatusNotFound
+			} else if strings.Contains(err.Error(), "does not belong") {
+				statusCode = http.StatusForbidden
+			} else if strings.Contains(err.Error(), "session was cancelled") {
+				statusCode = http.StatusConflict
 			}
 			http.Error(w, err.Error(), statusCode)
 			return
@@ -825,11 +1589,20 @@ func (s *Server) handleContinueDiagnostic() http.HandlerFunc {
 // @Param id path string true "Session ID"
 // @Success 200 {object} diagnostic.DiagnosticSession
 // @Failure 400 {string} string "Invalid session ID format"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 403 {string} string "Session does not belong to organisation"
 // @Failure 404 {string} string "Session not found"
 // @Failure 500 {string} string "Internal server error"
 // @Router /api/diagnostic/{id} [get].
 func (s *Server) handleGetDiagnostic() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		// Check if user is authenticated
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
 		sessionID := r.PathValue("id")
 		if sessionID == "" {
 			http.Error(w, "Session ID is required", http.StatusBadRequest)
@@ -842,15 +1615,20 @@ func (s *Server) handleGetDiagnostic() http.HandlerFunc {
 			return
 		}
 
-		session, err := s.diagnosticService.GetDiagnosticSession(r.Context(), sessionID)
+		session, err := s.diagnosticService.GetDiagnosticSession(r.Context(), sessionID, orgID)
 		if err != nil {
 			statusCode := http.StatusInternalServerError
 			if strings.Contains(err.Error(), "session not found") {
 				statusCode = http.StatusNotFound
+			} else if strings.Contains(err.Error(), "does not belong") {
+				statusCode = http.StatusForbidden
 			}
 			http.Error(w, err.Error(), statusCode)
 			return
 		}
+		if !checkAgentScope(w, r, session.AgentID) {
+			return
+		}
 
 		w.Header().Set("Content-Type", "application/json")
 		if encodeErr := json.NewEncoder(w).Encode(session); encodeErr != nil {
@@ -868,12 +1646,21 @@ func (s *Server) handleGetDiagnostic() http.HandlerFunc {
 // @Produce json
 // @Param id path string true "Session ID"
 // @Success 200 {string} string "Diagnostic summary"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 403 {string} string "Session does not belong to organisation"
 // @Failure 404 {string} string "Session not found"
 // @Failure 400 {string} string "Invalid session ID format"
 // @Failure 500 {string} string "Internal server error"
 // @Router /api/diagnostic/{id}/summary [get].
 func (s *Server) handleGetDiagnosticSummary() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		// Check if user is authenticated
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
 		sessionID := r.PathValue("id")
 		if sessionID == "" {
 			http.Error(w, "Session ID is required", http.StatusBadRequest)
@@ -886,11 +1673,17 @@ func (s *Server) handleGetDiagnosticSummary() http.HandlerFunc {
 			return
 		}
 
-		summary, err := s.diagnosticService.GetDiagnosticSummary(r.Context(), sessionID)
+		if !s.checkSessionScope(w, r, sessionID) {
+			return
+		}
+
+		summary, err := s.diagnosticService.GetDiagnosticSummary(r.Context(), sessionID, orgID)
 		if err != nil {
 			statusCode := http.StatusInternalServerError
 			if strings.Contains(err.Error(), "session not found") {
 				statusCode = http.StatusNotFound
+			} else if strings.Contains(err.Error(), "does not belong") {
+				statusCode = http.StatusForbidden
 			}
 			http.Error(w, err.Error(), statusCode)
 			return
@@ -921,8 +1714,8 @@ func (s *Server) handleGetDiagnosticSummary() http.HandlerFunc {
 func (s *Server) handleDeleteDiagnostic() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Check if user is authenticated
-		userID, _ := GetUserFromContext(r)
-		if userID == "" {
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
 			http.Error(w, "User not authenticated", http.StatusUnauthorized)
 			return
 		}
@@ -939,7 +1732,7 @@ func (s *Server) handleDeleteDiagnostic() http.HandlerFunc {
 			return
 		}
 
-		err := s.diagnosticService.DeleteSession(r.Context(), sessionID, userID)
+		err := s.diagnosticService.DeleteSession(r.Context(), sessionID, orgID)
 		if err != nil {
 			statusCode := http.StatusInternalServerError
 			if err.Error() == "session not found" {
@@ -974,13 +1767,13 @@ func (s *Server) handleListDiagnostics() http.HandlerFunc {
 		w.Header().Set("Content-Type", "application/json")
 
 		// Check if user is authenticated
-		userID, _ := GetUserFromContext(r)
-		if userID == "" {
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
 			http.Error(w, "User not authenticated", http.StatusUnauthorized)
 			return
 		}
 
-		sessions, err := s.diagnosticService.ListUserSessions(r.Context(), userID)
+		sessions, err := s.diagnosticService.ListUserSessions(r.Context(), orgID)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Failed to list sessions: %v", err), http.StatusInternalServerError)
 			return
@@ -993,3 +1786,2856 @@ func (s *Server) handleListDiagnostics() http.HandlerFunc {
 		}
 	}
 }
+
+// handleGetNotificationPreferences retrieves the email notification preferences of the authenticated user
+// @Summary Get notification preferences
+// @Description Get the email notification preferences of the authenticated user
+// @Tags notifications
+// @Produce json
+// @Success 200 {object} notification.Preferences
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 500 {string} string "Failed to retrieve notification preferences"
+// @Router /api/notification-preferences [get].
+func (s *Server) handleGetNotificationPreferences() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if user is authenticated
+		userID, _ := GetUserFromContext(r)
+		if userID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		prefs, err := s.notificationService.GetPreferences(r.Context(), userID)
+		if err != nil {
+			log.Printf("Failed to retrieve notification preferences: %v", err)
+			http.Error(w, "Failed to retrieve notification preferences", http.StatusInternalServerError)
+			return
+		}
+
+		if err := json.NewEncoder(w).Encode(prefs); err != nil {
+			log.Printf("Failed to encode notification preferences response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleUpdateNotificationPreferences updates the email notification preferences of the authenticated user
+// @Summary Update notification preferences
+// @Description Update the email notification preferences of the authenticated user
+// @Tags notifications
+// @Accept json
+// @Produce json
+// @Param request body notification.PreferencesUpdate true "Notification preferences to change"
+// @Success 200 {object} notification.Preferences
+// @Failure 400 {string} string "Invalid request payload"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 500 {string} string "Failed to save notification preferences"
+// @Router /api/notification-preferences [put].
+func (s *Server) handleUpdateNotificationPreferences() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if user is authenticated
+		userID, _ := GetUserFromContext(r)
+		if userID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		var update notification.PreferencesUpdate
+		if err := parseRequestJSON(r, &update); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if update.Email != nil && *update.Email != "" && !IsValidEmail(*update.Email) {
+			http.Error(w, "Invalid email address", http.StatusBadRequest)
+			return
+		}
+
+		prefs, err := s.notificationService.UpdatePreferences(r.Context(), userID, &update)
+		if err != nil {
+			if strings.Contains(err.Error(), "digest_hour") || strings.Contains(err.Error(), "invalid group") || strings.Contains(err.Error(), "invalid email") {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.Printf("Failed to save notification preferences: %v", err)
+			http.Error(w, "Failed to save notification preferences", http.StatusInternalServerError)
+			return
+		}
+
+		if err := json.NewEncoder(w).Encode(prefs); err != nil {
+			log.Printf("Failed to encode notification preferences response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleGetChangePolicy retrieves the metric change-detection policy of the authenticated user
+// @Summary Get change-detection policy
+// @Description Get the global, group and agent thresholds used to detect significant metric changes. Metrics without a configured threshold use the built-in defaults.
+// @Tags agent-info
+// @Produce json
+// @Success 200 {object} agent.ChangePolicy
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 500 {string} string "Failed to retrieve change policy"
+// @Router /api/change-policy [get].
+func (s *Server) handleGetChangePolicy() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if user is authenticated
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		policy, err := s.changePolicyService.GetPolicy(r.Context(), orgID)
+		if err != nil {
+			log.Printf("Failed to retrieve change policy: %v", err)
+			http.Error(w, "Failed to retrieve change policy", http.StatusInternalServerError)
+			return
+		}
+
+		if err := json.NewEncoder(w).Encode(policy); err != nil {
+			log.Printf("Failed to encode change policy response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleUpdateChangePolicy replaces the metric change-detection policy of the authenticated user
+// @Summary Update change-detection policy
+// @Description Replace the global, group and agent thresholds used to detect significant metric changes
+// @Tags agent-info
+// @Accept json
+// @Produce json
+// @Param request body agent.ChangePolicy true "Change-detection policy"
+// @Success 200 {object} agent.ChangePolicy
+// @Failure 400 {string} string "Invalid request payload or threshold"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 500 {string} string "Failed to save change policy"
+// @Router /api/change-policy [put].
+func (s *Server) handleUpdateChangePolicy() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if user is authenticated
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		var policy agent.ChangePolicy
+		if err := parseRequestJSON(r, &policy); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		policy.UserID = orgID
+		if err := s.changePolicyService.UpdatePolicy(r.Context(), &policy); err != nil {
+			if strings.Contains(err.Error(), "invalid threshold") {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.Printf("Failed to save change policy: %v", err)
+			http.Error(w, "Failed to save change policy", http.StatusInternalServerError)
+			return
+		}
+
+		if err := json.NewEncoder(w).Encode(policy); err != nil {
+			log.Printf("Failed to encode change policy response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleListAlerts lists the alerts raised for the agents of the authenticated user
+// @Summary List alerts
+// @Description List the alerts raised by the anomaly engine for the agents of the authenticated user, newest first
+// @Tags alerts
+// @Produce json
+// @Param status query string false "Filter by status (pending, firing, acknowledged, resolved)"
+// @Success 200 {array} alert.Alert
+// @Failure 400 {string} string "Invalid alert status"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 500 {string} string "Failed to retrieve alerts"
+// @Router /api/alerts [get].
+func (s *Server) handleListAlerts() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if user is authenticated
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		alerts, err := s.alertService.ListAlerts(r.Context(), orgID, r.URL.Query().Get("status"))
+		if err != nil {
+			if strings.Contains(err.Error(), "invalid alert status") {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.Printf("Failed to retrieve alerts: %v", err)
+			http.Error(w, "Failed to retrieve alerts", http.StatusInternalServerError)
+			return
+		}
+
+		if alerts == nil {
+			alerts = []*alert.Alert{}
+		}
+
+		if err := json.NewEncoder(w).Encode(alerts); err != nil {
+			log.Printf("Failed to encode alerts response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// alertErrorStatus maps alert service errors to HTTP status codes.
+func alertErrorStatus(err error) int {
+	switch {
+	case strings.Contains(err.Error(), "not found"):
+		return http.StatusNotFound
+	case strings.Contains(err.Error(), "does not belong to user"):
+		return http.StatusForbidden
+	case strings.Contains(err.Error(), "invalid alert transition"), strings.Contains(err.Error(), "agent is offline"), strings.Contains(err.Error(), "agent is decommissioned"):
+		return http.StatusConflict
+	case strings.Contains(err.Error(), "invalid"):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// handleGetAlert retrieves an alert with its history
+// @Summary Get alert
+// @Description Get an alert of the authenticated user with its state history and linked diagnostic sessions
+// @Tags alerts
+// @Produce json
+// @Param id path string true "Alert ID"
+// @Success 200 {object} alert.Alert
+// @Failure 400 {string} string "Invalid alert ID format"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 403 {string} string "Alert does not belong to user"
+// @Failure 404 {string} string "Alert not found"
+// @Failure 500 {string} string "Failed to retrieve alert"
+// @Router /api/alerts/{id} [get].
+func (s *Server) handleGetAlert() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if user is authenticated
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		alertID, err := bson.ObjectIDFromHex(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid alert ID format", http.StatusBadRequest)
+			return
+		}
+
+		found, err := s.alertService.GetAlert(r.Context(), alertID, orgID)
+		if err != nil {
+			status := alertErrorStatus(err)
+			if status == http.StatusInternalServerError {
+				log.Printf("Failed to retrieve alert: %v", err)
+				http.Error(w, "Failed to retrieve alert", status)
+				return
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		if err := json.NewEncoder(w).Encode(found); err != nil {
+			log.Printf("Failed to encode alert response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleAlertTransition acknowledges or resolves an alert
+// @Summary Acknowledge or resolve alert
+// @Description Acknowledge a firing alert, or resolve an active alert. The optional note is kept in the alert history.
+// @Tags alerts
+// @Accept json
+// @Produce json
+// @Param id path string true "Alert ID"
+// @Param request body alert.TransitionRequest false "Optional note"
+// @Success 200 {object} alert.Alert
+// @Failure 400 {string} string "Invalid alert ID format or request payload"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 403 {string} string "Alert does not belong to user"
+// @Failure 404 {string} string "Alert not found"
+// @Failure 409 {string} string "Alert is not in a state that allows the transition"
+// @Failure 500 {string} string "Failed to update alert"
+// @Router /api/alerts/{id}/acknowledge [post]
+// @Router /api/alerts/{id}/resolve [post].
+func (s *Server) handleAlertTransition(to string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if user is authenticated
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		alertID, err := bson.ObjectIDFromHex(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid alert ID format", http.StatusBadRequest)
+			return
+		}
+
+		// The note is optional, so an empty body is accepted
+		var req alert.TransitionRequest
+		if r.ContentLength != 0 {
+			if err := parseRequestJSON(r, &req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		var updated *alert.Alert
+		if to == alert.StatusAcknowledged {
+			updated, err = s.alertService.AcknowledgeAlert(r.Context(), alertID, orgID, req.Note)
+		} else {
+			updated, err = s.alertService.ResolveAlert(r.Context(), alertID, orgID, req.Note)
+		}
+		if err != nil {
+			status := alertErrorStatus(err)
+			if status == http.StatusInternalServerError {
+				log.Printf("Failed to update alert %s: %v", alertID.Hex(), err)
+				http.Error(w, "Failed to update alert", status)
+				return
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		if err := json.NewEncoder(w).Encode(updated); err != nil {
+			log.Printf("Failed to encode alert response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleDiagnoseAlert starts a diagnostic session for an alert
+// @Summary Diagnose alert
+// @Description Start a diagnostic session on the agent of an alert, using the alert as the issue, and link the session to the alert
+// @Tags alerts
+// @Produce json
+// @Param id path string true "Alert ID"
+// @Success 201 {object} diagnostic.DiagnosticSession
+// @Failure 400 {string} string "Invalid alert ID format"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 403 {string} string "Alert does not belong to user"
+// @Failure 404 {string} string "Alert not found"
+// @Failure 409 {string} string "Agent is offline"
+// @Failure 500 {string} string "Failed to start diagnostic session"
+// @Router /api/alerts/{id}/diagnose [post].
+func (s *Server) handleDiagnoseAlert() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if user is authenticated
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		alertID, err := bson.ObjectIDFromHex(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid alert ID format", http.StatusBadRequest)
+			return
+		}
+
+		session, err := s.alertService.DiagnoseAlert(r.Context(), alertID, orgID)
+		if err != nil {
+			status := alertErrorStatus(err)
+			if status == http.StatusInternalServerError || status == http.StatusBadRequest {
+				log.Printf("Failed to start diagnostic session for alert %s: %v", alertID.Hex(), err)
+				http.Error(w, "Failed to start diagnostic session", http.StatusInternalServerError)
+				return
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(session); err != nil {
+			log.Printf("Failed to encode diagnostic session response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleCreateAlertRule creates an alert rule
+// @Summary Create alert rule
+// @Description Create an alert rule evaluated against the metrics of the user's agents, e.g. fs_usage of / above 90 for 600 seconds
+// @Tags alerts
+// @Accept json
+// @Produce json
+// @Param request body alert.Rule true "Alert rule"
+// @Success 201 {object} alert.Rule
+// @Failure 400 {string} string "Invalid request payload or rule"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 500 {string} string "Failed to create alert rule"
+// @Router /api/alert-rules [post].
+func (s *Server) handleCreateAlertRule() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if user is authenticated
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		var rule alert.Rule
+		if err := parseRequestJSON(r, &rule); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		rule.UserID = orgID
+		if err := s.alertService.CreateRule(r.Context(), &rule); err != nil {
+			if strings.Contains(err.Error(), "invalid rule") {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.Printf("Failed to create alert rule: %v", err)
+			http.Error(w, "Failed to create alert rule", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(rule); err != nil {
+			log.Printf("Failed to encode alert rule response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleListAlertRules lists the alert rules of the authenticated user
+// @Summary List alert rules
+// @Description List the alert rules of the authenticated user. Built-in anomaly rules are not included.
+// @Tags alerts
+// @Produce json
+// @Success 200 {array} alert.Rule
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 500 {string} string "Failed to retrieve alert rules"
+// @Router /api/alert-rules [get].
+func (s *Server) handleListAlertRules() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if user is authenticated
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		rules, err := s.alertService.ListRules(r.Context(), orgID)
+		if err != nil {
+			log.Printf("Failed to retrieve alert rules: %v", err)
+			http.Error(w, "Failed to retrieve alert rules", http.StatusInternalServerError)
+			return
+		}
+
+		if rules == nil {
+			rules = []*alert.Rule{}
+		}
+
+		if err := json.NewEncoder(w).Encode(rules); err != nil {
+			log.Printf("Failed to encode alert rules response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleGetAlertRule retrieves an alert rule
+// @Summary Get alert rule
+// @Description Get an alert rule of the authenticated user
+// @Tags alerts
+// @Produce json
+// @Param id path string true "Rule ID"
+// @Success 200 {object} alert.Rule
+// @Failure 400 {string} string "Invalid rule ID format"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 403 {string} string "Alert rule does not belong to user"
+// @Failure 404 {string} string "Alert rule not found"
+// @Failure 500 {string} string "Failed to retrieve alert rule"
+// @Router /api/alert-rules/{id} [get].
+func (s *Server) handleGetAlertRule() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if user is authenticated
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		ruleID, err := bson.ObjectIDFromHex(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid rule ID format", http.StatusBadRequest)
+			return
+		}
+
+		rule, err := s.alertService.GetRule(r.Context(), ruleID, orgID)
+		if err != nil {
+			status := alertErrorStatus(err)
+			if status == http.StatusInternalServerError {
+				log.Printf("Failed to retrieve alert rule: %v", err)
+				http.Error(w, "Failed to retrieve alert rule", status)
+				return
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		if err := json.NewEncoder(w).Encode(rule); err != nil {
+			log.Printf("Failed to encode alert rule response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleUpdateAlertRule replaces an alert rule
+// @Summary Update alert rule
+// @Description Replace the definition of an alert rule of the authenticated user
+// @Tags alerts
+// @Accept json
+// @Produce json
+// @Param id path string true "Rule ID"
+// @Param request body alert.Rule true "Alert rule"
+// @Success 200 {object} alert.Rule
+// @Failure 400 {string} string "Invalid rule ID format, request payload or rule"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 403 {string} string "Alert rule does not belong to user"
+// @Failure 404 {string} string "Alert rule not found"
+// @Failure 500 {string} string "Failed to update alert rule"
+// @Router /api/alert-rules/{id} [put].
+func (s *Server) handleUpdateAlertRule() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if user is authenticated
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		ruleID, err := bson.ObjectIDFromHex(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid rule ID format", http.StatusBadRequest)
+			return
+		}
+
+		var rule alert.Rule
+		if err := parseRequestJSON(r, &rule); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		rule.ID = ruleID
+		rule.UserID = orgID
+		if err := s.alertService.UpdateRule(r.Context(), &rule); err != nil {
+			status := alertErrorStatus(err)
+			if status == http.StatusInternalServerError {
+				log.Printf("Failed to update alert rule: %v", err)
+				http.Error(w, "Failed to update alert rule", status)
+				return
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		if err := json.NewEncoder(w).Encode(rule); err != nil {
+			log.Printf("Failed to encode alert rule response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleDeleteAlertRule deletes an alert rule
+// @Summary Delete alert rule
+// @Description Delete an alert rule of the authenticated user. Its active alerts resolve on the next report of each agent.
+// @Tags alerts
+// @Produce json
+// @Param id path string true "Rule ID"
+// @Success 200 {string} string "Alert rule deleted successfully"
+// @Failure 400 {string} string "Invalid rule ID format"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 403 {string} string "Alert rule does not belong to user"
+// @Failure 404 {string} string "Alert rule not found"
+// @Failure 500 {string} string "Failed to delete alert rule"
+// @Router /api/alert-rules/{id} [delete].
+func (s *Server) handleDeleteAlertRule() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if user is authenticated
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		ruleID, err := bson.ObjectIDFromHex(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid rule ID format", http.StatusBadRequest)
+			return
+		}
+
+		if err := s.alertService.DeleteRule(r.Context(), ruleID, orgID); err != nil {
+			status := alertErrorStatus(err)
+			if status == http.StatusInternalServerError {
+				log.Printf("Failed to delete alert rule: %v", err)
+				http.Error(w, "Failed to delete alert rule", status)
+				return
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		if err := json.NewEncoder(w).Encode(map[string]string{"message": "Alert rule deleted successfully"}); err != nil {
+			log.Printf("Failed to encode delete response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// groupErrorStatus maps agent group errors to HTTP status codes.
+func groupErrorStatus(err error) int {
+	switch {
+	case strings.Contains(err.Error(), "not found"):
+		return http.StatusNotFound
+	case strings.Contains(err.Error(), "does not belong to user"):
+		return http.StatusForbidden
+	case strings.Contains(err.Error(), "already exists"):
+		return http.StatusConflict
+	case strings.Contains(err.Error(), "invalid"):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// handleSetAgentLabels replaces the labels of an agent
+// @Summary Set agent labels
+// @Description Replace the key/value labels of an agent. Labels are matched by selectors and group definitions; an empty object removes all labels.
+// @Tags agent-info
+// @Accept json
+// @Produce json
+// @Param id path string true "Agent ID"
+// @Param request body agent.LabelsRequest true "Labels"
+// @Success 200 {object} agent.AgentInfo
+// @Failure 400 {string} string "Invalid agent ID format, request payload or labels"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 403 {string} string "Agent does not belong to user"
+// @Failure 404 {string} string "Agent not found"
+// @Failure 500 {string} string "Failed to update agent labels"
+// @Router /api/agent-info/{id}/labels [put].
+func (s *Server) handleSetAgentLabels() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if user is authenticated
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		agentID, err := bson.ObjectIDFromHex(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid agent ID format", http.StatusBadRequest)
+			return
+		}
+
+		var req agent.LabelsRequest
+		if err := parseRequestJSON(r, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		agentInfo, err := s.agentInfoService.SetLabels(r.Context(), agentID, orgID, req.Labels)
+		if err != nil {
+			status := groupErrorStatus(err)
+			if status == http.StatusInternalServerError {
+				log.Printf("Failed to update labels of agent %s: %v", agentID.Hex(), err)
+				http.Error(w, "Failed to update agent labels", status)
+				return
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		if err := json.NewEncoder(w).Encode(agentInfo); err != nil {
+			log.Printf("Failed to encode agent info response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleCreateGroup creates an agent group
+// @Summary Create agent group
+// @Description Create a named group of agents defined by a label selector. Groups can be targeted by change policies, alert rules and notification preferences.
+// @Tags agent-groups
+// @Accept json
+// @Produce json
+// @Param request body agent.Group true "Group"
+// @Success 201 {object} agent.Group
+// @Failure 400 {string} string "Invalid request payload, name or selector"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 409 {string} string "Group already exists"
+// @Failure 500 {string} string "Failed to create group"
+// @Router /api/agent-groups [post].
+func (s *Server) handleCreateGroup() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if user is authenticated
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		var group agent.Group
+		if err := parseRequestJSON(r, &group); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		group.UserID = orgID
+		if err := s.groupService.CreateGroup(r.Context(), &group); err != nil {
+			status := groupErrorStatus(err)
+			if status == http.StatusInternalServerError {
+				log.Printf("Failed to create group: %v", err)
+				http.Error(w, "Failed to create group", status)
+				return
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(group); err != nil {
+			log.Printf("Failed to encode group response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleListGroups lists the agent groups of the authenticated user
+// @Summary List agent groups
+// @Description List the agent groups of the authenticated user ordered by name
+// @Tags agent-groups
+// @Produce json
+// @Success 200 {array} agent.Group
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 500 {string} string "Failed to retrieve groups"
+// @Router /api/agent-groups [get].
+func (s *Server) handleListGroups() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if user is authenticated
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		groups, err := s.groupService.ListGroups(r.Context(), orgID)
+		if err != nil {
+			log.Printf("Failed to retrieve groups: %v", err)
+			http.Error(w, "Failed to retrieve groups", http.StatusInternalServerError)
+			return
+		}
+
+		if groups == nil {
+			groups = []*agent.Group{}
+		}
+
+		if err := json.NewEncoder(w).Encode(groups); err != nil {
+			log.Printf("Failed to encode groups response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleGetGroup retrieves an agent group
+// @Summary Get agent group
+// @Description Get an agent group of the authenticated user
+// @Tags agent-groups
+// @Produce json
+// @Param id path string true "Group ID"
+// @Success 200 {object} agent.Group
+// @Failure 400 {string} string "Invalid group ID format"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 403 {string} string "Group does not belong to user"
+// @Failure 404 {string} string "Group not found"
+// @Failure 500 {string} string "Failed to retrieve group"
+// @Router /api/agent-groups/{id} [get].
+func (s *Server) handleGetGroup() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if user is authenticated
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		groupID, err := bson.ObjectIDFromHex(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid group ID format", http.StatusBadRequest)
+			return
+		}
+
+		group, err := s.groupService.GetGroup(r.Context(), groupID, orgID)
+		if err != nil {
+			status := groupErrorStatus(err)
+			if status == http.StatusInternalServerError {
+				log.Printf("Failed to retrieve group: %v", err)
+				http.Error(w, "Failed to retrieve group", status)
+				return
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		if err := json.NewEncoder(w).Encode(group); err != nil {
+			log.Printf("Failed to encode group response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleUpdateGroup replaces an agent group
+// @Summary Update agent group
+// @Description Replace the name, description and selector of an agent group. Policies, alert rules and notification preferences refer to groups by name and are not updated on rename.
+// @Tags agent-groups
+// @Accept json
+// @Produce json
+// @Param id path string true "Group ID"
+// @Param request body agent.Group true "Group"
+// @Success 200 {object} agent.Group
+// @Failure 400 {string} string "Invalid group ID format, request payload, name or selector"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 403 {string} string "Group does not belong to user"
+// @Failure 404 {string} string "Group not found"
+// @Failure 409 {string} string "Group already exists"
+// @Failure 500 {string} string "Failed to update group"
+// @Router /api/agent-groups/{id} [put].
+func (s *Server) handleUpdateGroup() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if user is authenticated
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		groupID, err := bson.ObjectIDFromHex(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid group ID format", http.StatusBadRequest)
+			return
+		}
+
+		var group agent.Group
+		if err := parseRequestJSON(r, &group); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		group.ID = groupID
+		group.UserID = orgID
+		if err := s.groupService.UpdateGroup(r.Context(), &group); err != nil {
+			status := groupErrorStatus(err)
+			if status == http.StatusInternalServerError {
+				log.Printf("Failed to update group: %v", err)
+				http.Error(w, "Failed to update group", status)
+				return
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		if err := json.NewEncoder(w).Encode(group); err != nil {
+			log.Printf("Failed to encode group response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleDeleteGroup deletes an agent group
+// @Summary Delete agent group
+// @Description Delete an agent group of the authenticated user. Settings that target the group stop matching any agent.
+// @Tags agent-groups
+// @Produce json
+// @Param id path string true "Group ID"
+// @Success 200 {string} string "Group deleted successfully"
+// @Failure 400 {string} string "Invalid group ID format"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 403 {string} string "Group does not belong to user"
+// @Failure 404 {string} string "Group not found"
+// @Failure 500 {string} string "Failed to delete group"
+// @Router /api/agent-groups/{id} [delete].
+func (s *Server) handleDeleteGroup() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if user is authenticated
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		groupID, err := bson.ObjectIDFromHex(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid group ID format", http.StatusBadRequest)
+			return
+		}
+
+		if err := s.groupService.DeleteGroup(r.Context(), groupID, orgID); err != nil {
+			status := groupErrorStatus(err)
+			if status == http.StatusInternalServerError {
+				log.Printf("Failed to delete group: %v", err)
+				http.Error(w, "Failed to delete group", status)
+				return
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		if err := json.NewEncoder(w).Encode(map[string]string{"message": "Group deleted successfully"}); err != nil {
+			log.Printf("Failed to encode delete response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleListGroupAgents lists the agents of a group
+// @Summary List group members
+// @Description List the agents whose labels currently match the selector of the group
+// @Tags agent-groups
+// @Produce json
+// @Param id path string true "Group ID"
+// @Success 200 {array} agent.AgentInfo
+// @Failure 400 {string} string "Invalid group ID format"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 403 {string} string "Group does not belong to user"
+// @Failure 404 {string} string "Group not found"
+// @Failure 500 {string} string "Failed to retrieve agents info"
+// @Router /api/agent-groups/{id}/agents [get].
+func (s *Server) handleListGroupAgents() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if user is authenticated
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		groupID, err := bson.ObjectIDFromHex(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid group ID format", http.StatusBadRequest)
+			return
+		}
+
+		group, err := s.groupService.GetGroup(r.Context(), groupID, orgID)
+		if err != nil {
+			status := groupErrorStatus(err)
+			if status == http.StatusInternalServerError {
+				log.Printf("Failed to retrieve group: %v", err)
+				http.Error(w, "Failed to retrieve group", status)
+				return
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		selector, err := agent.ParseSelector(group.Selector)
+		if err != nil {
+			log.Printf("Failed to parse selector of group %s: %v", group.Name, err)
+			http.Error(w, "Failed to retrieve agents info", http.StatusInternalServerError)
+			return
+		}
+
+		agents, err := s.agentInfoService.FindAgents(r.Context(), orgID, agent.AgentQuery{Selector: selector})
+		if err != nil {
+			log.Printf("Failed to retrieve agents info: %v", err)
+			http.Error(w, "Failed to retrieve agents info", http.StatusInternalServerError)
+			return
+		}
+
+		if err := json.NewEncoder(w).Encode(agents); err != nil {
+			log.Printf("Failed to encode agents response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// campaignErrorStatus maps campaign errors to HTTP status codes.
+func campaignErrorStatus(err error) int {
+	switch {
+	case strings.Contains(err.Error(), "campaign not found"):
+		return http.StatusNotFound
+	case strings.Contains(err.Error(), "does not belong to user"):
+		return http.StatusForbidden
+	case strings.Contains(err.Error(), "campaign is already"):
+		return http.StatusConflict
+	case strings.Contains(err.Error(), "invalid campaign"):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// handleCreateCampaign starts a diagnostic campaign
+// @Summary Create diagnostic campaign
+// @Description Diagnose the same issue on many agents, chosen by ID, label selector or group. One diagnostic session is started per agent, with at most concurrency sessions in progress at a time.
+// @Tags campaigns
+// @Accept json
+// @Produce json
+// @Param request body campaign.CreateCampaignRequest true "Campaign"
+// @Success 201 {object} campaign.Campaign
+// @Failure 400 {string} string "Invalid request payload, targets or concurrency"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 500 {string} string "Failed to create campaign"
+// @Router /api/campaigns [post].
+func (s *Server) handleCreateCampaign() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if user is authenticated
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		var req campaign.CreateCampaignRequest
+		if err := parseRequestJSON(r, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		created, err := s.campaignService.CreateCampaign(r.Context(), orgID, &req)
+		if err != nil {
+			status := campaignErrorStatus(err)
+			if status == http.StatusInternalServerError {
+				log.Printf("Failed to create campaign: %v", err)
+				http.Error(w, "Failed to create campaign", status)
+				return
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(created); err != nil {
+			log.Printf("Failed to encode campaign response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleListCampaigns lists the campaigns of the authenticated user
+// @Summary List diagnostic campaigns
+// @Description List the diagnostic campaigns of the authenticated user, newest first
+// @Tags campaigns
+// @Produce json
+// @Success 200 {array} campaign.Campaign
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 500 {string} string "Failed to retrieve campaigns"
+// @Router /api/campaigns [get].
+func (s *Server) handleListCampaigns() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if user is authenticated
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		campaigns, err := s.campaignService.ListCampaigns(r.Context(), orgID)
+		if err != nil {
+			log.Printf("Failed to retrieve campaigns: %v", err)
+			http.Error(w, "Failed to retrieve campaigns", http.StatusInternalServerError)
+			return
+		}
+
+		if campaigns == nil {
+			campaigns = []*campaign.Campaign{}
+		}
+
+		if err := json.NewEncoder(w).Encode(campaigns); err != nil {
+			log.Printf("Failed to encode campaigns response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleGetCampaign retrieves a campaign with the progress of its targets
+// @Summary Get diagnostic campaign
+// @Description Get a diagnostic campaign with the state of every target and the overall progress
+// @Tags campaigns
+// @Produce json
+// @Param id path string true "Campaign ID"
+// @Success 200 {object} campaign.Campaign
+// @Failure 400 {string} string "Invalid campaign ID format"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 403 {string} string "Campaign does not belong to user"
+// @Failure 404 {string} string "Campaign not found"
+// @Failure 500 {string} string "Failed to retrieve campaign"
+// @Router /api/campaigns/{id} [get].
+func (s *Server) handleGetCampaign() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if user is authenticated
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		campaignID, err := bson.ObjectIDFromHex(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid campaign ID format", http.StatusBadRequest)
+			return
+		}
+
+		found, err := s.campaignService.GetCampaign(r.Context(), campaignID, orgID)
+		if err != nil {
+			status := campaignErrorStatus(err)
+			if status == http.StatusInternalServerError {
+				log.Printf("Failed to retrieve campaign: %v", err)
+				http.Error(w, "Failed to retrieve campaign", status)
+				return
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		if err := json.NewEncoder(w).Encode(found); err != nil {
+			log.Printf("Failed to encode campaign response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleCompareCampaign compares the results of a campaign
+// @Summary Compare campaign results
+// @Description Group the agents of a campaign by diagnosis type and root cause, largest group first, to show which hosts share a cause
+// @Tags campaigns
+// @Produce json
+// @Param id path string true "Campaign ID"
+// @Success 200 {object} campaign.Comparison
+// @Failure 400 {string} string "Invalid campaign ID format"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 403 {string} string "Campaign does not belong to user"
+// @Failure 404 {string} string "Campaign not found"
+// @Failure 500 {string} string "Failed to compare campaign results"
+// @Router /api/campaigns/{id}/comparison [get].
+func (s *Server) handleCompareCampaign() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if user is authenticated
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		campaignID, err := bson.ObjectIDFromHex(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid campaign ID format", http.StatusBadRequest)
+			return
+		}
+
+		comparison, err := s.campaignService.CompareResults(r.Context(), campaignID, orgID)
+		if err != nil {
+			status := campaignErrorStatus(err)
+			if status == http.StatusInternalServerError {
+				log.Printf("Failed to compare campaign results: %v", err)
+				http.Error(w, "Failed to compare campaign results", status)
+				return
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		if err := json.NewEncoder(w).Encode(comparison); err != nil {
+			log.Printf("Failed to encode campaign comparison response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleCancelCampaign cancels a running campaign
+// @Summary Cancel diagnostic campaign
+// @Description Stop a running campaign from starting further sessions. Queued targets are skipped; sessions in progress keep running.
+// @Tags campaigns
+// @Produce json
+// @Param id path string true "Campaign ID"
+// @Success 200 {object} campaign.Campaign
+// @Failure 400 {string} string "Invalid campaign ID format"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 403 {string} string "Campaign does not belong to user"
+// @Failure 404 {string} string "Campaign not found"
+// @Failure 409 {string} string "Campaign is not running"
+// @Failure 500 {string} string "Failed to cancel campaign"
+// @Router /api/campaigns/{id}/cancel [post].
+func (s *Server) handleCancelCampaign() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if user is authenticated
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		campaignID, err := bson.ObjectIDFromHex(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid campaign ID format", http.StatusBadRequest)
+			return
+		}
+
+		cancelled, err := s.campaignService.CancelCampaign(r.Context(), campaignID, orgID)
+		if err != nil {
+			status := campaignErrorStatus(err)
+			if status == http.StatusInternalServerError {
+				log.Printf("Failed to cancel campaign: %v", err)
+				http.Error(w, "Failed to cancel campaign", status)
+				return
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		if err := json.NewEncoder(w).Encode(cancelled); err != nil {
+			log.Printf("Failed to encode campaign response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+const (
+	defaultJobPollWait = 30 * time.Second
+	maxJobPollWait     = 60 * time.Second
+)
+
+// jobErrorStatus maps job errors to HTTP status codes.
+func jobErrorStatus(err error) int {
+	switch {
+	case strings.Contains(err.Error(), "not found"):
+		return http.StatusNotFound
+	case strings.Contains(err.Error(), "does not belong to user"):
+		return http.StatusForbidden
+	case strings.Contains(err.Error(), "invalid job transition"), strings.Contains(err.Error(), "agent is offline"), strings.Contains(err.Error(), "agent is decommissioned"):
+		return http.StatusConflict
+	case strings.Contains(err.Error(), "invalid"):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeJobError reports a job error, hiding internal errors behind the given message.
+func writeJobError(w http.ResponseWriter, err error, message string) {
+	status := jobErrorStatus(err)
+	if status == http.StatusInternalServerError {
+		log.Printf("%s: %v", message, err)
+		http.Error(w, message, status)
+		return
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// handleCreateJob queues a job for an agent
+// @Summary Queue agent job
+// @Description Queue a diagnostic, log_check or metrics_refresh job for an agent. Diagnostic jobs start a session for the issue; the agent runs each iteration as it picks up the jobs.
+// @Tags jobs
+// @Accept json
+// @Produce json
+// @Param id path string true "Agent ID"
+// @Param request body job.CreateJobRequest true "Job"
+// @Success 201 {object} job.Job
+// @Failure 400 {string} string "Invalid agent ID format, request payload or job"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 403 {string} string "Agent does not belong to user"
+// @Failure 404 {string} string "Agent not found"
+// @Failure 409 {string} string "Agent is offline"
+// @Failure 500 {string} string "Failed to queue job"
+// @Router /api/agent-info/{id}/jobs [post].
+func (s *Server) handleCreateJob() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if user is authenticated
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		agentID, err := bson.ObjectIDFromHex(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid agent ID format", http.StatusBadRequest)
+			return
+		}
+
+		var req job.CreateJobRequest
+		if err := parseRequestJSON(r, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		created, err := s.jobService.CreateJob(r.Context(), agentID, orgID, &req)
+		if err != nil {
+			writeJobError(w, err, "Failed to queue job")
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(created); err != nil {
+			log.Printf("Failed to encode job response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handlePollJobs hands out the pending jobs of an agent
+// @Summary Poll agent jobs
+// @Description Long-poll for the jobs queued for an agent. Returns as soon as jobs are available, or an empty list once the wait ends. Jobs without a result within the lease are delivered again.
+// @Tags jobs
+// @Produce json
+// @Param id path string true "Agent ID"
+// @Param wait query string false "How long to wait for a job, e.g. 30s (default 30s, max 60s)"
+// @Success 200 {array} job.Job
+// @Failure 400 {string} string "Invalid agent ID format or wait"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 403 {string} string "Agent does not belong to user"
+// @Failure 404 {string} string "Agent not found"
+// @Failure 500 {string} string "Failed to poll jobs"
+// @Router /api/agent-info/{id}/jobs/poll [post].
+func (s *Server) handlePollJobs() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if user is authenticated
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		agentID, err := bson.ObjectIDFromHex(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid agent ID format", http.StatusBadRequest)
+			return
+		}
+
+		wait := defaultJobPollWait
+		if value := r.URL.Query().Get("wait"); value != "" {
+			wait, err = time.ParseDuration(value)
+			if err != nil || wait < 0 || wait > maxJobPollWait {
+				http.Error(w, fmt.Sprintf("Invalid wait, must be a duration between 0s and %s", maxJobPollWait), http.StatusBadRequest)
+				return
+			}
+		}
+
+		jobs, err := s.jobService.Poll(r.Context(), agentID, orgID, wait)
+		if err != nil {
+			writeJobError(w, err, "Failed to poll jobs")
+			return
+		}
+
+		if err := json.NewEncoder(w).Encode(jobs); err != nil {
+			log.Printf("Failed to encode jobs response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleJobResult records the result of a job
+// @Summary Post job result
+// @Description Post the result of a dispatched job. Diagnostic output continues the session and queues its next iteration; metrics_refresh results update the agent's metrics.
+// @Tags jobs
+// @Accept json
+// @Produce json
+// @Param id path string true "Job ID"
+// @Param request body job.Result true "Result"
+// @Success 200 {object} job.Job
+// @Failure 400 {string} string "Invalid job ID format, request payload or result"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 403 {string} string "Job does not belong to user"
+// @Failure 404 {string} string "Job not found"
+// @Failure 409 {string} string "Job is not dispatched"
+// @Failure 500 {string} string "Failed to record job result"
+// @Router /api/jobs/{id}/result [post].
+func (s *Server) handleJobResult() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if user is authenticated
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		jobID, err := bson.ObjectIDFromHex(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid job ID format", http.StatusBadRequest)
+			return
+		}
+
+		var result job.Result
+		if err := parseRequestJSON(r, &result); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if _, ok := GetAgentFromContext(r); ok {
+			existing, err := s.jobService.GetJob(r.Context(), jobID, orgID)
+			if err != nil {
+				writeJobError(w, err, "Failed to record job result")
+				return
+			}
+			if !checkAgentScope(w, r, existing.AgentID) {
+				return
+			}
+		}
+
+		finished, err := s.jobService.CompleteJob(r.Context(), jobID, orgID, &result)
+		if err != nil {
+			writeJobError(w, err, "Failed to record job result")
+			return
+		}
+
+		if err := json.NewEncoder(w).Encode(finished); err != nil {
+			log.Printf("Failed to encode job response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleListJobs lists the jobs of the authenticated user
+// @Summary List agent jobs
+// @Description List the jobs of the authenticated user, newest first
+// @Tags jobs
+// @Produce json
+// @Param agent_id query string false "Filter by agent ID"
+// @Param status query string false "Filter by status (pending, dispatched, completed, failed, cancelled, expired)"
+// @Success 200 {array} job.Job
+// @Failure 400 {string} string "Invalid status"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 500 {string} string "Failed to retrieve jobs"
+// @Router /api/jobs [get].
+func (s *Server) handleListJobs() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if user is authenticated
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		jobs, err := s.jobService.ListJobs(r.Context(), orgID, r.URL.Query().Get("agent_id"), r.URL.Query().Get("status"))
+		if err != nil {
+			writeJobError(w, err, "Failed to retrieve jobs")
+			return
+		}
+
+		if jobs == nil {
+			jobs = []*job.Job{}
+		}
+
+		if err := json.NewEncoder(w).Encode(jobs); err != nil {
+			log.Printf("Failed to encode jobs response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleGetJob retrieves a job
+// @Summary Get agent job
+// @Description Get a job of the authenticated user with its result
+// @Tags jobs
+// @Produce json
+// @Param id path string true "Job ID"
+// @Success 200 {object} job.Job
+// @Failure 400 {string} string "Invalid job ID format"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 403 {string} string "Job does not belong to user"
+// @Failure 404 {string} string "Job not found"
+// @Failure 500 {string} string "Failed to retrieve job"
+// @Router /api/jobs/{id} [get].
+func (s *Server) handleGetJob() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if user is authenticated
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		jobID, err := bson.ObjectIDFromHex(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid job ID format", http.StatusBadRequest)
+			return
+		}
+
+		found, err := s.jobService.GetJob(r.Context(), jobID, orgID)
+		if err != nil {
+			writeJobError(w, err, "Failed to retrieve job")
+			return
+		}
+
+		if err := json.NewEncoder(w).Encode(found); err != nil {
+			log.Printf("Failed to encode job response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleCancelJob cancels a job
+// @Summary Cancel agent job
+// @Description Cancel a job that has not finished yet. Results posted for it afterwards are rejected.
+// @Tags jobs
+// @Produce json
+// @Param id path string true "Job ID"
+// @Success 200 {object} job.Job
+// @Failure 400 {string} string "Invalid job ID format"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 403 {string} string "Job does not belong to user"
+// @Failure 404 {string} string "Job not found"
+// @Failure 409 {string} string "Job already finished"
+// @Failure 500 {string} string "Failed to cancel job"
+// @Router /api/jobs/{id}/cancel [post].
+func (s *Server) handleCancelJob() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if user is authenticated
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		jobID, err := bson.ObjectIDFromHex(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid job ID format", http.StatusBadRequest)
+			return
+		}
+
+		cancelled, err := s.jobService.CancelJob(r.Context(), jobID, orgID)
+		if err != nil {
+			writeJobError(w, err, "Failed to cancel job")
+			return
+		}
+
+		if err := json.NewEncoder(w).Encode(cancelled); err != nil {
+			log.Printf("Failed to encode job response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleAgentConnect opens the WebSocket connection of an agent
+// @Summary Connect agent
+// @Description Upgrade to a WebSocket connection over which the server pushes jobs and settings and the agent streams job output and results. The agent must send a hello listing the jobs it is still running first; dispatched jobs it does not list are delivered again. A new connection replaces the agent's current one.
+// @Tags agent-info
+// @Param id path string true "Agent ID"
+// @Success 101 {string} string "Switching protocols"
+// @Failure 400 {string} string "Invalid agent ID format or not a WebSocket request"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 403 {string} string "Agent does not belong to user"
+// @Failure 404 {string} string "Agent not found"
+// @Failure 500 {string} string "Failed to retrieve agent"
+// @Router /api/agent-info/{id}/connect [get].
+func (s *Server) handleAgentConnect() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Check if user is authenticated
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		agentID, err := bson.ObjectIDFromHex(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid agent ID format", http.StatusBadRequest)
+			return
+		}
+
+		agentInfo, err := s.agentInfoService.GetAgentInfoByID(r.Context(), agentID)
+		if err != nil {
+			log.Printf("Failed to retrieve agent %s: %v", agentID.Hex(), err)
+			http.Error(w, "Failed to retrieve agent", http.StatusInternalServerError)
+			return
+		}
+		if agentInfo == nil {
+			http.Error(w, "Agent not found", http.StatusNotFound)
+			return
+		}
+		if agentInfo.UserID != orgID {
+			http.Error(w, "Agent does not belong to user", http.StatusForbidden)
+			return
+		}
+
+		s.connections.Serve(w, r, agentInfo)
+	}
+}
+
+// handleListConnections lists the agents connected over WebSocket
+// @Summary List agent connections
+// @Description List the agents of the user that hold a WebSocket connection to this API instance
+// @Tags agent-info
+// @Produce json
+// @Success 200 {array} connection.Info
+// @Failure 401 {string} string "User not authenticated"
+// @Router /api/connections [get].
+func (s *Server) handleListConnections() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if user is authenticated
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		if err := json.NewEncoder(w).Encode(s.connections.Connections(orgID)); err != nil {
+			log.Printf("Failed to encode connections response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// enrollmentErrorStatus maps enrollment and credential errors to HTTP status codes.
+func enrollmentErrorStatus(err error) int {
+	switch {
+	case strings.Contains(err.Error(), "invalid enrollment token"):
+		return http.StatusUnauthorized
+	case strings.Contains(err.Error(), "not found"):
+		return http.StatusNotFound
+	case strings.Contains(err.Error(), "does not belong to user"):
+		return http.StatusForbidden
+	case strings.Contains(err.Error(), "invalid credential transition"):
+		return http.StatusConflict
+	case strings.Contains(err.Error(), "invalid"):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// handleEnrollAgent trades an enrollment token for an agent credential
+// @Summary Enroll agent
+// @Description Register an agent with a single-use enrollment token and issue its own credential. The credential is only returned once; agents send it in the X-NANNYAPI-Key header, and it is only accepted on agent endpoints for the enrolled agent. Agents can also sign requests with the credential, using credential_id as the key ID. Agents that send a PEM csr get a client certificate from the internal CA instead. Pass the agent ID in the agent info to enroll an existing agent again.
+// @Tags agent-info
+// @Accept json
+// @Produce json
+// @Param request body agent.EnrollRequest true "Enrollment token and agent info"
+// @Success 201 {object} agent.EnrollResponse
+// @Failure 400 {string} string "Invalid request payload or agent info"
+// @Failure 401 {string} string "Invalid, used or expired enrollment token"
+// @Failure 403 {string} string "Agent does not belong to user"
+// @Failure 404 {string} string "Agent not found"
+// @Failure 500 {string} string "Failed to enroll agent"
+// @Router /api/agents/enroll [post].
+func (s *Server) handleEnrollAgent() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		var req agent.EnrollRequest
+		if err := parseRequestJSON(r, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Validate required fields
+		info := req.Agent
+		if info.Hostname == "" || info.IPAddress == "" || info.KernelVersion == "" || info.OsVersion == "" {
+			http.Error(w, "All fields (hostname, ip_address, kernel_version) are required", http.StatusBadRequest)
+			return
+		}
+		if err := info.SystemMetrics.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		enrolled, err := s.enrollmentService.Enroll(r.Context(), &req)
+		if err != nil {
+			status := enrollmentErrorStatus(err)
+			if status == http.StatusInternalServerError {
+				log.Printf("Failed to enroll agent: %v", err)
+				http.Error(w, "Failed to enroll agent", status)
+				return
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(enrolled); err != nil {
+			log.Printf("Failed to encode enrollment response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleCreateEnrollmentToken creates an enrollment token
+// @Summary Create enrollment token
+// @Description Create a short-lived, single-use token an agent trades for its own credential. The token is only returned once.
+// @Tags agent-info
+// @Accept json
+// @Produce json
+// @Param request body agent.CreateEnrollmentTokenRequest true "Lifetime and labels of the enrolled agent"
+// @Success 201 {object} agent.EnrollmentToken
+// @Failure 400 {string} string "Invalid request payload, ttl or labels"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 500 {string} string "Failed to create enrollment token"
+// @Router /api/enrollment-tokens [post].
+func (s *Server) handleCreateEnrollmentToken() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if user is authenticated
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		// An empty body creates a token with the defaults
+		var req agent.CreateEnrollmentTokenRequest
+		if r.ContentLength != 0 {
+			if err := parseRequestJSON(r, &req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		enrollment, err := s.enrollmentService.CreateEnrollmentToken(r.Context(), orgID, &req)
+		if err != nil {
+			if strings.Contains(err.Error(), "invalid") {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.Printf("Failed to create enrollment token: %v", err)
+			http.Error(w, "Failed to create enrollment token", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(enrollment); err != nil {
+			log.Printf("Failed to encode enrollment token response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleListEnrollmentTokens lists the enrollment tokens of the authenticated user
+// @Summary List enrollment tokens
+// @Description List the enrollment tokens of the authenticated user with their expiry and the agent that used them, newest first
+// @Tags agent-info
+// @Produce json
+// @Success 200 {array} agent.EnrollmentToken
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 500 {string} string "Failed to list enrollment tokens"
+// @Router /api/enrollment-tokens [get].
+func (s *Server) handleListEnrollmentTokens() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if user is authenticated
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		enrollments, err := s.enrollmentService.ListEnrollmentTokens(r.Context(), orgID)
+		if err != nil {
+			log.Printf("Failed to list enrollment tokens: %v", err)
+			http.Error(w, "Failed to list enrollment tokens", http.StatusInternalServerError)
+			return
+		}
+		if enrollments == nil {
+			enrollments = []*agent.EnrollmentToken{}
+		}
+
+		if err := json.NewEncoder(w).Encode(enrollments); err != nil {
+			log.Printf("Failed to encode enrollment tokens response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleDeleteEnrollmentToken deletes an enrollment token
+// @Summary Delete enrollment token
+// @Description Delete an enrollment token so it can no longer be used. Agents that already enrolled with it keep their credentials.
+// @Tags agent-info
+// @Produce json
+// @Param id path string true "Enrollment token ID"
+// @Success 200 {object} map[string]string
+// @Failure 400 {string} string "Invalid enrollment token ID format"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 403 {string} string "Enrollment token does not belong to user"
+// @Failure 404 {string} string "Enrollment token not found"
+// @Failure 500 {string} string "Failed to delete enrollment token"
+// @Router /api/enrollment-tokens/{id} [delete].
+func (s *Server) handleDeleteEnrollmentToken() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if user is authenticated
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		id, err := bson.ObjectIDFromHex(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid enrollment token ID format", http.StatusBadRequest)
+			return
+		}
+
+		if err := s.enrollmentService.DeleteEnrollmentToken(r.Context(), id, orgID); err != nil {
+			status := enrollmentErrorStatus(err)
+			if status == http.StatusInternalServerError {
+				log.Printf("Failed to delete enrollment token: %v", err)
+				http.Error(w, "Failed to delete enrollment token", status)
+				return
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		if err := json.NewEncoder(w).Encode(map[string]string{"message": "Enrollment token deleted successfully"}); err != nil {
+			log.Printf("Failed to encode delete enrollment token response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleListAgentCredentials lists the credentials of an agent
+// @Summary List agent credentials
+// @Description List the credentials of an agent, including revoked ones. Secrets are never returned.
+// @Tags agent-info
+// @Produce json
+// @Param id path string true "Agent ID"
+// @Success 200 {array} agent.Credential
+// @Failure 400 {string} string "Invalid agent ID format"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 403 {string} string "Agent does not belong to user"
+// @Failure 404 {string} string "Agent not found"
+// @Failure 500 {string} string "Failed to list credentials"
+// @Router /api/agent-info/{id}/credentials [get].
+func (s *Server) handleListAgentCredentials() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if user is authenticated
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		agentID, err := bson.ObjectIDFromHex(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid agent ID format", http.StatusBadRequest)
+			return
+		}
+
+		credentials, err := s.enrollmentService.ListCredentials(r.Context(), agentID, orgID)
+		if err != nil {
+			status := enrollmentErrorStatus(err)
+			if status == http.StatusInternalServerError {
+				log.Printf("Failed to list credentials: %v", err)
+				http.Error(w, "Failed to list credentials", status)
+				return
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		if credentials == nil {
+			credentials = []*agent.Credential{}
+		}
+
+		if err := json.NewEncoder(w).Encode(credentials); err != nil {
+			log.Printf("Failed to encode credentials response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleRevokeAgentCredential revokes an agent credential
+// @Summary Revoke agent credential
+// @Description Revoke a single agent credential. Requests with it are rejected from then on and a WebSocket connection of the agent is closed; other credentials of the agent keep working.
+// @Tags agent-info
+// @Produce json
+// @Param id path string true "Credential ID"
+// @Success 200 {object} agent.Credential
+// @Failure 400 {string} string "Invalid credential ID format"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 403 {string} string "Credential does not belong to user"
+// @Failure 404 {string} string "Credential not found"
+// @Failure 409 {string} string "Credential is already revoked"
+// @Failure 500 {string} string "Failed to revoke credential"
+// @Router /api/agent-credentials/{id}/revoke [post].
+func (s *Server) handleRevokeAgentCredential() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if user is authenticated
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		id, err := bson.ObjectIDFromHex(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid credential ID format", http.StatusBadRequest)
+			return
+		}
+
+		revoked, err := s.enrollmentService.RevokeCredential(r.Context(), id, orgID)
+		if err != nil {
+			status := enrollmentErrorStatus(err)
+			if status == http.StatusInternalServerError {
+				log.Printf("Failed to revoke credential: %v", err)
+				http.Error(w, "Failed to revoke credential", status)
+				return
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		// The connection may have been opened with the revoked credential; the agent reconnects if it has another
+		s.connections.Disconnect(revoked.AgentID)
+
+		if err := json.NewEncoder(w).Encode(revoked); err != nil {
+			log.Printf("Failed to encode credential response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// decommissionErrorStatus maps decommissioning errors to HTTP status codes.
+func decommissionErrorStatus(err error) int {
+	switch {
+	case strings.Contains(err.Error(), "not found"):
+		return http.StatusNotFound
+	case strings.Contains(err.Error(), "does not belong to user"):
+		return http.StatusForbidden
+	case strings.Contains(err.Error(), "invalid decommission transition"):
+		return http.StatusConflict
+	case strings.Contains(err.Error(), "invalid"):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// handleDecommissionAgent decommissions an agent
+// @Summary Decommission agent
+// @Description Retire an agent: revoke its credentials and certificates, close its WebSocket connection, and cancel its unfinished jobs and diagnostic sessions. In archive mode the agent, its sessions and metric history are kept until AGENT_ARCHIVE_RETENTION passes; in delete mode they are deleted right away. Archived agents can be decommissioned again in delete mode. The report tells what was revoked, cancelled and deleted.
+// @Tags agent-info
+// @Accept json
+// @Produce json
+// @Param id path string true "Agent ID"
+// @Param request body decommission.Request false "Retention mode, archive or delete (default AGENT_DECOMMISSION_MODE)"
+// @Success 200 {object} decommission.Report
+// @Failure 400 {string} string "Invalid decommission mode"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 403 {string} string "Agent does not belong to user"
+// @Failure 404 {string} string "Agent not found"
+// @Failure 409 {string} string "Agent is already decommissioned"
+// @Failure 500 {string} string "Failed to decommission agent"
+// @Router /api/agent-info/{id}/decommission [post].
+func (s *Server) handleDecommissionAgent() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if user is authenticated
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		agentID, err := bson.ObjectIDFromHex(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid agent ID format", http.StatusBadRequest)
+			return
+		}
+
+		// An empty body uses the configured retention mode
+		var req decommission.Request
+		if r.ContentLength != 0 {
+			if err := parseRequestJSON(r, &req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		report, err := s.decommissionService.Decommission(r.Context(), agentID, orgID, &req)
+		if err != nil {
+			status := decommissionErrorStatus(err)
+			if status == http.StatusInternalServerError {
+				log.Printf("Failed to decommission agent %s: %v", agentID.Hex(), err)
+				http.Error(w, "Failed to decommission agent", status)
+				return
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		// Its credentials and certificates are revoked, so the agent cannot reconnect
+		s.connections.Disconnect(report.AgentID)
+
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			log.Printf("Failed to encode decommission response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// mergeErrorStatus maps agent merge errors to HTTP status codes.
+func mergeErrorStatus(err error) int {
+	switch {
+	case strings.Contains(err.Error(), "invalid merge"):
+		return http.StatusBadRequest
+	case strings.Contains(err.Error(), "not found"):
+		return http.StatusNotFound
+	case strings.Contains(err.Error(), "does not belong to user"), strings.Contains(err.Error(), "rights the API key does not have"):
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// handleMergeAgents folds duplicate agents into one
+// @Summary Merge duplicate agents
+// @Description Fold duplicate records of the same machine into the agent: move their diagnostic sessions, jobs, metric history, alerts and credentials to it, and delete them. The agent keeps its own info; labels and the machine ID it lacks are taken from the duplicates. Certificates of the duplicates are revoked and their WebSocket connections closed.
+// @Tags agent-info
+// @Accept json
+// @Produce json
+// @Param id path string true "Agent ID to keep"
+// @Param request body merge.Request true "Duplicate agent IDs"
+// @Success 200 {object} merge.Report
+// @Failure 400 {string} string "Invalid merge"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 403 {string} string "Agent does not belong to user"
+// @Failure 404 {string} string "Agent not found"
+// @Failure 500 {string} string "Failed to merge agents"
+// @Router /api/agent-info/{id}/merge [post].
+func (s *Server) handleMergeAgents() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if user is authenticated
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		agentID, err := bson.ObjectIDFromHex(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid agent ID format", http.StatusBadRequest)
+			return
+		}
+
+		var req merge.Request
+		if err := parseRequestJSON(r, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		report, err := s.mergeService.Merge(r.Context(), agentID, orgID, &req)
+		if err != nil {
+			status := mergeErrorStatus(err)
+			if status == http.StatusInternalServerError {
+				log.Printf("Failed to merge agents into %s: %v", agentID.Hex(), err)
+				http.Error(w, "Failed to merge agents", status)
+				return
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		// The duplicates no longer exist; agents holding a moved credential reconnect as the merged agent
+		for _, merged := range report.MergedAgentIDs {
+			s.connections.Disconnect(merged)
+		}
+
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			log.Printf("Failed to encode merge response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// certificateErrorStatus maps certificate errors to HTTP status codes.
+func certificateErrorStatus(err error) int {
+	switch {
+	case strings.Contains(err.Error(), "not found"):
+		return http.StatusNotFound
+	case strings.Contains(err.Error(), "does not belong to user"):
+		return http.StatusForbidden
+	case strings.Contains(err.Error(), "invalid certificate transition"):
+		return http.StatusConflict
+	case strings.Contains(err.Error(), "invalid"):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeCertificateError reports a certificate error, hiding internal errors behind the given message.
+func writeCertificateError(w http.ResponseWriter, err error, message string) {
+	status := certificateErrorStatus(err)
+	if status == http.StatusInternalServerError {
+		log.Printf("%s: %v", message, err)
+		http.Error(w, message, status)
+		return
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// handleGetCACertificate returns the certificate of the internal CA
+// @Summary Get CA certificate
+// @Description Get the PEM certificate of the internal CA that issues agent client certificates
+// @Tags certificates
+// @Produce application/x-pem-file
+// @Success 200 {string} string "PEM certificate"
+// @Router /api/ca/certificate [get].
+func (s *Server) handleGetCACertificate() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		if _, err := w.Write(s.certificateService.Authority().CertificatePEM()); err != nil {
+			log.Printf("Failed to write CA certificate response: %v", err)
+		}
+	}
+}
+
+// handleGetCRL returns the certificate revocation list of the internal CA
+// @Summary Get CRL
+// @Description Get the DER certificate revocation list of the internal CA, listing the revoked agent certificates that have not expired
+// @Tags certificates
+// @Produce application/pkix-crl
+// @Success 200 {string} string "DER CRL"
+// @Failure 500 {string} string "Failed to create CRL"
+// @Router /api/ca/crl [get].
+func (s *Server) handleGetCRL() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		crl, err := s.certificateService.RevocationList(r.Context())
+		if err != nil {
+			log.Printf("Failed to create CRL: %v", err)
+			http.Error(w, "Failed to create CRL", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/pkix-crl")
+		if _, err := w.Write(crl); err != nil {
+			log.Printf("Failed to write CRL response: %v", err)
+		}
+	}
+}
+
+// handleIssueAgentCertificate signs a certificate request of an agent
+// @Summary Issue agent certificate
+// @Description Sign a PEM CSR for an agent, e.g. to rotate its client certificate before renew_after. The subject is always set to the agent ID. Earlier certificates stay valid until they expire or are revoked.
+// @Tags certificates
+// @Accept json
+// @Produce json
+// @Param id path string true "Agent ID"
+// @Param request body pki.CertificateRequest true "Certificate signing request"
+// @Success 201 {object} agent.IssuedCertificate
+// @Failure 400 {string} string "Invalid agent ID format, request payload or CSR"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 403 {string} string "Agent does not belong to user"
+// @Failure 404 {string} string "Agent not found"
+// @Failure 500 {string} string "Failed to issue certificate"
+// @Router /api/agent-info/{id}/certificates [post].
+func (s *Server) handleIssueAgentCertificate() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if user is authenticated
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		agentID, err := bson.ObjectIDFromHex(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid agent ID format", http.StatusBadRequest)
+			return
+		}
+
+		var req pki.CertificateRequest
+		if err := parseRequestJSON(r, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		issued, err := s.certificateService.RotateCertificate(r.Context(), agentID, orgID, req.CSR)
+		if err != nil {
+			writeCertificateError(w, err, "Failed to issue certificate")
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(issued); err != nil {
+			log.Printf("Failed to encode certificate response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleListAgentCertificates lists the certificates of an agent
+// @Summary List agent certificates
+// @Description List the client certificates issued to an agent, newest first, including revoked and expired ones
+// @Tags certificates
+// @Produce json
+// @Param id path string true "Agent ID"
+// @Success 200 {array} pki.Certificate
+// @Failure 400 {string} string "Invalid agent ID format"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 403 {string} string "Agent does not belong to user"
+// @Failure 404 {string} string "Agent not found"
+// @Failure 500 {string} string "Failed to list certificates"
+// @Router /api/agent-info/{id}/certificates [get].
+func (s *Server) handleListAgentCertificates() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if user is authenticated
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		agentID, err := bson.ObjectIDFromHex(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid agent ID format", http.StatusBadRequest)
+			return
+		}
+
+		certs, err := s.certificateService.ListCertificates(r.Context(), agentID, orgID)
+		if err != nil {
+			writeCertificateError(w, err, "Failed to list certificates")
+			return
+		}
+		if certs == nil {
+			certs = []*pki.Certificate{}
+		}
+
+		if err := json.NewEncoder(w).Encode(certs); err != nil {
+			log.Printf("Failed to encode certificates response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleRevokeAgentCertificate revokes an agent certificate
+// @Summary Revoke agent certificate
+// @Description Revoke an agent client certificate. It is rejected from then on, listed in the CRL until it expires, and a WebSocket connection of the agent is closed.
+// @Tags certificates
+// @Produce json
+// @Param id path string true "Certificate ID"
+// @Success 200 {object} pki.Certificate
+// @Failure 400 {string} string "Invalid certificate ID format"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 403 {string} string "Certificate does not belong to user"
+// @Failure 404 {string} string "Certificate not found"
+// @Failure 409 {string} string "Certificate is already revoked"
+// @Failure 500 {string} string "Failed to revoke certificate"
+// @Router /api/agent-certificates/{id}/revoke [post].
+func (s *Server) handleRevokeAgentCertificate() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		// Check if user is authenticated
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		id, err := bson.ObjectIDFromHex(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid certificate ID format", http.StatusBadRequest)
+			return
+		}
+
+		revoked, err := s.certificateService.RevokeCertificate(r.Context(), id, orgID)
+		if err != nil {
+			writeCertificateError(w, err, "Failed to revoke certificate")
+			return
+		}
+
+		// The connection may have been opened with the revoked certificate; the agent reconnects if it has another
+		s.connections.Disconnect(revoked.AgentID)
+
+		if err := json.NewEncoder(w).Encode(revoked); err != nil {
+			log.Printf("Failed to encode certificate response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// orgErrorStatus maps organisation errors to HTTP status codes.
+func orgErrorStatus(err error) int {
+	switch {
+	case strings.Contains(err.Error(), "only owners"), strings.Contains(err.Error(), "does not belong"), strings.Contains(err.Error(), "another email"):
+		return http.StatusForbidden
+	case strings.Contains(err.Error(), "not found"):
+		return http.StatusNotFound
+	case strings.Contains(err.Error(), "invalid"):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeOrgError writes the response for an organisation error, logging unexpected ones.
+func writeOrgError(w http.ResponseWriter, err error, message string) {
+	status := orgErrorStatus(err)
+	if status == http.StatusInternalServerError {
+		log.Printf("%s: %v", message, err)
+		http.Error(w, message, status)
+		return
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// handleListOrganisations lists the organisations of the authenticated user
+// @Summary List organisations
+// @Description List the organisations the authenticated user is a member of with the role of the user, starting with the personal organisation. Send the ID of one in the X-NANNYAPI-Org header to act in it.
+// @Tags organisations
+// @Produce json
+// @Success 200 {array} org.Membership
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 500 {string} string "Failed to list organisations"
+// @Router /api/orgs [get].
+func (s *Server) handleListOrganisations() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		userID, _ := GetUserFromContext(r)
+		if userID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		memberships, err := s.orgService.ListOrganisations(r.Context(), userID)
+		if err != nil {
+			log.Printf("Failed to list organisations of user %s: %v", userID, err)
+			http.Error(w, "Failed to list organisations", http.StatusInternalServerError)
+			return
+		}
+
+		if err := json.NewEncoder(w).Encode(memberships); err != nil {
+			log.Printf("Failed to encode organisations response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleCreateOrganisation creates an organisation
+// @Summary Create organisation
+// @Description Create an organisation with the authenticated user as its owner
+// @Tags organisations
+// @Accept json
+// @Produce json
+// @Param request body org.CreateOrganisationRequest true "Name of the organisation"
+// @Success 201 {object} org.Membership
+// @Failure 400 {string} string "Invalid request payload or name"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 500 {string} string "Failed to create organisation"
+// @Router /api/orgs [post].
+func (s *Server) handleCreateOrganisation() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		userID, _ := GetUserFromContext(r)
+		if userID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		var req org.CreateOrganisationRequest
+		if err := parseRequestJSON(r, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		membership, err := s.orgService.CreateOrganisation(r.Context(), userID, &req)
+		if err != nil {
+			writeOrgError(w, err, "Failed to create organisation")
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(membership); err != nil {
+			log.Printf("Failed to encode organisation response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleGetOrganisation retrieves the organisation the request acts in
+// @Summary Get current organisation
+// @Description Retrieve the organisation the request acts in, selected with the X-NANNYAPI-Org header, with the role of the caller
+// @Tags organisations
+// @Produce json
+// @Success 200 {object} org.Membership
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 404 {string} string "Organisation not found"
+// @Failure 500 {string} string "Failed to retrieve organisation"
+// @Router /api/org [get].
+func (s *Server) handleGetOrganisation() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		userID, _ := GetUserFromContext(r)
+		orgID, _ := GetOrgFromContext(r)
+		role, _ := GetRoleFromContext(r)
+		if userID == "" || orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		organisation, err := s.orgService.GetOrganisation(r.Context(), orgID, userID)
+		if err != nil {
+			writeOrgError(w, err, "Failed to retrieve organisation")
+			return
+		}
+
+		if err := json.NewEncoder(w).Encode(&org.Membership{Organisation: organisation, Role: role}); err != nil {
+			log.Printf("Failed to encode organisation response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleListMembers lists the members of the organisation the request acts in
+// @Summary List members
+// @Description List the members of the organisation the request acts in with their roles, oldest first
+// @Tags organisations
+// @Produce json
+// @Success 200 {array} org.Member
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 500 {string} string "Failed to list members"
+// @Router /api/org/members [get].
+func (s *Server) handleListMembers() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		userID, _ := GetUserFromContext(r)
+		orgID, _ := GetOrgFromContext(r)
+		if userID == "" || orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		members, err := s.orgService.ListMembers(r.Context(), orgID, userID)
+		if err != nil {
+			writeOrgError(w, err, "Failed to list members")
+			return
+		}
+		if members == nil {
+			members = []*org.Member{}
+		}
+
+		if err := json.NewEncoder(w).Encode(members); err != nil {
+			log.Printf("Failed to encode members response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleUpdateMember changes the role of a member
+// @Summary Change member role
+// @Description Change the role of a member of the organisation the request acts in. Only owners may grant or take away the owner role, and the last owner keeps it.
+// @Tags organisations
+// @Accept json
+// @Produce json
+// @Param user_id path string true "User ID of the member"
+// @Param request body org.UpdateMemberRequest true "New role"
+// @Success 200 {object} org.Member
+// @Failure 400 {string} string "Invalid request payload or role, or the last owner"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 403 {string} string "Role does not allow the change"
+// @Failure 404 {string} string "Member not found"
+// @Failure 500 {string} string "Failed to update member"
+// @Router /api/org/members/{user_id} [put].
+func (s *Server) handleUpdateMember() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		orgID, _ := GetOrgFromContext(r)
+		role, _ := GetRoleFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		var req org.UpdateMemberRequest
+		if err := parseRequestJSON(r, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		member, err := s.orgService.UpdateMemberRole(r.Context(), orgID, role, r.PathValue("user_id"), req.Role)
+		if err != nil {
+			writeOrgError(w, err, "Failed to update member")
+			return
+		}
+
+		if err := json.NewEncoder(w).Encode(member); err != nil {
+			log.Printf("Failed to encode member response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleRemoveMember removes a member
+// @Summary Remove member
+// @Description Remove a member from the organisation the request acts in. Only owners may remove owners, and the last owner cannot be removed. Agents, tokens and sessions stay with the organisation.
+// @Tags organisations
+// @Produce json
+// @Param user_id path string true "User ID of the member"
+// @Success 200 {object} map[string]string
+// @Failure 400 {string} string "The last owner"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 403 {string} string "Role does not allow the removal"
+// @Failure 404 {string} string "Member not found"
+// @Failure 500 {string} string "Failed to remove member"
+// @Router /api/org/members/{user_id} [delete].
+func (s *Server) handleRemoveMember() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		orgID, _ := GetOrgFromContext(r)
+		role, _ := GetRoleFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		if err := s.orgService.RemoveMember(r.Context(), orgID, role, r.PathValue("user_id")); err != nil {
+			writeOrgError(w, err, "Failed to remove member")
+			return
+		}
+
+		if err := json.NewEncoder(w).Encode(map[string]string{"message": "Member removed successfully"}); err != nil {
+			log.Printf("Failed to encode remove member response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleLeaveOrganisation removes the authenticated user from the organisation the request acts in
+// @Summary Leave organisation
+// @Description Leave the organisation the request acts in. The last owner cannot leave, and nobody can leave their personal organisation.
+// @Tags organisations
+// @Produce json
+// @Success 200 {object} map[string]string
+// @Failure 400 {string} string "The last owner or a personal organisation"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 500 {string} string "Failed to leave organisation"
+// @Router /api/org/leave [post].
+func (s *Server) handleLeaveOrganisation() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		userID, _ := GetUserFromContext(r)
+		orgID, _ := GetOrgFromContext(r)
+		role, _ := GetRoleFromContext(r)
+		if userID == "" || orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		if err := s.orgService.RemoveMember(r.Context(), orgID, role, userID); err != nil {
+			writeOrgError(w, err, "Failed to leave organisation")
+			return
+		}
+
+		if err := json.NewEncoder(w).Encode(map[string]string{"message": "Left organisation successfully"}); err != nil {
+			log.Printf("Failed to encode leave organisation response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleCreateInvitation invites a user to the organisation the request acts in
+// @Summary Create invitation
+// @Description Invite the user with the email address to the organisation the request acts in. The invited user accepts with the token, which is only returned once and expires after 7 days. Only owners may invite owners.
+// @Tags organisations
+// @Accept json
+// @Produce json
+// @Param request body org.InviteRequest true "Email address and role"
+// @Success 201 {object} org.Invitation
+// @Failure 400 {string} string "Invalid request payload, email address or role, or a personal organisation"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 403 {string} string "Role does not allow the invitation"
+// @Failure 500 {string} string "Failed to create invitation"
+// @Router /api/org/invitations [post].
+func (s *Server) handleCreateInvitation() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		userID, _ := GetUserFromContext(r)
+		orgID, _ := GetOrgFromContext(r)
+		role, _ := GetRoleFromContext(r)
+		if userID == "" || orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		var req org.InviteRequest
+		if err := parseRequestJSON(r, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		invitation, err := s.orgService.Invite(r.Context(), orgID, userID, role, &req)
+		if err != nil {
+			writeOrgError(w, err, "Failed to create invitation")
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(invitation); err != nil {
+			log.Printf("Failed to encode invitation response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleListInvitations lists the pending invitations of the organisation the request acts in
+// @Summary List invitations
+// @Description List the invitations of the organisation the request acts in that can still be accepted, newest first
+// @Tags organisations
+// @Produce json
+// @Success 200 {array} org.Invitation
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 500 {string} string "Failed to list invitations"
+// @Router /api/org/invitations [get].
+func (s *Server) handleListInvitations() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		invitations, err := s.orgService.ListInvitations(r.Context(), orgID)
+		if err != nil {
+			log.Printf("Failed to list invitations of organisation %s: %v", orgID, err)
+			http.Error(w, "Failed to list invitations", http.StatusInternalServerError)
+			return
+		}
+		if invitations == nil {
+			invitations = []*org.Invitation{}
+		}
+
+		if err := json.NewEncoder(w).Encode(invitations); err != nil {
+			log.Printf("Failed to encode invitations response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleRevokeInvitation deletes an invitation
+// @Summary Revoke invitation
+// @Description Delete an invitation of the organisation the request acts in so it can no longer be accepted
+// @Tags organisations
+// @Produce json
+// @Param id path string true "Invitation ID"
+// @Success 200 {object} map[string]string
+// @Failure 400 {string} string "Invalid invitation ID format"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 403 {string} string "Invitation does not belong to organisation"
+// @Failure 404 {string} string "Invitation not found"
+// @Failure 500 {string} string "Failed to revoke invitation"
+// @Router /api/org/invitations/{id} [delete].
+func (s *Server) handleRevokeInvitation() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		orgID, _ := GetOrgFromContext(r)
+		if orgID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		id, err := bson.ObjectIDFromHex(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, "Invalid invitation ID format", http.StatusBadRequest)
+			return
+		}
+
+		if err := s.orgService.RevokeInvitation(r.Context(), orgID, id); err != nil {
+			writeOrgError(w, err, "Failed to revoke invitation")
+			return
+		}
+
+		if err := json.NewEncoder(w).Encode(map[string]string{"message": "Invitation revoked successfully"}); err != nil {
+			log.Printf("Failed to encode revoke invitation response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// handleAcceptInvitation adds the authenticated user to the organisation of an invitation
+// @Summary Accept invitation
+// @Description Join the organisation of an invitation sent to the email address of the authenticated user. Members keep their role.
+// @Tags organisations
+// @Accept json
+// @Produce json
+// @Param request body org.AcceptInvitationRequest true "Invitation token"
+// @Success 200 {object} org.Membership
+// @Failure 400 {string} string "Invalid request payload or token"
+// @Failure 401 {string} string "User not authenticated"
+// @Failure 403 {string} string "Invitation is for another email address"
+// @Failure 404 {string} string "Invitation not found, used or expired"
+// @Failure 500 {string} string "Failed to accept invitation"
+// @Router /api/invitations/accept [post].
+func (s *Server) handleAcceptInvitation() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		userID, _ := GetUserFromContext(r)
+		if userID == "" {
+			http.Error(w, "User not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		var req org.AcceptInvitationRequest
+		if err := parseRequestJSON(r, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		membership, err := s.orgService.AcceptInvitation(r.Context(), userID, req.Token)
+		if err != nil {
+			writeOrgError(w, err, "Failed to accept invitation")
+			return
+		}
+
+		if err := json.NewEncoder(w).Encode(membership); err != nil {
+			log.Printf("Failed to encode membership response: %v", err)
+			http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+			return
+		}
+	}
+}
@@ -13,16 +13,28 @@ import (
 	"testing"
 	"time"
 
+	"github.com/golang-jwt/jwt"
 	"github.com/stretchr/testify/assert"
 	"go.mongodb.org/mongo-driver/v2/bson"
 	"go.mongodb.org/mongo-driver/v2/mongo"
 	"go.mongodb.org/mongo-driver/v2/mongo/options"
 
 	"github.com/harshavmb/nannyapi/internal/agent"
+	"github.com/harshavmb/nannyapi/internal/alert"
 	"github.com/harshavmb/nannyapi/internal/auth"
+	"github.com/harshavmb/nannyapi/internal/campaign"
+	"github.com/harshavmb/nannyapi/internal/connection"
+	"github.com/harshavmb/nannyapi/internal/decommission"
 	"github.com/harshavmb/nannyapi/internal/diagnostic"
+	"github.com/harshavmb/nannyapi/internal/job"
+	"github.com/harshavmb/nannyapi/internal/merge"
+	"github.com/harshavmb/nannyapi/internal/metrics"
+	"github.com/harshavmb/nannyapi/internal/notification"
+	"github.com/harshavmb/nannyapi/internal/org"
+	"github.com/harshavmb/nannyapi/internal/pki"
 	"github.com/harshavmb/nannyapi/internal/token"
 	"github.com/harshavmb/nannyapi/internal/user"
+	"github.com/harshavmb/nannyapi/pkg/database"
 )
 
 const (
@@ -68,6 +80,7 @@ func setupServer(t *testing.T) (*Server, func(), token.Token, string) {
 	refreshTokenRepository := token.NewRefreshTokenRepository(client.Database(testDBName))
 	agentInfoRepository := agent.NewAgentInfoRepository(client.Database(testDBName))
 	diagnosticRepository := diagnostic.NewDiagnosticRepository(client.Database(testDBName))
+	preferencesRepository := notification.NewPreferencesRepository(client.Database(testDBName))
 
 	// Mock Services
 	mockUserService := user.NewUserService(userRepository)
@@ -75,9 +88,35 @@ func setupServer(t *testing.T) (*Server, func(), token.Token, string) {
 	mockTokenService := token.NewTokenService(tokenRepository)
 	mockRefreshTokenService := token.NewRefreshTokenService(refreshTokenRepository)
 	diagnosticService := diagnostic.NewDiagnosticService(os.Getenv("DEEPSEEK_API_KEY"), diagnosticRepository, agentInfoservice)
+	notificationService := notification.NewNotificationService(preferencesRepository, nil, mockUserService, agentInfoservice, diagnosticService)
 
 	// Create a new server instance
-	server := NewServer(mockGitHubAuth, mockUserService, agentInfoservice, mockTokenService, mockRefreshTokenService, diagnosticService, jwtSecret, encryptionKey)
+	metricsService := metrics.NewMetricsService(metrics.NewMetricsRepository(client.Database(testDBName)))
+	changePolicyService := agent.NewChangePolicyService(agent.NewChangePolicyRepository(client.Database(testDBName)))
+	alertService := alert.NewAlertService(alert.NewAlertRepository(client.Database(testDBName)), alert.NewRuleRepository(client.Database(testDBName)), alert.NewBaselineRepository(client.Database(testDBName)), alert.DefaultConfig())
+	groupService := agent.NewGroupService(agent.NewGroupRepository(client.Database(testDBName)))
+	keySource, err := token.NewStaticKeySource(encryptionKey)
+	if err != nil {
+		t.Fatalf("Failed to create key source: %v", err)
+	}
+	envelope := token.NewEnvelope(keySource)
+	enrollmentService := agent.NewEnrollmentService(agent.NewEnrollmentRepository(client.Database(testDBName)), agentInfoservice, envelope, database.NewNonceRepository(client.Database(testDBName), "request_nonces"))
+	campaignService := campaign.NewCampaignService(campaign.NewCampaignRepository(client.Database(testDBName)), diagnosticService, agentInfoservice, groupService, campaign.DefaultConfig())
+	jobService := job.NewJobService(job.NewJobRepository(client.Database(testDBName)), diagnosticService, agentInfoservice, job.DefaultConfig())
+	connections := connection.NewHub(jobService, agentInfoservice, connection.DefaultConfig())
+	authority, err := pki.NewAuthority(time.Now())
+	if err != nil {
+		t.Fatalf("Failed to create certificate authority: %v", err)
+	}
+	certificateService := pki.NewCertificateService(pki.NewCertificateRepository(client.Database(testDBName)), authority, agentInfoservice, pki.DefaultConfig())
+	enrollmentService.SetCertificateIssuer(certificateService)
+	decommissionService := decommission.NewDecommissionService(agentInfoservice, enrollmentService, certificateService, mockTokenService, jobService, diagnosticService, metricsService, decommission.DefaultConfig())
+	mergeService := merge.NewMergeService(agentInfoservice, enrollmentService, certificateService, jobService, diagnosticService, metricsService, alertService)
+	keys := token.NewKeyring(token.NewSigningKeyRepository(client.Database(testDBName)), token.DefaultKeyringConfig(), envelope, jwtSecret)
+	if err := keys.Load(context.Background()); err != nil {
+		t.Fatalf("Failed to load signing keys: %v", err)
+	}
+	server := NewServer(mockGitHubAuth, auth.NewOIDCAuth(nil, mockUserService, mockRefreshTokenService, envelope, jwtSecret, keys, "http://localhost:8081", database.NewNonceRepository(client.Database(testDBName), "login_nonces")), mockUserService, agentInfoservice, mockTokenService, mockRefreshTokenService, diagnosticService, notificationService, metricsService, changePolicyService, alertService, groupService, campaignService, jobService, connections, enrollmentService, certificateService, decommissionService, mergeService, org.NewOrgService(org.NewOrgRepository(client.Database(testDBName)), mockUserService), keys, envelope)
 
 	// Create a valid auth token for the test user
 	testUser := &user.User{
@@ -88,7 +127,7 @@ func setupServer(t *testing.T) (*Server, func(), token.Token, string) {
 		LastLoggedIn: time.Now(),
 	}
 
-	err := mockUserService.SaveUser(context.Background(), map[string]interface{}{
+	err = mockUserService.SaveUser(context.Background(), map[string]interface{}{
 		"email":          testUser.Email,
 		"name":           testUser.Name,
 		"avatar_url":     testUser.AvatarURL,
@@ -113,12 +152,12 @@ func setupServer(t *testing.T) (*Server, func(), token.Token, string) {
 		Token:  token.GenerateRandomString(10),
 	}
 
-	_, err = mockTokenService.CreateToken(context.Background(), staticToken, encryptionKey)
+	_, err = mockTokenService.CreateToken(context.Background(), staticToken, envelope)
 	if err != nil {
 		t.Fatalf("Failed to create auth token: %v", err)
 	}
 
-	accessToken, err := generateAccessToken(staticToken.UserID, jwtSecret)
+	accessToken, err := keys.GenerateJWT(staticToken.UserID, token.AccessTokenLifetime, "access")
 	if err != nil {
 		t.Fatalf("Failed to create access token: %v", err)
 	}
@@ -127,17 +166,17 @@ func setupServer(t *testing.T) (*Server, func(), token.Token, string) {
 }
 
 func TestHandleDeleteAuthToken(t *testing.T) {
-	server, cleanup, _, accessToken := setupServer(t)
+	server, cleanup, staticToken, accessToken := setupServer(t)
 	defer cleanup()
 
 	t.Run("ValidRequest", func(t *testing.T) {
 		// create the token
 		testTokenObj := token.Token{
-			UserID: "123456",
+			UserID: staticToken.UserID,
 			Token:  "adfadsfdsfdsfadsf",
 		}
 
-		tokenCreated, err := server.tokenService.CreateToken(context.Background(), testTokenObj, server.nannyEncryptionKey)
+		tokenCreated, err := server.tokenService.CreateToken(context.Background(), testTokenObj, server.envelope)
 		if err != nil {
 			log.Fatalf("error while creating token: %v", err)
 		}
@@ -171,6 +210,17 @@ func TestHandleDeleteAuthToken(t *testing.T) {
 
 	})
 
+	t.Run("OtherOrganisation", func(t *testing.T) {
+		tokenCreated, err := server.tokenService.CreateToken(context.Background(), token.Token{UserID: "123456", Token: "adfadsfdsfdsfadsf"}, server.envelope)
+		assert.NoError(t, err)
+
+		req := httptest.NewRequest("DELETE", "/api/auth-token/"+tokenCreated.ID.Hex(), nil)
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, req)
+		assert.Equal(t, http.StatusForbidden, recorder.Code)
+	})
+
 	t.Run("InValidRequest", func(t *testing.T) {
 		// create the token
 		testTokenObj := token.Token{
@@ -178,7 +228,7 @@ func TestHandleDeleteAuthToken(t *testing.T) {
 			Token:  "adfadsfdsfdsfadsf",
 		}
 
-		_, err := server.tokenService.CreateToken(context.Background(), testTokenObj, server.nannyEncryptionKey)
+		_, err := server.tokenService.CreateToken(context.Background(), testTokenObj, server.envelope)
 		if err != nil {
 			log.Fatalf("error while creating token: %v", err)
 		}
@@ -369,6 +419,25 @@ func TestHandleAgentInfoWithAccessToken(t *testing.T) {
 		}
 	})
 
+	t.Run("OtherOrganisationAgent", func(t *testing.T) {
+		otherOrgID := bson.NewObjectID().Hex()
+		insertResult, err := server.agentInfoService.SaveAgentInfo(context.Background(), agent.AgentInfo{UserID: otherOrgID, Hostname: "other-host", IPAddress: "10.0.0.2", KernelVersion: "6.1", OsVersion: "Debian 12"})
+		assert.NoError(t, err)
+		agentID := insertResult.InsertedID.(bson.ObjectID)
+
+		agentInfo := fmt.Sprintf(`{"id":"%s","hostname":"taken-host","ip_address":"192.168.1.1","kernel_version":"5.10.0","os_version":"Ubuntu 24.04","status":"decommissioned"}`, agentID.Hex())
+		req := httptest.NewRequest("POST", "/api/agent-info", strings.NewReader(agentInfo))
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, req)
+		assert.Equal(t, http.StatusForbidden, recorder.Code)
+
+		stored, err := server.agentInfoService.GetAgentInfoByID(context.Background(), agentID)
+		assert.NoError(t, err)
+		assert.Equal(t, otherOrgID, stored.UserID)
+		assert.Equal(t, "other-host", stored.Hostname)
+	})
+
 	t.Run("InvalidRequestPayload", func(t *testing.T) {
 		// Create a test request with invalid agent info
 		agentInfo := `{"hostname":"test-host","ip_address":"192.168.1.1"}`
@@ -425,7 +494,7 @@ func TestHandleCreateAuthToken(t *testing.T) {
 	defer cleanup()
 
 	t.Run("ValidRequest", func(t *testing.T) {
-		req, err := http.NewRequest("POST", "/api/auth-token", nil)
+		req, err := http.NewRequest("POST", "/api/auth-token", strings.NewReader(`{"name":"ci","scopes":["diagnostics:read"]}`))
 		if err != nil {
 			t.Fatalf("Could not create request: %v", err)
 		}
@@ -462,6 +531,18 @@ func TestHandleCreateAuthToken(t *testing.T) {
 		assert.Equal(t, responseToken.HashedToken, tokenHash)
 	})
 
+	t.Run("InvalidScope", func(t *testing.T) {
+		req, err := http.NewRequest("POST", "/api/auth-token", strings.NewReader(`{"name":"ci","scopes":["agents:read"]}`))
+		if err != nil {
+			t.Fatalf("Could not create request: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, req)
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	})
+
 	t.Run("UserNotAuthenticated", func(t *testing.T) {
 		// Create a test request with valid token info
 		requestToken := fmt.Sprintf(`{"user_id":"123456","token":"%s"}`, "abcdcadscds") // token model
@@ -483,6 +564,104 @@ func TestHandleCreateAuthToken(t *testing.T) {
 	})
 }
 
+func TestStaticTokenScopes(t *testing.T) {
+	server, cleanup, validToken, _ := setupServer(t)
+	defer cleanup()
+
+	createToken := func(t *testing.T, scopes []string, expiresAt *time.Time) string {
+		tokenString := token.GenerateRandomString(33)
+		_, err := server.tokenService.CreateToken(context.Background(), token.Token{UserID: validToken.UserID, Name: "test", Scopes: scopes, ExpiresAt: expiresAt, Token: tokenString}, server.envelope)
+		if err != nil {
+			t.Fatalf("Failed to create auth token: %v", err)
+		}
+		return tokenString
+	}
+	get := func(path, apiKey string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("X-NANNYAPI-Key", apiKey)
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	t.Run("ScopeGranted", func(t *testing.T) {
+		apiKey := createToken(t, []string{token.ScopeDiagnosticsWrite}, nil)
+		assert.Equal(t, http.StatusOK, get("/api/diagnostics", apiKey))
+	})
+
+	t.Run("ScopeMissing", func(t *testing.T) {
+		apiKey := createToken(t, []string{token.ScopeDiagnosticsRead}, nil)
+		assert.Equal(t, http.StatusForbidden, get("/api/agents", apiKey))
+		assert.Equal(t, http.StatusForbidden, get("/api/auth-tokens", apiKey))
+		// Endpoints without a scope are closed to scoped tokens
+		assert.Equal(t, http.StatusForbidden, get("/api/alerts", apiKey))
+	})
+
+	t.Run("Unscoped", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, get("/api/agents", validToken.Token))
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		expiresAt := time.Now().Add(-time.Minute)
+		apiKey := createToken(t, []string{token.ScopeDiagnosticsRead}, &expiresAt)
+		assert.Equal(t, http.StatusUnauthorized, get("/api/diagnostics", apiKey))
+	})
+}
+
+func TestHandleRotateAuthToken(t *testing.T) {
+	server, cleanup, validToken, accessToken := setupServer(t)
+	defer cleanup()
+
+	oldSecret := token.GenerateRandomString(33)
+	created, err := server.tokenService.CreateToken(context.Background(), token.Token{UserID: validToken.UserID, Name: "fleet", Scopes: []string{token.ScopeAgentsWrite}, Token: oldSecret}, server.envelope)
+	if err != nil {
+		t.Fatalf("Failed to create auth token: %v", err)
+	}
+
+	rotate := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", fmt.Sprintf("/api/auth-token/%s/rotate", created.ID.Hex()), strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, req)
+		return recorder
+	}
+	get := func(apiKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/agents", nil)
+		req.Header.Set("X-NANNYAPI-Key", apiKey)
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	t.Run("GracePeriod", func(t *testing.T) {
+		recorder := rotate(`{"grace_period":"1h"}`)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		var rotated token.Token
+		assert.NoError(t, json.NewDecoder(recorder.Body).Decode(&rotated))
+		assert.NotEqual(t, oldSecret, rotated.Token)
+		assert.NotNil(t, rotated.GraceEndsAt)
+
+		recorder = get(rotated.Token)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, token.SecretCurrent, recorder.Header().Get(token.SecretHeader))
+
+		recorder = get(oldSecret)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, token.SecretPrevious, recorder.Header().Get(token.SecretHeader))
+		oldSecret = rotated.Token
+	})
+
+	t.Run("NoGracePeriod", func(t *testing.T) {
+		recorder := rotate(`{"grace_period":"0s"}`)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, http.StatusUnauthorized, get(oldSecret).Code)
+	})
+
+	t.Run("InvalidGracePeriod", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, rotate(`{"grace_period":"forever"}`).Code)
+	})
+}
+
 func TestHandleGetAgentInfoByID(t *testing.T) {
 	server, cleanup, validToken, _ := setupServer(t)
 	defer cleanup()
@@ -532,6 +711,32 @@ func TestHandleGetAgentInfoByID(t *testing.T) {
 		}
 	})
 
+	t.Run("OtherOrganisation", func(t *testing.T) {
+		insertResult, err := server.agentInfoService.SaveAgentInfo(context.Background(), agent.AgentInfo{
+			UserID:        "other-org",
+			Hostname:      "other-host",
+			IPAddress:     "192.168.1.2",
+			KernelVersion: "5.10.0",
+			OsVersion:     "Ubuntu 24.04",
+		})
+		assert.NoError(t, err)
+
+		req := httptest.NewRequest("GET", fmt.Sprintf("/api/agent-info/%s", insertResult.InsertedID.(bson.ObjectID).Hex()), nil)
+		req.Header.Set("X-NANNYAPI-Key", validToken.Token)
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, req)
+		assert.Equal(t, http.StatusForbidden, recorder.Code)
+		assert.NotContains(t, recorder.Body.String(), "other-host")
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/api/agent-info/%s", bson.NewObjectID().Hex()), nil)
+		req.Header.Set("X-NANNYAPI-Key", validToken.Token)
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, req)
+		assert.Equal(t, http.StatusNotFound, recorder.Code)
+	})
+
 	t.Run("IDNotProvided", func(t *testing.T) {
 		// Create a test request without ID
 		req, err := http.NewRequest("GET", fmt.Sprintf("/api/agent-info/%s", ""), nil)
@@ -746,7 +951,7 @@ func TestHandleRefreshToken(t *testing.T) {
 	t.Run("ValidRefreshToken", func(t *testing.T) {
 		userID := "test-user-id"
 		// Generate the refresh token
-		tokenString, err := generateRefreshToken(userID, jwtSecret)
+		tokenString, err := server.keys.GenerateJWT(userID, token.RefreshTokenLifetime, "refresh")
 		if err != nil {
 			log.Fatalf("error generating refresh token %v", err)
 		}
@@ -757,7 +962,7 @@ func TestHandleRefreshToken(t *testing.T) {
 			UserAgent: "test-agent",
 			IPAddress: "127.0.0.1",
 			Token:     tokenString,
-		}, server.nannyEncryptionKey)
+		}, server.envelope)
 		assert.NoError(t, err)
 
 		// Create a request with the valid refresh token
@@ -779,13 +984,57 @@ func TestHandleRefreshToken(t *testing.T) {
 		assert.NoError(t, err)
 		assert.NotEmpty(t, response["access_token"])
 		assert.NotEmpty(t, response["refresh_token"])
+		assert.NotEqual(t, tokenString, response["refresh_token"])
 		assert.Equal(t, token.HashToken(tokenString), refreshToken.HashedToken)
+
+		// The response cookie carries the rotated token
+		var cookieValue string
+		for _, cookie := range recorder.Result().Cookies() {
+			if cookie.Name == "refresh_token" {
+				cookieValue = cookie.Value
+			}
+		}
+		assert.Equal(t, response["refresh_token"], cookieValue)
+	})
+
+	t.Run("ReusedRefreshToken", func(t *testing.T) {
+		userID := "test-user-id"
+		tokenString, err := server.keys.GenerateJWT(userID, token.RefreshTokenLifetime, "refresh")
+		assert.NoError(t, err)
+		_, err = server.refreshTokenservice.CreateRefreshToken(context.Background(), token.RefreshToken{
+			UserID: userID,
+			Token:  tokenString,
+		}, server.envelope)
+		assert.NoError(t, err)
+
+		refresh := func(value string) *httptest.ResponseRecorder {
+			req, err := http.NewRequest("POST", "/api/refresh-token", nil)
+			assert.NoError(t, err)
+			req.AddCookie(&http.Cookie{Name: "refresh_token", Value: value})
+			recorder := httptest.NewRecorder()
+			server.ServeHTTP(recorder, req)
+			return recorder
+		}
+
+		recorder := refresh(tokenString)
+		assert.Equal(t, http.StatusCreated, recorder.Code)
+		var response map[string]string
+		assert.NoError(t, json.NewDecoder(recorder.Body).Decode(&response))
+
+		// Presenting the retired token again revokes the token issued in exchange
+		recorder = refresh(tokenString)
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "refresh token reuse detected")
+
+		recorder = refresh(response["refresh_token"])
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "refresh token revoked")
 	})
 
 	t.Run("ExpiredRefreshToken", func(t *testing.T) {
 		userID := "test-user-id"
 		// Generate the refresh token
-		tokenString, err := generateRefreshToken(userID, jwtSecret)
+		tokenString, err := server.keys.GenerateJWT(userID, token.RefreshTokenLifetime, "refresh")
 		if err != nil {
 			log.Fatalf("error generating refresh token %v", err)
 		}
@@ -796,7 +1045,7 @@ func TestHandleRefreshToken(t *testing.T) {
 			UserAgent: "test-agent",
 			IPAddress: "127.0.0.1",
 			Token:     tokenString,
-		}, server.nannyEncryptionKey)
+		}, server.envelope)
 		assert.NoError(t, err)
 
 		// Simulate an expired refresh token
@@ -812,7 +1061,7 @@ func TestHandleRefreshToken(t *testing.T) {
 		}
 
 		// update the token now
-		err = server.refreshTokenservice.UpdateRefreshToken(context.Background(), updatedToken, server.nannyEncryptionKey)
+		err = server.refreshTokenservice.UpdateRefreshToken(context.Background(), updatedToken, server.envelope)
 		if err != nil {
 			log.Fatalf("error updating refresh token %v", err)
 		}
@@ -829,13 +1078,8 @@ func TestHandleRefreshToken(t *testing.T) {
 		recorder := httptest.NewRecorder()
 		server.ServeHTTP(recorder, req)
 
-		assert.Equal(t, http.StatusCreated, recorder.Code)
-
-		var response map[string]string
-		err = json.NewDecoder(recorder.Body).Decode(&response)
-		assert.NoError(t, err)
-		assert.NotEmpty(t, response["access_token"])
-		assert.NotEmpty(t, response["refresh_token"])
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "refresh token expired")
 	})
 
 	t.Run("InvalidRefreshToken", func(t *testing.T) {
@@ -874,6 +1118,166 @@ func TestHandleRefreshToken(t *testing.T) {
 	})
 }
 
+func TestJWKS(t *testing.T) {
+	server, cleanup, _, accessToken := setupServer(t)
+	defer cleanup()
+
+	t.Run("ValidRequest", func(t *testing.T) {
+		req, err := http.NewRequest("GET", "/.well-known/jwks.json", nil)
+		assert.NoError(t, err)
+
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, req)
+
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "public, max-age=300", recorder.Header().Get("Cache-Control"))
+
+		var set token.JSONWebKeySet
+		assert.NoError(t, json.NewDecoder(recorder.Body).Decode(&set))
+		assert.NotEmpty(t, set.Keys)
+
+		// The access token names a published key
+		parsed, _, err := new(jwt.Parser).ParseUnverified(accessToken, &token.Claims{})
+		assert.NoError(t, err)
+		assert.Equal(t, set.Keys[0].Kid, parsed.Header["kid"])
+	})
+
+	t.Run("RefreshTokenAsAccessToken", func(t *testing.T) {
+		refreshToken, err := server.keys.GenerateJWT(bson.NewObjectID().Hex(), token.RefreshTokenLifetime, "refresh")
+		assert.NoError(t, err)
+
+		req, err := http.NewRequest("GET", "/api/sessions", nil)
+		assert.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+refreshToken)
+
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, req)
+
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	})
+}
+
+func TestSessions(t *testing.T) {
+	server, cleanup, validToken, accessToken := setupServer(t)
+	defer cleanup()
+
+	// The test user is shared with other tests, start without sessions
+	assert.NoError(t, server.refreshTokenservice.RevokeAllRefreshTokens(context.Background(), validToken.UserID))
+
+	login := func(userAgent string) string {
+		refreshToken, err := server.keys.GenerateJWT(validToken.UserID, token.RefreshTokenLifetime, "refresh")
+		assert.NoError(t, err)
+		_, err = server.refreshTokenservice.CreateRefreshToken(context.Background(), token.RefreshToken{
+			UserID:    validToken.UserID,
+			Token:     refreshToken,
+			UserAgent: userAgent,
+			IPAddress: "127.0.0.1",
+		}, server.envelope)
+		assert.NoError(t, err)
+		return refreshToken
+	}
+	request := func(method, path, refreshToken string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		if refreshToken != "" {
+			req.AddCookie(&http.Cookie{Name: "refresh_token", Value: refreshToken})
+		}
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, req)
+		return recorder
+	}
+	list := func(refreshToken string) []token.Session {
+		recorder := request("GET", "/api/sessions", refreshToken)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		var sessions []token.Session
+		assert.NoError(t, json.NewDecoder(recorder.Body).Decode(&sessions))
+		return sessions
+	}
+
+	laptop := login("Mozilla/5.0 (X11; Linux x86_64; rv:89.0) Gecko/20100101 Firefox/89.0")
+	phone := login("Mozilla/5.0 (iPhone; CPU iPhone OS 14_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/14.0.3 Mobile/15E148 Safari/604.1")
+	tablet := login("Mozilla/5.0 (Linux; Android 10; SM-A205U) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/90.0.4430.210 Mobile Safari/537.36")
+
+	t.Run("ListSessions", func(t *testing.T) {
+		sessions := list(laptop)
+		assert.Len(t, sessions, 3)
+		devices := map[string]bool{}
+		for _, session := range sessions {
+			devices[session.Device] = session.Current
+			assert.Equal(t, "127.0.0.1", session.IPAddress)
+		}
+		assert.Equal(t, map[string]bool{"Firefox on Linux": true, "Safari on iOS": false, "Chrome on Android": false}, devices)
+	})
+
+	t.Run("RevokeSession", func(t *testing.T) {
+		var phoneSession string
+		for _, session := range list(phone) {
+			if session.Current {
+				phoneSession = session.ID
+			}
+		}
+
+		recorder := request("DELETE", "/api/sessions/"+phoneSession, laptop)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Len(t, list(laptop), 2)
+
+		recorder = request("POST", "/api/refresh-token", phone)
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+
+		recorder = request("DELETE", "/api/sessions/"+phoneSession, laptop)
+		assert.Equal(t, http.StatusNotFound, recorder.Code)
+	})
+
+	t.Run("RevokeOtherSessions", func(t *testing.T) {
+		recorder := request("DELETE", "/api/sessions", laptop)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		var response map[string]int
+		assert.NoError(t, json.NewDecoder(recorder.Body).Decode(&response))
+		assert.Equal(t, 1, response["revoked"])
+
+		recorder = request("POST", "/api/refresh-token", tablet)
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+		sessions := list(laptop)
+		assert.Len(t, sessions, 1)
+		assert.True(t, sessions[0].Current)
+
+		// Without the refresh token the current session is unknown, so nothing is signed out
+		recorder = request("DELETE", "/api/sessions", "")
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+		assert.Len(t, list(laptop), 1)
+	})
+
+	t.Run("APIKey", func(t *testing.T) {
+		for _, method := range []string{"GET", "DELETE"} {
+			req := httptest.NewRequest(method, "/api/sessions", nil)
+			req.Header.Set("X-NANNYAPI-Key", validToken.Token)
+			recorder := httptest.NewRecorder()
+			server.ServeHTTP(recorder, req)
+			assert.Equal(t, http.StatusForbidden, recorder.Code)
+		}
+		assert.Len(t, list(laptop), 1)
+	})
+
+	t.Run("Logout", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/api/logout", nil)
+		req.AddCookie(&http.Cookie{Name: "refresh_token", Value: laptop})
+		req.AddCookie(&http.Cookie{Name: "GH_Authorization", Value: "gho_token"})
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, req)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		cleared := map[string]bool{}
+		for _, cookie := range recorder.Result().Cookies() {
+			cleared[cookie.Name] = cookie.MaxAge < 0
+		}
+		assert.Equal(t, map[string]bool{"refresh_token": true, "GH_Authorization": true}, cleared)
+
+		recorder = request("POST", "/api/refresh-token", laptop)
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+		assert.Empty(t, list(""))
+	})
+}
+
 func TestHandleStartDiagnostic(t *testing.T) {
 	server, cleanup, validToken, _ := setupServer(t)
 	defer cleanup()
@@ -1266,7 +1670,7 @@ func TestHandleDeleteDiagnostic(t *testing.T) {
 		assert.Equal(t, http.StatusOK, recorder.Code)
 
 		// Verify session was deleted
-		_, err = server.diagnosticService.GetDiagnosticSession(context.Background(), session.ID.Hex())
+		_, err = server.diagnosticService.GetDiagnosticSession(context.Background(), session.ID.Hex(), session.UserID)
 		assert.Error(t, err)
 		assert.Contains(t, err.Error(), "session not found")
 	})
@@ -1412,3 +1816,185 @@ func TestHandleGetDiagnosticSummary(t *testing.T) {
 		assert.Contains(t, recorder.Body.String(), "invalid session ID format")
 	})
 }
+
+func TestHandleUpdateNotificationPreferences(t *testing.T) {
+	server, cleanup, validToken, _ := setupServer(t)
+	defer cleanup()
+
+	update := func(body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("PUT", "/api/notification-preferences", strings.NewReader(body))
+		assert.NoError(t, err)
+		req.Header.Set("X-NANNYAPI-Key", validToken.Token)
+		req.Header.Set("Content-Type", "application/json")
+
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	t.Run("PartialUpdate", func(t *testing.T) {
+		recorder := update(`{"daily_digest": true, "digest_hour": 17}`)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		// Fields left out keep their saved value
+		recorder = update(`{"session_completed": false}`)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		var prefs notification.Preferences
+		assert.NoError(t, json.NewDecoder(recorder.Body).Decode(&prefs))
+		assert.True(t, prefs.DailyDigest)
+		assert.Equal(t, 17, prefs.DigestHour)
+		assert.False(t, prefs.SessionCompleted)
+	})
+
+	t.Run("AccountEmail", func(t *testing.T) {
+		recorder := update(`{"email": "Test@Example.com"}`)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		var prefs notification.Preferences
+		assert.NoError(t, json.NewDecoder(recorder.Body).Decode(&prefs))
+		assert.Equal(t, "test@example.com", prefs.Email)
+	})
+
+	t.Run("OtherEmail", func(t *testing.T) {
+		recorder := update(`{"email": "someone-else@example.com"}`)
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "email address of your account")
+	})
+
+	t.Run("InvalidDigestHour", func(t *testing.T) {
+		recorder := update(`{"digest_hour": 24}`)
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	})
+}
+
+func TestOrganisations(t *testing.T) {
+	server, cleanup, staticToken, accessToken := setupServer(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	// A teammate of the test user
+	err := server.userService.SaveUser(ctx, map[string]interface{}{
+		"email":      "teammate@example.com",
+		"name":       "Teammate",
+		"avatar_url": "",
+		"html_url":   "",
+	})
+	assert.NoError(t, err)
+	teammate, err := server.userService.GetUserByEmail(ctx, "teammate@example.com")
+	assert.NoError(t, err)
+	teammateToken, err := server.keys.GenerateJWT(teammate.ID.Hex(), token.AccessTokenLifetime, "access")
+	assert.NoError(t, err)
+
+	do := func(method, path, bearer, orgID, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+bearer)
+		req.Header.Set("Content-Type", "application/json")
+		if orgID != "" {
+			req.Header.Set(OrgHeader, orgID)
+		}
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	recorder := do("POST", "/api/orgs", accessToken, "", `{"name":"Platform"}`)
+	assert.Equal(t, http.StatusCreated, recorder.Code)
+	var created org.Membership
+	assert.NoError(t, json.NewDecoder(recorder.Body).Decode(&created))
+	assert.Equal(t, org.RoleOwner, created.Role)
+	orgID := created.ID
+
+	// Agents of the organisation are not those of the personal organisation
+	_, err = server.agentInfoService.SaveAgentInfo(ctx, agent.AgentInfo{UserID: orgID, Hostname: "shared-host", IPAddress: "10.0.0.1", KernelVersion: "6.1", OsVersion: "Debian 12"})
+	assert.NoError(t, err)
+
+	t.Run("NotAMember", func(t *testing.T) {
+		recorder := do("GET", "/api/agents", teammateToken, orgID, "")
+		assert.Equal(t, http.StatusForbidden, recorder.Code)
+	})
+
+	t.Run("Invitation", func(t *testing.T) {
+		// Personal organisations have no other members
+		recorder := do("POST", "/api/org/invitations", accessToken, "", `{"email":"teammate@example.com","role":"viewer"}`)
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+		recorder = do("POST", "/api/org/invitations", accessToken, orgID, `{"email":"teammate@example.com","role":"viewer"}`)
+		assert.Equal(t, http.StatusCreated, recorder.Code)
+		var invitation org.Invitation
+		assert.NoError(t, json.NewDecoder(recorder.Body).Decode(&invitation))
+		assert.NotEmpty(t, invitation.Token)
+
+		// Only the invited user can accept it
+		recorder = do("POST", "/api/invitations/accept", accessToken, "", `{"token":"`+invitation.Token+`"}`)
+		assert.Equal(t, http.StatusForbidden, recorder.Code)
+		recorder = do("POST", "/api/invitations/accept", teammateToken, "", `{"token":"`+invitation.Token+`"}`)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		recorder = do("POST", "/api/invitations/accept", teammateToken, "", `{"token":"`+invitation.Token+`"}`)
+		assert.Equal(t, http.StatusNotFound, recorder.Code)
+
+		recorder = do("GET", "/api/orgs", teammateToken, "", "")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		var memberships []org.Membership
+		assert.NoError(t, json.NewDecoder(recorder.Body).Decode(&memberships))
+		assert.Len(t, memberships, 2)
+		assert.True(t, memberships[0].Personal)
+		assert.Equal(t, org.RoleViewer, memberships[1].Role)
+	})
+
+	t.Run("Viewer", func(t *testing.T) {
+		recorder := do("GET", "/api/agents", teammateToken, orgID, "")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "shared-host")
+
+		recorder = do("POST", "/api/agent-groups", teammateToken, orgID, `{"name":"web"}`)
+		assert.Equal(t, http.StatusForbidden, recorder.Code)
+		recorder = do("POST", "/api/auth-token", teammateToken, orgID, `{"name":"ci","scopes":["agents:write"]}`)
+		assert.Equal(t, http.StatusForbidden, recorder.Code)
+	})
+
+	t.Run("ChangeRole", func(t *testing.T) {
+		recorder := do("PUT", "/api/org/members/"+teammate.ID.Hex(), teammateToken, orgID, `{"role":"admin"}`)
+		assert.Equal(t, http.StatusForbidden, recorder.Code)
+
+		recorder = do("PUT", "/api/org/members/"+teammate.ID.Hex(), accessToken, orgID, `{"role":"admin"}`)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		// Admins cannot take the owner role away
+		recorder = do("PUT", "/api/org/members/"+staticToken.UserID, teammateToken, orgID, `{"role":"viewer"}`)
+		assert.Equal(t, http.StatusForbidden, recorder.Code)
+	})
+
+	t.Run("OrganisationToken", func(t *testing.T) {
+		recorder := do("POST", "/api/auth-token", teammateToken, orgID, `{"name":"ci","scopes":["agents:write"]}`)
+		assert.Equal(t, http.StatusCreated, recorder.Code)
+		var created token.Token
+		assert.NoError(t, json.NewDecoder(recorder.Body).Decode(&created))
+		assert.Equal(t, orgID, created.UserID)
+		assert.Equal(t, teammate.ID.Hex(), created.CreatedBy)
+
+		req := httptest.NewRequest("GET", "/api/agents", nil)
+		req.Header.Set("X-NANNYAPI-Key", created.Token)
+		recorder = httptest.NewRecorder()
+		server.ServeHTTP(recorder, req)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "shared-host")
+
+		// API keys act in the organisation they were created in
+		req.Header.Set(OrgHeader, teammate.ID.Hex())
+		recorder = httptest.NewRecorder()
+		server.ServeHTTP(recorder, req)
+		assert.Equal(t, http.StatusForbidden, recorder.Code)
+
+		// Keys stop working when their creator leaves
+		recorder = do("POST", "/api/org/leave", teammateToken, orgID, "")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		req.Header.Del(OrgHeader)
+		recorder = httptest.NewRecorder()
+		server.ServeHTTP(recorder, req)
+		assert.Equal(t, http.StatusForbidden, recorder.Code)
+	})
+
+	t.Run("LastOwner", func(t *testing.T) {
+		recorder := do("POST", "/api/org/leave", accessToken, orgID, "")
+		assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	})
+}
@@ -0,0 +1,198 @@
+package token
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// envelopeVersion prefixes values encrypted with an Envelope. Values without a version were encrypted with
+// the master key itself by Encrypt, before envelope encryption was added.
+const envelopeVersion = "v3"
+
+// unboundVersion prefixes envelopes encrypted before values were bound to the document holding them. They
+// are still decrypted, and moved to the current version by Reencrypt.
+const unboundVersion = "v2"
+
+// dataKeySize is the size of the AES-256 keys that encrypt each value.
+const dataKeySize = 32
+
+// Envelope encrypts the secrets stored in the database. Every value is encrypted with its own random data
+// key, which is wrapped by the active master key of the key source and stored next to it:
+//
+//	v3:<master key ID>:<wrapped data key>:<nonce and ciphertext>
+//
+// The ciphertext authenticates the collection, field and document the value is stored in (see AAD), so a
+// value copied into another document or field fails to decrypt. Moving a value to a new master key only
+// rewraps its data key. Values encrypted by Encrypt before envelopes were added are still decrypted with
+// any master key of the source.
+type Envelope struct {
+	source KeySource
+}
+
+// NewEnvelope creates an envelope wrapping data keys with the master keys of the source.
+func NewEnvelope(source KeySource) *Envelope {
+	return &Envelope{source: source}
+}
+
+// ActiveKeyID returns the ID of the master key new values are encrypted under.
+func (e *Envelope) ActiveKeyID() string {
+	return e.source.ActiveKeyID()
+}
+
+// AAD returns the additional authenticated data binding a value to the field of the document it is stored in.
+func AAD(collection, field, id string) []byte {
+	return []byte(collection + "." + field + ":" + id)
+}
+
+// Encrypt encrypts a value with a new data key wrapped by the active master key. The additional data must be
+// passed again to decrypt it.
+func (e *Envelope) Encrypt(plaintext string, aad []byte) (string, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return "", fmt.Errorf("failed to generate data key: %v", err)
+	}
+	sealed, err := seal(dataKey, []byte(plaintext), aad)
+	if err != nil {
+		return "", err
+	}
+	return e.wrap(dataKey, sealed)
+}
+
+// Decrypt decrypts a value encrypted by Encrypt with the same additional data, or by the package Encrypt
+// function with a master key of the source.
+func (e *Envelope) Decrypt(ciphertext string, aad []byte) (string, error) {
+	if strings.HasPrefix(ciphertext, unboundVersion+":") {
+		aad = nil
+	} else if !strings.HasPrefix(ciphertext, envelopeVersion+":") {
+		return e.decryptLegacy(ciphertext)
+	}
+	keyID, dataKey, sealed, err := e.unwrap(ciphertext)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := open(dataKey, sealed, aad)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt value under master key %s: %v", keyID, err)
+	}
+	return string(plaintext), nil
+}
+
+// Current reports whether a value is encrypted in the current format under the active master key.
+func (e *Envelope) Current(ciphertext string) bool {
+	return strings.HasPrefix(ciphertext, e.prefix())
+}
+
+// Reencrypt moves a value to the active master key. Only the data key of an envelope is rewrapped; values
+// from before envelopes or before values were bound to their document are encrypted again with the
+// additional data.
+func (e *Envelope) Reencrypt(ciphertext string, aad []byte) (string, error) {
+	if e.Current(ciphertext) {
+		return ciphertext, nil
+	}
+	if !strings.HasPrefix(ciphertext, envelopeVersion+":") {
+		plaintext, err := e.Decrypt(ciphertext, nil)
+		if err != nil {
+			return "", err
+		}
+		return e.Encrypt(plaintext, aad)
+	}
+	_, dataKey, sealed, err := e.unwrap(ciphertext)
+	if err != nil {
+		return "", err
+	}
+	return e.wrap(dataKey, sealed)
+}
+
+func (e *Envelope) prefix() string {
+	return envelopeVersion + ":" + e.source.ActiveKeyID() + ":"
+}
+
+// wrap wraps the data key with the active master key and formats the value.
+func (e *Envelope) wrap(dataKey, sealed []byte) (string, error) {
+	keyID := e.source.ActiveKeyID()
+	wrapped, err := e.source.WrapKey(keyID, dataKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to wrap data key with master key %s: %v", keyID, err)
+	}
+	return e.prefix() + base64.StdEncoding.EncodeToString(wrapped) + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// unwrap parses a value and unwraps its data key.
+func (e *Envelope) unwrap(ciphertext string) (string, []byte, []byte, error) {
+	parts := strings.Split(ciphertext, ":")
+	if len(parts) != 4 {
+		return "", nil, nil, fmt.Errorf("invalid encrypted value: expected 4 parts, got %d", len(parts))
+	}
+	keyID := parts[1]
+	wrapped, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("invalid encrypted value: failed to base64 decode data key: %v", err)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("invalid encrypted value: failed to base64 decode ciphertext: %v", err)
+	}
+	dataKey, err := e.source.UnwrapKey(keyID, wrapped)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("failed to unwrap data key with master key %s: %v", keyID, err)
+	}
+	return keyID, dataKey, sealed, nil
+}
+
+// decryptLegacy decrypts a value encrypted directly with a master key. The value does not name its key, so
+// each master key is tried, the active one first.
+func (e *Envelope) decryptLegacy(ciphertext string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", fmt.Errorf("failed to base64 decode encrypted string: %v", err)
+	}
+	// Legacy values have the format of wrapped data keys: a nonce and the AES-GCM ciphertext
+	for _, keyID := range e.source.KeyIDs() {
+		if plaintext, err := e.source.UnwrapKey(keyID, sealed); err == nil {
+			return string(plaintext), nil
+		}
+	}
+	return "", fmt.Errorf("failed to decrypt value with any master key")
+}
+
+// seal encrypts with AES-256-GCM, prefixing the ciphertext with the random nonce as Encrypt does.
+func seal(key, plaintext, aad []byte) ([]byte, error) {
+	aesGCM, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aesGCM.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aesGCM.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+// open decrypts the output of seal.
+func open(key, sealed, aad []byte) ([]byte, error) {
+	aesGCM, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aesGCM.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:aesGCM.NonceSize()], sealed[aesGCM.NonceSize():]
+	return aesGCM.Open(nil, nonce, ciphertext, aad)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("invalid key size %d, key size must be 32 bytes for AES-256", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,173 @@
+package token
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const previousEncryptionKey = "q5hYQ8Cw3EcPq/Hq1X0+S4ZVbY8k3zvQZ2zB2VKJk6s=" // Base64 encoded 32-byte key
+
+var testAAD = AAD("auth_tokens", "token", "67c1f0a2b3c4d5e6f7a8b9c0")
+
+func newTestEnvelope(t *testing.T, keys ...string) *Envelope {
+	if len(keys) == 0 {
+		keys = []string{encryptionKey}
+	}
+	source, err := NewStaticKeySource(keys...)
+	assert.NoError(t, err)
+	return NewEnvelope(source)
+}
+
+func TestEnvelope(t *testing.T) {
+	envelope := newTestEnvelope(t)
+
+	t.Run("EncryptDecrypt", func(t *testing.T) {
+		encrypted, err := envelope.Encrypt("nanny-secret", testAAD)
+		assert.NoError(t, err)
+		assert.True(t, strings.HasPrefix(encrypted, "v3:"+envelope.ActiveKeyID()+":"))
+		assert.NotContains(t, encrypted, "nanny-secret")
+		assert.True(t, envelope.Current(encrypted))
+
+		decrypted, err := envelope.Decrypt(encrypted, testAAD)
+		assert.NoError(t, err)
+		assert.Equal(t, "nanny-secret", decrypted)
+	})
+
+	t.Run("DataKeyPerValue", func(t *testing.T) {
+		first, err := envelope.Encrypt("nanny-secret", testAAD)
+		assert.NoError(t, err)
+		second, err := envelope.Encrypt("nanny-secret", testAAD)
+		assert.NoError(t, err)
+		assert.NotEqual(t, strings.Split(first, ":")[2], strings.Split(second, ":")[2])
+	})
+
+	t.Run("LegacyValue", func(t *testing.T) {
+		legacy, err := Encrypt("nanny-secret", encryptionKey)
+		assert.NoError(t, err)
+		assert.False(t, envelope.Current(legacy))
+
+		decrypted, err := envelope.Decrypt(legacy, testAAD)
+		assert.NoError(t, err)
+		assert.Equal(t, "nanny-secret", decrypted)
+	})
+
+	t.Run("OtherMasterKey", func(t *testing.T) {
+		encrypted, err := newTestEnvelope(t, previousEncryptionKey).Encrypt("nanny-secret", testAAD)
+		assert.NoError(t, err)
+
+		_, err = envelope.Decrypt(encrypted, testAAD)
+		assert.ErrorContains(t, err, "unknown master key")
+	})
+
+	t.Run("OtherDocument", func(t *testing.T) {
+		encrypted, err := envelope.Encrypt("nanny-secret", testAAD)
+		assert.NoError(t, err)
+
+		_, err = envelope.Decrypt(encrypted, AAD("auth_tokens", "token", "67c1f0a2b3c4d5e6f7a8b9c1"))
+		assert.ErrorContains(t, err, "failed to decrypt value")
+		_, err = envelope.Decrypt(encrypted, AAD("refresh_tokens", "token", "67c1f0a2b3c4d5e6f7a8b9c0"))
+		assert.ErrorContains(t, err, "failed to decrypt value")
+	})
+
+	t.Run("Tampered", func(t *testing.T) {
+		encrypted, err := envelope.Encrypt("nanny-secret", testAAD)
+		assert.NoError(t, err)
+		parts := strings.Split(encrypted, ":")
+		other, err := envelope.Encrypt("other-secret", testAAD)
+		assert.NoError(t, err)
+		parts[3] = strings.Split(other, ":")[3]
+
+		_, err = envelope.Decrypt(strings.Join(parts, ":"), testAAD)
+		assert.ErrorContains(t, err, "failed to decrypt value")
+	})
+
+	t.Run("Malformed", func(t *testing.T) {
+		_, err := envelope.Decrypt("v3:abc", testAAD)
+		assert.ErrorContains(t, err, "invalid encrypted value")
+		_, err = envelope.Decrypt("v3:abc:!!!:!!!", testAAD)
+		assert.ErrorContains(t, err, "invalid encrypted value")
+		_, err = envelope.Decrypt("not base64!", testAAD)
+		assert.ErrorContains(t, err, "failed to base64 decode")
+	})
+}
+
+func TestEnvelopeReencrypt(t *testing.T) {
+	previous := newTestEnvelope(t, previousEncryptionKey)
+	rotated := newTestEnvelope(t, encryptionKey, previousEncryptionKey)
+
+	t.Run("Rewrap", func(t *testing.T) {
+		encrypted, err := previous.Encrypt("nanny-secret", testAAD)
+		assert.NoError(t, err)
+		assert.False(t, rotated.Current(encrypted))
+
+		// Values under the previous key are still readable
+		decrypted, err := rotated.Decrypt(encrypted, testAAD)
+		assert.NoError(t, err)
+		assert.Equal(t, "nanny-secret", decrypted)
+
+		moved, err := rotated.Reencrypt(encrypted, testAAD)
+		assert.NoError(t, err)
+		assert.True(t, rotated.Current(moved))
+		// Only the data key is rewrapped
+		assert.Equal(t, strings.Split(encrypted, ":")[3], strings.Split(moved, ":")[3])
+
+		decrypted, err = newTestEnvelope(t).Decrypt(moved, testAAD)
+		assert.NoError(t, err)
+		assert.Equal(t, "nanny-secret", decrypted)
+	})
+
+	t.Run("LegacyValue", func(t *testing.T) {
+		legacy, err := Encrypt("nanny-secret", previousEncryptionKey)
+		assert.NoError(t, err)
+
+		moved, err := rotated.Reencrypt(legacy, testAAD)
+		assert.NoError(t, err)
+		assert.True(t, rotated.Current(moved))
+
+		decrypted, err := newTestEnvelope(t).Decrypt(moved, testAAD)
+		assert.NoError(t, err)
+		assert.Equal(t, "nanny-secret", decrypted)
+	})
+
+	t.Run("UnboundValue", func(t *testing.T) {
+		// Envelopes encrypted before values were bound to their document
+		dataKey := make([]byte, dataKeySize)
+		sealed, err := seal(dataKey, []byte("nanny-secret"), nil)
+		assert.NoError(t, err)
+		encrypted, err := previous.wrap(dataKey, sealed)
+		assert.NoError(t, err)
+		unbound := strings.Replace(encrypted, "v3:", "v2:", 1)
+
+		decrypted, err := rotated.Decrypt(unbound, testAAD)
+		assert.NoError(t, err)
+		assert.Equal(t, "nanny-secret", decrypted)
+
+		moved, err := rotated.Reencrypt(unbound, testAAD)
+		assert.NoError(t, err)
+		assert.True(t, rotated.Current(moved))
+		decrypted, err = rotated.Decrypt(moved, testAAD)
+		assert.NoError(t, err)
+		assert.Equal(t, "nanny-secret", decrypted)
+		_, err = rotated.Decrypt(moved, nil)
+		assert.ErrorContains(t, err, "failed to decrypt value")
+	})
+
+	t.Run("Current", func(t *testing.T) {
+		encrypted, err := rotated.Encrypt("nanny-secret", testAAD)
+		assert.NoError(t, err)
+
+		moved, err := rotated.Reencrypt(encrypted, testAAD)
+		assert.NoError(t, err)
+		assert.Equal(t, encrypted, moved)
+	})
+
+	t.Run("UnknownKey", func(t *testing.T) {
+		legacy, err := Encrypt("nanny-secret", previousEncryptionKey)
+		assert.NoError(t, err)
+
+		_, err = newTestEnvelope(t).Reencrypt(legacy, testAAD)
+		assert.EqualError(t, err, "failed to decrypt value with any master key")
+	})
+}
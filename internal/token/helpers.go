@@ -10,9 +10,6 @@ import (
 	"io"
 	"log"
 	"math"
-	"time"
-
-	"github.com/golang-jwt/jwt"
 )
 
 const (
@@ -42,6 +39,8 @@ func HashToken(token string) string {
 	return base64.StdEncoding.EncodeToString(hash[:])
 }
 
+// Encrypt encrypts a string with a base64 encoded AES-256 key. Secrets were stored in this format before
+// envelope encryption, see Envelope.
 func Encrypt(stringToEncrypt, encryptionKey string) (string, error) {
 
 	// Base64 decode the encryption key
@@ -125,62 +124,3 @@ func Decrypt(encryptedString string, encryptionKey string) (string, error) {
 
 	return string(plaintext), nil
 }
-
-// generateJWT generates both JWT Access & refresh tokens with the given claims.
-func GenerateJWT(UserID string, duration time.Duration, tokenType, jwtSecret string) (string, error) {
-	claims := Claims{
-		UserID: UserID,
-		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: time.Now().Unix() + int64(duration.Seconds()),
-			IssuedAt:  time.Now().Unix(),
-			Issuer:    Issuer,
-			Subject:   tokenType, // "access" or "refresh"
-		},
-	}
-
-	if tokenType == "" || jwtSecret == "" {
-		return "", fmt.Errorf("tokenType and jwtSecrets shouldn't be empty")
-	}
-
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString([]byte(jwtSecret))
-	if err != nil {
-		return "", fmt.Errorf("error generating jwt token of type %s for user %s: %v", tokenType, UserID, err)
-	}
-	return tokenString, nil
-}
-
-// validates the JWT token.
-func ValidateJWTToken(tokenString, jwtSecret string) (*Claims, error) {
-	claims := &Claims{}
-
-	if tokenString == "" {
-		return nil, fmt.Errorf("token string is empty")
-	}
-
-	jwtToken, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		// Validate signing method
-		if token.Method.Alg() != jwt.SigningMethodHS256.Alg() {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Method.Alg())
-		}
-
-		return []byte(jwtSecret), nil
-	})
-
-	if err != nil {
-		log.Printf("jwt token validation failed: %v", err)
-		return nil, fmt.Errorf("invalid token")
-	}
-
-	if !jwtToken.Valid {
-		return nil, fmt.Errorf("invalid token")
-	}
-
-	// Type-assert the token.Claims to *Claims
-	if parsedClaims, ok := jwtToken.Claims.(*Claims); ok {
-		return parsedClaims, nil
-	}
-
-	// If type assertion fails, return an error
-	return nil, fmt.Errorf("failed to parse claims")
-}
@@ -2,9 +2,7 @@ package token
 
 import (
 	"testing"
-	"time"
 
-	"github.com/golang-jwt/jwt"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -67,125 +65,3 @@ func TestHashToken(t *testing.T) {
 		})
 	}
 }
-
-func TestGenerateJWT(t *testing.T) {
-	jwtSecret := "test-secret"
-	userID := "test-user"
-	duration := 1 * time.Hour
-
-	t.Run("AccessToken", func(t *testing.T) {
-		token, err := GenerateJWT(userID, duration, "access", jwtSecret)
-		assert.NoError(t, err)
-		assert.NotEmpty(t, token)
-
-		claims := &Claims{}
-		parsedToken, err := jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
-			return []byte(jwtSecret), nil
-		})
-
-		assert.NoError(t, err)
-		assert.True(t, parsedToken.Valid)
-		assert.Equal(t, userID, claims.UserID)
-		assert.Equal(t, "access", claims.Subject)
-		assert.Equal(t, Issuer, claims.Issuer)
-		assert.True(t, claims.ExpiresAt > time.Now().Unix())
-	})
-
-	t.Run("RefreshToken", func(t *testing.T) {
-		token, err := GenerateJWT(userID, duration, "refresh", jwtSecret)
-		assert.NoError(t, err)
-		assert.NotEmpty(t, token)
-
-		claims := &Claims{}
-		parsedToken, err := jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
-			return []byte(jwtSecret), nil
-		})
-
-		assert.NoError(t, err)
-		assert.True(t, parsedToken.Valid)
-		assert.Equal(t, userID, claims.UserID)
-		assert.Equal(t, "refresh", claims.Subject)
-		assert.Equal(t, Issuer, claims.Issuer)
-		assert.True(t, claims.ExpiresAt > time.Now().Unix())
-	})
-
-	t.Run("InvalidSecret", func(t *testing.T) {
-		_, err := GenerateJWT(userID, duration, "access", "")
-		assert.Error(t, err)
-	})
-}
-
-func TestValidateJWTToken(t *testing.T) {
-	jwtSecret := "test-secret"
-	userID := "test-user"
-	duration := 1 * time.Hour
-
-	t.Run("ValidToken", func(t *testing.T) {
-		tokenString, err := GenerateJWT(userID, duration, "access", jwtSecret)
-		assert.NoError(t, err)
-
-		claims, err := ValidateJWTToken(tokenString, jwtSecret)
-		assert.NoError(t, err)
-		assert.NotNil(t, claims)
-		assert.Equal(t, userID, claims.UserID)
-		assert.Equal(t, "access", claims.Subject)
-		assert.Equal(t, Issuer, claims.Issuer)
-		// Use VerifyExpiresAt to check expiration
-		assert.True(t, claims.VerifyExpiresAt(time.Now().Unix(), true), "token should not be expired yet")
-
-		// Simulate token expiration by advancing time
-		expiredTime := time.Now().Add(duration + time.Second).Unix() // 1 hour and 1 second later
-		assert.False(t, claims.VerifyExpiresAt(expiredTime, true), "token should be expired")
-	})
-
-	t.Run("ValidRefreshToken", func(t *testing.T) {
-		expirationDuration := 7 * 24 * time.Hour
-		tokenString, err := GenerateJWT(userID, expirationDuration, "refresh", jwtSecret)
-		assert.NoError(t, err)
-
-		claims, err := ValidateJWTToken(tokenString, jwtSecret)
-		assert.NoError(t, err)
-		assert.NotNil(t, claims)
-		assert.Equal(t, userID, claims.UserID)
-		assert.Equal(t, "refresh", claims.Subject)
-		assert.Equal(t, Issuer, claims.Issuer)
-		// Use VerifyExpiresAt to check expiration
-		assert.True(t, claims.VerifyExpiresAt(time.Now().Unix(), true), "token should not be expired yet")
-
-		// Simulate token expiration by advancing time
-		expiredTime := time.Now().Add(expirationDuration + time.Second).Unix() // 7 days and 1 second later
-		assert.False(t, claims.VerifyExpiresAt(expiredTime, true), "token should be expired")
-	})
-
-	t.Run("InvalidToken_Expired", func(t *testing.T) {
-		// Generate a token that has already expired
-		expiredDuration := -1 * time.Hour
-		tokenString, err := GenerateJWT(userID, expiredDuration, "access", jwtSecret)
-		assert.NoError(t, err)
-
-		_, err = ValidateJWTToken(tokenString, jwtSecret)
-		assert.Error(t, err)
-		assert.Contains(t, err.Error(), "invalid token")
-	})
-
-	t.Run("InvalidToken_WrongSecret", func(t *testing.T) {
-		tokenString, err := GenerateJWT(userID, duration, "access", jwtSecret)
-		assert.NoError(t, err)
-
-		_, err = ValidateJWTToken(tokenString, "wrong-secret")
-		assert.Error(t, err)
-		assert.Contains(t, err.Error(), "invalid token")
-	})
-
-	t.Run("InvalidToken_Malformed", func(t *testing.T) {
-		_, err := ValidateJWTToken("malformed-token", jwtSecret)
-		assert.Error(t, err)
-		assert.Contains(t, err.Error(), "invalid token")
-	})
-
-	t.Run("InvalidToken_EmptyToken", func(t *testing.T) {
-		_, err := ValidateJWTToken("", jwtSecret)
-		assert.Error(t, err)
-		assert.Contains(t, err.Error(), "token string is empty")
-	})
-}
@@ -0,0 +1,491 @@
+package token
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// Algorithms of the keys that sign JWTs.
+const (
+	AlgorithmRS256 = "RS256"
+	AlgorithmEdDSA = "EdDSA"
+)
+
+// AccessTokenLifetime is how long an access token is valid.
+const AccessTokenLifetime = 15 * time.Minute
+
+const (
+	// keyVerifyWindow is how long a retired key keeps verifying tokens: the lifetime of the longest-lived
+	// token it may have signed.
+	keyVerifyWindow = RefreshTokenLifetime
+	rsaKeyBits      = 2048
+	// keyReloadInterval throttles reloads for tokens signed by a key this instance has not loaded yet.
+	keyReloadInterval = 10 * time.Second
+)
+
+// KeyringConfig controls the keys that sign JWTs.
+type KeyringConfig struct {
+	Algorithm       string        // Algorithm of new keys, RS256 or EdDSA
+	RefreshInterval time.Duration // How often keys rotated by other instances are loaded
+}
+
+// DefaultKeyringConfig returns the keyring settings used when none are configured.
+func DefaultKeyringConfig() KeyringConfig {
+	return KeyringConfig{
+		Algorithm:       AlgorithmRS256,
+		RefreshInterval: time.Minute,
+	}
+}
+
+// KeyringConfigFromEnv reads JWT_SIGNING_ALGORITHM and JWT_KEYRING_REFRESH_INTERVAL.
+func KeyringConfigFromEnv() (KeyringConfig, error) {
+	config := DefaultKeyringConfig()
+	if value := os.Getenv("JWT_SIGNING_ALGORITHM"); value != "" {
+		if value != AlgorithmRS256 && value != AlgorithmEdDSA {
+			return config, fmt.Errorf("invalid JWT_SIGNING_ALGORITHM %q, must be %s or %s", value, AlgorithmRS256, AlgorithmEdDSA)
+		}
+		config.Algorithm = value
+	}
+	if value := os.Getenv("JWT_KEYRING_REFRESH_INTERVAL"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < keyReloadInterval {
+			return config, fmt.Errorf("invalid JWT_KEYRING_REFRESH_INTERVAL %q, must be a duration of at least %s", value, keyReloadInterval)
+		}
+		config.RefreshInterval = d
+	}
+	return config, nil
+}
+
+// keyPair is a decrypted signing key.
+type keyPair struct {
+	id          string
+	method      jwt.SigningMethod
+	private     crypto.Signer
+	createdAt   time.Time
+	legacyUntil time.Time // Set on the first key
+}
+
+// Keyring signs JWTs with its active key and verifies them with any key that is active or was retired
+// less than a refresh token lifetime ago, found by the kid header. Keys are shared by every instance
+// through the database; keyrings without a repository keep their keys in memory, e.g. in tests.
+type Keyring struct {
+	repository   *SigningKeyRepository
+	config       KeyringConfig
+	envelope     *Envelope
+	legacySecret []byte
+
+	mu          sync.RWMutex
+	active      *keyPair
+	keys        []*keyPair // Newest first
+	loadedAt    time.Time
+	legacyUntil time.Time // Latest expiry of a token signed with the legacy secret, zero once it is past
+}
+
+// NewKeyring creates a keyring; Load must be called before it signs tokens. Tokens signed with the legacy
+// HS256 secret before the first key was created are still accepted until they expire, at the latest a
+// refresh token lifetime after the first key was created, so upgrading does not log users out.
+func NewKeyring(repository *SigningKeyRepository, config KeyringConfig, envelope *Envelope, legacySecret string) *Keyring {
+	return &Keyring{
+		repository:   repository,
+		config:       config,
+		envelope:     envelope,
+		legacySecret: []byte(legacySecret),
+	}
+}
+
+// signingMethod returns the JWT signing method of an algorithm.
+func signingMethod(algorithm string) (jwt.SigningMethod, error) {
+	switch algorithm {
+	case AlgorithmRS256:
+		return jwt.SigningMethodRS256, nil
+	case AlgorithmEdDSA:
+		return jwt.SigningMethodEdDSA, nil
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %q", algorithm)
+	}
+}
+
+// newKeyPair generates a key pair with the configured algorithm.
+func (k *Keyring) newKeyPair(now time.Time) (*keyPair, error) {
+	method, err := signingMethod(k.config.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	var private crypto.Signer
+	switch k.config.Algorithm {
+	case AlgorithmRS256:
+		private, err = rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	case AlgorithmEdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate signing key: %v", err)
+	}
+	return &keyPair{id: GenerateRandomString(16), method: method, private: private, createdAt: now}, nil
+}
+
+// encryptKeyPair returns the key pair as it is stored in the database.
+func (k *Keyring) encryptKeyPair(pair *keyPair) (*SigningKey, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(pair.private)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal signing key: %v", err)
+	}
+	encrypted, err := k.envelope.Encrypt(string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), signingKeyAAD(pair.id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt signing key: %v", err)
+	}
+	key := &SigningKey{ID: pair.id, Algorithm: pair.method.Alg(), EncryptedKey: encrypted, CreatedAt: pair.createdAt}
+	if !pair.legacyUntil.IsZero() {
+		key.LegacyUntil = &pair.legacyUntil
+	}
+	return key, nil
+}
+
+// decryptSigningKey returns the key pair of a stored key.
+func (k *Keyring) decryptSigningKey(key *SigningKey) (*keyPair, error) {
+	method, err := signingMethod(key.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := k.envelope.Decrypt(key.EncryptedKey, signingKeyAAD(key.ID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt signing key: %v", err)
+	}
+	block, _ := pem.Decode([]byte(keyPEM))
+	if block == nil {
+		return nil, fmt.Errorf("invalid signing key PEM")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key: %v", err)
+	}
+	switch parsed.(type) {
+	case *rsa.PrivateKey:
+		if key.Algorithm != AlgorithmRS256 {
+			return nil, fmt.Errorf("RSA signing key stored as %s", key.Algorithm)
+		}
+	case ed25519.PrivateKey:
+		if key.Algorithm != AlgorithmEdDSA {
+			return nil, fmt.Errorf("Ed25519 signing key stored as %s", key.Algorithm)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported signing key type %T", parsed)
+	}
+	pair := &keyPair{id: key.ID, method: method, private: parsed.(crypto.Signer), createdAt: key.CreatedAt}
+	if key.LegacyUntil != nil {
+		pair.legacyUntil = *key.LegacyUntil
+	}
+	return pair, nil
+}
+
+// createKey generates a key and stores it, it becomes active on the next load. The first key records
+// until when tokens signed with the legacy secret can be valid.
+func (k *Keyring) createKey(ctx context.Context, now time.Time, first bool) (*keyPair, error) {
+	pair, err := k.newKeyPair(now)
+	if err != nil {
+		return nil, err
+	}
+	if first {
+		pair.legacyUntil = now.Add(RefreshTokenLifetime)
+	}
+	stored, err := k.encryptKeyPair(pair)
+	if err != nil {
+		return nil, err
+	}
+	if err := k.repository.InsertSigningKey(ctx, stored); err != nil {
+		return nil, fmt.Errorf("failed to store signing key: %v", err)
+	}
+	return pair, nil
+}
+
+// Load reads the keys from the database, creating the first key when there is no active one.
+func (k *Keyring) Load(ctx context.Context) error {
+	now := time.Now()
+	if k.repository == nil {
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		if k.active == nil {
+			pair, err := k.newKeyPair(now)
+			if err != nil {
+				return err
+			}
+			pair.legacyUntil = now.Add(RefreshTokenLifetime)
+			k.active, k.keys, k.loadedAt, k.legacyUntil = pair, []*keyPair{pair}, now, pair.legacyUntil
+		}
+		return nil
+	}
+
+	stored, err := k.repository.ListSigningKeys(ctx, now.Add(-keyVerifyWindow))
+	if err != nil {
+		return fmt.Errorf("failed to load signing keys: %v", err)
+	}
+	var active *keyPair
+	keys := make([]*keyPair, 0, len(stored)+1)
+	for _, key := range stored {
+		pair, err := k.decryptSigningKey(key)
+		if err != nil {
+			return fmt.Errorf("failed to load signing key %s: %v", key.ID, err)
+		}
+		if active == nil && key.RetiredAt == nil {
+			active = pair
+		}
+		keys = append(keys, pair)
+	}
+	if active == nil {
+		if active, err = k.createKey(ctx, now, len(stored) == 0); err != nil {
+			return err
+		}
+		keys = append([]*keyPair{active}, keys...)
+		log.Printf("Created JWT signing key %s", active.id)
+	}
+
+	// The first key is deleted only after every legacy token has expired
+	var legacyUntil time.Time
+	for _, pair := range keys {
+		if pair.legacyUntil.After(legacyUntil) {
+			legacyUntil = pair.legacyUntil
+		}
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.active, k.keys, k.loadedAt, k.legacyUntil = active, keys, now, legacyUntil
+	return nil
+}
+
+// Rotate creates a new active key. The previous keys only verify tokens from then on, until the tokens
+// they signed have expired.
+func (k *Keyring) Rotate(ctx context.Context) (*SigningKey, error) {
+	now := time.Now()
+	if k.repository == nil {
+		pair, err := k.newKeyPair(now)
+		if err != nil {
+			return nil, err
+		}
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		k.active, k.keys = pair, append([]*keyPair{pair}, k.keys...)
+		return &SigningKey{ID: pair.id, Algorithm: pair.method.Alg(), CreatedAt: now}, nil
+	}
+
+	pair, err := k.createKey(ctx, now, false)
+	if err != nil {
+		return nil, err
+	}
+	retired, err := k.repository.RetireSigningKeys(ctx, pair.id, now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retire signing keys: %v", err)
+	}
+	deleted, err := k.repository.DeleteSigningKeys(ctx, now.Add(-keyVerifyWindow))
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete expired signing keys: %v", err)
+	}
+	log.Printf("Rotated JWT signing key to %s, %d keys retired, %d expired keys deleted", pair.id, retired, deleted)
+	if err := k.Load(ctx); err != nil {
+		return nil, err
+	}
+	return &SigningKey{ID: pair.id, Algorithm: pair.method.Alg(), CreatedAt: now}, nil
+}
+
+// StartRefresher loads the keys every refresh interval until the context is cancelled, so keys rotated
+// on another instance are used and trusted here too.
+func (k *Keyring) StartRefresher(ctx context.Context) {
+	if k.repository == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(k.config.RefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := k.Load(ctx); err != nil {
+					log.Printf("Failed to refresh JWT signing keys: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// GenerateJWT signs a token of the type ("access" or "refresh") for the user with the active key.
+func (k *Keyring) GenerateJWT(userID string, duration time.Duration, tokenType string) (string, error) {
+	if tokenType == "" {
+		return "", fmt.Errorf("tokenType shouldn't be empty")
+	}
+	k.mu.RLock()
+	active := k.active
+	k.mu.RUnlock()
+	if active == nil {
+		return "", fmt.Errorf("no JWT signing key loaded")
+	}
+
+	now := time.Now()
+	claims := Claims{
+		UserID: userID,
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: now.Add(duration).Unix(),
+			IssuedAt:  now.Unix(),
+			Issuer:    Issuer,
+			Subject:   tokenType,                // "access" or "refresh"
+			Id:        GenerateRandomString(16), // tokens issued in the same second must still differ
+		},
+	}
+	token := jwt.NewWithClaims(active.method, claims)
+	token.Header["kid"] = active.id
+	tokenString, err := token.SignedString(active.private)
+	if err != nil {
+		return "", fmt.Errorf("error generating jwt token of type %s for user %s: %v", tokenType, userID, err)
+	}
+	return tokenString, nil
+}
+
+// ValidateJWTToken verifies a token and checks it is of the expected type, so that a refresh token
+// cannot be used as an access token or the other way round.
+func (k *Keyring) ValidateJWTToken(tokenString, tokenType string) (*Claims, error) {
+	if tokenString == "" {
+		return nil, fmt.Errorf("token string is empty")
+	}
+
+	claims := &Claims{}
+	jwtToken, err := jwt.ParseWithClaims(tokenString, claims, k.verificationKey)
+	if err != nil {
+		log.Printf("jwt token validation failed: %v", err)
+		return nil, fmt.Errorf("invalid token")
+	}
+	if !jwtToken.Valid {
+		return nil, fmt.Errorf("invalid token")
+	}
+	if claims.Subject != tokenType {
+		return nil, fmt.Errorf("invalid token: expected a %s token", tokenType)
+	}
+	if claims.Issuer != Issuer {
+		return nil, fmt.Errorf("invalid token: unexpected issuer")
+	}
+	return claims, nil
+}
+
+// verificationKey returns the public key of the kid header of a token.
+func (k *Keyring) verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		return k.legacyKey(token)
+	}
+
+	pair := k.key(kid)
+	if pair == nil {
+		k.reload()
+		if pair = k.key(kid); pair == nil {
+			return nil, fmt.Errorf("unknown signing key %s", kid)
+		}
+	}
+	if token.Method.Alg() != pair.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Method.Alg())
+	}
+	return pair.private.Public(), nil
+}
+
+// legacyKey returns the HS256 secret for tokens issued before the first signing key was created. Such
+// tokens cannot expire later than a refresh token lifetime after that, so the secret stops verifying
+// anything once that time is past.
+func (k *Keyring) legacyKey(token *jwt.Token) (interface{}, error) {
+	if len(k.legacySecret) == 0 || token.Method.Alg() != jwt.SigningMethodHS256.Alg() {
+		return nil, fmt.Errorf("token has no key ID")
+	}
+	k.mu.RLock()
+	legacyUntil := k.legacyUntil
+	k.mu.RUnlock()
+	if legacyUntil.IsZero() || !time.Now().Before(legacyUntil) {
+		return nil, fmt.Errorf("token has no key ID")
+	}
+	claims, ok := token.Claims.(*Claims)
+	if !ok || claims.IssuedAt >= legacyUntil.Add(-RefreshTokenLifetime).Unix() || claims.ExpiresAt == 0 || claims.ExpiresAt > legacyUntil.Unix() {
+		return nil, fmt.Errorf("token has no key ID")
+	}
+	log.Printf("Accepted a legacy HS256 token of user %s; tokens signed with JWT_SECRET are no longer accepted after %s", claims.UserID, legacyUntil.Format(time.RFC3339))
+	return k.legacySecret, nil
+}
+
+func (k *Keyring) key(kid string) *keyPair {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	for _, pair := range k.keys {
+		if pair.id == kid {
+			return pair
+		}
+	}
+	return nil
+}
+
+// reload loads the keys again for a token signed by an unknown key, which may have been created by
+// another instance since the last refresh.
+func (k *Keyring) reload() {
+	if k.repository == nil {
+		return
+	}
+	k.mu.RLock()
+	recent := time.Since(k.loadedAt) < keyReloadInterval
+	k.mu.RUnlock()
+	if recent {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := k.Load(ctx); err != nil {
+		log.Printf("Failed to reload JWT signing keys: %v", err)
+	}
+}
+
+// JSONWebKey is a public signing key as published in the JWKS.
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`   // RSA modulus
+	E   string `json:"e,omitempty"`   // RSA exponent
+	Crv string `json:"crv,omitempty"` // Ed25519
+	X   string `json:"x,omitempty"`   // Ed25519 public key
+}
+
+// JSONWebKeySet is the document served at /.well-known/jwks.json.
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// JWKS returns the public keys that verify tokens, the active key first.
+func (k *Keyring) JWKS() JSONWebKeySet {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	set := JSONWebKeySet{Keys: []JSONWebKey{}}
+	for _, pair := range k.keys {
+		key := JSONWebKey{Kid: pair.id, Use: "sig", Alg: pair.method.Alg()}
+		switch public := pair.private.Public().(type) {
+		case *rsa.PublicKey:
+			key.Kty = "RSA"
+			key.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			key.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			key.Kty = "OKP"
+			key.Crv = "Ed25519"
+			key.X = base64.RawURLEncoding.EncodeToString(public)
+		}
+		set.Keys = append(set.Keys, key)
+	}
+	return set
+}
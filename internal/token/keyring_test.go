@@ -0,0 +1,247 @@
+package token
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestKeyring(t *testing.T, algorithm, legacySecret string) *Keyring {
+	config := DefaultKeyringConfig()
+	config.Algorithm = algorithm
+	keys := NewKeyring(nil, config, nil, legacySecret)
+	assert.NoError(t, keys.Load(context.Background()))
+	return keys
+}
+
+func TestGenerateJWT(t *testing.T) {
+	userID := "test-user"
+	duration := 1 * time.Hour
+
+	for _, algorithm := range []string{AlgorithmRS256, AlgorithmEdDSA} {
+		t.Run(algorithm, func(t *testing.T) {
+			keys := newTestKeyring(t, algorithm, "")
+
+			tokenString, err := keys.GenerateJWT(userID, duration, "access")
+			assert.NoError(t, err)
+
+			parsed, _, err := new(jwt.Parser).ParseUnverified(tokenString, &Claims{})
+			assert.NoError(t, err)
+			assert.Equal(t, algorithm, parsed.Method.Alg())
+			assert.Equal(t, keys.JWKS().Keys[0].Kid, parsed.Header["kid"])
+
+			claims := parsed.Claims.(*Claims)
+			assert.Equal(t, userID, claims.UserID)
+			assert.Equal(t, "access", claims.Subject)
+			assert.Equal(t, Issuer, claims.Issuer)
+			assert.True(t, claims.ExpiresAt > time.Now().Unix())
+		})
+	}
+
+	t.Run("Unique", func(t *testing.T) {
+		keys := newTestKeyring(t, AlgorithmEdDSA, "")
+		first, err := keys.GenerateJWT(userID, duration, "refresh")
+		assert.NoError(t, err)
+		second, err := keys.GenerateJWT(userID, duration, "refresh")
+		assert.NoError(t, err)
+		assert.NotEqual(t, first, second)
+	})
+
+	t.Run("NotLoaded", func(t *testing.T) {
+		_, err := NewKeyring(nil, DefaultKeyringConfig(), nil, "").GenerateJWT(userID, duration, "access")
+		assert.EqualError(t, err, "no JWT signing key loaded")
+	})
+}
+
+func TestValidateJWTToken(t *testing.T) {
+	userID := "test-user"
+	duration := 1 * time.Hour
+	keys := newTestKeyring(t, AlgorithmRS256, "")
+
+	t.Run("ValidToken", func(t *testing.T) {
+		tokenString, err := keys.GenerateJWT(userID, duration, "access")
+		assert.NoError(t, err)
+
+		claims, err := keys.ValidateJWTToken(tokenString, "access")
+		assert.NoError(t, err)
+		assert.Equal(t, userID, claims.UserID)
+		assert.Equal(t, "access", claims.Subject)
+	})
+
+	t.Run("InvalidToken_WrongType", func(t *testing.T) {
+		tokenString, err := keys.GenerateJWT(userID, duration, "refresh")
+		assert.NoError(t, err)
+
+		_, err = keys.ValidateJWTToken(tokenString, "access")
+		assert.EqualError(t, err, "invalid token: expected a access token")
+	})
+
+	t.Run("InvalidToken_Expired", func(t *testing.T) {
+		tokenString, err := keys.GenerateJWT(userID, -1*time.Hour, "access")
+		assert.NoError(t, err)
+
+		_, err = keys.ValidateJWTToken(tokenString, "access")
+		assert.ErrorContains(t, err, "invalid token")
+	})
+
+	t.Run("InvalidToken_OtherKeyring", func(t *testing.T) {
+		tokenString, err := newTestKeyring(t, AlgorithmRS256, "").GenerateJWT(userID, duration, "access")
+		assert.NoError(t, err)
+
+		_, err = keys.ValidateJWTToken(tokenString, "access")
+		assert.ErrorContains(t, err, "invalid token")
+	})
+
+	t.Run("InvalidToken_AlgorithmConfusion", func(t *testing.T) {
+		// An HS256 token keyed with the public key under the kid of the RSA key
+		jwk := keys.JWKS().Keys[0]
+		forged := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{UserID: userID, StandardClaims: jwt.StandardClaims{Subject: "access", Issuer: Issuer, ExpiresAt: time.Now().Add(duration).Unix()}})
+		forged.Header["kid"] = jwk.Kid
+		tokenString, err := forged.SignedString([]byte(jwk.N))
+		assert.NoError(t, err)
+
+		_, err = keys.ValidateJWTToken(tokenString, "access")
+		assert.ErrorContains(t, err, "invalid token")
+	})
+
+	t.Run("InvalidToken_Malformed", func(t *testing.T) {
+		_, err := keys.ValidateJWTToken("malformed-token", "access")
+		assert.ErrorContains(t, err, "invalid token")
+	})
+
+	t.Run("InvalidToken_EmptyToken", func(t *testing.T) {
+		_, err := keys.ValidateJWTToken("", "access")
+		assert.ErrorContains(t, err, "token string is empty")
+	})
+}
+
+func TestKeyringRotation(t *testing.T) {
+	keys := newTestKeyring(t, AlgorithmRS256, "")
+	before, err := keys.GenerateJWT("test-user", time.Hour, "access")
+	assert.NoError(t, err)
+
+	rotated, err := keys.Rotate(context.Background())
+	assert.NoError(t, err)
+	after, err := keys.GenerateJWT("test-user", time.Hour, "access")
+	assert.NoError(t, err)
+
+	// Tokens signed with the previous key stay valid
+	_, err = keys.ValidateJWTToken(before, "access")
+	assert.NoError(t, err)
+	_, err = keys.ValidateJWTToken(after, "access")
+	assert.NoError(t, err)
+
+	parsed, _, err := new(jwt.Parser).ParseUnverified(after, &Claims{})
+	assert.NoError(t, err)
+	assert.Equal(t, rotated.ID, parsed.Header["kid"])
+
+	set := keys.JWKS()
+	assert.Len(t, set.Keys, 2)
+	assert.Equal(t, rotated.ID, set.Keys[0].Kid)
+}
+
+func TestLegacyTokens(t *testing.T) {
+	legacyExpiring := func(issuedAt, expiresAt time.Time) string {
+		claims := Claims{UserID: "test-user", StandardClaims: jwt.StandardClaims{Subject: "access", Issuer: Issuer, IssuedAt: issuedAt.Unix(), ExpiresAt: expiresAt.Unix()}}
+		tokenString, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("legacy-secret"))
+		assert.NoError(t, err)
+		return tokenString
+	}
+	legacy := func(issuedAt time.Time) string {
+		return legacyExpiring(issuedAt, time.Now().Add(time.Hour))
+	}
+	keys := newTestKeyring(t, AlgorithmRS256, "legacy-secret")
+
+	_, err := keys.ValidateJWTToken(legacy(time.Now().Add(-time.Minute)), "access")
+	assert.NoError(t, err)
+
+	// The secret no longer signs tokens once the keyring exists
+	_, err = keys.ValidateJWTToken(legacy(time.Now().Add(time.Minute)), "access")
+	assert.ErrorContains(t, err, "invalid token")
+	_, err = newTestKeyring(t, AlgorithmRS256, "").ValidateJWTToken(legacy(time.Now().Add(-time.Minute)), "access")
+	assert.ErrorContains(t, err, "invalid token")
+
+	// Forged tokens cannot outlive the refresh token lifetime after the first key
+	_, err = keys.ValidateJWTToken(legacyExpiring(time.Now().Add(-time.Minute), time.Now().Add(RefreshTokenLifetime+time.Hour)), "access")
+	assert.ErrorContains(t, err, "invalid token")
+
+	// Nor are they accepted once that lifetime is past, even after a rotation
+	_, err = keys.Rotate(context.Background())
+	assert.NoError(t, err)
+	keys.legacyUntil = time.Now().Add(-time.Second)
+	_, err = keys.ValidateJWTToken(legacy(time.Now().Add(-time.Minute)), "access")
+	assert.ErrorContains(t, err, "invalid token")
+}
+
+func TestJWKS(t *testing.T) {
+	t.Run("RS256", func(t *testing.T) {
+		keys := newTestKeyring(t, AlgorithmRS256, "")
+		jwk := keys.JWKS().Keys[0]
+		assert.Equal(t, "RSA", jwk.Kty)
+		assert.Equal(t, "sig", jwk.Use)
+		assert.Equal(t, AlgorithmRS256, jwk.Alg)
+
+		// The published key verifies tokens of the keyring
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		assert.NoError(t, err)
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		assert.NoError(t, err)
+		public := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		tokenString, err := keys.GenerateJWT("test-user", time.Hour, "access")
+		assert.NoError(t, err)
+		_, err = jwt.ParseWithClaims(tokenString, &Claims{}, func(*jwt.Token) (interface{}, error) { return public, nil })
+		assert.NoError(t, err)
+	})
+
+	t.Run("EdDSA", func(t *testing.T) {
+		keys := newTestKeyring(t, AlgorithmEdDSA, "")
+		jwk := keys.JWKS().Keys[0]
+		assert.Equal(t, "OKP", jwk.Kty)
+		assert.Equal(t, "Ed25519", jwk.Crv)
+
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		assert.NoError(t, err)
+		tokenString, err := keys.GenerateJWT("test-user", time.Hour, "access")
+		assert.NoError(t, err)
+		_, err = jwt.ParseWithClaims(tokenString, &Claims{}, func(*jwt.Token) (interface{}, error) { return ed25519.PublicKey(x), nil })
+		assert.NoError(t, err)
+	})
+}
+
+func TestSigningKeyEncryption(t *testing.T) {
+	keys := NewKeyring(nil, DefaultKeyringConfig(), newTestEnvelope(t), "")
+	pair, err := keys.newKeyPair(time.Now())
+	assert.NoError(t, err)
+
+	stored, err := keys.encryptKeyPair(pair)
+	assert.NoError(t, err)
+	assert.NotContains(t, stored.EncryptedKey, "PRIVATE KEY")
+
+	decrypted, err := keys.decryptSigningKey(stored)
+	assert.NoError(t, err)
+	assert.Equal(t, pair.private.Public(), decrypted.private.Public())
+
+	stored.Algorithm = AlgorithmEdDSA
+	_, err = keys.decryptSigningKey(stored)
+	assert.ErrorContains(t, err, "RSA signing key stored as EdDSA")
+}
+
+func TestKeyringConfigFromEnv(t *testing.T) {
+	t.Setenv("JWT_SIGNING_ALGORITHM", "EdDSA")
+	t.Setenv("JWT_KEYRING_REFRESH_INTERVAL", "30s")
+	config, err := KeyringConfigFromEnv()
+	assert.NoError(t, err)
+	assert.Equal(t, AlgorithmEdDSA, config.Algorithm)
+	assert.Equal(t, 30*time.Second, config.RefreshInterval)
+
+	t.Setenv("JWT_SIGNING_ALGORITHM", "HS256")
+	_, err = KeyringConfigFromEnv()
+	assert.ErrorContains(t, err, "invalid JWT_SIGNING_ALGORITHM")
+}
@@ -0,0 +1,352 @@
+package token
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Key sources selected by NANNY_KEY_SOURCE.
+const (
+	KeySourceEnv      = "env"
+	KeySourceFile     = "file"
+	KeySourceLocalKMS = "local-kms"
+)
+
+// defaultLocalKMSPath is where the local KMS keeps its keys when NANNY_LOCAL_KMS_PATH is not set.
+const defaultLocalKMSPath = "nanny-kms.json"
+
+// KeySource holds the master keys that wrap the data keys of an Envelope. Master keys never leave the
+// source, so it can stand in for a KMS.
+type KeySource interface {
+	// ActiveKeyID returns the ID of the master key that wraps new data keys.
+	ActiveKeyID() string
+	// KeyIDs returns the IDs of all master keys, the active one first.
+	KeyIDs() []string
+	// WrapKey encrypts a data key with a master key.
+	WrapKey(keyID string, dataKey []byte) ([]byte, error)
+	// UnwrapKey decrypts a data key wrapped by a master key.
+	UnwrapKey(keyID string, wrapped []byte) ([]byte, error)
+}
+
+// KeySourceFromEnv creates the key source selected by NANNY_KEY_SOURCE:
+//
+//   - env (default): NANNY_ENCRYPTION_KEY, and the keys it replaced in NANNY_PREVIOUS_ENCRYPTION_KEYS
+//   - file: the keys in NANNY_ENCRYPTION_KEY_FILE, one per line, the active key first
+//   - local-kms: a local stand-in for a KMS keeping its keys in NANNY_LOCAL_KMS_PATH. It imports
+//     NANNY_ENCRYPTION_KEY, if set, as its first key.
+func KeySourceFromEnv() (KeySource, error) {
+	switch value := os.Getenv("NANNY_KEY_SOURCE"); value {
+	case "", KeySourceEnv:
+		if os.Getenv("NANNY_ENCRYPTION_KEY") == "" {
+			return nil, fmt.Errorf("NANNY_ENCRYPTION_KEY not set")
+		}
+		keys := []string{os.Getenv("NANNY_ENCRYPTION_KEY")}
+		for _, key := range strings.Split(os.Getenv("NANNY_PREVIOUS_ENCRYPTION_KEYS"), ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				keys = append(keys, key)
+			}
+		}
+		return NewStaticKeySource(keys...)
+	case KeySourceFile:
+		path := os.Getenv("NANNY_ENCRYPTION_KEY_FILE")
+		if path == "" {
+			return nil, fmt.Errorf("NANNY_ENCRYPTION_KEY_FILE not set")
+		}
+		return FileKeySource(path)
+	case KeySourceLocalKMS:
+		path := os.Getenv("NANNY_LOCAL_KMS_PATH")
+		if path == "" {
+			path = defaultLocalKMSPath
+		}
+		return OpenLocalKMS(path, os.Getenv("NANNY_ENCRYPTION_KEY"))
+	default:
+		return nil, fmt.Errorf("invalid NANNY_KEY_SOURCE %q, must be %s, %s or %s", value, KeySourceEnv, KeySourceFile, KeySourceLocalKMS)
+	}
+}
+
+// masterKeyID names a master key after its fingerprint, so the same key has the same ID in every source.
+func masterKeyID(key []byte) string {
+	hash := sha256.Sum256(key)
+	return hex.EncodeToString(hash[:6])
+}
+
+// StaticKeySource holds a fixed set of master keys.
+type StaticKeySource struct {
+	ids  []string
+	keys map[string][]byte
+}
+
+// NewStaticKeySource creates a key source from base64 encoded 32-byte keys, the active key first.
+func NewStaticKeySource(keys ...string) (*StaticKeySource, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no encryption key")
+	}
+	source := &StaticKeySource{keys: map[string][]byte{}}
+	for i, encoded := range keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("failed to base64 decode encryption key %d: %v", i+1, err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("invalid size %d of encryption key %d, key size must be 32 bytes for AES-256", len(key), i+1)
+		}
+		id := masterKeyID(key)
+		if _, ok := source.keys[id]; ok {
+			continue
+		}
+		source.ids = append(source.ids, id)
+		source.keys[id] = key
+	}
+	return source, nil
+}
+
+// FileKeySource reads the master keys from a file with one base64 encoded key per line, the active key
+// first. Empty lines and lines starting with # are skipped.
+func FileKeySource(path string) (*StaticKeySource, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read encryption key file: %v", err)
+	}
+	var keys []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			keys = append(keys, line)
+		}
+	}
+	return NewStaticKeySource(keys...)
+}
+
+// ActiveKeyID returns the ID of the key that wraps new data keys.
+func (s *StaticKeySource) ActiveKeyID() string {
+	return s.ids[0]
+}
+
+// KeyIDs returns the IDs of the keys, the active one first.
+func (s *StaticKeySource) KeyIDs() []string {
+	return append([]string(nil), s.ids...)
+}
+
+// WrapKey encrypts a data key with a master key.
+func (s *StaticKeySource) WrapKey(keyID string, dataKey []byte) ([]byte, error) {
+	key, ok := s.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown master key %s", keyID)
+	}
+	return seal(key, dataKey, nil)
+}
+
+// UnwrapKey decrypts a data key wrapped by a master key.
+func (s *StaticKeySource) UnwrapKey(keyID string, wrapped []byte) ([]byte, error) {
+	key, ok := s.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown master key %s", keyID)
+	}
+	return open(key, wrapped, nil)
+}
+
+// localKMSKey is a key version of the local KMS.
+type localKMSKey struct {
+	ID        string    `json:"id"`
+	Material  string    `json:"material"` // Base64 encoded AES-256 key
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// LocalKMS stands in for a cloud KMS during development and on single hosts: it generates and rotates
+// master keys itself and only wraps and unwraps data keys. The keys are kept in a JSON file, newest
+// first, that every instance sharing it reloads when it sees a key it does not know.
+type LocalKMS struct {
+	path string
+
+	mu   sync.RWMutex
+	keys []localKMSKey
+}
+
+// OpenLocalKMS loads the keys of the local KMS, creating the key file when it does not exist. A new KMS
+// starts with the base64 encoded import key, if given, so values encrypted with it stay readable.
+func OpenLocalKMS(path, importKey string) (*LocalKMS, error) {
+	kms := &LocalKMS{path: path}
+	if err := kms.load(); err == nil {
+		return kms, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	material := importKey
+	if material == "" {
+		key := make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, key); err != nil {
+			return nil, fmt.Errorf("failed to generate master key: %v", err)
+		}
+		material = base64.StdEncoding.EncodeToString(key)
+	}
+	key, err := newLocalKMSKey(material)
+	if err != nil {
+		return nil, err
+	}
+	kms.keys = []localKMSKey{key}
+	if err := kms.save(); err != nil {
+		return nil, err
+	}
+	log.Printf("Created local KMS key file %s with master key %s", path, key.ID)
+	return kms, nil
+}
+
+func newLocalKMSKey(material string) (localKMSKey, error) {
+	key, err := base64.StdEncoding.DecodeString(material)
+	if err != nil {
+		return localKMSKey{}, fmt.Errorf("failed to base64 decode master key: %v", err)
+	}
+	if len(key) != 32 {
+		return localKMSKey{}, fmt.Errorf("invalid master key size %d, key size must be 32 bytes for AES-256", len(key))
+	}
+	return localKMSKey{ID: masterKeyID(key), Material: material, CreatedAt: time.Now().UTC()}, nil
+}
+
+// Rotate generates a new active master key and returns its ID. Data keys wrapped by older keys can still
+// be unwrapped.
+func (k *LocalKMS) Rotate() (string, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", fmt.Errorf("failed to generate master key: %v", err)
+	}
+	created, err := newLocalKMSKey(base64.StdEncoding.EncodeToString(key))
+	if err != nil {
+		return "", err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	// Keep the keys another instance may have added since this one loaded them
+	if err := k.load(); err != nil {
+		return "", err
+	}
+	k.keys = append([]localKMSKey{created}, k.keys...)
+	if err := k.save(); err != nil {
+		k.keys = k.keys[1:]
+		return "", err
+	}
+	return created.ID, nil
+}
+
+// Reload reads the key file again, picking up keys rotated by another process.
+func (k *LocalKMS) Reload() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.load()
+}
+
+// ActiveKeyID returns the ID of the newest key, which wraps new data keys.
+func (k *LocalKMS) ActiveKeyID() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.keys[0].ID
+}
+
+// KeyIDs returns the IDs of the keys, the active one first.
+func (k *LocalKMS) KeyIDs() []string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	ids := make([]string, 0, len(k.keys))
+	for _, key := range k.keys {
+		ids = append(ids, key.ID)
+	}
+	return ids
+}
+
+// WrapKey encrypts a data key with a master key.
+func (k *LocalKMS) WrapKey(keyID string, dataKey []byte) ([]byte, error) {
+	key, err := k.key(keyID)
+	if err != nil {
+		return nil, err
+	}
+	return seal(key, dataKey, nil)
+}
+
+// UnwrapKey decrypts a data key wrapped by a master key.
+func (k *LocalKMS) UnwrapKey(keyID string, wrapped []byte) ([]byte, error) {
+	key, err := k.key(keyID)
+	if err != nil {
+		return nil, err
+	}
+	return open(key, wrapped, nil)
+}
+
+// key returns the material of a key, reloading the key file for keys rotated by another instance.
+func (k *LocalKMS) key(keyID string) ([]byte, error) {
+	if key := k.find(keyID); key != nil {
+		return base64.StdEncoding.DecodeString(key.Material)
+	}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+	if key := k.find(keyID); key != nil {
+		return base64.StdEncoding.DecodeString(key.Material)
+	}
+	return nil, fmt.Errorf("unknown master key %s", keyID)
+}
+
+func (k *LocalKMS) find(keyID string) *localKMSKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	for i := range k.keys {
+		if k.keys[i].ID == keyID {
+			return &k.keys[i]
+		}
+	}
+	return nil
+}
+
+// load reads the key file; the caller holds the lock.
+func (k *LocalKMS) load() error {
+	data, err := os.ReadFile(k.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return err
+		}
+		return fmt.Errorf("failed to read local KMS key file: %v", err)
+	}
+	var keys []localKMSKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return fmt.Errorf("failed to parse local KMS key file: %v", err)
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("local KMS key file %s has no keys", k.path)
+	}
+	k.keys = keys
+	return nil
+}
+
+// save writes the key file atomically, readable by the owner only; the caller holds the lock.
+func (k *LocalKMS) save() error {
+	data, err := json.MarshalIndent(k.keys, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode local KMS keys: %v", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(k.path), ".nanny-kms-*")
+	if err != nil {
+		return fmt.Errorf("failed to write local KMS key file: %v", err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write local KMS key file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write local KMS key file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), k.path); err != nil {
+		return fmt.Errorf("failed to write local KMS key file: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package token
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStaticKeySource(t *testing.T) {
+	t.Run("ActiveKeyFirst", func(t *testing.T) {
+		source, err := NewStaticKeySource(encryptionKey, previousEncryptionKey, encryptionKey)
+		assert.NoError(t, err)
+		assert.Len(t, source.KeyIDs(), 2)
+		assert.Equal(t, source.KeyIDs()[0], source.ActiveKeyID())
+
+		// IDs are fingerprints, the same in every source
+		previous, err := NewStaticKeySource(previousEncryptionKey)
+		assert.NoError(t, err)
+		assert.Equal(t, previous.ActiveKeyID(), source.KeyIDs()[1])
+	})
+
+	t.Run("InvalidKeys", func(t *testing.T) {
+		_, err := NewStaticKeySource()
+		assert.EqualError(t, err, "no encryption key")
+		_, err = NewStaticKeySource("not base64!")
+		assert.ErrorContains(t, err, "failed to base64 decode encryption key 1")
+		_, err = NewStaticKeySource(encryptionKey, "c2hvcnQ=")
+		assert.ErrorContains(t, err, "invalid size 5 of encryption key 2")
+	})
+
+	t.Run("File", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "keys")
+		assert.NoError(t, os.WriteFile(path, []byte("# rotated 2026-10-01\n"+encryptionKey+"\n\n"+previousEncryptionKey+"\n"), 0o600))
+
+		source, err := FileKeySource(path)
+		assert.NoError(t, err)
+		assert.Len(t, source.KeyIDs(), 2)
+		assert.Equal(t, newTestEnvelope(t).ActiveKeyID(), source.ActiveKeyID())
+
+		_, err = FileKeySource(filepath.Join(t.TempDir(), "missing"))
+		assert.ErrorContains(t, err, "failed to read encryption key file")
+	})
+}
+
+func TestLocalKMS(t *testing.T) {
+	t.Run("ImportKey", func(t *testing.T) {
+		kms, err := OpenLocalKMS(filepath.Join(t.TempDir(), "kms.json"), encryptionKey)
+		assert.NoError(t, err)
+		assert.Equal(t, newTestEnvelope(t).ActiveKeyID(), kms.ActiveKeyID())
+
+		// Values encrypted with the imported key stay readable
+		legacy, err := Encrypt("nanny-secret", encryptionKey)
+		assert.NoError(t, err)
+		decrypted, err := NewEnvelope(kms).Decrypt(legacy, testAAD)
+		assert.NoError(t, err)
+		assert.Equal(t, "nanny-secret", decrypted)
+	})
+
+	t.Run("Rotate", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "kms.json")
+		kms, err := OpenLocalKMS(path, "")
+		assert.NoError(t, err)
+		info, err := os.Stat(path)
+		assert.NoError(t, err)
+		assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+		encrypted, err := NewEnvelope(kms).Encrypt("nanny-secret", testAAD)
+		assert.NoError(t, err)
+
+		// Another instance sharing the key file
+		other, err := OpenLocalKMS(path, "")
+		assert.NoError(t, err)
+		first := other.ActiveKeyID()
+		rotated, err := kms.Rotate()
+		assert.NoError(t, err)
+		assert.NotEqual(t, first, rotated)
+		assert.Equal(t, []string{rotated, first}, kms.KeyIDs())
+
+		moved, err := NewEnvelope(kms).Reencrypt(encrypted, testAAD)
+		assert.NoError(t, err)
+		// The other instance loads the new key when it sees it
+		decrypted, err := NewEnvelope(other).Decrypt(moved, testAAD)
+		assert.NoError(t, err)
+		assert.Equal(t, "nanny-secret", decrypted)
+		assert.Equal(t, rotated, other.ActiveKeyID())
+	})
+
+	t.Run("InvalidFile", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "kms.json")
+		assert.NoError(t, os.WriteFile(path, []byte("[]"), 0o600))
+		_, err := OpenLocalKMS(path, "")
+		assert.ErrorContains(t, err, "has no keys")
+
+		_, err = OpenLocalKMS(filepath.Join(t.TempDir(), "kms.json"), "c2hvcnQ=")
+		assert.ErrorContains(t, err, "invalid master key size 5")
+	})
+}
+
+func TestKeySourceFromEnv(t *testing.T) {
+	t.Run("Env", func(t *testing.T) {
+		t.Setenv("NANNY_KEY_SOURCE", "")
+		t.Setenv("NANNY_ENCRYPTION_KEY", encryptionKey)
+		t.Setenv("NANNY_PREVIOUS_ENCRYPTION_KEYS", " "+previousEncryptionKey+", ")
+		source, err := KeySourceFromEnv()
+		assert.NoError(t, err)
+		assert.Len(t, source.KeyIDs(), 2)
+
+		t.Setenv("NANNY_ENCRYPTION_KEY", "")
+		_, err = KeySourceFromEnv()
+		assert.EqualError(t, err, "NANNY_ENCRYPTION_KEY not set")
+	})
+
+	t.Run("File", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "keys")
+		assert.NoError(t, os.WriteFile(path, []byte(encryptionKey+"\n"), 0o600))
+		t.Setenv("NANNY_KEY_SOURCE", "file")
+		t.Setenv("NANNY_ENCRYPTION_KEY_FILE", path)
+		source, err := KeySourceFromEnv()
+		assert.NoError(t, err)
+		assert.IsType(t, &StaticKeySource{}, source)
+	})
+
+	t.Run("LocalKMS", func(t *testing.T) {
+		t.Setenv("NANNY_KEY_SOURCE", "local-kms")
+		t.Setenv("NANNY_LOCAL_KMS_PATH", filepath.Join(t.TempDir(), "kms.json"))
+		t.Setenv("NANNY_ENCRYPTION_KEY", "")
+		source, err := KeySourceFromEnv()
+		assert.NoError(t, err)
+		assert.IsType(t, &LocalKMS{}, source)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		t.Setenv("NANNY_KEY_SOURCE", "vault")
+		_, err := KeySourceFromEnv()
+		assert.ErrorContains(t, err, "invalid NANNY_KEY_SOURCE")
+	})
+}
+
+func TestReencryptionConfigFromEnv(t *testing.T) {
+	t.Setenv("NANNY_REENCRYPT_INTERVAL", "10m")
+	t.Setenv("NANNY_REENCRYPT_BATCH_SIZE", "50")
+	config, err := ReencryptionConfigFromEnv()
+	assert.NoError(t, err)
+	assert.Equal(t, 10*time.Minute, config.Interval)
+	assert.Equal(t, 50, config.BatchSize)
+
+	t.Setenv("NANNY_REENCRYPT_BATCH_SIZE", "0")
+	_, err = ReencryptionConfigFromEnv()
+	assert.ErrorContains(t, err, "invalid NANNY_REENCRYPT_BATCH_SIZE")
+}
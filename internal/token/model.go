@@ -9,11 +9,26 @@ import (
 // Token struct for static tokens (already defined).
 type Token struct {
 	ID          bson.ObjectID `json:"id" bson:"_id,omitempty"`
-	UserID      string        `json:"user_id" bson:"user_id"`
-	Token       string        `bson:"token" json:"token"`
-	HashedToken string        `bson:"hashed_token" json:"hashed_token"`
+	UserID      string        `json:"user_id" bson:"user_id"`                           // Organisation the token acts in
+	CreatedBy   string        `bson:"created_by,omitempty" json:"created_by,omitempty"` // Empty for tokens created before organisations were added
+	Name        string        `bson:"name,omitempty" json:"name,omitempty"`
+	Scopes      []string      `bson:"scopes,omitempty" json:"scopes,omitempty"`     // Empty for unscoped tokens created before scopes were added
+	AgentID     string        `bson:"agent_id,omitempty" json:"agent_id,omitempty"` // Restricts the token to the endpoints of one agent
+	Token       string        `bson:"token" json:"token,omitempty"`                 // Only sent when the token is created or rotated
+	HashedToken string        `bson:"hashed_token" json:"hashed_token,omitempty"`
+	Hint        string        `bson:"hint,omitempty" json:"hint,omitempty"` // Last characters of the secret, empty for tokens created before hints were added
 	CreatedAt   time.Time     `bson:"created_at" json:"created_at"`
-	Retrieved   bool          `bson:"retrieved" json:"retrieved"`
+	ExpiresAt   *time.Time    `bson:"expires_at,omitempty" json:"expires_at,omitempty"`
+	LastUsedAt  *time.Time    `bson:"last_used_at,omitempty" json:"last_used_at,omitempty"`
+	LastUsedIP  string        `bson:"last_used_ip,omitempty" json:"last_used_ip,omitempty"`
+	// Hash of the secret replaced by the last rotation, accepted until GraceEndsAt
+	PreviousHashedToken string     `bson:"previous_hashed_token,omitempty" json:"-"`
+	RotatedAt           *time.Time `bson:"rotated_at,omitempty" json:"rotated_at,omitempty"`
+	GraceEndsAt         *time.Time `bson:"grace_ends_at,omitempty" json:"grace_ends_at,omitempty"` // When the previous secret stops working
+	PreviousLastUsedAt  *time.Time `bson:"previous_last_used_at,omitempty" json:"previous_last_used_at,omitempty"`
+	PreviousLastUsedIP  string     `bson:"previous_last_used_ip,omitempty" json:"previous_last_used_ip,omitempty"`
+	GraceNoticeSentAt   *time.Time `bson:"grace_notice_sent_at,omitempty" json:"grace_notice_sent_at,omitempty"`
+	Retrieved           bool       `bson:"retrieved" json:"retrieved"`
 }
 
 // RefreshToken struct for refresh tokens (store in database).
@@ -27,6 +42,22 @@ type RefreshToken struct {
 	Revoked     bool          `bson:"revoked" json:"revoked"`
 	UserAgent   string        `bson:"user_agent,omitempty" json:"user_agent,omitempty"` // Optional user agent
 	IPAddress   string        `bson:"ip_address,omitempty" json:"ip_address,omitempty"` // Optional IP
+	// Shared by the tokens rotated from one login, empty for tokens created before rotation was added
+	FamilyID      string     `bson:"family_id,omitempty" json:"family_id,omitempty"`
+	RotatedAt     *time.Time `bson:"rotated_at,omitempty" json:"rotated_at,omitempty"` // When the token was exchanged for its successor
+	RevokedAt     *time.Time `bson:"revoked_at,omitempty" json:"revoked_at,omitempty"`
+	RevokedReason string     `bson:"revoked_reason,omitempty" json:"revoked_reason,omitempty"`
+}
+
+// SigningKey is a key pair of the keyring that signs JWTs. The private key is encrypted with the
+// envelope of the server.
+type SigningKey struct {
+	ID           string     `bson:"_id" json:"kid"`
+	Algorithm    string     `bson:"algorithm" json:"alg"`         // RS256 or EdDSA
+	EncryptedKey string     `bson:"encrypted_key" json:"-"`       // PEM encoded PKCS #8 private key, encrypted
+	CreatedAt    time.Time  `bson:"created_at" json:"created_at"` // Active from creation until a newer key is created
+	RetiredAt    *time.Time `bson:"retired_at,omitempty" json:"retired_at,omitempty"`
+	LegacyUntil  *time.Time `bson:"legacy_until,omitempty" json:"-"` // Set on the first key: until when tokens signed with JWT_SECRET can be valid
 }
 
 // AccessToken struct (not stored in database)
@@ -0,0 +1,184 @@
+package token
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// EncryptedField is a field of a collection holding values encrypted with an Envelope.
+type EncryptedField struct {
+	Collection *mongo.Collection
+	Field      string
+}
+
+// AAD returns the additional data the value of the field in the document with the ID is encrypted with.
+func (f EncryptedField) AAD(id bson.RawValue) []byte {
+	documentID := id.String()
+	if oid, ok := id.ObjectIDOK(); ok {
+		documentID = oid.Hex()
+	} else if str, ok := id.StringValueOK(); ok {
+		documentID = str
+	}
+	return AAD(f.Collection.Name(), f.Field, documentID)
+}
+
+// ReencryptionConfig controls the job moving stored secrets to the active master key.
+type ReencryptionConfig struct {
+	Interval  time.Duration // How often the collections are checked for values under other keys
+	BatchSize int           // How many values are read at once
+}
+
+// DefaultReencryptionConfig returns the re-encryption settings used when none are configured.
+func DefaultReencryptionConfig() ReencryptionConfig {
+	return ReencryptionConfig{
+		Interval:  time.Hour,
+		BatchSize: 100,
+	}
+}
+
+// ReencryptionConfigFromEnv reads NANNY_REENCRYPT_INTERVAL and NANNY_REENCRYPT_BATCH_SIZE.
+func ReencryptionConfigFromEnv() (ReencryptionConfig, error) {
+	config := DefaultReencryptionConfig()
+	if value := os.Getenv("NANNY_REENCRYPT_INTERVAL"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < time.Minute {
+			return config, fmt.Errorf("invalid NANNY_REENCRYPT_INTERVAL %q, must be a duration of at least 1m", value)
+		}
+		config.Interval = d
+	}
+	if value := os.Getenv("NANNY_REENCRYPT_BATCH_SIZE"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > 1000 {
+			return config, fmt.Errorf("invalid NANNY_REENCRYPT_BATCH_SIZE %q, must be between 1 and 1000", value)
+		}
+		config.BatchSize = n
+	}
+	return config, nil
+}
+
+// Reencryptor moves the secrets stored in the encrypted fields to the active master key of the envelope,
+// so that previous master keys can be removed once it has run. Values written before envelope encryption
+// are upgraded to it on the way.
+type Reencryptor struct {
+	envelope *Envelope
+	config   ReencryptionConfig
+	fields   []EncryptedField
+}
+
+// NewReencryptor creates a re-encryption job for the fields.
+func NewReencryptor(envelope *Envelope, config ReencryptionConfig, fields ...EncryptedField) *Reencryptor {
+	return &Reencryptor{envelope: envelope, config: config, fields: fields}
+}
+
+// Run re-encrypts every value not under the active master key and returns how many were moved. Values
+// that cannot be decrypted are logged and skipped.
+func (r *Reencryptor) Run(ctx context.Context) (int, error) {
+	// Values must not be moved back to a key another process has already replaced
+	if reloader, ok := r.envelope.source.(interface{ Reload() error }); ok {
+		if err := reloader.Reload(); err != nil {
+			return 0, fmt.Errorf("failed to reload master keys: %v", err)
+		}
+	}
+	moved, failed := 0, 0
+	for _, field := range r.fields {
+		m, f, err := r.runField(ctx, field)
+		moved += m
+		failed += f
+		if err != nil {
+			return moved, err
+		}
+	}
+	if failed > 0 {
+		return moved, fmt.Errorf("failed to re-encrypt %d values", failed)
+	}
+	return moved, nil
+}
+
+// runField re-encrypts the values of a field in batches, in the order of their document IDs so that
+// values failing to decrypt are visited once.
+func (r *Reencryptor) runField(ctx context.Context, field EncryptedField) (int, int, error) {
+	name := field.Collection.Name() + "." + field.Field
+	stale := bson.M{
+		"$type": "string",
+		"$ne":   "",
+		"$not":  bson.Regex{Pattern: "^" + regexp.QuoteMeta(r.envelope.prefix())},
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetLimit(int64(r.config.BatchSize)).
+		SetProjection(bson.M{field.Field: 1})
+
+	moved, failed := 0, 0
+	var lastID interface{}
+	for {
+		filter := bson.M{field.Field: stale}
+		if lastID != nil {
+			filter["_id"] = bson.M{"$gt": lastID}
+		}
+		cursor, err := field.Collection.Find(ctx, filter, opts)
+		if err != nil {
+			return moved, failed, fmt.Errorf("failed to find values to re-encrypt in %s: %v", name, err)
+		}
+		var docs []bson.Raw
+		if err := cursor.All(ctx, &docs); err != nil {
+			return moved, failed, fmt.Errorf("failed to read values to re-encrypt in %s: %v", name, err)
+		}
+		if len(docs) == 0 {
+			return moved, failed, nil
+		}
+
+		for _, doc := range docs {
+			id := doc.Lookup("_id")
+			lastID = id
+			old, ok := doc.Lookup(field.Field).StringValueOK()
+			if !ok {
+				continue
+			}
+			value, err := r.envelope.Reencrypt(old, field.AAD(id))
+			if err != nil {
+				log.Printf("Failed to re-encrypt %s of %s: %v", name, id, err)
+				failed++
+				continue
+			}
+			// The value is only replaced if it was not changed meanwhile
+			result, err := field.Collection.UpdateOne(ctx, bson.M{"_id": id, field.Field: old}, bson.M{"$set": bson.M{field.Field: value}})
+			if err != nil {
+				return moved, failed, fmt.Errorf("failed to store re-encrypted %s of %s: %v", name, id, err)
+			}
+			if result.ModifiedCount > 0 {
+				moved++
+			}
+		}
+	}
+}
+
+// Start runs the job at once and then every interval until the context is cancelled.
+func (r *Reencryptor) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(r.config.Interval)
+		defer ticker.Stop()
+		for {
+			moved, err := r.Run(ctx)
+			if err != nil {
+				log.Printf("Failed to re-encrypt secrets: %v", err)
+			}
+			if moved > 0 {
+				log.Printf("Re-encrypted %d secrets with master key %s", moved, r.envelope.ActiveKeyID())
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
@@ -0,0 +1,55 @@
+package token
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestReencryptor(t *testing.T) {
+	client, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	repo := NewTokenRepository(client.Database(testDBName))
+	service := NewTokenService(repo)
+	assert.NoError(t, repo.collection.Drop(ctx))
+
+	// Tokens stored before envelope encryption and under the previous master key
+	legacy, err := Encrypt("legacy-secret", previousEncryptionKey)
+	assert.NoError(t, err)
+	legacyToken, err := repo.CreateToken(ctx, Token{UserID: "reencrypt-user", Token: legacy, HashedToken: HashToken("legacy-secret")})
+	assert.NoError(t, err)
+	previous, err := service.CreateToken(ctx, Token{UserID: "reencrypt-user", Token: "previous-secret"}, newTestEnvelope(t, previousEncryptionKey))
+	assert.NoError(t, err)
+	// A value no key can decrypt is skipped
+	unknown, err := Encrypt("unknown-secret", "QUJDREVGR0hJSktMTU5PUFFSU1RVVldYWVpBQkNERUY=")
+	assert.NoError(t, err)
+	_, err = repo.CreateToken(ctx, Token{UserID: "reencrypt-user", Token: unknown, HashedToken: HashToken("unknown-secret")})
+	assert.NoError(t, err)
+
+	envelope := newTestEnvelope(t, encryptionKey, previousEncryptionKey)
+	config := DefaultReencryptionConfig()
+	config.BatchSize = 1
+	reencryptor := NewReencryptor(envelope, config, repo.EncryptedField())
+
+	moved, err := reencryptor.Run(ctx)
+	assert.EqualError(t, err, "failed to re-encrypt 1 values")
+	assert.Equal(t, 2, moved)
+
+	current := newTestEnvelope(t)
+	for id, secret := range map[bson.ObjectID]string{legacyToken.ID: "legacy-secret", previous.ID: "previous-secret"} {
+		stored, err := repo.GetToken(ctx, id)
+		assert.NoError(t, err)
+		assert.True(t, envelope.Current(stored.Token))
+		decrypted, err := current.Decrypt(stored.Token, TokenAAD(id))
+		assert.NoError(t, err)
+		assert.Equal(t, secret, decrypted)
+	}
+
+	// Nothing is left to move
+	moved, _ = reencryptor.Run(ctx)
+	assert.Equal(t, 0, moved)
+}
@@ -0,0 +1,127 @@
+package token
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// RefreshTokenLifetime is how long a refresh token can be exchanged. Each exchange issues a new token, so
+// a session ends after this long without use.
+const RefreshTokenLifetime = 7 * 24 * time.Hour
+
+// Reasons recorded on revoked refresh tokens.
+const (
+	RevokedReuse    = "reuse"    // A retired token of the family was presented again
+	RevokedReplaced = "replaced" // A new login replaced the session
+)
+
+// Family returns the ID of the token family. Tokens created before families were added start their own.
+func (t *RefreshToken) Family() string {
+	if t.FamilyID != "" {
+		return t.FamilyID
+	}
+	return t.ID.Hex()
+}
+
+// CheckRefreshToken returns the stored refresh token if it can still be exchanged. Presenting a token that
+// was already exchanged means it was stolen or replayed: the whole family is revoked, so neither the
+// attacker nor the user can continue the session without logging in again.
+func (s *RefreshTokenService) CheckRefreshToken(ctx context.Context, refreshToken string, keys *Keyring, userAgent, ipAddress string) (*RefreshToken, error) {
+	claims, err := keys.ValidateJWTToken(refreshToken, "refresh")
+	if err != nil {
+		return nil, fmt.Errorf("invalid refresh token: %v", err)
+	}
+
+	stored, err := s.refreshTokenRepo.GetRefreshToken(ctx, HashToken(refreshToken))
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, fmt.Errorf("refresh token not found")
+		}
+		return nil, fmt.Errorf("failed to retrieve refresh token: %v", err)
+	}
+	if stored.UserID != claims.UserID {
+		return nil, fmt.Errorf("invalid refresh token: issued to another user")
+	}
+	if stored.Revoked {
+		return nil, fmt.Errorf("refresh token revoked")
+	}
+	if stored.RotatedAt != nil {
+		log.Printf("Refresh token reuse detected for user %s in family %s, rotated at %s, presented by %s from %s",
+			stored.UserID, stored.Family(), stored.RotatedAt.Format(time.RFC3339), userAgent, ipAddress)
+		if err := s.revokeFamily(ctx, stored, RevokedReuse); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("refresh token reuse detected")
+	}
+	if time.Now().After(stored.ExpiresAt) {
+		return nil, fmt.Errorf("refresh token expired")
+	}
+	return stored, nil
+}
+
+// RotateRefreshToken exchanges a refresh token for a new one in the same family and retires the presented
+// token. It returns the new token and its stored record.
+func (s *RefreshTokenService) RotateRefreshToken(ctx context.Context, refreshToken string, keys *Keyring, userAgent, ipAddress string, envelope *Envelope) (string, *RefreshToken, error) {
+	stored, err := s.CheckRefreshToken(ctx, refreshToken, keys, userAgent, ipAddress)
+	if err != nil {
+		return "", nil, err
+	}
+
+	retired, err := s.refreshTokenRepo.RetireRefreshToken(ctx, stored.ID, time.Now())
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to retire refresh token: %v", err)
+	}
+	if !retired {
+		// Another request exchanged the same token first
+		log.Printf("Refresh token reuse detected for user %s in family %s, presented concurrently by %s from %s",
+			stored.UserID, stored.Family(), userAgent, ipAddress)
+		if err := s.revokeFamily(ctx, stored, RevokedReuse); err != nil {
+			return "", nil, err
+		}
+		return "", nil, fmt.Errorf("refresh token reuse detected")
+	}
+
+	next, err := keys.GenerateJWT(stored.UserID, RefreshTokenLifetime, "refresh")
+	if err != nil {
+		return "", nil, err
+	}
+	created, err := s.CreateRefreshToken(ctx, RefreshToken{
+		UserID:    stored.UserID,
+		Token:     next,
+		FamilyID:  stored.Family(),
+		UserAgent: userAgent,
+		IPAddress: ipAddress,
+	}, envelope)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create refresh token: %v", err)
+	}
+	return next, created, nil
+}
+
+// RevokeRefreshToken revokes the family of a refresh token, e.g. when a new login replaces the session it
+// belongs to. Unknown tokens are ignored.
+func (s *RefreshTokenService) RevokeRefreshToken(ctx context.Context, refreshToken, reason string) error {
+	stored, err := s.refreshTokenRepo.GetRefreshToken(ctx, HashToken(refreshToken))
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil
+		}
+		return fmt.Errorf("failed to retrieve refresh token: %v", err)
+	}
+	return s.revokeFamily(ctx, stored, reason)
+}
+
+func (s *RefreshTokenService) revokeFamily(ctx context.Context, t *RefreshToken, reason string) error {
+	revoked, err := s.refreshTokenRepo.RevokeRefreshTokenFamily(ctx, t.Family(), t.ID, reason, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to revoke refresh token family %s: %v", t.Family(), err)
+	}
+	if revoked > 0 {
+		log.Printf("Revoked %d refresh tokens of user %s in family %s: %s", revoked, t.UserID, t.Family(), reason)
+	}
+	return nil
+}
@@ -3,9 +3,11 @@ package token
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"go.mongodb.org/mongo-driver/v2/bson"
 	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
 )
 
 type TokenRepository struct {
@@ -16,18 +18,65 @@ type RefreshTokenRepository struct {
 	collection *mongo.Collection
 }
 
+type SigningKeyRepository struct {
+	collection *mongo.Collection
+}
+
+// Collections holding encrypted values, which are part of the additional data of the values.
+const (
+	tokensCollection        = "auth_tokens"
+	refreshTokensCollection = "refresh_tokens"
+	signingKeysCollection   = "signing_keys"
+)
+
 func NewTokenRepository(db *mongo.Database) *TokenRepository {
 	return &TokenRepository{
-		collection: db.Collection("auth_tokens"),
+		collection: db.Collection(tokensCollection),
 	}
 }
 
 func NewRefreshTokenRepository(db *mongo.Database) *RefreshTokenRepository {
 	return &RefreshTokenRepository{
-		collection: db.Collection("refresh_tokens"),
+		collection: db.Collection(refreshTokensCollection),
 	}
 }
 
+func NewSigningKeyRepository(db *mongo.Database) *SigningKeyRepository {
+	return &SigningKeyRepository{
+		collection: db.Collection(signingKeysCollection),
+	}
+}
+
+// TokenAAD returns the additional data the secret of the static token with the ID is encrypted with.
+func TokenAAD(id bson.ObjectID) []byte {
+	return AAD(tokensCollection, "token", id.Hex())
+}
+
+// refreshTokenAAD returns the additional data the refresh token with the ID is encrypted with.
+func refreshTokenAAD(id bson.ObjectID) []byte {
+	return AAD(refreshTokensCollection, "token", id.Hex())
+}
+
+// signingKeyAAD returns the additional data the private key of the signing key with the ID is encrypted with.
+func signingKeyAAD(id string) []byte {
+	return AAD(signingKeysCollection, "encrypted_key", id)
+}
+
+// EncryptedField returns the field holding the encrypted secrets of static tokens.
+func (r *TokenRepository) EncryptedField() EncryptedField {
+	return EncryptedField{Collection: r.collection, Field: "token"}
+}
+
+// EncryptedField returns the field holding encrypted refresh tokens.
+func (r *RefreshTokenRepository) EncryptedField() EncryptedField {
+	return EncryptedField{Collection: r.collection, Field: "token"}
+}
+
+// EncryptedField returns the field holding the encrypted private keys of the JWT keyring.
+func (r *SigningKeyRepository) EncryptedField() EncryptedField {
+	return EncryptedField{Collection: r.collection, Field: "encrypted_key"}
+}
+
 // static tokens.
 func (r *TokenRepository) CreateToken(ctx context.Context, token Token) (*Token, error) {
 	tokenResult, err := r.collection.InsertOne(ctx, token)
@@ -80,8 +129,11 @@ func (r *TokenRepository) GetToken(ctx context.Context, tokenId bson.ObjectID) (
 	return &token, nil
 }
 
-func (r *TokenRepository) GetTokenByHashedToken(ctx context.Context, hashedToken string) (*Token, error) {
-	filter := bson.M{"hashed_token": hashedToken}
+func (r *TokenRepository) GetTokenByHashedToken(ctx context.Context, hashedToken string, now time.Time) (*Token, error) {
+	filter := bson.M{"$or": bson.A{
+		bson.M{"hashed_token": hashedToken},
+		bson.M{"previous_hashed_token": hashedToken, "grace_ends_at": bson.M{"$gt": now}},
+	}}
 	var token Token
 	err := r.collection.FindOne(ctx, filter).Decode(&token)
 	if err != nil {
@@ -104,6 +156,93 @@ func (r *TokenRepository) DeleteToken(ctx context.Context, tokenID bson.ObjectID
 	return nil
 }
 
+// TouchToken records the use of a static token, or of the previous secret of a rotated token, unless a use
+// was recorded within the interval.
+func (r *TokenRepository) TouchToken(ctx context.Context, id bson.ObjectID, now time.Time, ip string, previous bool, interval time.Duration) error {
+	usedAt, usedIP := "last_used_at", "last_used_ip"
+	if previous {
+		usedAt, usedIP = "previous_last_used_at", "previous_last_used_ip"
+	}
+	filter := bson.M{
+		"_id": id,
+		"$or": bson.A{
+			bson.M{usedAt: bson.M{"$exists": false}},
+			bson.M{usedAt: bson.M{"$lt": now.Add(-interval)}},
+		},
+	}
+	if _, err := r.collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{usedAt: now, usedIP: ip}}); err != nil {
+		return fmt.Errorf("failed to update auth token: %v", err)
+	}
+	return nil
+}
+
+// RotateToken replaces the secret of a static token, keeping the current one as the previous secret until
+// the grace period ends. It reports false when the current secret changed in the meantime.
+func (r *TokenRepository) RotateToken(ctx context.Context, id bson.ObjectID, currentHash, newHash, encryptedToken, hint string, now, graceEndsAt time.Time) (bool, error) {
+	filter := bson.M{"_id": id, "hashed_token": currentHash}
+	update := bson.M{
+		"$set": bson.M{
+			"token":                 encryptedToken,
+			"hashed_token":          newHash,
+			"hint":                  hint,
+			"previous_hashed_token": currentHash,
+			"rotated_at":            now,
+			"grace_ends_at":         graceEndsAt,
+		},
+		"$unset": bson.M{"previous_last_used_at": "", "previous_last_used_ip": "", "grace_notice_sent_at": ""},
+	}
+	result, err := r.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, fmt.Errorf("failed to rotate auth token: %v", err)
+	}
+	return result.ModifiedCount > 0, nil
+}
+
+// ExpireAgentTokens expires the static tokens bound to an agent that are still valid at the given time and
+// returns how many were expired.
+func (r *TokenRepository) ExpireAgentTokens(ctx context.Context, agentID string, now time.Time) (int64, error) {
+	filter := bson.M{
+		"agent_id": agentID,
+		"$or": bson.A{
+			bson.M{"expires_at": bson.M{"$exists": false}},
+			bson.M{"expires_at": bson.M{"$gt": now}},
+		},
+	}
+	result, err := r.collection.UpdateMany(ctx, filter, bson.M{"$set": bson.M{"expires_at": now}})
+	if err != nil {
+		return 0, fmt.Errorf("failed to expire auth tokens of agent %s: %v", agentID, err)
+	}
+	return result.ModifiedCount, nil
+}
+
+// GetTokensWithGraceEnding returns the rotated tokens whose previous secret stops working between now and
+// the given time and whose owner was not notified yet.
+func (r *TokenRepository) GetTokensWithGraceEnding(ctx context.Context, now, until time.Time) ([]*Token, error) {
+	filter := bson.M{
+		"grace_ends_at":        bson.M{"$gt": now, "$lte": until},
+		"grace_notice_sent_at": bson.M{"$exists": false},
+	}
+	cursor, err := r.collection.Find(ctx, filter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find rotated auth tokens: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	var tokens []*Token
+	if err := cursor.All(ctx, &tokens); err != nil {
+		return nil, fmt.Errorf("failed to decode rotated auth tokens: %v", err)
+	}
+	return tokens, nil
+}
+
+// SetGraceNoticeSentAt records that the owner was told the grace period of the token is ending.
+func (r *TokenRepository) SetGraceNoticeSentAt(ctx context.Context, id bson.ObjectID, sentAt time.Time) error {
+	if _, err := r.collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"grace_notice_sent_at": sentAt}}); err != nil {
+		return fmt.Errorf("failed to update auth token: %v", err)
+	}
+	return nil
+}
+
 func (r *TokenRepository) UpdateToken(ctx context.Context, token *Token) error {
 	filter := bson.M{"token": token.Token}
 	_, err := r.collection.UpdateOne(ctx, filter, bson.M{"$set": token})
@@ -125,7 +264,7 @@ func (r *RefreshTokenRepository) CreateRefreshToken(ctx context.Context, token R
 }
 
 func (r *RefreshTokenRepository) UpdateRefreshToken(ctx context.Context, token *RefreshToken) error {
-	filter := bson.M{"token": token.Token}
+	filter := bson.M{"hashed_token": token.HashedToken} // the encrypted token differs on every encryption
 	_, err := r.collection.UpdateOne(ctx, filter, bson.M{"$set": token})
 	return err
 }
@@ -143,6 +282,32 @@ func (r *RefreshTokenRepository) GetRefreshToken(ctx context.Context, hashedToke
 	return &token, nil
 }
 
+// RetireRefreshToken marks a refresh token as exchanged for its successor. It reports false when the token
+// was already retired or revoked, e.g. by a concurrent request presenting the same token.
+func (r *RefreshTokenRepository) RetireRefreshToken(ctx context.Context, id bson.ObjectID, now time.Time) (bool, error) {
+	filter := bson.M{"_id": id, "revoked": false, "rotated_at": bson.M{"$exists": false}}
+	result, err := r.collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"rotated_at": now}})
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+// RevokeRefreshTokenFamily revokes the tokens of a family. The token ID covers tokens created before
+// families were added, which are the first token of the family named after their ID.
+func (r *RefreshTokenRepository) RevokeRefreshTokenFamily(ctx context.Context, familyID string, tokenID bson.ObjectID, reason string, now time.Time) (int64, error) {
+	filter := bson.M{
+		"$or":     bson.A{bson.M{"family_id": familyID}, bson.M{"_id": tokenID}},
+		"revoked": false,
+	}
+	update := bson.M{"$set": bson.M{"revoked": true, "revoked_at": now, "revoked_reason": reason}}
+	result, err := r.collection.UpdateMany(ctx, filter, update)
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
 func (r *RefreshTokenRepository) DeleteRefreshToken(ctx context.Context, hashedToken string) error {
 	filter := bson.M{"hashed_token": hashedToken}
 
@@ -180,3 +345,45 @@ func (r *RefreshTokenRepository) GetRefreshTokensByUser(ctx context.Context, use
 	}
 	return tokens, nil
 }
+
+// signing keys.
+func (r *SigningKeyRepository) InsertSigningKey(ctx context.Context, key *SigningKey) error {
+	_, err := r.collection.InsertOne(ctx, key)
+	return err
+}
+
+// ListSigningKeys returns the keys that are active or were retired after the given time, newest first.
+func (r *SigningKeyRepository) ListSigningKeys(ctx context.Context, retiredAfter time.Time) ([]*SigningKey, error) {
+	filter := bson.M{"$or": bson.A{
+		bson.M{"retired_at": bson.M{"$exists": false}},
+		bson.M{"retired_at": bson.M{"$gt": retiredAfter}},
+	}}
+	cursor, err := r.collection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+	var keys []*SigningKey
+	if err := cursor.All(ctx, &keys); err != nil {
+		return nil, fmt.Errorf("cursor error: %w", err)
+	}
+	return keys, nil
+}
+
+// RetireSigningKeys makes every active key except the given one verify only.
+func (r *SigningKeyRepository) RetireSigningKeys(ctx context.Context, except string, now time.Time) (int64, error) {
+	filter := bson.M{"_id": bson.M{"$ne": except}, "retired_at": bson.M{"$exists": false}}
+	result, err := r.collection.UpdateMany(ctx, filter, bson.M{"$set": bson.M{"retired_at": now}})
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+// DeleteSigningKeys deletes the keys retired before the given time, which no longer verify any token.
+func (r *SigningKeyRepository) DeleteSigningKeys(ctx context.Context, retiredBefore time.Time) (int64, error) {
+	result, err := r.collection.DeleteMany(ctx, bson.M{"retired_at": bson.M{"$lte": retiredBefore}})
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
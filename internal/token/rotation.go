@@ -0,0 +1,187 @@
+package token
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// Which secret of a static token authenticated a request, see SecretHeader.
+const (
+	SecretCurrent  = "current"
+	SecretPrevious = "previous"
+)
+
+// SecretHeader tells clients whether their static token is the current secret or the previous one, which
+// stops working when the grace period of a rotation ends.
+const SecretHeader = "X-NANNYAPI-Key-Secret"
+
+// RotationConfig controls how long the previous secret of a rotated token stays valid and when its owner
+// is told the grace period is ending.
+type RotationConfig struct {
+	DefaultGrace  time.Duration // Used when a rotation does not ask for a grace period
+	MaxGrace      time.Duration
+	NoticeBefore  time.Duration // How long before the end of the grace period the owner is notified
+	CheckInterval time.Duration // How often grace periods are checked for notices
+}
+
+// DefaultRotationConfig returns the rotation settings used when none are configured.
+func DefaultRotationConfig() RotationConfig {
+	return RotationConfig{
+		DefaultGrace:  24 * time.Hour,
+		MaxGrace:      30 * 24 * time.Hour,
+		NoticeBefore:  time.Hour,
+		CheckInterval: 5 * time.Minute,
+	}
+}
+
+// RotationConfigFromEnv reads TOKEN_ROTATION_GRACE, TOKEN_ROTATION_NOTICE and TOKEN_ROTATION_CHECK_INTERVAL.
+func RotationConfigFromEnv() (RotationConfig, error) {
+	config := DefaultRotationConfig()
+	if value := os.Getenv("TOKEN_ROTATION_GRACE"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 || d > config.MaxGrace {
+			return config, fmt.Errorf("invalid TOKEN_ROTATION_GRACE %q, must be a duration between 0s and %s", value, config.MaxGrace)
+		}
+		config.DefaultGrace = d
+	}
+	if value := os.Getenv("TOKEN_ROTATION_NOTICE"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < time.Minute {
+			return config, fmt.Errorf("invalid TOKEN_ROTATION_NOTICE %q, must be a duration of at least 1m", value)
+		}
+		config.NoticeBefore = d
+	}
+	if value := os.Getenv("TOKEN_ROTATION_CHECK_INTERVAL"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < time.Minute {
+			return config, fmt.Errorf("invalid TOKEN_ROTATION_CHECK_INTERVAL %q, must be a duration of at least 1m", value)
+		}
+		config.CheckInterval = d
+	}
+	return config, nil
+}
+
+// RotateTokenRequest is the body of a request to rotate a static token.
+type RotateTokenRequest struct {
+	GracePeriod string `json:"grace_period,omitempty"` // How long the old secret stays valid, e.g. 2h, 0s revokes it at once
+}
+
+// Secret returns which secret of the token has the hash.
+func (t *Token) Secret(hashedToken string) string {
+	if t.HashedToken != hashedToken && t.PreviousHashedToken == hashedToken {
+		return SecretPrevious
+	}
+	return SecretCurrent
+}
+
+// GraceNotifier tells the owner of a rotated token that the previous secret stops working soon.
+type GraceNotifier func(ctx context.Context, token *Token) error
+
+// SetRotationConfig sets the grace periods and notices of token rotations.
+func (s *TokenService) SetRotationConfig(config RotationConfig) {
+	s.rotation = config
+}
+
+// SetGraceNotifier registers how owners are told a grace period is ending.
+func (s *TokenService) SetGraceNotifier(notifier GraceNotifier) {
+	s.graceNotifier = notifier
+}
+
+// gracePeriod returns how long the previous secret stays valid after a rotation.
+func (s *TokenService) gracePeriod(req *RotateTokenRequest) (time.Duration, error) {
+	if req.GracePeriod == "" {
+		return s.rotation.DefaultGrace, nil
+	}
+	grace, err := time.ParseDuration(req.GracePeriod)
+	if err != nil || grace < 0 || grace > s.rotation.MaxGrace {
+		return 0, fmt.Errorf("invalid grace_period %q, must be a duration between 0s and %s", req.GracePeriod, s.rotation.MaxGrace)
+	}
+	return grace, nil
+}
+
+// RotateToken issues a new secret for the static token. The previous secret stays valid for the grace
+// period; a secret that was still in the grace period of an earlier rotation stops working at once.
+// The returned token holds the new secret encrypted, like CreateToken. Requests made with an API key, the
+// caller, can only rotate tokens that it covers.
+func (s *TokenService) RotateToken(ctx context.Context, id bson.ObjectID, userID string, caller *Token, req *RotateTokenRequest, envelope *Envelope) (*Token, error) {
+	grace, err := s.gracePeriod(req)
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := s.GetToken(ctx, id, userID)
+	if err != nil {
+		return nil, err
+	}
+	if caller != nil && !caller.Covers(existing) {
+		return nil, fmt.Errorf("auth token has rights the API key does not have")
+	}
+	now := time.Now()
+	if existing.Expired(now) {
+		return nil, fmt.Errorf("invalid rotation: auth token has expired")
+	}
+
+	secret := GenerateRandomString(33)
+	encrypted, err := envelope.Encrypt(secret, TokenAAD(id))
+	if err != nil {
+		return nil, err
+	}
+	graceEndsAt := now.Add(grace)
+	rotated, err := s.tokenRepo.RotateToken(ctx, id, existing.HashedToken, HashToken(secret), encrypted, SecretHint(secret), now, graceEndsAt)
+	if err != nil {
+		return nil, err
+	}
+	if !rotated {
+		return nil, fmt.Errorf("invalid rotation: auth token was rotated concurrently")
+	}
+
+	log.Printf("Static token %s rotated by user %s, previous secret valid until %s", id.Hex(), userID, graceEndsAt.Format(time.RFC3339))
+	return s.tokenRepo.GetToken(ctx, id)
+}
+
+// NotifyEndingGracePeriods notifies the owners of tokens whose previous secret stops working within the
+// notice period. Each rotation is notified once.
+func (s *TokenService) NotifyEndingGracePeriods(ctx context.Context, now time.Time) error {
+	tokens, err := s.tokenRepo.GetTokensWithGraceEnding(ctx, now, now.Add(s.rotation.NoticeBefore))
+	if err != nil {
+		return err
+	}
+	for _, t := range tokens {
+		if err := s.graceNotifier(ctx, t); err != nil {
+			log.Printf("Failed to notify end of grace period of token %s: %v", t.ID.Hex(), err)
+			continue
+		}
+		if err := s.tokenRepo.SetGraceNoticeSentAt(ctx, t.ID, now); err != nil {
+			log.Printf("Failed to record grace period notice of token %s: %v", t.ID.Hex(), err)
+		}
+	}
+	return nil
+}
+
+// StartGraceNotifier checks for ending grace periods every check interval until the context is cancelled.
+func (s *TokenService) StartGraceNotifier(ctx context.Context) {
+	if s.graceNotifier == nil {
+		log.Printf("No grace notifier registered, token rotation notices are disabled")
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(s.rotation.CheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				if err := s.NotifyEndingGracePeriods(ctx, now); err != nil {
+					log.Printf("Failed to check token grace periods: %v", err)
+				}
+			}
+		}
+	}()
+}
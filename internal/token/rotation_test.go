@@ -0,0 +1,58 @@
+package token
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRotationConfigFromEnv(t *testing.T) {
+	t.Run("Defaults", func(t *testing.T) {
+		config, err := RotationConfigFromEnv()
+		assert.NoError(t, err)
+		assert.Equal(t, DefaultRotationConfig(), config)
+	})
+
+	t.Run("Overrides", func(t *testing.T) {
+		t.Setenv("TOKEN_ROTATION_GRACE", "2h")
+		t.Setenv("TOKEN_ROTATION_NOTICE", "30m")
+		t.Setenv("TOKEN_ROTATION_CHECK_INTERVAL", "1m")
+		config, err := RotationConfigFromEnv()
+		assert.NoError(t, err)
+		assert.Equal(t, 2*time.Hour, config.DefaultGrace)
+		assert.Equal(t, 30*time.Minute, config.NoticeBefore)
+		assert.Equal(t, time.Minute, config.CheckInterval)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		t.Setenv("TOKEN_ROTATION_GRACE", "1000h")
+		_, err := RotationConfigFromEnv()
+		assert.ErrorContains(t, err, "invalid TOKEN_ROTATION_GRACE")
+	})
+}
+
+func TestGracePeriod(t *testing.T) {
+	s := &TokenService{rotation: DefaultRotationConfig()}
+
+	grace, err := s.gracePeriod(&RotateTokenRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, 24*time.Hour, grace)
+
+	grace, err = s.gracePeriod(&RotateTokenRequest{GracePeriod: "0s"})
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), grace)
+
+	_, err = s.gracePeriod(&RotateTokenRequest{GracePeriod: "-1h"})
+	assert.ErrorContains(t, err, "invalid grace_period")
+
+	_, err = s.gracePeriod(&RotateTokenRequest{GracePeriod: "721h"})
+	assert.ErrorContains(t, err, "invalid grace_period")
+}
+
+func TestSecret(t *testing.T) {
+	rotated := &Token{HashedToken: HashToken("new"), PreviousHashedToken: HashToken("old")}
+	assert.Equal(t, SecretCurrent, rotated.Secret(HashToken("new")))
+	assert.Equal(t, SecretPrevious, rotated.Secret(HashToken("old")))
+	assert.Equal(t, SecretCurrent, (&Token{HashedToken: HashToken("new")}).Secret(HashToken("new")))
+}
@@ -0,0 +1,90 @@
+package token
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateScopes(t *testing.T) {
+	scopes, err := ValidateScopes([]string{ScopeTokensAdmin, ScopeAgentsWrite, ScopeAgentsWrite})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{ScopeAgentsWrite, ScopeTokensAdmin}, scopes)
+
+	_, err = ValidateScopes(nil)
+	assert.Error(t, err)
+
+	_, err = ValidateScopes([]string{"agents:read"})
+	assert.ErrorContains(t, err, `invalid scope "agents:read"`)
+}
+
+func TestCreateTokenRequestValidate(t *testing.T) {
+	now := time.Now()
+	past := now.Add(-time.Hour)
+	future := now.Add(time.Hour)
+
+	req := &CreateTokenRequest{Name: "  ci  ", Scopes: []string{ScopeDiagnosticsRead}, ExpiresAt: &future}
+	assert.NoError(t, req.Validate(now))
+	assert.Equal(t, "ci", req.Name)
+
+	assert.ErrorContains(t, (&CreateTokenRequest{Scopes: []string{ScopeDiagnosticsRead}}).Validate(now), "invalid name")
+	assert.ErrorContains(t, (&CreateTokenRequest{Name: "ci"}).Validate(now), "invalid scopes")
+	assert.ErrorContains(t, (&CreateTokenRequest{Name: "ci", Scopes: []string{ScopeDiagnosticsRead}, ExpiresAt: &past}).Validate(now), "invalid expires_at")
+}
+
+func TestHasScope(t *testing.T) {
+	unscoped := &Token{}
+	assert.True(t, unscoped.HasScope(ScopeTokensAdmin))
+
+	writer := &Token{Scopes: []string{ScopeDiagnosticsWrite}}
+	assert.True(t, writer.HasScope(ScopeDiagnosticsWrite))
+	assert.True(t, writer.HasScope(ScopeDiagnosticsRead))
+	assert.False(t, writer.HasScope(ScopeAgentsWrite))
+
+	reader := &Token{Scopes: []string{ScopeDiagnosticsRead}}
+	assert.False(t, reader.HasScope(ScopeDiagnosticsWrite))
+}
+
+func TestExpired(t *testing.T) {
+	now := time.Now()
+	expiresAt := now.Add(time.Minute)
+	assert.False(t, (&Token{}).Expired(now))
+	assert.False(t, (&Token{ExpiresAt: &expiresAt}).Expired(now))
+	assert.True(t, (&Token{ExpiresAt: &expiresAt}).Expired(expiresAt))
+}
+
+func TestCreator(t *testing.T) {
+	assert.Equal(t, "user", (&Token{UserID: "user"}).Creator())
+	assert.Equal(t, "member", (&Token{UserID: "org", CreatedBy: "member"}).Creator())
+}
+
+func TestRedacted(t *testing.T) {
+	secret := "adfadsfdsfdsfadsf"
+	authToken := &Token{Name: "fleet", Token: "encrypted", HashedToken: HashToken(secret), PreviousHashedToken: "previous", Hint: SecretHint(secret)}
+	redacted := authToken.Redacted()
+	assert.Empty(t, redacted.Token)
+	assert.Empty(t, redacted.HashedToken)
+	assert.Empty(t, redacted.PreviousHashedToken)
+	assert.Equal(t, "adsf", redacted.Hint)
+	assert.Equal(t, "fleet", redacted.Name)
+	assert.Equal(t, "encrypted", authToken.Token)
+	assert.Empty(t, SecretHint("abcd"))
+}
+
+func TestCovers(t *testing.T) {
+	unscoped := &Token{}
+	writer := &Token{Scopes: []string{ScopeAgentsWrite, ScopeDiagnosticsWrite}}
+	reader := &Token{Scopes: []string{ScopeDiagnosticsRead}}
+	bound := &Token{Scopes: []string{ScopeAgentsWrite}, AgentID: "agent"}
+	otherBound := &Token{Scopes: []string{ScopeAgentsWrite}, AgentID: "other"}
+
+	assert.True(t, unscoped.Covers(writer))
+	assert.True(t, unscoped.Covers(bound))
+	assert.False(t, writer.Covers(unscoped))
+	assert.True(t, writer.Covers(reader))
+	assert.False(t, reader.Covers(writer))
+	assert.True(t, bound.Covers(bound))
+	assert.False(t, bound.Covers(otherBound))
+	assert.False(t, bound.Covers(&Token{Scopes: []string{ScopeAgentsWrite}}))
+}
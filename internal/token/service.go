@@ -11,7 +11,9 @@ import (
 )
 
 type TokenService struct {
-	tokenRepo *TokenRepository
+	tokenRepo     *TokenRepository
+	rotation      RotationConfig
+	graceNotifier GraceNotifier
 }
 
 type RefreshTokenService struct {
@@ -21,6 +23,7 @@ type RefreshTokenService struct {
 func NewTokenService(tokenRepo *TokenRepository) *TokenService {
 	return &TokenService{
 		tokenRepo: tokenRepo,
+		rotation:  DefaultRotationConfig(),
 	}
 }
 
@@ -31,16 +34,21 @@ func NewRefreshTokenService(refreshTokenRepo *RefreshTokenRepository) *RefreshTo
 }
 
 // CreateToken creates a static token.
-func (s *TokenService) CreateToken(ctx context.Context, token Token, encryptionKey string) (*Token, error) {
+func (s *TokenService) CreateToken(ctx context.Context, token Token, envelope *Envelope) (*Token, error) {
 	// Hash the token
 	hashedToken := HashToken(token.Token)
 
-	encryptedToken, err := Encrypt(token.Token, encryptionKey)
+	// The ID is part of the additional data of the encrypted secret
+	if token.ID.IsZero() {
+		token.ID = bson.NewObjectID()
+	}
+	encryptedToken, err := envelope.Encrypt(token.Token, TokenAAD(token.ID))
 	if err != nil {
 		return nil, err
 	}
 
 	// set Token object
+	token.Hint = SecretHint(token.Token)
 	token.Token = encryptedToken
 	token.HashedToken = hashedToken
 	token.CreatedAt = time.Now()
@@ -51,9 +59,19 @@ func (s *TokenService) CreateToken(ctx context.Context, token Token, encryptionK
 	return s.tokenRepo.CreateToken(ctx, token)
 }
 
-// GetTokenByHashedToken retrieves a static token by hashed token.
+// tokenUseInterval throttles how often the last use of a static token is recorded.
+const tokenUseInterval = time.Minute
+
+// TouchToken records the use of a static token from the IP address, with the previous secret of a rotated
+// token when previous is set.
+func (s *TokenService) TouchToken(ctx context.Context, id bson.ObjectID, ip string, previous bool) error {
+	return s.tokenRepo.TouchToken(ctx, id, time.Now(), ip, previous, tokenUseInterval)
+}
+
+// GetTokenByHashedToken retrieves a static token by hashed token. The previous secret of a rotated token
+// is matched until its grace period ends.
 func (s *TokenService) GetTokenByHashedToken(ctx context.Context, hashedToken string) (*Token, error) {
-	token, err := s.tokenRepo.GetTokenByHashedToken(ctx, hashedToken)
+	token, err := s.tokenRepo.GetTokenByHashedToken(ctx, hashedToken, time.Now())
 
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
@@ -71,8 +89,23 @@ func (s *TokenService) GetTokenByHashedToken(ctx context.Context, hashedToken st
 	return token, nil
 }
 
-// DeleteToken deletes a static token.
-func (s *TokenService) DeleteToken(ctx context.Context, tokenID bson.ObjectID) error {
+// GetToken retrieves a static token of the user.
+func (s *TokenService) GetToken(ctx context.Context, id bson.ObjectID, userID string) (*Token, error) {
+	token, err := s.tokenRepo.GetToken(ctx, id)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, fmt.Errorf("auth token not found")
+		}
+		return nil, fmt.Errorf("failed to retrieve auth token: %v", err)
+	}
+	if token.UserID != userID {
+		return nil, fmt.Errorf("auth token does not belong to user")
+	}
+	return token, nil
+}
+
+// DeleteToken deletes a static token of the user.
+func (s *TokenService) DeleteToken(ctx context.Context, tokenID bson.ObjectID, userID string) error {
 	// this is necessary to confirm token is deleted
 	// and to return the correct response to client
 	errorMsg := fmt.Errorf("error while deleting token %s", tokenID.Hex())
@@ -85,6 +118,9 @@ func (s *TokenService) DeleteToken(ctx context.Context, tokenID bson.ObjectID) e
 	}
 
 	if token != nil {
+		if token.UserID != userID {
+			return fmt.Errorf("auth token does not belong to user")
+		}
 		err := s.tokenRepo.DeleteToken(ctx, tokenID)
 		if err != nil {
 			return errorMsg
@@ -97,6 +133,33 @@ func (s *TokenService) DeleteToken(ctx context.Context, tokenID bson.ObjectID) e
 	return nil
 }
 
+// hintLength is the number of trailing characters of a secret kept as its hint.
+const hintLength = 4
+
+// SecretHint returns the last characters of the secret, which tell tokens apart without revealing them.
+func SecretHint(secret string) string {
+	if len(secret) <= hintLength {
+		return ""
+	}
+	return secret[len(secret)-hintLength:]
+}
+
+// Redacted returns a copy of the token without its secret and hashes. Secrets are only sent when a token
+// is created or rotated.
+func (t *Token) Redacted() *Token {
+	redacted := *t
+	redacted.Token = ""
+	redacted.HashedToken = ""
+	redacted.PreviousHashedToken = ""
+	return &redacted
+}
+
+// RevokeAgentTokens expires the static tokens bound to the agent, e.g. when it is decommissioned, and
+// returns how many were expired. They are kept, so their use stays traceable.
+func (s *TokenService) RevokeAgentTokens(ctx context.Context, agentID string) (int64, error) {
+	return s.tokenRepo.ExpireAgentTokens(ctx, agentID, time.Now())
+}
+
 // GetAllTokens gets all static tokens by a user.
 func (s *TokenService) GetAllTokens(context context.Context, userID string) ([]*Token, error) {
 	tokens, err := s.tokenRepo.GetTokensByUser(context, userID)
@@ -119,11 +182,15 @@ func (s *TokenService) GetAllTokens(context context.Context, userID string) ([]*
 }
 
 // CreateRefreshToken creates a refresh token.
-func (s *RefreshTokenService) CreateRefreshToken(ctx context.Context, token RefreshToken, encryptionKey string) (*RefreshToken, error) {
+func (s *RefreshTokenService) CreateRefreshToken(ctx context.Context, token RefreshToken, envelope *Envelope) (*RefreshToken, error) {
 	// Hash the token
 	hashedToken := HashToken(token.Token)
 
-	encryptedToken, err := Encrypt(token.Token, encryptionKey)
+	// The ID is part of the additional data of the encrypted token
+	if token.ID.IsZero() {
+		token.ID = bson.NewObjectID()
+	}
+	encryptedToken, err := envelope.Encrypt(token.Token, refreshTokenAAD(token.ID))
 	if err != nil {
 		return nil, err
 	}
@@ -132,7 +199,10 @@ func (s *RefreshTokenService) CreateRefreshToken(ctx context.Context, token Refr
 	token.Token = encryptedToken
 	token.HashedToken = hashedToken
 	token.CreatedAt = time.Now()
-	token.ExpiresAt = time.Now().AddDate(0, 0, 7) // 7 days expiry
+	token.ExpiresAt = token.CreatedAt.Add(RefreshTokenLifetime)
+	if token.FamilyID == "" {
+		token.FamilyID = bson.NewObjectID().Hex() // a login starts a new family
+	}
 
 	log.Printf("Created refresh token for user %s using user agent %s from %s", token.UserID, token.UserAgent, token.IPAddress)
 
@@ -141,11 +211,11 @@ func (s *RefreshTokenService) CreateRefreshToken(ctx context.Context, token Refr
 
 // UpdateRefreshToken updates a refresh token
 // NOT TO BE USED by http handlers, only for testing.
-func (s *RefreshTokenService) UpdateRefreshToken(ctx context.Context, token RefreshToken, encryptionKey string) error {
+func (s *RefreshTokenService) UpdateRefreshToken(ctx context.Context, token RefreshToken, envelope *Envelope) error {
 	// Hash the token
 	hashedToken := HashToken(token.Token)
 
-	encryptedToken, err := Encrypt(token.Token, encryptionKey)
+	encryptedToken, err := envelope.Encrypt(token.Token, refreshTokenAAD(token.ID))
 	if err != nil {
 		return err
 	}
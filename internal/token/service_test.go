@@ -43,6 +43,7 @@ func setupTestDB(t *testing.T) (*mongo.Client, func()) {
 func TestTokenService(t *testing.T) {
 	client, cleanup := setupTestDB(t)
 	defer cleanup()
+	envelope := newTestEnvelope(t)
 
 	repo := NewTokenRepository(client.Database(testDBName))
 	service := NewTokenService(repo)
@@ -53,7 +54,7 @@ func TestTokenService(t *testing.T) {
 			Token:  GenerateRandomString(10),
 		}
 
-		result, err := service.CreateToken(context.Background(), token, encryptionKey)
+		result, err := service.CreateToken(context.Background(), token, envelope)
 		assert.NoError(t, err)
 		assert.NotNil(t, result)
 
@@ -71,7 +72,7 @@ func TestTokenService(t *testing.T) {
 			Token:  GenerateRandomString(10),
 		}
 
-		_, err := service.CreateToken(context.Background(), token, encryptionKey)
+		_, err := service.CreateToken(context.Background(), token, envelope)
 		assert.NoError(t, err)
 
 		// Find tokens by userID
@@ -95,11 +96,15 @@ func TestTokenService(t *testing.T) {
 			Token:  GenerateRandomString(10),
 		}
 
-		result, err := service.CreateToken(context.Background(), token, encryptionKey)
+		result, err := service.CreateToken(context.Background(), token, envelope)
 		assert.NoError(t, err)
 
 		// Delete tokens by hashedToken
-		err = service.DeleteToken(context.Background(), result.ID)
+		// Tokens of other users are left alone
+		err = service.DeleteToken(context.Background(), result.ID, "other-user")
+		assert.EqualError(t, err, "auth token does not belong to user")
+
+		err = service.DeleteToken(context.Background(), result.ID, token.UserID)
 		assert.NoError(t, err)
 
 		// Try to find a non-existent token
@@ -115,11 +120,11 @@ func TestTokenService(t *testing.T) {
 			Token:  GenerateRandomString(10),
 		}
 
-		_, err := service.CreateToken(context.Background(), token, encryptionKey)
+		_, err := service.CreateToken(context.Background(), token, envelope)
 		assert.NoError(t, err)
 
 		// Delete tokens by hashedToken
-		err = service.DeleteToken(context.Background(), bson.NewObjectID())
+		err = service.DeleteToken(context.Background(), bson.NewObjectID(), token.UserID)
 		assert.Error(t, err)
 	})
 }
@@ -127,6 +132,7 @@ func TestTokenService(t *testing.T) {
 func TestRefreshTokenService(t *testing.T) {
 	client, cleanup := setupTestDB(t)
 	defer cleanup()
+	envelope := newTestEnvelope(t)
 
 	repo := NewRefreshTokenRepository(client.Database(testDBName))
 	service := NewRefreshTokenService(repo)
@@ -139,7 +145,7 @@ func TestRefreshTokenService(t *testing.T) {
 			IPAddress: "1.1.1.1",
 		}
 
-		result, err := service.CreateRefreshToken(context.Background(), token, encryptionKey)
+		result, err := service.CreateRefreshToken(context.Background(), token, envelope)
 		assert.NoError(t, err)
 		assert.NotNil(t, result)
 
@@ -159,7 +165,7 @@ func TestRefreshTokenService(t *testing.T) {
 			IPAddress: "1.1.1.1",
 		}
 
-		_, err := service.CreateRefreshToken(context.Background(), token, encryptionKey)
+		_, err := service.CreateRefreshToken(context.Background(), token, envelope)
 		assert.NoError(t, err)
 
 		// Find the refresh tokens by userID
@@ -185,7 +191,7 @@ func TestRefreshTokenService(t *testing.T) {
 			IPAddress: "1.1.1.1",
 		}
 
-		result, err := service.CreateRefreshToken(context.Background(), token, encryptionKey)
+		result, err := service.CreateRefreshToken(context.Background(), token, envelope)
 		assert.NoError(t, err)
 
 		// Delete tokens by hashedToken
@@ -217,7 +223,7 @@ func TestRefreshTokenService(t *testing.T) {
 		}
 
 		for _, token := range tokens {
-			_, err := service.CreateRefreshToken(context.Background(), token, encryptionKey)
+			_, err := service.CreateRefreshToken(context.Background(), token, envelope)
 			assert.NoError(t, err)
 		}
 
@@ -236,3 +242,85 @@ func TestRefreshTokenService(t *testing.T) {
 		assert.NotNil(t, otherUserTokens)
 	})
 }
+
+func TestRotateRefreshToken(t *testing.T) {
+	client, cleanup := setupTestDB(t)
+	defer cleanup()
+	envelope := newTestEnvelope(t)
+
+	repo := NewRefreshTokenRepository(client.Database(testDBName))
+	service := NewRefreshTokenService(repo)
+	ctx := context.Background()
+	keys := NewKeyring(nil, DefaultKeyringConfig(), nil, "")
+	assert.NoError(t, keys.Load(ctx))
+
+	login := func(t *testing.T, userID string) string {
+		refreshToken, err := keys.GenerateJWT(userID, RefreshTokenLifetime, "refresh")
+		assert.NoError(t, err)
+		_, err = service.CreateRefreshToken(ctx, RefreshToken{UserID: userID, Token: refreshToken}, envelope)
+		assert.NoError(t, err)
+		return refreshToken
+	}
+
+	t.Run("Rotation", func(t *testing.T) {
+		first := login(t, GenerateRandomString(6))
+
+		second, created, err := service.RotateRefreshToken(ctx, first, keys, "tests/nannyapi", "1.1.1.1", envelope)
+		assert.NoError(t, err)
+		assert.NotEqual(t, first, second)
+		assert.Equal(t, "1.1.1.1", created.IPAddress)
+
+		retired, err := repo.GetRefreshToken(ctx, HashToken(first))
+		assert.NoError(t, err)
+		assert.NotNil(t, retired.RotatedAt)
+		assert.Equal(t, retired.FamilyID, created.FamilyID)
+
+		third, _, err := service.RotateRefreshToken(ctx, second, keys, "tests/nannyapi", "1.1.1.1", envelope)
+		assert.NoError(t, err)
+		assert.NotEqual(t, second, third)
+	})
+
+	t.Run("ReuseRevokesFamily", func(t *testing.T) {
+		first := login(t, GenerateRandomString(6))
+		second, _, err := service.RotateRefreshToken(ctx, first, keys, "tests/nannyapi", "1.1.1.1", envelope)
+		assert.NoError(t, err)
+
+		_, _, err = service.RotateRefreshToken(ctx, first, keys, "attacker", "6.6.6.6", envelope)
+		assert.EqualError(t, err, "refresh token reuse detected")
+
+		_, _, err = service.RotateRefreshToken(ctx, second, keys, "tests/nannyapi", "1.1.1.1", envelope)
+		assert.EqualError(t, err, "refresh token revoked")
+		revoked, err := repo.GetRefreshToken(ctx, HashToken(second))
+		assert.NoError(t, err)
+		assert.Equal(t, RevokedReuse, revoked.RevokedReason)
+	})
+
+	t.Run("OtherFamiliesUntouched", func(t *testing.T) {
+		userID := GenerateRandomString(6)
+		stolen := login(t, userID)
+		other := login(t, userID)
+		_, _, err := service.RotateRefreshToken(ctx, stolen, keys, "tests/nannyapi", "1.1.1.1", envelope)
+		assert.NoError(t, err)
+		_, _, err = service.RotateRefreshToken(ctx, stolen, keys, "attacker", "6.6.6.6", envelope)
+		assert.Error(t, err)
+
+		_, err = service.CheckRefreshToken(ctx, other, keys, "tests/nannyapi", "1.1.1.1")
+		assert.NoError(t, err)
+	})
+
+	t.Run("RevokeRefreshToken", func(t *testing.T) {
+		refreshToken := login(t, GenerateRandomString(6))
+		assert.NoError(t, service.RevokeRefreshToken(ctx, refreshToken, RevokedReplaced))
+
+		_, err := service.CheckRefreshToken(ctx, refreshToken, keys, "tests/nannyapi", "1.1.1.1")
+		assert.EqualError(t, err, "refresh token revoked")
+		assert.NoError(t, service.RevokeRefreshToken(ctx, "unknown-token", RevokedReplaced))
+	})
+
+	t.Run("UnknownToken", func(t *testing.T) {
+		refreshToken, err := keys.GenerateJWT(GenerateRandomString(6), RefreshTokenLifetime, "refresh")
+		assert.NoError(t, err)
+		_, err = service.CheckRefreshToken(ctx, refreshToken, keys, "tests/nannyapi", "1.1.1.1")
+		assert.EqualError(t, err, "refresh token not found")
+	})
+}
@@ -0,0 +1,183 @@
+package token
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// Reasons recorded on refresh tokens revoked by their user.
+const (
+	RevokedLogout    = "logout"     // The user logged out of the session
+	RevokedSignedOut = "signed_out" // The user signed the session out from another one
+)
+
+// Session is a login of a user on a device: the family of refresh tokens rotated from it.
+type Session struct {
+	ID         string    `json:"id"`     // The token family
+	Device     string    `json:"device"` // Browser and operating system read from the user agent
+	UserAgent  string    `json:"user_agent,omitempty"`
+	IPAddress  string    `json:"ip_address,omitempty"` // Address of the last refresh
+	CreatedAt  time.Time `json:"created_at"`           // When the user logged in
+	LastUsedAt time.Time `json:"last_used_at"`         // When the refresh token was last issued or exchanged
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"` // Whether the request was made from this session
+}
+
+// sessionsFromTokens groups refresh tokens into the sessions that can still be refreshed, most recently
+// used first. A session is active while its newest token is neither revoked, exchanged nor expired.
+func sessionsFromTokens(tokens []*RefreshToken, currentFamily string, now time.Time) []*Session {
+	families := map[string][]*RefreshToken{}
+	for _, t := range tokens {
+		families[t.Family()] = append(families[t.Family()], t)
+	}
+
+	sessions := []*Session{}
+	for family, members := range families {
+		sort.Slice(members, func(i, j int) bool { return members[i].CreatedAt.Before(members[j].CreatedAt) })
+		first, latest := members[0], members[len(members)-1]
+		if latest.Revoked || latest.RotatedAt != nil || !now.Before(latest.ExpiresAt) {
+			continue
+		}
+		sessions = append(sessions, &Session{
+			ID:         family,
+			Device:     describeDevice(latest.UserAgent),
+			UserAgent:  latest.UserAgent,
+			IPAddress:  latest.IPAddress,
+			CreatedAt:  first.CreatedAt,
+			LastUsedAt: latest.CreatedAt,
+			ExpiresAt:  latest.ExpiresAt,
+			Current:    family == currentFamily,
+		})
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt) })
+	return sessions
+}
+
+// describeDevice returns a short description of the browser and operating system of a user agent, such
+// as "Firefox on macOS".
+func describeDevice(userAgent string) string {
+	var browser, os string
+	switch {
+	case strings.Contains(userAgent, "Edg/"):
+		browser = "Edge"
+	case strings.Contains(userAgent, "OPR/"):
+		browser = "Opera"
+	case strings.Contains(userAgent, "Firefox/"):
+		browser = "Firefox"
+	case strings.Contains(userAgent, "Chrome/"):
+		browser = "Chrome"
+	case strings.Contains(userAgent, "Safari/"):
+		browser = "Safari"
+	case strings.HasPrefix(userAgent, "curl/"):
+		browser = "curl"
+	}
+	switch {
+	case strings.Contains(userAgent, "Android"):
+		os = "Android"
+	case strings.Contains(userAgent, "iPhone"), strings.Contains(userAgent, "iPad"):
+		os = "iOS"
+	case strings.Contains(userAgent, "Windows"):
+		os = "Windows"
+	case strings.Contains(userAgent, "Mac OS X"):
+		os = "macOS"
+	case strings.Contains(userAgent, "Linux"):
+		os = "Linux"
+	}
+	switch {
+	case browser != "" && os != "":
+		return browser + " on " + os
+	case browser != "":
+		return browser
+	case os != "":
+		return os
+	default:
+		return "Unknown device"
+	}
+}
+
+// currentFamily returns the family of the refresh token the request was made with, if it is known.
+func (s *RefreshTokenService) currentFamily(ctx context.Context, refreshToken string) string {
+	if refreshToken == "" {
+		return ""
+	}
+	t, err := s.refreshTokenRepo.GetRefreshToken(ctx, HashToken(refreshToken))
+	if err != nil {
+		return ""
+	}
+	return t.Family()
+}
+
+// ListSessions returns the active sessions of a user. The session of the refresh token, if any, is marked
+// as the current one.
+func (s *RefreshTokenService) ListSessions(ctx context.Context, userID, refreshToken string) ([]*Session, error) {
+	tokens, err := s.refreshTokenRepo.GetRefreshTokensByUser(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve refresh tokens: %v", err)
+	}
+	return sessionsFromTokens(tokens, s.currentFamily(ctx, refreshToken), time.Now()), nil
+}
+
+// RevokeSession signs a session of the user out. Its refresh token stops working at once; access tokens
+// already issued to it expire on their own.
+func (s *RefreshTokenService) RevokeSession(ctx context.Context, userID, sessionID string) error {
+	sessions, err := s.ListSessions(ctx, userID, "")
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		if session.ID == sessionID {
+			return s.revokeSession(ctx, userID, session.ID, RevokedSignedOut)
+		}
+	}
+	return fmt.Errorf("session not found")
+}
+
+// RevokeOtherSessions signs out every session of the user except the one of the refresh token. It returns
+// how many sessions were signed out, and an error without signing out any when the refresh token is not
+// one of an active session of the user.
+func (s *RefreshTokenService) RevokeOtherSessions(ctx context.Context, userID, refreshToken string) (int, error) {
+	sessions, err := s.ListSessions(ctx, userID, refreshToken)
+	if err != nil {
+		return 0, err
+	}
+	current := false
+	for _, session := range sessions {
+		current = current || session.Current
+	}
+	if !current {
+		return 0, fmt.Errorf("invalid session: the current session could not be identified")
+	}
+	revoked := 0
+	for _, session := range sessions {
+		if session.Current {
+			continue
+		}
+		if err := s.revokeSession(ctx, userID, session.ID, RevokedSignedOut); err != nil {
+			return revoked, err
+		}
+		revoked++
+	}
+	return revoked, nil
+}
+
+// Logout revokes the session of a refresh token.
+func (s *RefreshTokenService) Logout(ctx context.Context, refreshToken string) error {
+	return s.RevokeRefreshToken(ctx, refreshToken, RevokedLogout)
+}
+
+func (s *RefreshTokenService) revokeSession(ctx context.Context, userID, family, reason string) error {
+	// Sessions of tokens created before families were added are named after the ID of their first token
+	tokenID, _ := bson.ObjectIDFromHex(family)
+	revoked, err := s.refreshTokenRepo.RevokeRefreshTokenFamily(ctx, family, tokenID, reason, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to revoke session %s: %v", family, err)
+	}
+	log.Printf("Revoked %d refresh tokens of user %s in family %s: %s", revoked, userID, family, reason)
+	return nil
+}
@@ -0,0 +1,58 @@
+package token
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestSessionsFromTokens(t *testing.T) {
+	now := time.Now()
+	rotatedAt := now.Add(-time.Hour)
+	legacyID := bson.NewObjectID()
+	tokens := []*RefreshToken{
+		// Rotated once, the laptop session
+		{FamilyID: "laptop", UserAgent: "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) Gecko/20100101 Firefox/89.0", IPAddress: "10.0.0.1", CreatedAt: now.Add(-48 * time.Hour), ExpiresAt: now.Add(72 * time.Hour), RotatedAt: &rotatedAt},
+		{FamilyID: "laptop", UserAgent: "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) Gecko/20100101 Firefox/89.0", IPAddress: "10.0.0.2", CreatedAt: now.Add(-time.Hour), ExpiresAt: now.Add(time.Hour)},
+		// Created before families were added
+		{ID: legacyID, UserAgent: "curl/8.5.0", CreatedAt: now.Add(-2 * time.Hour), ExpiresAt: now.Add(time.Hour)},
+		// Signed out, expired and reused sessions are not listed
+		{FamilyID: "revoked", CreatedAt: now.Add(-time.Hour), ExpiresAt: now.Add(time.Hour), Revoked: true},
+		{FamilyID: "expired", CreatedAt: now.Add(-8 * 24 * time.Hour), ExpiresAt: now.Add(-24 * time.Hour)},
+		{FamilyID: "retired", CreatedAt: now.Add(-time.Hour), ExpiresAt: now.Add(time.Hour), RotatedAt: &rotatedAt},
+	}
+
+	sessions := sessionsFromTokens(tokens, "laptop", now)
+	assert.Len(t, sessions, 2)
+
+	assert.Equal(t, "laptop", sessions[0].ID)
+	assert.True(t, sessions[0].Current)
+	assert.Equal(t, "Firefox on macOS", sessions[0].Device)
+	assert.Equal(t, "10.0.0.2", sessions[0].IPAddress)
+	assert.Equal(t, now.Add(-48*time.Hour), sessions[0].CreatedAt)
+	assert.Equal(t, now.Add(-time.Hour), sessions[0].LastUsedAt)
+
+	assert.Equal(t, legacyID.Hex(), sessions[1].ID)
+	assert.False(t, sessions[1].Current)
+	assert.Equal(t, "curl", sessions[1].Device)
+
+	assert.Empty(t, sessionsFromTokens(nil, "", now))
+}
+
+func TestDescribeDevice(t *testing.T) {
+	tests := map[string]string{
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36":                       "Chrome on Windows",
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36 Edg/91.0.864.59":       "Edge on Windows",
+		"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/14.0 Safari/605.1.15":                     "Safari on macOS",
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 14_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/14.0.3 Mobile/15E148 Safari/604.1": "Safari on iOS",
+		"Mozilla/5.0 (Linux; Android 10; SM-A205U) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/90.0.4430.210 Mobile Safari/537.36":                "Chrome on Android",
+		"Mozilla/5.0 (X11; Linux x86_64; rv:89.0) Gecko/20100101 Firefox/89.0":                                                                      "Firefox on Linux",
+		"nannyagent/1.0": "Unknown device",
+		"":               "Unknown device",
+	}
+	for userAgent, expected := range tests {
+		assert.Equal(t, expected, describeDevice(userAgent), userAgent)
+	}
+}
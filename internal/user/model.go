@@ -13,6 +13,15 @@ type User struct {
 	AvatarURL    string        `json:"avatar_url" bson:"avatar_url"`
 	HTMLURL      string        `json:"html_url" bson:"html_url"`
 	LastLoggedIn time.Time     `json:"last_logged_in" bson:"last_logged_in"`
+	Identities   []Identity    `json:"identities,omitempty" bson:"identities,omitempty"` // OpenID Connect accounts linked to the user
+}
+
+// Identity is an account of the user at an OpenID Connect provider.
+type Identity struct {
+	Provider string    `json:"provider" bson:"provider"`
+	Subject  string    `json:"subject" bson:"subject"` // The sub claim, stable for the account at the provider
+	Email    string    `json:"email" bson:"email"`
+	LinkedAt time.Time `json:"linked_at" bson:"linked_at"`
 }
 
 type GitHubEmail struct {
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	"go.mongodb.org/mongo-driver/v2/bson"
@@ -21,10 +22,20 @@ func NewUserRepository(db *mongo.Database) *UserRepository {
 	}
 }
 
+// emailCollation compares email addresses case-insensitively, which also matches users stored before emails
+// were normalised.
+var emailCollation = &options.Collation{Locale: "en", Strength: 2}
+
+// NormalizeEmail returns the email address in the form users are stored and looked up with.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
 func (r *UserRepository) UpsertUser(ctx context.Context, user *User) (*mongo.UpdateResult, error) {
 	if user.ID.IsZero() {
 		user.ID = bson.NewObjectID()
 	}
+	user.Email = NormalizeEmail(user.Email)
 
 	filter := bson.M{"_id": user.ID}
 	update := bson.M{
@@ -49,9 +60,9 @@ func (r *UserRepository) UpsertUser(ctx context.Context, user *User) (*mongo.Upd
 }
 
 func (r *UserRepository) FindUserByEmail(ctx context.Context, email string) (*User, error) {
-	filter := bson.M{"email": email}
+	filter := bson.M{"email": NormalizeEmail(email)}
 	var user User
-	err := r.collection.FindOne(ctx, filter).Decode(&user)
+	err := r.collection.FindOne(ctx, filter, options.FindOne().SetCollation(emailCollation)).Decode(&user)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			return nil, nil // No user found
@@ -76,10 +87,10 @@ func (r *UserRepository) FindUserByID(ctx context.Context, userId bson.ObjectID)
 
 // GetUserByEmail retrieves a user by their email address.
 func (r *UserRepository) GetUserByEmail(ctx context.Context, email string) (*User, error) {
-	filter := bson.M{"email": email}
+	filter := bson.M{"email": NormalizeEmail(email)}
 
 	var user User
-	err := r.collection.FindOne(ctx, filter).Decode(&user)
+	err := r.collection.FindOne(ctx, filter, options.FindOne().SetCollation(emailCollation)).Decode(&user)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			return nil, mongo.ErrNoDocuments
@@ -90,9 +101,60 @@ func (r *UserRepository) GetUserByEmail(ctx context.Context, email string) (*Use
 	return &user, nil
 }
 
+// FindUserByIdentity returns the user linked to the account at the provider, or nil if there is none.
+func (r *UserRepository) FindUserByIdentity(ctx context.Context, provider, subject string) (*User, error) {
+	filter := bson.M{"identities": bson.M{"$elemMatch": bson.M{"provider": provider, "subject": subject}}}
+	var user User
+	err := r.collection.FindOne(ctx, filter).Decode(&user)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to find user: %w", err)
+	}
+	return &user, nil
+}
+
+// RecordLogin updates the profile and login time of the user and links the identity, unless an identity
+// of the same provider and subject is already linked.
+func (r *UserRepository) RecordLogin(ctx context.Context, id bson.ObjectID, profile *User, identity Identity) error {
+	set := bson.M{"last_logged_in": profile.LastLoggedIn}
+	if profile.Name != "" {
+		set["name"] = profile.Name
+	}
+	if profile.AvatarURL != "" {
+		set["avatar_url"] = profile.AvatarURL
+	}
+	if _, err := r.collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": set}); err != nil {
+		return fmt.Errorf("failed to update user: %w", err)
+	}
+
+	filter := bson.M{"_id": id, "identities": bson.M{"$not": bson.M{"$elemMatch": bson.M{"provider": identity.Provider, "subject": identity.Subject}}}}
+	if _, err := r.collection.UpdateOne(ctx, filter, bson.M{"$push": bson.M{"identities": identity}}); err != nil {
+		return fmt.Errorf("failed to link identity: %w", err)
+	}
+	return nil
+}
+
+// ListUsers returns every user.
+func (r *UserRepository) ListUsers(ctx context.Context) ([]*User, error) {
+	cursor, err := r.collection.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var users []*User
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, fmt.Errorf("failed to decode users: %w", err)
+	}
+	return users, nil
+}
+
 // SHOULDN'T be used in this project as GitHub OAuth is used.
 func (r *UserRepository) CreateUser(ctx context.Context, user *User) (*mongo.InsertOneResult, error) {
 	user.LastLoggedIn = time.Now()
+	user.Email = NormalizeEmail(user.Email)
 
 	return r.collection.InsertOne(ctx, user)
 }
@@ -86,6 +86,25 @@ func TestUserRepository(t *testing.T) {
 		assert.Equal(t, "findme@example.com", foundUser.Email)
 	})
 
+	t.Run("EmailCase", func(t *testing.T) {
+		user := &User{Email: " Mixed.Case@Example.com", Name: "Mixed Case", LastLoggedIn: time.Now()}
+		_, err := repo.UpsertUser(context.Background(), user)
+		assert.NoError(t, err)
+		assert.Equal(t, "mixed.case@example.com", user.Email)
+
+		foundUser, err := repo.FindUserByEmail(context.Background(), "MIXED.case@example.com")
+		assert.NoError(t, err)
+		assert.NotNil(t, foundUser)
+		assert.Equal(t, user.ID, foundUser.ID)
+
+		// Users stored before emails were normalised are still found
+		_, err = repo.collection.InsertOne(context.Background(), bson.M{"email": "Legacy@Example.com", "name": "Legacy"})
+		assert.NoError(t, err)
+		foundUser, err = repo.GetUserByEmail(context.Background(), "legacy@example.com")
+		assert.NoError(t, err)
+		assert.Equal(t, "Legacy", foundUser.Name)
+	})
+
 	t.Run("UserNotFound", func(t *testing.T) {
 		// Try to find a non-existent user
 		user, err := repo.FindUserByEmail(context.Background(), "nonexistent@example.com")
@@ -179,3 +198,43 @@ func TestFindUser(t *testing.T) {
 	// 	assert.Contains(t, err.Error(), "context is nil")
 	// })
 }
+
+func TestLoginWithIdentity(t *testing.T) {
+	client, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	repo := NewUserRepository(client.Database(testDBName))
+	service := NewUserService(repo)
+	ctx := context.Background()
+
+	google := Identity{Provider: "google", Subject: "google-1", Email: "linked@example.com"}
+	created, err := service.LoginWithIdentity(ctx, google, User{Name: "Linked User"})
+	assert.NoError(t, err)
+	assert.Equal(t, "linked@example.com", created.Email)
+	assert.Len(t, created.Identities, 1)
+
+	t.Run("SameIdentity", func(t *testing.T) {
+		again, err := service.LoginWithIdentity(ctx, google, User{Name: "Renamed User"})
+		assert.NoError(t, err)
+		assert.Equal(t, created.ID, again.ID)
+		assert.Equal(t, "Renamed User", again.Name)
+		assert.Len(t, again.Identities, 1)
+	})
+
+	t.Run("SameEmailOtherProvider", func(t *testing.T) {
+		gitlab := Identity{Provider: "gitlab", Subject: "gitlab-1", Email: "linked@example.com"}
+		linked, err := service.LoginWithIdentity(ctx, gitlab, User{Name: "Linked User"})
+		assert.NoError(t, err)
+		assert.Equal(t, created.ID, linked.ID)
+		assert.Len(t, linked.Identities, 2)
+
+		found, err := repo.FindUserByIdentity(ctx, "gitlab", "gitlab-1")
+		assert.NoError(t, err)
+		assert.Equal(t, created.ID, found.ID)
+	})
+
+	t.Run("InvalidIdentity", func(t *testing.T) {
+		_, err := service.LoginWithIdentity(ctx, Identity{Provider: "google"}, User{})
+		assert.ErrorContains(t, err, "invalid identity")
+	})
+}
@@ -80,6 +80,51 @@ func (s *UserService) GetUserByID(ctx context.Context, id bson.ObjectID) (*User,
 	return user, nil
 }
 
+// ListUsers returns every user.
+func (s *UserService) ListUsers(ctx context.Context) ([]*User, error) {
+	return s.userRepo.ListUsers(ctx)
+}
+
+// LoginWithIdentity returns the user of an OpenID Connect login, creating it on first login. The account
+// at the provider is matched first; otherwise the login is linked to the user with the same email, which the
+// caller must have checked is verified by the provider.
+func (s *UserService) LoginWithIdentity(ctx context.Context, identity Identity, profile User) (*User, error) {
+	if identity.Provider == "" || identity.Subject == "" || identity.Email == "" {
+		return nil, fmt.Errorf("invalid identity: provider, subject and email are required")
+	}
+	now := time.Now()
+	identity.LinkedAt = now
+	profile.LastLoggedIn = now
+
+	existing, err := s.userRepo.FindUserByIdentity(ctx, identity.Provider, identity.Subject)
+	if err != nil {
+		return nil, err
+	}
+	if existing == nil {
+		existing, err = s.userRepo.FindUserByEmail(ctx, identity.Email)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find user: %w", err)
+		}
+	}
+
+	if existing == nil {
+		profile.ID = bson.NewObjectID()
+		profile.Email = identity.Email
+		profile.Identities = []Identity{identity}
+		if _, err := s.userRepo.UpsertUser(ctx, &profile); err != nil {
+			return nil, fmt.Errorf("failed to create user: %w", err)
+		}
+		log.Printf("Created user %s from %s login", profile.ID.Hex(), identity.Provider)
+		return &profile, nil
+	}
+
+	if err := s.userRepo.RecordLogin(ctx, existing.ID, &profile, identity); err != nil {
+		return nil, err
+	}
+	log.Printf("User %s logged in with %s", existing.ID.Hex(), identity.Provider)
+	return s.userRepo.FindUserByID(ctx, existing.ID)
+}
+
 func (s *UserService) CreateUser(ctx context.Context, user User) (*mongo.InsertOneResult, error) {
 	insertInfo, err := s.userRepo.CreateUser(ctx, &user)
 	if err != nil {
@@ -0,0 +1,48 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// NonceRepository records nonces that may be used once, in a collection shared by every API instance.
+// Nonces are stored as document IDs, so each can be inserted once, and a TTL index deletes them after they
+// expire, when whatever carried them is rejected anyway.
+type NonceRepository struct {
+	collection *mongo.Collection
+}
+
+func NewNonceRepository(db *mongo.Database, collection string) *NonceRepository {
+	return &NonceRepository{
+		collection: db.Collection(collection),
+	}
+}
+
+// EnsureIndexes creates the TTL index that deletes expired nonces.
+func (r *NonceRepository) EnsureIndexes(ctx context.Context) error {
+	index := mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	}
+	if _, err := r.collection.Indexes().CreateOne(ctx, index); err != nil {
+		return fmt.Errorf("failed to create nonce index: %v", err)
+	}
+	return nil
+}
+
+// UseNonce records the nonce until it expires and reports false when it was already used.
+func (r *NonceRepository) UseNonce(ctx context.Context, nonce string, expiresAt time.Time) (bool, error) {
+	_, err := r.collection.InsertOne(ctx, bson.M{"_id": nonce, "expires_at": expiresAt})
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to record nonce: %v", err)
+	}
+	return true, nil
+}
@@ -0,0 +1,40 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNonceRepository(t *testing.T) {
+	db, err := InitDB()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	ctx := context.Background()
+	repo := NewNonceRepository(db, "test_nonces")
+	defer func() {
+		if err := repo.collection.Drop(ctx); err != nil {
+			t.Fatalf("Failed to drop test collection: %v", err)
+		}
+	}()
+
+	assert.NoError(t, repo.EnsureIndexes(ctx))
+	// Creating the index again is a no-op
+	assert.NoError(t, repo.EnsureIndexes(ctx))
+
+	expiresAt := time.Now().Add(time.Minute)
+	used, err := repo.UseNonce(ctx, "nonce", expiresAt)
+	assert.NoError(t, err)
+	assert.True(t, used)
+
+	used, err = repo.UseNonce(ctx, "nonce", expiresAt)
+	assert.NoError(t, err)
+	assert.False(t, used)
+
+	used, err = repo.UseNonce(ctx, "other-nonce", expiresAt)
+	assert.NoError(t, err)
+	assert.True(t, used)
+}